@@ -66,7 +66,7 @@ Check the Elastic Security API documentation for details.`,
 
 func createApikeyCmd(settings instance.Settings) *cobra.Command {
 	var keyName, expiration string
-	var ingest, sourcemap, agentConfig, json bool
+	var ingest, sourcemap, agentConfig, aggregationFlush, json bool
 	short := "Create an API Key with the specified privilege(s)"
 	create := &cobra.Command{
 		Use:   "create",
@@ -74,7 +74,7 @@ func createApikeyCmd(settings instance.Settings) *cobra.Command {
 		Long: short + `.
 If no privilege(s) are specified, the API Key will be valid for all.`,
 		Run: makeAPIKeyRun(settings, &json, func(client es.Client, config *config.Config, args []string) error {
-			privileges := booleansToPrivileges(ingest, sourcemap, agentConfig)
+			privileges := booleansToPrivileges(ingest, sourcemap, agentConfig, aggregationFlush)
 			if len(privileges) == 0 {
 				// No privileges specified, grant all.
 				privileges = auth.AllPrivilegeActions()
@@ -93,6 +93,9 @@ If no privilege(s) are specified, the API Key will be valid for all.`,
 	create.Flags().BoolVar(&agentConfig, "agent-config", false,
 		fmt.Sprintf("give the %v privilege to this key, required for agents to read configuration remotely",
 			auth.PrivilegeAgentConfigRead))
+	create.Flags().BoolVar(&aggregationFlush, "aggregation-flush", false,
+		fmt.Sprintf("give the %v privilege to this key, required for forcing aggregated metrics to be published",
+			auth.PrivilegeAggregationFlush))
 	create.Flags().BoolVar(&json, "json", false,
 		"prints the output of this command as JSON")
 	// this actually means "preserve sorting given in code" and not reorder them alphabetically
@@ -158,7 +161,7 @@ If neither of them are, an error will be returned.`,
 
 func verifyApikeyCmd(settings instance.Settings) *cobra.Command {
 	var credentials string
-	var ingest, sourcemap, agentConfig, json bool
+	var ingest, sourcemap, agentConfig, aggregationFlush, json bool
 	short := `Check if a "credentials" string has the given privilege(s)`
 	long := short + `.
 If no privilege(s) are specified, the credentials will be queried for all.`
@@ -167,7 +170,7 @@ If no privilege(s) are specified, the credentials will be queried for all.`
 		Short: short,
 		Long:  long,
 		Run: makeAPIKeyRun(settings, &json, func(client es.Client, config *config.Config, args []string) error {
-			privileges := booleansToPrivileges(ingest, sourcemap, agentConfig)
+			privileges := booleansToPrivileges(ingest, sourcemap, agentConfig, aggregationFlush)
 			if len(privileges) == 0 {
 				privileges = auth.AllPrivilegeActions()
 			}
@@ -183,6 +186,9 @@ If no privilege(s) are specified, the credentials will be queried for all.`
 	verify.Flags().BoolVar(&agentConfig, "agent-config", false,
 		fmt.Sprintf("ask for the %v privilege, required for agents to read configuration remotely",
 			auth.PrivilegeAgentConfigRead))
+	verify.Flags().BoolVar(&aggregationFlush, "aggregation-flush", false,
+		fmt.Sprintf("ask for the %v privilege, required for forcing aggregated metrics to be published",
+			auth.PrivilegeAggregationFlush))
 	verify.Flags().BoolVar(&json, "json", false,
 		"prints the output of this command as JSON")
 	verify.MarkFlagRequired("credentials")
@@ -252,7 +258,7 @@ func bootstrap(settings instance.Settings) (es.Client, *config.Config, error) {
 	return client, beaterConfig, nil
 }
 
-func booleansToPrivileges(ingest, sourcemap, agentConfig bool) []es.PrivilegeAction {
+func booleansToPrivileges(ingest, sourcemap, agentConfig, aggregationFlush bool) []es.PrivilegeAction {
 	privileges := make([]es.PrivilegeAction, 0)
 	if ingest {
 		privileges = append(privileges, auth.PrivilegeEventWrite.Action)
@@ -263,6 +269,9 @@ func booleansToPrivileges(ingest, sourcemap, agentConfig bool) []es.PrivilegeAct
 	if agentConfig {
 		privileges = append(privileges, auth.PrivilegeAgentConfigRead.Action)
 	}
+	if aggregationFlush {
+		privileges = append(privileges, auth.PrivilegeAggregationFlush.Action)
+	}
 	return privileges
 }
 
@@ -433,6 +442,8 @@ func verifyAPIKey(config *config.Config, privileges []es.PrivilegeAction, creden
 			action = auth.ActionEventIngest
 		case auth.PrivilegeSourcemapWrite.Action:
 			action = auth.ActionSourcemapUpload
+		case auth.PrivilegeAggregationFlush.Action:
+			action = auth.ActionAggregationFlush
 		}
 
 		authorized := true
@@ -0,0 +1,79 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package flush
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/internal/beater/auth"
+	"github.com/elastic/apm-server/internal/beater/request"
+)
+
+var (
+	// MonitoringMap holds a mapping for request.IDs to monitoring counters
+	MonitoringMap = request.DefaultMonitoringMapForRegistry(registry)
+	registry      = monitoring.Default.NewRegistry("apm-server.flush")
+)
+
+// FlushFunc forces aggregated metrics to be published immediately,
+// returning the number of groups published.
+type FlushFunc func(context.Context) (int, error)
+
+// Handler returns a request.Handler which calls flush for POST requests,
+// and responds with the number of groups published.
+//
+// Requests must be authorized for auth.ActionAggregationFlush, which
+// anonymous requests and API Keys without the aggregation:flush privilege
+// are not. Methods other than POST are not allowed.
+func Handler(flush FlushFunc) request.Handler {
+	return func(c *request.Context) {
+		if c.Request.Method != http.MethodPost {
+			c.Result.Set(request.IDResponseErrorsMethodNotAllowed,
+				http.StatusMethodNotAllowed,
+				"only POST requests are supported",
+				nil, nil,
+			)
+			c.WriteResult()
+			return
+		}
+		if err := auth.Authorize(c.Request.Context(), auth.ActionAggregationFlush, auth.Resource{}); err != nil {
+			if errors.Is(err, auth.ErrUnauthorized) {
+				id := request.IDResponseErrorsForbidden
+				status := request.MapResultIDToStatus[id]
+				c.Result.Set(id, status.Code, err.Error(), nil, nil)
+			} else {
+				c.Result.SetDefault(request.IDResponseErrorsServiceUnavailable)
+				c.Result.Err = err
+			}
+			c.WriteResult()
+			return
+		}
+		groups, err := flush(c.Request.Context())
+		if err != nil {
+			c.Result.SetWithError(request.IDResponseErrorsInternal, err)
+			c.WriteResult()
+			return
+		}
+		c.Result.SetWithBody(request.IDResponseValidOK, map[string]int{"groups": groups})
+		c.WriteResult()
+	}
+}
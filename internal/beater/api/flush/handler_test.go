@@ -0,0 +1,109 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package flush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/internal/beater/auth"
+	"github.com/elastic/apm-server/internal/beater/request"
+)
+
+func TestFlushHandler(t *testing.T) {
+	var flushed int
+	flush := func(context.Context) (int, error) {
+		flushed++
+		return 123, nil
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		c, w := flushTestContext(http.MethodPost)
+		Handler(flush)(c)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "{\"groups\":123}\n", w.Body.String())
+		assert.Equal(t, 1, flushed)
+	})
+
+	t.Run("method_not_allowed", func(t *testing.T) {
+		c, w := flushTestContext(http.MethodGet)
+		Handler(flush)(c)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		assert.Equal(t, 1, flushed)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		c, w := flushTestContext(http.MethodPost)
+		c.Request = c.Request.WithContext(auth.ContextWithAuthorizer(c.Request.Context(), authorizerFunc(
+			func(ctx context.Context, action auth.Action, _ auth.Resource) error {
+				assert.Equal(t, auth.ActionAggregationFlush, action)
+				return fmt.Errorf("%w: denied", auth.ErrUnauthorized)
+			},
+		)))
+		Handler(flush)(c)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, "{\"error\":\"unauthorized: denied\"}\n", w.Body.String())
+		assert.Equal(t, 1, flushed)
+	})
+
+	t.Run("authorizer_error", func(t *testing.T) {
+		c, w := flushTestContext(http.MethodPost)
+		c.Request = c.Request.WithContext(context.Background())
+		Handler(flush)(c)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, 1, flushed)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		c, w := flushTestContext(http.MethodPost)
+		Handler(func(context.Context) (int, error) {
+			return 0, errors.New("boom")
+		})(c)
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "{\"error\":\"internal error: boom\"}\n", w.Body.String())
+	})
+}
+
+func flushTestContext(method string) (*request.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c := request.NewContext()
+	r := httptest.NewRequest(method, "/", nil)
+	r = r.WithContext(auth.ContextWithAuthorizer(r.Context(), authorizerFunc(
+		func(context.Context, auth.Action, auth.Resource) error { return nil },
+	)))
+	c.Reset(w, r)
+	c.Authentication.Method = auth.MethodNone
+	return c, w
+}
+
+type authorizerFunc func(context.Context, auth.Action, auth.Resource) error
+
+func (f authorizerFunc) Authorize(ctx context.Context, action auth.Action, resource auth.Resource) error {
+	return f(ctx, action, resource)
+}
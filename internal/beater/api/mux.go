@@ -32,6 +32,7 @@ import (
 
 	"github.com/elastic/apm-server/internal/agentcfg"
 	"github.com/elastic/apm-server/internal/beater/api/config/agent"
+	"github.com/elastic/apm-server/internal/beater/api/flush"
 	"github.com/elastic/apm-server/internal/beater/api/intake"
 	"github.com/elastic/apm-server/internal/beater/api/root"
 	"github.com/elastic/apm-server/internal/beater/auth"
@@ -74,6 +75,10 @@ const (
 	OTLPMetricsIntakePath = "/v1/metrics"
 	// OTLPLogsIntakePath defines the path to ingest OpenTelemetry logs (HTTP Collector)
 	OTLPLogsIntakePath = "/v1/logs"
+
+	// AggregationFlushPath defines the path to force aggregated metrics
+	// to be published immediately
+	AggregationFlushPath = "/admin/aggregation/flush"
 )
 
 // NewMux creates a new gorilla/mux router, with routes registered for handling the
@@ -87,6 +92,8 @@ func NewMux(
 	sourcemapFetcher sourcemap.Fetcher,
 	fleetManaged bool,
 	publishReady func() bool,
+	flushAggregations flush.FlushFunc,
+	prometheusRegistries []string,
 ) (*mux.Router, error) {
 	pool := request.NewContextPool()
 	logger := logp.NewLogger(logs.Handler)
@@ -125,6 +132,10 @@ func NewMux(
 		{OTLPLogsIntakePath, builder.otlpHandler(otlpHandlers.LogsHandler, otlp.HTTPLogsMonitoringMap)},
 	}
 
+	if beaterConfig.Aggregation.FlushEndpoint && flushAggregations != nil {
+		routeMap = append(routeMap, route{AggregationFlushPath, builder.flushHandler(flushAggregations)})
+	}
+
 	for _, route := range routeMap {
 		h, err := route.handlerFn()
 		if err != nil {
@@ -138,6 +149,14 @@ func NewMux(
 		logger.Infof("Path %s added to request handler", path)
 		router.Handle(path, http.HandlerFunc(debugVarsHandler))
 	}
+	if beaterConfig.Prometheus.Enabled {
+		path := beaterConfig.Prometheus.URL
+		logger.Infof("Path %s added to request handler", path)
+		if len(prometheusRegistries) == 0 {
+			prometheusRegistries = defaultPrometheusRegistries
+		}
+		router.Handle(path, newPrometheusHandler(logger, monitoring.Default, prometheusRegistries...))
+	}
 	if beaterConfig.Pprof.Enabled {
 		const path = "/debug/pprof"
 		logger.Infof("Path %s added to request handler", path)
@@ -231,6 +250,13 @@ func (r *routeBuilder) rootHandler(publishReady func() bool) func() (request.Han
 	}
 }
 
+func (r *routeBuilder) flushHandler(f flush.FlushFunc) func() (request.Handler, error) {
+	return func() (request.Handler, error) {
+		h := flush.Handler(f)
+		return middleware.Wrap(h, flushMiddleware(r.cfg, r.authenticator)...)
+	}
+}
+
 func (r *routeBuilder) backendAgentConfigHandler(f agentcfg.Fetcher) func() (request.Handler, error) {
 	return func() (request.Handler, error) {
 		return agentConfigHandler(r.cfg, r.authenticator, r.ratelimitStore, backendMiddleware, f, r.fleetManaged)
@@ -306,6 +332,13 @@ func rootMiddleware(cfg *config.Config, authenticator *auth.Authenticator) []mid
 	)
 }
 
+func flushMiddleware(cfg *config.Config, authenticator *auth.Authenticator) []middleware.Middleware {
+	return append(apmMiddleware(flush.MonitoringMap),
+		middleware.ResponseHeadersMiddleware(cfg.ResponseHeaders),
+		middleware.AuthMiddleware(authenticator, true),
+	)
+}
+
 func baseRequestMetadata(c *request.Context) model.APMEvent {
 	return model.APMEvent{
 		Timestamp: c.Timestamp,
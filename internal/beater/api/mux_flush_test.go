@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/internal/beater/headers"
+	"github.com/elastic/apm-server/internal/elasticsearch"
+)
+
+func TestFlushHandler(t *testing.T) {
+	flush := func(context.Context) (int, error) { return 10, nil }
+	request := func(t *testing.T, cfg *config.Config, header map[string]string) *httptest.ResponseRecorder {
+		mux, err := muxBuilder{FlushAggregations: flush}.build(cfg)
+		require.NoError(t, err)
+		r := requestWithHeader(httptest.NewRequest(http.MethodPost, AggregationFlushPath, nil), header)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		rec := request(t, config.DefaultConfig(), nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	cfg := config.DefaultConfig()
+	cfg.Aggregation.FlushEndpoint = true
+	cfg.AgentAuth.SecretToken = "1234"
+
+	t.Run("unauthorized", func(t *testing.T) {
+		rec := request(t, cfg, nil)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("authorized", func(t *testing.T) {
+		rec := request(t, cfg, map[string]string{headers.Authorization: "Bearer 1234"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "{\"groups\":10}\n", rec.Body.String())
+	})
+
+	// API Keys must have the aggregation:flush privilege, and not only
+	// the privilege to ingest events.
+	flushCredentials := base64.StdEncoding.EncodeToString([]byte("flush_id:key_value"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aggregationFlush := r.Header.Get(headers.Authorization) == headers.APIKey+" "+flushCredentials
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		fmt.Fprintf(w, `{
+		  "username": "api_key_username",
+		  "application": {
+		    "apm": {
+		      "-": {"event:write": true, "aggregation:flush": %t}
+		    }
+		  }
+		}`, aggregationFlush)
+	}))
+	defer srv.Close()
+	apiKeyConfig := config.DefaultConfig()
+	apiKeyConfig.Aggregation.FlushEndpoint = true
+	apiKeyConfig.AgentAuth.APIKey.Enabled = true
+	apiKeyConfig.AgentAuth.APIKey.ESConfig.Hosts = elasticsearch.Hosts{srv.URL}
+
+	t.Run("api_key_ingest_only", func(t *testing.T) {
+		credentials := base64.StdEncoding.EncodeToString([]byte("ingest_id:key_value"))
+		rec := request(t, apiKeyConfig, map[string]string{headers.Authorization: headers.APIKey + " " + credentials})
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, "{\"error\":\"unauthorized: API Key not permitted action \\\"aggregation:flush\\\"\"}\n", rec.Body.String())
+	})
+
+	t.Run("api_key_aggregation_flush", func(t *testing.T) {
+		rec := request(t, apiKeyConfig, map[string]string{headers.Authorization: headers.APIKey + " " + flushCredentials})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "{\"groups\":10}\n", rec.Body.String())
+	})
+}
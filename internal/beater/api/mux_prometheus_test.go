@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package api
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/internal/beater/config"
+)
+
+func TestPrometheusDefaultDisabled(t *testing.T) {
+	cfg := config.DefaultConfig()
+	recorder, err := requestToMuxerWithPattern(cfg, "/metrics")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestPrometheusEnabled(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Prometheus.Enabled = true
+	recorder, err := requestToMuxerWithPattern(cfg, "/metrics")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+}
+
+func TestPrometheusEnabledRegistries(t *testing.T) {
+	registry := monitoring.Default.NewRegistry("custom-prefix.sampling")
+	defer monitoring.Default.Remove("custom-prefix.sampling")
+	monitoring.NewInt(registry, "int").Set(123)
+
+	cfg := config.DefaultConfig()
+	cfg.Prometheus.Enabled = true
+	mux, err := muxBuilder{PrometheusRegistries: []string{"custom-prefix.sampling"}}.build(cfg)
+	require.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "# TYPE custom_prefix_sampling_int untyped\ncustom_prefix_sampling_int 123\n", recorder.Body.String())
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	root := monitoring.NewRegistry()
+	registry := root.NewRegistry("apm-server").NewRegistry("sampling")
+	monitoring.NewInt(registry, "int").Set(123)
+	monitoring.NewInt(registry, "large").Set(math.MaxInt64)
+	monitoring.NewFloat(registry, "float").Set(1.5)
+	monitoring.NewBool(registry, "bool").Set(true)
+	monitoring.NewString(registry, "string").Set("ignored")
+	monitoring.NewInt(registry, "a-b").Set(1)
+	monitoring.NewInt(registry, "a_b").Set(2)
+
+	handler := newPrometheusHandler(logp.NewLogger(""), root, "apm-server.sampling", "apm-server.missing")
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, `# TYPE apm_server_sampling_a_b untyped
+apm_server_sampling_a_b 1
+# TYPE apm_server_sampling_bool untyped
+apm_server_sampling_bool 1
+# TYPE apm_server_sampling_float untyped
+apm_server_sampling_float 1.5
+# TYPE apm_server_sampling_int untyped
+apm_server_sampling_int 123
+# TYPE apm_server_sampling_large untyped
+apm_server_sampling_large 9223372036854775807
+`, recorder.Body.String())
+}
+
+func TestPrometheusMetricName(t *testing.T) {
+	assert.Equal(t, "apm_server_aggregation_txmetrics_active_groups", prometheusMetricName("apm-server.aggregation.txmetrics.active_groups"))
+	assert.Equal(t, "a:b_c", prometheusMetricName("a:b/c"))
+}
@@ -31,6 +31,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/elastic/apm-server/internal/agentcfg"
+	"github.com/elastic/apm-server/internal/beater/api/flush"
 	"github.com/elastic/apm-server/internal/beater/auth"
 	"github.com/elastic/apm-server/internal/beater/config"
 	"github.com/elastic/apm-server/internal/beater/monitoringtest"
@@ -150,8 +151,10 @@ func newTestMux(t *testing.T, cfg *config.Config) http.Handler {
 }
 
 type muxBuilder struct {
-	SourcemapFetcher sourcemap.Fetcher
-	Managed          bool
+	SourcemapFetcher     sourcemap.Fetcher
+	Managed              bool
+	FlushAggregations    flush.FlushFunc
+	PrometheusRegistries []string
 }
 
 func (m muxBuilder) build(cfg *config.Config) (http.Handler, error) {
@@ -167,6 +170,8 @@ func (m muxBuilder) build(cfg *config.Config) (http.Handler, error) {
 		m.SourcemapFetcher,
 		m.Managed,
 		func() bool { return true },
+		m.FlushAggregations,
+		m.PrometheusRegistries,
 	)
 }
 
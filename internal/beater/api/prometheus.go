@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// defaultPrometheusRegistries holds the names of the libbeat/monitoring
+// registries which are exposed by the Prometheus handler, if NewMux is not
+// given the names of the registries to which the server's processors report.
+var defaultPrometheusRegistries = []string{
+	"apm-server.aggregation",
+	"apm-server.sampling",
+}
+
+// newPrometheusHandler returns an http.HandlerFunc which reports the metrics
+// in the named child registries of root, in the Prometheus text exposition
+// format.
+//
+// libbeat/monitoring does not distinguish between counters and gauges,
+// so all metrics are reported as untyped. Booleans are reported as 0 or 1,
+// and string values are omitted.
+//
+// Distinct metric names may translate to the same Prometheus metric name,
+// e.g. "a-b" and "a_b". Prometheus rejects scrapes with duplicate series,
+// so only the first metric (in sorted order) is reported, and the rest are
+// logged and skipped.
+func newPrometheusHandler(logger *logp.Logger, root *monitoring.Registry, registries ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		seen := make(map[string]string)
+		for _, name := range registries {
+			registry := root.GetRegistry(name)
+			if registry == nil {
+				// Registries are created lazily, e.g. when tail-based
+				// sampling is enabled, so they may not exist yet.
+				continue
+			}
+			snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+			values := make(map[string]string, len(snapshot.Ints)+len(snapshot.Floats)+len(snapshot.Bools))
+			for k, v := range snapshot.Ints {
+				values[k] = strconv.FormatInt(v, 10)
+			}
+			for k, v := range snapshot.Floats {
+				values[k] = strconv.FormatFloat(v, 'g', -1, 64)
+			}
+			for k, v := range snapshot.Bools {
+				if v {
+					values[k] = "1"
+				} else {
+					values[k] = "0"
+				}
+			}
+			keys := make([]string, 0, len(values))
+			for k := range values {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fullName := name + "." + k
+				metricName := prometheusMetricName(fullName)
+				if other, ok := seen[metricName]; ok {
+					logger.Debugf(
+						"skipping metric %q: Prometheus metric name %q already used by %q",
+						fullName, metricName, other,
+					)
+					continue
+				}
+				seen[metricName] = fullName
+				io.WriteString(w, "# TYPE "+metricName+" untyped\n")
+				io.WriteString(w, metricName+" "+values[k]+"\n")
+			}
+		}
+	}
+}
+
+// prometheusMetricName translates a dotted libbeat/monitoring metric name
+// into a valid Prometheus metric name, replacing any characters outside of
+// [a-zA-Z0-9_:] with underscores.
+func prometheusMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		}
+		return '_'
+	}, name)
+}
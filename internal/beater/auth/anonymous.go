@@ -74,6 +74,8 @@ func (a *anonymousAuth) Authorize(ctx context.Context, action Action, resource R
 		return nil
 	case ActionSourcemapUpload:
 		return fmt.Errorf("%w: anonymous access not permitted for sourcemap uploads", ErrUnauthorized)
+	case ActionAggregationFlush:
+		return fmt.Errorf("%w: anonymous access not permitted for flushing aggregations", ErrUnauthorized)
 	default:
 		return fmt.Errorf("unknown action %q", action)
 	}
@@ -45,6 +45,12 @@ func TestAnonymousAuthorizer(t *testing.T) {
 			resource:     auth.Resource{AgentName: "iOS/swift", ServiceName: "opbeans-ios"},
 			expectErr:    fmt.Errorf(`%w: anonymous access not permitted for sourcemap uploads`, auth.ErrUnauthorized),
 		},
+		"deny_aggregation_flush": {
+			allowAgent:   nil,
+			allowService: nil,
+			action:       auth.ActionAggregationFlush,
+			expectErr:    fmt.Errorf(`%w: anonymous access not permitted for flushing aggregations`, auth.ErrUnauthorized),
+		},
 		"deny_unknown_action": {
 			allowAgent:   nil,
 			allowService: nil,
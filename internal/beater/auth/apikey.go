@@ -55,6 +55,11 @@ var (
 	// PrivilegeSourcemapWrite identifies the Elasticsearch API Key privilege
 	// required for authorizing source map uploads.
 	PrivilegeSourcemapWrite = es.NewPrivilege("sourcemap", "sourcemap:write")
+
+	// PrivilegeAggregationFlush identifies the Elasticsearch API Key privilege
+	// required for authorizing requests to force aggregated metrics to be
+	// published.
+	PrivilegeAggregationFlush = es.NewPrivilege("aggregationFlush", "aggregation:flush")
 )
 
 // AllPrivilegeActions returns all Elasticsearch privilege actions used by APM Server.
@@ -63,6 +68,7 @@ func AllPrivilegeActions() []es.PrivilegeAction {
 		PrivilegeAgentConfigRead.Action,
 		PrivilegeEventWrite.Action,
 		PrivilegeSourcemapWrite.Action,
+		PrivilegeAggregationFlush.Action,
 	}
 }
 
@@ -168,6 +174,8 @@ func (a *apikeyAuthorizer) Authorize(ctx context.Context, action Action, _ Resou
 		apikeyPrivilegeAction = PrivilegeEventWrite.Action
 	case ActionSourcemapUpload:
 		apikeyPrivilegeAction = PrivilegeSourcemapWrite.Action
+	case ActionAggregationFlush:
+		apikeyPrivilegeAction = PrivilegeAggregationFlush.Action
 	default:
 		return fmt.Errorf("unknown action %q", action)
 	}
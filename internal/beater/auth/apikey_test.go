@@ -68,6 +68,10 @@ func TestAPIKeyAuthorizer(t *testing.T) {
 	assert.EqualError(t, err, `unauthorized: API Key not permitted action "sourcemap:write"`)
 	assert.True(t, errors.Is(err, ErrUnauthorized))
 
+	err = authz.Authorize(context.Background(), ActionAggregationFlush, Resource{})
+	assert.EqualError(t, err, `unauthorized: API Key not permitted action "aggregation:flush"`)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+
 	err = authz.Authorize(context.Background(), "unknown", Resource{})
 	assert.EqualError(t, err, `unknown action "unknown"`)
 }
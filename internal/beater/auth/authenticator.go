@@ -65,6 +65,10 @@ const (
 
 	// ActionSourcemapUpload is an Action describing an attempt to upload a source map.
 	ActionSourcemapUpload Action = "sourcemap"
+
+	// ActionAggregationFlush is an Action describing an attempt to force
+	// aggregated metrics to be published.
+	ActionAggregationFlush Action = "aggregation_flush"
 )
 
 const (
@@ -25,6 +25,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
 	"sync"
@@ -91,12 +92,24 @@ type CreatorParams struct {
 	// ServerParams provided to RunServerFunc; this BatchProcessor will
 	// have rate-limiting, authorization, and data preprocessing applied.
 	WrapServer WrapServerFunc
+
+	// Processors is optional, and holds registrations of additional
+	// processors to inject into the processing chain, e.g. for custom
+	// enrichment by embedders.
+	//
+	// The registrations are passed to WrapServer in ServerParams, and it
+	// is up to WrapServer to create, position, and run the processors;
+	// Processors therefore requires WrapServer.
+	Processors []ProcessorRegistration
 }
 
 // NewCreator returns a new beat.Creator which creates beaters
 // using the provided CreatorParams.
 func NewCreator(args CreatorParams) beat.Creator {
 	return func(b *beat.Beat, ucfg *agentconfig.C) (beat.Beater, error) {
+		if len(args.Processors) > 0 && args.WrapServer == nil {
+			return nil, errors.New("processors registered without WrapServer")
+		}
 		logger := args.Logger
 		if logger != nil {
 			logger = logger.Named(logs.Beater)
@@ -108,6 +121,7 @@ func NewCreator(args CreatorParams) beat.Creator {
 			stopped:                   false,
 			logger:                    logger,
 			wrapServer:                args.WrapServer,
+			processors:                args.Processors,
 			waitPublished:             publish.NewWaitPublishedAcker(),
 			outputConfigReloader:      newChanReloader(),
 			libbeatMonitoringRegistry: monitoring.Default.GetRegistry("libbeat"),
@@ -149,6 +163,7 @@ type beater struct {
 	config                    *config.Config
 	logger                    *logp.Logger
 	wrapServer                WrapServerFunc
+	processors                []ProcessorRegistration
 	waitPublished             *publish.WaitPublishedAcker
 	outputConfigReloader      *chanReloader
 	libbeatMonitoringRegistry *monitoring.Registry
@@ -160,13 +175,49 @@ type beater struct {
 
 // Run runs the APM Server, blocking until the beater's Stop method is called,
 // or a fatal error occurs.
+//
+// Run also returns after draining the server when the process receives a
+// drain signal (SIGUSR2 on Unix-like systems), for use in rolling upgrades.
 func (bt *beater) Run(b *beat.Beat) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	stopHandlingDrainSignals := bt.handleDrainSignals()
+	defer stopHandlingDrainSignals()
 	if err := bt.run(ctx, cancel, b); err != nil {
 		return err
 	}
-	return bt.waitPublished.Wait(ctx)
+	if err := bt.waitPublished.Wait(ctx); err != nil {
+		return err
+	}
+	bt.logger.Info("apm-server drained: all events have been published")
+	return nil
+}
+
+// handleDrainSignals starts a goroutine which stops the beater upon receiving
+// one of drainSignals. Stopping the beater stops accepting new events, then
+// drains and stops the server's processors in order, and finally waits for
+// all events to be published before Run returns and the process exits.
+//
+// The returned function must be called to stop handling signals.
+func (bt *beater) handleDrainSignals() func() {
+	if len(drainSignals) == 0 {
+		return func() {}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, drainSignals...)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case sig := <-signals:
+			bt.logger.Infof("received %s, draining apm-server before exiting", sig)
+			bt.Stop()
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
 }
 
 func (bt *beater) run(ctx context.Context, cancelContext context.CancelFunc, b *beat.Beat) error {
@@ -203,6 +254,7 @@ func (bt *beater) run(ctx context.Context, cancelContext context.CancelFunc, b *
 		args: sharedServerRunnerParams{
 			Beat:                      b,
 			WrapServer:                bt.wrapServer,
+			Processors:                bt.processors,
 			Logger:                    bt.logger,
 			Tracer:                    tracer,
 			TracerServer:              tracerServer,
@@ -412,6 +464,7 @@ type serverRunner struct {
 	tracer                    *apm.Tracer
 	tracerServer              *tracerServer
 	wrapServer                WrapServerFunc
+	processors                []ProcessorRegistration
 	libbeatMonitoringRegistry *monitoring.Registry
 }
 
@@ -426,6 +479,7 @@ type serverRunnerParams struct {
 type sharedServerRunnerParams struct {
 	Beat                      *beat.Beat
 	WrapServer                WrapServerFunc
+	Processors                []ProcessorRegistration
 	Logger                    *logp.Logger
 	Tracer                    *apm.Tracer
 	TracerServer              *tracerServer
@@ -464,6 +518,7 @@ func newServerRunner(ctx context.Context, args serverRunnerParams) (*serverRunne
 		tracer:                    args.Tracer,
 		tracerServer:              args.TracerServer,
 		wrapServer:                args.WrapServer,
+		processors:                args.Processors,
 		libbeatMonitoringRegistry: args.LibbeatMonitoringRegistry,
 	}, nil
 }
@@ -474,6 +529,13 @@ func (s *serverRunner) run(listener net.Listener) error {
 	// Send config to telemetry.
 	recordAPMServerConfig(s.config)
 
+	// Log the effective config, to aid in diagnosing configuration issues.
+	if data, err := s.config.RedactedJSON(); err != nil {
+		s.logger.Warnf("failed to encode effective config: %v", err)
+	} else {
+		s.logger.Infof("effective config: %s", data)
+	}
+
 	var kibanaClient kibana.Client
 	if s.config.Kibana.Enabled {
 		kibanaClient = kibana.NewConnectingClient(s.config.Kibana.ClientConfig)
@@ -612,41 +674,83 @@ func (s *serverRunner) run(listener net.Listener) error {
 	if err != nil {
 		return err
 	}
-	batchProcessor := modelprocessor.Chained{
-		// Ensure all events have observer.*, ecs.*, and data_stream.* fields added,
-		// and are counted in metrics. This is done in the final processors to ensure
-		// aggregated metrics are also processed.
-		newObserverBatchProcessor(s.beat.Info),
-		model.ProcessBatchFunc(ecsVersionBatchProcessor),
-		&modelprocessor.SetDataStream{Namespace: s.namespace},
-		modelprocessor.NewEventCounter(monitoring.Default.GetRegistry("apm-server")),
-
-		// The server always drops non-RUM unsampled transactions. We store RUM unsampled
-		// transactions as they are needed by the User Experience app, which performs
-		// aggregations over dimensions that are not available in transaction metrics.
-		//
-		// It is important that this is done just before calling the publisher to
-		// avoid affecting aggregations.
-		modelprocessor.NewDropUnsampled(false /* don't drop RUM unsampled transactions*/),
-		modelprocessor.DroppedSpansStatsDiscarder{},
-		finalBatchProcessor,
+	eventCounter := modelprocessor.NewEventCounter(monitoring.Default.GetRegistry("apm-server"))
+	newBatchProcessor := func(final model.BatchProcessor, namespace string) model.BatchProcessor {
+		return modelprocessor.Chained{
+			// Ensure all events have observer.*, ecs.*, and data_stream.* fields added,
+			// and are counted in metrics. This is done in the final processors to ensure
+			// aggregated metrics are also processed.
+			newObserverBatchProcessor(s.beat.Info),
+			model.ProcessBatchFunc(ecsVersionBatchProcessor),
+			&modelprocessor.SetDataStream{Namespace: namespace},
+			eventCounter,
+
+			// The server always drops non-RUM unsampled transactions. We store RUM unsampled
+			// transactions as they are needed by the User Experience app, which performs
+			// aggregations over dimensions that are not available in transaction metrics.
+			//
+			// It is important that this is done just before calling the publisher to
+			// avoid affecting aggregations.
+			modelprocessor.NewDropUnsampled(false /* don't drop RUM unsampled transactions*/),
+			modelprocessor.DroppedSpansStatsDiscarder{},
+			final,
+		}
+	}
+	batchProcessor := newBatchProcessor(finalBatchProcessor, s.namespace)
+
+	// Aggregated metrics are processed by the same BatchProcessor chain as
+	// all other events, unless they are configured to be indexed separately
+	// or into a different data stream namespace.
+	aggregationNamespace := s.namespace
+	if s.config.Aggregation.Namespace != "" {
+		aggregationNamespace = s.config.Aggregation.Namespace
+	}
+	aggregationBatchProcessor := batchProcessor
+	if aggregationNamespace != s.namespace {
+		aggregationBatchProcessor = newBatchProcessor(finalBatchProcessor, aggregationNamespace)
+	}
+	closeAggregationBatchProcessor := func(context.Context) error { return nil }
+	if s.config.Aggregation.ESConfig != nil {
+		aggregationIndexer, err := s.newAggregationIndexer(newElasticsearchClient)
+		if err != nil {
+			return err
+		}
+		aggregationBatchProcessor = newBatchProcessor(aggregationIndexer, aggregationNamespace)
+		closeAggregationBatchProcessor = aggregationIndexer.Close
+	}
+
+	// Events which cannot be processed, e.g. due to indexing errors, are
+	// optionally written to a dead-letter output rather than dropped.
+	deadLetterSink, closeDeadLetterSink, err := newDeadLetterSink(
+		s.config.DeadLetter, s.namespace, finalBatchProcessor,
+	)
+	if err != nil {
+		return err
+	}
+	if deadLetterSink != nil {
+		aggregationBatchProcessor = &modelprocessor.DeadLetter{
+			Processor: aggregationBatchProcessor,
+			Sink:      deadLetterSink,
+		}
 	}
 
 	serverParams := ServerParams{
-		UUID:                   s.beat.Info.ID,
-		Config:                 s.config,
-		Managed:                s.beat.Manager != nil && s.beat.Manager.Enabled(),
-		Namespace:              s.namespace,
-		Logger:                 s.logger,
-		Tracer:                 s.tracer,
-		Authenticator:          authenticator,
-		RateLimitStore:         ratelimitStore,
-		BatchProcessor:         batchProcessor,
-		SourcemapFetcher:       sourcemapFetcher,
-		PublishReady:           publishReady,
-		KibanaClient:           kibanaClient,
-		NewElasticsearchClient: newElasticsearchClient,
-		GRPCServer:             grpcServer,
+		UUID:                      s.beat.Info.ID,
+		Config:                    s.config,
+		Managed:                   s.beat.Manager != nil && s.beat.Manager.Enabled(),
+		Namespace:                 s.namespace,
+		Logger:                    s.logger,
+		Tracer:                    s.tracer,
+		Authenticator:             authenticator,
+		RateLimitStore:            ratelimitStore,
+		BatchProcessor:            batchProcessor,
+		AggregationBatchProcessor: aggregationBatchProcessor,
+		SourcemapFetcher:          sourcemapFetcher,
+		PublishReady:              publishReady,
+		KibanaClient:              kibanaClient,
+		NewElasticsearchClient:    newElasticsearchClient,
+		GRPCServer:                grpcServer,
+		Processors:                s.processors,
 	}
 	if s.wrapServer != nil {
 		// Wrap the serverParams and runServer function, enabling
@@ -656,6 +760,14 @@ func (s *serverRunner) run(listener net.Listener) error {
 			return err
 		}
 	}
+	if deadLetterSink != nil {
+		// Dead-letter events which fail processing after being decoded
+		// and authorized, including in processors added by wrapServer.
+		serverParams.BatchProcessor = &modelprocessor.DeadLetter{
+			Processor: serverParams.BatchProcessor,
+			Sink:      deadLetterSink,
+		}
+	}
 
 	// Add pre-processing batch processors to the beginning of the chain,
 	// applying only to the events that are decoded from agent/client payloads.
@@ -690,9 +802,15 @@ func (s *serverRunner) run(listener net.Listener) error {
 	close(s.started)
 
 	result := g.Wait()
+	if err := closeAggregationBatchProcessor(s.backgroundContext); err != nil {
+		result = multierror.Append(result, err)
+	}
 	if err := closeFinalBatchProcessor(s.backgroundContext); err != nil {
 		result = multierror.Append(result, err)
 	}
+	if err := closeDeadLetterSink(); err != nil {
+		result = multierror.Append(result, err)
+	}
 	return result
 }
 
@@ -772,6 +890,26 @@ func (s *serverRunner) waitReady(ctx context.Context, kibanaClient kibana.Client
 	return waitReady(ctx, s.config.WaitReadyInterval, s.tracer, s.logger, check)
 }
 
+// newAggregationIndexer returns a modelindexer.Indexer for indexing aggregated
+// metrics into the Elasticsearch cluster defined by aggregation.elasticsearch.
+func (s *serverRunner) newAggregationIndexer(
+	newElasticsearchClient func(cfg *elasticsearch.Config) (elasticsearch.Client, error),
+) (*modelindexer.Indexer, error) {
+	esConfig := s.config.Aggregation.ESConfig
+	client, err := newElasticsearchClient(esConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Elasticsearch client for aggregated metrics")
+	}
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		CompressionLevel: esConfig.CompressionLevel,
+		Tracer:           s.tracer,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create indexer for aggregated metrics")
+	}
+	return indexer, nil
+}
+
 // newFinalBatchProcessor returns the final model.BatchProcessor that publishes events,
 // and a cleanup function which should be called on server shutdown. If the output is
 // "elasticsearch", then we use modelindexer; otherwise we use the libbeat publisher.
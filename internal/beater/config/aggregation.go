@@ -18,22 +18,79 @@
 package config
 
 import (
+	"math"
 	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/internal/elasticsearch"
+	"github.com/elastic/elastic-agent-libs/config"
 )
 
 const (
 	defaultTransactionAggregationInterval                       = time.Minute
 	defaultTransactionAggregationMaxGroups                      = 10000
 	defaultTransactionAggregationHDRHistogramSignificantFigures = 2
+	defaultTransactionAggregationEvictionPolicy                 = "publish_individual"
 
 	defaultServiceDestinationAggregationInterval  = time.Minute
 	defaultServiceDestinationAggregationMaxGroups = 10000
+
+	defaultAggregationTimestampAlignment = "start"
 )
 
 // AggregationConfig holds configuration related to various metrics aggregations.
 type AggregationConfig struct {
 	Transactions        TransactionAggregationConfig        `config:"transactions"`
 	ServiceDestinations ServiceDestinationAggregationConfig `config:"service_destinations"`
+
+	// ESConfig holds optional Elasticsearch configuration for indexing
+	// aggregated metrics separately from all other events, e.g. into a
+	// different cluster. If ESConfig is nil, aggregated metrics are
+	// indexed along with all other events.
+	ESConfig *elasticsearch.Config `config:"elasticsearch"`
+
+	// Namespace holds an optional data stream namespace for aggregated
+	// metrics. If Namespace is empty, aggregated metrics are indexed into
+	// the same namespace as all other events.
+	Namespace string `config:"namespace"`
+
+	// TimestampAlignment controls whether aggregated metrics are
+	// timestamped with the start ("start", the default) or end ("end")
+	// of their aggregation interval.
+	TimestampAlignment string `config:"timestamp_alignment"`
+
+	// FlushEndpoint controls whether an endpoint is served for forcing the
+	// aggregators to publish their metrics immediately, rather than at the
+	// end of their interval, e.g. for testing, or for draining a server
+	// before scaling down. Requests must be authorized with the secret
+	// token, or an API Key with the aggregation:flush privilege. Disabled
+	// by default.
+	FlushEndpoint bool `config:"flush_endpoint"`
+}
+
+func (c *AggregationConfig) Validate() error {
+	switch c.TimestampAlignment {
+	case "start", "end":
+	default:
+		return errors.Errorf("invalid timestamp_alignment %q", c.TimestampAlignment)
+	}
+	return nil
+}
+
+// setESConfigDefaults sets ESConfig to the default Elasticsearch config if
+// aggregation.elasticsearch is defined in ucfg, so that the defaults are
+// merged with the user-defined config when unpacking.
+func (c *AggregationConfig) setESConfigDefaults(ucfg *config.C) {
+	if !ucfg.HasField("aggregation") {
+		return
+	}
+	aggregationCfg, err := ucfg.Child("aggregation", -1)
+	if err != nil || !aggregationCfg.HasField("elasticsearch") {
+		return
+	}
+	c.ESConfig = elasticsearch.DefaultConfig()
 }
 
 // TransactionAggregationConfig holds configuration related to transaction metrics aggregation.
@@ -41,12 +98,135 @@ type TransactionAggregationConfig struct {
 	Interval                       time.Duration `config:"interval" validate:"min=1"`
 	MaxTransactionGroups           int           `config:"max_groups" validate:"min=1"`
 	HDRHistogramSignificantFigures int           `config:"hdrhistogram_significant_figures" validate:"min=1, max=5"`
+
+	// EvictionPolicy controls how transactions which would create a new
+	// transaction group are handled once MaxTransactionGroups has been
+	// reached: "publish_individual" (default), "lru", "lfu", or
+	// "overflow_bucket".
+	EvictionPolicy string `config:"eviction_policy"`
+
+	// FlushThreshold, if greater than zero, is the number of transaction
+	// groups at which metrics are published without waiting for Interval
+	// to elapse. By default metrics are published only every Interval.
+	FlushThreshold int `config:"flush_threshold" validate:"min=0"`
+
+	// Shards, if greater than one, is the number of shards to split
+	// transaction groups across, for aggregating in parallel on multi-core
+	// machines. MaxTransactionGroups and FlushThreshold are divided evenly
+	// between the shards. By default a single shard is used.
+	Shards int `config:"shards" validate:"min=0"`
+
+	// MaxMemory holds the maximum estimated memory used for transaction
+	// groups, e.g. "100MiB". Once reached, transactions which would create
+	// a new group are handled as when MaxTransactionGroups is reached, and
+	// metrics are published without waiting for Interval to elapse. If
+	// MaxMemory is empty, which is the default, memory is not limited.
+	MaxMemory       string `config:"max_memory"`
+	MaxMemoryParsed int
+
+	// RollupInterval, if non-zero, is the interval of additional, coarser
+	// metrics rolled up from those aggregated every Interval, e.g. "1h",
+	// for retaining historical metrics at a lower storage cost. It must
+	// be a multiple of Interval. By default metrics are not rolled up.
+	RollupInterval time.Duration `config:"rollup_interval" validate:"min=0"`
+}
+
+func (c *TransactionAggregationConfig) Validate() error {
+	switch c.EvictionPolicy {
+	case "publish_individual", "lru", "lfu", "overflow_bucket":
+	default:
+		return errors.Errorf("invalid eviction_policy %q", c.EvictionPolicy)
+	}
+	if c.FlushThreshold > c.MaxTransactionGroups {
+		return errors.New("flush_threshold must not be greater than max_groups")
+	}
+	if c.Shards > c.MaxTransactionGroups {
+		return errors.New("shards must not be greater than max_groups")
+	}
+	if err := validateAggregationRollupInterval(c.RollupInterval, c.Interval); err != nil {
+		return err
+	}
+	var err error
+	if c.MaxMemoryParsed, err = parseAggregationMaxMemory(c.MaxMemory); err != nil {
+		return err
+	}
+	return nil
 }
 
 // ServiceDestinationAggregationConfig holds configuration related to span metrics aggregation for service maps.
 type ServiceDestinationAggregationConfig struct {
 	Interval  time.Duration `config:"interval" validate:"min=1"`
 	MaxGroups int           `config:"max_groups" validate:"min=1"`
+
+	// GroupByOutcome controls whether service destination metrics are
+	// grouped by span outcome, for calculating failure rates per
+	// destination. This is enabled by default.
+	GroupByOutcome bool `config:"group_by_outcome"`
+
+	// FlushThreshold, if greater than zero, is the number of service
+	// destination groups at which metrics are published without waiting
+	// for Interval to elapse. By default metrics are published only every
+	// Interval.
+	FlushThreshold int `config:"flush_threshold" validate:"min=0"`
+
+	// MaxSpanNamesPerDestination, if greater than zero, is the maximum
+	// number of distinct span names aggregated for each destination. Spans
+	// with other names are aggregated without span name. By default the
+	// number of span names per destination is not limited.
+	MaxSpanNamesPerDestination int `config:"max_span_names_per_destination" validate:"min=0"`
+
+	// MaxMemory holds the maximum estimated memory used for service
+	// destination groups, e.g. "10MiB". Once reached, spans which would
+	// create a new group are published as individual metrics, and metrics
+	// are published without waiting for Interval to elapse. If MaxMemory
+	// is empty, which is the default, memory is not limited.
+	MaxMemory       string `config:"max_memory"`
+	MaxMemoryParsed int
+
+	// RollupInterval, if non-zero, is the interval of additional, coarser
+	// metrics rolled up from those aggregated every Interval, e.g. "1h".
+	// It must be a multiple of Interval. By default metrics are not
+	// rolled up.
+	RollupInterval time.Duration `config:"rollup_interval" validate:"min=0"`
+}
+
+func (c *ServiceDestinationAggregationConfig) Validate() error {
+	if c.FlushThreshold > c.MaxGroups {
+		return errors.New("flush_threshold must not be greater than max_groups")
+	}
+	if err := validateAggregationRollupInterval(c.RollupInterval, c.Interval); err != nil {
+		return err
+	}
+	var err error
+	if c.MaxMemoryParsed, err = parseAggregationMaxMemory(c.MaxMemory); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateAggregationRollupInterval validates that rollupInterval, if
+// non-zero, is a multiple of interval.
+func validateAggregationRollupInterval(rollupInterval, interval time.Duration) error {
+	if rollupInterval > 0 && rollupInterval%interval != 0 {
+		return errors.Errorf("rollup_interval %s must be a multiple of interval %s", rollupInterval, interval)
+	}
+	return nil
+}
+
+// parseAggregationMaxMemory parses the given human-readable size, returning
+// zero if s is empty.
+func parseAggregationMaxMemory(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "error parsing max_memory")
+	}
+	if n > math.MaxInt32 {
+		return 0, errors.Errorf("max_memory %q out of range", s)
+	}
+	return int(n), nil
 }
 
 func defaultAggregationConfig() AggregationConfig {
@@ -55,10 +235,13 @@ func defaultAggregationConfig() AggregationConfig {
 			Interval:                       defaultTransactionAggregationInterval,
 			MaxTransactionGroups:           defaultTransactionAggregationMaxGroups,
 			HDRHistogramSignificantFigures: defaultTransactionAggregationHDRHistogramSignificantFigures,
+			EvictionPolicy:                 defaultTransactionAggregationEvictionPolicy,
 		},
 		ServiceDestinations: ServiceDestinationAggregationConfig{
-			Interval:  defaultServiceDestinationAggregationInterval,
-			MaxGroups: defaultServiceDestinationAggregationMaxGroups,
+			Interval:       defaultServiceDestinationAggregationInterval,
+			MaxGroups:      defaultServiceDestinationAggregationMaxGroups,
+			GroupByOutcome: true,
 		},
+		TimestampAlignment: defaultAggregationTimestampAlignment,
 	}
 }
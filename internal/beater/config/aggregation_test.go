@@ -19,10 +19,12 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/elastic/apm-server/internal/elasticsearch"
 	"github.com/elastic/elastic-agent-libs/config"
 )
 
@@ -55,6 +57,66 @@ func TestAggregationConfigInvalid(t *testing.T) {
 		key:    "aggregation.transactions.hdrhistogram_significant_figures",
 		value:  float64(6),
 		expect: "Error processing configuration: requires value <= 5 accessing 'aggregation.transactions.hdrhistogram_significant_figures'",
+	}, {
+		name:   "unknown eviction_policy",
+		key:    "aggregation.transactions.eviction_policy",
+		value:  "random",
+		expect: `Error processing configuration: invalid eviction_policy "random" accessing 'aggregation.transactions'`,
+	}, {
+		name:   "negative flush_threshold",
+		key:    "aggregation.transactions.flush_threshold",
+		value:  float64(-1),
+		expect: "Error processing configuration: requires value >= 0 accessing 'aggregation.transactions.flush_threshold'",
+	}, {
+		name:   "transactions flush_threshold greater than max_groups",
+		key:    "aggregation.transactions.flush_threshold",
+		value:  float64(defaultTransactionAggregationMaxGroups + 1),
+		expect: "Error processing configuration: flush_threshold must not be greater than max_groups accessing 'aggregation.transactions'",
+	}, {
+		name:   "negative shards",
+		key:    "aggregation.transactions.shards",
+		value:  float64(-1),
+		expect: "Error processing configuration: requires value >= 0 accessing 'aggregation.transactions.shards'",
+	}, {
+		name:   "shards greater than max_groups",
+		key:    "aggregation.transactions.shards",
+		value:  float64(defaultTransactionAggregationMaxGroups + 1),
+		expect: "Error processing configuration: shards must not be greater than max_groups accessing 'aggregation.transactions'",
+	}, {
+		name:   "service_destinations flush_threshold greater than max_groups",
+		key:    "aggregation.service_destinations.flush_threshold",
+		value:  float64(defaultServiceDestinationAggregationMaxGroups + 1),
+		expect: "Error processing configuration: flush_threshold must not be greater than max_groups accessing 'aggregation.service_destinations'",
+	}, {
+		name:   "negative max_span_names_per_destination",
+		key:    "aggregation.service_destinations.max_span_names_per_destination",
+		value:  float64(-1),
+		expect: "Error processing configuration: requires value >= 0 accessing 'aggregation.service_destinations.max_span_names_per_destination'",
+	}, {
+		name:   "invalid transactions max_memory",
+		key:    "aggregation.transactions.max_memory",
+		value:  "lots",
+		expect: `Error processing configuration: error parsing max_memory: strconv.ParseFloat: parsing "": invalid syntax accessing 'aggregation.transactions'`,
+	}, {
+		name:   "service_destinations max_memory out of range",
+		key:    "aggregation.service_destinations.max_memory",
+		value:  "4GiB",
+		expect: `Error processing configuration: max_memory "4GiB" out of range accessing 'aggregation.service_destinations'`,
+	}, {
+		name:   "negative rollup_interval",
+		key:    "aggregation.transactions.rollup_interval",
+		value:  "-1h",
+		expect: "Error processing configuration: requires duration >= 0 accessing 'aggregation.transactions.rollup_interval'",
+	}, {
+		name:   "service_destinations rollup_interval not a multiple of interval",
+		key:    "aggregation.service_destinations.rollup_interval",
+		value:  "90s",
+		expect: "Error processing configuration: rollup_interval 1m30s must be a multiple of interval 1m0s accessing 'aggregation.service_destinations'",
+	}, {
+		name:   "unknown timestamp_alignment",
+		key:    "aggregation.timestamp_alignment",
+		value:  "middle",
+		expect: `Error processing configuration: invalid timestamp_alignment "middle" accessing 'aggregation'`,
 	}} {
 		t.Run(test.name, func(t *testing.T) {
 			_, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
@@ -71,3 +133,71 @@ func TestAggregationConfigDefault(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, defaultAggregationConfig(), cfg.Aggregation)
 }
+
+func TestAggregationConfigMaxMemory(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"aggregation.transactions.max_memory":         "100MiB",
+		"aggregation.service_destinations.max_memory": "10MB",
+	}), nil)
+	require.NoError(t, err)
+
+	expected := defaultAggregationConfig()
+	expected.Transactions.MaxMemory = "100MiB"
+	expected.Transactions.MaxMemoryParsed = 100 * 1024 * 1024
+	expected.ServiceDestinations.MaxMemory = "10MB"
+	expected.ServiceDestinations.MaxMemoryParsed = 10 * 1000 * 1000
+	assert.Equal(t, expected, cfg.Aggregation)
+}
+
+func TestAggregationConfigRollupInterval(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"aggregation.transactions.rollup_interval":         "1h",
+		"aggregation.service_destinations.rollup_interval": "10m",
+	}), nil)
+	require.NoError(t, err)
+
+	expected := defaultAggregationConfig()
+	expected.Transactions.RollupInterval = time.Hour
+	expected.ServiceDestinations.RollupInterval = 10 * time.Minute
+	assert.Equal(t, expected, cfg.Aggregation)
+}
+
+func TestAggregationConfigElasticsearch(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"aggregation.elasticsearch.hosts":   []string{"metrics:9200"},
+		"aggregation.elasticsearch.api_key": "id:api_key",
+	}), nil)
+	require.NoError(t, err)
+
+	expected := elasticsearch.DefaultConfig()
+	expected.Hosts = elasticsearch.Hosts{"metrics:9200"}
+	expected.APIKey = "id:api_key"
+	assert.Equal(t, expected, cfg.Aggregation.ESConfig)
+
+	// Other aggregation config should retain its defaults.
+	expectedAggregation := defaultAggregationConfig()
+	expectedAggregation.ESConfig = expected
+	assert.Equal(t, expectedAggregation, cfg.Aggregation)
+}
+
+func TestAggregationConfigNamespace(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"aggregation.namespace": "metrics",
+	}), nil)
+	require.NoError(t, err)
+
+	expected := defaultAggregationConfig()
+	expected.Namespace = "metrics"
+	assert.Equal(t, expected, cfg.Aggregation)
+}
+
+func TestAggregationConfigFlushEndpoint(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"aggregation.flush_endpoint": true,
+	}), nil)
+	require.NoError(t, err)
+
+	expected := defaultAggregationConfig()
+	expected.FlushEndpoint = true
+	assert.Equal(t, expected, cfg.Aggregation)
+}
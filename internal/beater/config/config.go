@@ -60,6 +60,7 @@ type Config struct {
 	MaxConnections            int                     `config:"max_connections"`
 	ResponseHeaders           map[string][]string     `config:"response_headers"`
 	Expvar                    ExpvarConfig            `config:"expvar"`
+	Prometheus                PrometheusConfig        `config:"prometheus"`
 	Pprof                     PprofConfig             `config:"pprof"`
 	AugmentEnabled            bool                    `config:"capture_personal_data"`
 	RumConfig                 RumConfig               `config:"rum"`
@@ -70,6 +71,7 @@ type Config struct {
 	DataStreams               DataStreamsConfig       `config:"data_streams"`
 	DefaultServiceEnvironment string                  `config:"default_service_environment"`
 	JavaAttacherConfig        JavaAttacherConfig      `config:"java_attacher"`
+	DeadLetter                DeadLetterConfig        `config:"dead_letter"`
 
 	AgentConfigs []AgentConfig `config:"agent_config"`
 
@@ -83,12 +85,20 @@ type Config struct {
 	// memory consumed by the processors decodeing the incoming intake events.
 	// This setting is beta and subject to breaking changes and removal.
 	MaxConcurrentDecoders uint `config:"max_concurrent_decoders"`
+
+	// ShutdownGracePeriod holds the duration to wait after the server
+	// stops accepting events, before stopping the event processors, e.g.
+	// to allow trailing spans to arrive before tail-sampling decisions
+	// are finalized. ShutdownTimeout applies once the grace period has
+	// elapsed. By default the processors are stopped immediately.
+	ShutdownGracePeriod time.Duration `config:"shutdown_grace_period" validate:"min=0"`
 }
 
 // NewConfig creates a Config struct based on the default config and the given input params
 func NewConfig(ucfg *config.C, outputESCfg *config.C) (*Config, error) {
 	logger := logp.NewLogger(logs.Config)
 	c := DefaultConfig()
+	c.Aggregation.setESConfigDefaults(ucfg)
 	if err := ucfg.Unpack(c); err != nil {
 		return nil, errors.Wrap(err, "Error processing configuration")
 	}
@@ -143,6 +153,10 @@ func DefaultConfig() *Config {
 			Enabled: false,
 			URL:     "/debug/vars",
 		},
+		Prometheus: PrometheusConfig{
+			Enabled: false,
+			URL:     "/metrics",
+		},
 		Pprof:                 PprofConfig{Enabled: false},
 		RumConfig:             defaultRum(),
 		Kibana:                defaultKibanaConfig(),
@@ -92,6 +92,7 @@ func TestUnpackConfig(t *testing.T) {
 				"read_timeout":            3 * time.Second,
 				"write_timeout":           4 * time.Second,
 				"shutdown_timeout":        9 * time.Second,
+				"shutdown_grace_period":   2 * time.Second,
 				"capture_personal_data":   true,
 				"max_concurrent_decoders": 100,
 				"auth": map[string]interface{}{
@@ -155,9 +156,12 @@ func TestUnpackConfig(t *testing.T) {
 						"interval":                         "1s",
 						"max_groups":                       123,
 						"hdrhistogram_significant_figures": 1,
+						"eviction_policy":                  "lru",
+						"shards":                           4,
 					},
 					"service_destinations": map[string]interface{}{
-						"max_groups": 456,
+						"max_groups":       456,
+						"group_by_outcome": false,
 					},
 				},
 				"default_service_environment": "overridden",
@@ -170,6 +174,7 @@ func TestUnpackConfig(t *testing.T) {
 				ReadTimeout:           3000000000,
 				WriteTimeout:          4000000000,
 				ShutdownTimeout:       9000000000,
+				ShutdownGracePeriod:   2000000000,
 				MaxConcurrentDecoders: 100,
 				AgentAuth: AgentAuth{
 					SecretToken: "1234random",
@@ -209,6 +214,10 @@ func TestUnpackConfig(t *testing.T) {
 					Enabled: true,
 					URL:     "/debug/vars",
 				},
+				Prometheus: PrometheusConfig{
+					Enabled: false,
+					URL:     "/metrics",
+				},
 				Pprof: PprofConfig{
 					Enabled: false,
 				},
@@ -245,11 +254,14 @@ func TestUnpackConfig(t *testing.T) {
 						Interval:                       time.Second,
 						MaxTransactionGroups:           123,
 						HDRHistogramSignificantFigures: 1,
+						EvictionPolicy:                 "lru",
+						Shards:                         4,
 					},
 					ServiceDestinations: ServiceDestinationAggregationConfig{
 						Interval:  time.Minute,
 						MaxGroups: 456,
 					},
+					TimestampAlignment: "start",
 				},
 				Sampling: SamplingConfig{
 					Tail: TailSamplingConfig{
@@ -257,10 +269,51 @@ func TestUnpackConfig(t *testing.T) {
 						ESConfig:              elasticsearch.DefaultConfig(),
 						Interval:              1 * time.Minute,
 						IngestRateDecayFactor: 0.25,
+						MaxDynamicServices:    1000,
+						FinalizeConcurrency:   1,
 						StorageGCInterval:     5 * time.Minute,
 						StorageLimit:          "3GB",
 						StorageLimitParsed:    3000000000,
 						TTL:                   30 * time.Minute,
+						Strategy:              "random",
+						TraceIDCollision:      "merge",
+						BulkMaxRequests:       10,
+						BulkFlushBytes:        "5MiB",
+						BulkFlushBytesParsed:  5 * 1024 * 1024,
+						CircuitBreaker: TailSamplingCircuitBreakerConfig{
+							FailureThreshold: 5,
+							Cooldown:         30 * time.Second,
+						},
+						PublishRetry: TailSamplingPublishRetryConfig{
+							Backoff: time.Second,
+							Jitter:  0.5,
+							Timeout: 30 * time.Second,
+						},
+						StorageValueLogFileSize:       "128MiB",
+						StorageValueLogFileSizeParsed: 128 * 1024 * 1024,
+						StorageCompression:            "none",
+						StorageKeySchema:              "trace_event",
+						StorageCorruption: TailSamplingStorageCorruptionConfig{
+							Action: "move",
+						},
+						StorageWrite: TailSamplingStorageWriteConfig{
+							QueueSize: 1000,
+						},
+						TraceCompletion: TailSamplingTraceCompletionConfig{
+							Label: "trace_complete",
+						},
+						SampledTraces: TailSamplingSampledTracesConfig{
+							Compression: "gzip",
+						},
+						AuditLog: TailSamplingAuditLogConfig{
+							Path:          "tail_sampling_audit",
+							MaxSize:       "10MiB",
+							MaxSizeParsed: 10 * 1024 * 1024,
+							MaxBackups:    7,
+						},
+						DecisionMetrics: TailSamplingDecisionMetricsConfig{
+							Dataset: "apm.sampling",
+						},
 					},
 				},
 				DefaultServiceEnvironment: "overridden",
@@ -315,11 +368,25 @@ func TestUnpackConfig(t *testing.T) {
 					},
 				},
 				"sampling.tail": map[string]interface{}{
-					"enabled":           false,
-					"policies":          []map[string]interface{}{{"sample_rate": 0.5}},
-					"interval":          "2m",
-					"ingest_rate_decay": 1.0,
-					"storage_limit":     "1GB",
+					"enabled":                   false,
+					"policies":                  []map[string]interface{}{{"sample_rate": 0.5}},
+					"interval":                  "2m",
+					"ingest_rate_decay":         1.0,
+					"max_dynamic_services":      500,
+					"finalize_concurrency":      4,
+					"storage_limit":             "1GB",
+					"strategy":                  "diversity",
+					"keep_root_on_drop":         true,
+					"emit_sampling_probability": true,
+					"sampled_by_label":          "sampled_by",
+					"bulk_max_requests":         20,
+					"bulk_flush_bytes":          "1MB",
+					"circuit_breaker":           map[string]interface{}{"failure_threshold": 3},
+					"storage_write":             map[string]interface{}{"workers": 4},
+					"trace_completion":          map[string]interface{}{"enabled": true},
+					"sampled_traces":            map[string]interface{}{"namespace": "long_term", "compression": "zstd"},
+					"audit_log":                 map[string]interface{}{"enabled": true, "max_size": "1MiB"},
+					"decision_metrics":          map[string]interface{}{"enabled": true, "dataset": "apm.sampling_decisions"},
 				},
 				"data_streams": map[string]interface{}{
 					"namespace":            "foo",
@@ -362,6 +429,10 @@ func TestUnpackConfig(t *testing.T) {
 					Enabled: true,
 					URL:     "/debug/vars",
 				},
+				Prometheus: PrometheusConfig{
+					Enabled: false,
+					URL:     "/metrics",
+				},
 				Pprof: PprofConfig{
 					Enabled: true,
 				},
@@ -396,23 +467,75 @@ func TestUnpackConfig(t *testing.T) {
 						Interval:                       time.Minute,
 						MaxTransactionGroups:           10000,
 						HDRHistogramSignificantFigures: 2,
+						EvictionPolicy:                 "publish_individual",
 					},
 					ServiceDestinations: ServiceDestinationAggregationConfig{
-						Interval:  time.Minute,
-						MaxGroups: 10000,
+						Interval:       time.Minute,
+						MaxGroups:      10000,
+						GroupByOutcome: true,
 					},
+					TimestampAlignment: "start",
 				},
 				Sampling: SamplingConfig{
 					Tail: TailSamplingConfig{
-						Enabled:               false,
-						Policies:              []TailSamplingPolicy{{SampleRate: 0.5}},
-						ESConfig:              elasticsearch.DefaultConfig(),
-						Interval:              2 * time.Minute,
-						IngestRateDecayFactor: 1.0,
-						StorageGCInterval:     5 * time.Minute,
-						StorageLimit:          "1GB",
-						StorageLimitParsed:    1000000000,
-						TTL:                   30 * time.Minute,
+						Enabled:                 false,
+						Policies:                []TailSamplingPolicy{{SampleRate: 0.5}},
+						ESConfig:                elasticsearch.DefaultConfig(),
+						Interval:                2 * time.Minute,
+						IngestRateDecayFactor:   1.0,
+						MaxDynamicServices:      500,
+						FinalizeConcurrency:     4,
+						StorageGCInterval:       5 * time.Minute,
+						StorageLimit:            "1GB",
+						StorageLimitParsed:      1000000000,
+						TTL:                     30 * time.Minute,
+						Strategy:                "diversity",
+						TraceIDCollision:        "merge",
+						KeepRootOnDrop:          true,
+						EmitSamplingProbability: true,
+						SampledByLabel:          "sampled_by",
+						BulkMaxRequests:         20,
+						BulkFlushBytes:          "1MB",
+						BulkFlushBytesParsed:    1000000,
+						CircuitBreaker: TailSamplingCircuitBreakerConfig{
+							FailureThreshold: 3,
+							Cooldown:         30 * time.Second,
+						},
+						PublishRetry: TailSamplingPublishRetryConfig{
+							Backoff: time.Second,
+							Jitter:  0.5,
+							Timeout: 30 * time.Second,
+						},
+						StorageValueLogFileSize:       "128MiB",
+						StorageValueLogFileSizeParsed: 128 * 1024 * 1024,
+						StorageCompression:            "none",
+						StorageKeySchema:              "trace_event",
+						StorageCorruption: TailSamplingStorageCorruptionConfig{
+							Action: "move",
+						},
+						SampledTraces: TailSamplingSampledTracesConfig{
+							Namespace:   "long_term",
+							Compression: "zstd",
+						},
+						StorageWrite: TailSamplingStorageWriteConfig{
+							Workers:   4,
+							QueueSize: 1000,
+						},
+						TraceCompletion: TailSamplingTraceCompletionConfig{
+							Enabled: true,
+							Label:   "trace_complete",
+						},
+						AuditLog: TailSamplingAuditLogConfig{
+							Enabled:       true,
+							Path:          "tail_sampling_audit",
+							MaxSize:       "1MiB",
+							MaxSizeParsed: 1024 * 1024,
+							MaxBackups:    7,
+						},
+						DecisionMetrics: TailSamplingDecisionMetricsConfig{
+							Enabled: true,
+							Dataset: "apm.sampling_decisions",
+						},
 					},
 				},
 				DataStreams: DataStreamsConfig{
@@ -0,0 +1,60 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// DeadLetterOutputFile identifies the dead-letter output which writes
+	// events to a file as newline-delimited JSON.
+	DeadLetterOutputFile = "file"
+
+	// DeadLetterOutputDataStream identifies the dead-letter output which
+	// indexes events into a separate data stream.
+	DeadLetterOutputDataStream = "data_stream"
+)
+
+// DeadLetterConfig holds configuration for recording events which could not
+// be processed, e.g. due to errors indexing them, for later inspection or
+// replay, rather than dropping them.
+type DeadLetterConfig struct {
+	// Output holds the dead-letter output: DeadLetterOutputFile or
+	// DeadLetterOutputDataStream. If Output is empty, which is the
+	// default, events which could not be processed are dropped.
+	Output string `config:"output"`
+
+	// Path holds the path of the file to which events are appended,
+	// when Output is DeadLetterOutputFile.
+	Path string `config:"path"`
+}
+
+// Validate validates the dead-letter output and its settings.
+func (c *DeadLetterConfig) Validate() error {
+	switch c.Output {
+	case "", DeadLetterOutputDataStream:
+	case DeadLetterOutputFile:
+		if c.Path == "" {
+			return errors.New("path must be specified for file output")
+		}
+	default:
+		return errors.Errorf("invalid output %q", c.Output)
+	}
+	return nil
+}
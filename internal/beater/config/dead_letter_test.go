@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/config"
+)
+
+func TestDeadLetterConfig(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterConfig{}, cfg.DeadLetter)
+
+	cfg, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"dead_letter.output": "file",
+		"dead_letter.path":   "/tmp/dead_letter.ndjson",
+	}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterConfig{Output: DeadLetterOutputFile, Path: "/tmp/dead_letter.ndjson"}, cfg.DeadLetter)
+
+	cfg, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"dead_letter.output": "data_stream",
+	}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterConfig{Output: DeadLetterOutputDataStream}, cfg.DeadLetter)
+}
+
+func TestDeadLetterConfigInvalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		config map[string]interface{}
+		expect string
+	}{
+		"unknown output": {
+			config: map[string]interface{}{"dead_letter.output": "queue"},
+			expect: `Error processing configuration: invalid output "queue" accessing 'dead_letter'`,
+		},
+		"file without path": {
+			config: map[string]interface{}{"dead_letter.output": "file"},
+			expect: "Error processing configuration: path must be specified for file output accessing 'dead_letter'",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewConfig(config.MustNewConfigFrom(test.config), nil)
+			assert.EqualError(t, err, test.expect)
+		})
+	}
+}
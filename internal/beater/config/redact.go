@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/elastic-agent-libs/config"
+)
+
+// redactedValue replaces the value of secret settings in RedactedJSON.
+const redactedValue = "[REDACTED]"
+
+// redactedKeys holds the names of settings whose values are secret.
+var redactedKeys = map[string]bool{
+	"api_key":        true,
+	"headers":        true,
+	"key":            true,
+	"key_passphrase": true,
+	"password":       true,
+	"secret_token":   true,
+	"service_token":  true,
+}
+
+// RedactedJSON returns the fully-resolved config as JSON, with the values of
+// secret settings such as passwords and API keys redacted. Secret settings
+// which are unset are left empty, so it remains clear whether they are set.
+func (c *Config) RedactedJSON() ([]byte, error) {
+	cfg, err := config.NewConfigFrom(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "error converting config")
+	}
+	var m map[string]interface{}
+	if err := cfg.Unpack(&m); err != nil {
+		return nil, errors.Wrap(err, "error unpacking config")
+	}
+	return json.Marshal(redact(m))
+}
+
+func redact(in interface{}) interface{} {
+	switch in := in.(type) {
+	case map[string]interface{}:
+		for k, v := range in {
+			if redactedKeys[k] && !isEmptyValue(v) {
+				if _, ok := v.(map[string]interface{}); !ok || k == "headers" {
+					in[k] = redactedValue
+					continue
+				}
+			}
+			in[k] = redact(v)
+		}
+	case []interface{}:
+		for i, v := range in {
+			in[i] = redact(v)
+		}
+	}
+	return in
+}
+
+func isEmptyValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
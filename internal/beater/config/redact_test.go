@@ -0,0 +1,62 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/config"
+)
+
+func TestRedactedJSON(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"auth.secret_token":                        "secret",
+		"auth.api_key.enabled":                     true,
+		"kibana.password":                          "kibana_password",
+		"kibana.headers":                           map[string]interface{}{"Authorization": "Bearer secret"},
+		"aggregation.transactions.max_groups":      123,
+		"rum.source_mapping.elasticsearch.hosts":   []string{"es:9200"},
+		"rum.source_mapping.elasticsearch.api_key": "sourcemap_api_key",
+	}), nil)
+	require.NoError(t, err)
+
+	data, err := cfg.RedactedJSON()
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), `"secret"`)
+	assert.NotContains(t, string(data), "kibana_password")
+	assert.NotContains(t, string(data), "sourcemap_api_key")
+	assert.NotContains(t, string(data), "Bearer")
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	auth := decoded["auth"].(map[string]interface{})
+	assert.Equal(t, "[REDACTED]", auth["secret_token"])
+	assert.Equal(t, true, auth["api_key"].(map[string]interface{})["enabled"])
+	kibana := decoded["kibana"].(map[string]interface{})
+	assert.Equal(t, "[REDACTED]", kibana["password"])
+	assert.Equal(t, "[REDACTED]", kibana["headers"])
+	assert.Equal(t, "", kibana["username"])
+	sourcemapES := decoded["rum"].(map[string]interface{})["source_mapping"].(map[string]interface{})["elasticsearch"].(map[string]interface{})
+	assert.Equal(t, "[REDACTED]", sourcemapES["api_key"])
+	assert.Equal(t, []interface{}{"es:9200"}, sourcemapES["hosts"])
+	assert.Equal(t, float64(123), decoded["aggregation"].(map[string]interface{})["transactions"].(map[string]interface{})["max_groups"])
+}
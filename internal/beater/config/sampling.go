@@ -18,6 +18,13 @@
 package config
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -27,6 +34,8 @@ import (
 	"github.com/elastic/apm-server/internal/logs"
 	"github.com/elastic/elastic-agent-libs/config"
 	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+	"github.com/elastic/elastic-agent-libs/paths"
 )
 
 // SamplingConfig holds configuration related to sampling.
@@ -45,6 +54,139 @@ type TailSamplingConfig struct {
 	// that dropping non-matching traces is intentional.
 	Policies []TailSamplingPolicy `config:"policies"`
 
+	// PoliciesFile holds the path to an optional YAML or JSON file defining
+	// additional tail-sampling policies, under a top-level "policies" key.
+	//
+	// Policies loaded from the file are appended to Policies, and so are
+	// matched after any policies defined inline. A relative path is resolved
+	// relative to the config path.
+	//
+	// The file is checked for changes periodically while the server is
+	// running. When it changes, the policies are reloaded with LoadPolicies
+	// and swapped into the running tail-sampling processor, keeping the
+	// traces already admitted to its sampling reservoirs. If the changed
+	// file is invalid, the error is logged and the current policies are
+	// kept.
+	PoliciesFile string `config:"policies_file"`
+
+	// ShadowPolicies holds an optional second set of tail-sampling policies,
+	// which are evaluated alongside Policies without affecting sampling
+	// decisions. The number of traces each set of policies samples is
+	// reported in monitoring metrics, for comparing a candidate policy set
+	// with the live one before rolling it out.
+	//
+	// Like Policies, ShadowPolicies must include at least one policy that
+	// matches all traces, if it is non-empty.
+	ShadowPolicies []TailSamplingPolicy `config:"shadow_policies"`
+
+	// TraceNameNormalizers holds optional rules for normalizing root
+	// transaction names before they are matched against the trace.name
+	// criteria of policies, e.g. for replacing IDs in URL paths with a
+	// placeholder. The rules are applied in order.
+	TraceNameNormalizers []TailSamplingTraceNameNormalizer `config:"trace_name_normalizers"`
+
+	// DefaultTraceOutcome holds an optional outcome, "success", "failure",
+	// or "unknown", which root transactions with an empty outcome are
+	// treated as having when matched against the trace.outcome criteria
+	// of policies. By default this is empty, and such root transactions
+	// do not match any policy with trace.outcome specified.
+	DefaultTraceOutcome string `config:"default_trace_outcome"`
+
+	// Strategy holds the strategy used for choosing which root transactions
+	// to keep within each policy's sample rate: "random", the default, or
+	// "diversity". The "diversity" strategy prefers keeping root transactions
+	// which differ by name, outcome, and duration, so that the traces kept
+	// cover more cases, e.g. for debugging-oriented retention.
+	Strategy string `config:"strategy"`
+
+	// TraceIDCollision holds the handling of trace ID collisions, where
+	// a root transaction is received for a trace ID which already has a
+	// different root transaction, e.g. due to agents generating trace IDs
+	// poorly: "merge", the default, treats them as a single trace; "separate"
+	// samples the colliding root transaction independently of the trace; and
+	// "drop" drops the colliding root transaction. Collisions are counted in
+	// monitoring metrics regardless.
+	TraceIDCollision string `config:"trace_id_collision"`
+
+	// DroppedTraceMetrics controls whether metrics are published counting
+	// the traces dropped by tail-sampling, by service and transaction name.
+	// This is disabled by default, to avoid the additional cardinality.
+	DroppedTraceMetrics bool `config:"dropped_trace_metrics"`
+
+	// KeepRootOnDrop controls whether the root transactions of dropped
+	// traces are published without the rest of their traces, keeping
+	// service-level throughput and latency dashboards populated while
+	// span detail is discarded. This is disabled by default.
+	KeepRootOnDrop bool `config:"keep_root_on_drop"`
+
+	// EmitSamplingProbability controls whether the events of sampled
+	// traces are annotated with the probability with which they were
+	// sampled, in the "sampling_probability" numeric label, for correcting
+	// counts for the sampling rate downstream. This is disabled by default.
+	EmitSamplingProbability bool `config:"emit_sampling_probability"`
+
+	// SampledByLabel, if non-empty, holds the name of a label set on the
+	// events of sampled traces, identifying the policy by which they were
+	// sampled as "tail:<policy name>", for filtering downstream. This is
+	// disabled by default, to avoid altering events unexpectedly.
+	SampledByLabel string `config:"sampled_by_label"`
+
+	// TraceIDs holds lists of trace IDs, or trace ID prefixes ending with
+	// "*", which are consulted before policy evaluation: traces in the allow
+	// list are always kept, and traces in the deny list are always dropped.
+	//
+	// These are intended as short-lived debugging tools. Like other config,
+	// they are applied when the config is reloaded.
+	TraceIDs struct {
+		Allow []string `config:"allow"`
+		Deny  []string `config:"deny"`
+	} `config:"trace_ids"`
+
+	// MaxDynamicServices holds the maximum number of services without an
+	// explicit policy, for which sampling state is tracked. Once this is
+	// reached, the least recently seen service which has not been seen in
+	// the current interval is evicted to make room for a new service; if
+	// there is none, root transactions from new services are dropped.
+	MaxDynamicServices int `config:"max_dynamic_services" validate:"min=1"`
+
+	// FinalizeConcurrency holds the maximum number of batches of sampled
+	// traces whose events are read from storage and reported concurrently
+	// at the end of each interval. Increasing this drains sampled traces
+	// faster, at the cost of greater spikes in CPU and memory usage.
+	// This defaults to 1, reporting batches one at a time.
+	FinalizeConcurrency int `config:"finalize_concurrency" validate:"min=1"`
+
+	// BypassServices holds the names of services whose transactions and
+	// spans skip tail-sampling entirely, and are always indexed without
+	// being buffered, e.g. for critical services requiring full retention.
+	BypassServices []string `config:"bypass_services"`
+
+	// BulkMaxRequests holds the maximum number of concurrent bulk requests
+	// to make when publishing sampled trace IDs to Elasticsearch.
+	BulkMaxRequests int `config:"bulk_max_requests" validate:"min=1"`
+
+	// BulkFlushBytes holds the size at which bulk requests are flushed when
+	// publishing sampled trace IDs to Elasticsearch, e.g. "5MiB".
+	BulkFlushBytes       string `config:"bulk_flush_bytes"`
+	BulkFlushBytesParsed int
+
+	// CircuitBreaker holds configuration for the circuit breaker guarding
+	// requests to Elasticsearch when publishing sampled trace IDs.
+	CircuitBreaker TailSamplingCircuitBreakerConfig `config:"circuit_breaker"`
+
+	// PublishRetry holds configuration for retrying failed requests to
+	// Elasticsearch when publishing sampled trace IDs.
+	PublishRetry TailSamplingPublishRetryConfig `config:"publish_retry"`
+
+	// SampledTraces holds configuration for the data stream to which
+	// sampled trace IDs are published, and from which they are searched.
+	SampledTraces TailSamplingSampledTracesConfig `config:"sampled_traces"`
+
+	// IngestRateDecayEnvironments holds optional ingest_rate_decay overrides
+	// by service environment. An override applies to the policies with the
+	// matching service.environment; other policies use ingest_rate_decay.
+	IngestRateDecayEnvironments []TailSamplingIngestRateDecayEnvironment `config:"ingest_rate_decay_environments"`
+
 	ESConfig              *elasticsearch.Config `config:"elasticsearch"`
 	Interval              time.Duration         `config:"interval" validate:"min=1s"`
 	IngestRateDecayFactor float64               `config:"ingest_rate_decay" validate:"min=0, max=1"`
@@ -53,11 +195,284 @@ type TailSamplingConfig struct {
 	StorageLimit          string                `config:"storage_limit"`
 	StorageLimitParsed    uint64
 
+	// StorageValueLogFileSize holds the maximum size of each of the files
+	// holding buffered event data on disk, e.g. "128MiB". Disk space is
+	// reclaimed a file at a time, so smaller files allow space to be
+	// reclaimed sooner, at the cost of more files. This must be in the
+	// range [1MiB,2GiB), and defaults to 128MiB.
+	StorageValueLogFileSize       string `config:"storage_value_log_file_size"`
+	StorageValueLogFileSizeParsed int64
+
+	// StorageCompression holds the compression used for buffered events
+	// stored on disk: "none", which is the default, "snappy", or "zstd".
+	// Compression reduces the storage used by each event at the cost of
+	// CPU; zstd compresses better than snappy, but is more expensive.
+	// Events already in storage remain readable if this is changed.
+	StorageCompression string `config:"storage_compression"`
+
+	// StorageKeySchema holds the layout of the keys of buffered events
+	// stored on disk: "trace_event", which is the default, or
+	// "trace_timestamp_event", which adds the event timestamp after the
+	// trace ID so a trace's events are ordered by time, enabling range
+	// scans. Events already in storage remain readable if this is changed.
+	StorageKeySchema string `config:"storage_key_schema"`
+
+	// DropOnStorageLimit controls whether events of traces which cannot be
+	// stored, because storage_limit has been reached, are dropped. By
+	// default they are indexed without waiting for a sampling decision.
+	// Either way, traces already stored continue to be sampled as usual.
+	DropOnStorageLimit bool `config:"drop_on_storage_limit"`
+
+	// FinalizeOnStorageLimit controls whether, once storage_limit has been
+	// reached, the sampling reservoirs are finalized early rather than at
+	// the next interval, and the stored events of traces not sampled are
+	// deleted to reclaim space for new traces. Some sampling decisions are
+	// then made before traces are complete. Disabled by default.
+	FinalizeOnStorageLimit bool `config:"finalize_on_storage_limit"`
+
+	// StorageCorruption holds configuration for recreating local storage
+	// when it is persistently corrupt.
+	StorageCorruption TailSamplingStorageCorruptionConfig `config:"storage_corruption"`
+
+	// OutcomeTTL holds optional TTLs for buffered events by event outcome,
+	// overriding TTL, e.g. for buffering failed events for longer.
+	OutcomeTTL TailSamplingOutcomeTTLConfig `config:"outcome_ttl"`
+
+	// OrphanTraceTimeout holds the amount of time after which traces with
+	// no observed root transaction are dropped, and their events deleted
+	// from local storage, rather than waiting for TTL. If zero, which is
+	// the default, such traces are kept until TTL.
+	//
+	// Root transactions may be received by another APM Server, so this
+	// must comfortably exceed the time taken for sampling decisions to be
+	// shared between servers: up to flush_interval and a half, plus the
+	// indexing latency. Sampling decisions received after a trace has been
+	// dropped cannot be honoured, as its events have been deleted.
+	OrphanTraceTimeout time.Duration `config:"orphan_trace_timeout"`
+
+	// StorageWrite holds configuration for writing buffered events to
+	// local storage asynchronously.
+	StorageWrite TailSamplingStorageWriteConfig `config:"storage_write"`
+
+	// StoredLabels holds limits on the labels stored with each buffered
+	// event, for bounding the storage used by high-cardinality labels.
+	StoredLabels TailSamplingStoredLabelsConfig `config:"stored_labels"`
+
+	// TraceCompletion holds configuration for sampling traces as soon as
+	// agents signal that they are complete, rather than at the next
+	// interval.
+	TraceCompletion TailSamplingTraceCompletionConfig `config:"trace_completion"`
+
+	// AuditLog holds configuration for recording each local sampling
+	// decision to a rotating file, e.g. for compliance.
+	AuditLog TailSamplingAuditLogConfig `config:"audit_log"`
+
+	// DecisionMetrics holds configuration for publishing metrics counting
+	// the traces kept and dropped, by policy and service, to a metrics
+	// data stream.
+	DecisionMetrics TailSamplingDecisionMetricsConfig `config:"decision_metrics"`
+
 	esConfigured bool
+
+	// numInlinePolicies holds the number of policies defined inline, which
+	// precede those loaded from PoliciesFile in Policies, if PoliciesFile
+	// is specified.
+	numInlinePolicies int
+
+	// unpackErr holds the error which caused tail-sampling to be
+	// disabled when unpacking the config, if any.
+	unpackErr error
+}
+
+// UnpackError returns the error which caused tail-sampling to be disabled
+// when the config was unpacked, if any.
+func (c *TailSamplingConfig) UnpackError() error {
+	return c.unpackErr
+}
+
+// TailSamplingCircuitBreakerConfig holds configuration for the circuit breaker
+// guarding requests to Elasticsearch when publishing sampled trace IDs.
+type TailSamplingCircuitBreakerConfig struct {
+	// FailureThreshold holds the number of consecutive failed requests after
+	// which the circuit breaker opens, short-circuiting further requests for
+	// Cooldown. If FailureThreshold is zero, no circuit breaker is used.
+	FailureThreshold int `config:"failure_threshold" validate:"min=0"`
+
+	// Cooldown holds the amount of time for which the circuit breaker stays
+	// open, before allowing a request through to probe Elasticsearch.
+	Cooldown time.Duration `config:"cooldown" validate:"min=1s"`
+}
+
+// TailSamplingPublishRetryConfig holds configuration for retrying failed
+// requests to Elasticsearch when publishing sampled trace IDs. Requests which
+// fail with a network error, a 429 (Too Many Requests) response, or a 5xx
+// response are retried with exponential backoff.
+type TailSamplingPublishRetryConfig struct {
+	// MaxRetries holds the maximum number of times a failed request is
+	// retried. If MaxRetries is zero, which is the default, failed requests
+	// are not retried.
+	MaxRetries int `config:"max_retries" validate:"min=0"`
+
+	// Backoff holds the amount of time to wait before the first retry,
+	// doubling for each subsequent retry. Defaults to 1s.
+	Backoff time.Duration `config:"backoff" validate:"min=1ms"`
+
+	// Jitter holds the fraction of each backoff, in the range [0,1], which
+	// is randomised, so that servers do not retry in lockstep. Defaults to
+	// 0.5.
+	Jitter float64 `config:"jitter"`
+
+	// Timeout holds the maximum amount of time to spend on a request,
+	// including its retries; no retry is made if its backoff would exceed
+	// the timeout. Defaults to 30s.
+	Timeout time.Duration `config:"timeout" validate:"min=1ms"`
+}
+
+// TailSamplingSampledTracesConfig holds configuration for the data stream
+// to which sampled trace IDs are published.
+type TailSamplingSampledTracesConfig struct {
+	// Namespace holds an optional namespace for the traces-apm.sampled data
+	// stream, overriding data_streams.namespace. This allows sampled trace
+	// IDs to be written to a data stream with its own index template and
+	// lifecycle policy, rolling over independently of the raw traces.
+	//
+	// All APM Servers sharing sampling decisions must use the same namespace.
+	// The namespace must follow the data stream naming scheme: it must be
+	// lowercase, and must not contain "-".
+	Namespace string `config:"namespace"`
+
+	// Compression holds the codec used for compressing requests publishing
+	// sampled trace IDs: "gzip", which is the default, "zstd", or "none".
+	// The gzip compression level is taken from the elasticsearch config.
+	//
+	// zstd may provide better throughput and compression, but is not
+	// supported by all versions of Elasticsearch. If Elasticsearch does
+	// not accept zstd-compressed requests, gzip is used instead.
+	Compression string `config:"compression"`
+}
+
+// TailSamplingStorageWriteConfig holds configuration for writing buffered
+// events to local storage asynchronously, decoupling storage writes from
+// intake.
+type TailSamplingStorageWriteConfig struct {
+	// Workers holds the number of workers writing to local storage.
+	// If Workers is zero, which is the default, events are written
+	// synchronously during intake.
+	Workers int `config:"workers" validate:"min=0"`
+
+	// QueueSize holds the maximum number of writes queued for the
+	// workers. Once the queue is full, intake blocks until there is
+	// room in the queue.
+	QueueSize int `config:"queue_size" validate:"min=0"`
+}
+
+// TailSamplingIngestRateDecayEnvironment holds the ingest rate decay factor
+// for the policies of a service environment.
+type TailSamplingIngestRateDecayEnvironment struct {
+	Environment string  `config:"environment" validate:"required"`
+	Decay       float64 `config:"decay" validate:"min=0, max=1"`
+}
+
+// TailSamplingStorageCorruptionConfig holds configuration for recreating
+// local storage when it is persistently corrupt, rather than continuing to
+// fail reads and writes until the server is restarted.
+type TailSamplingStorageCorruptionConfig struct {
+	// Threshold holds the number of storage corruption errors after which
+	// local storage is recreated, discarding buffered events. If storage
+	// cannot be recreated, it is unavailable until a retry succeeds. If
+	// Threshold is zero, which is the default, storage is never recreated.
+	Threshold int `config:"threshold" validate:"min=0"`
+
+	// Action controls what is done with the corrupt storage directory when
+	// storage is recreated: "move", which is the default, renames it so it
+	// can be inspected later, and "wipe" deletes it.
+	Action string `config:"action"`
+}
+
+// TailSamplingStoredLabelsConfig holds limits on the labels stored with each
+// buffered event.
+type TailSamplingStoredLabelsConfig struct {
+	// MaxLabels holds the maximum number of labels stored with each
+	// buffered event. If MaxLabels is zero, which is the default, the
+	// number of labels is not limited.
+	MaxLabels int `config:"max_labels" validate:"min=0"`
+
+	// MaxSize holds the maximum total size of the names and values of
+	// the labels stored with each buffered event, e.g. "4KiB". If MaxSize
+	// is empty, which is the default, the size of labels is not limited.
+	MaxSize       string `config:"max_size"`
+	MaxSizeParsed int
+
+	// Preserve holds the names of labels which are kept in preference
+	// to others when the labels of a buffered event are truncated.
+	Preserve []string `config:"preserve"`
+}
+
+// TailSamplingOutcomeTTLConfig holds TTLs for buffered events by event
+// outcome. Zero values, which are the default, mean the global TTL is used.
+type TailSamplingOutcomeTTLConfig struct {
+	Success time.Duration `config:"success" validate:"min=0"`
+	Failure time.Duration `config:"failure" validate:"min=0"`
+	Unknown time.Duration `config:"unknown" validate:"min=0"`
+}
+
+// TailSamplingTraceCompletionConfig holds configuration for sampling traces
+// as soon as agents signal that they are complete.
+type TailSamplingTraceCompletionConfig struct {
+	// Enabled controls whether agents may signal that traces are complete.
+	// This is disabled by default.
+	Enabled bool `config:"enabled"`
+
+	// Label holds the name of the label which, when set to "true" on a
+	// root transaction, signals that its trace is complete. Completed
+	// traces are sampled immediately, at the matching policy's sample
+	// rate, and their buffered events indexed without waiting for the
+	// next interval.
+	Label string `config:"label"`
+}
+
+// TailSamplingAuditLogConfig holds configuration for the tail-sampling audit
+// log, which records each local sampling decision.
+type TailSamplingAuditLogConfig struct {
+	// Enabled controls whether sampling decisions are recorded. This is
+	// disabled by default.
+	Enabled bool `config:"enabled"`
+
+	// Path holds the path of the audit log files, to which the date and
+	// ".ndjson" are appended. Relative paths are resolved against the
+	// logs path.
+	Path string `config:"path"`
+
+	// MaxSize holds the size at which the audit log file is rotated,
+	// e.g. "10MiB".
+	MaxSize       string `config:"max_size"`
+	MaxSizeParsed uint64
+
+	// MaxBackups holds the number of rotated audit log files to keep.
+	// Older files are deleted.
+	MaxBackups uint `config:"max_backups" validate:"max=1024"`
+}
+
+// TailSamplingDecisionMetricsConfig holds configuration for publishing metrics
+// counting the traces kept and dropped by tail-sampling.
+type TailSamplingDecisionMetricsConfig struct {
+	// Enabled controls whether the metrics are published at each interval,
+	// making sampling effectiveness queryable over time. This is disabled
+	// by default.
+	Enabled bool `config:"enabled"`
+
+	// Dataset holds the dataset of the metrics data stream to which the
+	// metrics are published. The namespace is data_streams.namespace.
+	// The dataset must not contain "-".
+	Dataset string `config:"dataset"`
 }
 
 // TailSamplingPolicy holds a tail-sampling policy.
 type TailSamplingPolicy struct {
+	// Name holds an optional name for the policy, identifying it in
+	// monitoring metrics. Names must be unique within a set of policies.
+	Name string `config:"name"`
+
 	// Service holds attributes of the service which this policy matches.
 	Service struct {
 		Name        string `config:"name"`
@@ -65,15 +480,267 @@ type TailSamplingPolicy struct {
 	} `config:"service"`
 
 	// Trace holds attributes of the trace which this policy matches.
-	Trace struct {
-		Name    string `config:"name"`
-		Outcome string `config:"outcome"`
-	} `config:"trace"`
+	// HasError restricts the policy to traces with at least one error,
+	// and MinDuration and MaxDuration to traces whose root transaction
+	// duration is in the range [min_duration, max_duration).
+	//
+	// HTTPStatusCode restricts the policy to traces whose root transaction
+	// has a matching HTTP response status code: a single status code, e.g.
+	// "404", a status class, e.g. "5xx", or an inclusive range, e.g.
+	// "500-504". It is parsed into HTTPStatusCodeMin and HTTPStatusCodeMax.
+	//
+	// MinSpanCount restricts the policy to traces with at least that many
+	// spans stored when the sampling decision is made.
+	Trace TailSamplingTraceCriteria `config:"trace"`
+
+	// Attributes holds OTLP resource and span attributes which this policy
+	// matches, as an alternative to Service and Trace: service.name,
+	// deployment.environment, and otel.status_code.
+	Attributes *config.C `config:"attributes"`
+
+	// Match holds an optional matcher expression, which traces must match
+	// in addition to Service and Trace. This can be used for combining
+	// criteria with OR logic.
+	Match *TailSamplingPolicyMatcher `config:"match"`
 
 	// SampleRate holds the sample rate applied for this policy.
 	SampleRate float64 `config:"sample_rate" validate:"min=0, max=1"`
 }
 
+// TailSamplingTraceCriteria holds the trace criteria of a tail-sampling
+// policy or matcher.
+type TailSamplingTraceCriteria struct {
+	Name           string        `config:"name"`
+	Outcome        string        `config:"outcome"`
+	HasError       bool          `config:"has_error"`
+	MinDuration    time.Duration `config:"min_duration"`
+	MaxDuration    time.Duration `config:"max_duration"`
+	HTTPStatusCode string        `config:"http_status_code"`
+	MinSpanCount   int           `config:"min_span_count"`
+
+	HTTPStatusCodeMin int
+	HTTPStatusCodeMax int
+}
+
+// validate validates the trace criteria, parsing HTTPStatusCode.
+func (c *TailSamplingTraceCriteria) validate() error {
+	if err := validateTailSamplingTraceDuration(c.MinDuration, c.MaxDuration); err != nil {
+		return err
+	}
+	if c.MinSpanCount < 0 {
+		return errors.New("trace.min_span_count must not be negative")
+	}
+	var err error
+	c.HTTPStatusCodeMin, c.HTTPStatusCodeMax, err = parseHTTPStatusCodeRange(c.HTTPStatusCode)
+	return err
+}
+
+// TailSamplingPolicyMatcher holds a tail-sampling policy matcher expression.
+//
+// Exactly one of the following must be specified: Service, Trace, and/or
+// Attributes criteria, which must all match; All, a list of matchers which must all
+// match; or Any, a list of matchers of which at least one must match.
+type TailSamplingPolicyMatcher struct {
+	Service struct {
+		Name        string `config:"name"`
+		Environment string `config:"environment"`
+	} `config:"service"`
+
+	Trace TailSamplingTraceCriteria `config:"trace"`
+
+	Attributes *config.C `config:"attributes"`
+
+	All []TailSamplingPolicyMatcher `config:"all"`
+	Any []TailSamplingPolicyMatcher `config:"any"`
+}
+
+// Validate validates the matcher. Matchers in All and Any are validated
+// when they are unpacked.
+func (m *TailSamplingPolicyMatcher) Validate() error {
+	var n int
+	if m.Service.Name != "" || m.Service.Environment != "" || m.Trace.Name != "" || m.Trace.Outcome != "" || m.Trace.HasError ||
+		m.Trace.MinDuration != 0 || m.Trace.MaxDuration != 0 || m.Trace.HTTPStatusCode != "" || m.Trace.MinSpanCount != 0 ||
+		m.Attributes != nil {
+		n++
+	}
+	if len(m.All) > 0 {
+		n++
+	}
+	if len(m.Any) > 0 {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of criteria (service, trace, attributes), all, or any must be specified")
+	}
+	return m.Trace.validate()
+}
+
+// Validate validates the policy. Its matcher, if any, is validated when it
+// is unpacked.
+func (p *TailSamplingPolicy) Validate() error {
+	return p.Trace.validate()
+}
+
+// validateTailSamplingTraceDuration validates the trace.min_duration and
+// trace.max_duration criteria of a policy or matcher.
+func validateTailSamplingTraceDuration(min, max time.Duration) error {
+	if min < 0 || max < 0 {
+		return errors.New("trace.min_duration and trace.max_duration must not be negative")
+	}
+	if max > 0 && min >= max {
+		return errors.Errorf("trace.min_duration %s must be less than trace.max_duration %s", min, max)
+	}
+	return nil
+}
+
+// parseHTTPStatusCodeRange parses the trace.http_status_code criterion of a
+// policy or matcher, returning the inclusive range of status codes which it
+// matches. The criterion may be a single status code, e.g. "404", a status
+// class, e.g. "5xx", or an inclusive range, e.g. "500-504". If s is empty,
+// parseHTTPStatusCodeRange returns zeroes.
+func parseHTTPStatusCodeRange(s string) (min, max int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	invalid := func() (int, int, error) {
+		return 0, 0, errors.Errorf("invalid trace.http_status_code %q", s)
+	}
+	if len(s) == 3 && s[0] >= '1' && s[0] <= '5' && strings.EqualFold(s[1:], "xx") {
+		class := int(s[0]-'0') * 100
+		return class, class + 99, nil
+	}
+	minString, maxString := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		minString, maxString = s[:i], s[i+1:]
+	}
+	if min, err = strconv.Atoi(strings.TrimSpace(minString)); err != nil {
+		return invalid()
+	}
+	if max, err = strconv.Atoi(strings.TrimSpace(maxString)); err != nil {
+		return invalid()
+	}
+	if min > max {
+		return invalid()
+	}
+	if min < 100 || max > 599 {
+		return 0, 0, errors.Errorf("trace.http_status_code %q out of range [100,599]", s)
+	}
+	return min, max, nil
+}
+
+// tailSamplingAttributes holds the OTLP resource and span attributes which
+// may be used in tail-sampling policy criteria, mapped to the equivalent
+// criteria. Events received via OTLP are translated such that matching on
+// these attributes is equivalent to matching on the criteria, so a policy
+// matches traces uniformly whether they were received via OTLP or the
+// Elastic APM intake protocol.
+var tailSamplingAttributes = map[string]string{
+	"service.name":           "service.name",
+	"deployment.environment": "service.environment",
+	"otel.status_code":       "trace.outcome",
+}
+
+// otelStatusCodeOutcomes maps OTLP span status codes, as used for the
+// "otel.status_code" attribute, to the equivalent event outcomes.
+var otelStatusCodeOutcomes = map[string]string{
+	"OK":    "success",
+	"ERROR": "failure",
+	"UNSET": "unknown",
+}
+
+// resolvetailSamplingAttributes sets the criteria equivalent to the OTLP
+// attributes in attrs, returning an error if an attribute is unsupported
+// or conflicts with a criterion specified directly.
+func resolvetailSamplingAttributes(attrs *config.C, serviceName, serviceEnvironment, traceOutcome *string) error {
+	if attrs == nil {
+		return nil
+	}
+	var m mapstr.M
+	if err := attrs.Unpack(&m); err != nil {
+		return errors.Wrap(err, "error unpacking attributes")
+	}
+	flattened := m.Flatten()
+	keys := make([]string, 0, len(flattened))
+	for key := range flattened {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, ok := flattened[key].(string)
+		if !ok {
+			return errors.Errorf("invalid attribute %q: expected string value", key)
+		}
+		var criterion *string
+		switch tailSamplingAttributes[key] {
+		case "service.name":
+			criterion = serviceName
+		case "service.environment":
+			criterion = serviceEnvironment
+		case "trace.outcome":
+			outcome, ok := otelStatusCodeOutcomes[value]
+			if !ok {
+				return errors.Errorf("invalid attribute %q: unknown status code %q", key, value)
+			}
+			criterion, value = traceOutcome, outcome
+		default:
+			return errors.Errorf("unsupported attribute %q", key)
+		}
+		if *criterion != "" && *criterion != value {
+			return errors.Errorf("attribute %q conflicts with %s %q", key, tailSamplingAttributes[key], *criterion)
+		}
+		*criterion = value
+	}
+	return nil
+}
+
+// resolveAttributes sets the criteria equivalent to the policy's attributes,
+// and those of its matcher, if any.
+func (p *TailSamplingPolicy) resolveAttributes() error {
+	if err := resolvetailSamplingAttributes(
+		p.Attributes, &p.Service.Name, &p.Service.Environment, &p.Trace.Outcome,
+	); err != nil {
+		return err
+	}
+	if p.Match != nil {
+		return errors.Wrap(p.Match.resolveAttributes(), "invalid match")
+	}
+	return nil
+}
+
+// resolveAttributes sets the criteria equivalent to the matcher's attributes,
+// and those of any nested matchers.
+func (m *TailSamplingPolicyMatcher) resolveAttributes() error {
+	if err := resolvetailSamplingAttributes(
+		m.Attributes, &m.Service.Name, &m.Service.Environment, &m.Trace.Outcome,
+	); err != nil {
+		return err
+	}
+	for _, matchers := range [][]TailSamplingPolicyMatcher{m.All, m.Any} {
+		for i := range matchers {
+			if err := matchers[i].resolveAttributes(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TailSamplingTraceNameNormalizer holds a rule for normalizing root
+// transaction names: matches of the regular expression Pattern are
+// replaced with Replacement, which may refer to submatches, e.g. "$1".
+type TailSamplingTraceNameNormalizer struct {
+	Pattern     string `config:"pattern" validate:"required"`
+	Replacement string `config:"replacement"`
+}
+
+// Validate validates the normalizer's pattern.
+func (n *TailSamplingTraceNameNormalizer) Validate() error {
+	if _, err := regexp.Compile(n.Pattern); err != nil {
+		return errors.Wrap(err, "invalid pattern")
+	}
+	return nil
+}
+
 func (c *TailSamplingConfig) Unpack(in *config.C) error {
 	var err error
 	defer func() {
@@ -82,6 +749,7 @@ func (c *TailSamplingConfig) Unpack(in *config.C) error {
 			logger.Errorf("failed to setup tail sampling: %v", err)
 			logger.Info("continuing with tail sampling disabled")
 			*c = TailSamplingConfig(defaultTailSamplingConfig())
+			c.unpackErr = err
 		}
 	}()
 	type tailSamplingConfig TailSamplingConfig
@@ -95,6 +763,36 @@ func (c *TailSamplingConfig) Unpack(in *config.C) error {
 		return err
 	}
 	cfg.StorageLimitParsed = limit
+	if cfg.BulkFlushBytesParsed, err = parseBulkFlushBytes(cfg.BulkFlushBytes); err != nil {
+		return nil
+	}
+	if cfg.StorageValueLogFileSizeParsed, err = parseStorageValueLogFileSize(cfg.StorageValueLogFileSize); err != nil {
+		return nil
+	}
+	if cfg.StoredLabels.MaxSizeParsed, err = parseStoredLabelsMaxSize(cfg.StoredLabels.MaxSize); err != nil {
+		return nil
+	}
+	if cfg.AuditLog.MaxSizeParsed, err = humanize.ParseBytes(cfg.AuditLog.MaxSize); err != nil {
+		err = errors.Wrap(err, "error parsing audit_log.max_size")
+		return nil
+	}
+	if cfg.PoliciesFile != "" {
+		cfg.numInlinePolicies = len(cfg.Policies)
+		var filePolicies []TailSamplingPolicy
+		filePolicies, err = loadTailSamplingPolicies(paths.Resolve(paths.Config, cfg.PoliciesFile))
+		if err != nil {
+			err = errors.Wrap(err, "error loading policies file")
+			return nil
+		}
+		cfg.Policies = append(cfg.Policies, filePolicies...)
+	}
+	if err = resolveTailSamplingPolicyAttributes(cfg.Policies); err != nil {
+		return nil
+	}
+	if err = resolveTailSamplingPolicyAttributes(cfg.ShadowPolicies); err != nil {
+		err = errors.Wrap(err, "invalid shadow policies")
+		return nil
+	}
 	cfg.Enabled = in.Enabled()
 	*c = TailSamplingConfig(cfg)
 	c.esConfigured = in.HasField("elasticsearch")
@@ -107,23 +805,262 @@ func (c *TailSamplingConfig) Validate() error {
 	if !c.Enabled {
 		return nil
 	}
-	if len(c.Policies) == 0 {
-		return errors.New("no policies specified")
+	if err := validateTailSamplingPolicies(c.Policies); err != nil {
+		return err
+	}
+	if len(c.ShadowPolicies) > 0 && !hasDefaultTailSamplingPolicy(c.ShadowPolicies) {
+		return errors.New("no default (empty criteria) shadow policy specified")
+	}
+	if c.OrphanTraceTimeout < 0 || c.OrphanTraceTimeout >= c.TTL {
+		return errors.Errorf("orphan_trace_timeout %s out of range [0,ttl)", c.OrphanTraceTimeout)
+	}
+	switch c.DefaultTraceOutcome {
+	case "", "success", "failure", "unknown":
+	default:
+		return errors.Errorf("invalid default_trace_outcome %q", c.DefaultTraceOutcome)
+	}
+	switch c.Strategy {
+	case "random", "diversity":
+	default:
+		return errors.Errorf("invalid strategy %q", c.Strategy)
+	}
+	switch c.TraceIDCollision {
+	case "merge", "separate", "drop":
+	default:
+		return errors.Errorf("invalid trace_id_collision %q", c.TraceIDCollision)
 	}
-	var anyDefaultPolicy bool
-	for _, policy := range c.Policies {
-		if policy == (TailSamplingPolicy{SampleRate: policy.SampleRate}) {
-			// We have at least one default policy.
-			anyDefaultPolicy = true
-			break
+	if c.TraceCompletion.Enabled && c.TraceCompletion.Label == "" {
+		return errors.New("trace_completion.label must be specified when trace_completion is enabled")
+	}
+	decayEnvironments := make(map[string]bool, len(c.IngestRateDecayEnvironments))
+	for _, env := range c.IngestRateDecayEnvironments {
+		if decayEnvironments[env.Environment] {
+			return errors.Errorf("duplicate ingest_rate_decay_environments environment %q", env.Environment)
+		}
+		decayEnvironments[env.Environment] = true
+		if env.Decay == 0 {
+			return errors.Errorf("ingest_rate_decay_environments decay for %q must be greater than zero", env.Environment)
 		}
 	}
-	if !anyDefaultPolicy {
+	if strings.ContainsAny(c.SampledByLabel, `.*"`) {
+		return errors.Errorf("invalid sampled_by_label %q: must not contain '.', '*', or '\"'", c.SampledByLabel)
+	}
+	switch c.StorageCompression {
+	case "none", "snappy", "zstd":
+	default:
+		return errors.Errorf("invalid storage_compression %q", c.StorageCompression)
+	}
+	switch c.StorageKeySchema {
+	case "trace_event", "trace_timestamp_event":
+	default:
+		return errors.Errorf("invalid storage_key_schema %q", c.StorageKeySchema)
+	}
+	switch c.StorageCorruption.Action {
+	case "move", "wipe":
+	default:
+		return errors.Errorf("invalid storage_corruption.action %q", c.StorageCorruption.Action)
+	}
+	if c.PublishRetry.Jitter < 0 || c.PublishRetry.Jitter > 1 {
+		return errors.Errorf("publish_retry.jitter %v out of range [0,1]", c.PublishRetry.Jitter)
+	}
+	switch c.SampledTraces.Compression {
+	case "gzip", "zstd", "none":
+	default:
+		return errors.Errorf("invalid sampled_traces.compression %q", c.SampledTraces.Compression)
+	}
+	if c.AuditLog.Enabled {
+		if c.AuditLog.Path == "" {
+			return errors.New("audit_log.path must be specified when audit_log is enabled")
+		}
+		if c.AuditLog.MaxSizeParsed == 0 {
+			return errors.New("audit_log.max_size must be greater than zero")
+		}
+	}
+	if c.DecisionMetrics.Enabled {
+		if c.DecisionMetrics.Dataset == "" {
+			return errors.New("decision_metrics.dataset must be specified when decision_metrics is enabled")
+		}
+		if strings.Contains(c.DecisionMetrics.Dataset, "-") {
+			return errors.Errorf("invalid decision_metrics.dataset %q: must not contain \"-\"", c.DecisionMetrics.Dataset)
+		}
+	}
+	return errors.Wrap(validateTailSamplingPolicyNames(c.ShadowPolicies), "invalid shadow policies")
+}
+
+// LoadPolicies returns Policies with those loaded from PoliciesFile, if any,
+// replaced by the file's current policies. The policies are validated as
+// when the config is loaded.
+func (c *TailSamplingConfig) LoadPolicies() ([]TailSamplingPolicy, error) {
+	if c.PoliciesFile == "" {
+		return c.Policies, nil
+	}
+	filePolicies, err := loadTailSamplingPolicies(paths.Resolve(paths.Config, c.PoliciesFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading policies file")
+	}
+	policies := make([]TailSamplingPolicy, c.numInlinePolicies, c.numInlinePolicies+len(filePolicies))
+	copy(policies, c.Policies)
+	policies = append(policies, filePolicies...)
+	if err := resolveTailSamplingPolicyAttributes(policies); err != nil {
+		return nil, err
+	}
+	if err := validateTailSamplingPolicies(policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// validateTailSamplingPolicies checks that policies include a default policy,
+// and that their names are unique.
+func validateTailSamplingPolicies(policies []TailSamplingPolicy) error {
+	if len(policies) == 0 {
+		return errors.New("no policies specified")
+	}
+	if !hasDefaultTailSamplingPolicy(policies) {
 		return errors.New("no default (empty criteria) policy specified")
 	}
+	return validateTailSamplingPolicyNames(policies)
+}
+
+// validateTailSamplingPolicyNames checks that policy names are unique, as
+// they identify policies in monitoring metrics.
+func validateTailSamplingPolicyNames(policies []TailSamplingPolicy) error {
+	names := make(map[string]bool)
+	for _, policy := range policies {
+		if policy.Name == "" {
+			continue
+		}
+		if names[policy.Name] {
+			return errors.Errorf("duplicate policy name %q", policy.Name)
+		}
+		names[policy.Name] = true
+	}
+	return nil
+}
+
+// resolveTailSamplingPolicyAttributes resolves the attributes of policies.
+func resolveTailSamplingPolicyAttributes(policies []TailSamplingPolicy) error {
+	for i := range policies {
+		if err := policies[i].resolveAttributes(); err != nil {
+			return errors.Wrapf(err, "invalid policy %d", i)
+		}
+	}
 	return nil
 }
 
+// hasDefaultTailSamplingPolicy reports whether policies contains at least one
+// policy with empty criteria and no matcher, which matches all traces.
+func hasDefaultTailSamplingPolicy(policies []TailSamplingPolicy) bool {
+	for _, policy := range policies {
+		if policy == (TailSamplingPolicy{Name: policy.Name, SampleRate: policy.SampleRate}) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBulkFlushBytes parses the given human-readable size, which must be
+// positive.
+func parseBulkFlushBytes(s string) (int, error) {
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "error parsing bulk_flush_bytes")
+	}
+	if n == 0 || n > math.MaxInt32 {
+		return 0, errors.Errorf("bulk_flush_bytes %q out of range", s)
+	}
+	return int(n), nil
+}
+
+// parseStorageValueLogFileSize parses the given human-readable size, which
+// must be in the range accepted by Badger, [1MiB,2GiB).
+func parseStorageValueLogFileSize(s string) (int64, error) {
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "error parsing storage_value_log_file_size")
+	}
+	if n < 1<<20 || n >= 2<<30 {
+		return 0, errors.Errorf("storage_value_log_file_size %q out of range [1MiB,2GiB)", s)
+	}
+	return int64(n), nil
+}
+
+func parseStoredLabelsMaxSize(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "error parsing stored_labels.max_size")
+	}
+	if n > math.MaxInt32 {
+		return 0, errors.Errorf("stored_labels.max_size %q out of range", s)
+	}
+	return int(n), nil
+}
+
+// loadTailSamplingPolicies loads tail-sampling policies from the YAML or
+// JSON file at path. Each policy is validated individually, so that errors
+// identify the offending policy by its index and criteria.
+func loadTailSamplingPolicies(path string) ([]TailSamplingPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading policies file")
+	}
+	in, err := config.NewConfigWithYAML(data, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing policies file %q", path)
+	}
+	var file struct {
+		Policies []*config.C `config:"policies" validate:"required"`
+	}
+	if err := in.Unpack(&file); err != nil {
+		return nil, errors.Wrapf(err, "error unpacking policies file %q", path)
+	}
+	policies := make([]TailSamplingPolicy, len(file.Policies))
+	for i, policy := range file.Policies {
+		if err := policy.Unpack(&policies[i]); err != nil {
+			return nil, errors.Wrapf(err,
+				"invalid policy %d (%s) in policies file %q",
+				i, describeTailSamplingPolicy(policy), path,
+			)
+		}
+	}
+	return policies, nil
+}
+
+// describeTailSamplingPolicy returns a description of the criteria defined in
+// the raw policy config, for identifying policies in error messages.
+func describeTailSamplingPolicy(policy *config.C) string {
+	var criteria []string
+	for _, field := range []string{
+		"name",
+		"service.name",
+		"service.environment",
+		"trace.name",
+		"trace.outcome",
+		"trace.has_error",
+		"trace.min_duration",
+		"trace.max_duration",
+		"trace.http_status_code",
+		"trace.min_span_count",
+	} {
+		if value, err := policy.String(field, -1); err == nil && value != "" {
+			criteria = append(criteria, fmt.Sprintf("%s: %q", field, value))
+		}
+	}
+	if policy.HasField("attributes") {
+		criteria = append(criteria, "attributes")
+	}
+	if policy.HasField("match") {
+		criteria = append(criteria, "match expression")
+	}
+	if len(criteria) == 0 {
+		return "no criteria"
+	}
+	return strings.Join(criteria, ", ")
+}
+
 func (c *TailSamplingConfig) setup(log *logp.Logger, outputESCfg *config.C) error {
 	if !c.Enabled {
 		return nil
@@ -150,9 +1087,50 @@ func defaultTailSamplingConfig() TailSamplingConfig {
 		ESConfig:              elasticsearch.DefaultConfig(),
 		Interval:              1 * time.Minute,
 		IngestRateDecayFactor: 0.25,
+		MaxDynamicServices:    1000,
+		FinalizeConcurrency:   1,
 		StorageGCInterval:     5 * time.Minute,
 		TTL:                   30 * time.Minute,
 		StorageLimit:          "3GB",
+		Strategy:              "random",
+		TraceIDCollision:      "merge",
+		BulkMaxRequests:       10,
+		BulkFlushBytes:        "5MiB",
+		BulkFlushBytesParsed:  5 * 1024 * 1024,
+		CircuitBreaker: TailSamplingCircuitBreakerConfig{
+			FailureThreshold: 5,
+			Cooldown:         30 * time.Second,
+		},
+		PublishRetry: TailSamplingPublishRetryConfig{
+			Backoff: time.Second,
+			Jitter:  0.5,
+			Timeout: 30 * time.Second,
+		},
+		StorageValueLogFileSize:       "128MiB",
+		StorageValueLogFileSizeParsed: 128 * 1024 * 1024,
+		StorageCompression:            "none",
+		StorageKeySchema:              "trace_event",
+		StorageCorruption: TailSamplingStorageCorruptionConfig{
+			Action: "move",
+		},
+		StorageWrite: TailSamplingStorageWriteConfig{
+			QueueSize: 1000,
+		},
+		TraceCompletion: TailSamplingTraceCompletionConfig{
+			Label: "trace_complete",
+		},
+		SampledTraces: TailSamplingSampledTracesConfig{
+			Compression: "gzip",
+		},
+		AuditLog: TailSamplingAuditLogConfig{
+			Path:          "tail_sampling_audit",
+			MaxSize:       "10MiB",
+			MaxSizeParsed: 10 * 1024 * 1024,
+			MaxBackups:    7,
+		},
+		DecisionMetrics: TailSamplingDecisionMetricsConfig{
+			Dataset: "apm.sampling",
+		},
 	}
 	parsed, err := humanize.ParseBytes(cfg.StorageLimit)
 	if err != nil {
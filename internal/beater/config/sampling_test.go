@@ -18,11 +18,17 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/elastic/elastic-agent-libs/config"
+	"github.com/elastic/elastic-agent-libs/paths"
 )
 
 func TestSamplingPoliciesValidation(t *testing.T) {
@@ -40,6 +46,7 @@ func TestSamplingPoliciesValidation(t *testing.T) {
 		}), nil)
 		assert.NoError(t, err)
 		assert.False(t, c.Sampling.Tail.Enabled)
+		assert.EqualError(t, c.Sampling.Tail.UnpackError(), "invalid config: no policies specified")
 	})
 	t.Run("NoDefaultPolicies", func(t *testing.T) {
 		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
@@ -51,4 +58,988 @@ func TestSamplingPoliciesValidation(t *testing.T) {
 		assert.NoError(t, err)
 		assert.False(t, c.Sampling.Tail.Enabled)
 	})
+	t.Run("NoDefaultShadowPolicies", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":  true,
+			"sampling.tail.policies": []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.shadow_policies": []map[string]interface{}{{
+				"service.name": "foo",
+				"sample_rate":  0.5,
+			}},
+		}), nil)
+		assert.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled)
+	})
+	t.Run("ShadowPolicies", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":         true,
+			"sampling.tail.policies":        []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.shadow_policies": []map[string]interface{}{{"sample_rate": 0.1}},
+		}), nil)
+		assert.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, []TailSamplingPolicy{{SampleRate: 0.1}}, c.Sampling.Tail.ShadowPolicies)
+	})
+	t.Run("PolicyNames", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{
+				{"name": "failures", "trace.outcome": "failure", "sample_rate": 1.0},
+				{"name": "default", "sample_rate": 0.5},
+			},
+		}), nil)
+		require.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, "failures", c.Sampling.Tail.Policies[0].Name)
+		assert.Equal(t, "default", c.Sampling.Tail.Policies[1].Name)
+	})
+	t.Run("DuplicatePolicyNames", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{
+				{"name": "policy", "service.name": "foo", "sample_rate": 1.0},
+				{"name": "policy", "sample_rate": 0.5},
+			},
+		}), nil)
+		require.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled)
+	})
+}
+
+func TestSamplingBulkValidation(t *testing.T) {
+	for name, settings := range map[string]map[string]interface{}{
+		"ZeroMaxRequests":     {"bulk_max_requests": 0},
+		"NegativeMaxRequests": {"bulk_max_requests": -1},
+		"ZeroFlushBytes":      {"bulk_flush_bytes": "0"},
+		"InvalidFlushBytes":   {"bulk_flush_bytes": "lots"},
+		"InvalidCompression":  {"sampled_traces.compression": "lz4"},
+		"NegativeMaxRetries":  {"publish_retry.max_retries": -1},
+		"ZeroRetryBackoff":    {"publish_retry.backoff": "0s"},
+		"InvalidRetryJitter":  {"publish_retry.jitter": 1.5},
+		"ZeroRetryTimeout":    {"publish_retry.timeout": "0s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			in := map[string]interface{}{
+				"sampling.tail.enabled":  true,
+				"sampling.tail.policies": []map[string]interface{}{{"sample_rate": 0.5}},
+			}
+			for k, v := range settings {
+				in["sampling.tail."+k] = v
+			}
+			c, err := NewConfig(config.MustNewConfigFrom(in), nil)
+			assert.NoError(t, err)
+			assert.False(t, c.Sampling.Tail.Enabled)
+		})
+	}
+}
+
+func TestSamplingStorageValueLogFileSize(t *testing.T) {
+	newConfig := func(t *testing.T, size string) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":                     true,
+			"sampling.tail.policies":                    []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.storage_value_log_file_size": size,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(128*1024*1024), c.Sampling.Tail.StorageValueLogFileSizeParsed)
+
+	c = newConfig(t, "1MiB")
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, int64(1024*1024), c.Sampling.Tail.StorageValueLogFileSizeParsed)
+
+	c = newConfig(t, "lots")
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.Error(t, c.Sampling.Tail.UnpackError())
+
+	for _, invalid := range []string{"1KiB", "2GiB"} {
+		c = newConfig(t, invalid)
+		assert.False(t, c.Sampling.Tail.Enabled)
+		assert.EqualError(t, c.Sampling.Tail.UnpackError(), fmt.Sprintf(
+			"storage_value_log_file_size %q out of range [1MiB,2GiB)", invalid,
+		))
+	}
+}
+
+func TestSamplingPublishRetry(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":                   true,
+		"sampling.tail.policies":                  []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.publish_retry.max_retries": 5,
+		"sampling.tail.publish_retry.backoff":     "100ms",
+		"sampling.tail.publish_retry.jitter":      0,
+		"sampling.tail.publish_retry.timeout":     "1m",
+	}), nil)
+	require.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, TailSamplingPublishRetryConfig{
+		MaxRetries: 5,
+		Backoff:    100 * time.Millisecond,
+		Jitter:     0,
+		Timeout:    time.Minute,
+	}, c.Sampling.Tail.PublishRetry)
+}
+
+func TestSamplingStorageCompression(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "none", c.Sampling.Tail.StorageCompression)
+
+	for _, compression := range []string{"none", "snappy", "zstd", "lz4"} {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":             true,
+			"sampling.tail.policies":            []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.storage_compression": compression,
+		}), nil)
+		require.NoError(t, err)
+		if compression == "lz4" {
+			assert.False(t, c.Sampling.Tail.Enabled)
+			assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: invalid storage_compression "lz4"`)
+			continue
+		}
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, compression, c.Sampling.Tail.StorageCompression)
+	}
+}
+
+func TestSamplingStorageKeySchema(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "trace_event", c.Sampling.Tail.StorageKeySchema)
+
+	for _, keySchema := range []string{"trace_event", "trace_timestamp_event", "timestamp_trace_event"} {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":            true,
+			"sampling.tail.policies":           []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.storage_key_schema": keySchema,
+		}), nil)
+		require.NoError(t, err)
+		if keySchema == "timestamp_trace_event" {
+			assert.False(t, c.Sampling.Tail.Enabled)
+			assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: invalid storage_key_schema "timestamp_trace_event"`)
+			continue
+		}
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, keySchema, c.Sampling.Tail.StorageKeySchema)
+	}
+}
+
+func TestSamplingSampledByLabel(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Empty(t, c.Sampling.Tail.SampledByLabel)
+
+	for _, label := range []string{"sampled_by", "sampled.by"} {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":          true,
+			"sampling.tail.policies":         []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.sampled_by_label": label,
+		}), nil)
+		require.NoError(t, err)
+		if label == "sampled.by" {
+			assert.False(t, c.Sampling.Tail.Enabled)
+			assert.EqualError(t, c.Sampling.Tail.UnpackError(),
+				`invalid config: invalid sampled_by_label "sampled.by": must not contain '.', '*', or '"'`,
+			)
+			continue
+		}
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, label, c.Sampling.Tail.SampledByLabel)
+	}
+}
+
+func TestSamplingFinalizeConcurrency(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, c.Sampling.Tail.FinalizeConcurrency)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":              true,
+		"sampling.tail.policies":             []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.finalize_concurrency": 0,
+	}), nil)
+	require.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(),
+		"error unpacking config: requires value >= 1 accessing 'sampling.tail.finalize_concurrency'",
+	)
+}
+
+func TestSamplingIngestRateDecayEnvironments(t *testing.T) {
+	newConfig := func(t *testing.T, environments []map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":                        true,
+			"sampling.tail.policies":                       []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.ingest_rate_decay_environments": environments,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, []map[string]interface{}{
+		{"environment": "production", "decay": 0.1},
+		{"environment": "development", "decay": 1.0},
+	})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, []TailSamplingIngestRateDecayEnvironment{
+		{Environment: "production", Decay: 0.1},
+		{Environment: "development", Decay: 1.0},
+	}, c.Sampling.Tail.IngestRateDecayEnvironments)
+
+	c = newConfig(t, []map[string]interface{}{
+		{"environment": "production", "decay": 0.1},
+		{"environment": "production", "decay": 0.2},
+	})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: duplicate ingest_rate_decay_environments environment "production"`)
+
+	c = newConfig(t, []map[string]interface{}{{"environment": "production", "decay": 0}})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: ingest_rate_decay_environments decay for "production" must be greater than zero`)
+
+	c = newConfig(t, []map[string]interface{}{{"environment": "production", "decay": 1.5}})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.Error(t, c.Sampling.Tail.UnpackError())
+}
+
+func TestSamplingStorageCorruption(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, TailSamplingStorageCorruptionConfig{Action: "move"}, c.Sampling.Tail.StorageCorruption)
+
+	for _, action := range []string{"move", "wipe", "repair"} {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":                      true,
+			"sampling.tail.policies":                     []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.storage_corruption.threshold": 10,
+			"sampling.tail.storage_corruption.action":    action,
+		}), nil)
+		require.NoError(t, err)
+		if action == "repair" {
+			assert.False(t, c.Sampling.Tail.Enabled)
+			assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: invalid storage_corruption.action "repair"`)
+			continue
+		}
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, TailSamplingStorageCorruptionConfig{
+			Threshold: 10,
+			Action:    action,
+		}, c.Sampling.Tail.StorageCorruption)
+	}
+}
+
+func TestSamplingOrphanTraceTimeout(t *testing.T) {
+	newConfig := func(t *testing.T, timeout string) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":              true,
+			"sampling.tail.policies":             []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.ttl":                  "10m",
+			"sampling.tail.orphan_trace_timeout": timeout,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, "2m")
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 2*time.Minute, c.Sampling.Tail.OrphanTraceTimeout)
+
+	for _, invalid := range []string{"-1m", "10m", "1h"} {
+		c := newConfig(t, invalid)
+		assert.False(t, c.Sampling.Tail.Enabled, invalid)
+	}
+}
+
+func TestSamplingDefaultTraceOutcome(t *testing.T) {
+	newConfig := func(t *testing.T, outcome string) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":               true,
+			"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.default_trace_outcome": outcome,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", c.Sampling.Tail.DefaultTraceOutcome)
+
+	for _, valid := range []string{"success", "failure", "unknown"} {
+		c := newConfig(t, valid)
+		assert.True(t, c.Sampling.Tail.Enabled, valid)
+		assert.Equal(t, valid, c.Sampling.Tail.DefaultTraceOutcome)
+	}
+
+	c = newConfig(t, "error")
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: invalid default_trace_outcome "error"`)
+}
+
+func TestSamplingStrategy(t *testing.T) {
+	newConfig := func(t *testing.T, strategy string) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":  true,
+			"sampling.tail.policies": []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.strategy": strategy,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "random", c.Sampling.Tail.Strategy)
+
+	for _, valid := range []string{"random", "diversity"} {
+		c := newConfig(t, valid)
+		assert.True(t, c.Sampling.Tail.Enabled, valid)
+		assert.Equal(t, valid, c.Sampling.Tail.Strategy)
+	}
+
+	c = newConfig(t, "stratified")
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: invalid strategy "stratified"`)
+}
+
+func TestSamplingTraceIDCollision(t *testing.T) {
+	newConfig := func(t *testing.T, collision string) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":            true,
+			"sampling.tail.policies":           []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.trace_id_collision": collision,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "merge", c.Sampling.Tail.TraceIDCollision)
+
+	for _, valid := range []string{"merge", "separate", "drop"} {
+		c := newConfig(t, valid)
+		assert.True(t, c.Sampling.Tail.Enabled, valid)
+		assert.Equal(t, valid, c.Sampling.Tail.TraceIDCollision)
+	}
+
+	c = newConfig(t, "ignore")
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(), `invalid config: invalid trace_id_collision "ignore"`)
+}
+
+func TestSamplingTraceCompletion(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{}), nil)
+	require.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.TraceCompletion.Enabled)
+	assert.Equal(t, "trace_complete", c.Sampling.Tail.TraceCompletion.Label)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":                  true,
+		"sampling.tail.policies":                 []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.trace_completion.enabled": true,
+		"sampling.tail.trace_completion.label":   "",
+	}), nil)
+	require.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(),
+		"invalid config: trace_completion.label must be specified when trace_completion is enabled",
+	)
+}
+
+func TestSamplingAuditLog(t *testing.T) {
+	newConfig := func(t *testing.T, auditLog map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":   true,
+			"sampling.tail.policies":  []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.audit_log": auditLog,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, map[string]interface{}{"enabled": true, "path": "/var/log/audit", "max_backups": 30})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, TailSamplingAuditLogConfig{
+		Enabled:       true,
+		Path:          "/var/log/audit",
+		MaxSize:       "10MiB",
+		MaxSizeParsed: 10 * 1024 * 1024,
+		MaxBackups:    30,
+	}, c.Sampling.Tail.AuditLog)
+
+	c = newConfig(t, map[string]interface{}{"enabled": true, "path": ""})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(),
+		"invalid config: audit_log.path must be specified when audit_log is enabled",
+	)
+
+	c = newConfig(t, map[string]interface{}{"enabled": true, "max_size": "0"})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(),
+		"invalid config: audit_log.max_size must be greater than zero",
+	)
+
+	c = newConfig(t, map[string]interface{}{"max_size": "lots"})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.Error(t, c.Sampling.Tail.UnpackError())
+
+	c = newConfig(t, map[string]interface{}{"max_backups": 2000})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.Error(t, c.Sampling.Tail.UnpackError())
+}
+
+func TestSamplingDecisionMetrics(t *testing.T) {
+	newConfig := func(t *testing.T, decisionMetrics map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":          true,
+			"sampling.tail.policies":         []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.decision_metrics": decisionMetrics,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, map[string]interface{}{"enabled": true})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, TailSamplingDecisionMetricsConfig{
+		Enabled: true,
+		Dataset: "apm.sampling",
+	}, c.Sampling.Tail.DecisionMetrics)
+
+	c = newConfig(t, map[string]interface{}{"enabled": true, "dataset": ""})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(),
+		"invalid config: decision_metrics.dataset must be specified when decision_metrics is enabled",
+	)
+
+	c = newConfig(t, map[string]interface{}{"enabled": true, "dataset": "apm-sampling"})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.EqualError(t, c.Sampling.Tail.UnpackError(),
+		`invalid config: invalid decision_metrics.dataset "apm-sampling": must not contain "-"`,
+	)
+}
+
+func TestSamplingStoredLabels(t *testing.T) {
+	newConfig := func(t *testing.T, storedLabels map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":       true,
+			"sampling.tail.policies":      []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.stored_labels": storedLabels,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, map[string]interface{}{})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, TailSamplingStoredLabelsConfig{}, c.Sampling.Tail.StoredLabels)
+
+	c = newConfig(t, map[string]interface{}{
+		"max_labels": 10,
+		"max_size":   "4KiB",
+		"preserve":   []string{"tenant"},
+	})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, TailSamplingStoredLabelsConfig{
+		MaxLabels:     10,
+		MaxSize:       "4KiB",
+		MaxSizeParsed: 4096,
+		Preserve:      []string{"tenant"},
+	}, c.Sampling.Tail.StoredLabels)
+
+	c = newConfig(t, map[string]interface{}{"max_size": "lots"})
+	assert.False(t, c.Sampling.Tail.Enabled)
+	assert.Error(t, c.Sampling.Tail.UnpackError())
+}
+
+func TestSamplingPoliciesFile(t *testing.T) {
+	writePoliciesFile := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "policies.yml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	t.Run("YAML", func(t *testing.T) {
+		path := writePoliciesFile(t, `
+policies:
+  - service.name: foo
+    sample_rate: 0.5
+  - sample_rate: 0.1
+`)
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{{
+				"service.name": "bar",
+				"sample_rate":  1.0,
+			}},
+			"sampling.tail.policies_file": path,
+		}), nil)
+		require.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		require.Len(t, c.Sampling.Tail.Policies, 3)
+		assert.Equal(t, "bar", c.Sampling.Tail.Policies[0].Service.Name)
+		assert.Equal(t, "foo", c.Sampling.Tail.Policies[1].Service.Name)
+		assert.Equal(t, 0.1, c.Sampling.Tail.Policies[2].SampleRate)
+	})
+	t.Run("JSON", func(t *testing.T) {
+		path := writePoliciesFile(t, `{"policies": [{"trace": {"outcome": "failure"}, "sample_rate": 1}, {"sample_rate": 0.1}]}`)
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":       true,
+			"sampling.tail.policies_file": path,
+		}), nil)
+		require.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		require.Len(t, c.Sampling.Tail.Policies, 2)
+		assert.Equal(t, "failure", c.Sampling.Tail.Policies[0].Trace.Outcome)
+	})
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		path := writePoliciesFile(t, `
+policies:
+  - sample_rate: 0.1
+  - service.name: foo
+    service.environment: production
+    sample_rate: 2
+`)
+		_, err := loadTailSamplingPolicies(path)
+		assert.ErrorContains(t, err, `invalid policy 1 (service.name: "foo", service.environment: "production") in policies file`)
+
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":       true,
+			"sampling.tail.policies_file": path,
+		}), nil)
+		assert.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled)
+	})
+	t.Run("RelativePath", func(t *testing.T) {
+		path := writePoliciesFile(t, "policies: [{sample_rate: 0.5}]")
+		configPath := paths.Paths.Config
+		paths.Paths.Config = filepath.Dir(path)
+		defer func() { paths.Paths.Config = configPath }()
+
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":       true,
+			"sampling.tail.policies_file": filepath.Base(path),
+		}), nil)
+		require.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		require.Len(t, c.Sampling.Tail.Policies, 1)
+		assert.Equal(t, 0.5, c.Sampling.Tail.Policies[0].SampleRate)
+	})
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := loadTailSamplingPolicies(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.ErrorContains(t, err, "error reading policies file")
+	})
+}
+
+func TestSamplingLoadPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.yml")
+	require.NoError(t, os.WriteFile(path, []byte("policies: [{service.name: foo, sample_rate: 0.5}, {sample_rate: 0.1}]"), 0644))
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":       true,
+		"sampling.tail.policies":      []map[string]interface{}{{"service.name": "bar", "sample_rate": 1.0}},
+		"sampling.tail.policies_file": path,
+	}), nil)
+	require.NoError(t, err)
+	require.Len(t, c.Sampling.Tail.Policies, 3)
+
+	// The file's policies are replaced, and the inline policies kept.
+	require.NoError(t, os.WriteFile(path, []byte("policies: [{trace.outcome: failure, sample_rate: 1}, {sample_rate: 0.2}]"), 0644))
+	policies, err := c.Sampling.Tail.LoadPolicies()
+	require.NoError(t, err)
+	require.Len(t, policies, 3)
+	assert.Equal(t, "bar", policies[0].Service.Name)
+	assert.Equal(t, "failure", policies[1].Trace.Outcome)
+	assert.Equal(t, 0.2, policies[2].SampleRate)
+	assert.Equal(t, "foo", c.Sampling.Tail.Policies[1].Service.Name)
+
+	// Invalid policies are rejected as when the config is loaded.
+	require.NoError(t, os.WriteFile(path, []byte("policies: [{trace.outcome: failure, sample_rate: 1}]"), 0644))
+	_, err = c.Sampling.Tail.LoadPolicies()
+	assert.EqualError(t, err, "no default (empty criteria) policy specified")
+	require.NoError(t, os.WriteFile(path, []byte("policies: [{sample_rate: 2}]"), 0644))
+	_, err = c.Sampling.Tail.LoadPolicies()
+	assert.ErrorContains(t, err, "error loading policies file: invalid policy 0")
+}
+
+func TestSamplingPolicyHasError(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled": true,
+		"sampling.tail.policies": []map[string]interface{}{
+			{"trace.has_error": true, "sample_rate": 1.0},
+			{"match": map[string]interface{}{"trace.has_error": true}, "sample_rate": 0.5},
+			{"sample_rate": 0.1},
+		},
+	}), nil)
+	require.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	require.Len(t, c.Sampling.Tail.Policies, 3)
+	assert.True(t, c.Sampling.Tail.Policies[0].Trace.HasError)
+	require.NotNil(t, c.Sampling.Tail.Policies[1].Match)
+	assert.True(t, c.Sampling.Tail.Policies[1].Match.Trace.HasError)
+
+	// A policy with only has_error specified is not a default policy.
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":  true,
+		"sampling.tail.policies": []map[string]interface{}{{"trace.has_error": true, "sample_rate": 1.0}},
+	}), nil)
+	require.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestSamplingPolicyDuration(t *testing.T) {
+	newConfig := func(t *testing.T, policy map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{
+				policy,
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, map[string]interface{}{
+		"trace.min_duration": "1s",
+		"trace.max_duration": "1m",
+		"sample_rate":        1.0,
+	})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, time.Second, c.Sampling.Tail.Policies[0].Trace.MinDuration)
+	assert.Equal(t, time.Minute, c.Sampling.Tail.Policies[0].Trace.MaxDuration)
+
+	c = newConfig(t, map[string]interface{}{
+		"match":       map[string]interface{}{"trace.min_duration": "500ms"},
+		"sample_rate": 1.0,
+	})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 500*time.Millisecond, c.Sampling.Tail.Policies[0].Match.Trace.MinDuration)
+
+	for name, policy := range map[string]map[string]interface{}{
+		"Negative":       {"trace.min_duration": "-1s", "sample_rate": 1.0},
+		"MinNotBelowMax": {"trace.min_duration": "1m", "trace.max_duration": "1s", "sample_rate": 1.0},
+		"InvalidMatcher": {"match": map[string]interface{}{"trace.max_duration": "-1s"}, "sample_rate": 1.0},
+		"MinEqualsMax":   {"trace.min_duration": "1s", "trace.max_duration": "1s", "sample_rate": 1.0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newConfig(t, policy)
+			assert.False(t, c.Sampling.Tail.Enabled)
+		})
+	}
+}
+
+func TestDescribeTailSamplingPolicy(t *testing.T) {
+	assert.Equal(t, "no criteria", describeTailSamplingPolicy(config.MustNewConfigFrom(map[string]interface{}{
+		"sample_rate": 0.1,
+	})))
+	assert.Equal(t,
+		`name: "slow", service.name: "foo", trace.outcome: "failure", trace.has_error: "true", `+
+			`trace.min_duration: "1s", trace.max_duration: "1m", trace.http_status_code: "5xx", `+
+			`trace.min_span_count: "10", match expression`,
+		describeTailSamplingPolicy(config.MustNewConfigFrom(map[string]interface{}{
+			"name":                   "slow",
+			"service.name":           "foo",
+			"trace.outcome":          "failure",
+			"trace.has_error":        true,
+			"trace.min_duration":     "1s",
+			"trace.max_duration":     "1m",
+			"trace.http_status_code": "5xx",
+			"trace.min_span_count":   10,
+			"match":                  map[string]interface{}{"trace.has_error": true},
+			"sample_rate":            1.0,
+		})),
+	)
+}
+
+func TestSamplingPolicyMinSpanCount(t *testing.T) {
+	newConfig := func(t *testing.T, policy map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{
+				policy,
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, map[string]interface{}{"trace.min_span_count": 100, "sample_rate": 1.0})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 100, c.Sampling.Tail.Policies[0].Trace.MinSpanCount)
+
+	c = newConfig(t, map[string]interface{}{
+		"match":       map[string]interface{}{"trace.min_span_count": 50},
+		"sample_rate": 1.0,
+	})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 50, c.Sampling.Tail.Policies[0].Match.Trace.MinSpanCount)
+
+	for name, policy := range map[string]map[string]interface{}{
+		"Negative":       {"trace.min_span_count": -1, "sample_rate": 1.0},
+		"InvalidMatcher": {"match": map[string]interface{}{"trace.min_span_count": -1}, "sample_rate": 1.0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newConfig(t, policy)
+			assert.False(t, c.Sampling.Tail.Enabled)
+		})
+	}
+}
+
+func TestSamplingPolicyHTTPStatusCode(t *testing.T) {
+	newConfig := func(t *testing.T, policy map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{
+				policy,
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	for statusCode, expected := range map[string][2]int{
+		"404":     {404, 404},
+		"5xx":     {500, 599},
+		"2XX":     {200, 299},
+		"500-504": {500, 504},
+		"100-599": {100, 599},
+	} {
+		t.Run(statusCode, func(t *testing.T) {
+			c := newConfig(t, map[string]interface{}{
+				"trace.http_status_code": statusCode,
+				"sample_rate":            1.0,
+			})
+			assert.True(t, c.Sampling.Tail.Enabled)
+			trace := c.Sampling.Tail.Policies[0].Trace
+			assert.Equal(t, expected, [2]int{trace.HTTPStatusCodeMin, trace.HTTPStatusCodeMax})
+		})
+	}
+
+	c := newConfig(t, map[string]interface{}{
+		"match":       map[string]interface{}{"trace.http_status_code": "4xx"},
+		"sample_rate": 1.0,
+	})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 400, c.Sampling.Tail.Policies[0].Match.Trace.HTTPStatusCodeMin)
+	assert.Equal(t, 499, c.Sampling.Tail.Policies[0].Match.Trace.HTTPStatusCodeMax)
+
+	for _, statusCode := range []string{"abc", "6xx", "0xx", "99", "600", "504-500", "500-", "-500", "200-700"} {
+		t.Run("Invalid_"+statusCode, func(t *testing.T) {
+			c := newConfig(t, map[string]interface{}{
+				"trace.http_status_code": statusCode,
+				"sample_rate":            1.0,
+			})
+			assert.False(t, c.Sampling.Tail.Enabled)
+		})
+	}
+}
+
+func TestParseHTTPStatusCodeRange(t *testing.T) {
+	_, _, err := parseHTTPStatusCodeRange("5yy")
+	assert.EqualError(t, err, `invalid trace.http_status_code "5yy"`)
+	_, _, err = parseHTTPStatusCodeRange("600")
+	assert.EqualError(t, err, `trace.http_status_code "600" out of range [100,599]`)
+	min, max, err := parseHTTPStatusCodeRange("")
+	assert.NoError(t, err)
+	assert.Zero(t, min)
+	assert.Zero(t, max)
+}
+
+func TestSamplingPolicyMatcher(t *testing.T) {
+	newConfig := func(t *testing.T, match map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{
+				{"match": match, "sample_rate": 1.0},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		c := newConfig(t, map[string]interface{}{
+			"all": []map[string]interface{}{{
+				"any": []map[string]interface{}{
+					{"service.name": "a"},
+					{"service.name": "b"},
+				},
+			}, {
+				"service.environment": "production",
+			}},
+		})
+		assert.True(t, c.Sampling.Tail.Enabled)
+		require.Len(t, c.Sampling.Tail.Policies, 2)
+		match := c.Sampling.Tail.Policies[0].Match
+		require.NotNil(t, match)
+		require.Len(t, match.All, 2)
+		require.Len(t, match.All[0].Any, 2)
+		assert.Equal(t, "a", match.All[0].Any[0].Service.Name)
+		assert.Equal(t, "b", match.All[0].Any[1].Service.Name)
+		assert.Equal(t, "production", match.All[1].Service.Environment)
+		assert.Nil(t, c.Sampling.Tail.Policies[1].Match)
+	})
+	for name, match := range map[string]map[string]interface{}{
+		"Empty": {"all": []map[string]interface{}{}},
+		"CriteriaAndAll": {
+			"service.name": "a",
+			"all":          []map[string]interface{}{{"service.name": "b"}},
+		},
+		"AllAndAny": {
+			"all": []map[string]interface{}{{"service.name": "a"}},
+			"any": []map[string]interface{}{{"service.name": "b"}},
+		},
+		"InvalidNested": {
+			"any": []map[string]interface{}{{"trace.name": "a"}, {"all": []map[string]interface{}{}}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newConfig(t, match)
+			assert.False(t, c.Sampling.Tail.Enabled)
+		})
+	}
+	t.Run("MatchIsNotDefault", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{{
+				"match":       map[string]interface{}{"trace.outcome": "failure"},
+				"sample_rate": 0.5,
+			}},
+		}), nil)
+		require.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled)
+	})
+}
+
+func TestSamplingPolicyAttributes(t *testing.T) {
+	newConfig := func(t *testing.T, policy map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled": true,
+			"sampling.tail.policies": []map[string]interface{}{
+				policy,
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		c := newConfig(t, map[string]interface{}{
+			"attributes": map[string]interface{}{
+				"service.name":           "a",
+				"deployment.environment": "production",
+				"otel.status_code":       "ERROR",
+			},
+			"match": map[string]interface{}{
+				"any": []map[string]interface{}{
+					{"attributes": map[string]interface{}{"otel.status_code": "OK"}},
+					{"service.environment": "staging"},
+				},
+			},
+			"sample_rate": 1.0,
+		})
+		assert.True(t, c.Sampling.Tail.Enabled)
+		require.Len(t, c.Sampling.Tail.Policies, 2)
+		policy := c.Sampling.Tail.Policies[0]
+		assert.Equal(t, "a", policy.Service.Name)
+		assert.Equal(t, "production", policy.Service.Environment)
+		assert.Equal(t, "failure", policy.Trace.Outcome)
+		require.NotNil(t, policy.Match)
+		require.Len(t, policy.Match.Any, 2)
+		assert.Equal(t, "success", policy.Match.Any[0].Trace.Outcome)
+		assert.Equal(t, "staging", policy.Match.Any[1].Service.Environment)
+	})
+	t.Run("SameAsCriteria", func(t *testing.T) {
+		c := newConfig(t, map[string]interface{}{
+			"service.environment": "production",
+			"attributes":          map[string]interface{}{"deployment.environment": "production"},
+		})
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, "production", c.Sampling.Tail.Policies[0].Service.Environment)
+	})
+	for name, policy := range map[string]map[string]interface{}{
+		"Unsupported": {
+			"attributes": map[string]interface{}{"http.method": "GET"},
+		},
+		"UnknownStatusCode": {
+			"attributes": map[string]interface{}{"otel.status_code": "BROKEN"},
+		},
+		"ConflictsWithCriteria": {
+			"service.environment": "staging",
+			"attributes":          map[string]interface{}{"deployment.environment": "production"},
+		},
+		"InvalidNested": {
+			"match": map[string]interface{}{
+				"all": []map[string]interface{}{
+					{"attributes": map[string]interface{}{"http.method": "GET"}},
+				},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newConfig(t, policy)
+			assert.False(t, c.Sampling.Tail.Enabled)
+			assert.Error(t, c.Sampling.Tail.UnpackError())
+		})
+	}
+}
+
+func TestSamplingTraceNameNormalizers(t *testing.T) {
+	newConfig := func(t *testing.T, normalizers []map[string]interface{}) *Config {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.enabled":                true,
+			"sampling.tail.policies":               []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.trace_name_normalizers": normalizers,
+		}), nil)
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newConfig(t, []map[string]interface{}{
+		{"pattern": `/\d+`, "replacement": "/:id"},
+		{"pattern": `^(GET|POST) `, "replacement": "$1 "},
+	})
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, []TailSamplingTraceNameNormalizer{
+		{Pattern: `/\d+`, Replacement: "/:id"},
+		{Pattern: `^(GET|POST) `, Replacement: "$1 "},
+	}, c.Sampling.Tail.TraceNameNormalizers)
+
+	for name, normalizer := range map[string]map[string]interface{}{
+		"MissingPattern": {"replacement": "/:id"},
+		"InvalidPattern": {"pattern": `/(\d+`, "replacement": "/:id"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newConfig(t, []map[string]interface{}{normalizer})
+			assert.False(t, c.Sampling.Tail.Enabled)
+		})
+	}
+}
+
+func TestSamplingOutcomeTTL(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":             true,
+		"sampling.tail.policies":            []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.outcome_ttl.failure": "2h",
+	}), nil)
+	require.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, TailSamplingOutcomeTTLConfig{Failure: 2 * time.Hour}, c.Sampling.Tail.OutcomeTTL)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":             true,
+		"sampling.tail.policies":            []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.outcome_ttl.success": "-1m",
+	}), nil)
+	require.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
 }
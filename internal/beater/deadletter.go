@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package beater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/internal/datastreams"
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
+)
+
+// deadLetterDataset is the dataset of the data stream into which events are
+// indexed by dataStreamDeadLetterSink.
+const deadLetterDataset = "apm.dead_letter"
+
+// newDeadLetterSink returns a modelprocessor.DeadLetterSink for the given
+// config, and a function for closing it. If no dead-letter output is
+// configured, newDeadLetterSink returns a nil sink.
+//
+// final is used for indexing events with the data stream output.
+func newDeadLetterSink(
+	cfg config.DeadLetterConfig, namespace string, final model.BatchProcessor,
+) (modelprocessor.DeadLetterSink, func() error, error) {
+	switch cfg.Output {
+	case config.DeadLetterOutputFile:
+		sink, err := newFileDeadLetterSink(cfg.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, sink.Close, nil
+	case config.DeadLetterOutputDataStream:
+		sink := &dataStreamDeadLetterSink{namespace: namespace, processor: final}
+		return sink, func() error { return nil }, nil
+	}
+	return nil, func() error { return nil }, nil
+}
+
+// fileDeadLetterSink is a modelprocessor.DeadLetterSink which appends events
+// to a file as newline-delimited JSON objects, each holding an event and the
+// error which caused it to be dead-lettered.
+type fileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileDeadLetterSink(path string) (*fileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open dead-letter file")
+	}
+	return &fileDeadLetterSink{file: file}, nil
+}
+
+// WriteDeadLetters appends the events in batch to the file.
+func (s *fileDeadLetterSink) WriteDeadLetters(ctx context.Context, batch model.Batch, err error) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range batch {
+		beatEvent := batch[i].BeatEvent()
+		if err := enc.Encode(fileDeadLetter{
+			Error:     err.Error(),
+			Timestamp: beatEvent.Timestamp,
+			Event:     beatEvent.Fields,
+		}); err != nil {
+			return errors.Wrap(err, "failed to encode dead-lettered event")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, writeErr := s.file.Write(buf.Bytes())
+	return writeErr
+}
+
+// Close closes the file.
+func (s *fileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+type fileDeadLetter struct {
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"@timestamp"`
+	Event     mapstr.M  `json:"event"`
+}
+
+// dataStreamDeadLetterSink is a modelprocessor.DeadLetterSink which indexes
+// events into the "logs-apm.dead_letter-<namespace>" data stream, labelling
+// each with the error which caused it to be dead-lettered.
+type dataStreamDeadLetterSink struct {
+	namespace string
+	processor model.BatchProcessor
+}
+
+// WriteDeadLetters indexes the events in batch.
+func (s *dataStreamDeadLetterSink) WriteDeadLetters(ctx context.Context, batch model.Batch, err error) error {
+	for i := range batch {
+		event := &batch[i]
+		event.DataStream = model.DataStream{
+			Type:      datastreams.LogsType,
+			Dataset:   deadLetterDataset,
+			Namespace: s.namespace,
+		}
+		// Labels may be shared with the events as processed,
+		// so copy them before adding the error.
+		event.Labels = event.Labels.Clone()
+		event.Labels.Set("dead_letter_error", err.Error())
+	}
+	return s.processor.ProcessBatch(ctx, &batch)
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package beater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/internal/model"
+)
+
+func TestFileDeadLetterSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letter.ndjson")
+	sink, closeSink, err := newDeadLetterSink(config.DeadLetterConfig{
+		Output: config.DeadLetterOutputFile,
+		Path:   path,
+	}, "default", nil)
+	require.NoError(t, err)
+
+	timestamp := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	batch := model.Batch{{
+		Timestamp:   timestamp,
+		Processor:   model.TransactionProcessor,
+		Transaction: &model.Transaction{ID: "transaction_id"},
+	}, {
+		Timestamp: timestamp,
+		Processor: model.SpanProcessor,
+		Span:      &model.Span{ID: "span_id"},
+	}}
+	require.NoError(t, sink.WriteDeadLetters(context.Background(), batch, errors.New("indexing failed")))
+	require.NoError(t, sink.WriteDeadLetters(context.Background(), batch[:1], errors.New("indexing failed again")))
+	require.NoError(t, closeSink())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+
+	type deadLetter struct {
+		Error     string                 `json:"error"`
+		Timestamp time.Time              `json:"@timestamp"`
+		Event     map[string]interface{} `json:"event"`
+	}
+	var deadLetters []deadLetter
+	for _, line := range lines {
+		var d deadLetter
+		require.NoError(t, json.Unmarshal([]byte(line), &d))
+		deadLetters = append(deadLetters, d)
+	}
+	assert.Equal(t, "indexing failed", deadLetters[0].Error)
+	assert.Equal(t, timestamp, deadLetters[0].Timestamp)
+	assert.Equal(t, map[string]interface{}{"id": "transaction_id"}, deadLetters[0].Event["transaction"])
+	assert.Equal(t, "indexing failed", deadLetters[1].Error)
+	assert.Equal(t, map[string]interface{}{"id": "span_id"}, deadLetters[1].Event["span"])
+	assert.Equal(t, "indexing failed again", deadLetters[2].Error)
+}
+
+func TestDataStreamDeadLetterSink(t *testing.T) {
+	var indexed model.Batch
+	sink, closeSink, err := newDeadLetterSink(config.DeadLetterConfig{
+		Output: config.DeadLetterOutputDataStream,
+	}, "custom", model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		indexed = append(indexed, *batch...)
+		return nil
+	}))
+	require.NoError(t, err)
+	defer closeSink()
+
+	labels := model.Labels{"key": {Value: "value"}}
+	batch := model.Batch{{
+		DataStream:  model.DataStream{Type: "traces", Dataset: "apm", Namespace: "default"},
+		Processor:   model.TransactionProcessor,
+		Labels:      labels,
+		Transaction: &model.Transaction{ID: "transaction_id"},
+	}}
+	require.NoError(t, sink.WriteDeadLetters(context.Background(), batch, errors.New("indexing failed")))
+	require.Len(t, indexed, 1)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "apm.dead_letter", Namespace: "custom"}, indexed[0].DataStream)
+	assert.Equal(t, model.Labels{
+		"key":               {Value: "value"},
+		"dead_letter_error": {Value: "indexing failed"},
+	}, indexed[0].Labels)
+	assert.Equal(t, model.Labels{"key": {Value: "value"}}, labels) // not modified
+}
+
+func TestNewDeadLetterSinkDisabled(t *testing.T) {
+	sink, closeSink, err := newDeadLetterSink(config.DeadLetterConfig{}, "default", nil)
+	require.NoError(t, err)
+	assert.Nil(t, sink)
+	assert.NoError(t, closeSink())
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/elastic/apm-server/internal/beater/auth"
 	"github.com/elastic/apm-server/internal/beater/ratelimit"
 	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
 )
 
 const (
@@ -41,6 +42,7 @@ func authorizeEventIngestProcessor(ctx context.Context, batch *model.Batch) erro
 			AgentName:   event.Agent.Name,
 			ServiceName: event.Service.Name,
 		}); err != nil {
+			modelprocessor.RecordDropped(modelprocessor.DropReasonUnauthorized, len(*batch))
 			return err
 		}
 	}
@@ -55,6 +57,7 @@ func rateLimitBatchProcessor(ctx context.Context, batch *model.Batch) error {
 		ctx, cancel := context.WithTimeout(ctx, rateLimitTimeout)
 		defer cancel()
 		if err := limiter.WaitN(ctx, len(*batch)); err != nil {
+			modelprocessor.RecordDropped(modelprocessor.DropReasonRateLimited, len(*batch))
 			return ratelimit.ErrRateLimitExceeded
 		}
 	}
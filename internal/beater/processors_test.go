@@ -27,6 +27,7 @@ import (
 
 	"github.com/elastic/apm-server/internal/beater/ratelimit"
 	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/elastic-agent-libs/monitoring"
 )
 
 func TestRateLimitBatchProcessor(t *testing.T) {
@@ -44,6 +45,9 @@ func TestRateLimitBatchProcessor(t *testing.T) {
 
 	// After the second batch, the rate limiter burst has been exhausted,
 	// and the limit is not high enough to allow another one.
+	dropped := monitoring.Default.Get("apm-server.dropped.rate_limited").(*monitoring.Int)
+	initialDropped := dropped.Get()
 	err := rateLimitBatchProcessor(ctx, &batch)
 	assert.Equal(t, ratelimit.ErrRateLimitExceeded, err)
+	assert.Equal(t, int64(len(batch)), dropped.Get()-initialDropped)
 }
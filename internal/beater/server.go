@@ -50,6 +50,59 @@ import (
 // and RunServerFunc. See CreatorParams.WrapServer.
 type WrapServerFunc func(ServerParams, RunServerFunc) (ServerParams, RunServerFunc, error)
 
+// Processor is a model.BatchProcessor which is run alongside the server.
+// See CreatorParams.Processors.
+type Processor interface {
+	model.BatchProcessor
+
+	// Run runs the processor until Stop is called, or a fatal
+	// error occurs.
+	Run() error
+
+	// Stop stops the processor, waiting for it to finish processing
+	// until ctx is done.
+	Stop(ctx context.Context) error
+}
+
+// ProcessorPosition identifies the position of a registered processor
+// in the processing chain, relative to the metrics aggregators and the
+// tail sampler.
+type ProcessorPosition int
+
+const (
+	// ProcessorPositionBeforeAggregation places a processor at the start
+	// of the chain, so that its enrichment is visible to the metrics
+	// aggregators and the tail sampler.
+	ProcessorPositionBeforeAggregation ProcessorPosition = iota
+
+	// ProcessorPositionBeforeSampling places a processor after the metrics
+	// aggregators, and before the tail sampler.
+	ProcessorPositionBeforeSampling
+
+	// ProcessorPositionAfterSampling places a processor at the end of the
+	// chain, after the tail sampler, so that it processes only the events
+	// which are published, including those published by the tail sampler
+	// once their traces are sampled.
+	ProcessorPositionAfterSampling
+)
+
+// ProcessorRegistration registers a processor to be added to the processing
+// chain. See CreatorParams.Processors.
+type ProcessorRegistration struct {
+	// Name identifies the processor in logs.
+	Name string
+
+	// Position holds the position of the processor in the chain.
+	// Processors registered with the same position are added in
+	// the order in which they are registered.
+	Position ProcessorPosition
+
+	// New returns a new processor for the given ServerParams. New is
+	// called each time the server is started, including when it is
+	// restarted due to configuration reloading.
+	New func(ServerParams) (Processor, error)
+}
+
 // RunServerFunc is a function which runs the APM Server until a
 // fatal error occurs, or the context is cancelled.
 type RunServerFunc func(context.Context, ServerParams) error
@@ -92,6 +145,13 @@ type ServerParams struct {
 	// for publishing events to the output, such as Elasticsearch.
 	BatchProcessor model.BatchProcessor
 
+	// AggregationBatchProcessor holds the model.BatchProcessor used for
+	// publishing metrics aggregated by the server. This is the same as
+	// BatchProcessor, unless aggregated metrics are configured to be
+	// indexed separately with aggregation.elasticsearch, or into a
+	// different data stream namespace with aggregation.namespace.
+	AggregationBatchProcessor model.BatchProcessor
+
 	// PublishReady holds a channel which will be signalled when the serve
 	// is ready to publish events. Readiness means that preconditions for
 	// event publication have been met, including icense checks for some
@@ -122,6 +182,23 @@ type ServerParams struct {
 	// authentication/authorization, logging, metrics, and tracing.
 	// See package internal/beater/interceptors for details.
 	GRPCServer *grpc.Server
+
+	// Processors holds the processor registrations provided in
+	// CreatorParams.Processors, for WrapServer to add to the chain.
+	Processors []ProcessorRegistration
+
+	// FlushAggregations, if non-nil, forces the server's metrics
+	// aggregators to publish their metrics immediately, returning the
+	// number of groups published. WrapServer sets FlushAggregations if
+	// it adds aggregators, for serving at api.AggregationFlushPath when
+	// aggregation.flush_endpoint is enabled.
+	FlushAggregations func(context.Context) (int, error)
+
+	// MonitoringRegistries holds the names of the monitoring registries
+	// to which the processors added by WrapServer report metrics, for
+	// exposing at the Prometheus endpoint when prometheus.enabled is true.
+	// If empty, the default "apm-server" registries are exposed.
+	MonitoringRegistries []string
 }
 
 // newBaseRunServer returns the base RunServerFunc.
@@ -162,6 +239,7 @@ func newServer(args ServerParams, listener net.Listener) (server, error) {
 		args.Config, args.BatchProcessor,
 		args.Authenticator, agentcfgFetchReporter, args.RateLimitStore,
 		args.SourcemapFetcher, args.Managed, publishReady,
+		args.FlushAggregations, args.MonitoringRegistries,
 	)
 	if err != nil {
 		return server{}, err
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -62,6 +63,7 @@ import (
 	"github.com/elastic/apm-server/internal/beater/api"
 	"github.com/elastic/apm-server/internal/beater/config"
 	"github.com/elastic/apm-server/internal/elasticsearch"
+	"github.com/elastic/apm-server/internal/model"
 )
 
 type m map[string]interface{}
@@ -982,6 +984,109 @@ func TestServerElasticsearchOutput(t *testing.T) {
 	}, snapshot)
 }
 
+func TestServerAggregationNamespace(t *testing.T) {
+	docs := make(chan []byte, 2)
+	apmBeat, cfg := newBeat(t, agentconfig.MustNewConfigFrom(map[string]interface{}{
+		"data_streams.namespace": "traces_namespace",
+		"aggregation.namespace":  "metrics_namespace",
+	}), nil, docs)
+
+	createBeater := NewCreator(CreatorParams{
+		Logger: logp.NewLogger(""),
+		WrapServer: func(args ServerParams, runServer RunServerFunc) (ServerParams, RunServerFunc, error) {
+			// Capture the processors before the beater adds pre-processing
+			// for events decoded from agent payloads, such as authorization.
+			batchProcessor := args.BatchProcessor
+			aggregationBatchProcessor := args.AggregationBatchProcessor
+			return args, func(ctx context.Context, args ServerParams) error {
+				transaction := model.Batch{{
+					Processor:   model.TransactionProcessor,
+					Trace:       model.Trace{ID: "trace_id"},
+					Transaction: &model.Transaction{ID: "transaction_id", Sampled: true},
+				}}
+				if err := batchProcessor.ProcessBatch(ctx, &transaction); err != nil {
+					return err
+				}
+				metricset := model.Batch{{
+					Processor:   model.MetricsetProcessor,
+					Metricset:   &model.Metricset{Name: "transaction"},
+					Transaction: &model.Transaction{Name: "transaction_name"},
+				}}
+				if err := aggregationBatchProcessor.ProcessBatch(ctx, &metricset); err != nil {
+					return err
+				}
+				return runServer(ctx, args)
+			}, nil
+		},
+	})
+	beater, err := createBeater(apmBeat, cfg)
+	require.NoError(t, err)
+	t.Cleanup(beater.Stop)
+	go beater.Run(apmBeat)
+
+	namespaces := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-docs:
+			var doc struct {
+				Processor struct {
+					Event string
+				}
+				DataStreamNamespace string `json:"data_stream.namespace"`
+			}
+			require.NoError(t, json.Unmarshal(data, &doc))
+			namespaces[doc.Processor.Event] = doc.DataStreamNamespace
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for document")
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"transaction": "traces_namespace",
+		"metric":      "metrics_namespace",
+	}, namespaces)
+}
+
+func TestServerProcessorsRegistered(t *testing.T) {
+	registration := ProcessorRegistration{
+		Name:     "enrichment",
+		Position: ProcessorPositionBeforeSampling,
+		New: func(ServerParams) (Processor, error) {
+			return nil, errors.New("not implemented")
+		},
+	}
+
+	// Registered processors are added to the chain by WrapServer.
+	_, err := NewCreator(CreatorParams{
+		Logger:     logp.NewLogger(""),
+		Processors: []ProcessorRegistration{registration},
+	})(nil, nil)
+	assert.EqualError(t, err, "processors registered without WrapServer")
+
+	apmBeat, cfg := newBeat(t, nil, nil, nil)
+	registered := make(chan []ProcessorRegistration, 1)
+	createBeater := NewCreator(CreatorParams{
+		Logger:     logp.NewLogger(""),
+		Processors: []ProcessorRegistration{registration},
+		WrapServer: func(args ServerParams, runServer RunServerFunc) (ServerParams, RunServerFunc, error) {
+			registered <- args.Processors
+			return args, runServer, nil
+		},
+	})
+	beater, err := createBeater(apmBeat, cfg)
+	require.NoError(t, err)
+	t.Cleanup(beater.Stop)
+	go beater.Run(apmBeat)
+
+	select {
+	case processors := <-registered:
+		require.Len(t, processors, 1)
+		assert.Equal(t, "enrichment", processors[0].Name)
+		assert.Equal(t, ProcessorPositionBeforeSampling, processors[0].Position)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for server to be wrapped")
+	}
+}
+
 func TestServerPProf(t *testing.T) {
 	ucfg, err := agentconfig.NewConfigFrom(m{"pprof.enabled": true})
 	assert.NoError(t, err)
@@ -72,6 +72,8 @@ func newTracerServer(listener net.Listener, logger *logp.Logger) (*tracerServer,
 		nil,                         // no sourcemap store
 		false,                       // not managed
 		func() bool { return true }, // ready for publishing
+		nil,                         // no aggregators
+		nil,                         // default monitoring registries
 	)
 	if err != nil {
 		return nil, err
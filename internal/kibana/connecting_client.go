@@ -18,6 +18,7 @@
 package kibana
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -56,16 +57,29 @@ type Client interface {
 }
 
 // ConnectingClient implements Client interface
+//
+// Responses to agent config queries are cached for a short period of time,
+// so repeated identical queries do not each result in a request to Kibana.
+// The cache is invalidated whenever a new connection is established.
+//
+// Failures to reach Kibana, and the subsequent restoration of connectivity,
+// are logged with the time and duration of the outage.
 type ConnectingClient struct {
 	m      sync.RWMutex
 	client *kibana.Client
 	cfg    kibana.ClientConfig
+	cache  *responseCache
+	status *connectionStatus
 }
 
 // NewConnectingClient returns instance of ConnectingClient and starts a background routine trying to connect
 // to configured Kibana instance, using JitterBackoff for establishing connection.
 func NewConnectingClient(cfg kibana.ClientConfig) Client {
-	c := &ConnectingClient{cfg: cfg}
+	c := &ConnectingClient{
+		cfg:    cfg,
+		cache:  newResponseCache(defaultResponseCacheTTL),
+		status: newConnectionStatus(),
+	}
 	go func() {
 		log := logp.NewLogger(logs.Kibana)
 		done := make(chan struct{})
@@ -86,6 +100,9 @@ func NewConnectingClient(cfg kibana.ClientConfig) Client {
 
 // Send tries to send a request to Kibana via established connection and returns unparsed response
 // If no connection is established an error is returned
+//
+// Agent config queries are served from the response cache if an identical
+// query was sent recently.
 func (c *ConnectingClient) Send(ctx context.Context, method, extraPath string, params url.Values,
 	headers http.Header, body io.Reader) (*http.Response, error) {
 	c.m.RLock()
@@ -93,7 +110,45 @@ func (c *ConnectingClient) Send(ctx context.Context, method, extraPath string, p
 	if c.client == nil {
 		return nil, errNotConnected
 	}
-	return c.client.SendWithContext(ctx, method, extraPath, params, headers, body)
+	if !c.cache.cacheable(method, extraPath) {
+		return c.send(ctx, method, extraPath, params, headers, body)
+	}
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+	key := responseCacheKey(method, extraPath, params, reqBody)
+	if resp, ok := c.cache.get(key); ok {
+		responseCacheHits.Inc()
+		return resp, nil
+	}
+	responseCacheMisses.Inc()
+	resp, err := c.send(ctx, method, extraPath, params, headers, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	return c.cache.set(key, resp)
+}
+
+// send sends a request to Kibana, recording whether Kibana could be reached.
+// Only transport errors are treated as connectivity failures; any response,
+// regardless of status code, means Kibana was reached. send must be called
+// with c.m held.
+func (c *ConnectingClient) send(ctx context.Context, method, extraPath string, params url.Values,
+	headers http.Header, body io.Reader) (*http.Response, error) {
+	resp, err := c.client.SendWithContext(ctx, method, extraPath, params, headers, body)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.status.failed(err)
+		}
+		return nil, err
+	}
+	c.status.succeeded()
+	return resp, nil
 }
 
 // GetVersion returns Kibana version or an error
@@ -133,12 +188,15 @@ func (c *ConnectingClient) SupportsVersion(ctx context.Context, v *version.V, re
 	)
 	if err != nil {
 		log.Errorf("failed to obtain connection to Kibana: %s", err.Error())
+		c.status.failed(err)
 		return upToDate, err
 	}
 	client.HTTP = apmhttp.WrapClient(client.HTTP)
 	c.m.Lock()
 	c.client = client
+	c.cache.purge()
 	c.m.Unlock()
+	c.status.succeeded()
 	return c.SupportsVersion(ctx, v, false)
 }
 
@@ -158,9 +216,12 @@ func (c *ConnectingClient) connect() error {
 		libbeatversion.BuildTime().String(),
 	)
 	if err != nil {
+		c.status.failed(err)
 		return err
 	}
 	client.HTTP = apmhttp.WrapClient(client.HTTP)
 	c.client = client
+	c.cache.purge()
+	c.status.succeeded()
 	return nil
 }
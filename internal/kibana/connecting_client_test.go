@@ -19,16 +19,22 @@ package kibana
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/elastic/elastic-agent-libs/kibana"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
 	"github.com/elastic/elastic-agent-libs/version"
 )
 
@@ -79,6 +85,89 @@ func TestConnectingClient_Send(t *testing.T) {
 	})
 }
 
+func TestConnectingClient_SendCached(t *testing.T) {
+	var requests int64
+	var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Request", string(body))
+		if n == 1 {
+			w.Write([]byte(`{"hits": 1}`))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	responseCacheHits.Set(0)
+	responseCacheMisses.Set(0)
+	t.Cleanup(func() {
+		responseCacheHits.Set(0)
+		responseCacheMisses.Set(0)
+	})
+
+	now := time.Now()
+	conn := &ConnectingClient{
+		cfg:   kibana.ClientConfig{Host: srv.URL, IgnoreVersion: true},
+		cache: newResponseCache(time.Minute),
+	}
+	conn.cache.now = func() time.Time { return now }
+	require.NoError(t, conn.connect())
+
+	send := func(method, path, body string) (int, string, string) {
+		resp, err := conn.Send(context.Background(), method, path, nil, nil, strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get("X-Request"), string(respBody)
+	}
+	assertCounters := func(hits, misses int64) {
+		t.Helper()
+		snapshot := monitoring.CollectFlatSnapshot(responseCacheRegistry, monitoring.Full, false)
+		assert.Equal(t, map[string]int64{"hits": hits, "misses": misses}, snapshot.Ints)
+	}
+
+	// Identical queries are served from the cache, including the request body.
+	for i := 0; i < 3; i++ {
+		status, header, body := send(http.MethodPost, agentConfigSearchPath, `{"service":{"name":"a"}}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, `{"service":{"name":"a"}}`, header)
+		assert.Equal(t, `{"hits": 1}`, body)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&requests))
+	assertCounters(2, 1)
+
+	// Different queries are cached separately; not found responses are cached.
+	status, _, _ := send(http.MethodPost, agentConfigSearchPath, `{"service":{"name":"b"}}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _, _ = send(http.MethodPost, agentConfigSearchPath, `{"service":{"name":"b"}}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	assertCounters(3, 2)
+
+	// Requests to other endpoints are never cached.
+	send(http.MethodPost, "/api/apm/fleet/apm_server_schema", `{}`)
+	send(http.MethodPost, "/api/apm/fleet/apm_server_schema", `{}`)
+	assert.Equal(t, int64(4), atomic.LoadInt64(&requests))
+	assertCounters(3, 2)
+
+	// Entries expire after the TTL.
+	now = now.Add(time.Minute)
+	status, _, _ = send(http.MethodPost, agentConfigSearchPath, `{"service":{"name":"a"}}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, int64(5), atomic.LoadInt64(&requests))
+	assertCounters(3, 3)
+
+	// Reconnecting invalidates the cache.
+	_, err := conn.SupportsVersion(context.Background(), version.MustNew("99.0.0"), true)
+	require.NoError(t, err)
+	send(http.MethodPost, agentConfigSearchPath, `{"service":{"name":"a"}}`)
+	assert.Equal(t, int64(6), atomic.LoadInt64(&requests))
+	assertCounters(3, 4)
+}
+
 func TestConnectingClient_GetVersion(t *testing.T) {
 	t.Run("GetVersion", func(t *testing.T) {
 		c := mockClient()
@@ -119,8 +208,58 @@ func TestConnectingClient_SupportsVersion(t *testing.T) {
 	})
 }
 
+func TestConnectingClient_ConnectionStatus(t *testing.T) {
+	require.NoError(t, logp.DevelopmentSetup(logp.ToObserverOutput()))
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := mockClient()
+	c.status = newConnectionStatus()
+	c.status.now = func() time.Time { return now }
+	httpClient := c.client.HTTP
+
+	send := func() error {
+		resp, err := c.Send(context.Background(), http.MethodGet, "", nil, nil, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	require.NoError(t, send())
+	assert.Empty(t, logp.ObserverLogs().TakeAll())
+
+	// Only the first failure is logged.
+	httpClient.Transport = rt{err: errors.New("connection refused")}
+	assert.Error(t, send())
+	now = now.Add(time.Minute)
+	assert.Error(t, send())
+	entries := logp.ObserverLogs().TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "kibana-connection-lost", fields["event.action"])
+	assert.Equal(t, now.Add(-time.Minute), fields["event.start"])
+	assert.Equal(t, `Get "": connection refused`, fields["error"])
+
+	// Any response means Kibana is reachable again.
+	now = now.Add(time.Minute)
+	httpClient.Transport = rt{resp: &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       io.NopCloser(strings.NewReader("")),
+	}}
+	require.NoError(t, send())
+	require.NoError(t, send())
+	entries = logp.ObserverLogs().TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.InfoLevel, entries[0].Level)
+	fields = entries[0].ContextMap()
+	assert.Equal(t, "kibana-connection-restored", fields["event.action"])
+	assert.Equal(t, now.Add(-2*time.Minute), fields["event.start"])
+	assert.Equal(t, now, fields["event.end"])
+	assert.Equal(t, 2*time.Minute, fields["event.duration"])
+}
+
 type rt struct {
 	resp *http.Response
+	err  error
 }
 
 var (
@@ -134,7 +273,7 @@ var (
 
 // RoundTrip implements the Round Tripper interface
 func (rt rt) RoundTrip(r *http.Request) (*http.Response, error) {
-	return rt.resp, nil
+	return rt.resp, rt.err
 }
 func mockClient() *ConnectingClient {
 	return &ConnectingClient{client: &kibana.Client{
@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kibana
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+
+	"github.com/elastic/apm-server/internal/logs"
+)
+
+// connectionStatus tracks whether Kibana is reachable, logging structured
+// events when connectivity is lost and when it is regained, including the
+// duration of the outage. This allows stale agent config to be correlated
+// with Kibana outages.
+type connectionStatus struct {
+	logger *logp.Logger
+	now    func() time.Time
+
+	mu sync.Mutex
+	// lostAt holds the time at which connectivity to Kibana was lost,
+	// or the zero time if Kibana is reachable.
+	lostAt time.Time
+}
+
+func newConnectionStatus() *connectionStatus {
+	return &connectionStatus{
+		logger: logp.NewLogger(logs.Kibana),
+		now:    time.Now,
+	}
+}
+
+// failed records a failure to reach Kibana. If Kibana was previously
+// reachable, the loss of connectivity is logged.
+func (s *connectionStatus) failed(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lostAt.IsZero() {
+		return
+	}
+	s.lostAt = s.now()
+	s.logger.With(
+		logp.Error(err),
+		"event.action", "kibana-connection-lost",
+		"event.start", s.lostAt,
+	).Warnf("lost connection to Kibana: %s", err)
+}
+
+// succeeded records that Kibana was reached. If connectivity was previously
+// lost, its restoration is logged along with the duration of the outage.
+func (s *connectionStatus) succeeded() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lostAt.IsZero() {
+		return
+	}
+	now := s.now()
+	outage := now.Sub(s.lostAt)
+	s.logger.With(
+		"event.action", "kibana-connection-restored",
+		"event.start", s.lostAt,
+		"event.end", now,
+		"event.duration", outage,
+	).Infof("restored connection to Kibana after %s", outage)
+	s.lostAt = time.Time{}
+}
@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kibana
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+const (
+	// agentConfigSearchPath is the Kibana endpoint used for fetching agent config.
+	agentConfigSearchPath = "/api/apm/settings/agent-configuration/search"
+
+	// defaultResponseCacheTTL defines how long agent config responses are
+	// served from memory before being requested from Kibana again.
+	defaultResponseCacheTTL = 5 * time.Second
+)
+
+var (
+	responseCacheRegistry = monitoring.Default.NewRegistry("apm-server.kibana.agent_config_cache")
+	responseCacheHits     = monitoring.NewInt(responseCacheRegistry, "hits")
+	responseCacheMisses   = monitoring.NewInt(responseCacheRegistry, "misses")
+)
+
+// responseCache is a short-lived, in-memory cache of Kibana responses,
+// keyed by the request method, path, query parameters and body.
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	status     string
+	statusCode int
+	header     http.Header
+	body       []byte
+	expires    time.Time
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cachedResponse),
+	}
+}
+
+// cacheable reports whether responses to the given request may be cached.
+func (c *responseCache) cacheable(method, extraPath string) bool {
+	return c != nil && c.ttl > 0 && method == http.MethodPost && extraPath == agentConfigSearchPath
+}
+
+// get returns a new response for the cached entry with the given key,
+// if it exists and has not expired.
+func (c *responseCache) get(key string) (*http.Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.response(), true
+}
+
+// set stores the status, headers and body of resp under the given key,
+// and returns a new response which may be consumed by the caller.
+// Only successful and not found responses are cached; resp is returned
+// unmodified for any other status.
+func (c *responseCache) set(key string, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	entry := cachedResponse{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		header:     resp.Header.Clone(),
+		body:       body,
+		expires:    now.Add(c.ttl),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.entries {
+		if !now.Before(v.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+	return entry.response(), nil
+}
+
+// purge removes all cached entries.
+func (c *responseCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cachedResponse)
+}
+
+func (r cachedResponse) response() *http.Response {
+	return &http.Response{
+		StatusCode:    r.statusCode,
+		Status:        r.status,
+		Header:        r.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+	}
+}
+
+func responseCacheKey(method, extraPath string, params url.Values, body []byte) string {
+	var sb strings.Builder
+	sb.WriteString(method)
+	sb.WriteByte(' ')
+	sb.WriteString(extraPath)
+	sb.WriteByte('?')
+	sb.WriteString(params.Encode())
+	sb.WriteByte('\n')
+	sb.Write(body)
+	return sb.String()
+}
@@ -18,6 +18,7 @@
 package model
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/elastic/elastic-agent-libs/mapstr"
@@ -61,6 +62,13 @@ type Metricset struct {
 	//
 	// See https://www.elastic.co/guide/en/elasticsearch/reference/current/mapping-doc-count-field.html
 	DocCount int64
+
+	// Interval holds the aggregation interval of pre-aggregated metrics,
+	// for distinguishing metrics aggregated at different resolutions.
+	//
+	// Interval is encoded as a whole number of minutes if possible, such
+	// as "60m", and otherwise a whole number of seconds, such as "90s".
+	Interval time.Duration
 }
 
 // MetricsetSample represents a single named metric.
@@ -159,6 +167,9 @@ func (me *Metricset) setFields(fields *mapStr) {
 		fields.set("_doc_count", me.DocCount)
 	}
 	fields.maybeSetString("metricset.name", me.Name)
+	if me.Interval > 0 {
+		fields.set("metricset.interval", formatMetricsetInterval(me.Interval))
+	}
 
 	var metricDescriptions mapStr
 	for name, sample := range me.Samples {
@@ -172,6 +183,15 @@ func (me *Metricset) setFields(fields *mapStr) {
 	fields.maybeSetMapStr("_metric_descriptions", mapstr.M(metricDescriptions))
 }
 
+// formatMetricsetInterval formats d as a whole number of minutes, or
+// seconds if d is not a whole number of minutes.
+func formatMetricsetInterval(d time.Duration) string {
+	if d%time.Minute == 0 {
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
 func (s *MetricsetSample) set(name string, fields *mapStr) {
 	switch s.Type {
 	case MetricTypeHistogram:
@@ -73,6 +73,21 @@ func TestMetricset(t *testing.T) {
 			},
 			Msg: "Timeseries instance and _doc_count",
 		},
+		{
+			Metricset: &Metricset{Name: "transaction", Interval: time.Hour},
+			Output: mapstr.M{
+				"metricset.name":     "transaction",
+				"metricset.interval": "60m",
+			},
+			Msg: "Metricset interval in minutes",
+		},
+		{
+			Metricset: &Metricset{Interval: 90 * time.Second},
+			Output: mapstr.M{
+				"metricset.interval": "90s",
+			},
+			Msg: "Metricset interval in seconds",
+		},
 		{
 			Metricset: &Metricset{
 				Samples: map[string]MetricsetSample{
@@ -74,6 +74,7 @@ func TestDecodeNestedMetricset(t *testing.T) {
 func TestDecodeMapToMetricsetModel(t *testing.T) {
 	exceptions := func(key string) bool {
 		if key == "DocCount" ||
+			key == "Interval" ||
 			key == "Name" ||
 			key == "TimeseriesInstanceID" ||
 			// test Samples separately
@@ -26,6 +26,7 @@ import (
 	"net/http"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"go.elastic.co/fastjson"
 
@@ -37,9 +38,16 @@ import (
 var (
 	esHeader   = http.Header{"X-Elastic-Product-Origin": []string{"observability"}}
 	gzipHeader = http.Header{"Content-Encoding": []string{"gzip"}, "X-Elastic-Product-Origin": []string{"observability"}}
+	zstdHeader = http.Header{"Content-Encoding": []string{"zstd"}, "X-Elastic-Product-Origin": []string{"observability"}}
 	newline    = []byte("\n")
 )
 
+// compressor is implemented by *gzip.Writer and *zstd.Encoder.
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
 // NOTE(axw) please avoid introducing apm-server specific details to this code;
 // it should eventually be removed, and either contributed to go-elasticsearch
 // or replaced by a new go-elasticsearch bulk indexing implementation.
@@ -62,7 +70,8 @@ type bulkIndexer struct {
 	itemsAdded   int
 	bytesFlushed int
 	jsonw        fastjson.Writer
-	gzipw        *gzip.Writer
+	compressor   compressor
+	header       http.Header
 	copybuf      [32 * 1024]byte
 	writer       io.Writer
 	buf          bytes.Buffer
@@ -70,11 +79,23 @@ type bulkIndexer struct {
 	resp         elasticsearch.BulkIndexerResponse
 }
 
-func newBulkIndexer(client elasticsearch.Client, compressionLevel int) *bulkIndexer {
-	b := &bulkIndexer{client: client}
-	if compressionLevel != gzip.NoCompression {
-		b.gzipw, _ = gzip.NewWriterLevel(&b.buf, compressionLevel)
-		b.writer = b.gzipw
+func newBulkIndexer(client elasticsearch.Client, compressionCodec string, compressionLevel int) *bulkIndexer {
+	b := &bulkIndexer{client: client, header: esHeader}
+	switch compressionCodec {
+	case CompressionCodecZstd:
+		// Requests are compressed synchronously, one at a time,
+		// so there is no benefit to concurrent encoding.
+		b.compressor, _ = zstd.NewWriter(&b.buf, zstd.WithEncoderConcurrency(1))
+		b.header = zstdHeader
+	case CompressionCodecNone:
+	default:
+		if compressionLevel != gzip.NoCompression {
+			b.compressor, _ = gzip.NewWriterLevel(&b.buf, compressionLevel)
+			b.header = gzipHeader
+		}
+	}
+	if b.compressor != nil {
+		b.writer = b.compressor
 	} else {
 		b.writer = &b.buf
 	}
@@ -86,8 +107,8 @@ func newBulkIndexer(client elasticsearch.Client, compressionLevel int) *bulkInde
 func (b *bulkIndexer) Reset() {
 	b.itemsAdded, b.bytesFlushed = 0, 0
 	b.buf.Reset()
-	if b.gzipw != nil {
-		b.gzipw.Reset(&b.buf)
+	if b.compressor != nil {
+		b.compressor.Reset(&b.buf)
 	}
 	b.respBuf.Reset()
 	b.resp = elasticsearch.BulkIndexerResponse{Items: b.resp.Items[:0]}
@@ -146,18 +167,15 @@ func (b *bulkIndexer) Flush(ctx context.Context) (elasticsearch.BulkIndexerRespo
 	if b.itemsAdded == 0 {
 		return elasticsearch.BulkIndexerResponse{}, nil
 	}
-	if b.gzipw != nil {
-		if err := b.gzipw.Close(); err != nil {
+	if b.compressor != nil {
+		if err := b.compressor.Close(); err != nil {
 			return elasticsearch.BulkIndexerResponse{}, fmt.Errorf(
-				"failed closing the gzip writer: %w", err,
+				"failed closing the compressor: %w", err,
 			)
 		}
 	}
 
-	req := esapi.BulkRequest{Body: &b.buf, Header: esHeader}
-	if b.gzipw != nil {
-		req.Header = gzipHeader
-	}
+	req := esapi.BulkRequest{Body: &b.buf, Header: b.header}
 
 	bytesFlushed := b.buf.Len()
 	res, err := req.Do(ctx, b.client)
@@ -172,7 +190,10 @@ func (b *bulkIndexer) Flush(ctx context.Context) (elasticsearch.BulkIndexerRespo
 		if res.StatusCode == http.StatusTooManyRequests {
 			return elasticsearch.BulkIndexerResponse{}, errorTooManyRequests{res: res}
 		}
-		return elasticsearch.BulkIndexerResponse{}, fmt.Errorf("flush failed: %s", res.String())
+		return elasticsearch.BulkIndexerResponse{}, errorFlushFailed{
+			status: res.StatusCode,
+			msg:    fmt.Sprintf("flush failed: %s", res.String()),
+		}
 	}
 
 	if _, err := b.respBuf.ReadFrom(res.Body); err != nil {
@@ -208,3 +229,19 @@ type errorTooManyRequests struct {
 func (e errorTooManyRequests) Error() string {
 	return fmt.Sprintf("flush failed: %s", e.res.String())
 }
+
+// errorFlushFailed is returned when a bulk request fails with an
+// error response other than 429 (Too Many Requests).
+type errorFlushFailed struct {
+	status int
+	msg    string
+}
+
+func (e errorFlushFailed) Error() string {
+	return e.msg
+}
+
+// statusClass returns the class of an HTTP status code, e.g. 4 for 4xx.
+func statusClass(status int) int {
+	return status / 100
+}
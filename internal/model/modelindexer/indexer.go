@@ -72,6 +72,8 @@ type Indexer struct {
 	eventsAdded           int64
 	eventsActive          int64
 	eventsFailed          int64
+	eventsFailedClient    int64
+	eventsFailedServer    int64
 	eventsIndexed         int64
 	tooManyRequests       int64
 	bytesTotal            int64
@@ -92,12 +94,30 @@ type Indexer struct {
 	timerStopped chan struct{}
 }
 
+// Compression codecs for bulk requests.
+const (
+	CompressionCodecGzip = "gzip"
+	CompressionCodecZstd = "zstd"
+	CompressionCodecNone = "none"
+)
+
 // Config holds configuration for Indexer.
 type Config struct {
+	// CompressionCodec holds the codec used for compressing bulk requests:
+	// CompressionCodecGzip, CompressionCodecZstd, or CompressionCodecNone.
+	//
+	// If CompressionCodec is empty, the default of CompressionCodecGzip
+	// will be used. Not all versions of Elasticsearch accept requests
+	// compressed with zstd.
+	CompressionCodec string
+
 	// CompressionLevel holds the gzip compression level, from 0 (gzip.NoCompression)
 	// to 9 (gzip.BestCompression). Higher values provide greater compression, at a
 	// greater cost of CPU. The special value -1 (gzip.DefaultCompression) selects the
 	// default compression level.
+	//
+	// CompressionLevel only applies to CompressionCodecGzip. Requests compressed
+	// with zstd use the default zstd compression level.
 	CompressionLevel int
 
 	// MaxRequests holds the maximum number of bulk index requests to execute concurrently.
@@ -126,6 +146,13 @@ type Config struct {
 // New returns a new Indexer that indexes events directly into data streams.
 func New(client elasticsearch.Client, cfg Config) (*Indexer, error) {
 	logger := logp.NewLogger("modelindexer", logs.WithRateLimit(logRateLimit))
+	switch cfg.CompressionCodec {
+	case "":
+		cfg.CompressionCodec = CompressionCodecGzip
+	case CompressionCodecGzip, CompressionCodecZstd, CompressionCodecNone:
+	default:
+		return nil, fmt.Errorf("unsupported CompressionCodec %q", cfg.CompressionCodec)
+	}
 	if cfg.CompressionLevel < -1 || cfg.CompressionLevel > 9 {
 		return nil, fmt.Errorf(
 			"expected CompressionLevel in range [-1,9], got %d",
@@ -143,7 +170,7 @@ func New(client elasticsearch.Client, cfg Config) (*Indexer, error) {
 	}
 	available := make(chan *bulkIndexer, cfg.MaxRequests)
 	for i := 0; i < cfg.MaxRequests; i++ {
-		available <- newBulkIndexer(client, cfg.CompressionLevel)
+		available <- newBulkIndexer(client, cfg.CompressionCodec, cfg.CompressionLevel)
 	}
 	indexer := &Indexer{
 		availableBulkRequests: int64(len(available)),
@@ -196,6 +223,8 @@ func (i *Indexer) Stats() Stats {
 		Active:                atomic.LoadInt64(&i.eventsActive),
 		BulkRequests:          atomic.LoadInt64(&i.bulkRequests),
 		Failed:                atomic.LoadInt64(&i.eventsFailed),
+		FailedClient:          atomic.LoadInt64(&i.eventsFailedClient),
+		FailedServer:          atomic.LoadInt64(&i.eventsFailedServer),
 		Indexed:               atomic.LoadInt64(&i.eventsIndexed),
 		TooManyRequests:       atomic.LoadInt64(&i.tooManyRequests),
 		BytesTotal:            atomic.LoadInt64(&i.bytesTotal),
@@ -395,13 +424,22 @@ func (i *Indexer) flush(ctx context.Context, bulkIndexer *bulkIndexer) error {
 		}
 
 		var errTooMany errorTooManyRequests
+		var errFailed errorFlushFailed
 		// 429 may be returned as errors from the bulk indexer.
 		if errors.As(err, &errTooMany) {
 			atomic.AddInt64(&i.tooManyRequests, int64(n))
+			atomic.AddInt64(&i.eventsFailedClient, int64(n))
+		} else if errors.As(err, &errFailed) {
+			switch statusClass(errFailed.status) {
+			case 4:
+				atomic.AddInt64(&i.eventsFailedClient, int64(n))
+			case 5:
+				atomic.AddInt64(&i.eventsFailedServer, int64(n))
+			}
 		}
 		return err
 	}
-	var eventsFailed, eventsIndexed, tooManyRequests int64
+	var eventsFailed, eventsFailedClient, eventsFailedServer, eventsIndexed, tooManyRequests int64
 	for _, item := range resp.Items {
 		for _, info := range item {
 			if info.Error.Type != "" || info.Status > 201 {
@@ -409,6 +447,12 @@ func (i *Indexer) flush(ctx context.Context, bulkIndexer *bulkIndexer) error {
 				if info.Status == http.StatusTooManyRequests {
 					tooManyRequests++
 				}
+				switch statusClass(info.Status) {
+				case 4:
+					eventsFailedClient++
+				case 5:
+					eventsFailedServer++
+				}
 				logger.Errorf(
 					"failed to index event (%s): %s",
 					info.Error.Type, info.Error.Reason,
@@ -421,6 +465,12 @@ func (i *Indexer) flush(ctx context.Context, bulkIndexer *bulkIndexer) error {
 	if eventsFailed > 0 {
 		atomic.AddInt64(&i.eventsFailed, eventsFailed)
 	}
+	if eventsFailedClient > 0 {
+		atomic.AddInt64(&i.eventsFailedClient, eventsFailedClient)
+	}
+	if eventsFailedServer > 0 {
+		atomic.AddInt64(&i.eventsFailedServer, eventsFailedServer)
+	}
 	if eventsIndexed > 0 {
 		atomic.AddInt64(&i.eventsIndexed, eventsIndexed)
 	}
@@ -480,6 +530,17 @@ type Stats struct {
 	// Failed holds the number of indexing operations that failed.
 	Failed int64
 
+	// FailedClient holds the number of indexing operations that failed
+	// with a 4xx status, including those counted by TooManyRequests.
+	FailedClient int64
+
+	// FailedServer holds the number of indexing operations that failed
+	// with a 5xx status.
+	//
+	// Operations which failed without a response, e.g. due to a network
+	// error, are counted by neither FailedClient nor FailedServer.
+	FailedServer int64
+
 	// Indexed holds the number of indexing operations that have completed
 	// successfully.
 	Indexed int64
@@ -97,6 +97,8 @@ func TestModelIndexer(t *testing.T) {
 		Active:                0,
 		BulkRequests:          1,
 		Failed:                2,
+		FailedClient:          1,
+		FailedServer:          1,
 		Indexed:               N - 2,
 		TooManyRequests:       1,
 		AvailableBulkRequests: 10,
@@ -226,6 +228,62 @@ func TestModelIndexerCompressionLevel(t *testing.T) {
 	}, stats)
 }
 
+func TestModelIndexerCompressionCodec(t *testing.T) {
+	for _, codec := range []string{"", "gzip", "zstd", "none"} {
+		t.Run(codec, func(t *testing.T) {
+			var contentEncoding string
+			var docs [][]byte
+			client := modelindexertest.NewMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+				contentEncoding = r.Header.Get("Content-Encoding")
+				var result elasticsearch.BulkIndexerResponse
+				docs, result = modelindexertest.DecodeBulkRequest(r)
+				json.NewEncoder(w).Encode(result)
+			})
+			indexer, err := modelindexer.New(client, modelindexer.Config{
+				CompressionCodec: codec,
+				CompressionLevel: gzip.BestSpeed,
+				FlushInterval:    time.Minute,
+			})
+			require.NoError(t, err)
+			defer indexer.Close(context.Background())
+
+			batch := model.Batch{{
+				Timestamp: time.Unix(123, 456789111).UTC(),
+				DataStream: model.DataStream{
+					Type:      "logs",
+					Dataset:   "apm_server",
+					Namespace: "testing",
+				},
+			}, {
+				Timestamp: time.Unix(124, 456789111).UTC(),
+				DataStream: model.DataStream{
+					Type:      "logs",
+					Dataset:   "apm_server",
+					Namespace: "testing",
+				},
+			}}
+			err = indexer.ProcessBatch(context.Background(), &batch)
+			require.NoError(t, err)
+			err = indexer.Close(context.Background())
+			require.NoError(t, err)
+
+			assert.Len(t, docs, 2)
+			assert.Equal(t, int64(2), indexer.Stats().Indexed)
+			switch codec {
+			case "", "gzip":
+				assert.Equal(t, "gzip", contentEncoding)
+			case "zstd":
+				assert.Equal(t, "zstd", contentEncoding)
+			default:
+				assert.Empty(t, contentEncoding)
+			}
+		})
+	}
+
+	_, err := modelindexer.New(nil, modelindexer.Config{CompressionCodec: "lz4"})
+	assert.EqualError(t, err, `unsupported CompressionCodec "lz4"`)
+}
+
 func TestModelIndexerFlushInterval(t *testing.T) {
 	requests := make(chan struct{}, 1)
 	client := modelindexertest.NewMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
@@ -330,6 +388,7 @@ func TestModelIndexerServerError(t *testing.T) {
 		Active:                0,
 		BulkRequests:          1,
 		Failed:                1,
+		FailedServer:          1,
 		AvailableBulkRequests: 10,
 		BytesTotal:            bytesTotal,
 	}, stats)
@@ -364,6 +423,7 @@ func TestModelIndexerServerErrorTooManyRequests(t *testing.T) {
 		Active:                0,
 		BulkRequests:          1,
 		Failed:                1,
+		FailedClient:          1,
 		TooManyRequests:       1,
 		AvailableBulkRequests: 10,
 		BytesTotal:            bytesTotal,
@@ -29,6 +29,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 
 	"github.com/elastic/go-elasticsearch/v8/esutil"
@@ -68,6 +69,13 @@ func DecodeBulkRequest(r *http.Request) ([][]byte, elasticsearch.BulkIndexerResp
 		}
 		defer r.Close()
 		body = r
+	case "zstd":
+		r, err := zstd.NewReader(body)
+		if err != nil {
+			panic(err)
+		}
+		defer r.Close()
+		body = r.IOReadCloser()
 	}
 
 	scanner := bufio.NewScanner(body)
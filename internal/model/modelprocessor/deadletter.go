@@ -0,0 +1,73 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor
+
+import (
+	"context"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+var (
+	deadLetterRegistry      = monitoring.Default.NewRegistry("apm-server.dead_letter")
+	deadLetterEventsWritten = monitoring.NewInt(deadLetterRegistry, "events")
+	deadLetterEventsFailed  = monitoring.NewInt(deadLetterRegistry, "failed")
+)
+
+// DeadLetterSink receives batches of events which could not be processed.
+type DeadLetterSink interface {
+	// WriteDeadLetters records the events in batch, which could not be
+	// processed due to err.
+	WriteDeadLetters(ctx context.Context, batch model.Batch, err error) error
+}
+
+// DeadLetter is a model.BatchProcessor that calls Processor, typically a
+// Chained processor, and writes any batch for which it returns an error to
+// Sink for later inspection or replay, rather than silently dropping it.
+//
+// The events written to Sink are those passed to ProcessBatch, before any
+// modifications made to the batch by Processor. Processor's error is always
+// returned, so callers are unaffected by whether events are dead-lettered.
+//
+// Dead-lettered events are counted in metrics named
+// `apm-server.dead_letter.events`, and events which could not be written to
+// Sink are counted in `apm-server.dead_letter.failed`.
+type DeadLetter struct {
+	Processor model.BatchProcessor
+	Sink      DeadLetterSink
+}
+
+// ProcessBatch calls d.Processor, writing b to d.Sink if it returns an error.
+func (d *DeadLetter) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	// Processors may modify the batch, e.g. removing events which are
+	// buffered for tail-based sampling, so keep the events as received.
+	received := make(model.Batch, len(*b))
+	copy(received, *b)
+	err := d.Processor.ProcessBatch(ctx, b)
+	if err == nil || len(received) == 0 {
+		return err
+	}
+	if sinkErr := d.Sink.WriteDeadLetters(ctx, received, err); sinkErr != nil {
+		deadLetterEventsFailed.Add(int64(len(received)))
+	} else {
+		deadLetterEventsWritten.Add(int64(len(received)))
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+func TestDeadLetter(t *testing.T) {
+	written := monitoring.Default.Get("apm-server.dead_letter.events").(*monitoring.Int)
+	failed := monitoring.Default.Get("apm-server.dead_letter.failed").(*monitoring.Int)
+	writtenBefore, failedBefore := written.Get(), failed.Get()
+	t.Cleanup(func() {
+		written.Set(writtenBefore)
+		failed.Set(failedBefore)
+	})
+
+	processErr := errors.New("processing failed")
+	var sinkErr error
+	var sinkBatches []model.Batch
+	var sinkErrs []error
+	processor := &modelprocessor.DeadLetter{
+		Processor: modelprocessor.Chained{
+			model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				// Modifications to the batch should not affect
+				// the events which are dead-lettered.
+				*batch = (*batch)[:1]
+				return nil
+			}),
+			model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				if (*batch)[0].Service.Name == "fail" {
+					return processErr
+				}
+				return nil
+			}),
+		},
+		Sink: deadLetterSinkFunc(func(ctx context.Context, batch model.Batch, err error) error {
+			sinkBatches = append(sinkBatches, batch)
+			sinkErrs = append(sinkErrs, err)
+			return sinkErr
+		}),
+	}
+
+	ok := model.Batch{{Service: model.Service{Name: "ok"}}, {}}
+	assert.NoError(t, processor.ProcessBatch(context.Background(), &ok))
+	assert.Empty(t, sinkBatches)
+
+	fail := model.Batch{{Service: model.Service{Name: "fail"}}, {}}
+	assert.Equal(t, processErr, processor.ProcessBatch(context.Background(), &fail))
+	assert.Equal(t, []model.Batch{{{Service: model.Service{Name: "fail"}}, {}}}, sinkBatches)
+	assert.Equal(t, []error{processErr}, sinkErrs)
+	assert.Equal(t, writtenBefore+2, written.Get())
+	assert.Equal(t, failedBefore, failed.Get())
+
+	// Errors writing to the sink are counted, and the processing
+	// error is returned.
+	sinkErr = errors.New("sink failed")
+	fail = model.Batch{{Service: model.Service{Name: "fail"}}, {}}
+	assert.Equal(t, processErr, processor.ProcessBatch(context.Background(), &fail))
+	assert.Len(t, sinkBatches, 2)
+	assert.Equal(t, writtenBefore+2, written.Get())
+	assert.Equal(t, failedBefore+2, failed.Get())
+}
+
+type deadLetterSinkFunc func(context.Context, model.Batch, error) error
+
+func (f deadLetterSinkFunc) WriteDeadLetters(ctx context.Context, batch model.Batch, err error) error {
+	return f(ctx, batch, err)
+}
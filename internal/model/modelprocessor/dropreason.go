@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor
+
+import (
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// DropReason is a machine-readable code describing why events were dropped
+// or rejected before being published.
+//
+// Dropped events are counted by reason in metrics named
+// `apm-server.dropped.<reason>`.
+type DropReason string
+
+const (
+	// DropReasonUnsampled identifies head-based unsampled transactions,
+	// which are dropped by the processor returned by NewDropUnsampled.
+	DropReasonUnsampled DropReason = "unsampled"
+
+	// DropReasonPolicy identifies trace events dropped due to a
+	// tail-sampling policy decision.
+	DropReasonPolicy DropReason = "policy"
+
+	// DropReasonStorageFull identifies trace events dropped due to the
+	// tail-sampling storage limit being reached.
+	DropReasonStorageFull DropReason = "storage_full"
+
+	// DropReasonStorageError identifies trace events dropped due to
+	// tail-sampling storage errors, other than the storage limit being
+	// reached.
+	DropReasonStorageError DropReason = "storage_error"
+
+	// DropReasonOversized identifies events rejected for exceeding the
+	// maximum permitted event size.
+	DropReasonOversized DropReason = "oversized"
+
+	// DropReasonInvalid identifies events rejected for failing decoding
+	// or validation.
+	DropReasonInvalid DropReason = "invalid"
+
+	// DropReasonRateLimited identifies events rejected due to the
+	// anonymous rate limit being exceeded.
+	DropReasonRateLimited DropReason = "rate_limited"
+
+	// DropReasonUnauthorized identifies events rejected due to the agent
+	// or service not being authorized to ingest events.
+	DropReasonUnauthorized DropReason = "unauthorized"
+)
+
+// DropReasons holds all known DropReasons.
+var DropReasons = []DropReason{
+	DropReasonUnsampled,
+	DropReasonPolicy,
+	DropReasonStorageFull,
+	DropReasonStorageError,
+	DropReasonOversized,
+	DropReasonInvalid,
+	DropReasonRateLimited,
+	DropReasonUnauthorized,
+}
+
+var droppedCounters = func() map[DropReason]*monitoring.Int {
+	registry := monitoring.Default.NewRegistry("apm-server.dropped")
+	counters := make(map[DropReason]*monitoring.Int, len(DropReasons))
+	for _, reason := range DropReasons {
+		counters[reason] = monitoring.NewInt(registry, string(reason))
+	}
+	return counters
+}()
+
+// RecordDropped records n events as having been dropped for the given reason.
+//
+// RecordDropped panics if reason is not one of DropReasons.
+func RecordDropped(reason DropReason, n int) {
+	counter, ok := droppedCounters[reason]
+	if !ok {
+		panic("unknown drop reason: " + string(reason))
+	}
+	counter.Add(int64(n))
+}
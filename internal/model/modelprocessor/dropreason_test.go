@@ -0,0 +1,37 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+func TestRecordDropped(t *testing.T) {
+	for _, reason := range modelprocessor.DropReasons {
+		counter := monitoring.Default.Get("apm-server.dropped." + string(reason)).(*monitoring.Int)
+		before := counter.Get()
+		modelprocessor.RecordDropped(reason, 3)
+		assert.Equal(t, before+3, counter.Get(), reason)
+	}
+	assert.Panics(t, func() { modelprocessor.RecordDropped("unknown", 1) })
+}
@@ -31,7 +31,8 @@ var (
 )
 
 // NewDropUnsampled returns a model.BatchProcessor which drops unsampled transaction events,
-// and counts them in a metric named `apm-server.sampling.transactions_dropped`.
+// and counts them in a metric named `apm-server.sampling.transactions_dropped`. The dropped
+// transactions are also recorded with the reason DropReasonUnsampled.
 //
 // If dropRUM is false, only non-RUM unsampled transaction events are dropped; otherwise all
 // unsampled transaction events are dropped.
@@ -52,6 +53,7 @@ func NewDropUnsampled(dropRUM bool) model.BatchProcessor {
 		}
 		if dropped := len(*batch) - len(events); dropped > 0 {
 			transactionsDroppedCounter.Add(int64(dropped))
+			RecordDropped(DropReasonUnsampled, dropped)
 		}
 		*batch = events
 		return nil
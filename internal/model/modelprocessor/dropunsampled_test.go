@@ -33,6 +33,9 @@ func TestNewDropUnsampled(t *testing.T) {
 		batchProcessor := modelprocessor.NewDropUnsampled(dropRUM)
 		counter := monitoring.Default.Get("apm-server.sampling.transactions_dropped").(*monitoring.Int)
 		counter.Set(0)
+		for _, reason := range modelprocessor.DropReasons {
+			monitoring.Default.Get("apm-server.dropped." + string(reason)).(*monitoring.Int).Set(0)
+		}
 
 		rumAgent := model.Agent{Name: "rum-js"}
 		t1 := &model.Transaction{ID: "t1", Sampled: false}
@@ -85,6 +88,12 @@ func TestNewDropUnsampled(t *testing.T) {
 		assert.ElementsMatch(t, expectedRemainingBatch, batch)
 		expectedMonitoring := monitoring.MakeFlatSnapshot()
 		expectedMonitoring.Ints["apm-server.sampling.transactions_dropped"] = expectedTransactionsDropped
+		for _, reason := range modelprocessor.DropReasons {
+			expectedMonitoring.Ints["apm-server.dropped."+string(reason)] = 0
+		}
+		expectedMonitoring.Ints["apm-server.dropped.unsampled"] = expectedTransactionsDropped
+		expectedMonitoring.Ints["apm-server.dead_letter.events"] = 0
+		expectedMonitoring.Ints["apm-server.dead_letter.failed"] = 0
 		snapshot := monitoring.CollectFlatSnapshot(
 			monitoring.Default,
 			monitoring.Full,
@@ -21,6 +21,8 @@ import (
 	"errors"
 
 	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
 )
 
 const (
@@ -57,8 +59,10 @@ func (r *Result) add(err error, add bool) {
 	if errors.As(err, &invalid) {
 		if invalid.TooLarge {
 			mTooLarge.Inc()
+			modelprocessor.RecordDropped(modelprocessor.DropReasonOversized, 1)
 		} else {
 			mInvalid.Inc()
+			modelprocessor.RecordDropped(modelprocessor.DropReasonInvalid, 1)
 		}
 	}
 	if add {
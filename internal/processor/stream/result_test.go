@@ -22,6 +22,8 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
 )
 
 func TestResultAdd(t *testing.T) {
@@ -51,6 +53,10 @@ func TestMonitoring(t *testing.T) {
 	initialAccepted := mAccepted.Get()
 	initialInvalid := mInvalid.Get()
 	initialTooLarge := mTooLarge.Get()
+	droppedInvalid := monitoring.Default.Get("apm-server.dropped.invalid").(*monitoring.Int)
+	droppedOversized := monitoring.Default.Get("apm-server.dropped.oversized").(*monitoring.Int)
+	initialDroppedInvalid := droppedInvalid.Get()
+	initialDroppedOversized := droppedOversized.Get()
 
 	var result Result
 	result.AddAccepted(9)
@@ -65,4 +71,6 @@ func TestMonitoring(t *testing.T) {
 	assert.Equal(t, int64(12), mAccepted.Get()-initialAccepted)
 	assert.Equal(t, int64(10), mInvalid.Get()-initialInvalid)
 	assert.Equal(t, int64(2), mTooLarge.Get()-initialTooLarge)
+	assert.Equal(t, int64(10), droppedInvalid.Get()-initialDroppedInvalid)
+	assert.Equal(t, int64(2), droppedOversized.Get()-initialDroppedOversized)
 }
@@ -193,6 +193,7 @@ func TestAPIKeyVerify(t *testing.T) {
 		"event:write":       true,
 		"config_agent:read": true,
 		"sourcemap:write":   false,
+		"aggregation:flush": false,
 	}, attrs)
 
 	cmd = apiKeyCommand("verify", "--json", "--credentials="+credentials, "--ingest")
@@ -33,7 +33,13 @@ func main() {
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
-	if err := gencorpora.Run(ctx); err != nil {
+	run := gencorpora.Run
+	if gencorpora.ReplayConfigured() {
+		run = gencorpora.Replay
+	} else if gencorpora.SyntheticConfigured() {
+		run = gencorpora.Synthetic
+	}
+	if err := run(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -23,32 +23,40 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8/esutil"
 )
 
 // CatBulkServer wraps http server and a listener to listen
-// for ES requests on any available port
+// for ES requests on the configured address, or any available port
 type CatBulkServer struct {
 	listener net.Listener
 	server   *http.Server
 	Addr     string
 
-	writer io.WriteCloser
+	// writers holds the writers for each shard of the corpus, and
+	// sourceFiles the paths of the files to which they first write.
+	writers     []*corpusWriter
+	sourceFiles []string
 
 	metaUpdateChan chan docsStat
 	metaWriteDone  chan struct{}
 }
 
-// docsStat represents statistics of ES docs generated by a request
+// docsStat represents statistics of ES docs generated by a request,
+// for one shard of the corpus.
 type docsStat struct {
+	shard int
 	count int
 	bytes int
 }
@@ -56,15 +64,49 @@ type docsStat struct {
 // NewCatBulkServer returns a HTTP Server which can serve as a
 // fake ES server writing the response of the bulk request to the
 // provided writer. Writes to the provided writer must be thread safe.
+//
+// The server listens on the address configured with -listen-addr, or
+// on a random port if none is configured. Addr holds the address on
+// which the server is listening in either case.
 func NewCatBulkServer() (*CatBulkServer, error) {
-	listener, err := net.Listen("tcp", ":0")
+	listenAddr := gencorporaConfig.CatBulkListenAddr
+	if listenAddr == "" {
+		listenAddr = ":0"
+	}
+	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to listen on %q for cat bulk server: %w", listenAddr, err)
 	}
 
-	writer, err := os.Create(gencorporaConfig.CorporaPath)
-	if err != nil {
-		return nil, err
+	shards := gencorporaConfig.CorporaShards
+	if shards < 1 {
+		listener.Close()
+		return nil, fmt.Errorf("invalid number of corpora shards %d, must be at least 1", shards)
+	}
+	sourceFiles := []string{gencorporaConfig.CorporaPath}
+	if shards > 1 {
+		sourceFiles = make([]string, shards)
+		for i := range sourceFiles {
+			sourceFiles[i] = corporaShardPath(gencorporaConfig.CorporaPath, i)
+		}
+	}
+	if gencorporaConfig.CorporaMaxBytes < 0 {
+		listener.Close()
+		return nil, fmt.Errorf("invalid corpora max bytes %d, must not be negative", gencorporaConfig.CorporaMaxBytes)
+	}
+	writers := make([]*corpusWriter, len(sourceFiles))
+	handlerWriters := make([]io.Writer, len(sourceFiles))
+	for i, sourceFile := range sourceFiles {
+		writer, err := newCorpusWriter(sourceFile, gencorporaConfig.CorporaMaxBytes)
+		if err != nil {
+			for _, writer := range writers[:i] {
+				writer.Close()
+			}
+			listener.Close()
+			return nil, err
+		}
+		writers[i] = writer
+		handlerWriters[i] = writer
 	}
 
 	addr := listener.Addr().String()
@@ -73,10 +115,17 @@ func NewCatBulkServer() (*CatBulkServer, error) {
 		listener: listener,
 		Addr:     addr,
 		server: &http.Server{
-			Addr:    addr,
-			Handler: handleReq(metaUpdateChan, writer),
+			Addr: addr,
+			Handler: handleReq(
+				metaUpdateChan, handlerWriters,
+				gencorporaConfig.MaxConcurrentBulkRequests,
+				gencorporaConfig.BulkRetryAfter,
+				gencorporaConfig.MaxContentLength,
+				gencorporaConfig.TraceBulkRequests,
+			),
 		},
-		writer:         writer,
+		writers:        writers,
+		sourceFiles:    sourceFiles,
 		metaUpdateChan: metaUpdateChan,
 		metaWriteDone:  make(chan struct{}),
 	}, nil
@@ -101,7 +150,11 @@ func (s *CatBulkServer) Serve() error {
 func (s *CatBulkServer) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	defer s.writer.Close()
+	defer func() {
+		for _, writer := range s.writers {
+			writer.Close()
+		}
+	}()
 
 	if err := s.server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("failed to shutdown cat bulk server no metadata written: %w", err)
@@ -117,19 +170,47 @@ func (s *CatBulkServer) metaWriter() error {
 	defer close(s.metaWriteDone)
 
 	metadata := struct {
-		SourceFile                 string `json:"source-file"`
-		DocumentCount              int    `json:"document-count"`
-		UncompressedBytes          int    `json:"uncompressed-bytes"`
-		IncludedsActionAndMetadata bool   `json:"includes-action-and-meta-data"`
+		SourceFile                 string        `json:"source-file,omitempty"`
+		DocumentCount              int           `json:"document-count"`
+		UncompressedBytes          int           `json:"uncompressed-bytes"`
+		IncludedsActionAndMetadata bool          `json:"includes-action-and-meta-data"`
+		Files                      []corpusFile  `json:"files,omitempty"`
+		Shards                     []corpusShard `json:"shards,omitempty"`
 	}{
-		SourceFile:                 gencorporaConfig.CorporaPath,
 		IncludedsActionAndMetadata: true,
 	}
+	// A sharded corpus has no single source file; the counts of each
+	// shard are recorded along with the totals.
+	if len(s.sourceFiles) == 1 {
+		metadata.SourceFile = s.sourceFiles[0]
+	} else {
+		metadata.Shards = make([]corpusShard, len(s.sourceFiles))
+		for i, sourceFile := range s.sourceFiles {
+			metadata.Shards[i].SourceFile = sourceFile
+		}
+	}
 
 	// update metadata as request is received by the server
 	for stat := range s.metaUpdateChan {
 		metadata.DocumentCount += stat.count
 		metadata.UncompressedBytes += stat.bytes
+		if metadata.Shards != nil {
+			metadata.Shards[stat.shard].DocumentCount += stat.count
+			metadata.Shards[stat.shard].UncompressedBytes += stat.bytes
+		}
+	}
+
+	// If the corpus files are rotated, each file written is recorded
+	// along with its size. The writers are no longer written to once
+	// metaUpdateChan is closed.
+	if gencorporaConfig.CorporaMaxBytes > 0 {
+		if metadata.Shards == nil {
+			metadata.Files = s.writers[0].Files()
+		} else {
+			for i, writer := range s.writers {
+				metadata.Shards[i].Files = writer.Files()
+			}
+		}
 	}
 
 	// write metadata to a file
@@ -148,7 +229,63 @@ func (s *CatBulkServer) metaWriter() error {
 	return nil
 }
 
-func handleReq(metaUpdateChan chan docsStat, writer io.Writer) http.HandlerFunc {
+// corpusShard holds the metadata of one shard of a sharded corpus. Files
+// lists the files of the shard, if they are rotated.
+type corpusShard struct {
+	SourceFile        string       `json:"source-file"`
+	DocumentCount     int          `json:"document-count"`
+	UncompressedBytes int          `json:"uncompressed-bytes"`
+	Files             []corpusFile `json:"files,omitempty"`
+}
+
+// handleReq returns a http.HandlerFunc which handles ES requests, writing the
+// documents of bulk requests to writers, distributing them round-robin if there
+// is more than one, and sending statistics for each writer to metaUpdateChan. If maxConcurrentBulkRequests is greater
+// than zero, bulk requests received while maxConcurrentBulkRequests are being
+// processed are rejected with 429 Too Many Requests, like ES does when its bulk
+// thread pool queue is full. If retryAfter is greater than zero, rejected requests
+// have a Retry-After header set to retryAfter, rounded up to whole seconds, so
+// clients can be checked for backing off accordingly. If maxContentLength is
+// greater than zero, requests whose body exceeds maxContentLength bytes after
+// decompression are rejected with 413 Request Entity Too Large, like ES does
+// for requests exceeding http.max_content_length. If traceRequests is true, each
+// request is logged; see traceRequest.
+func handleReq(
+	metaUpdateChan chan docsStat,
+	writers []io.Writer,
+	maxConcurrentBulkRequests int,
+	retryAfter time.Duration,
+	maxContentLength int64,
+	traceRequests bool,
+) http.HandlerFunc {
+	handler := handleBulkReq(metaUpdateChan, writers, maxConcurrentBulkRequests, retryAfter, maxContentLength)
+	if traceRequests {
+		return traceRequest(handler)
+	}
+	return handler
+}
+
+// handleBulkReq returns the http.HandlerFunc returned by handleReq, without
+// request tracing.
+func handleBulkReq(
+	metaUpdateChan chan docsStat,
+	writers []io.Writer,
+	maxConcurrentBulkRequests int,
+	retryAfter time.Duration,
+	maxContentLength int64,
+) http.HandlerFunc {
+	var sem chan struct{}
+	if maxConcurrentBulkRequests > 0 {
+		sem = make(chan struct{}, maxConcurrentBulkRequests)
+	}
+	var retryAfterHeader string
+	if retryAfter > 0 {
+		seconds := (retryAfter + time.Second - 1) / time.Second
+		retryAfterHeader = strconv.FormatInt(int64(seconds), 10)
+	}
+	// next holds the number of documents assigned to shards, for
+	// distributing them round-robin. It is accessed atomically.
+	var next uint64
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("X-Elastic-Product", "Elasticsearch")
 		switch req.Method {
@@ -156,6 +293,27 @@ func handleReq(metaUpdateChan chan docsStat, writer io.Writer) http.HandlerFunc
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(`{"cluster_uuid": "cat_bulk"}`))
 		case http.MethodPost:
+			if maxContentLength > 0 && req.ContentLength > maxContentLength &&
+				req.Header.Get("Content-Encoding") == "" {
+				// Reject the request without reading the body.
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write(bulkTooLargeResponse)
+				return
+			}
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				default:
+					if retryAfterHeader != "" {
+						w.Header().Set("Retry-After", retryAfterHeader)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					w.Write(bulkRejectedResponse)
+					return
+				}
+			}
+
 			reader := req.Body
 			defer req.Body.Close()
 
@@ -168,23 +326,28 @@ func handleReq(metaUpdateChan chan docsStat, writer io.Writer) http.HandlerFunc
 					return
 				}
 			}
+			var body io.Reader = reader
+			if maxContentLength > 0 {
+				body = &maxContentLengthReader{r: reader, remaining: maxContentLength}
+			}
 
 			mockResp := esutil.BulkIndexerResponse{}
-			scanner := bufio.NewScanner(reader)
+			scanner := bufio.NewScanner(body)
 			scanner.Split(splitMetadataAndSource)
 
-			var stat docsStat
+			// Documents are buffered until the whole request body has been
+			// read, so a truncated request does not add a partial set of
+			// documents to the corpus.
+			docs := make([]bytes.Buffer, len(writers))
+			stats := make([]docsStat, len(writers))
 			for scanner.Scan() {
-				n, err := writer.Write(scanner.Bytes())
-				if err != nil {
-					// Discard the request without processing further
-					log.Println("failed to write ES corpora to a file", err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
+				var shard int
+				if len(writers) > 1 {
+					shard = int((atomic.AddUint64(&next, 1) - 1) % uint64(len(writers)))
 				}
-
-				stat.count++
-				stat.bytes += n
+				n, _ := docs[shard].Write(scanner.Bytes())
+				stats[shard].count++
+				stats[shard].bytes += n
 
 				item := map[string]esutil.BulkIndexerResponseItem{
 					"action": {Status: http.StatusOK},
@@ -193,13 +356,47 @@ func handleReq(metaUpdateChan chan docsStat, writer io.Writer) http.HandlerFunc
 			}
 
 			if err := scanner.Err(); err != nil {
+				if errors.Is(err, errContentTooLong) {
+					log.Println("discarding bulk request exceeding max content length")
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					w.Write(bulkTooLargeResponse)
+					return
+				}
+				if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) {
+					// The client sent a truncated or corrupt body, e.g.
+					// because the connection was dropped mid-request.
+					log.Println("discarding truncated bulk request", err)
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write(bulkTruncatedResponse)
+					return
+				}
 				log.Println("failed to read ES corpora", err)
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
+			for i, writer := range writers {
+				if docs[i].Len() == 0 {
+					continue
+				}
+				if _, err := writer.Write(docs[i].Bytes()); err != nil {
+					// Discard the request without processing further
+					log.Println("failed to write ES corpora to a file", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+
 			// Update metadata with the ES document statistics generated by this request
-			metaUpdateChan <- stat
+			trace, _ := req.Context().Value(requestTraceKey{}).(*requestTrace)
+			for i, stat := range stats {
+				stat.shard = i
+				metaUpdateChan <- stat
+				if trace != nil {
+					trace.docs += stat.count
+					trace.bytes += stat.bytes
+				}
+			}
 
 			resp, err := json.Marshal(mockResp)
 			if err != nil {
@@ -215,35 +412,183 @@ func handleReq(metaUpdateChan chan docsStat, writer io.Writer) http.HandlerFunc
 	})
 }
 
+// requestTraceKey is the context key for the *requestTrace of a request
+// being traced.
+type requestTraceKey struct{}
+
+// requestTrace records the outcome of a traced request.
+type requestTrace struct {
+	status int
+	docs   int
+	bytes  int
+}
+
+// traceResponseWriter records the status code of a traced request's response.
+type traceResponseWriter struct {
+	http.ResponseWriter
+	trace *requestTrace
+}
+
+func (w *traceResponseWriter) WriteHeader(status int) {
+	w.trace.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// traceRequest returns a http.HandlerFunc which calls handler, and then logs
+// the request with a request ID, its headers, its (possibly compressed) size,
+// the response status, and the number and decompressed size of the documents
+// written to the corpus. The Authorization header is redacted.
+func traceRequest(handler http.HandlerFunc) http.HandlerFunc {
+	// requestID is incremented for each request. It is accessed atomically.
+	var requestID uint64
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := atomic.AddUint64(&requestID, 1)
+		trace := &requestTrace{status: http.StatusOK}
+		req = req.WithContext(context.WithValue(req.Context(), requestTraceKey{}, trace))
+		handler(&traceResponseWriter{ResponseWriter: w, trace: trace}, req)
+
+		header := req.Header.Clone()
+		if header.Get("Authorization") != "" {
+			header.Set("Authorization", "[redacted]")
+		}
+		log.Printf(
+			"request %d: %s %s status=%d content-length=%d docs=%d docs-bytes=%d headers=%v",
+			id, req.Method, req.URL.Path, trace.status, req.ContentLength, trace.docs, trace.bytes, header,
+		)
+	}
+}
+
+// bulkRejectedResponse is the body of responses to bulk requests rejected
+// due to the maximum number of concurrent bulk requests being reached,
+// mimicking ES's response when its bulk thread pool queue is full.
+var bulkRejectedResponse = []byte(`{"error":{"type":"es_rejected_execution_exception",` +
+	`"reason":"rejected execution of bulk request: too many concurrent bulk requests"},"status":429}`)
+
+// bulkTruncatedResponse is the body of responses to bulk requests whose
+// body was truncated, none of whose documents are written to the corpus.
+var bulkTruncatedResponse = []byte(`{"error":{"type":"parse_exception",` +
+	`"reason":"request body truncated, no documents were indexed"},"status":400}`)
+
+// bulkTooLargeResponse is the body of responses to bulk requests whose body
+// exceeds the maximum content length, none of whose documents are written to
+// the corpus.
+var bulkTooLargeResponse = []byte(`{"error":{"type":"content_too_long_exception",` +
+	`"reason":"request body exceeds http.max_content_length"},"status":413}`)
+
+// errContentTooLong is returned by maxContentLengthReader once more than
+// the maximum content length has been read.
+var errContentTooLong = errors.New("request body exceeds max content length")
+
+// maxContentLengthReader wraps a reader, returning errContentTooLong once
+// more than remaining bytes have been read from it.
+type maxContentLengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (r *maxContentLengthReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errContentTooLong
+	}
+	// Read at most one byte more than remaining, to detect excess content.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, errContentTooLong
+	}
+	return n, err
+}
+
 // splitMetadataAndSource splits the input ES corpora expecting each corpus to have
 // action-and-metdata line followed by source document in an ndjson format. The EOL
-// markers are preserved and included in the token.
+// markers are preserved and included in the token, with CRLF markers normalized to
+// LF so a trailing CR never ends up in the stored documents. Blank lines, including
+// those terminated by CRLF, are skipped and never included in a token.
 func splitMetadataAndSource(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
 
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		// This represents metadata EOL marker
-		// Try to find the source EOL marker
-		if len(data) > i+1 {
-			if j := bytes.IndexByte(data[i+1:], '\n'); j >= 0 {
-				// This represents source EOL marker
-				return i + j + 2, data[:i+j+2], nil
+	// Find the action-and-metadata and source lines, skipping blank lines.
+	// The token references data directly unless there are blank lines
+	// between the two lines, in which case the lines are copied.
+	var (
+		offset     int  // offset of the next line to read
+		skipped    int  // length of the leading blank lines
+		lines      int  // number of non-blank lines found
+		contiguous bool // whether the non-blank lines are adjacent
+	)
+	for lines < 2 {
+		i := bytes.IndexByte(data[offset:], '\n')
+		if i < 0 {
+			break
+		}
+		line := data[offset : offset+i+1]
+		offset += i + 1
+		if isBlankLine(line) {
+			if lines == 0 {
+				skipped = offset
+			}
+			contiguous = false
+			continue
+		}
+		switch lines {
+		case 0:
+			token = line
+			contiguous = true
+		default:
+			if contiguous {
+				token = data[skipped:offset]
+			} else {
+				token = append(token[:len(token):len(token)], line...)
 			}
 		}
+		lines++
+	}
+	if lines == 2 {
+		return offset, normalizeEOL(token), nil
+	}
+
+	if !atEOF {
+		// Request more data, discarding any leading blank lines.
+		return skipped, nil, nil
 	}
 
 	// At EOF the scanner will be in one of the following state:
 	// 1. We don't have both action and metadata for atleast one document
 	// 2. We have a final non-terminated line
-	// We can return the data as is in both cases. Case 1 may represents input doc
-	// to not be as metadata and action but is left to be handled by the consumer of
-	// the generated corpus.
-	if atEOF {
-		return len(data), data, nil
+	// We can return the remaining non-blank data in both cases. Case 1 may
+	// represents input doc to not be as metadata and action but is left to
+	// be handled by the consumer of the generated corpus.
+	if rest := data[offset:]; !isBlankLine(rest) {
+		token = append(token[:len(token):len(token)], rest...)
+	}
+	if len(token) == 0 {
+		return len(data), nil, nil
+	}
+	return len(data), normalizeEOL(token), nil
+}
+
+// normalizeEOL returns token with all CRLF EOL markers replaced by LF.
+// Since tokens are split on LF, every CRLF in a token is an EOL marker.
+// The token is returned as is if it has no CRLF EOL markers.
+func normalizeEOL(token []byte) []byte {
+	if !bytes.Contains(token, crlf) {
+		return token
 	}
+	return bytes.ReplaceAll(token, crlf, lf)
+}
+
+var (
+	crlf = []byte("\r\n")
+	lf   = []byte("\n")
+)
 
-	// Request more data.
-	return 0, nil, nil
+// isBlankLine reports whether line consists only of whitespace,
+// such as an empty line terminated by LF or CRLF.
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimSpace(line)) == 0
 }
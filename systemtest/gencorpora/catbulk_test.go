@@ -0,0 +1,296 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package gencorpora
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReqRetryAfter(t *testing.T) {
+	for name, test := range map[string]struct {
+		retryAfter time.Duration
+		header     string
+	}{
+		"unset":      {retryAfter: 0, header: ""},
+		"seconds":    {retryAfter: 2 * time.Second, header: "2"},
+		"rounded_up": {retryAfter: 1500 * time.Millisecond, header: "2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			metaUpdateChan := make(chan docsStat)
+			go func() {
+				for range metaUpdateChan {
+				}
+			}()
+			defer close(metaUpdateChan)
+			srv := httptest.NewServer(handleReq(metaUpdateChan, []io.Writer{io.Discard}, 1, test.retryAfter, 0, false))
+			defer srv.Close()
+
+			// Occupy the only bulk request slot with a request whose
+			// body is not complete until the pipe is closed.
+			pr, pw := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				resp, err := http.Post(srv.URL+"/_bulk", "application/x-ndjson", pr)
+				if err == nil {
+					resp.Body.Close()
+				}
+			}()
+			defer func() {
+				pw.Close()
+				<-done
+			}()
+
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				resp, err := http.Post(srv.URL+"/_bulk", "application/x-ndjson", strings.NewReader("{}\n{}\n"))
+				require.NoError(t, err)
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusTooManyRequests {
+					assert.Equal(t, test.header, resp.Header.Get("Retry-After"))
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("timed out waiting for bulk request to be rejected")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestHandleReqMaxContentLength(t *testing.T) {
+	metaUpdateChan := make(chan docsStat)
+	var stats []docsStat
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for stat := range metaUpdateChan {
+			stats = append(stats, stat)
+		}
+	}()
+	var corpus bytes.Buffer
+	srv := httptest.NewServer(handleReq(metaUpdateChan, []io.Writer{&corpus}, 0, 0, 8, false))
+	defer srv.Close()
+
+	post := func(body string, compress bool) int {
+		var buf bytes.Buffer
+		if compress {
+			zw := gzip.NewWriter(&buf)
+			zw.Write([]byte(body))
+			require.NoError(t, zw.Close())
+		} else {
+			buf.WriteString(body)
+		}
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/_bulk", &buf)
+		require.NoError(t, err)
+		if compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post("{}\n{}\n", false))
+	assert.Equal(t, http.StatusOK, post("{}\n{}\n", true))
+	assert.Equal(t, http.StatusOK, post("{}\n{}\n\n\n", false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("{}\n{}\n{}\n", false))
+
+	// The limit applies to the decompressed body, as the compressed
+	// body may well be within the limit.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("{}\n{}\n{}\n", true))
+
+	srv.Close()
+	close(metaUpdateChan)
+	<-done
+	assert.Len(t, stats, 3)
+	assert.Equal(t, "{}\n{}\n{}\n{}\n{}\n{}\n", corpus.String())
+}
+
+func TestHandleReqShards(t *testing.T) {
+	metaUpdateChan := make(chan docsStat)
+	var stats []docsStat
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for stat := range metaUpdateChan {
+			stats = append(stats, stat)
+		}
+	}()
+	var shard0, shard1 bytes.Buffer
+	srv := httptest.NewServer(handleReq(metaUpdateChan, []io.Writer{&shard0, &shard1}, 0, 0, 0, false))
+	defer srv.Close()
+
+	post := func(body string) {
+		resp, err := http.Post(srv.URL+"/_bulk", "application/x-ndjson", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	post("{}\n{\"a\":1}\n{}\n{\"a\":2}\n{}\n{\"a\":3}\n")
+	post("{}\n{\"a\":4}\n{}\n{\"a\":5}\n")
+
+	srv.Close()
+	close(metaUpdateChan)
+	<-done
+
+	// Documents are distributed round-robin across the shards, including
+	// across requests, and statistics are sent for each shard.
+	assert.Equal(t, "{}\n{\"a\":1}\n{}\n{\"a\":3}\n{}\n{\"a\":5}\n", shard0.String())
+	assert.Equal(t, "{}\n{\"a\":2}\n{}\n{\"a\":4}\n", shard1.String())
+	assert.Equal(t, []docsStat{
+		{shard: 0, count: 2, bytes: 22},
+		{shard: 1, count: 1, bytes: 11},
+		{shard: 0, count: 1, bytes: 11},
+		{shard: 1, count: 1, bytes: 11},
+	}, stats)
+}
+
+func TestHandleReqTraceRequests(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	metaUpdateChan := make(chan docsStat)
+	go func() {
+		for range metaUpdateChan {
+		}
+	}()
+	defer close(metaUpdateChan)
+	srv := httptest.NewServer(handleReq(metaUpdateChan, []io.Writer{io.Discard}, 0, 0, 0, true))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/_bulk", strings.NewReader("{}\n{}\n{}\n{}\n"))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "ApiKey secret")
+		req.Header.Set("X-Custom", "value")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "request 1: POST /_bulk status=200 content-length=12 docs=2 docs-bytes=12")
+	assert.Contains(t, lines[0], "X-Custom:[value]")
+	assert.Contains(t, lines[0], "Authorization:[[redacted]]")
+	assert.NotContains(t, lines[0], "secret")
+	assert.Contains(t, lines[1], "request 2: ")
+}
+
+func TestCorporaShardPath(t *testing.T) {
+	assert.Equal(t, "dir/es_corpora_docs_0.ndjson", corporaShardPath("dir/es_corpora_docs.ndjson", 0))
+	assert.Equal(t, "dir/es_corpora_docs_12.ndjson", corporaShardPath("dir/es_corpora_docs.ndjson", 12))
+	assert.Equal(t, "corpus_1", corporaShardPath("corpus", 1))
+}
+
+func TestSplitMetadataAndSource(t *testing.T) {
+	for name, test := range map[string]struct {
+		input  string
+		tokens []string
+	}{
+		"empty":             {input: "", tokens: nil},
+		"single_document":   {input: "a\nb\n", tokens: []string{"a\nb\n"}},
+		"two_documents":     {input: "a\nb\nc\nd\n", tokens: []string{"a\nb\n", "c\nd\n"}},
+		"unterminated":      {input: "a\nb\nc\nd", tokens: []string{"a\nb\n", "c\nd"}},
+		"metadata_only":     {input: "a\nb\nc\n", tokens: []string{"a\nb\n", "c\n"}},
+		"lone_newline":      {input: "\n", tokens: nil},
+		"lone_crlf":         {input: "\r\n", tokens: nil},
+		"blank_lines":       {input: "\n\na\n\n\nb\n\n", tokens: []string{"a\nb\n"}},
+		"crlf":              {input: "a\r\nb\r\nc\r\nd\r\n", tokens: []string{"a\nb\n", "c\nd\n"}},
+		"crlf_unterminated": {input: "a\r\nb\r\nc\r\nd", tokens: []string{"a\nb\n", "c\nd"}},
+		"crlf_blank_lines":  {input: "a\r\n\r\nb\r\n", tokens: []string{"a\nb\n"}},
+		"mixed_eol":         {input: "a\nb\r\nc\r\nd\n", tokens: []string{"a\nb\n", "c\nd\n"}},
+		"crlf_json": {
+			input:  "{\"index\":{}}\r\n{\"a\":\"b\\r\\n\"}\r\n",
+			tokens: []string{"{\"index\":{}}\n{\"a\":\"b\\r\\n\"}\n"},
+		},
+		"whitespace_at_eof": {input: "a\nb\n  ", tokens: []string{"a\nb\n"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.tokens, scanTokens(t, []byte(test.input)))
+		})
+	}
+}
+
+func FuzzSplitMetadataAndSource(f *testing.F) {
+	for _, seed := range []string{
+		"", "\n", "\r\n", "\n\n", "a", "a\n", "a\nb", "a\nb\n",
+		"a\r\nb\r\n", "\na\n\nb\n", "a\nb\nc", " \n\t\r\n",
+	} {
+		f.Add([]byte(seed), true)
+		f.Add([]byte(seed), false)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, atEOF bool) {
+		advance, token, err := splitMetadataAndSource(data, atEOF)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, advance, 0)
+		require.LessOrEqual(t, advance, len(data))
+		if token != nil {
+			require.NotEmpty(t, token)
+			require.Greater(t, advance, 0, "token returned without progress")
+		}
+		if atEOF && len(data) > 0 {
+			require.Greater(t, advance, 0, "no progress at EOF")
+		}
+
+		// Scanning the whole input must yield all non-blank lines, in order,
+		// with CRLF EOL markers replaced by LF.
+		var want []byte
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if !isBlankLine(line) {
+				want = append(want, bytes.ReplaceAll(line, []byte("\r\n"), []byte("\n"))...)
+			}
+		}
+		tokens := scanTokens(t, data)
+		assert.Equal(t, string(want), strings.Join(tokens, ""))
+		for i, token := range tokens {
+			if i < len(tokens)-1 {
+				assert.Equal(t, 2, strings.Count(token, "\n"), "token %q", token)
+			}
+		}
+	})
+}
+
+func scanTokens(t testing.TB, data []byte) []string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	scanner.Split(splitMetadataAndSource)
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	return tokens
+}
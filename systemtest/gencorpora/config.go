@@ -21,6 +21,8 @@ import (
 	"flag"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"go.uber.org/zap/zapcore"
 )
@@ -30,15 +32,80 @@ const (
 	defaultFilePrefix = "es_corpora"
 )
 
+const (
+	defaultReplayServerURL = "http://localhost:8200"
+)
+
+// defaultMaxContentLength is the default maximum size of requests accepted
+// by the CatBulk server, matching the default http.max_content_length of ES.
+const defaultMaxContentLength = 100 * 1024 * 1024
+
 var gencorporaConfig = struct {
 	CorporaPath  string
 	MetadataPath string
 	LoggingLevel zapcore.Level
 	ReplayCount  int
+
+	// MaxConcurrentBulkRequests is the maximum number of bulk requests
+	// processed concurrently by the CatBulk server, unlimited if zero.
+	MaxConcurrentBulkRequests int
+
+	// BulkRetryAfter is the delay advertised in the Retry-After header
+	// of bulk requests rejected with 429 Too Many Requests by the CatBulk
+	// server, rounded up to whole seconds. If zero, no Retry-After header
+	// is set.
+	BulkRetryAfter time.Duration
+
+	// MaxContentLength is the maximum size in bytes of request bodies
+	// accepted by the CatBulk server, after decompression, simulating
+	// ES's http.max_content_length. Larger requests are rejected with
+	// 413 Request Entity Too Large. If zero, the size is not limited.
+	MaxContentLength int64
+
+	// CatBulkListenAddr is the address on which the CatBulk server
+	// listens, in the form accepted by net.Listen. If empty, the server
+	// listens on a random port on all interfaces.
+	CatBulkListenAddr string
+
+	// CorporaShards is the number of files across which the CatBulk
+	// server distributes documents round-robin, so that the corpus can
+	// be replayed in parallel. If greater than one, the files are named
+	// after CorporaPath with the shard index appended to the file name;
+	// see corporaShardPath.
+	CorporaShards int
+
+	// CorporaMaxBytes is the size in bytes at which the CatBulk server
+	// rotates each corpus file, closing it and continuing in a new file
+	// numbered after it; see corporaRotatedPath. The files are listed in
+	// the metadata with their sizes. If zero, files are not rotated.
+	CorporaMaxBytes int64
+
+	// TraceBulkRequests controls whether the CatBulk server logs each
+	// request it receives, with its headers, size, and document count,
+	// for debugging the ES client configuration of APM Server. This is
+	// disabled by default, as it logs a line per request.
+	TraceBulkRequests bool
+
+	ReplayCorpusPath      string
+	ReplayServerURL       string
+	ReplaySecretToken     string
+	ReplayEventsPerMinute int
+
+	// Synthetic controls whether synthetic traces, of the shape described
+	// by SyntheticConfig, are generated and sent to the APM Server at
+	// ReplayServerURL instead of generating a corpus.
+	Synthetic       bool
+	SyntheticConfig SyntheticConfig
 }{
-	CorporaPath:  filepath.Join(defaultDir, getCorporaPath(defaultFilePrefix)),
-	MetadataPath: filepath.Join(defaultDir, getMetaPath(defaultFilePrefix)),
-	LoggingLevel: zapcore.WarnLevel,
+	CorporaPath:     filepath.Join(defaultDir, getCorporaPath(defaultFilePrefix)),
+	MetadataPath:    filepath.Join(defaultDir, getMetaPath(defaultFilePrefix)),
+	LoggingLevel:    zapcore.WarnLevel,
+	ReplayServerURL: defaultReplayServerURL,
+	CorporaShards:   1,
+	SyntheticConfig: SyntheticConfig{
+		Services:      1,
+		SpansPerTrace: 10,
+	},
 }
 
 func init() {
@@ -67,6 +134,115 @@ func init() {
 		"logging-level",
 		"Logging level for APM Server",
 	)
+	flag.IntVar(
+		&gencorporaConfig.MaxConcurrentBulkRequests,
+		"max-concurrent-bulk-requests",
+		0,
+		"Maximum number of bulk requests processed concurrently by the fake ES server, "+
+			"which rejects excess requests with 429 Too Many Requests; unlimited if zero",
+	)
+	flag.DurationVar(
+		&gencorporaConfig.BulkRetryAfter,
+		"bulk-retry-after",
+		0,
+		"Delay advertised in the Retry-After header of bulk requests rejected with "+
+			"429 Too Many Requests, rounded up to whole seconds; no header is set if zero",
+	)
+	flag.Int64Var(
+		&gencorporaConfig.MaxContentLength,
+		"max-content-length",
+		defaultMaxContentLength,
+		"Maximum size in bytes of request bodies accepted by the fake ES server, after decompression, "+
+			"which rejects larger requests with 413 Request Entity Too Large; unlimited if zero",
+	)
+	flag.StringVar(
+		&gencorporaConfig.CatBulkListenAddr,
+		"listen-addr",
+		"",
+		"Address on which the fake ES server listens, e.g. 127.0.0.1:9200; "+
+			"listens on a random port on all interfaces if empty",
+	)
+	flag.IntVar(
+		&gencorporaConfig.CorporaShards,
+		"corpora-shards",
+		1,
+		"Number of files across which the generated ES corpora documents are distributed round-robin, "+
+			"for replaying in parallel; the shard index is appended to the file names if greater than one",
+	)
+	flag.Int64Var(
+		&gencorporaConfig.CorporaMaxBytes,
+		"corpora-max-bytes",
+		0,
+		"Size in bytes at which each generated ES corpora file is rotated, continuing in a new numbered file; "+
+			"files are not rotated if zero",
+	)
+	flag.BoolVar(
+		&gencorporaConfig.TraceBulkRequests,
+		"trace-bulk-requests",
+		false,
+		"Log the headers, size, and document count of each request received by the fake ES server, "+
+			"for debugging APM Server's ES client configuration",
+	)
+	flag.StringVar(
+		&gencorporaConfig.ReplayCorpusPath,
+		"replay-corpus",
+		"",
+		"Path of a captured corpus of intake payloads, optionally gzipped, to replay to APM Server instead of generating a corpus",
+	)
+	flag.StringVar(
+		&gencorporaConfig.ReplayServerURL,
+		"replay-server-url",
+		defaultReplayServerURL,
+		"URL of the APM Server to which the corpus is replayed, or synthetic load is sent",
+	)
+	flag.StringVar(
+		&gencorporaConfig.ReplaySecretToken,
+		"replay-secret-token",
+		"",
+		"Secret token for the APM Server to which the corpus is replayed, or synthetic load is sent",
+	)
+	flag.IntVar(
+		&gencorporaConfig.ReplayEventsPerMinute,
+		"replay-epm",
+		0,
+		"Maximum number of events per minute to replay or generate, unlimited if zero",
+	)
+	flag.BoolVar(
+		&gencorporaConfig.Synthetic,
+		"synthetic",
+		false,
+		"Generate synthetic traces and send them to APM Server instead of generating a corpus",
+	)
+	flag.IntVar(
+		&gencorporaConfig.SyntheticConfig.Services,
+		"synthetic-services",
+		1,
+		"Number of services to which synthetic traces are attributed",
+	)
+	flag.IntVar(
+		&gencorporaConfig.SyntheticConfig.SpansPerTrace,
+		"synthetic-spans-per-trace",
+		10,
+		"Number of spans in each synthetic trace",
+	)
+	flag.Float64Var(
+		&gencorporaConfig.SyntheticConfig.ErrorRatio,
+		"synthetic-error-ratio",
+		0,
+		"Ratio of synthetic traces, between 0 and 1, which have an error recorded for their transaction",
+	)
+	flag.IntVar(
+		&gencorporaConfig.SyntheticConfig.Traces,
+		"synthetic-traces",
+		0,
+		"Number of synthetic traces to send, or zero to send traces until interrupted",
+	)
+}
+
+// ReplayConfigured reports whether a corpus has been configured to be
+// replayed with the -replay-corpus flag.
+func ReplayConfigured() bool {
+	return gencorporaConfig.ReplayCorpusPath != ""
 }
 
 func getCorporaPath(prefix string) string {
@@ -76,3 +252,10 @@ func getCorporaPath(prefix string) string {
 func getMetaPath(prefix string) string {
 	return fmt.Sprintf("%s_meta.json", prefix)
 }
+
+// corporaShardPath returns the path of the given shard of the corpus at
+// path, inserting the shard index before the file extension.
+func corporaShardPath(path string, shard int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(path, ext), shard, ext)
+}
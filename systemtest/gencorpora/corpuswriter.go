@@ -0,0 +1,128 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package gencorpora
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// corpusWriter writes documents to a corpus file, rotating it once it reaches
+// a maximum size: the file is closed, and writing continues in a new file
+// numbered after the original; see corporaRotatedPath.
+//
+// Each call to Write is written to a single file, so that documents are never
+// split across files. A file may therefore exceed the maximum size if a single
+// write does. Writes are safe for concurrent use.
+type corpusWriter struct {
+	path     string
+	maxBytes int64
+
+	mu    sync.Mutex
+	file  *os.File
+	files []corpusFile
+}
+
+// corpusFile holds the metadata of one of the files written by corpusWriter.
+type corpusFile struct {
+	SourceFile        string `json:"source-file"`
+	UncompressedBytes int64  `json:"uncompressed-bytes"`
+}
+
+// newCorpusWriter returns a corpusWriter writing to a new file at path. If
+// maxBytes is greater than zero, the file is rotated once writing to it would
+// exceed maxBytes.
+func newCorpusWriter(path string, maxBytes int64) (*corpusWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &corpusWriter{
+		path:     path,
+		maxBytes: maxBytes,
+		file:     file,
+		files:    []corpusFile{{SourceFile: path}},
+	}, nil
+}
+
+func (w *corpusWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	current := &w.files[len(w.files)-1]
+	if w.maxBytes > 0 && current.UncompressedBytes > 0 && current.UncompressedBytes+int64(len(p)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+		current = &w.files[len(w.files)-1]
+	}
+	n, err := w.file.Write(p)
+	current.UncompressedBytes += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, and creates the next numbered file.
+func (w *corpusWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close rotated corpus file: %w", err)
+	}
+	path := corporaRotatedPath(w.path, len(w.files))
+	file, err := os.Create(path)
+	if err != nil {
+		w.file = nil
+		return err
+	}
+	w.file = file
+	w.files = append(w.files, corpusFile{SourceFile: path})
+	return nil
+}
+
+// Close closes the current file.
+func (w *corpusWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Files returns the files written, in order, with their sizes.
+func (w *corpusWriter) Files() []corpusFile {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]corpusFile(nil), w.files...)
+}
+
+// corporaRotatedPath returns the path of the nth file rotated from the corpus
+// file at path, inserting n before the file extension. The first file keeps
+// its original path.
+func corporaRotatedPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
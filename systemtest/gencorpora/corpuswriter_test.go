@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package gencorpora
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorpusWriterRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corpus.ndjson")
+	w, err := newCorpusWriter(path, 10)
+	require.NoError(t, err)
+	for _, docs := range []string{"aaaaaa\n", "bbbbbb\n", "cc\n", "d\n"} {
+		_, err := w.Write([]byte(docs))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	rotated1 := filepath.Join(filepath.Dir(path), "corpus.1.ndjson")
+	rotated2 := filepath.Join(filepath.Dir(path), "corpus.2.ndjson")
+	assert.Equal(t, []corpusFile{
+		{SourceFile: path, UncompressedBytes: 7},
+		{SourceFile: rotated1, UncompressedBytes: 10},
+		{SourceFile: rotated2, UncompressedBytes: 2},
+	}, w.Files())
+	for path, expected := range map[string]string{
+		path:     "aaaaaa\n",
+		rotated1: "bbbbbb\ncc\n",
+		rotated2: "d\n",
+	} {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	_, err = w.Write([]byte("e\n"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestCorpusWriterUnlimited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corpus.ndjson")
+	w, err := newCorpusWriter(path, 0)
+	require.NoError(t, err)
+	defer w.Close()
+	for i := 0; i < 3; i++ {
+		_, err := w.Write([]byte("aaaaaa\n"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []corpusFile{{SourceFile: path, UncompressedBytes: 21}}, w.Files())
+}
+
+func TestCorporaRotatedPath(t *testing.T) {
+	assert.Equal(t, "dir/es_corpora_docs.ndjson", corporaRotatedPath("dir/es_corpora_docs.ndjson", 0))
+	assert.Equal(t, "dir/es_corpora_docs.2.ndjson", corporaRotatedPath("dir/es_corpora_docs.ndjson", 2))
+	assert.Equal(t, "dir/es_corpora_docs_1.3.ndjson", corporaRotatedPath("dir/es_corpora_docs_1.ndjson", 3))
+}
@@ -0,0 +1,212 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package gencorpora
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"golang.org/x/time/rate"
+
+	"github.com/elastic/apm-server/systemtest/loadgen"
+	"github.com/elastic/apm-server/systemtest/loadgen/eventhandler"
+)
+
+// maxReplayBatchEvents is the maximum number of events sent in a single
+// intake request when replaying a corpus. This is no greater than the
+// minimum burst size of the rate limiter returned by loadgen.GetNewLimiter.
+const maxReplayBatchEvents = 1000
+
+var (
+	intakeMetadataPrefix    = []byte(`{"metadata":`)
+	rumIntakeMetadataPrefix = []byte(`{"m":`)
+
+	errNotIntakeCorpus = errors.New(
+		"corpus does not hold intake payloads: replaying Elasticsearch documents is not supported",
+	)
+)
+
+// CorpusReader reads the lines of a newline-delimited JSON corpus file,
+// which may optionally be gzip-compressed.
+type CorpusReader struct {
+	file    *os.File
+	gzip    *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+// NewCorpusReader returns a new CorpusReader for the corpus file at path.
+// Gzip-compressed files are detected by their content, irrespective of the
+// file name.
+func NewCorpusReader(path string) (*CorpusReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &CorpusReader{file: file}
+	br := bufio.NewReader(file)
+	var reader io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		if r.gzip, err = gzip.NewReader(br); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read gzip-compressed corpus: %w", err)
+		}
+		reader = r.gzip
+	}
+	r.scanner = bufio.NewScanner(reader)
+	r.scanner.Buffer(nil, 10*1024*1024)
+	return r, nil
+}
+
+// ReadLine returns the next non-empty line of the corpus, or io.EOF if
+// there are no more lines. The returned slice is only valid until the
+// next call to ReadLine.
+func (r *CorpusReader) ReadLine() ([]byte, error) {
+	for r.scanner.Scan() {
+		if line := r.scanner.Bytes(); len(line) > 0 {
+			return line, nil
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close closes the corpus file.
+func (r *CorpusReader) Close() error {
+	if r.gzip != nil {
+		r.gzip.Close()
+	}
+	return r.file.Close()
+}
+
+// Replay replays a captured corpus of intake payloads to the APM Server
+// intake endpoint, /intake/v2/events, rate limited to the configured number
+// of events per minute.
+//
+// The corpus is sent as-is, i.e. it must hold intake v2 payloads: metadata
+// lines, each followed by the events it describes. Corpora of Elasticsearch
+// documents cannot be replayed, as they cannot be mapped back to intake
+// events.
+func Replay(ctx context.Context) error {
+	r, err := NewCorpusReader(gencorporaConfig.ReplayCorpusPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	transport := eventhandler.NewTransport(
+		http.DefaultClient,
+		gencorporaConfig.ReplayServerURL,
+		gencorporaConfig.ReplaySecretToken,
+	)
+	limiter := loadgen.GetNewLimiter(gencorporaConfig.ReplayEventsPerMinute)
+	for i := 0; i < gencorporaConfig.ReplayCount; i++ {
+		if i > 0 {
+			// Reopen the corpus for each replay after the first.
+			r.Close()
+			if r, err = NewCorpusReader(gencorporaConfig.ReplayCorpusPath); err != nil {
+				return err
+			}
+		}
+		if err := replayCorpus(ctx, r, transport, limiter); err != nil {
+			return fmt.Errorf("failed replaying corpus on iteration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// replayCorpus sends the intake payloads read from r using transport, in
+// batches of at most maxReplayBatchEvents events. Each batch is preceded by
+// the metadata line which preceded its events in the corpus.
+func replayCorpus(ctx context.Context, r *CorpusReader, transport *eventhandler.Transport, limiter *rate.Limiter) error {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	var metadata []byte
+	var events int
+
+	writeLine := func(line []byte) error {
+		if _, err := zw.Write(line); err != nil {
+			return err
+		}
+		_, err := zw.Write([]byte("\n"))
+		return err
+	}
+	flush := func() error {
+		if events == 0 {
+			return nil
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := limiter.WaitN(ctx, events); err != nil {
+			return err
+		}
+		if err := transport.SendV2Events(ctx, bytes.NewReader(buf.Bytes())); err != nil {
+			return err
+		}
+		buf.Reset()
+		zw.Reset(&buf)
+		events = 0
+		return nil
+	}
+
+	for {
+		line, err := r.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case bytes.HasPrefix(line, intakeMetadataPrefix):
+			if err := flush(); err != nil {
+				return err
+			}
+			metadata = append(metadata[:0], line...)
+			continue
+		case bytes.HasPrefix(line, rumIntakeMetadataPrefix):
+			return errors.New("replaying RUM intake payloads is not supported")
+		case metadata == nil:
+			return errNotIntakeCorpus
+		}
+		if events == 0 {
+			if err := writeLine(metadata); err != nil {
+				return err
+			}
+		}
+		if err := writeLine(line); err != nil {
+			return err
+		}
+		events++
+		if events == maxReplayBatchEvents {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
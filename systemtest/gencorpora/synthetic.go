@@ -0,0 +1,272 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package gencorpora
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+	"golang.org/x/time/rate"
+
+	"github.com/elastic/apm-server/systemtest/loadgen"
+	"github.com/elastic/apm-server/systemtest/loadgen/eventhandler"
+)
+
+// SyntheticConfig holds the shape of the synthetic load sent by Synthetic.
+type SyntheticConfig struct {
+	// Services is the number of services to which traces are attributed.
+	// Intake requests are sent on behalf of each service in turn.
+	Services int
+
+	// SpansPerTrace is the number of spans in each trace, all of which
+	// are children of the trace's root transaction.
+	SpansPerTrace int
+
+	// ErrorRatio is the ratio of traces, between 0 and 1, which have an
+	// error recorded for their transaction.
+	ErrorRatio float64
+
+	// Traces is the number of traces to send. If zero, traces are sent
+	// until the context is cancelled.
+	Traces int
+}
+
+func (cfg SyntheticConfig) validate() error {
+	if cfg.Services <= 0 {
+		return fmt.Errorf("invalid number of services %d, must be positive", cfg.Services)
+	}
+	if cfg.SpansPerTrace < 0 {
+		return fmt.Errorf("invalid number of spans per trace %d, must not be negative", cfg.SpansPerTrace)
+	}
+	if n := maxTraceEvents(cfg.SpansPerTrace); n > maxReplayBatchEvents {
+		return fmt.Errorf(
+			"too many spans per trace: traces may have up to %d events, must be at most %d",
+			n, maxReplayBatchEvents,
+		)
+	}
+	if cfg.ErrorRatio < 0 || cfg.ErrorRatio > 1 {
+		return fmt.Errorf("invalid error ratio %v, must be between 0 and 1", cfg.ErrorRatio)
+	}
+	if cfg.Traces < 0 {
+		return fmt.Errorf("invalid number of traces %d, must not be negative", cfg.Traces)
+	}
+	return nil
+}
+
+// maxTraceEvents returns the maximum number of events in a synthetic trace
+// with the given number of spans: a transaction, its spans, and an error.
+func maxTraceEvents(spansPerTrace int) int {
+	return spansPerTrace + 2
+}
+
+// SyntheticConfigured reports whether synthetic load has been configured to
+// be generated with the -synthetic flag.
+func SyntheticConfigured() bool {
+	return gencorporaConfig.Synthetic
+}
+
+// Synthetic generates synthetic traces and sends them to the APM Server
+// intake endpoint, /intake/v2/events, rate limited to the configured number
+// of events per minute. Unlike Run, which captures the documents indexed for
+// the events sent by a real agent, Synthetic is used for generating load of
+// a configurable shape; see SyntheticConfig.
+func Synthetic(ctx context.Context) error {
+	transport := eventhandler.NewTransport(
+		http.DefaultClient,
+		gencorporaConfig.ReplayServerURL,
+		gencorporaConfig.ReplaySecretToken,
+	)
+	limiter := loadgen.GetNewLimiter(gencorporaConfig.ReplayEventsPerMinute)
+	err := SendSyntheticLoad(ctx, gencorporaConfig.SyntheticConfig, transport, limiter)
+	if err == context.Canceled && gencorporaConfig.SyntheticConfig.Traces == 0 {
+		// Traces are sent until interrupted.
+		return nil
+	}
+	return err
+}
+
+// SendSyntheticLoad sends synthetic traces of the shape described by cfg
+// using transport, rate limited by limiter.
+//
+// Each intake request holds the metadata of one service, followed by as many
+// complete traces as fit within maxReplayBatchEvents events.
+func SendSyntheticLoad(
+	ctx context.Context,
+	cfg SyntheticConfig,
+	transport *eventhandler.Transport,
+	limiter *rate.Limiter,
+) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	g := newTraceGenerator(cfg, rand.New(rand.NewSource(time.Now().UnixNano())))
+	var buf bytes.Buffer
+	var w fastjson.Writer
+	zw := zlib.NewWriter(&buf)
+	for i, sent := 0, 0; cfg.Traces == 0 || sent < cfg.Traces; i++ {
+		w.Reset()
+		g.writeMetadata(&w, i%cfg.Services)
+		var events int
+		for cfg.Traces == 0 || sent < cfg.Traces {
+			if events+maxTraceEvents(cfg.SpansPerTrace) > maxReplayBatchEvents {
+				break
+			}
+			events += g.writeTrace(&w, time.Now())
+			sent++
+		}
+		buf.Reset()
+		zw.Reset(&buf)
+		if _, err := zw.Write(w.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := limiter.WaitN(ctx, events); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := transport.SendV2Events(ctx, bytes.NewReader(buf.Bytes())); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// traceGenerator generates synthetic intake events using the intake model
+// types of the Go agent.
+type traceGenerator struct {
+	cfg  SyntheticConfig
+	rand *rand.Rand
+}
+
+func newTraceGenerator(cfg SyntheticConfig, rand *rand.Rand) *traceGenerator {
+	return &traceGenerator{cfg: cfg, rand: rand}
+}
+
+// writeMetadata writes the metadata line for the service with the given
+// index to w.
+func (g *traceGenerator) writeMetadata(w *fastjson.Writer, service int) {
+	metadata := model.Service{
+		Name:        fmt.Sprintf("synthetic-service-%d", service),
+		Version:     "1.0.0",
+		Environment: "synthetic",
+		Agent:       &model.Agent{Name: "go", Version: "0.0.0"},
+		Language:    &model.Language{Name: "go"},
+	}
+	w.RawString(`{"metadata":{"service":`)
+	metadata.MarshalFastJSON(w)
+	w.RawString("}}\n")
+}
+
+// writeTrace writes the events of a trace which ended at end to w, and
+// returns the number of events written.
+func (g *traceGenerator) writeTrace(w *fastjson.Writer, end time.Time) int {
+	var traceID model.TraceID
+	var transactionID model.SpanID
+	g.rand.Read(traceID[:])
+	g.rand.Read(transactionID[:])
+
+	// Spans take up to 10ms each, and are run sequentially.
+	spanDurations := make([]time.Duration, g.cfg.SpansPerTrace)
+	duration := time.Millisecond
+	for i := range spanDurations {
+		spanDurations[i] = time.Duration(1+g.rand.Intn(10)) * time.Millisecond
+		duration += spanDurations[i]
+	}
+	start := end.Add(-duration)
+	failed := g.rand.Float64() < g.cfg.ErrorRatio
+
+	transaction := model.Transaction{
+		ID:        transactionID,
+		TraceID:   traceID,
+		Name:      "GET /synthetic",
+		Type:      "request",
+		Timestamp: model.Time(start),
+		Duration:  durationMillis(duration),
+		Result:    "HTTP 2xx",
+		Outcome:   "success",
+		SpanCount: model.SpanCount{Started: g.cfg.SpansPerTrace},
+	}
+	if failed {
+		transaction.Result = "HTTP 5xx"
+		transaction.Outcome = "failure"
+	}
+	w.RawString(`{"transaction":`)
+	transaction.MarshalFastJSON(w)
+	w.RawString("}\n")
+
+	spanStart := start
+	for i, spanDuration := range spanDurations {
+		span := model.Span{
+			Name:          fmt.Sprintf("SELECT FROM synthetic_%d", i),
+			Type:          "db",
+			Subtype:       "postgresql",
+			Action:        "query",
+			TraceID:       traceID,
+			TransactionID: transactionID,
+			ParentID:      transactionID,
+			Timestamp:     model.Time(spanStart),
+			Duration:      durationMillis(spanDuration),
+			Outcome:       "success",
+		}
+		g.rand.Read(span.ID[:])
+		w.RawString(`{"span":`)
+		span.MarshalFastJSON(w)
+		w.RawString("}\n")
+		spanStart = spanStart.Add(spanDuration)
+	}
+	if !failed {
+		return 1 + len(spanDurations)
+	}
+
+	sampled := true
+	e := model.Error{
+		Timestamp:     model.Time(end),
+		TraceID:       traceID,
+		ParentID:      transactionID,
+		TransactionID: transactionID,
+		Exception:     model.Exception{Message: "synthetic error", Type: "SyntheticError"},
+		Transaction: model.ErrorTransaction{
+			Sampled: &sampled,
+			Type:    transaction.Type,
+			Name:    transaction.Name,
+		},
+	}
+	g.rand.Read(e.ID[:])
+	w.RawString(`{"error":`)
+	e.MarshalFastJSON(w)
+	w.RawString("}\n")
+	return 2 + len(spanDurations)
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
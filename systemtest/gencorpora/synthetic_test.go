@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package gencorpora
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/systemtest/loadgen"
+	"github.com/elastic/apm-server/systemtest/loadgen/eventhandler"
+)
+
+func TestSendSyntheticLoad(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	services := make(map[string]int)
+	events := make(map[string]int)
+	errorTraces := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/intake/v2/events", r.URL.Path)
+		zr, err := zlib.NewReader(r.Body)
+		require.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		scanner := bufio.NewScanner(zr)
+		require.True(t, scanner.Scan())
+		var metadata struct {
+			Metadata struct {
+				Service struct {
+					Name string `json:"name"`
+				} `json:"service"`
+			} `json:"metadata"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &metadata))
+		services[metadata.Metadata.Service.Name]++
+		for scanner.Scan() {
+			var event map[string]struct {
+				TraceID string `json:"trace_id"`
+			}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			require.Len(t, event, 1)
+			for k, v := range event {
+				events[k]++
+				if k == "error" {
+					errorTraces[v.TraceID] = true
+				}
+			}
+		}
+		require.NoError(t, scanner.Err())
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	transport := eventhandler.NewTransport(srv.Client(), srv.URL, "")
+	err := SendSyntheticLoad(context.Background(), SyntheticConfig{
+		Services:      3,
+		SpansPerTrace: 98,
+		ErrorRatio:    1,
+		Traces:        25,
+	}, transport, loadgen.GetNewLimiter(0))
+	require.NoError(t, err)
+
+	// Each request holds up to 10 traces of 100 events.
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, map[string]int{
+		"synthetic-service-0": 1,
+		"synthetic-service-1": 1,
+		"synthetic-service-2": 1,
+	}, services)
+	assert.Equal(t, map[string]int{
+		"transaction": 25,
+		"span":        25 * 98,
+		"error":       25,
+	}, events)
+	assert.Len(t, errorTraces, 25)
+}
+
+func TestSendSyntheticLoadInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]SyntheticConfig{
+		"no_services":          {Services: 0},
+		"negative_spans":       {Services: 1, SpansPerTrace: -1},
+		"too_many_spans":       {Services: 1, SpansPerTrace: maxReplayBatchEvents},
+		"negative_error_ratio": {Services: 1, ErrorRatio: -0.1},
+		"large_error_ratio":    {Services: 1, ErrorRatio: 1.1},
+		"negative_traces":      {Services: 1, Traces: -1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := SendSyntheticLoad(context.Background(), cfg, nil, loadgen.GetNewLimiter(0))
+			assert.Error(t, err)
+		})
+	}
+}
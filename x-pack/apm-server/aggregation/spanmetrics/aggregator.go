@@ -8,17 +8,24 @@ import (
 	"context"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/pkg/errors"
 
 	"github.com/elastic/apm-server/internal/logs"
 	"github.com/elastic/apm-server/internal/model"
 	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
 )
 
 const (
 	metricsetName = "service_destination"
+
+	// groupBytes is the estimated memory used by a group, excluding
+	// the variable length strings of its aggregation key.
+	groupBytes = int(unsafe.Sizeof(aggregationKey{}) + unsafe.Sizeof(spanMetrics{}))
 )
 
 // AggregatorConfig holds configuration for creating an Aggregator.
@@ -39,11 +46,74 @@ type AggregatorConfig struct {
 	// on span.name.
 	MaxGroups int
 
+	// IgnoreOutcome controls whether span outcome is omitted from the
+	// aggregation key. By default metrics are grouped by outcome, so the
+	// failure rate of each destination can be calculated.
+	//
+	// Outcomes other than "success", "failure", and "unknown" are grouped
+	// as "unknown", to bound the number of groups that outcome adds.
+	IgnoreOutcome bool
+
 	// Interval is the interval between publishing of aggregated metrics.
 	// There may be additional metrics reported at arbitrary times if the
 	// aggregation groups fill up.
 	Interval time.Duration
 
+	// FlushThreshold is the number of service destination groups at which
+	// aggregated metrics are published without waiting for Interval to
+	// elapse. Metrics published early are timestamped with the same
+	// interval as those published at the end of the interval.
+	//
+	// If FlushThreshold is zero, metrics are published only every
+	// Interval. FlushThreshold must be no greater than MaxGroups.
+	FlushThreshold int
+
+	// MaxSpanNamesPerDestination is the maximum number of distinct span
+	// names to aggregate for each service destination within an aggregation
+	// period. Once this number of span names is reached for a destination,
+	// metrics for spans with other names are aggregated into the
+	// destination's overflow group, without span.name, and counted in the
+	// "span_names_overflowed" monitoring metric.
+	//
+	// This bounds the memory used by destinations with high cardinality
+	// span names, before MaxGroups becomes 50% full. If
+	// MaxSpanNamesPerDestination is zero, the number of span names per
+	// destination is not limited.
+	MaxSpanNamesPerDestination int
+
+	// TimestampAlignment controls the timestamp of published metrics:
+	// "start" for the start of the Interval in which the spans occurred,
+	// or "end" for the end of the interval. If TimestampAlignment is
+	// empty, "start" is used.
+	TimestampAlignment string
+
+	// MaxMemoryBytes is the maximum estimated memory, in bytes, to use
+	// for service destination groups within an aggregation period. Once
+	// the estimated memory would exceed MaxMemoryBytes, any new
+	// aggregation keys will cause individual metrics documents to be
+	// immediately published, and aggregated metrics are published
+	// without waiting for Interval to elapse.
+	//
+	// If MaxMemoryBytes is zero, memory is bounded only by MaxGroups.
+	MaxMemoryBytes int
+
+	// RollupInterval, if non-zero, is the interval of a second, coarser
+	// resolution of metrics, for retaining historical metrics at a lower
+	// storage cost. The groups published every Interval are merged into
+	// groups timestamped by RollupInterval, and published every
+	// RollupInterval.
+	//
+	// When RollupInterval is non-zero, published metrics have their
+	// aggregation interval recorded in model.Metricset.Interval, so that
+	// the two resolutions can be distinguished. Metrics published
+	// individually, because MaxGroups or MaxMemoryBytes was reached, are
+	// not rolled up.
+	//
+	// If the number of rolled up groups reaches MaxGroups, they are
+	// published without waiting for RollupInterval to elapse.
+	// RollupInterval must be a multiple of Interval.
+	RollupInterval time.Duration
+
 	// Logger is the logger for logging metrics aggregation/publishing.
 	//
 	// If Logger is nil, a new logger will be constructed.
@@ -61,6 +131,23 @@ func (config AggregatorConfig) Validate() error {
 	if config.Interval <= 0 {
 		return errors.New("Interval unspecified or negative")
 	}
+	if config.FlushThreshold < 0 || config.FlushThreshold > config.MaxGroups {
+		return errors.New("FlushThreshold out of range [0,MaxGroups]")
+	}
+	if config.MaxSpanNamesPerDestination < 0 {
+		return errors.New("MaxSpanNamesPerDestination negative")
+	}
+	if config.MaxMemoryBytes < 0 {
+		return errors.New("MaxMemoryBytes negative")
+	}
+	switch config.TimestampAlignment {
+	case "", "start", "end":
+	default:
+		return errors.Errorf("TimestampAlignment %q unsupported", config.TimestampAlignment)
+	}
+	if config.RollupInterval < 0 || config.RollupInterval%config.Interval != 0 {
+		return errors.New("RollupInterval must be a multiple of Interval")
+	}
 	return nil
 }
 
@@ -70,12 +157,34 @@ type Aggregator struct {
 	stopping chan struct{}
 	stopped  chan struct{}
 
+	// flush is signalled when the number of groups reaches FlushThreshold,
+	// or when MaxMemoryBytes is reached.
+	flush chan struct{}
+
+	// flushRequests receives requests from Flush to publish immediately.
+	flushRequests chan chan<- flushResult
+
 	config AggregatorConfig
 
+	// spanNamesOverflowed counts the spans aggregated without span.name
+	// because MaxSpanNamesPerDestination was reached for their destination.
+	spanNamesOverflowed *int64 // heap-allocated for 64-bit alignment
+
+	// memoryLimitReached counts the metrics published individually
+	// because MaxMemoryBytes was reached.
+	memoryLimitReached *int64 // heap-allocated for 64-bit alignment
+
 	mu sync.RWMutex
 	// These two metricsBuffer are set to the same size and act as buffers
 	// for caching and then publishing the metrics as batches.
 	active, inactive *metricsBuffer
+
+	// rollup holds the groups rolled up from those published every
+	// Interval, if RollupInterval is non-zero. rollup is only modified
+	// by Run, and rollupMu protects it from concurrent reads by
+	// CollectMonitoring.
+	rollupMu sync.Mutex
+	rollup   map[aggregationKey]spanMetrics
 }
 
 // NewAggregator returns a new Aggregator with the given config.
@@ -86,21 +195,74 @@ func NewAggregator(config AggregatorConfig) (*Aggregator, error) {
 	if config.Logger == nil {
 		config.Logger = logp.NewLogger(logs.SpanMetrics)
 	}
+	flush := make(chan struct{}, 1)
+	spanNamesOverflowed := new(int64)
+	memoryLimitReached := new(int64)
+	var rollup map[aggregationKey]spanMetrics
+	if config.RollupInterval > 0 {
+		rollup = make(map[aggregationKey]spanMetrics)
+	}
 	return &Aggregator{
-		stopping: make(chan struct{}),
-		stopped:  make(chan struct{}),
-		config:   config,
-		active:   newMetricsBuffer(config.MaxGroups),
-		inactive: newMetricsBuffer(config.MaxGroups),
+		stopping:            make(chan struct{}),
+		stopped:             make(chan struct{}),
+		flush:               flush,
+		flushRequests:       make(chan chan<- flushResult),
+		config:              config,
+		spanNamesOverflowed: spanNamesOverflowed,
+		memoryLimitReached:  memoryLimitReached,
+		active:              newMetricsBuffer(config, flush, spanNamesOverflowed, memoryLimitReached),
+		inactive:            newMetricsBuffer(config, flush, spanNamesOverflowed, memoryLimitReached),
+		rollup:              rollup,
 	}, nil
 }
 
+// CollectMonitoring may be called to collect monitoring metrics from the
+// aggregation. It is intended to be used with libbeat/monitoring.NewFunc.
+//
+// The metrics should be added to the "apm-server.aggregation.spanmetrics" registry.
+func (a *Aggregator) CollectMonitoring(_ monitoring.Mode, V monitoring.Visitor) {
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+
+	a.mu.RLock()
+	a.active.mu.RLock()
+	activeGroups := len(a.active.m)
+	activeBytes := a.active.bytes
+	a.active.mu.RUnlock()
+	a.mu.RUnlock()
+
+	monitoring.ReportInt(V, "active_groups", int64(activeGroups))
+	monitoring.ReportInt(V, "span_names_overflowed", atomic.LoadInt64(a.spanNamesOverflowed))
+	if a.config.MaxMemoryBytes > 0 {
+		monitoring.ReportNamespace(V, "memory", func() {
+			monitoring.ReportInt(V, "estimated_bytes", int64(activeBytes))
+			monitoring.ReportInt(V, "limit_reached", atomic.LoadInt64(a.memoryLimitReached))
+		})
+	}
+	if a.config.RollupInterval > 0 {
+		a.rollupMu.Lock()
+		rollupGroups := len(a.rollup)
+		a.rollupMu.Unlock()
+		monitoring.ReportNamespace(V, "rollup", func() {
+			monitoring.ReportInt(V, "active_groups", int64(rollupGroups))
+		})
+	}
+}
+
 // Run runs the Aggregator, periodically publishing and clearing aggregated
-// metrics. Run returns when either a fatal error occurs, or the Aggregator's
-// Stop method is invoked.
+// metrics, and whenever the number of groups reaches FlushThreshold. If
+// RollupInterval is non-zero, rolled up metrics are published every
+// RollupInterval. Run returns when either a fatal error occurs, or the
+// Aggregator's Stop method is invoked.
 func (a *Aggregator) Run() error {
 	ticker := time.NewTicker(a.config.Interval)
 	defer ticker.Stop()
+	var rollupTicks <-chan time.Time
+	if a.config.RollupInterval > 0 {
+		rollupTicker := time.NewTicker(a.config.RollupInterval)
+		defer rollupTicker.Stop()
+		rollupTicks = rollupTicker.C
+	}
 	defer func() {
 		a.stopMu.Lock()
 		defer a.stopMu.Unlock()
@@ -112,20 +274,77 @@ func (a *Aggregator) Run() error {
 	}()
 	var stop bool
 	for !stop {
+		var rollup bool
+		var flushed chan<- flushResult
 		select {
 		case <-a.stopping:
-			stop = true
+			stop, rollup = true, true
 		case <-ticker.C:
+		case <-a.flush:
+		case flushed = <-a.flushRequests:
+			rollup = true
+		case <-rollupTicks:
+			// Publish the current metrics first, so they
+			// are included in the rolled up metrics.
+			rollup = true
 		}
-		if err := a.publish(context.Background()); err != nil {
-			a.config.Logger.With(logp.Error(err)).Warnf(
-				"publishing span metrics failed: %s", err,
+		var result flushResult
+		result.groups, result.err = a.publish(context.Background())
+		if result.err != nil {
+			a.config.Logger.With(logp.Error(result.err)).Warnf(
+				"publishing span metrics failed: %s", result.err,
 			)
 		}
+		if rollup && a.config.RollupInterval > 0 {
+			groups, err := a.publishRollup(context.Background())
+			if err != nil {
+				a.config.Logger.With(logp.Error(err)).Warnf(
+					"publishing rolled up span metrics failed: %s", err,
+				)
+				if result.err == nil {
+					result.err = err
+				}
+			}
+			result.groups += groups
+		}
+		if flushed != nil {
+			flushed <- result
+		}
 	}
 	return nil
 }
 
+// flushResult holds the result of a flush requested by Flush.
+type flushResult struct {
+	groups int
+	err    error
+}
+
+// Flush publishes the aggregated metrics immediately, along with any rolled
+// up metrics, rather than waiting for the next interval. Flush returns the
+// number of groups published.
+//
+// Flush may be called concurrently with Run publishing metrics at each
+// interval; the metrics are published by Run in either case. Flush returns
+// an error if the aggregator is stopped, or ctx is cancelled before the
+// metrics have been published.
+func (a *Aggregator) Flush(ctx context.Context) (int, error) {
+	result := make(chan flushResult, 1)
+	select {
+	case a.flushRequests <- result:
+	case <-a.stopping:
+		return 0, errors.New("aggregator stopped")
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case r := <-result:
+		return r.groups, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
 // Stop stops the Aggregator if it is running, waiting for it to flush any
 // aggregated metrics and return, or for the context to be cancelled.
 //
@@ -150,7 +369,9 @@ func (a *Aggregator) Stop(ctx context.Context) error {
 	return nil
 }
 
-func (a *Aggregator) publish(ctx context.Context) error {
+// publish publishes and clears the aggregated metrics, returning the number
+// of groups published.
+func (a *Aggregator) publish(ctx context.Context) (int, error) {
 	// We hold a.mu only long enough to swap the spanMetrics. This will
 	// be blocked by spanMetrics updates, which is OK, as we prefer not
 	// to block spanMetrics updaters. After the lock is released nothing
@@ -167,17 +388,77 @@ func (a *Aggregator) publish(ctx context.Context) error {
 	size := len(a.inactive.m)
 	if size == 0 {
 		a.config.Logger.Debugf("no span metrics to publish")
-		return nil
+		return 0, nil
 	}
 
 	batch := make(model.Batch, 0, size)
+	a.rollupMu.Lock()
 	for key, metrics := range a.inactive.m {
 		metricset := makeMetricset(key, metrics)
+		if a.config.RollupInterval > 0 {
+			metricset.Metricset.Interval = a.config.Interval
+			a.rollupMetrics(key, metrics)
+		}
 		batch = append(batch, metricset)
 		delete(a.inactive.m, key)
 	}
+	rollupGroups := len(a.rollup)
+	a.rollupMu.Unlock()
+	for key := range a.inactive.spanNames {
+		delete(a.inactive.spanNames, key)
+	}
+	a.inactive.bytes = 0
 	a.config.Logger.Debugf("publishing %d metricsets", len(batch))
-	return a.config.BatchProcessor.ProcessBatch(ctx, &batch)
+	if err := a.config.BatchProcessor.ProcessBatch(ctx, &batch); err != nil {
+		return 0, err
+	}
+	if a.config.RollupInterval > 0 && rollupGroups >= a.config.MaxGroups {
+		// Publish the rolled up metrics early to bound memory,
+		// rather than waiting for RollupInterval to elapse.
+		groups, err := a.publishRollup(ctx)
+		return size + groups, err
+	}
+	return size, nil
+}
+
+// rollupMetrics merges metrics for the group identified by key, which are
+// about to be published, into the corresponding rolled up group.
+// rollupMetrics must be called with a.rollupMu held.
+func (a *Aggregator) rollupMetrics(key aggregationKey, metrics spanMetrics) {
+	ts := key.timestamp
+	if a.config.TimestampAlignment == "end" {
+		// Align by the start of the interval, so metrics for an
+		// interval ending on a RollupInterval boundary are rolled
+		// up with the preceding intervals.
+		ts = ts.Add(-a.config.Interval)
+	}
+	key.timestamp = a.alignTimestamp(ts, a.config.RollupInterval)
+	old := a.rollup[key]
+	a.rollup[key] = spanMetrics{count: metrics.count + old.count, sum: metrics.sum + old.sum}
+}
+
+// publishRollup publishes and clears the rolled up metrics, returning the
+// number of rolled up groups published.
+func (a *Aggregator) publishRollup(ctx context.Context) (int, error) {
+	a.rollupMu.Lock()
+	rollup := a.rollup
+	a.rollup = make(map[aggregationKey]spanMetrics)
+	a.rollupMu.Unlock()
+	if len(rollup) == 0 {
+		a.config.Logger.Debugf("no rolled up span metrics to publish")
+		return 0, nil
+	}
+	batch := make(model.Batch, 0, len(rollup))
+	for key, metrics := range rollup {
+		metricset := makeMetricset(key, metrics)
+		metricset.Metricset.Interval = a.config.RollupInterval
+		batch = append(batch, metricset)
+	}
+	a.config.Logger.Debugf("publishing %d rolled up metricsets", len(batch))
+	if err := a.config.BatchProcessor.ProcessBatch(ctx, &batch); err != nil {
+		return 0, err
+	}
+	return len(batch), nil
 }
 
 // ProcessBatch aggregates all spans contained in "b", adding to it any
@@ -245,7 +526,8 @@ func (a *Aggregator) processSpan(event *model.APMEvent) model.APMEvent {
 		serviceTargetType,
 		serviceTargetName,
 		event.Span.Name,
-		a.config.Interval,
+		a.aggregationOutcome(event.Event.Outcome),
+		a.intervalTimestamp(event.Timestamp),
 	)
 	metrics := spanMetrics{
 		count: float64(count) * event.Span.RepresentativeCount,
@@ -276,7 +558,8 @@ func (a *Aggregator) processDroppedSpanStats(event *model.APMEvent, dss model.Dr
 		// Capturing the service name requires changes to Elastic APM agents.
 		"",
 
-		a.config.Interval,
+		a.aggregationOutcome(event.Event.Outcome),
+		a.intervalTimestamp(event.Timestamp),
 	)
 	metrics := spanMetrics{
 		count: float64(dss.Duration.Count) * representativeCount,
@@ -288,17 +571,79 @@ func (a *Aggregator) processDroppedSpanStats(event *model.APMEvent, dss model.Dr
 	return makeMetricset(key, metrics)
 }
 
+// intervalTimestamp returns the timestamp of metrics for events with the
+// given timestamp, according to the configured TimestampAlignment.
+func (a *Aggregator) intervalTimestamp(ts time.Time) time.Time {
+	return a.alignTimestamp(ts, a.config.Interval)
+}
+
+// alignTimestamp returns the start of the interval containing ts, or the
+// end of the interval if TimestampAlignment is "end".
+func (a *Aggregator) alignTimestamp(ts time.Time, interval time.Duration) time.Time {
+	ts = ts.Truncate(interval)
+	if a.config.TimestampAlignment == "end" {
+		ts = ts.Add(interval)
+	}
+	return ts
+}
+
+// aggregationOutcome returns the outcome to use in aggregation keys for
+// spans with the given outcome.
+func (a *Aggregator) aggregationOutcome(outcome string) string {
+	if a.config.IgnoreOutcome {
+		return ""
+	}
+	switch outcome {
+	case "", "success", "failure", "unknown":
+		return outcome
+	}
+	return "unknown"
+}
+
 type metricsBuffer struct {
 	maxSize int
 
+	// flushThreshold is the number of groups at which flush is
+	// signalled, if greater than zero.
+	flushThreshold int
+	flush          chan<- struct{}
+
+	// maxSpanNames is the maximum number of span names for each
+	// destination, if greater than zero. spanNames holds the number
+	// of span names for each destination, keyed by the aggregation
+	// key without span.name, and spanNamesOverflowed is incremented
+	// for each span aggregated without span.name because its
+	// destination has reached maxSpanNames.
+	maxSpanNames        int
+	spanNames           map[aggregationKey]int
+	spanNamesOverflowed *int64
+
+	// maxBytes is the maximum estimated memory for groups, if greater
+	// than zero. bytes holds the estimated memory used by the groups,
+	// and memoryLimitReached is incremented for each metric which is
+	// not aggregated because its group would exceed maxBytes.
+	maxBytes           int
+	bytes              int
+	memoryLimitReached *int64
+
 	mu sync.RWMutex
 	m  map[aggregationKey]spanMetrics
 }
 
-func newMetricsBuffer(maxSize int) *metricsBuffer {
+func newMetricsBuffer(
+	config AggregatorConfig, flush chan<- struct{},
+	spanNamesOverflowed, memoryLimitReached *int64,
+) *metricsBuffer {
 	return &metricsBuffer{
-		maxSize: maxSize,
-		m:       make(map[aggregationKey]spanMetrics),
+		maxSize:             config.MaxGroups,
+		flushThreshold:      config.FlushThreshold,
+		flush:               flush,
+		maxSpanNames:        config.MaxSpanNamesPerDestination,
+		spanNames:           make(map[aggregationKey]int),
+		spanNamesOverflowed: spanNamesOverflowed,
+		maxBytes:            config.MaxMemoryBytes,
+		memoryLimitReached:  memoryLimitReached,
+		m:                   make(map[aggregationKey]spanMetrics),
 	}
 }
 
@@ -318,8 +663,28 @@ func (mb *metricsBuffer) storeOrUpdate(
 			// number of groups reaches 50% capacity.
 			key.spanName = ""
 			old, ok = mb.m[key]
+		} else if key.spanName != "" && mb.maxSpanNames > 0 {
+			// Stop aggregating on span.name for destinations
+			// which have reached the maximum number of span
+			// names, folding excess span names into the
+			// destination's overflow group.
+			destination := key
+			destination.spanName = ""
+			if mb.spanNames[destination] >= mb.maxSpanNames {
+				atomic.AddInt64(mb.spanNamesOverflowed, 1)
+				key = destination
+				old, ok = mb.m[key]
+			}
 		}
 		if !ok {
+			bytes := key.estimatedBytes()
+			if mb.maxBytes > 0 && mb.bytes+bytes > mb.maxBytes {
+				// Publish the aggregated metrics early to free
+				// memory, and this metric individually.
+				atomic.AddInt64(mb.memoryLimitReached, 1)
+				mb.signalFlush()
+				return false
+			}
 			switch n {
 			case mb.maxSize:
 				return false
@@ -328,12 +693,30 @@ func (mb *metricsBuffer) storeOrUpdate(
 			case mb.maxSize - 1:
 				logger.Warn("service destination groups reached 100% capacity")
 			}
+			if key.spanName != "" && mb.maxSpanNames > 0 {
+				destination := key
+				destination.spanName = ""
+				mb.spanNames[destination]++
+			}
+			mb.bytes += bytes
 		}
 	}
 	mb.m[key] = spanMetrics{count: value.count + old.count, sum: value.sum + old.sum}
+	if !ok && mb.flushThreshold > 0 && len(mb.m) >= mb.flushThreshold {
+		mb.signalFlush()
+	}
 	return true
 }
 
+// signalFlush signals Run to publish, without blocking if it has
+// already been signalled.
+func (mb *metricsBuffer) signalFlush() {
+	select {
+	case mb.flush <- struct{}{}:
+	default:
+	}
+}
+
 type aggregationKey struct {
 	timestamp time.Time
 
@@ -354,19 +737,27 @@ type aggregationKey struct {
 	resource string
 }
 
+// estimatedBytes returns the estimated memory used by a group with the
+// aggregation key k.
+func (k *aggregationKey) estimatedBytes() int {
+	return groupBytes + len(k.serviceName) + len(k.serviceEnvironment) +
+		len(k.agentName) + len(k.spanName) + len(k.outcome) +
+		len(k.targetType) + len(k.targetName) + len(k.resource)
+}
+
 func makeAggregationKey(
-	event *model.APMEvent, resource, targetType, targetName, spanName string, interval time.Duration,
+	event *model.APMEvent, resource, targetType, targetName, spanName, outcome string, timestamp time.Time,
 ) aggregationKey {
 	return aggregationKey{
 		// Group metrics by time interval.
-		timestamp: event.Timestamp.Truncate(interval),
+		timestamp: timestamp,
 
 		serviceName:        event.Service.Name,
 		serviceEnvironment: event.Service.Environment,
 		agentName:          event.Agent.Name,
 
 		spanName: spanName,
-		outcome:  event.Event.Outcome,
+		outcome:  outcome,
 
 		targetType: targetType,
 		targetName: targetName,
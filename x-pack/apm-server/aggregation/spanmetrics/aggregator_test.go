@@ -6,6 +6,7 @@ package spanmetrics
 
 import (
 	"context"
+	"fmt"
 	"sort"
 	"sync"
 	"testing"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/elastic/apm-server/internal/model"
 	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
 )
 
 func BenchmarkAggregateSpan(b *testing.B) {
@@ -59,6 +61,46 @@ func TestNewAggregatorConfigInvalid(t *testing.T) {
 			MaxGroups:      1,
 		},
 		err: "Interval unspecified or negative",
+	}, {
+		config: AggregatorConfig{
+			BatchProcessor: report,
+			MaxGroups:      1,
+			Interval:       time.Nanosecond,
+			FlushThreshold: 2,
+		},
+		err: "FlushThreshold out of range [0,MaxGroups]",
+	}, {
+		config: AggregatorConfig{
+			BatchProcessor:             report,
+			MaxGroups:                  1,
+			Interval:                   time.Nanosecond,
+			MaxSpanNamesPerDestination: -1,
+		},
+		err: "MaxSpanNamesPerDestination negative",
+	}, {
+		config: AggregatorConfig{
+			BatchProcessor:     report,
+			MaxGroups:          1,
+			Interval:           time.Nanosecond,
+			TimestampAlignment: "middle",
+		},
+		err: `TimestampAlignment "middle" unsupported`,
+	}, {
+		config: AggregatorConfig{
+			BatchProcessor: report,
+			MaxGroups:      1,
+			Interval:       time.Nanosecond,
+			MaxMemoryBytes: -1,
+		},
+		err: "MaxMemoryBytes negative",
+	}, {
+		config: AggregatorConfig{
+			BatchProcessor: report,
+			MaxGroups:      1,
+			Interval:       time.Minute,
+			RollupInterval: 90 * time.Second,
+		},
+		err: "RollupInterval must be a multiple of Interval",
 	}} {
 		agg, err := NewAggregator(test.config)
 		require.Error(t, err)
@@ -242,6 +284,78 @@ func TestAggregatorRun(t *testing.T) {
 	}
 }
 
+func TestAggregatorRunFlushThreshold(t *testing.T) {
+	batches := make(chan model.Batch, 1)
+	agg, err := NewAggregator(AggregatorConfig{
+		BatchProcessor: makeChanBatchProcessor(batches),
+		Interval:       time.Hour,
+		MaxGroups:      10,
+		FlushThreshold: 2,
+	})
+	require.NoError(t, err)
+	go agg.Run()
+	defer agg.Stop(context.Background())
+
+	batch := model.Batch{
+		makeSpan("service-A", "java", "destination-X", "", "", "success", 100*time.Millisecond, 1),
+		makeSpan("service-A", "java", "destination-X", "", "", "success", 100*time.Millisecond, 1),
+		makeSpan("service-A", "java", "destination-Z", "", "", "success", 100*time.Millisecond, 1),
+	}
+	require.NoError(t, agg.ProcessBatch(context.Background(), &batch))
+
+	// Metrics should be published once the threshold is reached,
+	// well before the interval elapses.
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
+	require.Len(t, metricsets, 2)
+	counts := make(map[string]int)
+	for _, ms := range metricsets {
+		counts[ms.Span.DestinationService.Resource] = ms.Span.DestinationService.ResponseTime.Count
+	}
+	assert.Equal(t, map[string]int{"destination-X": 2, "destination-Z": 1}, counts)
+
+	select {
+	case <-batches:
+		t.Fatal("unexpected publish")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	batches := make(chan model.Batch, 2)
+	agg, err := NewAggregator(AggregatorConfig{
+		BatchProcessor: makeChanBatchProcessor(batches),
+		Interval:       time.Hour,
+		RollupInterval: 2 * time.Hour,
+		MaxGroups:      10,
+	})
+	require.NoError(t, err)
+	go agg.Run()
+
+	batch := model.Batch{
+		makeSpan("service-A", "java", "destination-X", "", "", "success", 100*time.Millisecond, 1),
+		makeSpan("service-A", "java", "destination-X", "", "", "success", 100*time.Millisecond, 1),
+		makeSpan("service-A", "java", "destination-Z", "", "", "success", 100*time.Millisecond, 1),
+	}
+	require.NoError(t, agg.ProcessBatch(context.Background(), &batch))
+
+	// Both the metrics and the rolled up metrics are published
+	// immediately, well before the intervals elapse.
+	groups, err := agg.Flush(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, groups)
+	for _, interval := range []time.Duration{time.Hour, 2 * time.Hour} {
+		metricsets := batchMetricsets(t, expectBatch(t, batches))
+		require.Len(t, metricsets, 2)
+		for _, ms := range metricsets {
+			assert.Equal(t, interval, ms.Metricset.Interval)
+		}
+	}
+
+	require.NoError(t, agg.Stop(context.Background()))
+	_, err = agg.Flush(context.Background())
+	assert.EqualError(t, err, "aggregator stopped")
+}
+
 func TestAggregateCompositeSpan(t *testing.T) {
 	batches := make(chan model.Batch, 1)
 	agg, err := NewAggregator(AggregatorConfig{
@@ -483,37 +597,243 @@ func TestAggregateHalfCapacityNoSpanName(t *testing.T) {
 	}, actualDestinationSpanNames)
 }
 
-func TestAggregateTimestamp(t *testing.T) {
+func TestAggregateMaxSpanNamesPerDestination(t *testing.T) {
 	batches := make(chan model.Batch, 1)
 	agg, err := NewAggregator(AggregatorConfig{
-		BatchProcessor: makeChanBatchProcessor(batches),
-		Interval:       30 * time.Second,
-		MaxGroups:      1000,
+		BatchProcessor:             makeChanBatchProcessor(batches),
+		Interval:                   10 * time.Millisecond,
+		MaxGroups:                  1000,
+		MaxSpanNamesPerDestination: 2,
 	})
 	require.NoError(t, err)
 
-	t0 := time.Unix(0, 0)
-	for _, ts := range []time.Time{t0, t0.Add(15 * time.Second), t0.Add(30 * time.Second)} {
-		span := makeSpan("service_name", "agent_name", "destination", "trg_type", "trg_name", "success", 100*time.Millisecond, 1)
-		span.Timestamp = ts
-		batch := model.Batch{span}
-		err = agg.ProcessBatch(context.Background(), &batch)
-		require.NoError(t, err)
-		assert.Empty(t, batchMetricsets(t, batch))
+	var batch model.Batch
+	for _, name := range []string{"a", "b", "c", "a", "d"} {
+		span := makeSpan("service", "agent", "dest1", "", "", "success", 100*time.Millisecond, 1)
+		span.Span.Name = name
+		batch = append(batch, span)
 	}
+	batch = append(batch, makeSpan("service", "agent", "dest2", "", "", "success", 100*time.Millisecond, 1))
+	require.NoError(t, agg.ProcessBatch(context.Background(), &batch))
+	assert.Empty(t, batchMetricsets(t, batch))
+
+	registry := monitoring.NewRegistry()
+	monitoring.NewFunc(registry, "spanmetrics", agg.CollectMonitoring)
+	snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, map[string]int64{
+		"spanmetrics.active_groups":         4,
+		"spanmetrics.span_names_overflowed": 2,
+	}, snapshot.Ints)
 
 	go agg.Run()
-	err = agg.Stop(context.Background()) // stop to flush
+	defer agg.Stop(context.Background())
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
+
+	counts := make(map[string]int)
+	for _, ms := range metricsets {
+		key := ms.Span.DestinationService.Resource + "/" + ms.Span.Name
+		counts[key] += ms.Span.DestinationService.ResponseTime.Count
+	}
+	assert.Equal(t, map[string]int{
+		"dest1/a": 2,
+		"dest1/b": 1,
+		// Span names exceeding the limit for dest1 are aggregated
+		// in its overflow group, without span.name.
+		"dest1/":              2,
+		"dest2/service:dest2": 1,
+	}, counts)
+}
+
+func TestAggregateMaxMemoryBytes(t *testing.T) {
+	span := func(resource string) model.APMEvent {
+		return makeSpan("service", "agent", resource, "", "", "success", 100*time.Millisecond, 1)
+	}
+	key := makeAggregationKey(&model.APMEvent{
+		Service: model.Service{Name: "service"},
+		Agent:   model.Agent{Name: "agent"},
+	}, "dest1", "", "", "service:dest1", "success", time.Time{})
+
+	// Limit memory so that only one group fits.
+	batches := make(chan model.Batch, 1)
+	agg, err := NewAggregator(AggregatorConfig{
+		BatchProcessor: makeChanBatchProcessor(batches),
+		Interval:       time.Hour,
+		MaxGroups:      1000,
+		MaxMemoryBytes: key.estimatedBytes(),
+	})
 	require.NoError(t, err)
 
-	batch := expectBatch(t, batches)
+	batch := model.Batch{span("dest1"), span("dest1"), span("dest2")}
+	require.NoError(t, agg.ProcessBatch(context.Background(), &batch))
 	metricsets := batchMetricsets(t, batch)
-	require.Len(t, metricsets, 2)
-	sort.Slice(metricsets, func(i, j int) bool {
-		return metricsets[i].Timestamp.Before(metricsets[j].Timestamp)
-	})
-	assert.Equal(t, t0, metricsets[0].Timestamp)
-	assert.Equal(t, t0.Add(30*time.Second), metricsets[1].Timestamp)
+	require.Len(t, metricsets, 1)
+	assert.Equal(t, "dest2", metricsets[0].Span.DestinationService.Resource)
+
+	registry := monitoring.NewRegistry()
+	monitoring.NewFunc(registry, "spanmetrics", agg.CollectMonitoring)
+	snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, map[string]int64{
+		"spanmetrics.active_groups":          1,
+		"spanmetrics.span_names_overflowed":  0,
+		"spanmetrics.memory.estimated_bytes": int64(key.estimatedBytes()),
+		"spanmetrics.memory.limit_reached":   1,
+	}, snapshot.Ints)
+
+	// The aggregated metrics are published early, without waiting for
+	// the interval to elapse.
+	go agg.Run()
+	defer agg.Stop(context.Background())
+	metricsets = batchMetricsets(t, expectBatch(t, batches))
+	require.Len(t, metricsets, 1)
+	assert.Equal(t, "dest1", metricsets[0].Span.DestinationService.Resource)
+	assert.Equal(t, 2, metricsets[0].Span.DestinationService.ResponseTime.Count)
+}
+
+func TestAggregateOutcome(t *testing.T) {
+	for _, ignoreOutcome := range []bool{false, true} {
+		t.Run(fmt.Sprintf("IgnoreOutcome=%v", ignoreOutcome), func(t *testing.T) {
+			batches := make(chan model.Batch, 1)
+			agg, err := NewAggregator(AggregatorConfig{
+				BatchProcessor: makeChanBatchProcessor(batches),
+				Interval:       10 * time.Millisecond,
+				MaxGroups:      1000,
+				IgnoreOutcome:  ignoreOutcome,
+			})
+			require.NoError(t, err)
+
+			err = agg.ProcessBatch(
+				context.Background(),
+				&model.Batch{
+					makeSpan("service", "agent", "dest", "", "", "success", 100*time.Millisecond, 1),
+					makeSpan("service", "agent", "dest", "", "", "failure", 100*time.Millisecond, 1),
+					makeSpan("service", "agent", "dest", "", "", "unknown", 100*time.Millisecond, 1),
+					makeSpan("service", "agent", "dest", "", "", "something_else", 100*time.Millisecond, 1),
+				},
+			)
+			require.NoError(t, err)
+
+			// Start the aggregator after processing to ensure metrics are aggregated deterministically.
+			go agg.Run()
+			defer agg.Stop(context.Background())
+
+			batch := expectBatch(t, batches)
+			metricsets := batchMetricsets(t, batch)
+
+			counts := make(map[string]int)
+			for _, ms := range metricsets {
+				counts[ms.Event.Outcome] += ms.Span.DestinationService.ResponseTime.Count
+			}
+			if ignoreOutcome {
+				assert.Equal(t, map[string]int{"": 4}, counts)
+			} else {
+				// Unrecognised outcomes are aggregated as "unknown".
+				assert.Equal(t, map[string]int{"success": 1, "failure": 1, "unknown": 2}, counts)
+			}
+		})
+	}
+}
+
+func TestAggregateTimestamp(t *testing.T) {
+	for alignment, offset := range map[string]time.Duration{
+		"":      0,
+		"start": 0,
+		"end":   30 * time.Second,
+	} {
+		t.Run(fmt.Sprintf("TimestampAlignment=%q", alignment), func(t *testing.T) {
+			batches := make(chan model.Batch, 1)
+			agg, err := NewAggregator(AggregatorConfig{
+				BatchProcessor:     makeChanBatchProcessor(batches),
+				Interval:           30 * time.Second,
+				MaxGroups:          1000,
+				TimestampAlignment: alignment,
+			})
+			require.NoError(t, err)
+
+			t0 := time.Unix(0, 0)
+			for _, ts := range []time.Time{t0, t0.Add(15 * time.Second), t0.Add(30 * time.Second)} {
+				span := makeSpan("service_name", "agent_name", "destination", "trg_type", "trg_name", "success", 100*time.Millisecond, 1)
+				span.Timestamp = ts
+				batch := model.Batch{span}
+				err = agg.ProcessBatch(context.Background(), &batch)
+				require.NoError(t, err)
+				assert.Empty(t, batchMetricsets(t, batch))
+			}
+
+			go agg.Run()
+			err = agg.Stop(context.Background()) // stop to flush
+			require.NoError(t, err)
+
+			batch := expectBatch(t, batches)
+			metricsets := batchMetricsets(t, batch)
+			require.Len(t, metricsets, 2)
+			sort.Slice(metricsets, func(i, j int) bool {
+				return metricsets[i].Timestamp.Before(metricsets[j].Timestamp)
+			})
+			assert.Equal(t, t0.Add(offset), metricsets[0].Timestamp)
+			assert.Equal(t, t0.Add(30*time.Second+offset), metricsets[1].Timestamp)
+		})
+	}
+}
+
+func TestAggregateRollup(t *testing.T) {
+	for alignment, offset := range map[string]time.Duration{
+		"start": 0,
+		"end":   time.Hour,
+	} {
+		t.Run(fmt.Sprintf("TimestampAlignment=%q", alignment), func(t *testing.T) {
+			batches := make(chan model.Batch, 2)
+			agg, err := NewAggregator(AggregatorConfig{
+				BatchProcessor:     makeChanBatchProcessor(batches),
+				Interval:           30 * time.Second,
+				MaxGroups:          1000,
+				TimestampAlignment: alignment,
+				RollupInterval:     time.Hour,
+			})
+			require.NoError(t, err)
+
+			t0 := time.Unix(0, 0)
+			for _, ts := range []time.Time{
+				t0, t0.Add(15 * time.Second), t0.Add(59 * time.Minute), t0.Add(time.Hour),
+			} {
+				span := makeSpan("service_name", "agent_name", "destination", "trg_type", "trg_name", "success", 100*time.Millisecond, 1)
+				span.Timestamp = ts
+				batch := model.Batch{span}
+				err = agg.ProcessBatch(context.Background(), &batch)
+				require.NoError(t, err)
+				assert.Empty(t, batchMetricsets(t, batch))
+			}
+
+			go agg.Run()
+			err = agg.Stop(context.Background()) // stop to flush
+			require.NoError(t, err)
+
+			metricsets := batchMetricsets(t, expectBatch(t, batches))
+			require.Len(t, metricsets, 3)
+			for _, ms := range metricsets {
+				assert.Equal(t, 30*time.Second, ms.Metricset.Interval)
+			}
+
+			// The metrics for the first two intervals should be rolled
+			// up together, as they are in the same hour.
+			metricsets = batchMetricsets(t, expectBatch(t, batches))
+			require.Len(t, metricsets, 2)
+			sort.Slice(metricsets, func(i, j int) bool {
+				return metricsets[i].Timestamp.Before(metricsets[j].Timestamp)
+			})
+			assert.Equal(t, t0.Add(offset), metricsets[0].Timestamp)
+			assert.Equal(t, time.Hour, metricsets[0].Metricset.Interval)
+			assert.Equal(t, model.AggregatedDuration{
+				Count: 3,
+				Sum:   300 * time.Millisecond,
+			}, metricsets[0].Span.DestinationService.ResponseTime)
+			assert.Equal(t, t0.Add(time.Hour+offset), metricsets[1].Timestamp)
+			assert.Equal(t, time.Hour, metricsets[1].Metricset.Interval)
+			assert.Equal(t, model.AggregatedDuration{
+				Count: 1,
+				Sum:   100 * time.Millisecond,
+			}, metricsets[1].Span.DestinationService.ResponseTime)
+		})
+	}
 }
 
 func TestAggregatorMaxGroups(t *testing.T) {
@@ -15,6 +15,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/pkg/errors"
@@ -48,21 +49,54 @@ const (
 )
 
 // Aggregator aggregates transaction durations, periodically publishing histogram metrics.
+//
+// The histograms published by separate Aggregators for the same transaction
+// group and interval may be combined with MergeHistograms.
 type Aggregator struct {
 	stopMu   sync.Mutex
 	stopping chan struct{}
 	stopped  chan struct{}
 
+	// flush is signalled when the number of groups reaches FlushThreshold.
+	flush chan struct{}
+
+	// flushRequests receives requests from Flush to publish immediately.
+	flushRequests chan chan<- flushResult
+
 	config              AggregatorConfig
 	metrics             *aggregatorMetrics // heap-allocated for 64-bit alignment
 	tooManyGroupsLogger *logp.Logger
 
+	// shards holds the aggregator's shards. Transaction groups are
+	// assigned to a shard by their hash.
+	shards   []*aggregatorShard
+	eviction evictionStrategy
+
+	// histogramBytes is the estimated memory used by the histogram
+	// of each transaction group.
+	histogramBytes int
+
+	// rollup holds the groups rolled up from those published every
+	// MetricsInterval, if RollupInterval is non-zero.
+	rollup *rollup
+}
+
+// aggregatorShard holds the metrics for a subset of transaction groups,
+// so that groups in different shards may be updated without contention.
+type aggregatorShard struct {
 	mu               sync.RWMutex
 	active, inactive *metrics
+
+	// flushThreshold is the shard's share of FlushThreshold.
+	flushThreshold int
 }
 
 type aggregatorMetrics struct {
 	overflowed int64
+
+	// memoryLimitReached counts the transactions which would have
+	// created a new group, had MaxMemoryBytes not been reached.
+	memoryLimitReached int64
 }
 
 // AggregatorConfig holds configuration for creating an Aggregator.
@@ -86,10 +120,81 @@ type AggregatorConfig struct {
 	// times if the aggregation groups fill up.
 	MetricsInterval time.Duration
 
+	// FlushThreshold is the number of transaction groups at which
+	// aggregated metrics are published without waiting for MetricsInterval
+	// to elapse. This bounds the number of groups held in memory, and
+	// smooths publishing for variable workloads.
+	//
+	// Metrics published early are timestamped with the same interval
+	// as those published at the end of the interval, so the same group
+	// may be published more than once per interval.
+	//
+	// If FlushThreshold is zero, metrics are published only every
+	// MetricsInterval. FlushThreshold must be no greater than
+	// MaxTransactionGroups.
+	FlushThreshold int
+
 	// HDRHistogramSignificantFigures is the number of significant figures
 	// to maintain in the HDR Histograms. HDRHistogramSignificantFigures
 	// must be in the range [1,5].
 	HDRHistogramSignificantFigures int
+
+	// EvictionPolicy controls how transactions which would create a new
+	// transaction group are handled once MaxTransactionGroups has been
+	// reached. If EvictionPolicy is empty, EvictionPolicyPublishIndividual
+	// will be used.
+	EvictionPolicy EvictionPolicy
+
+	// Shards is the number of shards to split transaction groups across,
+	// by transaction group hash. Each shard has its own metrics and locks,
+	// so that transactions may be aggregated in parallel on multi-core
+	// machines. MaxTransactionGroups and FlushThreshold are divided evenly
+	// between the shards, and the metrics of all shards are published
+	// together.
+	//
+	// If Shards is zero, a single shard is used. Shards must be no greater
+	// than MaxTransactionGroups.
+	Shards int
+
+	// TimestampAlignment controls the timestamp of published metrics:
+	// "start" for the start of the MetricsInterval in which the
+	// transactions occurred, or "end" for the end of the interval. If
+	// TimestampAlignment is empty, "start" is used.
+	//
+	// Metrics are timestamped by the interval rather than the time they
+	// are published, so that metrics for the same interval published by
+	// different servers, or published early, can be rolled up together.
+	TimestampAlignment string
+
+	// MaxMemoryBytes is the memory budget, in bytes, for the transaction
+	// groups held within an aggregation period, based on an estimate of
+	// the memory used by each group's key and histogram. Once a new group
+	// would exceed the budget, metrics are published without waiting for
+	// MetricsInterval to elapse, and until they are, transactions which
+	// would create a new group are handled according to EvictionPolicy,
+	// as if MaxTransactionGroups had been reached.
+	//
+	// MaxMemoryBytes is divided evenly between the shards. If
+	// MaxMemoryBytes is zero, memory use is bounded only by
+	// MaxTransactionGroups.
+	MaxMemoryBytes int
+
+	// RollupInterval, if non-zero, is the interval of a second, coarser
+	// resolution of metrics, for retaining historical metrics at a lower
+	// storage cost. The groups published every MetricsInterval are merged
+	// into groups timestamped by RollupInterval, and published every
+	// RollupInterval.
+	//
+	// When RollupInterval is non-zero, published metrics have their
+	// aggregation interval recorded in model.Metricset.Interval, so that
+	// the two resolutions can be distinguished. Metrics published
+	// individually, because MaxTransactionGroups or MaxMemoryBytes was
+	// reached, are not rolled up.
+	//
+	// If the number of rolled up groups reaches MaxTransactionGroups, they
+	// are published without waiting for RollupInterval to elapse.
+	// RollupInterval must be a multiple of MetricsInterval.
+	RollupInterval time.Duration
 }
 
 // Validate validates the aggregator config.
@@ -103,9 +208,29 @@ func (config AggregatorConfig) Validate() error {
 	if config.MetricsInterval <= 0 {
 		return errors.New("MetricsInterval unspecified or negative")
 	}
+	if config.FlushThreshold < 0 || config.FlushThreshold > config.MaxTransactionGroups {
+		return errors.New("FlushThreshold out of range [0,MaxTransactionGroups]")
+	}
+	if config.Shards < 0 || config.Shards > config.MaxTransactionGroups {
+		return errors.New("Shards out of range [0,MaxTransactionGroups]")
+	}
 	if n := config.HDRHistogramSignificantFigures; n < 1 || n > 5 {
 		return errors.Errorf("HDRHistogramSignificantFigures (%d) outside range [1,5]", n)
 	}
+	if err := validateEvictionPolicy(config.EvictionPolicy); err != nil {
+		return err
+	}
+	switch config.TimestampAlignment {
+	case "", "start", "end":
+	default:
+		return errors.Errorf("TimestampAlignment %q unsupported", config.TimestampAlignment)
+	}
+	if config.MaxMemoryBytes < 0 {
+		return errors.New("MaxMemoryBytes negative")
+	}
+	if config.RollupInterval < 0 || config.RollupInterval%config.MetricsInterval != 0 {
+		return errors.New("RollupInterval must be a multiple of MetricsInterval")
+	}
 	return nil
 }
 
@@ -117,23 +242,67 @@ func NewAggregator(config AggregatorConfig) (*Aggregator, error) {
 	if config.Logger == nil {
 		config.Logger = logp.NewLogger(logs.TransactionMetrics)
 	}
+	eviction := newEvictionStrategy(config.EvictionPolicy)
+	numShards := config.Shards
+	if numShards == 0 {
+		numShards = 1
+	}
+	shards := make([]*aggregatorShard, numShards)
+	for i := range shards {
+		maxGroups := shareOf(config.MaxTransactionGroups, i, numShards)
+		maxBytes := shareOf(config.MaxMemoryBytes, i, numShards)
+		shards[i] = &aggregatorShard{
+			active:         newMetrics(maxGroups, eviction.reserved(), maxBytes),
+			inactive:       newMetrics(maxGroups, eviction.reserved(), maxBytes),
+			flushThreshold: shareOf(config.FlushThreshold, i, numShards),
+		}
+		if config.FlushThreshold > 0 && shards[i].flushThreshold == 0 {
+			shards[i].flushThreshold = 1
+		}
+	}
+	var rollup *rollup
+	if config.RollupInterval > 0 {
+		rollup = newRollup()
+	}
 	return &Aggregator{
 		stopping:            make(chan struct{}),
 		stopped:             make(chan struct{}),
+		flush:               make(chan struct{}, 1),
+		flushRequests:       make(chan chan<- flushResult),
 		config:              config,
 		metrics:             &aggregatorMetrics{},
 		tooManyGroupsLogger: config.Logger.WithOptions(logs.WithRateLimit(tooManyGroupsLoggerRateLimit)),
-		active:              newMetrics(config.MaxTransactionGroups),
-		inactive:            newMetrics(config.MaxTransactionGroups),
+		shards:              shards,
+		eviction:            eviction,
+		histogramBytes:      newHistogram(config.HDRHistogramSignificantFigures).ByteSize(),
+		rollup:              rollup,
 	}, nil
 }
 
+// shareOf returns the i'th of n shares of total, distributing any remainder
+// across the first shares.
+func shareOf(total, i, n int) int {
+	share := total / n
+	if i < total%n {
+		share++
+	}
+	return share
+}
+
 // Run runs the Aggregator, periodically publishing and clearing aggregated
-// metrics. Run returns when either a fatal error occurs, or the Aggregator's
-// Stop method is invoked.
+// metrics, and whenever the number of groups reaches FlushThreshold. If
+// RollupInterval is non-zero, rolled up metrics are published every
+// RollupInterval. Run returns when either a fatal error occurs, or the
+// Aggregator's Stop method is invoked.
 func (a *Aggregator) Run() error {
 	ticker := time.NewTicker(a.config.MetricsInterval)
 	defer ticker.Stop()
+	var rollupTicks <-chan time.Time
+	if a.rollup != nil {
+		rollupTicker := time.NewTicker(a.config.RollupInterval)
+		defer rollupTicker.Stop()
+		rollupTicks = rollupTicker.C
+	}
 	defer func() {
 		a.stopMu.Lock()
 		defer a.stopMu.Unlock()
@@ -145,20 +314,77 @@ func (a *Aggregator) Run() error {
 	}()
 	var stop bool
 	for !stop {
+		var rollup bool
+		var flushed chan<- flushResult
 		select {
 		case <-a.stopping:
-			stop = true
+			stop, rollup = true, true
 		case <-ticker.C:
+		case <-a.flush:
+		case flushed = <-a.flushRequests:
+			rollup = true
+		case <-rollupTicks:
+			// Publish the current metrics first, so they
+			// are included in the rolled up metrics.
+			rollup = true
 		}
-		if err := a.publish(context.Background()); err != nil {
-			a.config.Logger.With(logp.Error(err)).Warnf(
-				"publishing transaction metrics failed: %s", err,
+		var result flushResult
+		result.groups, result.err = a.publish(context.Background())
+		if result.err != nil {
+			a.config.Logger.With(logp.Error(result.err)).Warnf(
+				"publishing transaction metrics failed: %s", result.err,
 			)
 		}
+		if rollup && a.rollup != nil {
+			groups, err := a.publishRollup(context.Background())
+			if err != nil {
+				a.config.Logger.With(logp.Error(err)).Warnf(
+					"publishing rolled up transaction metrics failed: %s", err,
+				)
+				if result.err == nil {
+					result.err = err
+				}
+			}
+			result.groups += groups
+		}
+		if flushed != nil {
+			flushed <- result
+		}
 	}
 	return nil
 }
 
+// flushResult holds the result of a flush requested by Flush.
+type flushResult struct {
+	groups int
+	err    error
+}
+
+// Flush publishes the aggregated metrics immediately, along with any rolled
+// up metrics, rather than waiting for the next interval. Flush returns the
+// number of transaction groups published.
+//
+// Flush may be called concurrently with Run publishing metrics at each
+// interval; the metrics are published by Run in either case. Flush returns
+// an error if the aggregator is stopped, or ctx is cancelled before the
+// metrics have been published.
+func (a *Aggregator) Flush(ctx context.Context) (int, error) {
+	result := make(chan flushResult, 1)
+	select {
+	case a.flushRequests <- result:
+	case <-a.stopping:
+		return 0, errors.New("aggregator stopped")
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case r := <-result:
+		return r.groups, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
 // Stop stops the Aggregator if it is running, waiting for it to flush any
 // aggregated metrics and return, or for the context to be cancelled.
 //
@@ -191,46 +417,167 @@ func (a *Aggregator) CollectMonitoring(_ monitoring.Mode, V monitoring.Visitor)
 	V.OnRegistryStart()
 	defer V.OnRegistryFinished()
 
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-
-	m := a.active
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	var activeGroups, activeBytes int
+	for _, s := range a.shards {
+		s.mu.RLock()
+		m := s.active
+		m.mu.RLock()
+		activeGroups += m.entries
+		activeBytes += m.bytes
+		m.mu.RUnlock()
+		s.mu.RUnlock()
+	}
 
-	monitoring.ReportInt(V, "active_groups", int64(m.entries))
+	monitoring.ReportInt(V, "active_groups", int64(activeGroups))
 	monitoring.ReportInt(V, "overflowed", atomic.LoadInt64(&a.metrics.overflowed))
+	if a.config.MaxMemoryBytes > 0 {
+		monitoring.ReportNamespace(V, "memory", func() {
+			// memory.estimated_bytes is the estimated memory used by
+			// the active groups, and memory.limit_reached counts the
+			// transactions which would have created a new group, had
+			// MaxMemoryBytes not been reached.
+			monitoring.ReportInt(V, "estimated_bytes", int64(activeBytes))
+			monitoring.ReportInt(V, "limit_reached", atomic.LoadInt64(&a.metrics.memoryLimitReached))
+		})
+	}
+	if policy := a.eviction.policy(); policy != EvictionPolicyPublishIndividual {
+		monitoring.ReportNamespace(V, "evicted", func() {
+			monitoring.ReportInt(V, string(policy), a.eviction.evictions())
+		})
+	}
+	if a.rollup != nil {
+		monitoring.ReportNamespace(V, "rollup", func() {
+			monitoring.ReportInt(V, "active_groups", int64(a.rollup.len()))
+		})
+	}
 }
 
-func (a *Aggregator) publish(ctx context.Context) error {
-	// We hold a.mu only long enough to swap the metrics. This will
-	// be blocked by metrics updates, which is OK, as we prefer not
-	// to block metrics updaters. After the lock is released nothing
-	// will be accessing a.inactive.
-	a.mu.Lock()
-	a.active, a.inactive = a.inactive, a.active
-	a.mu.Unlock()
+// publish publishes and clears the aggregated metrics, returning the number
+// of transaction groups published.
+func (a *Aggregator) publish(ctx context.Context) (int, error) {
+	// We hold each shard's mu only long enough to swap its metrics.
+	// This will be blocked by metrics updates, which is OK, as we
+	// prefer not to block metrics updaters. After the lock is released
+	// nothing will be accessing the shard's inactive metrics.
+	var numEntries int
+	for _, s := range a.shards {
+		s.mu.Lock()
+		s.active, s.inactive = s.inactive, s.active
+		s.mu.Unlock()
+		numEntries += s.inactive.entries
+	}
 
-	if a.inactive.entries == 0 {
+	if numEntries == 0 {
 		a.config.Logger.Debugf("no metrics to publish")
-		return nil
+		return 0, nil
 	}
 
 	// TODO(axw) record either the aggregation interval in effect, or
 	// the specific time period (date_range) on the metrics documents.
 
-	batch := make(model.Batch, 0, a.inactive.entries)
-	for hash, entries := range a.inactive.m {
+	batch := make(model.Batch, 0, numEntries)
+	for hash, entries := range a.mergeInactive() {
 		for _, entry := range entries {
 			totalCount, counts, values := entry.transactionMetrics.histogramBuckets()
-			batch = append(batch, makeMetricset(entry.transactionAggregationKey, hash, totalCount, counts, values))
+			metricset := makeMetricset(entry.transactionAggregationKey, hash, totalCount, counts, values)
+			if a.rollup != nil {
+				metricset.Metricset.Interval = a.config.MetricsInterval
+				a.rollupEntry(entry)
+			}
+			batch = append(batch, metricset)
+		}
+	}
+	for _, s := range a.shards {
+		m := s.inactive
+		for hash := range m.m {
+			delete(m.m, hash)
 		}
-		delete(a.inactive.m, hash)
+		m.entries = 0
+		m.bytes = 0
+		m.clock = 0
 	}
-	a.inactive.entries = 0
 
 	a.config.Logger.Debugf("publishing %d metricsets", len(batch))
-	return a.config.BatchProcessor.ProcessBatch(ctx, &batch)
+	if err := a.config.BatchProcessor.ProcessBatch(ctx, &batch); err != nil {
+		return 0, err
+	}
+	if a.rollup != nil && a.rollup.len() >= a.config.MaxTransactionGroups {
+		// Publish the rolled up metrics early to bound memory,
+		// rather than waiting for RollupInterval to elapse.
+		groups, err := a.publishRollup(ctx)
+		return len(batch) + groups, err
+	}
+	return len(batch), nil
+}
+
+// rollupEntry merges the metrics of entry, which is about to be published,
+// into the corresponding rolled up group.
+func (a *Aggregator) rollupEntry(entry *metricsMapEntry) {
+	key := entry.transactionAggregationKey
+	key.timestamp = a.rollupTimestamp(key.timestamp)
+	a.rollup.merge(key, key.hash(), entry.histogram, a.config.HDRHistogramSignificantFigures)
+}
+
+// rollupTimestamp returns the timestamp of rolled up metrics for metrics
+// with the timestamp ts, aligned according to TimestampAlignment.
+func (a *Aggregator) rollupTimestamp(ts time.Time) time.Time {
+	if a.config.TimestampAlignment == "end" {
+		// Align by the start of the interval, so metrics for an
+		// interval ending on a RollupInterval boundary are rolled
+		// up with the preceding intervals.
+		ts = ts.Add(-a.config.MetricsInterval)
+	}
+	return alignTimestamp(ts, a.config.RollupInterval, a.config.TimestampAlignment)
+}
+
+// publishRollup publishes and clears the rolled up metrics, returning the
+// number of rolled up groups published.
+func (a *Aggregator) publishRollup(ctx context.Context) (int, error) {
+	groups := a.rollup.swap()
+	if len(groups) == 0 {
+		a.config.Logger.Debugf("no rolled up metrics to publish")
+		return 0, nil
+	}
+	batch := make(model.Batch, 0, len(groups))
+	for _, group := range groups {
+		totalCount, counts, values := group.histogramBuckets()
+		metricset := makeMetricset(group.transactionAggregationKey, group.hash, totalCount, counts, values)
+		metricset.Metricset.Interval = a.config.RollupInterval
+		batch = append(batch, metricset)
+	}
+	a.config.Logger.Debugf("publishing %d rolled up metricsets", len(batch))
+	if err := a.config.BatchProcessor.ProcessBatch(ctx, &batch); err != nil {
+		return 0, err
+	}
+	return len(batch), nil
+}
+
+// mergeInactive returns the groups in the inactive metrics of all shards.
+//
+// Groups are assigned to shards by hash, except for groups that the eviction
+// strategy redirects transactions into, which are recorded in the shard of
+// the redirected transaction. Such groups may be recorded in several shards,
+// so their histograms are merged.
+func (a *Aggregator) mergeInactive() map[uint64][]*metricsMapEntry {
+	if len(a.shards) == 1 {
+		return a.shards[0].inactive.m
+	}
+	merged := make(map[uint64][]*metricsMapEntry)
+	for _, s := range a.shards {
+		for hash, entries := range s.inactive.m {
+		entryLoop:
+			for _, entry := range entries {
+				for _, existing := range merged[hash] {
+					if existing.transactionAggregationKey.equal(entry.transactionAggregationKey) {
+						existing.histogram.Merge(entry.histogram)
+						continue entryLoop
+					}
+				}
+				merged[hash] = append(merged[hash], entry)
+			}
+		}
+	}
+	return merged
 }
 
 // ProcessBatch aggregates all transactions contained in "b", adding to it any
@@ -254,9 +601,10 @@ func (a *Aggregator) ProcessBatch(ctx context.Context, b *model.Batch) error {
 // AggregateTransaction aggregates transaction metrics.
 //
 // If the transaction cannot be aggregated due to the maximum number
-// of transaction groups being exceeded, then a metricset APMEvent will
-// be returned which should be published immediately, along with the
-// transaction. Otherwise, the returned event will be the zero value.
+// of transaction groups being exceeded, or if another transaction group
+// was evicted to make room for the transaction's group, then a metricset
+// APMEvent will be returned which should be published immediately, along
+// with the transaction. Otherwise, the returned event will be the zero value.
 func (a *Aggregator) AggregateTransaction(event model.APMEvent) model.APMEvent {
 	if event.Transaction.RepresentativeCount <= 0 {
 		return model.APMEvent{}
@@ -265,8 +613,8 @@ func (a *Aggregator) AggregateTransaction(event model.APMEvent) model.APMEvent {
 	key := a.makeTransactionAggregationKey(event, a.config.MetricsInterval)
 	hash := key.hash()
 	count := transactionCount(event.Transaction)
-	if a.updateTransactionMetrics(key, hash, event.Transaction.RepresentativeCount, event.Event.Duration) {
-		return model.APMEvent{}
+	if ok, evicted := a.updateTransactionMetrics(key, hash, event.Transaction.RepresentativeCount, event.Event.Duration); ok {
+		return evicted
 	}
 	// Too many aggregation keys: could not update metrics, so immediately
 	// publish a single-value metric document.
@@ -281,68 +629,134 @@ unique transaction names.`[1:],
 	return makeMetricset(key, hash, counts[0], counts, values)
 }
 
-func (a *Aggregator) updateTransactionMetrics(key transactionAggregationKey, hash uint64, count float64, duration time.Duration) bool {
+// updateTransactionMetrics records a transaction in the group identified by
+// key and hash, returning false if the group does not exist and could not be
+// created due to the maximum number of groups being reached.
+//
+// If another group was evicted to make room for the new group, a metricset
+// event for the evicted group is returned, which should be published
+// immediately. Otherwise the returned event will be the zero value.
+func (a *Aggregator) updateTransactionMetrics(
+	key transactionAggregationKey, hash uint64, count float64, duration time.Duration,
+) (bool, model.APMEvent) {
 	if duration < minDuration {
 		duration = minDuration
 	} else if duration > maxDuration {
 		duration = maxDuration
 	}
 
-	a.mu.RLock()
-	defer a.mu.RUnlock()
+	s := a.shards[hash%uint64(len(a.shards))]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	m := a.active
+	// Transactions are recorded with m.mu held for reading, to prevent
+	// groups from being evicted and reused concurrently.
+	m := s.active
 	m.mu.RLock()
-	entries, ok := m.m[hash]
-	m.mu.RUnlock()
-	var offset int
-	if ok {
-		for offset = range entries {
-			if entries[offset].transactionAggregationKey.equal(key) {
-				entries[offset].recordDuration(duration, count)
-				return true
-			}
-		}
-		offset++ // where to start searching with the write lock below
+	if entry := m.find(key, hash); entry != nil {
+		a.recordDuration(m, entry, duration, count)
+		m.mu.RUnlock()
+		return true, model.APMEvent{}
 	}
+	m.mu.RUnlock()
 
 	m.mu.Lock()
-	entries, ok = m.m[hash]
-	if ok {
-		for i := range entries[offset:] {
-			if entries[offset+i].transactionAggregationKey.equal(key) {
-				m.mu.Unlock()
-				entries[offset+i].recordDuration(duration, count)
-				return true
+	defer m.mu.Unlock()
+	if entry := m.find(key, hash); entry != nil {
+		a.recordDuration(m, entry, duration, count)
+		return true, model.APMEvent{}
+	}
+
+	var entry *metricsMapEntry
+	var evicted model.APMEvent
+	withinBudget := m.withinBudget(a.groupBytes(&key))
+	if m.entries < m.limit && withinBudget {
+		entry = &m.space[m.entries]
+		m.entries++
+	} else {
+		if !withinBudget {
+			// Publish early to release memory, rather than
+			// waiting for MetricsInterval to elapse.
+			atomic.AddInt64(&a.metrics.memoryLimitReached, 1)
+			a.signalFlush()
+		}
+		victim, redirect := a.eviction.evict(m, key)
+		switch {
+		case victim != nil:
+			totalCount, counts, values := victim.histogramBuckets()
+			evicted = makeMetricset(victim.transactionAggregationKey, victim.hash, totalCount, counts, values)
+			m.remove(victim)
+			m.bytes -= a.groupBytes(&victim.transactionAggregationKey)
+			entry = victim
+		case redirect != nil:
+			key, hash = *redirect, redirect.hash()
+			if entry := m.find(key, hash); entry != nil {
+				a.recordDuration(m, entry, duration, count)
+				return true, model.APMEvent{}
 			}
+			if m.entries >= len(m.space) {
+				return false, model.APMEvent{}
+			}
+			entry = &m.space[m.entries]
+			m.entries++
+		default:
+			return false, model.APMEvent{}
 		}
-	} else if m.entries >= len(m.space) {
-		m.mu.Unlock()
-		return false
 	}
-	entry := &m.space[m.entries]
+
 	entry.transactionAggregationKey = key
+	entry.hash = hash
+	entry.lastRecorded = 0
+	entry.recordCount = 0
 	if entry.transactionMetrics.histogram == nil {
-		entry.transactionMetrics.histogram = hdrhistogram.New(
-			minDuration.Microseconds(),
-			maxDuration.Microseconds(),
-			a.config.HDRHistogramSignificantFigures,
-		)
+		entry.transactionMetrics.histogram = newHistogram(a.config.HDRHistogramSignificantFigures)
 	} else {
 		entry.transactionMetrics.histogram.Reset()
 	}
+	a.recordDuration(m, entry, duration, count)
+	m.m[hash] = append(m.m[hash], entry)
+	m.bytes += a.groupBytes(&key)
+	if s.flushThreshold > 0 && m.entries >= s.flushThreshold {
+		a.signalFlush()
+	}
+	return true, evicted
+}
+
+// signalFlush signals Run to publish, without blocking if it has already
+// been signalled.
+func (a *Aggregator) signalFlush() {
+	select {
+	case a.flush <- struct{}{}:
+	default:
+	}
+}
+
+// groupBytes returns the estimated memory used by the transaction group
+// identified by key.
+func (a *Aggregator) groupBytes(key *transactionAggregationKey) int {
+	return metricsMapEntryBytes + a.histogramBytes + key.variableBytes()
+}
+
+func newHistogram(significantFigures int) *hdrhistogram.Histogram {
+	return hdrhistogram.New(
+		minDuration.Microseconds(),
+		maxDuration.Microseconds(),
+		significantFigures,
+	)
+}
+
+// recordDuration records a transaction in entry, and informs the eviction
+// strategy. recordDuration must be called with m.mu held.
+func (a *Aggregator) recordDuration(m *metrics, entry *metricsMapEntry, duration time.Duration, count float64) {
 	entry.recordDuration(duration, count)
-	m.m[hash] = append(entries, entry)
-	m.entries++
-	m.mu.Unlock()
-	return true
+	a.eviction.recorded(m, entry)
 }
 
 func (a *Aggregator) makeTransactionAggregationKey(event model.APMEvent, interval time.Duration) transactionAggregationKey {
 	key := transactionAggregationKey{
 		comparable: comparable{
 			// Group metrics by time interval.
-			timestamp: event.Timestamp.Truncate(interval),
+			timestamp: alignTimestamp(event.Timestamp, interval, a.config.TimestampAlignment),
 
 			traceRoot:         event.Parent.ID == "",
 			transactionName:   event.Transaction.Name,
@@ -417,6 +831,16 @@ func (a *Aggregator) makeTransactionAggregationKey(event model.APMEvent, interva
 	return key
 }
 
+// alignTimestamp returns the start of the interval containing ts, or the end
+// of the interval if alignment is "end".
+func alignTimestamp(ts time.Time, interval time.Duration, alignment string) time.Time {
+	ts = ts.Truncate(interval)
+	if alignment == "end" {
+		ts = ts.Add(interval)
+	}
+	return ts
+}
+
 // makeMetricset makes a metricset event from key, counts, and values, with timestamp ts.
 func makeMetricset(
 	key transactionAggregationKey, hash uint64, totalCount int64, counts []int64, values []float64,
@@ -500,22 +924,83 @@ func makeMetricset(
 type metrics struct {
 	mu      sync.RWMutex
 	entries int
+	limit   int
 	m       map[uint64][]*metricsMapEntry
 	space   []metricsMapEntry
+
+	// bytes holds the estimated memory used by the groups, and
+	// maxBytes the memory budget for the groups, if greater than zero.
+	bytes    int
+	maxBytes int
+
+	// clock is incremented each time a transaction is recorded,
+	// for ordering groups by recency of use.
+	clock int64
 }
 
-func newMetrics(maxGroups int) *metrics {
+// newMetrics returns a new metrics which can hold maxGroups groups, and
+// an additional number of groups reserved for use by the eviction strategy,
+// within a memory budget of maxBytes if greater than zero.
+func newMetrics(maxGroups, reserved, maxBytes int) *metrics {
 	return &metrics{
-		m:     make(map[uint64][]*metricsMapEntry),
-		space: make([]metricsMapEntry, maxGroups),
+		m:        make(map[uint64][]*metricsMapEntry),
+		limit:    maxGroups,
+		space:    make([]metricsMapEntry, maxGroups+reserved),
+		maxBytes: maxBytes,
+	}
+}
+
+// withinBudget reports whether a new group, estimated to use the given
+// number of bytes, fits within the memory budget. withinBudget must be
+// called with m.mu held.
+func (m *metrics) withinBudget(bytes int) bool {
+	return m.maxBytes <= 0 || m.bytes+bytes <= m.maxBytes
+}
+
+// find returns the entry for the group identified by key and hash, or nil
+// if there is no such group. find must be called with m.mu held.
+func (m *metrics) find(key transactionAggregationKey, hash uint64) *metricsMapEntry {
+	for _, entry := range m.m[hash] {
+		if entry.transactionAggregationKey.equal(key) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// remove removes entry from the map, without releasing its space.
+// remove must be called with m.mu held for writing.
+func (m *metrics) remove(entry *metricsMapEntry) {
+	entries := m.m[entry.hash]
+	for i, e := range entries {
+		if e == entry {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(m.m, entry.hash)
+	} else {
+		m.m[entry.hash] = entries
 	}
 }
 
 type metricsMapEntry struct {
 	transactionMetrics
 	transactionAggregationKey
+	hash uint64
+
+	// lastRecorded and recordCount are updated atomically by
+	// eviction strategies which require them.
+	lastRecorded int64
+	recordCount  int64
 }
 
+// metricsMapEntryBytes is the estimated memory used by each group, excluding
+// its histogram and the variable-length fields of its key: the entry, and
+// its pointer in the metrics map.
+const metricsMapEntryBytes = int(unsafe.Sizeof(metricsMapEntry{}) + unsafe.Sizeof(&metricsMapEntry{}))
+
 // comparable contains the fields with types which can be compared with the
 // equal operator '=='.
 type comparable struct {
@@ -611,6 +1096,32 @@ func (k *transactionAggregationKey) hash() uint64 {
 	return h.Sum64()
 }
 
+// variableBytes returns the estimated memory used by the variable-length
+// fields of k: its strings and labels.
+func (k *transactionAggregationKey) variableBytes() int {
+	n := len(k.faasID) + len(k.faasName) + len(k.faasVersion) + len(k.faasTriggerType) +
+		len(k.agentName) + len(k.hostOSPlatform) + len(k.hostHostname) + len(k.hostName) +
+		len(k.kubernetesPodName) + len(k.containerID) +
+		len(k.cloudProvider) + len(k.cloudRegion) + len(k.cloudAvailabilityZone) +
+		len(k.cloudServiceName) + len(k.cloudAccountID) + len(k.cloudAccountName) +
+		len(k.cloudMachineType) + len(k.cloudProjectID) + len(k.cloudProjectName) +
+		len(k.serviceEnvironment) + len(k.serviceName) + len(k.serviceVersion) +
+		len(k.serviceNodeName) + len(k.serviceRuntimeName) + len(k.serviceRuntimeVersion) +
+		len(k.serviceLanguageName) + len(k.serviceLanguageVersion) +
+		len(k.transactionName) + len(k.transactionResult) + len(k.transactionType) +
+		len(k.eventOutcome)
+	for key, label := range k.labels {
+		n += len(key) + len(label.Value) + int(unsafe.Sizeof(label))
+		for _, v := range label.Values {
+			n += len(v) + int(unsafe.Sizeof(v))
+		}
+	}
+	for key, label := range k.numericLabels {
+		n += len(key) + int(unsafe.Sizeof(label)) + 8*len(label.Values)
+	}
+	return n
+}
+
 func (k *transactionAggregationKey) equal(key transactionAggregationKey) bool {
 	return k.comparable == key.comparable &&
 		equalLabels(k.labels, key.labels) &&
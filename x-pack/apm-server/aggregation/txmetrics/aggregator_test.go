@@ -7,6 +7,7 @@ package txmetrics_test
 import (
 	"context"
 	"fmt"
+	"math"
 	"sort"
 	"testing"
 	"time"
@@ -54,6 +55,60 @@ func TestNewAggregatorConfigInvalid(t *testing.T) {
 			HDRHistogramSignificantFigures: 6,
 		},
 		err: "HDRHistogramSignificantFigures (6) outside range [1,5]",
+	}, {
+		config: txmetrics.AggregatorConfig{
+			BatchProcessor:                 batchProcessor,
+			MaxTransactionGroups:           1,
+			MetricsInterval:                time.Nanosecond,
+			HDRHistogramSignificantFigures: 1,
+			EvictionPolicy:                 "random",
+		},
+		err: `unknown EvictionPolicy "random"`,
+	}, {
+		config: txmetrics.AggregatorConfig{
+			BatchProcessor:                 batchProcessor,
+			MaxTransactionGroups:           1,
+			MetricsInterval:                time.Nanosecond,
+			HDRHistogramSignificantFigures: 1,
+			FlushThreshold:                 2,
+		},
+		err: "FlushThreshold out of range [0,MaxTransactionGroups]",
+	}, {
+		config: txmetrics.AggregatorConfig{
+			BatchProcessor:                 batchProcessor,
+			MaxTransactionGroups:           1,
+			MetricsInterval:                time.Nanosecond,
+			HDRHistogramSignificantFigures: 1,
+			Shards:                         2,
+		},
+		err: "Shards out of range [0,MaxTransactionGroups]",
+	}, {
+		config: txmetrics.AggregatorConfig{
+			BatchProcessor:                 batchProcessor,
+			MaxTransactionGroups:           1,
+			MetricsInterval:                time.Nanosecond,
+			HDRHistogramSignificantFigures: 1,
+			TimestampAlignment:             "middle",
+		},
+		err: `TimestampAlignment "middle" unsupported`,
+	}, {
+		config: txmetrics.AggregatorConfig{
+			BatchProcessor:                 batchProcessor,
+			MaxTransactionGroups:           1,
+			MetricsInterval:                time.Nanosecond,
+			HDRHistogramSignificantFigures: 1,
+			MaxMemoryBytes:                 -1,
+		},
+		err: "MaxMemoryBytes negative",
+	}, {
+		config: txmetrics.AggregatorConfig{
+			BatchProcessor:                 batchProcessor,
+			MaxTransactionGroups:           1,
+			MetricsInterval:                time.Minute,
+			HDRHistogramSignificantFigures: 1,
+			RollupInterval:                 90 * time.Second,
+		},
+		err: "RollupInterval must be a multiple of MetricsInterval",
 	}} {
 		agg, err := txmetrics.NewAggregator(test.config)
 		require.Error(t, err)
@@ -147,6 +202,102 @@ func TestProcessTransformablesOverflow(t *testing.T) {
 	assert.Equal(t, 1, overflowLogEntries.Len()) // rate limited
 }
 
+func TestEvictionPolicy(t *testing.T) {
+	type test struct {
+		policy txmetrics.EvictionPolicy
+
+		// immediate holds the names of transactions for which metricsets
+		// are expected to be published immediately.
+		immediate []string
+
+		// published holds the names of transactions for which metricsets
+		// are expected to be published at the end of the interval.
+		published []string
+
+		expectedMonitoring map[string]int64
+	}
+
+	for _, test := range []test{{
+		policy:    txmetrics.EvictionPolicyPublishIndividual,
+		immediate: []string{"baz"},
+		published: []string{"bar", "foo"},
+		expectedMonitoring: map[string]int64{
+			"txmetrics.active_groups": 2,
+			"txmetrics.overflowed":    1,
+		},
+	}, {
+		policy:    txmetrics.EvictionPolicyLRU,
+		immediate: []string{"foo"},
+		published: []string{"bar", "baz"},
+		expectedMonitoring: map[string]int64{
+			"txmetrics.active_groups": 2,
+			"txmetrics.overflowed":    0,
+			"txmetrics.evicted.lru":   1,
+		},
+	}, {
+		policy:    txmetrics.EvictionPolicyLFU,
+		immediate: []string{"bar"},
+		published: []string{"baz", "foo"},
+		expectedMonitoring: map[string]int64{
+			"txmetrics.active_groups": 2,
+			"txmetrics.overflowed":    0,
+			"txmetrics.evicted.lfu":   1,
+		},
+	}, {
+		policy:    txmetrics.EvictionPolicyOverflowBucket,
+		published: []string{"_other", "bar", "foo"},
+		expectedMonitoring: map[string]int64{
+			"txmetrics.active_groups":           3,
+			"txmetrics.overflowed":              0,
+			"txmetrics.evicted.overflow_bucket": 1,
+		},
+	}} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			batches := make(chan model.Batch, 1)
+			agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+				BatchProcessor:                 makeChanBatchProcessor(batches),
+				MaxTransactionGroups:           2,
+				MetricsInterval:                time.Hour,
+				HDRHistogramSignificantFigures: 1,
+				EvictionPolicy:                 test.policy,
+			})
+			require.NoError(t, err)
+
+			// "foo" is recorded most frequently, but "bar" most recently.
+			var batch model.Batch
+			for _, name := range []string{"foo", "foo", "foo", "bar", "baz"} {
+				batch = append(batch, model.APMEvent{
+					Processor:   model.TransactionProcessor,
+					Transaction: &model.Transaction{Name: name, RepresentativeCount: 1},
+				})
+			}
+			require.NoError(t, agg.ProcessBatch(context.Background(), &batch))
+			assert.ElementsMatch(t, test.immediate, metricsetTransactionNames(batchMetricsets(t, batch)))
+
+			expectedMonitoring := monitoring.MakeFlatSnapshot()
+			for k, v := range test.expectedMonitoring {
+				expectedMonitoring.Ints[k] = v
+			}
+			registry := monitoring.NewRegistry()
+			monitoring.NewFunc(registry, "txmetrics", agg.CollectMonitoring)
+			assert.Equal(t, expectedMonitoring, monitoring.CollectFlatSnapshot(registry, monitoring.Full, false))
+
+			go agg.Run()
+			require.NoError(t, agg.Stop(context.Background()))
+			published := batchMetricsets(t, expectBatch(t, batches))
+			assert.ElementsMatch(t, test.published, metricsetTransactionNames(published))
+		})
+	}
+}
+
+func metricsetTransactionNames(metricsets []model.APMEvent) []string {
+	var names []string
+	for _, m := range metricsets {
+		names = append(names, m.Transaction.Name)
+	}
+	return names
+}
+
 func TestAggregatorRun(t *testing.T) {
 	batches := make(chan model.Batch, 1)
 	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
@@ -220,6 +371,253 @@ func TestAggregatorRun(t *testing.T) {
 	}
 }
 
+func TestAggregatorRunFlushThreshold(t *testing.T) {
+	batches := make(chan model.Batch, 1)
+	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+		BatchProcessor:                 makeChanBatchProcessor(batches),
+		MaxTransactionGroups:           10,
+		MetricsInterval:                time.Hour,
+		HDRHistogramSignificantFigures: 1,
+		FlushThreshold:                 2,
+	})
+	require.NoError(t, err)
+	go agg.Run()
+	defer agg.Stop(context.Background())
+
+	for _, name := range []string{"T-1", "T-1", "T-2"} {
+		metricset := agg.AggregateTransaction(model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Transaction: &model.Transaction{
+				Name:                name,
+				RepresentativeCount: 1,
+			},
+		})
+		require.Zero(t, metricset)
+	}
+
+	// Metrics should be published once the threshold is reached,
+	// well before the interval elapses.
+	batch := expectBatch(t, batches)
+	metricsets := batchMetricsets(t, batch)
+	require.Len(t, metricsets, 2)
+	sort.Slice(metricsets, func(i, j int) bool {
+		return metricsets[i].Transaction.Name < metricsets[j].Transaction.Name
+	})
+	assert.Equal(t, "T-1", metricsets[0].Transaction.Name)
+	assert.Equal(t, []int64{2}, metricsets[0].Transaction.DurationHistogram.Counts)
+	assert.Equal(t, "T-2", metricsets[1].Transaction.Name)
+	assert.Equal(t, []int64{1}, metricsets[1].Transaction.DurationHistogram.Counts)
+
+	select {
+	case <-batches:
+		t.Fatal("unexpected publish")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	batches := make(chan model.Batch, 1)
+	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+		BatchProcessor:                 makeChanBatchProcessor(batches),
+		MaxTransactionGroups:           10,
+		MetricsInterval:                time.Hour,
+		HDRHistogramSignificantFigures: 1,
+	})
+	require.NoError(t, err)
+	go agg.Run()
+
+	for _, name := range []string{"T-1", "T-1", "T-2"} {
+		metricset := agg.AggregateTransaction(model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Transaction: &model.Transaction{
+				Name:                name,
+				RepresentativeCount: 1,
+			},
+		})
+		require.Zero(t, metricset)
+	}
+
+	// Metrics are published immediately, well before the interval elapses.
+	groups, err := agg.Flush(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, groups)
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
+	assert.Len(t, metricsets, 2)
+
+	// Flushing with no aggregated metrics publishes nothing.
+	groups, err = agg.Flush(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, groups)
+
+	require.NoError(t, agg.Stop(context.Background()))
+	_, err = agg.Flush(context.Background())
+	assert.EqualError(t, err, "aggregator stopped")
+}
+
+func TestAggregatorFlushContextCancelled(t *testing.T) {
+	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+		BatchProcessor:                 makeChanBatchProcessor(make(chan model.Batch)),
+		MaxTransactionGroups:           10,
+		MetricsInterval:                time.Hour,
+		HDRHistogramSignificantFigures: 1,
+	})
+	require.NoError(t, err)
+
+	// Run has not been called, so the flush is never handled.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = agg.Flush(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestAggregatorMaxMemoryBytes(t *testing.T) {
+	newAggregator := func(maxMemoryBytes int, batches chan model.Batch) *txmetrics.Aggregator {
+		agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+			BatchProcessor:                 makeChanBatchProcessor(batches),
+			MaxTransactionGroups:           10,
+			MetricsInterval:                time.Hour,
+			HDRHistogramSignificantFigures: 1,
+			MaxMemoryBytes:                 maxMemoryBytes,
+		})
+		require.NoError(t, err)
+		return agg
+	}
+	collectMonitoring := func(agg *txmetrics.Aggregator) monitoring.FlatSnapshot {
+		registry := monitoring.NewRegistry()
+		monitoring.NewFunc(registry, "txmetrics", agg.CollectMonitoring)
+		return monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	}
+	aggregate := func(agg *txmetrics.Aggregator, name string) model.APMEvent {
+		return agg.AggregateTransaction(model.APMEvent{
+			Processor:   model.TransactionProcessor,
+			Transaction: &model.Transaction{Name: name, RepresentativeCount: 1},
+		})
+	}
+
+	// Measure the estimated memory used by a single group, and then
+	// limit memory to that, so only one group of the same size fits.
+	agg := newAggregator(math.MaxInt32, make(chan model.Batch, 1))
+	require.Zero(t, aggregate(agg, "T-1"))
+	groupBytes := collectMonitoring(agg).Ints["txmetrics.memory.estimated_bytes"]
+	require.NotZero(t, groupBytes)
+
+	batches := make(chan model.Batch, 1)
+	agg = newAggregator(int(groupBytes), batches)
+	require.Zero(t, aggregate(agg, "T-1"))
+	require.Zero(t, aggregate(agg, "T-1"))
+
+	// The budget is reached, so the new group's metrics are published
+	// individually, and the aggregated metrics are published early.
+	metricset := aggregate(agg, "T-2")
+	require.NotNil(t, metricset.Metricset)
+	assert.Equal(t, "T-2", metricset.Transaction.Name)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["txmetrics.active_groups"] = 1
+	expectedMonitoring.Ints["txmetrics.overflowed"] = 1
+	expectedMonitoring.Ints["txmetrics.memory.estimated_bytes"] = groupBytes
+	expectedMonitoring.Ints["txmetrics.memory.limit_reached"] = 1
+	assert.Equal(t, expectedMonitoring, collectMonitoring(agg))
+
+	go agg.Run()
+	defer agg.Stop(context.Background())
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
+	require.Len(t, metricsets, 1)
+	assert.Equal(t, "T-1", metricsets[0].Transaction.Name)
+	assert.Equal(t, []int64{2}, metricsets[0].Transaction.DurationHistogram.Counts)
+}
+
+func TestAggregatorShards(t *testing.T) {
+	batches := make(chan model.Batch, 1)
+	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+		BatchProcessor:                 makeChanBatchProcessor(batches),
+		MaxTransactionGroups:           100,
+		MetricsInterval:                time.Hour,
+		HDRHistogramSignificantFigures: 1,
+		Shards:                         4,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		for j := 0; j <= i%3; j++ {
+			metricset := agg.AggregateTransaction(model.APMEvent{
+				Processor: model.TransactionProcessor,
+				Transaction: &model.Transaction{
+					Name:                fmt.Sprintf("T-%d", i),
+					RepresentativeCount: 1,
+				},
+			})
+			require.Zero(t, metricset)
+		}
+	}
+
+	registry := monitoring.NewRegistry()
+	monitoring.NewFunc(registry, "txmetrics", agg.CollectMonitoring)
+	snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, int64(50), snapshot.Ints["txmetrics.active_groups"])
+
+	go agg.Run()
+	require.NoError(t, agg.Stop(context.Background()))
+
+	// Groups from all shards should be published together.
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
+	require.Len(t, metricsets, 50)
+	for _, m := range metricsets {
+		var i int
+		_, err := fmt.Sscanf(m.Transaction.Name, "T-%d", &i)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{int64(i%3 + 1)}, m.Transaction.DurationHistogram.Counts)
+	}
+}
+
+func TestAggregatorShardsOverflowBucket(t *testing.T) {
+	batches := make(chan model.Batch, 1)
+	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+		BatchProcessor:                 makeChanBatchProcessor(batches),
+		MaxTransactionGroups:           4,
+		MetricsInterval:                time.Hour,
+		HDRHistogramSignificantFigures: 1,
+		EvictionPolicy:                 txmetrics.EvictionPolicyOverflowBucket,
+		Shards:                         4,
+	})
+	require.NoError(t, err)
+
+	// Each shard holds one group, so most of the transactions are recorded
+	// in the overflow group of whichever shard their group is assigned to.
+	// The overflow groups of all shards should be merged when published.
+	const n = 100
+	for i := 0; i < n; i++ {
+		metricset := agg.AggregateTransaction(model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Transaction: &model.Transaction{
+				Name:                fmt.Sprintf("T-%d", i),
+				RepresentativeCount: 1,
+			},
+		})
+		require.Zero(t, metricset)
+	}
+
+	go agg.Run()
+	require.NoError(t, agg.Stop(context.Background()))
+
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
+	require.Len(t, metricsets, 5) // 4 groups + 1 merged overflow group
+	var overflowGroups int
+	var overflowed, total int64
+	for _, m := range metricsets {
+		require.Len(t, m.Transaction.DurationHistogram.Counts, 1)
+		count := m.Transaction.DurationHistogram.Counts[0]
+		if m.Transaction.Name == "_other" {
+			overflowGroups++
+			overflowed += count
+		}
+		total += count
+	}
+	assert.Equal(t, 1, overflowGroups)
+	assert.Equal(t, int64(n-4), overflowed)
+	assert.Equal(t, int64(n), total)
+}
+
 func TestAggregatorRunPublishErrors(t *testing.T) {
 	batches := make(chan model.Batch, 1)
 	chanBatchProcessor := makeChanBatchProcessor(batches)
@@ -363,36 +761,135 @@ func TestAggregateRepresentativeCount(t *testing.T) {
 }
 
 func TestAggregateTimestamp(t *testing.T) {
+	for alignment, offset := range map[string]time.Duration{
+		"":      0,
+		"start": 0,
+		"end":   30 * time.Second,
+	} {
+		t.Run(fmt.Sprintf("TimestampAlignment=%q", alignment), func(t *testing.T) {
+			batches := make(chan model.Batch, 1)
+			agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+				BatchProcessor:                 makeChanBatchProcessor(batches),
+				MaxTransactionGroups:           2,
+				MetricsInterval:                30 * time.Second,
+				HDRHistogramSignificantFigures: 1,
+				TimestampAlignment:             alignment,
+			})
+			require.NoError(t, err)
+
+			t0 := time.Unix(0, 0)
+			for _, ts := range []time.Time{t0, t0.Add(15 * time.Second), t0.Add(30 * time.Second)} {
+				agg.AggregateTransaction(model.APMEvent{
+					Timestamp:   ts,
+					Processor:   model.TransactionProcessor,
+					Transaction: &model.Transaction{Name: "name", RepresentativeCount: 1},
+				})
+			}
+
+			go agg.Run()
+			err = agg.Stop(context.Background()) // stop to flush
+			require.NoError(t, err)
+
+			batch := expectBatch(t, batches)
+			metricsets := batchMetricsets(t, batch)
+			require.Len(t, metricsets, 2)
+			sort.Slice(metricsets, func(i, j int) bool {
+				return metricsets[i].Timestamp.Before(metricsets[j].Timestamp)
+			})
+			assert.Equal(t, t0.Add(offset), metricsets[0].Timestamp)
+			assert.Equal(t, t0.Add(30*time.Second+offset), metricsets[1].Timestamp)
+		})
+	}
+}
+
+func TestAggregatorRollup(t *testing.T) {
+	for alignment, offset := range map[string]time.Duration{
+		"start": 0,
+		"end":   time.Hour,
+	} {
+		t.Run(fmt.Sprintf("TimestampAlignment=%q", alignment), func(t *testing.T) {
+			batches := make(chan model.Batch, 2)
+			agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+				BatchProcessor:                 makeChanBatchProcessor(batches),
+				MaxTransactionGroups:           10,
+				MetricsInterval:                30 * time.Second,
+				HDRHistogramSignificantFigures: 1,
+				TimestampAlignment:             alignment,
+				RollupInterval:                 time.Hour,
+			})
+			require.NoError(t, err)
+
+			t0 := time.Unix(0, 0)
+			for _, ts := range []time.Time{
+				t0, t0.Add(15 * time.Second), t0.Add(59 * time.Minute), t0.Add(time.Hour),
+			} {
+				agg.AggregateTransaction(model.APMEvent{
+					Timestamp:   ts,
+					Processor:   model.TransactionProcessor,
+					Event:       model.Event{Duration: time.Millisecond},
+					Transaction: &model.Transaction{Name: "name", RepresentativeCount: 1},
+				})
+			}
+
+			go agg.Run()
+			err = agg.Stop(context.Background()) // stop to flush
+			require.NoError(t, err)
+
+			metricsets := batchMetricsets(t, expectBatch(t, batches))
+			require.Len(t, metricsets, 3)
+			for _, ms := range metricsets {
+				assert.Equal(t, 30*time.Second, ms.Metricset.Interval)
+			}
+
+			// The metrics for the first two intervals should be rolled
+			// up together, as they are in the same hour.
+			metricsets = batchMetricsets(t, expectBatch(t, batches))
+			require.Len(t, metricsets, 2)
+			sort.Slice(metricsets, func(i, j int) bool {
+				return metricsets[i].Timestamp.Before(metricsets[j].Timestamp)
+			})
+			assert.Equal(t, t0.Add(offset), metricsets[0].Timestamp)
+			assert.Equal(t, time.Hour, metricsets[0].Metricset.Interval)
+			assert.Equal(t, int64(3), metricsets[0].Metricset.DocCount)
+			assert.Equal(t, []int64{3}, metricsets[0].Transaction.DurationHistogram.Counts)
+			assert.Equal(t, t0.Add(time.Hour+offset), metricsets[1].Timestamp)
+			assert.Equal(t, time.Hour, metricsets[1].Metricset.Interval)
+			assert.Equal(t, int64(1), metricsets[1].Metricset.DocCount)
+		})
+	}
+}
+
+func TestAggregatorRollupMaxGroups(t *testing.T) {
 	batches := make(chan model.Batch, 1)
 	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
 		BatchProcessor:                 makeChanBatchProcessor(batches),
 		MaxTransactionGroups:           2,
-		MetricsInterval:                30 * time.Second,
+		MetricsInterval:                time.Hour,
 		HDRHistogramSignificantFigures: 1,
+		FlushThreshold:                 2,
+		RollupInterval:                 24 * time.Hour,
 	})
 	require.NoError(t, err)
+	go agg.Run()
+	defer agg.Stop(context.Background())
 
-	t0 := time.Unix(0, 0)
-	for _, ts := range []time.Time{t0, t0.Add(15 * time.Second), t0.Add(30 * time.Second)} {
-		agg.AggregateTransaction(model.APMEvent{
-			Timestamp:   ts,
+	for _, name := range []string{"T-1", "T-2"} {
+		metricset := agg.AggregateTransaction(model.APMEvent{
 			Processor:   model.TransactionProcessor,
-			Transaction: &model.Transaction{Name: "name", RepresentativeCount: 1},
+			Transaction: &model.Transaction{Name: name, RepresentativeCount: 1},
 		})
+		require.Zero(t, metricset)
 	}
 
-	go agg.Run()
-	err = agg.Stop(context.Background()) // stop to flush
-	require.NoError(t, err)
-
-	batch := expectBatch(t, batches)
-	metricsets := batchMetricsets(t, batch)
+	// The rolled up metrics should be published once the number of
+	// rolled up groups reaches MaxTransactionGroups, well before the
+	// rollup interval elapses.
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
 	require.Len(t, metricsets, 2)
-	sort.Slice(metricsets, func(i, j int) bool {
-		return metricsets[i].Timestamp.Before(metricsets[j].Timestamp)
-	})
-	assert.Equal(t, t0, metricsets[0].Timestamp)
-	assert.Equal(t, t0.Add(30*time.Second), metricsets[1].Timestamp)
+	assert.Equal(t, time.Hour, metricsets[0].Metricset.Interval)
+	metricsets = batchMetricsets(t, expectBatch(t, batches))
+	require.Len(t, metricsets, 2)
+	assert.Equal(t, 24*time.Hour, metricsets[0].Metricset.Interval)
 }
 
 func TestHDRHistogramSignificantFigures(t *testing.T) {
@@ -569,6 +1066,48 @@ func TestAggregationFields(t *testing.T) {
 	assert.ElementsMatch(t, expected, metricsets)
 }
 
+func BenchmarkAggregateTransactionShards(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkAggregateTransactionShards(b, shards)
+		})
+	}
+}
+
+// benchmarkAggregateTransactionShards benchmarks aggregating transactions
+// for a high number of distinct transaction groups.
+func benchmarkAggregateTransactionShards(b *testing.B, shards int) {
+	const groups = 10000
+	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+		BatchProcessor:                 makeErrBatchProcessor(nil),
+		MaxTransactionGroups:           groups,
+		MetricsInterval:                time.Minute,
+		HDRHistogramSignificantFigures: 2,
+		Shards:                         shards,
+	})
+	require.NoError(b, err)
+
+	events := make([]model.APMEvent, groups)
+	for i := range events {
+		events[i] = model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Event:     model.Event{Duration: time.Millisecond},
+			Transaction: &model.Transaction{
+				Name:                fmt.Sprintf("T-%d", i),
+				RepresentativeCount: 1,
+			},
+		}
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			agg.AggregateTransaction(events[i%groups])
+			i++
+		}
+	})
+}
+
 func BenchmarkAggregateTransaction(b *testing.B) {
 	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
 		BatchProcessor:                 makeErrBatchProcessor(nil),
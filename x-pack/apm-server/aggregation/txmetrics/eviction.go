@@ -0,0 +1,209 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package txmetrics
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// overflowBucketName is the service and transaction name recorded for
+// the overflow bucket group, used by EvictionPolicyOverflowBucket.
+const overflowBucketName = "_other"
+
+// EvictionPolicy identifies how the aggregator handles transactions which
+// would create a new transaction group once MaxTransactionGroups has been
+// reached.
+type EvictionPolicy string
+
+const (
+	// EvictionPolicyPublishIndividual evicts no groups. Transactions which
+	// would create a new group are immediately published as individual
+	// metrics documents. This is the default eviction policy.
+	EvictionPolicyPublishIndividual EvictionPolicy = "publish_individual"
+
+	// EvictionPolicyLRU evicts the least recently updated group, making
+	// room for the new group. The evicted group's metrics are immediately
+	// published.
+	EvictionPolicyLRU EvictionPolicy = "lru"
+
+	// EvictionPolicyLFU evicts the least frequently updated group, making
+	// room for the new group. The evicted group's metrics are immediately
+	// published.
+	EvictionPolicyLFU EvictionPolicy = "lfu"
+
+	// EvictionPolicyOverflowBucket evicts no groups. Transactions which
+	// would create a new group are instead aggregated into a single
+	// overflow group, with service and transaction names of "_other".
+	EvictionPolicyOverflowBucket EvictionPolicy = "overflow_bucket"
+)
+
+// evictionStrategy implements an EvictionPolicy.
+type evictionStrategy interface {
+	// policy returns the EvictionPolicy implemented by the strategy.
+	policy() EvictionPolicy
+
+	// reserved returns the number of groups to reserve in addition to
+	// MaxTransactionGroups, for use by the strategy.
+	reserved() int
+
+	// recorded is called with m.mu held for reading or writing, whenever
+	// a transaction is recorded in entry.
+	recorded(m *metrics, entry *metricsMapEntry)
+
+	// evict is called with m.mu held for writing when a new group for key
+	// cannot be created because m is full. evict may return an entry to
+	// evict from m, whose space will be reused for the new group, or the
+	// key of an alternative group to record the transaction in. If evict
+	// returns neither, the transaction will be published individually.
+	evict(m *metrics, key transactionAggregationKey) (*metricsMapEntry, *transactionAggregationKey)
+
+	// evictions returns the number of evictions, or redirections into
+	// an alternative group, performed by the strategy.
+	evictions() int64
+}
+
+// newEvictionStrategy returns a new evictionStrategy for policy, which must
+// have been validated.
+func newEvictionStrategy(policy EvictionPolicy) evictionStrategy {
+	switch policy {
+	case EvictionPolicyLRU:
+		return &lruEvictionStrategy{}
+	case EvictionPolicyLFU:
+		return &lfuEvictionStrategy{}
+	case EvictionPolicyOverflowBucket:
+		return &overflowBucketEvictionStrategy{}
+	}
+	return &publishIndividualEvictionStrategy{}
+}
+
+func validateEvictionPolicy(policy EvictionPolicy) error {
+	switch policy {
+	case "", EvictionPolicyPublishIndividual, EvictionPolicyLRU, EvictionPolicyLFU, EvictionPolicyOverflowBucket:
+		return nil
+	}
+	return errors.Errorf("unknown EvictionPolicy %q", policy)
+}
+
+// evictionCounter counts evictions performed by an evictionStrategy.
+type evictionCounter struct {
+	count int64
+}
+
+func (c *evictionCounter) evictions() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+func (c *evictionCounter) inc() {
+	atomic.AddInt64(&c.count, 1)
+}
+
+type publishIndividualEvictionStrategy struct {
+	evictionCounter
+}
+
+func (*publishIndividualEvictionStrategy) policy() EvictionPolicy {
+	return EvictionPolicyPublishIndividual
+}
+
+func (*publishIndividualEvictionStrategy) reserved() int {
+	return 0
+}
+
+func (*publishIndividualEvictionStrategy) recorded(*metrics, *metricsMapEntry) {}
+
+// evict evicts nothing. Transactions published individually are
+// counted by the aggregator as "overflowed".
+func (*publishIndividualEvictionStrategy) evict(*metrics, transactionAggregationKey) (*metricsMapEntry, *transactionAggregationKey) {
+	return nil, nil
+}
+
+type lruEvictionStrategy struct {
+	evictionCounter
+}
+
+func (*lruEvictionStrategy) policy() EvictionPolicy {
+	return EvictionPolicyLRU
+}
+
+func (*lruEvictionStrategy) reserved() int {
+	return 0
+}
+
+func (*lruEvictionStrategy) recorded(m *metrics, entry *metricsMapEntry) {
+	atomic.StoreInt64(&entry.lastRecorded, atomic.AddInt64(&m.clock, 1))
+}
+
+func (s *lruEvictionStrategy) evict(m *metrics, _ transactionAggregationKey) (*metricsMapEntry, *transactionAggregationKey) {
+	var victim *metricsMapEntry
+	for i := range m.space[:m.entries] {
+		entry := &m.space[i]
+		if victim == nil || entry.lastRecorded < victim.lastRecorded {
+			victim = entry
+		}
+	}
+	if victim != nil {
+		s.inc()
+	}
+	return victim, nil
+}
+
+type lfuEvictionStrategy struct {
+	evictionCounter
+}
+
+func (*lfuEvictionStrategy) policy() EvictionPolicy {
+	return EvictionPolicyLFU
+}
+
+func (*lfuEvictionStrategy) reserved() int {
+	return 0
+}
+
+func (*lfuEvictionStrategy) recorded(_ *metrics, entry *metricsMapEntry) {
+	atomic.AddInt64(&entry.recordCount, 1)
+}
+
+func (s *lfuEvictionStrategy) evict(m *metrics, _ transactionAggregationKey) (*metricsMapEntry, *transactionAggregationKey) {
+	var victim *metricsMapEntry
+	for i := range m.space[:m.entries] {
+		entry := &m.space[i]
+		if victim == nil || entry.recordCount < victim.recordCount {
+			victim = entry
+		}
+	}
+	if victim != nil {
+		s.inc()
+	}
+	return victim, nil
+}
+
+type overflowBucketEvictionStrategy struct {
+	evictionCounter
+}
+
+func (*overflowBucketEvictionStrategy) policy() EvictionPolicy {
+	return EvictionPolicyOverflowBucket
+}
+
+// reserved reserves space for the overflow group.
+func (*overflowBucketEvictionStrategy) reserved() int {
+	return 1
+}
+
+func (*overflowBucketEvictionStrategy) recorded(*metrics, *metricsMapEntry) {}
+
+func (s *overflowBucketEvictionStrategy) evict(_ *metrics, key transactionAggregationKey) (*metricsMapEntry, *transactionAggregationKey) {
+	s.inc()
+	overflowKey := transactionAggregationKey{
+		comparable: comparable{
+			timestamp:       key.timestamp,
+			serviceName:     overflowBucketName,
+			transactionName: overflowBucketName,
+		},
+	}
+	return nil, &overflowKey
+}
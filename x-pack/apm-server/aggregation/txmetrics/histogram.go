@@ -0,0 +1,56 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package txmetrics
+
+import (
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// MergeHistograms returns a histogram combining the buckets of a and b,
+// which must be transaction duration histograms as published by Aggregator,
+// e.g. for the same transaction group and interval from different servers.
+//
+// Published histograms are serialized in the format expected by the
+// Elasticsearch histogram field type in HDR mode: Values holds the distinct
+// upper limits of each bucket into which transactions were recorded, in
+// microseconds and in ascending order, and Counts holds the number of
+// transactions recorded in each bucket. Aggregators configured with the
+// same HDRHistogramSignificantFigures produce identical bucket limits, so
+// merging their histograms sums the counts of matching buckets. Apart from
+// the rounding of fractional counts, this is equivalent to aggregating all
+// of their transactions in a single Aggregator. Histograms with differing
+// bucket limits may also be merged, in which case all buckets from both
+// are retained.
+//
+// Neither a nor b is modified.
+func MergeHistograms(a, b model.Histogram) model.Histogram {
+	n := len(a.Values) + len(b.Values)
+	if n == 0 {
+		return model.Histogram{}
+	}
+	merged := model.Histogram{
+		Values: make([]float64, 0, n),
+		Counts: make([]int64, 0, n),
+	}
+	var i, j int
+	for i < len(a.Values) || j < len(b.Values) {
+		switch {
+		case j == len(b.Values) || (i < len(a.Values) && a.Values[i] < b.Values[j]):
+			merged.Values = append(merged.Values, a.Values[i])
+			merged.Counts = append(merged.Counts, a.Counts[i])
+			i++
+		case i == len(a.Values) || b.Values[j] < a.Values[i]:
+			merged.Values = append(merged.Values, b.Values[j])
+			merged.Counts = append(merged.Counts, b.Counts[j])
+			j++
+		default:
+			merged.Values = append(merged.Values, a.Values[i])
+			merged.Counts = append(merged.Counts, a.Counts[i]+b.Counts[j])
+			i++
+			j++
+		}
+	}
+	return merged
+}
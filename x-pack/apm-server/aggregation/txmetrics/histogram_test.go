@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package txmetrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/aggregation/txmetrics"
+)
+
+func TestMergeHistograms(t *testing.T) {
+	a := model.Histogram{Values: []float64{1, 3, 5}, Counts: []int64{1, 2, 3}}
+	b := model.Histogram{Values: []float64{2, 3, 6}, Counts: []int64{4, 5, 6}}
+	assert.Equal(t, model.Histogram{
+		Values: []float64{1, 2, 3, 5, 6},
+		Counts: []int64{1, 4, 7, 3, 6},
+	}, txmetrics.MergeHistograms(a, b))
+	assert.Equal(t, txmetrics.MergeHistograms(a, b), txmetrics.MergeHistograms(b, a))
+
+	// Inputs are not modified.
+	assert.Equal(t, model.Histogram{Values: []float64{1, 3, 5}, Counts: []int64{1, 2, 3}}, a)
+	assert.Equal(t, model.Histogram{Values: []float64{2, 3, 6}, Counts: []int64{4, 5, 6}}, b)
+
+	assert.Equal(t, a, txmetrics.MergeHistograms(a, model.Histogram{}))
+	assert.Equal(t, b, txmetrics.MergeHistograms(model.Histogram{}, b))
+	assert.Equal(t, model.Histogram{}, txmetrics.MergeHistograms(model.Histogram{}, model.Histogram{}))
+}
+
+func TestMergeHistogramsAggregators(t *testing.T) {
+	durations1 := []time.Duration{time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond, time.Second}
+	durations2 := []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second, time.Minute}
+
+	// Merging the histograms published by two aggregators should give
+	// the same result as aggregating all transactions in one.
+	h1 := aggregateDurationHistogram(t, durations1)
+	h2 := aggregateDurationHistogram(t, durations2)
+	expected := aggregateDurationHistogram(t, append(durations1, durations2...))
+	assert.Equal(t, expected, txmetrics.MergeHistograms(h1, h2))
+}
+
+// aggregateDurationHistogram aggregates transactions with the given durations
+// in a new Aggregator, and returns the single published duration histogram.
+func aggregateDurationHistogram(t *testing.T, durations []time.Duration) model.Histogram {
+	batches := make(chan model.Batch, 1)
+	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
+		BatchProcessor:                 makeChanBatchProcessor(batches),
+		MaxTransactionGroups:           1,
+		MetricsInterval:                10 * time.Millisecond,
+		HDRHistogramSignificantFigures: 2,
+	})
+	require.NoError(t, err)
+	for _, d := range durations {
+		metricset := agg.AggregateTransaction(model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Event:     model.Event{Duration: d},
+			Transaction: &model.Transaction{
+				Name:                "T-1",
+				RepresentativeCount: 1,
+			},
+		})
+		require.Zero(t, metricset)
+	}
+	go agg.Run()
+	defer agg.Stop(context.Background())
+
+	metricsets := batchMetricsets(t, expectBatch(t, batches))
+	require.Len(t, metricsets, 1)
+	return metricsets[0].Transaction.DurationHistogram
+}
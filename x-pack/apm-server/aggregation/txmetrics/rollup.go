@@ -0,0 +1,74 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package txmetrics
+
+import (
+	"sync"
+
+	"github.com/elastic/go-hdrhistogram"
+)
+
+// rollup holds transaction groups rolled up to a coarser interval than
+// MetricsInterval, from the groups published every MetricsInterval.
+//
+// Groups are merged into the rollup when they are published, and the rollup
+// is published every RollupInterval, both by Run. The mutex protects the
+// groups from concurrent reads by CollectMonitoring.
+type rollup struct {
+	mu     sync.Mutex
+	m      map[uint64][]*rollupGroup
+	groups int
+}
+
+type rollupGroup struct {
+	transactionMetrics
+	transactionAggregationKey
+	hash uint64
+}
+
+func newRollup() *rollup {
+	return &rollup{m: make(map[uint64][]*rollupGroup)}
+}
+
+// len returns the number of rolled up groups.
+func (r *rollup) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.groups
+}
+
+// merge merges histogram into the rolled up group identified by key and
+// hash, creating the group if it does not exist.
+func (r *rollup) merge(
+	key transactionAggregationKey, hash uint64,
+	histogram *hdrhistogram.Histogram, significantFigures int,
+) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, group := range r.m[hash] {
+		if group.transactionAggregationKey.equal(key) {
+			group.histogram.Merge(histogram)
+			return
+		}
+	}
+	group := &rollupGroup{transactionAggregationKey: key, hash: hash}
+	group.histogram = newHistogram(significantFigures)
+	group.histogram.Merge(histogram)
+	r.m[hash] = append(r.m[hash], group)
+	r.groups++
+}
+
+// swap clears the rollup, returning the rolled up groups.
+func (r *rollup) swap() []*rollupGroup {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	groups := make([]*rollupGroup, 0, r.groups)
+	for _, hashGroups := range r.m {
+		groups = append(groups, hashGroups...)
+	}
+	r.m = make(map[uint64][]*rollupGroup)
+	r.groups = 0
+	return groups
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/hashicorp/go-multierror"
@@ -19,6 +20,8 @@ import (
 	"github.com/elastic/elastic-agent-libs/paths"
 
 	"github.com/elastic/apm-server/internal/beater"
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/internal/elasticsearch"
 	"github.com/elastic/apm-server/internal/model"
 	"github.com/elastic/apm-server/internal/model/modelprocessor"
 	"github.com/elastic/apm-server/x-pack/apm-server/aggregation/spanmetrics"
@@ -29,14 +32,25 @@ import (
 
 const (
 	tailSamplingStorageDir = "tail_sampling"
+
+	// defaultMonitoringRegistryPrefix is the prefix of the names of the
+	// monitoring registries used by the processors created by wrapServer.
+	defaultMonitoringRegistryPrefix = "apm-server"
 )
 
 var (
-	aggregationMonitoringRegistry = monitoring.Default.NewRegistry("apm-server.aggregation")
+	// Note: the "apm-server.sampling" registry is created in internal/model/modelprocessor.
+	// That registry will hopefully disappear in the future, when agents no longer send
+	// unsampled transactions.
+	defaultMonitoringRegistries = newMonitoringRegistries(
+		monitoring.Default,
+		monitoring.GetNamespace("state").GetRegistry(),
+		defaultMonitoringRegistryPrefix,
+	)
 
-	// Note: this registry is created in github.com/elastic/apm-server/sampling. That package
-	// will hopefully disappear in the future, when agents no longer send unsampled transactions.
-	samplingMonitoringRegistry = monitoring.Default.GetRegistry("apm-server.sampling")
+	// wrapServer wraps the server with the default processors, reporting
+	// metrics to the default monitoring registries.
+	wrapServer = newWrapServer(defaultMonitoringRegistries)
 
 	// badgerDB holds the badger database to use when tail-based sampling is configured.
 	badgerMu sync.Mutex
@@ -46,6 +60,42 @@ var (
 	storage   *eventstorage.ShardedReadWriter
 )
 
+// monitoringRegistries holds the monitoring registries to which processors
+// report metrics, and to which the startup report is reported.
+type monitoringRegistries struct {
+	// prefix holds the prefix of the registries' names.
+	prefix string
+
+	aggregation *monitoring.Registry
+	sampling    *monitoring.Registry
+	processors  *monitoring.Registry
+	state       *monitoring.Registry
+}
+
+// newMonitoringRegistries returns monitoringRegistries for registries named
+// "<prefix>.aggregation", "<prefix>.sampling", and "<prefix>.processors" under
+// root, and "<prefix>" under stateRoot, creating them if they do not already
+// exist.
+//
+// Multiple sets of processors may be run in one process, e.g. when embedding
+// the server, by using a distinct prefix for each set of processors.
+func newMonitoringRegistries(root, stateRoot *monitoring.Registry, prefix string) monitoringRegistries {
+	return monitoringRegistries{
+		prefix:      prefix,
+		aggregation: getOrCreateRegistry(root, prefix+".aggregation"),
+		sampling:    getOrCreateRegistry(root, prefix+".sampling"),
+		processors:  getOrCreateRegistry(root, prefix+".processors"),
+		state:       getOrCreateRegistry(stateRoot, prefix),
+	}
+}
+
+func getOrCreateRegistry(parent *monitoring.Registry, name string) *monitoring.Registry {
+	if registry := parent.GetRegistry(name); registry != nil {
+		return registry
+	}
+	return parent.NewRegistry(name)
+}
+
 type namedProcessor struct {
 	processor
 	name string
@@ -57,46 +107,167 @@ type processor interface {
 	Stop(context.Context) error
 }
 
+// lagReporter may optionally be implemented by a processor to report its
+// lag: how long the oldest item which it has yet to finish processing has
+// been waiting. Processors which do not implement lagReporter are assumed
+// to have no lag.
+type lagReporter interface {
+	Lag() time.Duration
+}
+
+// processorLag returns the lag reported by p, or zero if p does not
+// implement lagReporter.
+func processorLag(p processor) time.Duration {
+	if r, ok := p.(lagReporter); ok {
+		return r.Lag()
+	}
+	return 0
+}
+
+// initializer may optionally be implemented by a processor which must
+// complete its initialization, e.g. loading state from storage, before the
+// server starts accepting events. Initialized returns a channel which is
+// closed once the processor is initialized. Processors which do not
+// implement initializer are assumed to be initialized once they are run.
+type initializer interface {
+	Initialized() <-chan struct{}
+}
+
+// flusher may optionally be implemented by a processor which aggregates
+// metrics, to publish them immediately when requested through the server's
+// flush endpoint. Flush returns the number of groups published.
+type flusher interface {
+	Flush(context.Context) (int, error)
+}
+
+// newFlushAggregations returns a function which flushes each of the
+// processors implementing flusher in turn, returning the total number of
+// groups published, or nil if there are no such processors.
+func newFlushAggregations(processors []namedProcessor) func(context.Context) (int, error) {
+	var flushers []namedProcessor
+	for _, p := range processors {
+		if _, ok := p.processor.(flusher); ok {
+			flushers = append(flushers, p)
+		}
+	}
+	if len(flushers) == 0 {
+		return nil
+	}
+	return func(ctx context.Context) (int, error) {
+		var total int
+		for _, p := range flushers {
+			groups, err := p.processor.(flusher).Flush(ctx)
+			if err != nil {
+				return total, errors.Wrapf(err, "failed to flush %s", p.name)
+			}
+			total += groups
+		}
+		return total, nil
+	}
+}
+
 // newProcessors returns a list of processors which will process
 // events in sequential order, prior to the events being published.
-func newProcessors(args beater.ServerParams) ([]namedProcessor, error) {
-	processors := make([]namedProcessor, 0, 3)
+//
+// Processors registered with args.Processors are added in their registered
+// positions relative to the metrics aggregators and the tail sampler.
+func newProcessors(args beater.ServerParams, registries monitoringRegistries) ([]namedProcessor, error) {
+	processors, err := newRegisteredProcessors(args, beater.ProcessorPositionBeforeAggregation)
+	if err != nil {
+		return nil, err
+	}
+	aggregationBatchProcessor := args.AggregationBatchProcessor
+	if aggregationBatchProcessor == nil {
+		aggregationBatchProcessor = args.BatchProcessor
+	}
 	const txName = "transaction metrics aggregation"
 	args.Logger.Infof("creating %s with config: %+v", txName, args.Config.Aggregation.Transactions)
 	agg, err := txmetrics.NewAggregator(txmetrics.AggregatorConfig{
-		BatchProcessor:                 args.BatchProcessor,
+		BatchProcessor:                 aggregationBatchProcessor,
 		MaxTransactionGroups:           args.Config.Aggregation.Transactions.MaxTransactionGroups,
 		MetricsInterval:                args.Config.Aggregation.Transactions.Interval,
 		HDRHistogramSignificantFigures: args.Config.Aggregation.Transactions.HDRHistogramSignificantFigures,
+		EvictionPolicy:                 txmetrics.EvictionPolicy(args.Config.Aggregation.Transactions.EvictionPolicy),
+		FlushThreshold:                 args.Config.Aggregation.Transactions.FlushThreshold,
+		Shards:                         args.Config.Aggregation.Transactions.Shards,
+		TimestampAlignment:             args.Config.Aggregation.TimestampAlignment,
+		MaxMemoryBytes:                 args.Config.Aggregation.Transactions.MaxMemoryParsed,
+		RollupInterval:                 args.Config.Aggregation.Transactions.RollupInterval,
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "error creating %s", txName)
 	}
 	processors = append(processors, namedProcessor{name: txName, processor: agg})
-	aggregationMonitoringRegistry.Remove("txmetrics")
-	monitoring.NewFunc(aggregationMonitoringRegistry, "txmetrics", agg.CollectMonitoring, monitoring.Report)
+	registerMonitoringFunc(registries.aggregation, "txmetrics", agg.CollectMonitoring)
 
 	const spanName = "service destinations aggregation"
 	args.Logger.Infof("creating %s with config: %+v", spanName, args.Config.Aggregation.ServiceDestinations)
 	spanAggregator, err := spanmetrics.NewAggregator(spanmetrics.AggregatorConfig{
-		BatchProcessor: args.BatchProcessor,
+		BatchProcessor: aggregationBatchProcessor,
 		Interval:       args.Config.Aggregation.ServiceDestinations.Interval,
 		MaxGroups:      args.Config.Aggregation.ServiceDestinations.MaxGroups,
+		IgnoreOutcome:  !args.Config.Aggregation.ServiceDestinations.GroupByOutcome,
+		FlushThreshold: args.Config.Aggregation.ServiceDestinations.FlushThreshold,
+
+		MaxSpanNamesPerDestination: args.Config.Aggregation.ServiceDestinations.MaxSpanNamesPerDestination,
+		TimestampAlignment:         args.Config.Aggregation.TimestampAlignment,
+		MaxMemoryBytes:             args.Config.Aggregation.ServiceDestinations.MaxMemoryParsed,
+		RollupInterval:             args.Config.Aggregation.ServiceDestinations.RollupInterval,
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "error creating %s", spanName)
 	}
 	processors = append(processors, namedProcessor{name: spanName, processor: spanAggregator})
+	registerMonitoringFunc(registries.aggregation, "spanmetrics", spanAggregator.CollectMonitoring)
+
+	beforeSampling, err := newRegisteredProcessors(args, beater.ProcessorPositionBeforeSampling)
+	if err != nil {
+		return nil, err
+	}
+	processors = append(processors, beforeSampling...)
+	afterSampling, err := newRegisteredProcessors(args, beater.ProcessorPositionAfterSampling)
+	if err != nil {
+		return nil, err
+	}
 	if args.Config.Sampling.Tail.Enabled {
 		const name = "tail sampler"
-		sampler, err := newTailSamplingProcessor(args)
+		samplerArgs := args
+		if len(afterSampling) > 0 {
+			// The tail sampler publishes the events of sampled traces
+			// directly, so they must also pass through the processors
+			// positioned after it.
+			chain := make(modelprocessor.Chained, 0, len(afterSampling)+1)
+			for _, p := range afterSampling {
+				chain = append(chain, p)
+			}
+			samplerArgs.BatchProcessor = append(chain, args.BatchProcessor)
+		}
+		sampler, err := newTailSamplingProcessor(samplerArgs)
 		if err != nil {
 			return nil, errors.Wrapf(err, "error creating %s", name)
 		}
-		samplingMonitoringRegistry.Remove("tail")
-		monitoring.NewFunc(samplingMonitoringRegistry, "tail", sampler.CollectMonitoring, monitoring.Report)
+		registerMonitoringFunc(registries.sampling, "tail", sampler.CollectMonitoring)
+		registerMonitoringFunc(registries.sampling, "tail_storage", sampler.CollectStorageDiagnostics)
 		processors = append(processors, namedProcessor{name: name, processor: sampler})
 	}
+	return append(processors, afterSampling...), nil
+}
+
+// newRegisteredProcessors returns new processors for the registrations in
+// args.Processors with the given position, in registration order.
+func newRegisteredProcessors(args beater.ServerParams, position beater.ProcessorPosition) ([]namedProcessor, error) {
+	var processors []namedProcessor
+	for _, r := range args.Processors {
+		if r.Position != position {
+			continue
+		}
+		args.Logger.Infof("creating %s", r.Name)
+		p, err := r.New(args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating %s", r.Name)
+		}
+		processors = append(processors, namedProcessor{name: r.Name, processor: p})
+	}
 	return processors, nil
 }
 
@@ -108,59 +279,267 @@ func newTailSamplingProcessor(args beater.ServerParams) (*sampling.Processor, er
 	}
 
 	storageDir := paths.Resolve(paths.Data, tailSamplingStorageDir)
-	badgerDB, err = getBadgerDB(storageDir)
+	badgerDB, err = getBadgerDB(storageDir, tailSamplingConfig.StorageValueLogFileSizeParsed)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get Badger database")
 	}
-	readWriters := getStorage(badgerDB)
+	readWriters, err := getStorage(badgerDB, tailSamplingConfig.StorageCompression, tailSamplingConfig.StorageKeySchema)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get tail-sampling storage")
+	}
+	samplingConfig := newTailSamplingConfig(args, es, badgerDB, readWriters, storageDir)
+	samplingConfig.CorruptionThreshold = tailSamplingConfig.StorageCorruption.Threshold
+	samplingConfig.RecreateStorage = func() (*badger.DB, *eventstorage.ShardedReadWriter, error) {
+		return recreateBadgerStorage(
+			storageDir,
+			tailSamplingConfig.StorageCorruption.Action,
+			tailSamplingConfig.StorageValueLogFileSizeParsed,
+			tailSamplingConfig.StorageCompression,
+			tailSamplingConfig.StorageKeySchema,
+			args.Logger,
+		)
+	}
+	return sampling.NewProcessor(samplingConfig)
+}
+
+// newTailSamplingConfig returns the sampling.Config for the tail-sampling
+// config in args, using the given Elasticsearch client and storage.
+func newTailSamplingConfig(
+	args beater.ServerParams,
+	es elasticsearch.Client,
+	db *badger.DB,
+	storage *eventstorage.ShardedReadWriter,
+	storageDir string,
+) sampling.Config {
+	tailSamplingConfig := args.Config.Sampling.Tail
+	return sampling.Config{
+		BeatID:         args.UUID.String(),
+		BatchProcessor: args.BatchProcessor,
+		LocalSamplingConfig: sampling.LocalSamplingConfig{
+			FlushInterval:           tailSamplingConfig.Interval,
+			MaxDynamicServices:      tailSamplingConfig.MaxDynamicServices,
+			FinalizeConcurrency:     tailSamplingConfig.FinalizeConcurrency,
+			Policies:                newSamplingPolicies(tailSamplingConfig.Policies),
+			ShadowPolicies:          newSamplingPolicies(tailSamplingConfig.ShadowPolicies),
+			IngestRateDecayFactor:   tailSamplingConfig.IngestRateDecayFactor,
+			IngestRateDecayFactors:  newIngestRateDecayFactors(tailSamplingConfig.IngestRateDecayEnvironments),
+			DroppedTraceMetrics:     tailSamplingConfig.DroppedTraceMetrics,
+			KeepRootOnDrop:          tailSamplingConfig.KeepRootOnDrop,
+			EmitSamplingProbability: tailSamplingConfig.EmitSamplingProbability,
+			SampledByLabel:          tailSamplingConfig.SampledByLabel,
+			TraceIDAllowList:        tailSamplingConfig.TraceIDs.Allow,
+			TraceIDDenyList:         tailSamplingConfig.TraceIDs.Deny,
+			TraceNameNormalizers:    newTraceNameNormalizers(tailSamplingConfig.TraceNameNormalizers),
+			DefaultTraceOutcome:     tailSamplingConfig.DefaultTraceOutcome,
+			ReservoirStrategy:       tailSamplingConfig.Strategy,
+			TraceIDCollisionPolicy:  tailSamplingConfig.TraceIDCollision,
+			BypassServices:          tailSamplingConfig.BypassServices,
+			TraceCompleted:          newTraceCompleted(tailSamplingConfig.TraceCompletion),
+			AuditLogPath:            newAuditLogPath(tailSamplingConfig.AuditLog),
+			AuditLogMaxSize:         uint(tailSamplingConfig.AuditLog.MaxSizeParsed),
+			AuditLogMaxBackups:      tailSamplingConfig.AuditLog.MaxBackups,
+			DecisionMetricsDataset:  newDecisionMetricsDataset(tailSamplingConfig.DecisionMetrics),
+		},
+		RemoteSamplingConfig: sampling.RemoteSamplingConfig{
+			CompressionCodec:               tailSamplingConfig.SampledTraces.Compression,
+			CompressionLevel:               tailSamplingConfig.ESConfig.CompressionLevel,
+			MaxBulkRequests:                tailSamplingConfig.BulkMaxRequests,
+			BulkFlushBytes:                 tailSamplingConfig.BulkFlushBytesParsed,
+			Elasticsearch:                  es,
+			CircuitBreakerFailureThreshold: tailSamplingConfig.CircuitBreaker.FailureThreshold,
+			CircuitBreakerCooldown:         tailSamplingConfig.CircuitBreaker.Cooldown,
+			PublishMaxRetries:              tailSamplingConfig.PublishRetry.MaxRetries,
+			PublishRetryBackoff:            tailSamplingConfig.PublishRetry.Backoff,
+			PublishRetryJitter:             tailSamplingConfig.PublishRetry.Jitter,
+			PublishRetryTimeout:            tailSamplingConfig.PublishRetry.Timeout,
+			SampledTracesDataStream:        newSampledTracesDataStream(args.Namespace, tailSamplingConfig.SampledTraces),
+		},
+		StorageConfig: sampling.StorageConfig{
+			DB:                     db,
+			Storage:                storage,
+			StorageDir:             storageDir,
+			StorageGCInterval:      tailSamplingConfig.StorageGCInterval,
+			StorageLimit:           tailSamplingConfig.StorageLimitParsed,
+			DropOnStorageLimit:     tailSamplingConfig.DropOnStorageLimit,
+			FinalizeOnStorageLimit: tailSamplingConfig.FinalizeOnStorageLimit,
+			TTL:                    tailSamplingConfig.TTL,
+			OutcomeTTLs:            newOutcomeTTLs(tailSamplingConfig.OutcomeTTL),
+			OrphanTraceTimeout:     tailSamplingConfig.OrphanTraceTimeout,
+
+			StorageWriteWorkers:   tailSamplingConfig.StorageWrite.Workers,
+			StorageWriteQueueSize: tailSamplingConfig.StorageWrite.QueueSize,
+
+			StoredLabelsLimit:      tailSamplingConfig.StoredLabels.MaxLabels,
+			StoredLabelsBytesLimit: tailSamplingConfig.StoredLabels.MaxSizeParsed,
+			PreservedLabels:        newPreservedLabels(tailSamplingConfig),
+		},
+	}
+}
+
+// newSampledTracesDataStream returns the data stream for sampled trace IDs,
+// in the configured namespace if any, or otherwise the server's namespace.
+func newSampledTracesDataStream(namespace string, in config.TailSamplingSampledTracesConfig) sampling.DataStreamConfig {
+	if in.Namespace != "" {
+		namespace = in.Namespace
+	}
+	return sampling.DataStreamConfig{
+		Type:      "traces",
+		Dataset:   "apm.sampled",
+		Namespace: namespace,
+	}
+}
+
+func newIngestRateDecayFactors(in []config.TailSamplingIngestRateDecayEnvironment) map[string]float64 {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]float64, len(in))
+	for _, env := range in {
+		out[env.Environment] = env.Decay
+	}
+	return out
+}
+
+func newOutcomeTTLs(in config.TailSamplingOutcomeTTLConfig) map[string]time.Duration {
+	out := make(map[string]time.Duration)
+	for outcome, ttl := range map[string]time.Duration{
+		"success": in.Success,
+		"failure": in.Failure,
+		"unknown": in.Unknown,
+	} {
+		if ttl > 0 {
+			out[outcome] = ttl
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// newPreservedLabels returns the names of labels to keep in preference to
+// others when truncating the labels of stored events: those configured, and
+// the trace completion label, if enabled.
+func newPreservedLabels(in config.TailSamplingConfig) []string {
+	preserved := in.StoredLabels.Preserve
+	if in.TraceCompletion.Enabled {
+		preserved = append(preserved[:len(preserved):len(preserved)], in.TraceCompletion.Label)
+	}
+	return preserved
+}
+
+// newAuditLogPath returns the path of the tail-sampling audit log files,
+// resolved against the logs path, or "" if the audit log is disabled.
+func newAuditLogPath(in config.TailSamplingAuditLogConfig) string {
+	if !in.Enabled {
+		return ""
+	}
+	return paths.Resolve(paths.Logs, in.Path)
+}
+
+// newDecisionMetricsDataset returns the dataset to which tail-sampling decision
+// metrics are published, or "" if they are disabled.
+func newDecisionMetricsDataset(in config.TailSamplingDecisionMetricsConfig) string {
+	if !in.Enabled {
+		return ""
+	}
+	return in.Dataset
+}
+
+// newTraceCompleted returns a function reporting whether a root transaction
+// signals that its trace is complete, by having the configured label set to
+// "true", or nil if trace completion signals are disabled.
+func newTraceCompleted(in config.TailSamplingTraceCompletionConfig) func(*model.APMEvent) bool {
+	if !in.Enabled {
+		return nil
+	}
+	label := in.Label
+	return func(event *model.APMEvent) bool {
+		return event.Labels[label].Value == "true"
+	}
+}
+
+func newTraceNameNormalizers(in []config.TailSamplingTraceNameNormalizer) []sampling.TraceNameNormalizer {
+	if len(in) == 0 {
+		return nil
+	}
+	normalizers := make([]sampling.TraceNameNormalizer, len(in))
+	for i, n := range in {
+		normalizers[i] = sampling.TraceNameNormalizer{
+			Pattern:     n.Pattern,
+			Replacement: n.Replacement,
+		}
+	}
+	return normalizers
+}
 
-	policies := make([]sampling.Policy, len(tailSamplingConfig.Policies))
-	for i, in := range tailSamplingConfig.Policies {
+func newSamplingPolicies(tailSamplingPolicies []config.TailSamplingPolicy) []sampling.Policy {
+	if len(tailSamplingPolicies) == 0 {
+		return nil
+	}
+	policies := make([]sampling.Policy, len(tailSamplingPolicies))
+	for i, in := range tailSamplingPolicies {
 		policies[i] = sampling.Policy{
+			Name: in.Name,
 			PolicyCriteria: sampling.PolicyCriteria{
 				ServiceName:        in.Service.Name,
 				ServiceEnvironment: in.Service.Environment,
 				TraceName:          in.Trace.Name,
 				TraceOutcome:       in.Trace.Outcome,
+				HasError:           in.Trace.HasError,
+				MinDuration:        in.Trace.MinDuration,
+				MaxDuration:        in.Trace.MaxDuration,
+				MinHTTPStatusCode:  in.Trace.HTTPStatusCodeMin,
+				MaxHTTPStatusCode:  in.Trace.HTTPStatusCodeMax,
+				MinSpanCount:       in.Trace.MinSpanCount,
 			},
 			SampleRate: in.SampleRate,
 		}
+		if in.Match != nil {
+			match := newSamplingPolicyMatcher(*in.Match)
+			policies[i].Match = &match
+		}
 	}
+	return policies
+}
 
-	return sampling.NewProcessor(sampling.Config{
-		BeatID:         args.UUID.String(),
-		BatchProcessor: args.BatchProcessor,
-		LocalSamplingConfig: sampling.LocalSamplingConfig{
-			FlushInterval:         tailSamplingConfig.Interval,
-			MaxDynamicServices:    1000,
-			Policies:              policies,
-			IngestRateDecayFactor: tailSamplingConfig.IngestRateDecayFactor,
-		},
-		RemoteSamplingConfig: sampling.RemoteSamplingConfig{
-			CompressionLevel: tailSamplingConfig.ESConfig.CompressionLevel,
-			Elasticsearch:    es,
-			SampledTracesDataStream: sampling.DataStreamConfig{
-				Type:      "traces",
-				Dataset:   "apm.sampled",
-				Namespace: args.Namespace,
-			},
-		},
-		StorageConfig: sampling.StorageConfig{
-			DB:                badgerDB,
-			Storage:           readWriters,
-			StorageDir:        storageDir,
-			StorageGCInterval: tailSamplingConfig.StorageGCInterval,
-			StorageLimit:      tailSamplingConfig.StorageLimitParsed,
-			TTL:               tailSamplingConfig.TTL,
-		},
-	})
+func newSamplingPolicyMatcher(in config.TailSamplingPolicyMatcher) sampling.PolicyMatcher {
+	var out sampling.PolicyMatcher
+	switch {
+	case len(in.All) > 0:
+		out.All = newSamplingPolicyMatchers(in.All)
+	case len(in.Any) > 0:
+		out.Any = newSamplingPolicyMatchers(in.Any)
+	default:
+		out.Criteria = sampling.PolicyCriteria{
+			ServiceName:        in.Service.Name,
+			ServiceEnvironment: in.Service.Environment,
+			TraceName:          in.Trace.Name,
+			TraceOutcome:       in.Trace.Outcome,
+			HasError:           in.Trace.HasError,
+			MinDuration:        in.Trace.MinDuration,
+			MaxDuration:        in.Trace.MaxDuration,
+			MinHTTPStatusCode:  in.Trace.HTTPStatusCodeMin,
+			MaxHTTPStatusCode:  in.Trace.HTTPStatusCodeMax,
+			MinSpanCount:       in.Trace.MinSpanCount,
+		}
+	}
+	return out
+}
+
+func newSamplingPolicyMatchers(in []config.TailSamplingPolicyMatcher) []sampling.PolicyMatcher {
+	out := make([]sampling.PolicyMatcher, len(in))
+	for i, m := range in {
+		out[i] = newSamplingPolicyMatcher(m)
+	}
+	return out
 }
 
-func getBadgerDB(storageDir string) (*badger.DB, error) {
+func getBadgerDB(storageDir string, valueLogFileSize int64) (*badger.DB, error) {
 	badgerMu.Lock()
 	defer badgerMu.Unlock()
 	if badgerDB == nil {
-		db, err := eventstorage.OpenBadger(storageDir, -1)
+		db, err := eventstorage.OpenBadger(storageDir, valueLogFileSize)
 		if err != nil {
 			return nil, err
 		}
@@ -169,20 +548,99 @@ func getBadgerDB(storageDir string) (*badger.DB, error) {
 	return badgerDB, nil
 }
 
-func getStorage(db *badger.DB) *eventstorage.ShardedReadWriter {
+func getStorage(db *badger.DB, compression, keySchema string) (*eventstorage.ShardedReadWriter, error) {
 	storageMu.Lock()
 	defer storageMu.Unlock()
 	if storage == nil {
-		eventCodec := eventstorage.JSONCodec{}
-		storage = eventstorage.New(db, eventCodec).NewShardedReadWriter()
+		s, err := newEventStorage(db, compression, keySchema)
+		if err != nil {
+			return nil, err
+		}
+		storage = s.NewShardedReadWriter()
+	}
+	return storage, nil
+}
+
+// newEventStorage returns a new eventstorage.Storage using db, with the
+// given compression and key schema.
+func newEventStorage(db *badger.DB, compression, keySchema string) (*eventstorage.Storage, error) {
+	eventCodec, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, compression)
+	if err != nil {
+		return nil, err
 	}
-	return storage
+	return eventstorage.NewWithKeySchema(db, eventCodec, eventstorage.KeySchema(keySchema))
+}
+
+// recreateBadgerStorage closes the badger database and storage, moves or
+// wipes the storage directory according to action, and opens a new database
+// and storage in its place. The new database and storage replace the
+// globals, so they are closed by cleanup.
+func recreateBadgerStorage(
+	storageDir, action string,
+	valueLogFileSize int64,
+	compression, keySchema string,
+	logger *logp.Logger,
+) (*badger.DB, *eventstorage.ShardedReadWriter, error) {
+	badgerMu.Lock()
+	defer badgerMu.Unlock()
+	storageMu.Lock()
+	defer storageMu.Unlock()
+
+	if storage != nil {
+		storage.Close()
+		storage = nil
+	}
+	if badgerDB != nil {
+		// The database is corrupt, so errors closing it are expected.
+		if err := badgerDB.Close(); err != nil {
+			logger.With(logp.Error(err)).Warn("error closing corrupt Badger database")
+		}
+		badgerDB = nil
+	}
+	switch action {
+	case "wipe":
+		if err := os.RemoveAll(storageDir); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to wipe corrupt storage")
+		}
+		logger.Warnf("wiped corrupt storage %q", storageDir)
+	default:
+		corruptDir := storageDir + ".corrupt." + time.Now().UTC().Format("20060102T150405.000000000")
+		if err := os.Rename(storageDir, corruptDir); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to move corrupt storage")
+		}
+		logger.Warnf("moved corrupt storage %q to %q", storageDir, corruptDir)
+	}
+
+	db, err := eventstorage.OpenBadger(storageDir, valueLogFileSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := newEventStorage(db, compression, keySchema)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	badgerDB = db
+	storage = s.NewShardedReadWriter()
+	return badgerDB, storage, nil
 }
 
 // runServerWithProcessors runs the APM Server and the given list of processors.
 //
 // newProcessors returns a list of processors which will process events in
 // sequential order, prior to the events being published.
+//
+// The processors are started first, and the server is only started, opening
+// its listeners, once all processors implementing initializer have signalled
+// that they are initialized. If a processor fails before then, the server is
+// not started. See waitProcessorsInitialized.
+//
+// When the server stops, and so is no longer accepting events, the processors
+// are drained by stopping them one at a time in reverse order, so that each
+// processor flushes any events it has buffered (e.g. tail-sampling decisions,
+// or aggregated metrics) before the preceding processors are stopped. See
+// drainProcessors. Progress is logged, so operators can tell when it is safe
+// to terminate the process.
 func runServerWithProcessors(ctx context.Context, runServer beater.RunServerFunc, args beater.ServerParams, processors ...namedProcessor) error {
 	if len(processors) == 0 {
 		return runServer(ctx, args)
@@ -200,31 +658,112 @@ func runServerWithProcessors(ctx context.Context, runServer beater.RunServerFunc
 			args.Logger.Infof("%s stopped", p.name)
 			return nil
 		})
-		g.Go(func() error {
-			<-serverStopped
-			stopctx := context.Background()
-			if args.Config.ShutdownTimeout > 0 {
-				// On shutdown wait for the aggregator to stop
-				// in order to flush any accumulated metrics.
-				var cancel context.CancelFunc
-				stopctx, cancel = context.WithTimeout(stopctx, args.Config.ShutdownTimeout)
-				defer cancel()
-			}
-			return p.Stop(stopctx)
-		})
 	}
+	g.Go(func() error {
+		<-serverStopped
+		if gracePeriod := args.Config.ShutdownGracePeriod; gracePeriod > 0 {
+			args.Logger.Infof("waiting %s before stopping processors", gracePeriod)
+			select {
+			case <-ctx.Done():
+				// A processor failed; stop the others immediately.
+			case <-time.After(gracePeriod):
+			}
+		}
+		stopctx := context.Background()
+		if args.Config.ShutdownTimeout > 0 {
+			// On shutdown wait for the processors to stop
+			// in order to flush any accumulated events.
+			var cancel context.CancelFunc
+			stopctx, cancel = context.WithTimeout(stopctx, args.Config.ShutdownTimeout)
+			defer cancel()
+		}
+		return drainProcessors(stopctx, args.Logger, processors)
+	})
 	g.Go(func() error {
 		defer close(serverStopped)
+		if !waitProcessorsInitialized(ctx, args.Logger, processors) {
+			// A processor failed, or the server was stopped,
+			// before all processors were initialized.
+			return nil
+		}
 		return runServer(ctx, args)
 	})
 	return g.Wait()
 }
 
-func wrapServer(args beater.ServerParams, runServer beater.RunServerFunc) (beater.ServerParams, beater.RunServerFunc, error) {
-	processors, err := newProcessors(args)
+// waitProcessorsInitialized waits for each of the processors implementing
+// initializer to be initialized, logging progress. waitProcessorsInitialized
+// returns false if ctx is done before all processors are initialized.
+func waitProcessorsInitialized(ctx context.Context, logger *logp.Logger, processors []namedProcessor) bool {
+	for _, p := range processors {
+		i, ok := p.processor.(initializer)
+		if !ok {
+			continue
+		}
+		select {
+		case <-i.Initialized():
+			continue
+		default:
+		}
+		logger.Infof("waiting for %s to initialize", p.name)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-i.Initialized():
+			logger.Infof("%s initialized", p.name)
+		}
+	}
+	return true
+}
+
+// drainProcessors stops each of the processors in reverse order, logging
+// progress. All processors are stopped even if stopping one of them fails.
+//
+// processors are given in chain order, so processors nearest the output are
+// stopped first: the tail sampler, which finalizes its sampling decisions
+// and publishes buffered events when stopped, is stopped before the metrics
+// aggregators publish their final metrics.
+func drainProcessors(ctx context.Context, logger *logp.Logger, processors []namedProcessor) error {
+	var result error
+	for i := range processors {
+		p := processors[len(processors)-i-1]
+		logger.Infof("draining %s (%d of %d)", p.name, i+1, len(processors))
+		if err := p.Stop(ctx); err != nil {
+			logger.With(logp.Error(err)).Errorf("failed to drain %s", p.name)
+			result = multierror.Append(result, errors.Wrapf(err, "failed to drain %s", p.name))
+			continue
+		}
+		logger.Infof("drained %s", p.name)
+	}
+	if result == nil {
+		logger.Info("all processors drained")
+	}
+	return result
+}
+
+// newWrapServer returns a beater.WrapServerFunc which wraps the server with
+// the processors returned by newProcessors, reporting their metrics to the
+// given monitoring registries.
+func newWrapServer(registries monitoringRegistries) beater.WrapServerFunc {
+	return func(args beater.ServerParams, runServer beater.RunServerFunc) (beater.ServerParams, beater.RunServerFunc, error) {
+		return wrapServerWithProcessors(args, runServer, registries)
+	}
+}
+
+func wrapServerWithProcessors(
+	args beater.ServerParams,
+	runServer beater.RunServerFunc,
+	registries monitoringRegistries,
+) (beater.ServerParams, beater.RunServerFunc, error) {
+	processors, err := newProcessors(args, registries)
 	if err != nil {
 		return beater.ServerParams{}, nil, err
 	}
+	registerProcessorLag(registries.processors, processors)
+
+	report := newStartupReport(args, processors)
+	args.Logger.With(logp.Reflect("report", report)).Info("active subsystems")
+	registerMonitoringFunc(registries.state, "startup", report.collectMonitoring)
 
 	// Add the processors to the chain.
 	processorChain := make(modelprocessor.Chained, len(processors)+1)
@@ -233,13 +772,38 @@ func wrapServer(args beater.ServerParams, runServer beater.RunServerFunc) (beate
 	}
 	processorChain[len(processors)] = args.BatchProcessor
 	args.BatchProcessor = processorChain
+	args.FlushAggregations = newFlushAggregations(processors)
+	args.MonitoringRegistries = []string{
+		registries.prefix + ".aggregation",
+		registries.prefix + ".sampling",
+	}
 
+	sampler := tailSamplingProcessor(processors)
 	wrappedRunServer := func(ctx context.Context, args beater.ServerParams) error {
+		if sampler != nil && args.Config.Sampling.Tail.PoliciesFile != "" {
+			watchCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go watchPoliciesFile(
+				watchCtx, args.Config.Sampling.Tail, sampler,
+				policiesFileReloadInterval, args.Logger,
+			)
+		}
 		return runServerWithProcessors(ctx, runServer, args, processors...)
 	}
 	return args, wrappedRunServer, nil
 }
 
+// tailSamplingProcessor returns the tail-sampling processor in processors,
+// or nil if tail-sampling is disabled.
+func tailSamplingProcessor(processors []namedProcessor) *sampling.Processor {
+	for _, p := range processors {
+		if sampler, ok := p.processor.(*sampling.Processor); ok {
+			return sampler
+		}
+	}
+	return nil
+}
+
 // closeBadger is called at process exit time to close the badger.DB opened
 // by the tail-based sampling processor constructor, if any. This is never
 // called concurrently with opening badger.DB/accessing the badgerDB global,
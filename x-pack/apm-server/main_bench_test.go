@@ -0,0 +1,171 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+	"github.com/elastic/elastic-agent-libs/paths"
+
+	"github.com/elastic/apm-server/internal/beater"
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/internal/elasticsearch"
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/pubsub/pubsubtest"
+)
+
+const (
+	// benchmarkServices and benchmarkTransactionNames control the number
+	// of distinct aggregation groups in the synthetic events.
+	benchmarkServices         = 10
+	benchmarkTransactionNames = 10
+
+	// benchmarkSpansPerTrace is the number of spans in each synthetic trace.
+	benchmarkSpansPerTrace = 3
+)
+
+// BenchmarkProcessors measures the throughput of the full processor chain
+// built by newProcessors, with and without tail-based sampling, publishing
+// to modelprocessor.Nop. Each operation processes a synthetic trace made up
+// of a root transaction and benchmarkSpansPerTrace exit spans.
+func BenchmarkProcessors(b *testing.B) {
+	setupBenchmarkStorage(b)
+	for _, tailSampling := range []bool{false, true} {
+		b.Run(fmt.Sprintf("tail_sampling=%t", tailSampling), func(b *testing.B) {
+			cfg := config.DefaultConfig()
+			if tailSampling {
+				cfg.Sampling.Tail.Enabled = true
+				cfg.Sampling.Tail.Policies = []config.TailSamplingPolicy{{SampleRate: 0.1}}
+			}
+			benchmarkProcessors(b, cfg)
+		})
+	}
+}
+
+// benchmarkProcessors runs the processors built by newProcessors for cfg,
+// feeding them synthetic traces from parallel goroutines.
+func benchmarkProcessors(b *testing.B, cfg *config.Config) {
+	processors, err := newProcessors(beater.ServerParams{
+		Config:         cfg,
+		Logger:         logp.NewLogger(""),
+		BatchProcessor: modelprocessor.Nop{},
+		Namespace:      "default",
+		NewElasticsearchClient: func(*elasticsearch.Config) (elasticsearch.Client, error) {
+			return pubsubtest.Client(nil, nil), nil
+		},
+	}, newMonitoringRegistries(monitoring.NewRegistry(), monitoring.NewRegistry(), "apm-server"))
+	require.NoError(b, err)
+
+	chained := make(modelprocessor.Chained, len(processors))
+	for i, p := range processors {
+		go p.Run()
+		chained[i] = p
+	}
+	defer func() {
+		require.NoError(b, drainProcessors(context.Background(), logp.NewLogger(""), processors))
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		var seed int64
+		require.NoError(b, binary.Read(cryptorand.Reader, binary.LittleEndian, &seed))
+		rng := rand.New(rand.NewSource(seed))
+		var batch model.Batch
+		for pb.Next() {
+			batch = appendBenchmarkTrace(batch[:0], rng)
+			if err := chained.ProcessBatch(context.Background(), &batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*(1+benchmarkSpansPerTrace))/elapsed.Seconds(), "events/s")
+}
+
+// appendBenchmarkTrace appends the events of a synthetic trace to batch,
+// with a random trace ID, service, and transaction name.
+func appendBenchmarkTrace(batch model.Batch, rng *rand.Rand) model.Batch {
+	var traceID [16]byte
+	binary.LittleEndian.PutUint64(traceID[:8], rng.Uint64())
+	binary.LittleEndian.PutUint64(traceID[8:], rng.Uint64())
+	trace := model.Trace{ID: hex.EncodeToString(traceID[:])}
+	transactionID := hex.EncodeToString(traceID[:8])
+	service := model.Service{
+		Name:        fmt.Sprintf("service-%d", rng.Intn(benchmarkServices)),
+		Environment: "production",
+	}
+	timestamp := time.Now()
+
+	batch = append(batch, model.APMEvent{
+		Timestamp: timestamp,
+		Processor: model.TransactionProcessor,
+		Service:   service,
+		Trace:     trace,
+		Event: model.Event{
+			Duration: time.Duration(rng.Intn(1000)) * time.Millisecond,
+			Outcome:  "success",
+		},
+		Transaction: &model.Transaction{
+			ID:                  transactionID,
+			Name:                fmt.Sprintf("GET /%d", rng.Intn(benchmarkTransactionNames)),
+			Type:                "request",
+			Sampled:             true,
+			RepresentativeCount: 1,
+		},
+	})
+	for i := 0; i < benchmarkSpansPerTrace; i++ {
+		batch = append(batch, model.APMEvent{
+			Timestamp: timestamp,
+			Processor: model.SpanProcessor,
+			Service:   service,
+			Trace:     trace,
+			Parent:    model.Parent{ID: transactionID},
+			Event: model.Event{
+				Duration: time.Duration(rng.Intn(100)) * time.Millisecond,
+				Outcome:  "success",
+			},
+			Span: &model.Span{
+				ID:                  fmt.Sprintf("%s%02d", transactionID[:14], i),
+				Name:                "SELECT FROM table",
+				Type:                "db",
+				RepresentativeCount: 1,
+				DestinationService: &model.DestinationService{
+					Resource: fmt.Sprintf("postgresql/%d", i),
+				},
+			},
+		})
+	}
+	return batch
+}
+
+// setupBenchmarkStorage initialises paths so tail-sampling storage is created
+// in a temporary directory, and closes the storage when the benchmark ends.
+//
+// Storage is opened once per process and shared by processors, so it must be
+// reset in case another test or benchmark has opened and closed it.
+func setupBenchmarkStorage(b *testing.B) {
+	require.NoError(b, paths.InitPaths(&paths.Path{Home: b.TempDir()}))
+	badgerDB, storage = nil, nil
+	b.Cleanup(func() {
+		closeStorage()
+		closeBadger() // close badger.DB so data dir can be deleted on Windows
+		badgerDB, storage = nil, nil
+	})
+}
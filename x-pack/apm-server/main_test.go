@@ -8,7 +8,10 @@ package main
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -23,14 +26,12 @@ import (
 	"github.com/elastic/apm-server/internal/beater"
 	"github.com/elastic/apm-server/internal/beater/config"
 	"github.com/elastic/apm-server/internal/elasticsearch"
+	"github.com/elastic/apm-server/internal/model"
 	"github.com/elastic/apm-server/internal/model/modelprocessor"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling"
 )
 
 func TestMonitoring(t *testing.T) {
-	// samplingMonitoringRegistry will be nil, as under normal circumstances
-	// we rely on apm-server/sampling to create the registry.
-	samplingMonitoringRegistry = monitoring.NewRegistry()
-
 	home := t.TempDir()
 	err := paths.InitPaths(&paths.Path{Home: home})
 	require.NoError(t, err)
@@ -40,28 +41,447 @@ func TestMonitoring(t *testing.T) {
 	cfg.Sampling.Tail.Enabled = true
 	cfg.Sampling.Tail.Policies = []config.TailSamplingPolicy{{SampleRate: 0.1}}
 
-	// Wrap & run the server twice, to ensure metric registration does not panic.
-	runServerError := errors.New("runServer")
-	for i := 0; i < 2; i++ {
-		var aggregationMonitoringSnapshot, tailSamplingMonitoringSnapshot monitoring.FlatSnapshot
-		serverParams, runServer, err := wrapServer(beater.ServerParams{
-			Config:                 cfg,
-			Logger:                 logp.NewLogger(""),
-			Tracer:                 apmtest.DiscardTracer,
-			BatchProcessor:         modelprocessor.Nop{},
-			Managed:                true,
-			Namespace:              "default",
-			NewElasticsearchClient: elasticsearch.NewClient,
-		}, func(ctx context.Context, args beater.ServerParams) error {
-			aggregationMonitoringSnapshot = monitoring.CollectFlatSnapshot(aggregationMonitoringRegistry, monitoring.Full, false)
-			tailSamplingMonitoringSnapshot = monitoring.CollectFlatSnapshot(samplingMonitoringRegistry, monitoring.Full, false)
-			return runServerError
+	// Use a private root registry, and two sets of registries with different
+	// prefixes, to ensure multiple sets of processors can coexist.
+	root := monitoring.NewRegistry()
+	for _, prefix := range []string{"apm-server", "apm-server-2"} {
+		registries := newMonitoringRegistries(root, monitoring.NewRegistry(), prefix)
+		wrapServer := newWrapServer(registries)
+
+		// Wrap & run the server twice, to ensure metric registration does not panic.
+		runServerError := errors.New("runServer")
+		for i := 0; i < 2; i++ {
+			var aggregationMonitoringSnapshot, tailSamplingMonitoringSnapshot monitoring.FlatSnapshot
+			serverParams, runServer, err := wrapServer(beater.ServerParams{
+				Config:                 cfg,
+				Logger:                 logp.NewLogger(""),
+				Tracer:                 apmtest.DiscardTracer,
+				BatchProcessor:         modelprocessor.Nop{},
+				Managed:                true,
+				Namespace:              "default",
+				NewElasticsearchClient: elasticsearch.NewClient,
+			}, func(ctx context.Context, args beater.ServerParams) error {
+				aggregationMonitoringSnapshot = monitoring.CollectFlatSnapshot(registries.aggregation, monitoring.Full, false)
+				tailSamplingMonitoringSnapshot = monitoring.CollectFlatSnapshot(registries.sampling, monitoring.Full, false)
+				return runServerError
+			})
+			require.NoError(t, err)
+			// The Prometheus endpoint exposes the prefixed registries.
+			assert.Equal(t, []string{prefix + ".aggregation", prefix + ".sampling"}, serverParams.MonitoringRegistries)
+
+			err = runServer(context.Background(), serverParams)
+			assert.Equal(t, runServerError, err)
+			assert.NotEqual(t, monitoring.MakeFlatSnapshot(), aggregationMonitoringSnapshot)
+			assert.NotEqual(t, monitoring.MakeFlatSnapshot(), tailSamplingMonitoringSnapshot)
+		}
+		assert.NotNil(t, root.Get(prefix+".aggregation.txmetrics"))
+		assert.NotNil(t, root.Get(prefix+".aggregation.spanmetrics"))
+		assert.NotNil(t, root.Get(prefix+".sampling.tail"))
+		assert.NotNil(t, root.Get(prefix+".sampling.tail_storage"))
+	}
+}
+
+func TestNewProcessorsAggregationBatchProcessor(t *testing.T) {
+	var published, aggregated []model.APMEvent
+	recordBatchProcessor := func(events *[]model.APMEvent) model.BatchProcessor {
+		return model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			*events = append(*events, (*batch)...)
+			return nil
 		})
-		require.NoError(t, err)
+	}
+	processors, err := newProcessors(beater.ServerParams{
+		Config:                    config.DefaultConfig(),
+		Logger:                    logp.NewLogger(""),
+		BatchProcessor:            recordBatchProcessor(&published),
+		AggregationBatchProcessor: recordBatchProcessor(&aggregated),
+	}, newMonitoringRegistries(monitoring.NewRegistry(), monitoring.NewRegistry(), "apm-server"))
+	require.NoError(t, err)
+	require.Len(t, processors, 2)
 
-		err = runServer(context.Background(), serverParams)
-		assert.Equal(t, runServerError, err)
-		assert.NotEqual(t, monitoring.MakeFlatSnapshot(), aggregationMonitoringSnapshot)
-		assert.NotEqual(t, monitoring.MakeFlatSnapshot(), tailSamplingMonitoringSnapshot)
+	txmetrics := processors[0]
+	go txmetrics.Run()
+	err = txmetrics.ProcessBatch(context.Background(), &model.Batch{{
+		Processor:   model.TransactionProcessor,
+		Event:       model.Event{Duration: time.Millisecond},
+		Transaction: &model.Transaction{Name: "name", Type: "type", RepresentativeCount: 1},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, txmetrics.Stop(context.Background()))
+
+	assert.Empty(t, published)
+	require.Len(t, aggregated, 1)
+	assert.Equal(t, model.MetricsetProcessor, aggregated[0].Processor)
+}
+
+func TestNewProcessorsRegistered(t *testing.T) {
+	register := func(name string, position beater.ProcessorPosition) beater.ProcessorRegistration {
+		return beater.ProcessorRegistration{
+			Name:     name,
+			Position: position,
+			New: func(beater.ServerParams) (beater.Processor, error) {
+				return stopFuncProcessor(func(context.Context) error { return nil }), nil
+			},
+		}
+	}
+	args := beater.ServerParams{
+		Config:         config.DefaultConfig(),
+		Logger:         logp.NewLogger(""),
+		BatchProcessor: modelprocessor.Nop{},
+		Processors: []beater.ProcessorRegistration{
+			register("after sampling", beater.ProcessorPositionAfterSampling),
+			register("before sampling", beater.ProcessorPositionBeforeSampling),
+			register("first", beater.ProcessorPositionBeforeAggregation),
+			register("second", beater.ProcessorPositionBeforeAggregation),
+		},
+	}
+	processors, err := newProcessors(args, newMonitoringRegistries(monitoring.NewRegistry(), monitoring.NewRegistry(), "apm-server"))
+	require.NoError(t, err)
+
+	var names []string
+	for _, p := range processors {
+		names = append(names, p.name)
 	}
+	assert.Equal(t, []string{
+		"first",
+		"second",
+		"transaction metrics aggregation",
+		"service destinations aggregation",
+		"before sampling",
+		"after sampling",
+	}, names)
+
+	args.Processors = append(args.Processors, beater.ProcessorRegistration{
+		Name: "broken",
+		New: func(beater.ServerParams) (beater.Processor, error) {
+			return nil, errors.New("boom")
+		},
+	})
+	_, err = newProcessors(args, newMonitoringRegistries(monitoring.NewRegistry(), monitoring.NewRegistry(), "apm-server"))
+	assert.EqualError(t, err, "error creating broken: boom")
 }
+
+func TestNewSamplingPolicies(t *testing.T) {
+	var in config.TailSamplingPolicy
+	in.Name = "name"
+	in.Trace.Outcome = "failure"
+	in.Trace.MinDuration = time.Second
+	in.SampleRate = 0.5
+	in.Match = &config.TailSamplingPolicyMatcher{}
+	in.Match.Any = make([]config.TailSamplingPolicyMatcher, 2)
+	in.Match.Any[0].Service.Name = "a"
+	in.Match.Any[1].Service.Environment = "production"
+	in.Match.Any[1].Trace.HasError = true
+	in.Match.Any[1].Trace.HTTPStatusCodeMin = 500
+	in.Match.Any[1].Trace.HTTPStatusCodeMax = 599
+	in.Match.Any[1].Trace.MinSpanCount = 10
+
+	assert.Equal(t, []sampling.Policy{{
+		Name:           "name",
+		PolicyCriteria: sampling.PolicyCriteria{TraceOutcome: "failure", MinDuration: time.Second},
+		Match: &sampling.PolicyMatcher{Any: []sampling.PolicyMatcher{
+			{Criteria: sampling.PolicyCriteria{ServiceName: "a"}},
+			{Criteria: sampling.PolicyCriteria{
+				ServiceEnvironment: "production",
+				HasError:           true,
+				MinHTTPStatusCode:  500,
+				MaxHTTPStatusCode:  599,
+				MinSpanCount:       10,
+			}},
+		}},
+		SampleRate: 0.5,
+	}, {
+		SampleRate: 0.1,
+	}}, newSamplingPolicies([]config.TailSamplingPolicy{in, {SampleRate: 0.1}}))
+}
+
+func TestNewSampledTracesDataStream(t *testing.T) {
+	assert.Equal(t, sampling.DataStreamConfig{
+		Type:      "traces",
+		Dataset:   "apm.sampled",
+		Namespace: "default",
+	}, newSampledTracesDataStream("default", config.TailSamplingSampledTracesConfig{}))
+	assert.Equal(t, sampling.DataStreamConfig{
+		Type:      "traces",
+		Dataset:   "apm.sampled",
+		Namespace: "long_term",
+	}, newSampledTracesDataStream("default", config.TailSamplingSampledTracesConfig{Namespace: "long_term"}))
+}
+
+func TestNewIngestRateDecayFactors(t *testing.T) {
+	assert.Nil(t, newIngestRateDecayFactors(nil))
+	assert.Equal(t, map[string]float64{
+		"production":  0.1,
+		"development": 1,
+	}, newIngestRateDecayFactors([]config.TailSamplingIngestRateDecayEnvironment{
+		{Environment: "production", Decay: 0.1},
+		{Environment: "development", Decay: 1},
+	}))
+}
+
+func TestNewOutcomeTTLs(t *testing.T) {
+	assert.Nil(t, newOutcomeTTLs(config.TailSamplingOutcomeTTLConfig{}))
+	assert.Equal(t, map[string]time.Duration{
+		"failure": time.Hour,
+		"unknown": time.Minute,
+	}, newOutcomeTTLs(config.TailSamplingOutcomeTTLConfig{
+		Failure: time.Hour,
+		Unknown: time.Minute,
+	}))
+}
+
+func TestNewPreservedLabels(t *testing.T) {
+	var in config.TailSamplingConfig
+	assert.Empty(t, newPreservedLabels(in))
+
+	in.StoredLabels.Preserve = []string{"tenant"}
+	assert.Equal(t, []string{"tenant"}, newPreservedLabels(in))
+
+	// The trace completion label is preserved when enabled.
+	in.TraceCompletion.Enabled = true
+	in.TraceCompletion.Label = "done"
+	assert.Equal(t, []string{"tenant", "done"}, newPreservedLabels(in))
+	assert.Equal(t, []string{"tenant"}, in.StoredLabels.Preserve)
+}
+
+func TestNewAuditLogPath(t *testing.T) {
+	assert.Equal(t, "", newAuditLogPath(config.TailSamplingAuditLogConfig{Path: "audit"}))
+
+	auditLogPath := newAuditLogPath(config.TailSamplingAuditLogConfig{Enabled: true, Path: "audit"})
+	assert.Equal(t, paths.Resolve(paths.Logs, "audit"), auditLogPath)
+
+	absPath := filepath.Join(t.TempDir(), "audit")
+	assert.Equal(t, absPath, newAuditLogPath(config.TailSamplingAuditLogConfig{Enabled: true, Path: absPath}))
+}
+
+func TestNewTraceCompleted(t *testing.T) {
+	assert.Nil(t, newTraceCompleted(config.TailSamplingTraceCompletionConfig{Label: "done"}))
+
+	traceCompleted := newTraceCompleted(config.TailSamplingTraceCompletionConfig{Enabled: true, Label: "done"})
+	require.NotNil(t, traceCompleted)
+	assert.True(t, traceCompleted(&model.APMEvent{Labels: model.Labels{"done": {Value: "true"}}}))
+	assert.False(t, traceCompleted(&model.APMEvent{Labels: model.Labels{"done": {Value: "false"}}}))
+	assert.False(t, traceCompleted(&model.APMEvent{Labels: model.Labels{"other": {Value: "true"}}}))
+	assert.False(t, traceCompleted(&model.APMEvent{}))
+}
+
+func TestRecreateBadgerStorage(t *testing.T) {
+	for _, action := range []string{"move", "wipe"} {
+		t.Run(action, func(t *testing.T) {
+			storageDir := filepath.Join(t.TempDir(), tailSamplingStorageDir)
+
+			// Storage may have been opened by another test.
+			badgerDB, storage = nil, nil
+			t.Cleanup(func() {
+				assert.NoError(t, cleanup())
+				badgerDB, storage = nil, nil
+			})
+			db, err := getBadgerDB(storageDir, 0)
+			require.NoError(t, err)
+			_, err = getStorage(db, "none", "trace_event")
+			require.NoError(t, err)
+
+			newDB, newStorage, err := recreateBadgerStorage(storageDir, action, 0, "none", "trace_event", logp.NewLogger(""))
+			require.NoError(t, err)
+			assert.Equal(t, badgerDB, newDB)
+			assert.Equal(t, storage, newStorage)
+			assert.NotEqual(t, db, newDB)
+			assert.DirExists(t, storageDir)
+
+			moved, err := filepath.Glob(storageDir + ".corrupt.*")
+			require.NoError(t, err)
+			if action == "move" {
+				require.Len(t, moved, 1)
+				entries, err := os.ReadDir(moved[0])
+				require.NoError(t, err)
+				assert.NotEmpty(t, entries)
+			} else {
+				assert.Empty(t, moved)
+			}
+		})
+	}
+}
+
+func TestDrainProcessors(t *testing.T) {
+	var stopped []string
+	newProcessor := func(name string, err error) namedProcessor {
+		return namedProcessor{name: name, processor: stopFuncProcessor(func(context.Context) error {
+			stopped = append(stopped, name)
+			return err
+		})}
+	}
+	stopErr := errors.New("stop failed")
+	err := drainProcessors(context.Background(), logp.NewLogger(""), []namedProcessor{
+		newProcessor("first", nil),
+		newProcessor("second", stopErr),
+		newProcessor("third", nil),
+	})
+	assert.ErrorIs(t, err, stopErr)
+	assert.Equal(t, []string{"third", "second", "first"}, stopped)
+}
+
+func TestNewFlushAggregations(t *testing.T) {
+	assert.Nil(t, newFlushAggregations([]namedProcessor{newNopProcessor("nop")}))
+
+	// The aggregators added by default implement flusher.
+	processors, err := newProcessors(beater.ServerParams{
+		Config:         config.DefaultConfig(),
+		Logger:         logp.NewLogger(""),
+		BatchProcessor: modelprocessor.Nop{},
+	}, newMonitoringRegistries(monitoring.NewRegistry(), monitoring.NewRegistry(), "apm-server"))
+	require.NoError(t, err)
+	for _, p := range processors {
+		assert.Implements(t, (*flusher)(nil), p.processor, p.name)
+	}
+
+	newFlusher := func(name string, groups int, err error) namedProcessor {
+		return namedProcessor{name: name, processor: flusherProcessor{
+			stopFuncProcessor: func(context.Context) error { return nil },
+			flush:             func(context.Context) (int, error) { return groups, err },
+		}}
+	}
+	flush := newFlushAggregations([]namedProcessor{
+		newFlusher("first", 1, nil),
+		newNopProcessor("nop"),
+		newFlusher("second", 2, nil),
+	})
+	require.NotNil(t, flush)
+	groups, err := flush(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, groups)
+
+	flush = newFlushAggregations([]namedProcessor{
+		newFlusher("first", 1, nil),
+		newFlusher("second", 0, errors.New("boom")),
+	})
+	groups, err = flush(context.Background())
+	assert.EqualError(t, err, "failed to flush second: boom")
+	assert.Equal(t, 1, groups)
+}
+
+func TestRunServerWithProcessorsStopOrder(t *testing.T) {
+	var stopped []string
+	newProcessor := func(name string) namedProcessor {
+		return namedProcessor{name: name, processor: stopFuncProcessor(func(context.Context) error {
+			stopped = append(stopped, name)
+			return nil
+		})}
+	}
+	args := beater.ServerParams{Config: config.DefaultConfig(), Logger: logp.NewLogger("")}
+
+	// Processors are given in chain order, as returned by newProcessors,
+	// and are stopped in reverse order once the server stops: the tail
+	// sampler before the aggregators.
+	err := runServerWithProcessors(context.Background(),
+		func(context.Context, beater.ServerParams) error { return nil },
+		args,
+		newProcessor("transaction metrics aggregation"),
+		newProcessor("service destinations aggregation"),
+		newProcessor("tail sampler"),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"tail sampler",
+		"service destinations aggregation",
+		"transaction metrics aggregation",
+	}, stopped)
+}
+
+func TestRunServerWithProcessorsShutdownGracePeriod(t *testing.T) {
+	var serverStoppedAt, processorStoppedAt time.Time
+	args := beater.ServerParams{Config: config.DefaultConfig(), Logger: logp.NewLogger("")}
+	args.Config.ShutdownGracePeriod = 100 * time.Millisecond
+	err := runServerWithProcessors(context.Background(),
+		func(context.Context, beater.ServerParams) error {
+			serverStoppedAt = time.Now()
+			return nil
+		},
+		args,
+		namedProcessor{name: "tail sampler", processor: stopFuncProcessor(func(context.Context) error {
+			processorStoppedAt = time.Now()
+			return nil
+		})},
+	)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, processorStoppedAt.Sub(serverStoppedAt), args.Config.ShutdownGracePeriod)
+}
+
+func TestRunServerWithProcessorsInitialized(t *testing.T) {
+	args := beater.ServerParams{Config: config.DefaultConfig(), Logger: logp.NewLogger("")}
+	initialized := make(chan struct{})
+	serverStarted := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- runServerWithProcessors(context.Background(),
+			func(context.Context, beater.ServerParams) error {
+				close(serverStarted)
+				return nil
+			},
+			args,
+			newNopProcessor("transaction metrics aggregation"),
+			namedProcessor{name: "tail sampler", processor: initializerProcessor{
+				run:         func() error { return nil },
+				initialized: initialized,
+			}},
+		)
+	}()
+
+	// The server must not be started until all processors are initialized.
+	select {
+	case <-serverStarted:
+		t.Fatal("server started before processors were initialized")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(initialized)
+	select {
+	case <-serverStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for server to start")
+	}
+	assert.NoError(t, <-result)
+}
+
+func TestRunServerWithProcessorsInitializeFailed(t *testing.T) {
+	args := beater.ServerParams{Config: config.DefaultConfig(), Logger: logp.NewLogger("")}
+	runErr := errors.New("run failed")
+	err := runServerWithProcessors(context.Background(),
+		func(context.Context, beater.ServerParams) error {
+			t.Error("server started after processor failed to initialize")
+			return nil
+		},
+		args,
+		namedProcessor{name: "tail sampler", processor: initializerProcessor{
+			run:         func() error { return runErr },
+			initialized: make(chan struct{}),
+		}},
+	)
+	assert.ErrorIs(t, err, runErr)
+}
+
+func newNopProcessor(name string) namedProcessor {
+	return namedProcessor{name: name, processor: stopFuncProcessor(func(context.Context) error {
+		return nil
+	})}
+}
+
+type initializerProcessor struct {
+	stopFuncProcessor
+	run         func() error
+	initialized chan struct{}
+}
+
+func (p initializerProcessor) Run() error                   { return p.run() }
+func (p initializerProcessor) Stop(context.Context) error   { return nil }
+func (p initializerProcessor) Initialized() <-chan struct{} { return p.initialized }
+
+type flusherProcessor struct {
+	stopFuncProcessor
+	flush func(context.Context) (int, error)
+}
+
+func (p flusherProcessor) Flush(ctx context.Context) (int, error) { return p.flush(ctx) }
+
+type stopFuncProcessor func(context.Context) error
+
+func (f stopFuncProcessor) ProcessBatch(context.Context, *model.Batch) error { return nil }
+func (f stopFuncProcessor) Run() error                                       { return nil }
+func (f stopFuncProcessor) Stop(ctx context.Context) error                   { return f(ctx) }
@@ -0,0 +1,72 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// registerMonitoringFuncMu serialises registerMonitoringFunc, so concurrent
+// calls for the same name do not race between looking up and adding the
+// monitoring function.
+var registerMonitoringFuncMu sync.Mutex
+
+// registerMonitoringFunc registers f as a monitoring function named name in
+// registry, for reporting metrics in monitoring.Reported mode.
+//
+// registerMonitoringFunc is idempotent: if it has previously been called with
+// the same registry and name, the previously registered function is replaced
+// by f, rather than panicking due to the name already being in use. This
+// allows the server to be wrapped again, e.g. on config reload, without first
+// removing metrics from the registry.
+func registerMonitoringFunc(registry *monitoring.Registry, name string, f func(monitoring.Mode, monitoring.Visitor)) {
+	registerMonitoringFuncMu.Lock()
+	defer registerMonitoringFuncMu.Unlock()
+	if v, ok := registry.Get(name).(*replaceableFunc); ok {
+		v.set(f)
+		return
+	}
+	v := &replaceableFunc{f: f}
+	registry.Add(name, v, monitoring.Reported)
+}
+
+// replaceableFunc is a monitoring.Var which visits a function that may be
+// replaced after registration.
+type replaceableFunc struct {
+	mu sync.RWMutex
+	f  func(monitoring.Mode, monitoring.Visitor)
+}
+
+func (r *replaceableFunc) set(f func(monitoring.Mode, monitoring.Visitor)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f = f
+}
+
+// Visit implements monitoring.Var.
+func (r *replaceableFunc) Visit(mode monitoring.Mode, V monitoring.Visitor) {
+	r.mu.RLock()
+	f := r.f
+	r.mu.RUnlock()
+	f(mode, V)
+}
+
+// registerProcessorLag registers a monitoring function in registry for each
+// of the processors, reporting their lag in milliseconds as "<name>.lag_ms",
+// with spaces in the processor name replaced by underscores.
+func registerProcessorLag(registry *monitoring.Registry, processors []namedProcessor) {
+	for _, p := range processors {
+		p := p // copy for closure
+		name := strings.ReplaceAll(p.name, " ", "_")
+		registerMonitoringFunc(registry, name, func(_ monitoring.Mode, V monitoring.Visitor) {
+			V.OnRegistryStart()
+			defer V.OnRegistryFinished()
+			monitoring.ReportInt(V, "lag_ms", processorLag(p.processor).Milliseconds())
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+func TestRegisterMonitoringFunc(t *testing.T) {
+	registry := monitoring.NewRegistry()
+	reportInt := func(value int64) func(monitoring.Mode, monitoring.Visitor) {
+		return func(_ monitoring.Mode, V monitoring.Visitor) {
+			V.OnRegistryStart()
+			defer V.OnRegistryFinished()
+			monitoring.ReportInt(V, "value", value)
+		}
+	}
+
+	registerMonitoringFunc(registry, "a.b", reportInt(1))
+	snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, map[string]int64{"a.b.value": 1}, snapshot.Ints)
+
+	// Registering again with the same name replaces the function.
+	assert.NotPanics(t, func() { registerMonitoringFunc(registry, "a.b", reportInt(2)) })
+	snapshot = monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, map[string]int64{"a.b.value": 2}, snapshot.Ints)
+
+	// Metrics are reported in monitoring.Reported mode.
+	snapshot = monitoring.CollectFlatSnapshot(registry, monitoring.Reported, false)
+	assert.Equal(t, map[string]int64{"a.b.value": 2}, snapshot.Ints)
+}
+
+func TestRegisterProcessorLag(t *testing.T) {
+	registry := monitoring.NewRegistry()
+	registerProcessorLag(registry, []namedProcessor{
+		{name: "no lag", processor: stopFuncProcessor(func(context.Context) error { return nil })},
+		{name: "lagging", processor: lagProcessor{lag: 3 * time.Second}},
+	})
+	snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, map[string]int64{
+		"no_lag.lag_ms":  0,
+		"lagging.lag_ms": 3000,
+	}, snapshot.Ints)
+}
+
+type lagProcessor struct {
+	stopFuncProcessor
+	lag time.Duration
+}
+
+func (p lagProcessor) Lag() time.Duration { return p.lag }
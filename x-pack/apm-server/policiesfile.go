@@ -0,0 +1,82 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/paths"
+
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling"
+)
+
+// policiesFileReloadInterval holds the amount of time between checks of the
+// tail-sampling policies file for changes.
+const policiesFileReloadInterval = 10 * time.Second
+
+// policiesUpdater is implemented by *sampling.Processor.
+type policiesUpdater interface {
+	UpdatePolicies([]sampling.Policy) error
+}
+
+// policiesFileState identifies a version of the policies file.
+type policiesFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statPoliciesFile(path string) policiesFileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		// The file is reloaded once it exists again, and the
+		// error is logged by the attempt to reload it.
+		return policiesFileState{}
+	}
+	return policiesFileState{modTime: info.ModTime(), size: info.Size()}
+}
+
+// watchPoliciesFile checks the tail-sampling policies file in cfg for changes
+// every interval until ctx is done, reloading the policies into p when it
+// changes. If the reloaded policies are invalid, the error is logged and p
+// keeps its current policies until the file changes again.
+func watchPoliciesFile(
+	ctx context.Context,
+	cfg config.TailSamplingConfig,
+	p policiesUpdater,
+	interval time.Duration,
+	logger *logp.Logger,
+) {
+	path := paths.Resolve(paths.Config, cfg.PoliciesFile)
+	last := statPoliciesFile(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		state := statPoliciesFile(path)
+		if state == last {
+			continue
+		}
+		last = state
+		policies, err := cfg.LoadPolicies()
+		if err == nil {
+			err = p.UpdatePolicies(newSamplingPolicies(policies))
+		}
+		if err != nil {
+			logger.With(logp.Error(err)).Errorf(
+				"failed to reload tail-sampling policies from %q, keeping current policies", path,
+			)
+			continue
+		}
+		logger.Infof("reloaded %d tail-sampling policies from %q", len(policies), path)
+	}
+}
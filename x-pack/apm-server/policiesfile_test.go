@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agentconfig "github.com/elastic/elastic-agent-libs/config"
+	"github.com/elastic/elastic-agent-libs/logp"
+
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling"
+)
+
+type policiesUpdaterFunc func([]sampling.Policy) error
+
+func (f policiesUpdaterFunc) UpdatePolicies(policies []sampling.Policy) error {
+	return f(policies)
+}
+
+func TestWatchPoliciesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.yml")
+	writePolicies := func(content string, modTime time.Time) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	modTime := time.Now().Add(-time.Hour)
+	writePolicies("policies: [{sample_rate: 0.5}]", modTime)
+
+	cfg, err := config.NewConfig(agentconfig.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":       true,
+		"sampling.tail.policies_file": path,
+	}), nil)
+	require.NoError(t, err)
+
+	updates := make(chan []sampling.Policy, 1)
+	updater := policiesUpdaterFunc(func(policies []sampling.Policy) error {
+		updates <- policies
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchPoliciesFile(ctx, cfg.Sampling.Tail, updater, 10*time.Millisecond, logp.NewLogger(""))
+
+	expectNoUpdate := func() {
+		select {
+		case policies := <-updates:
+			t.Fatalf("unexpected policies update: %+v", policies)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	expectNoUpdate()
+
+	writePolicies("policies: [{service.name: foo, sample_rate: 1}, {sample_rate: 0.1}]", modTime.Add(time.Second))
+	select {
+	case policies := <-updates:
+		require.Len(t, policies, 2)
+		assert.Equal(t, "foo", policies[0].PolicyCriteria.ServiceName)
+		assert.Equal(t, 1.0, policies[0].SampleRate)
+		assert.Equal(t, 0.1, policies[1].SampleRate)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for policies update")
+	}
+
+	// Invalid policies are not applied: there is no default policy.
+	writePolicies("policies: [{service.name: foo, sample_rate: 1}]", modTime.Add(2*time.Second))
+	expectNoUpdate()
+}
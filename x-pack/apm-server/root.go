@@ -21,5 +21,7 @@ func newXPackRootCommand(newBeat beat.Creator) *libbeatcmd.BeatsRootCmd {
 		// error is ok => enroll has already been removed
 		rootCmd.RemoveCommand(enrollCmd)
 	}
+	rootCmd.TestCmd.AddCommand(newTestTailSamplingCommand(settings))
+	rootCmd.AddCommand(newTailSamplingStorageCommand(settings))
 	return rootCmd
 }
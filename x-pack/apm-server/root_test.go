@@ -12,14 +12,15 @@ import (
 
 func TestSubCommands(t *testing.T) {
 	validCommands := map[string]struct{}{
-		"apikey":     {},
-		"completion": {},
-		"export":     {},
-		"keystore":   {},
-		"run":        {},
-		"setup":      {},
-		"test":       {},
-		"version":    {},
+		"apikey":                {},
+		"completion":            {},
+		"export":                {},
+		"keystore":              {},
+		"run":                   {},
+		"setup":                 {},
+		"tail-sampling-storage": {},
+		"test":                  {},
+		"version":               {},
 	}
 
 	rootCmd := newXPackRootCommand(beater.NewCreator(beater.CreatorParams{}))
@@ -29,4 +30,13 @@ func TestSubCommands(t *testing.T) {
 			t.Errorf("unexpected command: %s", name)
 		}
 	}
+
+	if _, _, err := rootCmd.Find([]string{"test", "tail-sampling"}); err != nil {
+		t.Errorf("missing command: test tail-sampling")
+	}
+	for _, name := range []string{"export", "import"} {
+		if _, _, err := rootCmd.Find([]string{"tail-sampling-storage", name}); err != nil {
+			t.Errorf("missing command: tail-sampling-storage %s", name)
+		}
+	}
 }
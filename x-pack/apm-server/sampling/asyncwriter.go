@@ -0,0 +1,217 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// errAsyncWriterClosed is returned by asyncWriter methods once the writer
+// has been closed, e.g. while the processor is stopping.
+var errAsyncWriterClosed = errors.New("storage writer closed")
+
+// asyncWriter writes trace events and sampling decisions to storage
+// asynchronously, decoupling storage writes from intake.
+//
+// Writes are queued and performed by a fixed number of workers. Writes are
+// sharded across workers by trace ID, so writes for a trace are performed
+// in the order they are queued. When a worker's queue is full, writes block
+// until there is room, applying backpressure to intake.
+//
+// Before the events of traces are read, e.g. when reporting sampled traces,
+// flush must be called to wait for the writes queued for those traces.
+// Events queued after their trace's sampling decision has been made, e.g.
+// when the decision is made while the event is being processed, are still
+// written, but are not reported; they are counted, and expire from storage
+// after the TTL.
+type asyncWriter struct {
+	// dropped holds the number of queued writes which failed, and
+	// writtenAfterDecision the number of events written after their
+	// trace's sampling decision. They are accessed atomically, and
+	// must be the first fields for 64-bit alignment.
+	dropped              int64
+	writtenAfterDecision int64
+
+	rw             *wrappedRW
+	storageDelay   *durationHistogram
+	earlyFinalizer *earlyFinalizer
+	logger         *logp.Logger
+	queues         []chan asyncWrite
+	wg             sync.WaitGroup
+
+	// mu guards closed, and the queues against being closed while
+	// writes are being queued.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// asyncWrite holds a queued write. If event is nil, the write records
+// the trace's sampling decision, unless flushed is non-nil, in which case
+// the write is a barrier which closes flushed once the writes queued before
+// it have been performed.
+type asyncWrite struct {
+	traceID string
+	id      string
+	event   *model.APMEvent
+	sampled bool
+	flushed chan struct{}
+
+	// received holds the time at which event was received, for
+	// recording the delay until it is written to storage.
+	received time.Time
+}
+
+// newAsyncWriter returns a new asyncWriter which writes to rw using the
+// given number of workers, each with a queue of size queueSize/workers.
+// The delay from receiving events until they are written is recorded in
+// storageDelay. Early finalization is requested from earlyFinalizer when
+// writes are rejected because storage is at its limit.
+//
+// The writer's workers run until Close is called.
+func newAsyncWriter(
+	rw *wrappedRW, workers, queueSize int,
+	storageDelay *durationHistogram, earlyFinalizer *earlyFinalizer,
+	logger *logp.Logger,
+) *asyncWriter {
+	workerQueueSize := (queueSize + workers - 1) / workers
+	w := &asyncWriter{
+		rw:             rw,
+		storageDelay:   storageDelay,
+		earlyFinalizer: earlyFinalizer,
+		logger:         logger,
+		queues:         make([]chan asyncWrite, workers),
+	}
+	w.wg.Add(workers)
+	for i := range w.queues {
+		queue := make(chan asyncWrite, workerQueueSize)
+		w.queues[i] = queue
+		go func() {
+			defer w.wg.Done()
+			for write := range queue {
+				w.write(write)
+			}
+		}()
+	}
+	return w
+}
+
+// WriteTraceEvent queues a write of event, received at the given time,
+// to storage.
+//
+// The event is copied, so it may be modified once WriteTraceEvent returns.
+func (w *asyncWriter) WriteTraceEvent(traceID, id string, event *model.APMEvent, received time.Time) error {
+	eventCopy := *event
+	return w.enqueue(asyncWrite{traceID: traceID, id: id, event: &eventCopy, received: received})
+}
+
+// WriteTraceSampled queues a write of the trace's sampling decision to storage.
+func (w *asyncWriter) WriteTraceSampled(traceID string, sampled bool) error {
+	return w.enqueue(asyncWrite{traceID: traceID, sampled: sampled})
+}
+
+// flush waits for the writes queued for traceIDs before flush was called to
+// be performed, by queuing a barrier to each of their workers' queues. If
+// the writer is closed, flush returns immediately, as Close waits for the
+// queued writes.
+func (w *asyncWriter) flush(traceIDs []string) {
+	barriers := make(map[int]chan struct{})
+	for _, traceID := range traceIDs {
+		i := w.queueIndex(traceID)
+		if _, ok := barriers[i]; ok {
+			continue
+		}
+		barrier := make(chan struct{})
+		barriers[i] = barrier
+		if err := w.enqueue(asyncWrite{traceID: traceID, flushed: barrier}); err != nil {
+			return
+		}
+	}
+	for _, barrier := range barriers {
+		<-barrier
+	}
+}
+
+func (w *asyncWriter) enqueue(write asyncWrite) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return errAsyncWriterClosed
+	}
+	w.queues[w.queueIndex(write.traceID)] <- write
+	return nil
+}
+
+func (w *asyncWriter) write(write asyncWrite) {
+	if write.flushed != nil {
+		close(write.flushed)
+		return
+	}
+	var err error
+	if write.event != nil {
+		if _, err := w.rw.IsTraceSampled(write.traceID); err == nil {
+			atomic.AddInt64(&w.writtenAfterDecision, 1)
+		}
+		err = w.rw.WriteTraceEvent(write.traceID, write.id, write.event)
+	} else {
+		err = w.rw.WriteTraceSampled(write.traceID, write.sampled)
+	}
+	if err != nil {
+		if errors.Is(err, eventstorage.ErrLimitReached) {
+			w.earlyFinalizer.request()
+		}
+		atomic.AddInt64(&w.dropped, 1)
+		w.logger.With(logp.Error(err)).Warn("failed to write to storage")
+		return
+	}
+	if write.event != nil {
+		w.storageDelay.record(write.traceID, time.Since(write.received))
+	}
+}
+
+// queueIndex returns the index of the queue for the given trace ID.
+func (w *asyncWriter) queueIndex(traceID string) int {
+	var h xxhash.Digest
+	h.WriteString(traceID)
+	return int(h.Sum64() % uint64(len(w.queues)))
+}
+
+// depth returns the number of queued writes.
+func (w *asyncWriter) depth() int {
+	var n int
+	for _, queue := range w.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Close stops accepting writes, and waits for queued writes to be
+// performed. Close is idempotent.
+func (w *asyncWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		for _, queue := range w.queues {
+			close(queue)
+		}
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+func (w *asyncWriter) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "depth", int64(w.depth()))
+	monitoring.ReportInt(V, "dropped", atomic.LoadInt64(&w.dropped))
+	monitoring.ReportInt(V, "written_after_decision", atomic.LoadInt64(&w.writtenAfterDecision))
+}
@@ -0,0 +1,121 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+func TestAsyncWriterFlush(t *testing.T) {
+	db, err := eventstorage.OpenBadger(t.TempDir(), 0)
+	require.NoError(t, err)
+	storage := eventstorage.New(db, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	rw := newWrappedRW(db, storage, time.Minute, nil, 0)
+	t.Cleanup(func() {
+		storage.Close()
+		db.Close()
+	})
+
+	w := newAsyncWriter(rw, 2, 1000, newDurationHistogram(time.Minute, time.Minute), nil, logp.NewLogger(""))
+	defer w.Close()
+
+	// Block the workers from writing to storage until the writes have
+	// been queued and flush has been called.
+	rw.mu.Lock()
+	for i := 0; i < 100; i++ {
+		traceID := fmt.Sprintf("trace%d", i%5)
+		event := model.APMEvent{
+			Processor: model.SpanProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Span:      &model.Span{ID: fmt.Sprintf("span%d", i)},
+		}
+		require.NoError(t, w.WriteTraceEvent(traceID, event.Span.ID, &event, time.Now()))
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		w.flush([]string{"trace0", "trace1"})
+	}()
+	select {
+	case <-flushed:
+		t.Fatal("flush returned before queued writes were performed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rw.mu.Unlock()
+	<-flushed
+
+	// Once flushed, the queued events of the traces are all readable.
+	var batch model.Batch
+	require.NoError(t, rw.ReadTraceEventsBatch([]string{"trace0", "trace1"}, &batch))
+	assert.Len(t, batch, 40)
+	assert.Zero(t, atomic.LoadInt64(&w.writtenAfterDecision))
+
+	// Events written after their trace's sampling decision are counted.
+	require.NoError(t, rw.WriteTraceSampled("trace0", true))
+	event := model.APMEvent{
+		Processor: model.SpanProcessor,
+		Trace:     model.Trace{ID: "trace0"},
+		Span:      &model.Span{ID: "late"},
+	}
+	require.NoError(t, w.WriteTraceEvent("trace0", "late", &event, time.Now()))
+	w.flush([]string{"trace0"})
+	assert.Equal(t, int64(1), atomic.LoadInt64(&w.writtenAfterDecision))
+
+	// Flushing a closed writer returns immediately.
+	w.Close()
+	w.flush([]string{"trace0"})
+}
+
+func TestAsyncWriterLimitReached(t *testing.T) {
+	// Write events and reopen the database, so its size is updated.
+	dir := t.TempDir()
+	db, err := eventstorage.OpenBadger(dir, 0)
+	require.NoError(t, err)
+	storage := eventstorage.New(db, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	event := model.APMEvent{Processor: model.SpanProcessor, Span: &model.Span{ID: "span"}}
+	for i := 0; i < 100; i++ {
+		traceID := fmt.Sprintf("trace%d", i)
+		require.NoError(t, storage.WriteTraceEvent(traceID, "span", &event, eventstorage.WriterOpts{TTL: time.Minute}))
+	}
+	require.NoError(t, storage.Flush(0))
+	storage.Close()
+	require.NoError(t, db.Close())
+	db, err = eventstorage.OpenBadger(dir, 0)
+	require.NoError(t, err)
+	storage = eventstorage.New(db, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	t.Cleanup(func() {
+		storage.Close()
+		db.Close()
+	})
+	lsm, vlog := db.Size()
+	rw := newWrappedRW(db, storage, time.Minute, nil, lsm+vlog)
+
+	// Writes rejected because storage is at its limit request early
+	// finalization.
+	earlyFinalizer := newEarlyFinalizer(true, time.Minute)
+	w := newAsyncWriter(rw, 1, 1000, newDurationHistogram(time.Minute, time.Minute), earlyFinalizer, logp.NewLogger(""))
+	defer w.Close()
+	for i := 0; i < 500; i++ {
+		require.NoError(t, w.WriteTraceEvent("trace", fmt.Sprint(i), &event, time.Now()))
+	}
+	w.flush([]string{"trace"})
+	assert.NotZero(t, atomic.LoadInt64(&w.dropped))
+	select {
+	case <-earlyFinalizer.requested():
+	default:
+		t.Fatal("expected early finalization to be requested")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// auditRecord holds an audit record of a local sampling decision.
+type auditRecord struct {
+	Timestamp time.Time `json:"@timestamp"`
+	TraceID   string    `json:"trace.id"`
+	Decision  string    `json:"decision"`
+	Policy    string    `json:"policy"`
+}
+
+// auditLog records local sampling decisions, writing them to w as
+// newline-delimited JSON.
+//
+// Decisions are buffered in memory as they are made, and written by
+// flush, so that writing to w does not delay event processing. Each
+// record is written to w with a single call to Write, so that records
+// are not split across files when w is rotated.
+type auditLog struct {
+	// written and failed count the records written to w, and the
+	// records which could not be written. They are accessed atomically.
+	written int64
+	failed  int64
+
+	w   io.Writer
+	now func() time.Time
+
+	mu      sync.Mutex
+	pending []auditRecord
+	buf     []byte
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{w: w, now: time.Now}
+}
+
+// record records a decision to sample or drop the trace with the given ID,
+// made by the named policy.
+func (a *auditLog) record(traceID, policy string, sampled bool) {
+	decision := "dropped"
+	if sampled {
+		decision = "sampled"
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, auditRecord{
+		Timestamp: a.now(),
+		TraceID:   traceID,
+		Decision:  decision,
+		Policy:    policy,
+	})
+}
+
+// flush writes the records buffered since the last call to flush. If
+// writing a record fails, the remaining records are still written, and
+// the first error is returned.
+func (a *auditLog) flush() error {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	var firstErr error
+	for _, r := range pending {
+		err := a.write(r)
+		if err != nil {
+			atomic.AddInt64(&a.failed, 1)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		atomic.AddInt64(&a.written, 1)
+	}
+	return firstErr
+}
+
+// write writes r to a.w. write is only called by flush, which may not
+// be called concurrently, so a.buf is not protected by a.mu.
+func (a *auditLog) write(r auditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	a.buf = append(append(a.buf[:0], data...), '\n')
+	_, err = a.w.Write(a.buf)
+	return err
+}
+
+func (a *auditLog) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "written", atomic.LoadInt64(&a.written))
+	monitoring.ReportInt(V, "failed", atomic.LoadInt64(&a.failed))
+}
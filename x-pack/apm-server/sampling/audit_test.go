@@ -0,0 +1,58 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type auditLogWriterFunc func([]byte) (int, error)
+
+func (f auditLogWriterFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestAuditLog(t *testing.T) {
+	var writes []string
+	var fail bool
+	auditLog := newAuditLog(auditLogWriterFunc(func(p []byte) (int, error) {
+		if fail {
+			fail = false
+			return 0, errors.New("boom")
+		}
+		writes = append(writes, string(p))
+		return len(p), nil
+	}))
+	auditLog.now = func() time.Time {
+		return time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	}
+
+	auditLog.record("trace1", "policy1", true)
+	auditLog.record("trace2", "policy2", false)
+	assert.Empty(t, writes)
+
+	// Each record is written with a separate call to Write.
+	assert.NoError(t, auditLog.flush())
+	assert.Equal(t, []string{
+		`{"@timestamp":"2022-08-01T12:00:00Z","trace.id":"trace1","decision":"sampled","policy":"policy1"}` + "\n",
+		`{"@timestamp":"2022-08-01T12:00:00Z","trace.id":"trace2","decision":"dropped","policy":"policy2"}` + "\n",
+	}, writes)
+	assert.NoError(t, auditLog.flush())
+	assert.Len(t, writes, 2)
+
+	// Records which cannot be written are counted as failed, and do not
+	// prevent subsequent records from being written.
+	fail = true
+	auditLog.record("trace3", "policy1", false)
+	auditLog.record("trace4", "policy1", false)
+	assert.EqualError(t, auditLog.flush(), "boom")
+	assert.Len(t, writes, 3)
+	assert.Equal(t, int64(3), auditLog.written)
+	assert.Equal(t, int64(1), auditLog.failed)
+}
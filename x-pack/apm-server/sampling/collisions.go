@@ -0,0 +1,128 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// Trace ID collision policies; see LocalSamplingConfig.TraceIDCollisionPolicy.
+const (
+	traceIDCollisionMerge    = "merge"
+	traceIDCollisionSeparate = "separate"
+	traceIDCollisionDrop     = "drop"
+)
+
+// traceRoots tracks the root transactions received for each trace ID, for
+// detecting trace ID collisions: root transactions received for a trace ID
+// which already has a different root transaction.
+//
+// traceRoots is safe for concurrent use.
+type traceRoots struct {
+	// detected holds the number of collisions detected, and dropped the
+	// number of colliding root transactions dropped. They are accessed
+	// atomically, and must be the first fields for 64-bit alignment.
+	detected int64
+	dropped  int64
+
+	mu     sync.Mutex
+	traces map[string]traceRoot
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+type traceRoot struct {
+	transactionID string
+	firstSeen     time.Time
+}
+
+func newTraceRoots() *traceRoots {
+	return &traceRoots{
+		traces: make(map[string]traceRoot),
+		now:    time.Now,
+	}
+}
+
+// observe records the root transaction event, and reports whether its trace
+// ID collides with that of a different root transaction, counting it if so.
+// The first root transaction observed for a trace ID remains its root.
+func (r *traceRoots) observe(event *model.APMEvent) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	root, ok := r.traces[event.Trace.ID]
+	if !ok {
+		r.traces[event.Trace.ID] = traceRoot{
+			transactionID: event.Transaction.ID,
+			firstSeen:     r.now(),
+		}
+		return false
+	}
+	if root.transactionID == event.Transaction.ID {
+		// The same root transaction, e.g. sent again by an agent
+		// retrying a request, does not collide with itself.
+		return false
+	}
+	atomic.AddInt64(&r.detected, 1)
+	return true
+}
+
+// expire stops tracking root transactions first observed more than maxAge
+// ago, whose events have expired from local storage.
+func (r *traceRoots) expire(maxAge time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := r.now().Add(-maxAge)
+	for traceID, root := range r.traces {
+		if root.firstSeen.Before(cutoff) {
+			delete(r.traces, traceID)
+		}
+	}
+}
+
+func (r *traceRoots) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "detected", atomic.LoadInt64(&r.detected))
+	monitoring.ReportInt(V, "dropped", atomic.LoadInt64(&r.dropped))
+}
+
+// handleTraceIDCollision handles a root transaction whose trace ID collides
+// with that of a different root transaction, according to the configured
+// TraceIDCollisionPolicy. If handled is false, the root transaction is
+// processed like any other, merging it into the existing trace; otherwise
+// report holds whether the root transaction should be reported.
+func (p *Processor) handleTraceIDCollision(event *model.APMEvent) (report, handled bool, _ error) {
+	switch p.config.TraceIDCollisionPolicy {
+	case traceIDCollisionSeparate:
+		// Sample the root transaction independently of the reservoir,
+		// without recording a decision for the trace ID, as the trace
+		// already has one or is awaiting one for its original root.
+		p.groupsMu.RLock()
+		sampled, err := p.groups.sampleCompletedTrace(event)
+		p.groupsMu.RUnlock()
+		if err == errTooManyTraceGroups {
+			return false, true, nil
+		} else if err != nil {
+			return false, true, err
+		}
+		if sampled {
+			atomic.AddInt64(&p.eventMetrics.sampled, 1)
+		}
+		return sampled, true, nil
+	case traceIDCollisionDrop:
+		atomic.AddInt64(&p.traceRoots.dropped, 1)
+		p.rateLimitedLogger.Warnf(
+			"trace ID %s of root transaction from service %q collides with another root transaction, dropping",
+			event.Trace.ID, event.Service.Name,
+		)
+		return false, true, nil
+	}
+	return false, false, nil
+}
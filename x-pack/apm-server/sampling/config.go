@@ -5,6 +5,7 @@
 package sampling
 
 import (
+	"strings"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
@@ -40,10 +41,21 @@ type LocalSamplingConfig struct {
 	// no greater than half of the TTL.
 	FlushInterval time.Duration
 
+	// FinalizeConcurrency holds the maximum number of batches of locally
+	// sampled traces whose events are read from storage and reported
+	// concurrently after the reservoirs are finalized, smoothing the
+	// spike in resource usage at each FlushInterval into a bounded
+	// parallel drain. If FinalizeConcurrency is zero, batches are
+	// reported one at a time.
+	FinalizeConcurrency int
+
 	// MaxDynamicServices holds the maximum number of dynamic services to track.
 	//
-	// Once MaxDynamicServices is reached, root transactions from a service that
-	// does not have an explicit policy defined may be dropped.
+	// Once MaxDynamicServices is reached, the least recently seen dynamic
+	// service which has not been seen since the last FlushInterval is evicted
+	// to make room for a new service. If every dynamic service has been seen
+	// since then, root transactions from a service that does not have an
+	// explicit policy defined are dropped.
 	MaxDynamicServices int
 
 	// Policies holds local tail-sampling policies. Policies are matched in the
@@ -54,19 +66,224 @@ type LocalSamplingConfig struct {
 	// that dropping non-matching traces is intentional.
 	Policies []Policy
 
+	// ShadowPolicies holds an optional second set of tail-sampling policies,
+	// for evaluating a candidate policy set against live traffic.
+	//
+	// Root transactions are evaluated against both sets of policies, but only
+	// Policies are used for making sampling decisions. The decisions that
+	// ShadowPolicies would have made are only counted, and reported through
+	// CollectMonitoring alongside the decisions made by Policies.
+	//
+	// If ShadowPolicies is non-empty, it must include at least one policy
+	// that matches all traces, like Policies.
+	ShadowPolicies []Policy
+
 	// IngestRateDecayFactor holds the ingest rate decay factor, used for calculating
 	// the exponentially weighted moving average (EWMA) ingest rate for each trace
 	// group.
 	IngestRateDecayFactor float64
+
+	// IngestRateDecayFactors holds optional ingest rate decay factors by
+	// service environment, overriding IngestRateDecayFactor for the trace
+	// groups of policies with a matching ServiceEnvironment. Policies
+	// without a ServiceEnvironment use IngestRateDecayFactor.
+	//
+	// Traffic in some environments is more stable than in others, so a
+	// lower decay factor may be used for smoothing the ingest rate.
+	IngestRateDecayFactors map[string]float64
+
+	// DroppedTraceMetrics controls whether metrics are published counting the
+	// traces dropped by tail-sampling, by service and root transaction name.
+	//
+	// This keeps aggregate throughput accurate even though the individual traces
+	// are discarded, at the cost of additional metrics cardinality.
+	DroppedTraceMetrics bool
+
+	// KeepRootOnDrop controls whether the root transactions of traces
+	// dropped by Policies are reported, without the rest of their traces.
+	//
+	// This keeps service-level throughput and latency dashboards populated,
+	// while span detail is discarded. Root transactions which are dropped
+	// without being admitted to a sampling reservoir are reported
+	// immediately; those admitted but not sampled are reported from local
+	// storage when the reservoir is finalized.
+	KeepRootOnDrop bool
+
+	// EmitSamplingProbability controls whether the events of traces sampled
+	// by Policies are annotated with the probability with which they were
+	// sampled, in the "sampling_probability" numeric label, so that counts
+	// may be corrected for the sampling rate downstream.
+	//
+	// For traces sampled by a reservoir, this is the fraction of the
+	// matching policy's root transactions sampled in that interval; for
+	// traces sampled on completion or due to errors, it is the matching
+	// policy's sample rate. Traces sampled by other APM Servers are not
+	// annotated.
+	EmitSamplingProbability bool
+
+	// SampledByLabel, if non-empty, holds the name of a label set on the
+	// events of traces sampled by Policies, identifying the policy by
+	// which they were sampled as "tail:<policy name>", for filtering
+	// tail-sampled events downstream. Policies without a name are
+	// identified by their index. Traces sampled by other APM Servers are
+	// not labelled.
+	SampledByLabel string
+
+	// DecisionFunc, if non-nil, is called for each trace admitted to a
+	// sampling reservoir when the reservoirs are finalized, with a summary
+	// of the trace including the policies' decision, and reports whether
+	// the trace should be kept. This allows for overriding or supplementing
+	// the policies with custom logic.
+	//
+	// See DecisionFunc for details, including thread-safety requirements.
+	DecisionFunc DecisionFunc
+
+	// DecisionMetricsDataset, if non-empty, enables publishing metrics
+	// counting the traces kept and dropped by Policies at each FlushInterval,
+	// by policy and service, to the metrics data stream with this dataset.
+	//
+	// Policies are identified by Name, or by their index if they have no
+	// name. Like DroppedTraceMetrics, decisions for traces admitted to a
+	// sampling reservoir are counted once the reservoir is finalized.
+	DecisionMetricsDataset string
+
+	// TraceIDAllowList holds trace IDs for which all events are kept,
+	// bypassing policy evaluation. Trace IDs ending with "*" are treated
+	// as prefixes.
+	//
+	// TraceIDAllowList and TraceIDDenyList are intended as short-lived
+	// debugging tools, e.g. for guaranteeing that a specific trace is
+	// retained during incident investigation. If a trace ID is in both
+	// lists, the allow list takes precedence.
+	TraceIDAllowList []string
+
+	// TraceIDDenyList holds trace IDs for which all events are dropped,
+	// bypassing policy evaluation. Trace IDs ending with "*" are treated
+	// as prefixes.
+	TraceIDDenyList []string
+
+	// TraceNameNormalizers holds optional rules for normalizing root
+	// transaction names before they are matched against the TraceName
+	// criteria of Policies and ShadowPolicies. Normalizers are applied
+	// in the order provided.
+	//
+	// For example, a normalizer with Pattern `/\d+` and Replacement `/:id`
+	// would allow a policy with TraceName "GET /user/:id" to match the root
+	// transaction "GET /user/12345".
+	TraceNameNormalizers []TraceNameNormalizer
+
+	// DefaultTraceOutcome holds an optional outcome, "success", "failure",
+	// or "unknown", used in place of the outcome of root transactions
+	// whose outcome is empty when they are matched against the TraceOutcome
+	// criteria of Policies and ShadowPolicies.
+	//
+	// If DefaultTraceOutcome is empty, which is the default, root
+	// transactions with an empty outcome do not match any policy with
+	// TraceOutcome specified.
+	DefaultTraceOutcome string
+
+	// ReservoirStrategy holds the strategy used for choosing which root
+	// transactions to keep within each trace group's sample rate: "random"
+	// or "diversity". If ReservoirStrategy is empty, "random" is used.
+	//
+	// With "random", root transactions are kept by weighted random sampling,
+	// weighted by duration. With "diversity", root transactions are first
+	// partitioned by name, outcome, and duration bucket, and the sample is
+	// spread across as many partitions as possible, so that the traces kept
+	// cover more cases. This is intended for debugging-oriented retention,
+	// and makes sampling more expensive when there are many partitions.
+	ReservoirStrategy string
+
+	// TraceIDCollisionPolicy holds the handling of trace ID collisions,
+	// where a root transaction is received for a trace ID which already
+	// has a different root transaction, e.g. because two services generate
+	// colliding trace IDs: "merge", "separate", or "drop". If
+	// TraceIDCollisionPolicy is empty, "merge" is used.
+	//
+	// With "merge", the colliding root transaction is sampled like any
+	// other, and the events of both roots are treated as a single trace;
+	// this is the behaviour when collisions are not handled. With
+	// "separate", the colliding root transaction is sampled independently,
+	// and reported or dropped immediately without affecting the decision
+	// for the trace. With "drop", the colliding root transaction is
+	// dropped. Other events are stored under their trace ID, and cannot be
+	// attributed to either root, so they follow the trace's decision with
+	// any policy.
+	//
+	// Root transactions are tracked for detecting collisions until their
+	// events expire from local storage. Collisions are counted, and with
+	// "drop" the dropped root transactions, in monitoring metrics.
+	TraceIDCollisionPolicy string
+
+	// BypassServices holds the names of services whose transactions and
+	// spans bypass tail-sampling entirely: they are reported immediately,
+	// as sampled, without being stored or evaluated against Policies.
+	//
+	// Services are matched by the name of the service that produced each
+	// event, so events from other services in the same trace are still
+	// tail-sampled as usual.
+	BypassServices []string
+
+	// TraceCompleted, if non-nil, is called for each root transaction to
+	// determine whether the agent has signalled that the transaction's
+	// trace is complete.
+	//
+	// Completed traces are not added to a sampling reservoir to await
+	// finalization at the next FlushInterval; instead they are sampled
+	// immediately, with a probability equal to the matching policy's
+	// SampleRate, and their stored events reported straight away. The
+	// decisions are published to other APM Servers at the next flush.
+	// Events received after the root transaction, or still queued for
+	// writing when StorageWriteWorkers is configured, are handled like
+	// those of any trace with a decision.
+	TraceCompleted func(transactionEvent *model.APMEvent) bool
+
+	// AuditLogPath, if non-empty, holds the path of a file to which an
+	// audit record is written for each local sampling decision: the trace
+	// ID, whether the trace was sampled or dropped, the name of the policy
+	// that made the decision, and the time it was made. Records are written
+	// as newline-delimited JSON, with the date and ".ndjson" appended to
+	// AuditLogPath, at every FlushInterval and when the processor is stopped.
+	//
+	// Only decisions made by Policies are recorded. Decisions received from
+	// other APM Servers, and traces kept or dropped by TraceIDAllowList,
+	// TraceIDDenyList, or BypassServices, are not recorded.
+	AuditLogPath string
+
+	// AuditLogMaxSize holds the size in bytes at which the audit log file
+	// is rotated. If AuditLogMaxSize is zero, the file is rotated at 10MiB.
+	AuditLogMaxSize uint
+
+	// AuditLogMaxBackups holds the number of rotated audit log files to
+	// keep, in addition to the active file. Older files are deleted.
+	AuditLogMaxBackups uint
 }
 
 // RemoteSamplingConfig holds Processor configuration related to publishing and
 // subscribing to remote sampling decisions.
 type RemoteSamplingConfig struct {
+	// CompressionCodec holds the codec to use for compressing bulk requests
+	// when indexing sampled trace IDs: "gzip", "zstd", or "none". If empty,
+	// gzip is used. If Elasticsearch does not accept zstd-compressed requests,
+	// gzip is used instead.
+	CompressionCodec string
+
 	// CompressionLevel holds the gzip compression level to use when bulk
 	// indexing sampled trace IDs.
 	CompressionLevel int
 
+	// MaxBulkRequests holds the maximum number of concurrent bulk requests
+	// to make when indexing sampled trace IDs.
+	//
+	// If MaxBulkRequests is zero, the model/modelindexer default will be used.
+	MaxBulkRequests int
+
+	// BulkFlushBytes holds the flush threshold in bytes for bulk requests
+	// made when indexing sampled trace IDs.
+	//
+	// If BulkFlushBytes is zero, the model/modelindexer default will be used.
+	BulkFlushBytes int
+
 	// Elasticsearch holds the Elasticsearch client to use for publishing
 	// and subscribing to remote sampling decisions.
 	Elasticsearch elasticsearch.Client
@@ -74,6 +291,39 @@ type RemoteSamplingConfig struct {
 	// SampledTracesDataStream holds the identifiers for the Elasticsearch
 	// data stream for storing and searching sampled trace IDs.
 	SampledTracesDataStream DataStreamConfig
+
+	// CircuitBreakerFailureThreshold holds the number of consecutive failed
+	// bulk requests for indexing sampled trace IDs after which a circuit
+	// breaker opens, short-circuiting requests for CircuitBreakerCooldown.
+	// While the breaker is open, locally sampled trace IDs are not shared
+	// with other servers.
+	//
+	// If CircuitBreakerFailureThreshold is zero, no circuit breaker is used.
+	CircuitBreakerFailureThreshold int
+
+	// CircuitBreakerCooldown holds the amount of time for which the circuit
+	// breaker stays open, before allowing a request through to probe whether
+	// Elasticsearch has recovered.
+	CircuitBreakerCooldown time.Duration
+
+	// PublishMaxRetries holds the maximum number of times a failed bulk
+	// request for indexing sampled trace IDs is retried, waiting
+	// PublishRetryBackoff before the first retry, and doubling the wait
+	// for each subsequent retry.
+	//
+	// If PublishMaxRetries is zero, failed requests are not retried.
+	PublishMaxRetries   int
+	PublishRetryBackoff time.Duration
+
+	// PublishRetryJitter holds the fraction of each retry backoff, in the
+	// range [0,1], which is randomised, so that servers do not retry in
+	// lockstep.
+	PublishRetryJitter float64
+
+	// PublishRetryTimeout holds the maximum amount of time to spend on a
+	// bulk request, including its retries. If PublishRetryTimeout is zero,
+	// requests are retried until PublishMaxRetries is reached.
+	PublishRetryTimeout time.Duration
 }
 
 // DataStreamConfig holds configuration to identify a data stream.
@@ -108,18 +358,132 @@ type StorageConfig struct {
 	StorageGCInterval time.Duration
 
 	// StorageLimit for the badger database, in bytes.
+	//
+	// Once 90% of StorageLimit is reached, allowing for the delay in
+	// updating the size of storage, events of traces without a sampling
+	// decision are no longer stored; they are instead kept or dropped
+	// according to DropOnStorageLimit. Traces already stored continue to
+	// be sampled as usual, draining storage.
 	StorageLimit uint64
 
+	// DropOnStorageLimit controls whether events which cannot be stored,
+	// due to StorageLimit being reached or a storage error, are dropped.
+	// By default they are kept, and indexed immediately.
+	DropOnStorageLimit bool
+
+	// FinalizeOnStorageLimit controls whether the sampling reservoirs are
+	// finalized early, without waiting for the next FlushInterval, once
+	// storage reaches its limit and events cannot be stored. Sampling decisions are then made for the
+	// buffered traces, possibly before all of their events have been
+	// received, and the stored events of traces which are not sampled are
+	// deleted to reclaim space. Events which cannot be stored while
+	// storage is at its limit are still kept or dropped according to
+	// DropOnStorageLimit.
+	//
+	// Early finalization happens at most once per quarter FlushInterval.
+	FinalizeOnStorageLimit bool
+
 	// TTL holds the amount of time before events and sampling decisions
 	// are expired from local storage.
+	//
+	// TTLs, OrphanTraceTimeout, and the finalization of traces at each
+	// FlushInterval are all measured by the server's clock from when
+	// events are received, and not from event timestamps. Traces are
+	// therefore finalized and expired as normal regardless of any clock
+	// skew in the agents reporting them, and event timestamps are stored
+	// and indexed unmodified.
 	TTL time.Duration
+
+	// OutcomeTTLs holds optional TTLs for events, keyed by event outcome:
+	// "success", "failure", or "unknown". Events with an outcome not in
+	// OutcomeTTLs expire after TTL.
+	//
+	// This may be used for buffering failed events longer than successful
+	// ones, e.g. to allow more time for the root transactions of failing
+	// traces to arrive. TTLs are keyed on the outcome of each event, as the
+	// outcome of the trace is not known until its root transaction is
+	// received.
+	OutcomeTTLs map[string]time.Duration
+
+	// OrphanTraceTimeout holds the amount of time after which a trace with
+	// stored events, but no observed root transaction, is considered to be
+	// orphaned. Orphaned traces are dropped, and their events deleted from
+	// local storage, rather than occupying storage until TTL.
+	//
+	// The root transaction of a trace may be received by another server,
+	// so OrphanTraceTimeout must comfortably exceed the time taken for
+	// remote sampling decisions to be received: up to the other server's
+	// FlushInterval, plus half of FlushInterval for this server to search
+	// for the decision, plus indexing latency. A remote decision received
+	// after the trace is dropped cannot be honoured, as its events have
+	// been deleted; such decisions are counted in monitoring as
+	// orphan_traces.late_remote_decisions.
+	//
+	// If OrphanTraceTimeout is zero, orphaned traces are kept until TTL.
+	// Otherwise it must be less than TTL.
+	OrphanTraceTimeout time.Duration
+
+	// StorageWriteWorkers holds the number of workers writing events and
+	// sampling decisions to storage asynchronously, decoupling storage
+	// writes from event processing.
+	//
+	// If StorageWriteWorkers is zero, writes are performed synchronously
+	// during event processing.
+	StorageWriteWorkers int
+
+	// StorageWriteQueueSize holds the maximum number of writes queued for
+	// the storage write workers. Once the queue is full, event processing
+	// blocks until there is room in the queue.
+	StorageWriteQueueSize int
+
+	// StoredLabelsLimit and StoredLabelsBytesLimit hold the maximum number
+	// of labels, and the maximum total size in bytes of their names and
+	// values, stored with each buffered trace event. String and numeric
+	// labels are counted together, with each numeric value counted as 8
+	// bytes. Excess labels are dropped from the stored event, and so are
+	// missing from the event if it is later reported. If a limit is zero,
+	// it is not applied.
+	StoredLabelsLimit      int
+	StoredLabelsBytesLimit int
+
+	// PreservedLabels holds the names of labels which are kept in
+	// preference to others when truncating the labels of stored events,
+	// e.g. labels relied upon for sampling.
+	PreservedLabels []string
+
+	// CorruptionThreshold, if greater than zero, is the number of storage
+	// corruption errors, such as checksum mismatches, after which storage
+	// is recreated with RecreateStorage. The buffered events and sampling
+	// decisions are discarded, in favour of remaining available. The
+	// count is reset each time storage is recreated.
+	//
+	// If CorruptionThreshold is zero, storage is never recreated.
+	CorruptionThreshold int
+
+	// RecreateStorage closes DB and Storage, discards the storage in
+	// StorageDir, and returns a newly opened DB and Storage to replace
+	// them. It is called while no storage operations are in progress.
+	//
+	// RecreateStorage must be specified if CorruptionThreshold is greater
+	// than zero.
+	RecreateStorage func() (*badger.DB, *eventstorage.ShardedReadWriter, error)
 }
 
 // Policy holds a tail-sampling policy: criteria for matching root transactions,
 // and the sampling parameters to apply to their traces.
 type Policy struct {
+	// Name holds an optional name for the policy, identifying it in
+	// monitoring metrics. Policies without a name are identified by
+	// their index. Names must be unique within a set of policies.
+	Name string
+
 	PolicyCriteria
 
+	// Match holds an optional matcher expression, which root transactions
+	// must match in addition to PolicyCriteria. Match may be used for
+	// expressing criteria which are combined with OR logic.
+	Match *PolicyMatcher
+
 	// SampleRate holds the tail-based sample rate to use for traces that
 	// match this policy.
 	SampleRate float64
@@ -161,6 +525,73 @@ type PolicyCriteria struct {
 	// from the same service) will be grouped together for sampling purposes,
 	// similar to head-based sampling.
 	TraceName string
+
+	// HasError, if true, restricts the policy to traces for which at
+	// least one error event has been observed, regardless of the root
+	// transaction's outcome.
+	//
+	// Errors observed before the root transaction is received are taken
+	// into account when it is matched against the policies. Errors which
+	// arrive later are taken into account when the sampling reservoirs
+	// are finalized: root transactions admitted to a reservoir but not
+	// sampled, which would have matched a HasError policy, are sampled
+	// according to that policy's sample rate. Traces dropped immediately
+	// on receipt of their root transactions are not reconsidered.
+	HasError bool
+
+	// MinDuration and MaxDuration, if positive, restrict the policy to
+	// traces whose root transaction duration is at least MinDuration,
+	// and less than MaxDuration, respectively. For example, a policy
+	// with MinDuration and a high sample rate may be used for keeping
+	// slow traces.
+	MinDuration time.Duration
+	MaxDuration time.Duration
+
+	// MinHTTPStatusCode and MaxHTTPStatusCode, if positive, restrict the
+	// policy to traces whose root transaction has an HTTP response status
+	// code of at least MinHTTPStatusCode, and at most MaxHTTPStatusCode,
+	// respectively. Root transactions without an HTTP response status code
+	// do not match. For example, MinHTTPStatusCode 500 and MaxHTTPStatusCode
+	// 599 match server errors, and equal values match a single status code.
+	MinHTTPStatusCode int
+	MaxHTTPStatusCode int
+
+	// MinSpanCount, if positive, restricts the policy to traces with at
+	// least MinSpanCount spans stored in local storage awaiting a sampling
+	// decision. For example, a policy with MinSpanCount and a high sample
+	// rate may be used for keeping complex traces.
+	//
+	// Like HasError, spans stored before the root transaction is received
+	// are counted when it is matched against the policies, and spans which
+	// arrive later are counted when the sampling reservoirs are finalized:
+	// root transactions admitted to a reservoir but not sampled, which
+	// would have matched a MinSpanCount policy, are sampled according to
+	// that policy's sample rate if enough spans have then been stored.
+	MinSpanCount int
+}
+
+func (c PolicyCriteria) validate() error {
+	if c.MinDuration < 0 {
+		return errors.New("MinDuration must not be negative")
+	}
+	if c.MaxDuration < 0 {
+		return errors.New("MaxDuration must not be negative")
+	}
+	if c.MaxDuration > 0 && c.MinDuration >= c.MaxDuration {
+		return errors.New("MinDuration must be less than MaxDuration")
+	}
+	for _, code := range []int{c.MinHTTPStatusCode, c.MaxHTTPStatusCode} {
+		if code != 0 && (code < 100 || code > 599) {
+			return errors.Errorf("HTTP status code %d out of range [100,599]", code)
+		}
+	}
+	if c.MaxHTTPStatusCode > 0 && c.MinHTTPStatusCode > c.MaxHTTPStatusCode {
+		return errors.New("MinHTTPStatusCode must not be greater than MaxHTTPStatusCode")
+	}
+	if c.MinSpanCount < 0 {
+		return errors.New("MinSpanCount must not be negative")
+	}
+	return nil
 }
 
 // Validate validates the configuration.
@@ -190,36 +621,127 @@ func (config LocalSamplingConfig) validate() error {
 	if config.MaxDynamicServices <= 0 {
 		return errors.New("MaxDynamicServices unspecified or negative")
 	}
+	if config.FinalizeConcurrency < 0 {
+		return errors.New("FinalizeConcurrency negative")
+	}
 	if len(config.Policies) == 0 {
 		return errors.New("Policies unspecified")
 	}
+	if err := validatePolicies(config.Policies, "Policies", "Policy"); err != nil {
+		return err
+	}
+	if err := validatePolicies(config.ShadowPolicies, "ShadowPolicies", "ShadowPolicy"); err != nil {
+		return err
+	}
+	if config.IngestRateDecayFactor <= 0 || config.IngestRateDecayFactor > 1 {
+		return errors.New("IngestRateDecayFactor unspecified or out of range (0,1]")
+	}
+	for environment, factor := range config.IngestRateDecayFactors {
+		if factor <= 0 || factor > 1 {
+			return errors.Errorf("IngestRateDecayFactors[%q] out of range (0,1]", environment)
+		}
+	}
+	if err := validateTraceIDList(config.TraceIDAllowList); err != nil {
+		return errors.Wrap(err, "TraceIDAllowList invalid")
+	}
+	if err := validateTraceIDList(config.TraceIDDenyList); err != nil {
+		return errors.Wrap(err, "TraceIDDenyList invalid")
+	}
+	if err := validateTraceNameNormalizers(config.TraceNameNormalizers); err != nil {
+		return err
+	}
+	switch config.DefaultTraceOutcome {
+	case "", "success", "failure", "unknown":
+	default:
+		return errors.Errorf("DefaultTraceOutcome invalid: unknown outcome %q", config.DefaultTraceOutcome)
+	}
+	switch config.ReservoirStrategy {
+	case "", "random", reservoirStrategyDiversity:
+	default:
+		return errors.Errorf("ReservoirStrategy invalid: unknown strategy %q", config.ReservoirStrategy)
+	}
+	switch config.TraceIDCollisionPolicy {
+	case "", traceIDCollisionMerge, traceIDCollisionSeparate, traceIDCollisionDrop:
+	default:
+		return errors.Errorf("TraceIDCollisionPolicy invalid: unknown policy %q", config.TraceIDCollisionPolicy)
+	}
+	if strings.Contains(config.DecisionMetricsDataset, "-") {
+		return errors.Errorf("DecisionMetricsDataset %q invalid: must not contain \"-\"", config.DecisionMetricsDataset)
+	}
+	for i, service := range config.BypassServices {
+		if service == "" {
+			return errors.Errorf("BypassServices %d invalid: empty service name", i)
+		}
+	}
+	return nil
+}
+
+// validatePolicies validates a non-empty set of policies, using the given
+// names to identify the policies in errors.
+func validatePolicies(policies []Policy, name, elemName string) error {
+	if len(policies) == 0 {
+		return nil
+	}
 	var anyDefaultPolicy bool
-	for i, policy := range config.Policies {
+	names := make(map[string]bool)
+	for i, policy := range policies {
 		if err := policy.validate(); err != nil {
-			return errors.Wrapf(err, "Policy %d invalid", i)
+			return errors.Wrapf(err, "%s %d invalid", elemName, i)
+		}
+		if policy.Name != "" {
+			if names[policy.Name] {
+				return errors.Errorf("%s %d invalid: duplicate Name %q", elemName, i, policy.Name)
+			}
+			names[policy.Name] = true
 		}
-		if policy.PolicyCriteria == (PolicyCriteria{}) {
+		if policy.PolicyCriteria == (PolicyCriteria{}) && policy.Match == nil {
 			anyDefaultPolicy = true
 		}
 	}
 	if !anyDefaultPolicy {
-		return errors.New("Policies does not contain a default (empty criteria) policy")
-	}
-	if config.IngestRateDecayFactor <= 0 || config.IngestRateDecayFactor > 1 {
-		return errors.New("IngestRateDecayFactor unspecified or out of range (0,1]")
+		return errors.Errorf("%s does not contain a default (empty criteria) policy", name)
 	}
 	return nil
 }
 
 func (config RemoteSamplingConfig) validate() error {
+	switch config.CompressionCodec {
+	case "", "gzip", "zstd", "none":
+	default:
+		return errors.Errorf("CompressionCodec %q unsupported", config.CompressionCodec)
+	}
 	if config.CompressionLevel < -1 || config.CompressionLevel > 9 {
 		return errors.New("CompressionLevel out of range [-1,9]")
 	}
+	if config.MaxBulkRequests < 0 {
+		return errors.New("MaxBulkRequests negative")
+	}
+	if config.BulkFlushBytes < 0 {
+		return errors.New("BulkFlushBytes negative")
+	}
 	if config.Elasticsearch == nil {
 		return errors.New("Elasticsearch unspecified")
 	}
 	if err := config.SampledTracesDataStream.validate(); err != nil {
-		return errors.New("SampledTracesDataStream unspecified or invalid")
+		return errors.Wrap(err, "SampledTracesDataStream unspecified or invalid")
+	}
+	if config.CircuitBreakerFailureThreshold < 0 {
+		return errors.New("CircuitBreakerFailureThreshold negative")
+	}
+	if config.CircuitBreakerFailureThreshold > 0 && config.CircuitBreakerCooldown <= 0 {
+		return errors.New("CircuitBreakerCooldown unspecified or negative")
+	}
+	if config.PublishMaxRetries < 0 {
+		return errors.New("PublishMaxRetries negative")
+	}
+	if config.PublishMaxRetries > 0 && config.PublishRetryBackoff <= 0 {
+		return errors.New("PublishRetryBackoff unspecified or negative")
+	}
+	if config.PublishRetryJitter < 0 || config.PublishRetryJitter > 1 {
+		return errors.New("PublishRetryJitter out of range [0,1]")
+	}
+	if config.PublishRetryTimeout < 0 {
+		return errors.New("PublishRetryTimeout negative")
 	}
 	return nil
 }
@@ -244,6 +766,40 @@ func (config StorageConfig) validate() error {
 	if config.TTL <= 0 {
 		return errors.New("TTL unspecified or negative")
 	}
+	for outcome, ttl := range config.OutcomeTTLs {
+		switch outcome {
+		case "success", "failure", "unknown":
+		default:
+			return errors.Errorf("OutcomeTTLs invalid: unknown outcome %q", outcome)
+		}
+		if ttl <= 0 {
+			return errors.Errorf("OutcomeTTLs invalid: TTL for outcome %q unspecified or negative", outcome)
+		}
+	}
+	if config.OrphanTraceTimeout < 0 {
+		return errors.New("OrphanTraceTimeout negative")
+	}
+	if config.OrphanTraceTimeout >= config.TTL {
+		return errors.New("OrphanTraceTimeout must be less than TTL")
+	}
+	if config.StorageWriteWorkers < 0 {
+		return errors.New("StorageWriteWorkers negative")
+	}
+	if config.StorageWriteQueueSize < 0 {
+		return errors.New("StorageWriteQueueSize negative")
+	}
+	if config.CorruptionThreshold < 0 {
+		return errors.New("CorruptionThreshold negative")
+	}
+	if config.CorruptionThreshold > 0 && config.RecreateStorage == nil {
+		return errors.New("RecreateStorage unspecified")
+	}
+	if config.StoredLabelsLimit < 0 {
+		return errors.New("StoredLabelsLimit negative")
+	}
+	if config.StoredLabelsBytesLimit < 0 {
+		return errors.New("StoredLabelsBytesLimit negative")
+	}
 	return nil
 }
 
@@ -251,5 +807,13 @@ func (p Policy) validate() error {
 	if p.SampleRate < 0 || p.SampleRate > 1 {
 		return errors.New("SampleRate unspecified or out of range [0,1]")
 	}
+	if err := p.PolicyCriteria.validate(); err != nil {
+		return err
+	}
+	if p.Match != nil {
+		if err := p.Match.validate(); err != nil {
+			return errors.Wrap(err, "Match invalid")
+		}
+	}
 	return nil
 }
@@ -6,6 +6,7 @@ package sampling_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/stretchr/testify/assert"
@@ -38,6 +39,10 @@ func TestNewProcessorConfigInvalid(t *testing.T) {
 	assertInvalidConfigError("invalid local sampling config: MaxDynamicServices unspecified or negative")
 	config.MaxDynamicServices = 1
 
+	config.FinalizeConcurrency = -1
+	assertInvalidConfigError("invalid local sampling config: FinalizeConcurrency negative")
+	config.FinalizeConcurrency = 0
+
 	assertInvalidConfigError("invalid local sampling config: Policies unspecified")
 	config.Policies = []sampling.Policy{{
 		PolicyCriteria: sampling.PolicyCriteria{ServiceName: "foo"},
@@ -50,28 +55,140 @@ func TestNewProcessorConfigInvalid(t *testing.T) {
 	}
 	config.Policies[0].SampleRate = 1.0
 
+	config.Policies = append(config.Policies, sampling.Policy{
+		Match: &sampling.PolicyMatcher{Any: []sampling.PolicyMatcher{{}}},
+	})
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: Match invalid: Any 0 invalid: exactly one of Criteria, All, or Any must be specified")
+	config.Policies = config.Policies[:1]
+
+	config.Policies = append(config.Policies, sampling.Policy{
+		PolicyCriteria: sampling.PolicyCriteria{MinDuration: -time.Second},
+	})
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: MinDuration must not be negative")
+	config.Policies[1].PolicyCriteria = sampling.PolicyCriteria{MaxDuration: -time.Second}
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: MaxDuration must not be negative")
+	config.Policies[1].PolicyCriteria = sampling.PolicyCriteria{MinDuration: time.Second, MaxDuration: time.Second}
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: MinDuration must be less than MaxDuration")
+	config.Policies[1].PolicyCriteria = sampling.PolicyCriteria{MinHTTPStatusCode: 600}
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: HTTP status code 600 out of range [100,599]")
+	config.Policies[1].PolicyCriteria = sampling.PolicyCriteria{MaxHTTPStatusCode: 99}
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: HTTP status code 99 out of range [100,599]")
+	config.Policies[1].PolicyCriteria = sampling.PolicyCriteria{MinHTTPStatusCode: 500, MaxHTTPStatusCode: 499}
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: MinHTTPStatusCode must not be greater than MaxHTTPStatusCode")
+	config.Policies[1].PolicyCriteria = sampling.PolicyCriteria{MinSpanCount: -1}
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: MinSpanCount must not be negative")
+	config.Policies[1].PolicyCriteria = sampling.PolicyCriteria{}
+	config.Policies[1].Match = &sampling.PolicyMatcher{Criteria: sampling.PolicyCriteria{MaxDuration: -time.Second}}
+	assertInvalidConfigError("invalid local sampling config: Policy 1 invalid: Match invalid: MaxDuration must not be negative")
+	config.Policies = config.Policies[:1]
+
+	config.Policies = append(config.Policies,
+		sampling.Policy{Name: "name", SampleRate: 0.5},
+		sampling.Policy{Name: "name", SampleRate: 0.1},
+	)
+	assertInvalidConfigError(`invalid local sampling config: Policy 2 invalid: duplicate Name "name"`)
+	config.Policies = config.Policies[:1]
+
 	for _, invalid := range []float64{-1, 0, 2.0} {
 		config.IngestRateDecayFactor = invalid
 		assertInvalidConfigError("invalid local sampling config: IngestRateDecayFactor unspecified or out of range (0,1]")
 	}
 	config.IngestRateDecayFactor = 0.5
+	config.IngestRateDecayFactors = map[string]float64{"production": 1.5}
+	assertInvalidConfigError(`invalid local sampling config: IngestRateDecayFactors["production"] out of range (0,1]`)
+	config.IngestRateDecayFactors = map[string]float64{"production": 0.1}
+
+	config.TraceIDAllowList = []string{"abc", "*"}
+	assertInvalidConfigError("invalid local sampling config: TraceIDAllowList invalid: empty trace ID")
+	config.TraceIDAllowList = nil
+
+	config.TraceIDDenyList = []string{""}
+	assertInvalidConfigError("invalid local sampling config: TraceIDDenyList invalid: empty trace ID")
+	config.TraceIDDenyList = nil
+
+	config.TraceNameNormalizers = []sampling.TraceNameNormalizer{{Pattern: `\d+`}, {Replacement: "x"}}
+	assertInvalidConfigError("invalid local sampling config: TraceNameNormalizers 1 invalid: Pattern unspecified")
+	config.TraceNameNormalizers = []sampling.TraceNameNormalizer{{Pattern: `(a`}}
+	assertInvalidConfigError("invalid local sampling config: TraceNameNormalizers 0 invalid: Pattern invalid: error parsing regexp: missing closing ): `(a`")
+	config.TraceNameNormalizers = nil
+
+	config.DefaultTraceOutcome = "error"
+	assertInvalidConfigError(`invalid local sampling config: DefaultTraceOutcome invalid: unknown outcome "error"`)
+	config.DefaultTraceOutcome = ""
+
+	config.ReservoirStrategy = "stratified"
+	assertInvalidConfigError(`invalid local sampling config: ReservoirStrategy invalid: unknown strategy "stratified"`)
+	config.ReservoirStrategy = ""
+
+	config.TraceIDCollisionPolicy = "ignore"
+	assertInvalidConfigError(`invalid local sampling config: TraceIDCollisionPolicy invalid: unknown policy "ignore"`)
+	config.TraceIDCollisionPolicy = ""
+
+	config.DecisionMetricsDataset = "apm-sampling"
+	assertInvalidConfigError(`invalid local sampling config: DecisionMetricsDataset "apm-sampling" invalid: must not contain "-"`)
+	config.DecisionMetricsDataset = ""
+
+	config.BypassServices = []string{"critical", ""}
+	assertInvalidConfigError("invalid local sampling config: BypassServices 1 invalid: empty service name")
+	config.BypassServices = nil
+
+	config.ShadowPolicies = []sampling.Policy{{
+		PolicyCriteria: sampling.PolicyCriteria{ServiceName: "foo"},
+	}}
+	assertInvalidConfigError("invalid local sampling config: ShadowPolicies does not contain a default (empty criteria) policy")
+	config.ShadowPolicies[0].PolicyCriteria = sampling.PolicyCriteria{}
+	config.ShadowPolicies[0].SampleRate = -1
+	assertInvalidConfigError("invalid local sampling config: ShadowPolicy 0 invalid: SampleRate unspecified or out of range [0,1]")
+	config.ShadowPolicies = nil
+
+	config.CompressionCodec = "lz4"
+	assertInvalidConfigError(`invalid remote sampling config: CompressionCodec "lz4" unsupported`)
+	config.CompressionCodec = "zstd"
 
 	config.CompressionLevel = 11
 	assertInvalidConfigError("invalid remote sampling config: CompressionLevel out of range [-1,9]")
 	config.CompressionLevel = 0
 
+	config.MaxBulkRequests = -1
+	assertInvalidConfigError("invalid remote sampling config: MaxBulkRequests negative")
+	config.MaxBulkRequests = 0
+
+	config.BulkFlushBytes = -1
+	assertInvalidConfigError("invalid remote sampling config: BulkFlushBytes negative")
+	config.BulkFlushBytes = 0
+
 	assertInvalidConfigError("invalid remote sampling config: Elasticsearch unspecified")
 	var elasticsearchClient struct {
 		elasticsearch.Client
 	}
 	config.Elasticsearch = elasticsearchClient
 
-	assertInvalidConfigError("invalid remote sampling config: SampledTracesDataStream unspecified or invalid")
+	assertInvalidConfigError("invalid remote sampling config: SampledTracesDataStream unspecified or invalid: Type unspecified")
 	config.SampledTracesDataStream = sampling.DataStreamConfig{
 		Type:      "traces",
 		Dataset:   "sampled",
-		Namespace: "testing",
+		Namespace: "Testing",
 	}
+	assertInvalidConfigError(`invalid remote sampling config: SampledTracesDataStream unspecified or invalid: Namespace invalid: "Testing" must be lowercase`)
+	config.SampledTracesDataStream.Namespace = "testing"
+
+	config.CircuitBreakerFailureThreshold = -1
+	assertInvalidConfigError("invalid remote sampling config: CircuitBreakerFailureThreshold negative")
+	config.CircuitBreakerFailureThreshold = 1
+	assertInvalidConfigError("invalid remote sampling config: CircuitBreakerCooldown unspecified or negative")
+	config.CircuitBreakerCooldown = time.Second
+
+	config.PublishMaxRetries = -1
+	assertInvalidConfigError("invalid remote sampling config: PublishMaxRetries negative")
+	config.PublishMaxRetries = 1
+	assertInvalidConfigError("invalid remote sampling config: PublishRetryBackoff unspecified or negative")
+	config.PublishRetryBackoff = time.Second
+	config.PublishRetryJitter = 2
+	assertInvalidConfigError("invalid remote sampling config: PublishRetryJitter out of range [0,1]")
+	config.PublishRetryJitter = 0.5
+	config.PublishRetryTimeout = -1
+	assertInvalidConfigError("invalid remote sampling config: PublishRetryTimeout negative")
+	config.PublishRetryTimeout = 0
 
 	assertInvalidConfigError("invalid storage config: DB unspecified")
 	config.DB = &badger.DB{}
@@ -87,4 +204,34 @@ func TestNewProcessorConfigInvalid(t *testing.T) {
 
 	assertInvalidConfigError("invalid storage config: TTL unspecified or negative")
 	config.TTL = 1
+
+	config.OutcomeTTLs = map[string]time.Duration{"error": time.Hour}
+	assertInvalidConfigError(`invalid storage config: OutcomeTTLs invalid: unknown outcome "error"`)
+	config.OutcomeTTLs = map[string]time.Duration{"failure": 0}
+	assertInvalidConfigError(`invalid storage config: OutcomeTTLs invalid: TTL for outcome "failure" unspecified or negative`)
+	config.OutcomeTTLs = nil
+
+	config.OrphanTraceTimeout = -1
+	assertInvalidConfigError("invalid storage config: OrphanTraceTimeout negative")
+	config.OrphanTraceTimeout = 1
+	assertInvalidConfigError("invalid storage config: OrphanTraceTimeout must be less than TTL")
+	config.OrphanTraceTimeout = 0
+
+	config.StorageWriteWorkers = -1
+	assertInvalidConfigError("invalid storage config: StorageWriteWorkers negative")
+	config.StorageWriteWorkers = 1
+	config.StorageWriteQueueSize = -1
+	assertInvalidConfigError("invalid storage config: StorageWriteQueueSize negative")
+	config.StorageWriteQueueSize = 0
+	config.StoredLabelsLimit = -1
+	assertInvalidConfigError("invalid storage config: StoredLabelsLimit negative")
+	config.StoredLabelsLimit = 0
+	config.StoredLabelsBytesLimit = -1
+	assertInvalidConfigError("invalid storage config: StoredLabelsBytesLimit negative")
+	config.StoredLabelsBytesLimit = 0
+	config.CorruptionThreshold = -1
+	assertInvalidConfigError("invalid storage config: CorruptionThreshold negative")
+	config.CorruptionThreshold = 1
+	assertInvalidConfigError("invalid storage config: RecreateStorage unspecified")
+	config.CorruptionThreshold = 0
 }
@@ -0,0 +1,81 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync/atomic"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// DecisionFunc reports whether a trace should be kept, given a summary of
+// the trace and the decision made by the policies. The returned decision
+// replaces that of the policies: returning summary.Sampled keeps the
+// policies' decision.
+//
+// A DecisionFunc is called sequentially, from a single goroutine, for each
+// trace finalized at each FlushInterval, so it need not be safe for
+// concurrent use with itself. It is however called concurrently with event
+// processing, so any state it shares with other code must be synchronized.
+// It blocks the publication of sampling decisions while running, so it
+// should return promptly. It must not modify or retain summary.Events.
+//
+// Traces whose root transactions are dropped without being admitted to a
+// sampling reservoir, e.g. by a policy with a sample rate of zero, are not
+// passed to the DecisionFunc, nor are traces signalled as complete with
+// TraceCompleted, as their decisions are made immediately.
+type DecisionFunc func(summary TraceSummary) bool
+
+// TraceSummary holds a summary of a trace being finalized, passed to a
+// DecisionFunc.
+type TraceSummary struct {
+	// TraceID holds the trace's ID.
+	TraceID string
+
+	// Events holds the trace's events stored locally, including its
+	// root transaction. Events of the trace received by other APM
+	// Servers are not included. Events may be empty if the events
+	// could not be read from local storage.
+	Events model.Batch
+
+	// Sampled reports whether the trace was sampled by the policies.
+	Sampled bool
+}
+
+// applyDecisionFunc calls DecisionFunc for each of the traces finalized by
+// the policies, sampled and dropped, returning the IDs of the traces to keep
+// and of those to drop.
+func (p *Processor) applyDecisionFunc(sampled, dropped []string) (keep, drop []string) {
+	var events model.Batch
+	decide := func(traceID string, policySampled bool) bool {
+		events = events[:0]
+		if err := p.eventStore.ReadTraceEvents(traceID, &events); err != nil {
+			p.rateLimitedLogger.Warnf("received error reading trace events: %s", err)
+			events = events[:0]
+		}
+		return p.config.DecisionFunc(TraceSummary{
+			TraceID: traceID,
+			Events:  events,
+			Sampled: policySampled,
+		})
+	}
+	for _, traceID := range sampled {
+		if decide(traceID, true) {
+			keep = append(keep, traceID)
+			continue
+		}
+		atomic.AddInt64(&p.eventMetrics.decisionFuncDropped, 1)
+		drop = append(drop, traceID)
+	}
+	for _, traceID := range dropped {
+		if !decide(traceID, false) {
+			drop = append(drop, traceID)
+			continue
+		}
+		atomic.AddInt64(&p.eventMetrics.decisionFuncKept, 1)
+		keep = append(keep, traceID)
+	}
+	return keep, drop
+}
@@ -0,0 +1,112 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"time"
+
+	"github.com/elastic/apm-server/internal/datastreams"
+	"github.com/elastic/apm-server/internal/model"
+)
+
+const (
+	// decisionsMetricsetName is the name of the metricset published with
+	// counts of the traces kept and dropped by tail-sampling.
+	decisionsMetricsetName = "tail_sampling_decisions"
+
+	// decisionsPolicyLabel is the label recording the name of the policy
+	// which made the decisions counted in a metricset.
+	decisionsPolicyLabel = "tail_sampling_policy"
+)
+
+// decisionKey holds the dimensions by which sampling decisions are counted.
+type decisionKey struct {
+	policy      string
+	serviceName string
+}
+
+// decisionCounts holds the number of traces kept and dropped.
+type decisionCounts struct {
+	kept    int64
+	dropped int64
+}
+
+// addDecisions adds the decisions counted by group, for the given policy and
+// service, to g.decisions, and resets the group's counts. addDecisions must
+// be called with g.mu held.
+func (g *traceGroups) addDecisions(policy, serviceName string, group *traceGroup) {
+	if group.decisions == nil {
+		return
+	}
+	group.mu.Lock()
+	counts := *group.decisions
+	*group.decisions = decisionCounts{}
+	group.mu.Unlock()
+	g.addDecisionCounts(decisionKey{policy: policy, serviceName: serviceName}, counts)
+}
+
+// addDecisionCounts adds counts to g.decisions. addDecisionCounts must be
+// called with g.mu held.
+func (g *traceGroups) addDecisionCounts(key decisionKey, counts decisionCounts) {
+	if counts == (decisionCounts{}) {
+		return
+	}
+	total := g.decisions[key]
+	total.kept += counts.kept
+	total.dropped += counts.dropped
+	g.decisions[key] = total
+}
+
+// takeDecisions returns the number of root transactions kept and dropped
+// since the last call, by policy and service, and resets the counts. Root
+// transactions which were admitted to a sampling reservoir are counted once
+// the reservoir has been finalized.
+//
+// takeDecisions returns nil if decisions are not being counted.
+func (g *traceGroups) takeDecisions() map[decisionKey]decisionCounts {
+	if !g.countDecisions {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	decisions := g.decisions
+	g.decisions = make(map[decisionKey]decisionCounts)
+	return decisions
+}
+
+// makeDecisionsMetricsets returns metricset events recording the number of
+// traces kept and dropped in decisions, with the given timestamp, for
+// indexing into the metrics data stream with the given dataset.
+func makeDecisionsMetricsets(decisions map[decisionKey]decisionCounts, dataset string, timestamp time.Time) model.Batch {
+	batch := make(model.Batch, 0, len(decisions))
+	for key, counts := range decisions {
+		batch = append(batch, model.APMEvent{
+			Timestamp: timestamp,
+			DataStream: model.DataStream{
+				Type:    datastreams.MetricsType,
+				Dataset: dataset,
+			},
+			Service: model.Service{Name: key.serviceName},
+			Labels: model.Labels{
+				decisionsPolicyLabel: model.LabelValue{Value: key.policy},
+			},
+			Processor: model.MetricsetProcessor,
+			Metricset: &model.Metricset{
+				Name: decisionsMetricsetName,
+				Samples: map[string]model.MetricsetSample{
+					"tail_sampling.traces.kept": {
+						Type:  model.MetricTypeCounter,
+						Value: float64(counts.kept),
+					},
+					"tail_sampling.traces.dropped": {
+						Type:  model.MetricTypeCounter,
+						Value: float64(counts.dropped),
+					},
+				},
+			},
+		})
+	}
+	return batch
+}
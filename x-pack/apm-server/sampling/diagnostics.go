@@ -0,0 +1,117 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// storageKeysMaxAge is how long the count of keys in storage is reused by
+// StorageDiagnostics before counting them again, as counting the keys
+// requires iterating over storage.
+const storageKeysMaxAge = time.Minute
+
+// StorageDiagnostics holds a snapshot of the health of tail-sampling local
+// storage, as returned by Processor.StorageDiagnostics.
+type StorageDiagnostics struct {
+	// Keys holds the number of unexpired keys in storage, i.e. trace
+	// events and sampling decisions. The count may be up to a minute old.
+	Keys uint64
+
+	// Traces holds the approximate number of traces with events in
+	// storage awaiting a sampling decision.
+	Traces int
+
+	// OldestTraceAge holds the time elapsed since the first event of the
+	// oldest trace awaiting a sampling decision was stored, or zero if
+	// there are no such traces.
+	OldestTraceAge time.Duration
+
+	// LSMSize and ValueLogSize hold the size of storage's LSM tree and
+	// value log, in bytes.
+	LSMSize      int64
+	ValueLogSize int64
+
+	// Limit holds StorageLimit, in bytes, or zero if storage is unlimited.
+	// LimitUsage holds the ratio of the size of storage to Limit, or zero
+	// if storage is unlimited.
+	Limit      uint64
+	LimitUsage float64
+}
+
+// StorageDiagnostics returns a snapshot of the health of local storage.
+// It is intended to be cheap enough to be collected periodically.
+func (p *Processor) StorageDiagnostics() StorageDiagnostics {
+	traces, oldest := p.traceFirstSeen.oldest()
+	diagnostics := StorageDiagnostics{
+		Keys:   p.storageKeys.count(p.eventStore),
+		Traces: traces,
+		Limit:  p.config.StorageLimit,
+	}
+	if traces > 0 {
+		diagnostics.OldestTraceAge = time.Since(oldest)
+	}
+	diagnostics.LSMSize, diagnostics.ValueLogSize = p.eventStore.Size()
+	if diagnostics.Limit > 0 {
+		size := diagnostics.LSMSize + diagnostics.ValueLogSize
+		diagnostics.LimitUsage = float64(size) / float64(diagnostics.Limit)
+	}
+	return diagnostics
+}
+
+// CollectStorageDiagnostics may be called to collect the metrics returned by
+// StorageDiagnostics. It is intended to be used with libbeat/monitoring.NewFunc.
+//
+// The metrics should be added to the "apm-server.sampling" registry.
+func (p *Processor) CollectStorageDiagnostics(_ monitoring.Mode, V monitoring.Visitor) {
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+
+	diagnostics := p.StorageDiagnostics()
+	monitoring.ReportInt(V, "keys", int64(diagnostics.Keys))
+	monitoring.ReportInt(V, "traces", int64(diagnostics.Traces))
+	monitoring.ReportInt(V, "oldest_trace_age_ms", diagnostics.OldestTraceAge.Milliseconds())
+	monitoring.ReportInt(V, "lsm_size", diagnostics.LSMSize)
+	monitoring.ReportInt(V, "value_log_size", diagnostics.ValueLogSize)
+	monitoring.ReportInt(V, "limit", int64(diagnostics.Limit))
+	monitoring.ReportFloat(V, "limit_usage", diagnostics.LimitUsage)
+}
+
+// storageKeyCounter counts the keys in storage, reusing the count for
+// maxAge.
+type storageKeyCounter struct {
+	mu      sync.Mutex
+	keys    uint64
+	counted time.Time
+	maxAge  time.Duration
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+func newStorageKeyCounter(maxAge time.Duration) *storageKeyCounter {
+	return &storageKeyCounter{maxAge: maxAge, now: time.Now}
+}
+
+// count returns the number of keys in rw's storage, counting them if they
+// have not been counted within maxAge. If the keys cannot be counted, the
+// previous count is returned.
+func (c *storageKeyCounter) count(rw *wrappedRW) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if !c.counted.IsZero() && now.Sub(c.counted) < c.maxAge {
+		return c.keys
+	}
+	if keys, err := rw.KeyCount(); err == nil {
+		c.keys = keys
+		c.counted = now
+	}
+	return c.keys
+}
@@ -0,0 +1,67 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"time"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// droppedTracesMetricsetName is the name of the metricset published with
+// counts of traces dropped by tail-sampling.
+const droppedTracesMetricsetName = "dropped_traces"
+
+// droppedTraceKey holds the dimensions by which dropped traces are counted.
+//
+// The dimensions are deliberately limited to bound cardinality.
+type droppedTraceKey struct {
+	serviceName        string
+	serviceEnvironment string
+	transactionType    string
+	transactionName    string
+}
+
+func makeDroppedTraceKey(transactionEvent *model.APMEvent) droppedTraceKey {
+	return droppedTraceKey{
+		serviceName:        transactionEvent.Service.Name,
+		serviceEnvironment: transactionEvent.Service.Environment,
+		transactionType:    transactionEvent.Transaction.Type,
+		transactionName:    transactionEvent.Transaction.Name,
+	}
+}
+
+// makeDroppedTracesMetricsets returns metricset events recording the number
+// of dropped traces in dropped, with the given timestamp.
+//
+// The metricsets have the same shape as transaction metrics, with the number
+// of dropped traces recorded as the document count, so they are stored in the
+// internal metrics data stream alongside them.
+func makeDroppedTracesMetricsets(dropped map[droppedTraceKey]int64, timestamp time.Time) model.Batch {
+	batch := make(model.Batch, 0, len(dropped))
+	for key, count := range dropped {
+		if count <= 0 {
+			continue
+		}
+		batch = append(batch, model.APMEvent{
+			Timestamp: timestamp,
+			Service: model.Service{
+				Name:        key.serviceName,
+				Environment: key.serviceEnvironment,
+			},
+			Processor: model.MetricsetProcessor,
+			Metricset: &model.Metricset{
+				Name:     droppedTracesMetricsetName,
+				DocCount: count,
+			},
+			Transaction: &model.Transaction{
+				Name: key.transactionName,
+				Type: key.transactionType,
+				Root: true,
+			},
+		})
+	}
+	return batch
+}
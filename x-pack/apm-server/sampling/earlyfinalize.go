@@ -0,0 +1,92 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// earlyFinalizer requests that the sampling reservoirs be finalized before
+// the next FlushInterval when storage reaches its limit, so that decisions
+// are made for the buffered traces and the stored events of those which are
+// not sampled can be deleted, reclaiming space for new traces.
+//
+// Storage size is only updated periodically, so storage may remain at its
+// limit for some time after finalizing. Requests are therefore limited to
+// one per minInterval.
+//
+// A nil *earlyFinalizer never requests early finalization, for when
+// FinalizeOnStorageLimit is disabled.
+type earlyFinalizer struct {
+	// runs and traces count the early finalizations, and the traces
+	// finalized by them. They are accessed atomically, and must be
+	// first for 64-bit alignment.
+	runs   int64
+	traces int64
+
+	minInterval time.Duration
+	requests    chan struct{}
+
+	mu   sync.Mutex
+	last time.Time
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+func newEarlyFinalizer(enabled bool, minInterval time.Duration) *earlyFinalizer {
+	if !enabled {
+		return nil
+	}
+	return &earlyFinalizer{
+		minInterval: minInterval,
+		requests:    make(chan struct{}, 1),
+		now:         time.Now,
+	}
+}
+
+// request requests early finalization, unless it was last requested less
+// than minInterval ago.
+func (f *earlyFinalizer) request() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	if now.Sub(f.last) < f.minInterval {
+		return
+	}
+	f.last = now
+	select {
+	case f.requests <- struct{}{}:
+	default:
+	}
+}
+
+// requested returns a channel which receives a value when early finalization
+// is requested. If f is nil, the channel is nil, and never receives.
+func (f *earlyFinalizer) requested() <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	return f.requests
+}
+
+// finalized records that an early finalization decided n traces.
+func (f *earlyFinalizer) finalized(n int) {
+	atomic.AddInt64(&f.runs, 1)
+	atomic.AddInt64(&f.traces, int64(n))
+}
+
+func (f *earlyFinalizer) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "runs", atomic.LoadInt64(&f.runs))
+	monitoring.ReportInt(V, "traces", atomic.LoadInt64(&f.traces))
+}
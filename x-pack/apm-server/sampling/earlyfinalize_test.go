@@ -0,0 +1,52 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEarlyFinalizer(t *testing.T) {
+	now := time.Now()
+	f := newEarlyFinalizer(true, time.Minute)
+	f.now = func() time.Time { return now }
+
+	requested := func() bool {
+		select {
+		case <-f.requested():
+			return true
+		default:
+			return false
+		}
+	}
+
+	f.request()
+	assert.True(t, requested())
+
+	// Requests are limited to one per minInterval.
+	now = now.Add(time.Minute - time.Nanosecond)
+	f.request()
+	assert.False(t, requested())
+	now = now.Add(time.Nanosecond)
+	f.request()
+	f.request()
+	assert.True(t, requested())
+	assert.False(t, requested())
+
+	f.finalized(3)
+	f.finalized(2)
+	assert.Equal(t, int64(2), f.runs)
+	assert.Equal(t, int64(5), f.traces)
+}
+
+func TestEarlyFinalizerDisabled(t *testing.T) {
+	f := newEarlyFinalizer(false, time.Minute)
+	assert.Nil(t, f)
+	f.request()
+	assert.Nil(t, f.requested())
+}
@@ -0,0 +1,65 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"time"
+)
+
+// errorTraces tracks the IDs of traces for which error events have been
+// observed, for matching root transactions against policies with HasError
+// criteria.
+//
+// errorTraces is safe for concurrent use. A nil *errorTraces contains no
+// traces.
+type errorTraces struct {
+	mu     sync.Mutex
+	traces map[string]time.Time
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+func newErrorTraces() *errorTraces {
+	return &errorTraces{
+		traces: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// observe records that an error event has been observed for traceID.
+func (t *errorTraces) observe(traceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.traces[traceID]; !ok {
+		t.traces[traceID] = t.now()
+	}
+}
+
+// contains reports whether an error event has been observed for traceID.
+func (t *errorTraces) contains(traceID string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.traces[traceID]
+	return ok
+}
+
+// expire stops tracking traces whose first error was observed more than
+// maxAge ago, whose events have expired from local storage.
+func (t *errorTraces) expire(maxAge time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := t.now().Add(-maxAge)
+	for traceID, observed := range t.traces {
+		if observed.Before(cutoff) {
+			delete(t.traces, traceID)
+		}
+	}
+}
@@ -12,21 +12,79 @@ import (
 )
 
 const (
-	defaultValueLogFileSize = 128 * 1024 * 1024
+	// DefaultValueLogFileSize is the value log file size used by OpenBadger
+	// when the value log file size specified is <= 0.
+	DefaultValueLogFileSize = 128 * 1024 * 1024
 )
 
 // OpenBadger creates or opens a Badger database with the specified location
-// and value log file size. If the value log file size is <= 0, the default
-// of 128MB will be used.
+// and value log file size. The value log file size is the maximum size of each
+// of Badger's value log files, which hold the values of stored events; a new
+// file is started when the current one is full, and disk space is reclaimed
+// by garbage collecting whole files. If the value log file size is <= 0,
+// DefaultValueLogFileSize will be used.
+//
+// The effective options are logged, along with the requested value log file
+// size, so that storage behaviour can be reproduced when debugging.
 //
 // NOTE(axw) only one badger.DB for a given storage directory may be open at any given time.
 func OpenBadger(storageDir string, valueLogFileSize int64) (*badger.DB, error) {
 	logger := logp.NewLogger(logs.Sampling)
 	badgerOpts := badger.DefaultOptions(storageDir)
-	badgerOpts.ValueLogFileSize = defaultValueLogFileSize
+	badgerOpts.ValueLogFileSize = DefaultValueLogFileSize
 	if valueLogFileSize > 0 {
 		badgerOpts.ValueLogFileSize = valueLogFileSize
 	}
 	badgerOpts.Logger = &LogpAdaptor{Logger: logger}
+	fields := badgerOptionsFields(badgerOpts)
+	fields = append(fields, "badger.requested_value_log_file_size", valueLogFileSize)
+	logger.Infow("opening badger database", fields...)
+	return badger.Open(badgerOpts)
+}
+
+// badgerOptionsFields returns the options which affect storage behaviour as
+// key/value pairs, for logging.
+func badgerOptionsFields(opts badger.Options) []interface{} {
+	return []interface{}{
+		"badger.dir", opts.Dir,
+		"badger.value_dir", opts.ValueDir,
+		"badger.in_memory", opts.InMemory,
+		"badger.sync_writes", opts.SyncWrites,
+		"badger.table_loading_mode", int(opts.TableLoadingMode),
+		"badger.value_log_loading_mode", int(opts.ValueLogLoadingMode),
+		"badger.num_versions_to_keep", opts.NumVersionsToKeep,
+		"badger.truncate", opts.Truncate,
+		"badger.compression", int(opts.Compression),
+		"badger.zstd_compression_level", opts.ZSTDCompressionLevel,
+		"badger.max_table_size", opts.MaxTableSize,
+		"badger.level_size_multiplier", opts.LevelSizeMultiplier,
+		"badger.max_levels", opts.MaxLevels,
+		"badger.value_threshold", opts.ValueThreshold,
+		"badger.num_memtables", opts.NumMemtables,
+		"badger.block_size", opts.BlockSize,
+		"badger.bloom_false_positive", opts.BloomFalsePositive,
+		"badger.keep_l0_in_memory", opts.KeepL0InMemory,
+		"badger.block_cache_size", opts.BlockCacheSize,
+		"badger.index_cache_size", opts.IndexCacheSize,
+		"badger.num_level_zero_tables", opts.NumLevelZeroTables,
+		"badger.num_level_zero_tables_stall", opts.NumLevelZeroTablesStall,
+		"badger.level_one_size", opts.LevelOneSize,
+		"badger.value_log_file_size", opts.ValueLogFileSize,
+		"badger.value_log_max_entries", opts.ValueLogMaxEntries,
+		"badger.num_compactors", opts.NumCompactors,
+		"badger.compact_l0_on_close", opts.CompactL0OnClose,
+		"badger.log_rotates_to_flush", opts.LogRotatesToFlush,
+		"badger.verify_value_checksum", opts.VerifyValueChecksum,
+		"badger.checksum_verification_mode", int(opts.ChecksumVerificationMode),
+		"badger.detect_conflicts", opts.DetectConflicts,
+	}
+}
+
+// OpenBadgerInMemory creates a Badger database which is held entirely in
+// memory, e.g. for exercising tail-sampling without touching storage on disk.
+func OpenBadgerInMemory() (*badger.DB, error) {
+	logger := logp.NewLogger(logs.Sampling)
+	badgerOpts := badger.DefaultOptions("").WithInMemory(true)
+	badgerOpts.Logger = &LogpAdaptor{Logger: logger}
 	return badger.Open(badgerOpts)
 }
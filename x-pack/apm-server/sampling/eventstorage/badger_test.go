@@ -0,0 +1,32 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+func TestOpenBadgerLogsOptions(t *testing.T) {
+	require.NoError(t, logp.DevelopmentSetup(logp.ToObserverOutput()))
+
+	storageDir := t.TempDir()
+	db, err := eventstorage.OpenBadger(storageDir, -1)
+	require.NoError(t, err)
+	defer db.Close()
+
+	logs := logp.ObserverLogs().FilterMessage("opening badger database").TakeAll()
+	require.Len(t, logs, 1)
+	fields := logs[0].ContextMap()
+	assert.Equal(t, storageDir, fields["badger.dir"])
+	assert.Equal(t, int64(-1), fields["badger.requested_value_log_file_size"])
+	assert.Equal(t, int64(128*1024*1024), fields["badger.value_log_file_size"])
+	assert.Contains(t, fields, "badger.num_compactors")
+}
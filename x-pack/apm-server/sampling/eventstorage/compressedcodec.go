@@ -0,0 +1,114 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+const (
+	// CompressionNone stores encoded events as they are.
+	CompressionNone = "none"
+
+	// CompressionSnappy compresses encoded events with snappy, which is
+	// cheap in CPU but provides modest compression.
+	CompressionSnappy = "snappy"
+
+	// CompressionZstd compresses encoded events with zstd, which provides
+	// better compression than snappy, at a higher CPU cost.
+	CompressionZstd = "zstd"
+)
+
+// Each compressed value is prefixed with a byte identifying the compression
+// used. Values which do not start with one of these prefixes are decoded
+// as they are, so values written without compression remain readable when
+// compression is enabled, and vice versa.
+const (
+	snappyPrefix byte = 0x01
+	zstdPrefix   byte = 0x02
+)
+
+// CompressedCodec is an implementation of Codec which compresses the events
+// encoded by another Codec.
+//
+// The wrapped Codec's encoded events must not start with the bytes 0x01 or
+// 0x02, which identify compressed values. JSONCodec satisfies this.
+type CompressedCodec struct {
+	codec  Codec
+	prefix byte
+
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+}
+
+// NewCompressedCodec returns a new CompressedCodec, compressing the events
+// encoded by codec with the given compression: CompressionNone,
+// CompressionSnappy, or CompressionZstd.
+//
+// Events compressed with any of the supported compressions can be decoded,
+// regardless of the compression used for encoding.
+func NewCompressedCodec(codec Codec, compression string) (*CompressedCodec, error) {
+	c := &CompressedCodec{codec: codec}
+	switch compression {
+	case CompressionNone:
+	case CompressionSnappy:
+		c.prefix = snappyPrefix
+	case CompressionZstd:
+		c.prefix = zstdPrefix
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	var err error
+	c.zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return nil, err
+	}
+	c.zstdDecoder, err = zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DecodeEvent decompresses data, if it is compressed, and decodes it into
+// event with the wrapped Codec.
+func (c *CompressedCodec) DecodeEvent(data []byte, event *model.APMEvent) error {
+	if len(data) > 0 {
+		var err error
+		switch data[0] {
+		case snappyPrefix:
+			data, err = snappy.Decode(nil, data[1:])
+		case zstdPrefix:
+			data, err = c.zstdDecoder.DecodeAll(data[1:], nil)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decompress event: %w", err)
+		}
+	}
+	return c.codec.DecodeEvent(data, event)
+}
+
+// EncodeEvent encodes event with the wrapped Codec, and compresses it.
+func (c *CompressedCodec) EncodeEvent(event *model.APMEvent) ([]byte, error) {
+	data, err := c.codec.EncodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	switch c.prefix {
+	case snappyPrefix:
+		compressed := make([]byte, 1+snappy.MaxEncodedLen(len(data)))
+		compressed[0] = snappyPrefix
+		encoded := snappy.Encode(compressed[1:], data)
+		return compressed[:1+len(encoded)], nil
+	case zstdPrefix:
+		return c.zstdEncoder.EncodeAll(data, []byte{zstdPrefix}), nil
+	}
+	return data, nil
+}
@@ -0,0 +1,111 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+var compressions = []string{
+	eventstorage.CompressionNone,
+	eventstorage.CompressionSnappy,
+	eventstorage.CompressionZstd,
+}
+
+func TestCompressedCodec(t *testing.T) {
+	events := makeTraceEvents("0102030405060708090a0b0c0d0e0f10", 3)
+	for _, encodeCompression := range compressions {
+		encoder, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, encodeCompression)
+		require.NoError(t, err)
+		for _, event := range events {
+			data, err := encoder.EncodeEvent(event)
+			require.NoError(t, err)
+			uncompressed, err := eventstorage.JSONCodec{}.EncodeEvent(event)
+			require.NoError(t, err)
+			if encodeCompression == eventstorage.CompressionNone {
+				assert.Equal(t, uncompressed, data)
+			} else {
+				assert.Less(t, len(data), len(uncompressed))
+			}
+
+			// Events may be decoded regardless of the compression
+			// used to encode them.
+			for _, decodeCompression := range compressions {
+				decoder, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, decodeCompression)
+				require.NoError(t, err)
+				var decoded model.APMEvent
+				require.NoError(t, decoder.DecodeEvent(data, &decoded))
+				assert.Equal(t, *event, decoded)
+			}
+		}
+	}
+}
+
+func TestCompressedCodecInvalid(t *testing.T) {
+	_, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, "lz4")
+	assert.EqualError(t, err, `unknown compression "lz4"`)
+
+	codec, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, eventstorage.CompressionZstd)
+	require.NoError(t, err)
+	for _, data := range [][]byte{{0x01, 0xff, 0xff}, {0x02, 0xff, 0xff}} {
+		var event model.APMEvent
+		assert.ErrorContains(t, codec.DecodeEvent(data, &event), "failed to decompress event")
+	}
+}
+
+// BenchmarkCompressedCodec measures encoding and decoding a representative
+// trace with each compression, reporting the encoded size per event, for
+// comparison with the uncompressed JSON baseline.
+func BenchmarkCompressedCodec(b *testing.B) {
+	events := makeTraceEvents("0102030405060708090a0b0c0d0e0f10", 10)
+	for _, compression := range compressions {
+		codec, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, compression)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(compression+"/encode", func(b *testing.B) {
+			var size int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				size = 0
+				for _, event := range events {
+					data, err := codec.EncodeEvent(event)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size += len(data)
+				}
+			}
+			b.ReportMetric(float64(size)/float64(len(events)), "bytes/event")
+		})
+		b.Run(compression+"/decode", func(b *testing.B) {
+			encoded := make([][]byte, len(events))
+			for i, event := range events {
+				data, err := codec.EncodeEvent(event)
+				if err != nil {
+					b.Fatal(err)
+				}
+				encoded[i] = data
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, data := range encoded {
+					var event model.APMEvent
+					if err := codec.DecodeEvent(data, &event); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -15,7 +15,16 @@ import (
 )
 
 // JSONCodec is an implementation of Codec, using JSON encoding.
-type JSONCodec struct{}
+//
+// By default events are encoded in compact form, with no insignificant
+// whitespace, to minimise the storage used by each buffered event.
+type JSONCodec struct {
+	// Pretty controls whether events are encoded with indentation and
+	// newlines, for human inspection of stored events. Pretty should not
+	// be set for codecs used for writing to storage, as it considerably
+	// increases the size of each event.
+	Pretty bool
+}
 
 // DecodeEvent decodes data as JSON into event.
 func (JSONCodec) DecodeEvent(data []byte, event *model.APMEvent) error {
@@ -23,6 +32,9 @@ func (JSONCodec) DecodeEvent(data []byte, event *model.APMEvent) error {
 }
 
 // EncodeEvent encodes event as JSON.
-func (JSONCodec) EncodeEvent(event *model.APMEvent) ([]byte, error) {
+func (c JSONCodec) EncodeEvent(event *model.APMEvent) ([]byte, error) {
+	if c.Pretty {
+		return json.MarshalIndent(event, "", "  ")
+	}
 	return json.Marshal(event)
 }
@@ -0,0 +1,97 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+func TestJSONCodec(t *testing.T) {
+	for _, event := range makeTraceEvents("0102030405060708090a0b0c0d0e0f10", 3) {
+		compact, err := eventstorage.JSONCodec{}.EncodeEvent(event)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, json.Compact(&buf, compact))
+		assert.Equal(t, buf.String(), string(compact), "expected compact encoding")
+
+		pretty, err := eventstorage.JSONCodec{Pretty: true}.EncodeEvent(event)
+		require.NoError(t, err)
+		assert.Greater(t, len(pretty), len(compact))
+		buf.Reset()
+		require.NoError(t, json.Compact(&buf, pretty))
+		assert.Equal(t, string(compact), buf.String())
+
+		// Both forms decode to the same event.
+		for _, data := range [][]byte{compact, pretty} {
+			var decoded model.APMEvent
+			require.NoError(t, eventstorage.JSONCodec{}.DecodeEvent(data, &decoded))
+			assert.Equal(t, *event, decoded)
+		}
+	}
+}
+
+// BenchmarkJSONCodecEncode measures encoding a representative trace, made up
+// of a transaction and several spans, reporting the encoded size per event.
+func BenchmarkJSONCodecEncode(b *testing.B) {
+	events := makeTraceEvents("0102030405060708090a0b0c0d0e0f10", 10)
+	for _, pretty := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pretty=%t", pretty), func(b *testing.B) {
+			codec := eventstorage.JSONCodec{Pretty: pretty}
+			var size int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				size = 0
+				for _, event := range events {
+					data, err := codec.EncodeEvent(event)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size += len(data)
+				}
+			}
+			b.ReportMetric(float64(size)/float64(len(events)), "bytes/event")
+		})
+	}
+}
+
+// makeTraceEvents returns a transaction and numSpans spans for traceID,
+// sharing the transaction's service, agent, and host metadata.
+func makeTraceEvents(traceID string, numSpans int) []*model.APMEvent {
+	transaction := makeTransaction("0102030405060708", traceID)
+	transaction.Timestamp = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	transaction.Event.Duration = 123 * time.Millisecond
+	transaction.Transaction.Name = "GET /orders/{id}"
+	transaction.Transaction.Type = "request"
+	events := []*model.APMEvent{transaction}
+	for i := 0; i < numSpans; i++ {
+		span := *transaction
+		span.Processor = model.SpanProcessor
+		span.Transaction = nil
+		span.Parent = model.Parent{ID: transaction.Transaction.ID}
+		span.Timestamp = transaction.Timestamp.Add(time.Duration(i) * time.Millisecond)
+		span.Event.Duration = 10 * time.Millisecond
+		span.Span = &model.Span{
+			ID:   fmt.Sprintf("01020304050607%02x", i),
+			Name: "SELECT FROM orders",
+			Type: "db",
+			DestinationService: &model.DestinationService{
+				Resource: "postgresql",
+			},
+		}
+		events = append(events, &span)
+	}
+	return events
+}
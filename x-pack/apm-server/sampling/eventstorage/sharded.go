@@ -7,6 +7,7 @@ package eventstorage
 import (
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/hashicorp/go-multierror"
@@ -56,6 +57,30 @@ func (s *ShardedReadWriter) ReadTraceEvents(traceID string, out *model.Batch) er
 	return s.getWriter(traceID).ReadTraceEvents(traceID, out)
 }
 
+// ReadTraceEventsBatch calls Writer.ReadTraceEventsBatch for the trace IDs
+// belonging to each shard, using sharded, locked, Writers.
+func (s *ShardedReadWriter) ReadTraceEventsBatch(traceIDs []string, out *model.Batch) error {
+	shardTraceIDs := make([][]string, len(s.readWriters))
+	for _, traceID := range traceIDs {
+		i := s.shardIndex(traceID)
+		shardTraceIDs[i] = append(shardTraceIDs[i], traceID)
+	}
+	for i, traceIDs := range shardTraceIDs {
+		if len(traceIDs) == 0 {
+			continue
+		}
+		if err := s.readWriters[i].ReadTraceEventsBatch(traceIDs, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadTraceEventsRange calls Writer.ReadTraceEventsRange, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ReadTraceEventsRange(traceID string, start, end time.Time, out *model.Batch) error {
+	return s.getWriter(traceID).ReadTraceEventsRange(traceID, start, end, out)
+}
+
 // WriteTraceEvent calls Writer.WriteTraceEvent, using a sharded, locked, Writer.
 func (s *ShardedReadWriter) WriteTraceEvent(traceID, id string, event *model.APMEvent, opts WriterOpts) error {
 	return s.getWriter(traceID).WriteTraceEvent(traceID, id, event, opts)
@@ -82,9 +107,14 @@ func (s *ShardedReadWriter) DeleteTraceEvent(traceID, id string) error {
 // conflicts and ensure all events are reported once a sampling decision
 // has been recorded.
 func (s *ShardedReadWriter) getWriter(traceID string) *lockedReadWriter {
+	return &s.readWriters[s.shardIndex(traceID)]
+}
+
+// shardIndex returns the index of the shard for the given trace ID.
+func (s *ShardedReadWriter) shardIndex(traceID string) int {
 	var h xxhash.Digest
 	h.WriteString(traceID)
-	return &s.readWriters[h.Sum64()%uint64(len(s.readWriters))]
+	return int(h.Sum64() % uint64(len(s.readWriters)))
 }
 
 type lockedReadWriter struct {
@@ -110,6 +140,18 @@ func (rw *lockedReadWriter) ReadTraceEvents(traceID string, out *model.Batch) er
 	return rw.rw.ReadTraceEvents(traceID, out)
 }
 
+func (rw *lockedReadWriter) ReadTraceEventsBatch(traceIDs []string, out *model.Batch) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceEventsBatch(traceIDs, out)
+}
+
+func (rw *lockedReadWriter) ReadTraceEventsRange(traceID string, start, end time.Time, out *model.Batch) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceEventsRange(traceID, start, end, out)
+}
+
 func (rw *lockedReadWriter) WriteTraceEvent(traceID, id string, event *model.APMEvent, opts WriterOpts) error {
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
@@ -0,0 +1,149 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// snapshotMagic identifies snapshot files written by ExportSnapshot.
+//
+// The snapshot format must remain stable over time, so snapshots
+// can be imported by servers of a different version.
+const snapshotMagic = "APMTSSS1"
+
+// snapshotMaxPendingWrites is the maximum number of pending writes when
+// importing a snapshot, as recommended by the badger documentation.
+const snapshotMaxPendingWrites = 256
+
+// ErrSnapshotInvalid is returned by ImportSnapshot for files which are not
+// snapshots, or which are truncated or corrupted.
+var ErrSnapshotInvalid = errors.New("invalid tail-sampling storage snapshot")
+
+// ExportSnapshot writes a snapshot of db to the file at path, which must not
+// already exist, so that it may be imported into another database with
+// ImportSnapshot. This may be used for preserving buffered trace events and
+// sampling decisions when migrating the tail-sampling storage of a server.
+//
+// The snapshot holds a badger backup of db, prefixed with snapshotMagic and
+// followed by the SHA-256 digest of the backup, for verifying its integrity.
+// Entries keep their original expiry times. ExportSnapshot returns the size
+// of the snapshot in bytes.
+func ExportSnapshot(db *badger.DB, path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := writeSnapshot(db, f)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return size, f.Close()
+}
+
+func writeSnapshot(db *badger.DB, f *os.File) (int64, error) {
+	bw := bufio.NewWriter(f)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return 0, err
+	}
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(bw, hash)}
+	if _, err := db.Backup(counter, 0); err != nil {
+		return 0, fmt.Errorf("failed to back up storage: %w", err)
+	}
+	if _, err := bw.Write(hash.Sum(nil)); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return int64(len(snapshotMagic)) + counter.n + sha256.Size, nil
+}
+
+// ImportSnapshot loads the snapshot written by ExportSnapshot to the file at
+// path into db. The snapshot's integrity is verified before any entries are
+// loaded; if verification fails, ImportSnapshot returns an error wrapping
+// ErrSnapshotInvalid and db is left unmodified.
+//
+// Entries keep the expiry times they had when the snapshot was exported, so
+// those which have expired since then are not visible once loaded.
+func ImportSnapshot(db *badger.DB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	backupSize, err := verifySnapshot(f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(int64(len(snapshotMagic)), io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.LimitReader(f, backupSize))
+	if err := db.Load(r, snapshotMaxPendingWrites); err != nil {
+		return fmt.Errorf("failed to load storage snapshot: %w", err)
+	}
+	return nil
+}
+
+// verifySnapshot verifies the magic and digest of the snapshot in f, and
+// returns the size of the badger backup which it contains.
+func verifySnapshot(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	backupSize := info.Size() - int64(len(snapshotMagic)) - sha256.Size
+	if backupSize < 0 {
+		return 0, fmt.Errorf("%w: file too small", ErrSnapshotInvalid)
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, err
+	}
+	if string(magic) != snapshotMagic {
+		return 0, fmt.Errorf("%w: unrecognized file format", ErrSnapshotInvalid)
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, r, backupSize); err != nil {
+		return 0, err
+	}
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(digest, hash.Sum(nil)) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrSnapshotInvalid)
+	}
+	return backupSize, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,92 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+func TestSnapshotExportImport(t *testing.T) {
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	db := newBadgerDB(t, badgerOptions)
+	readWriter := eventstorage.New(db, eventstorage.JSONCodec{}).NewReadWriter()
+	transaction := model.APMEvent{Transaction: &model.Transaction{ID: "transaction_id"}}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "transaction_id", &transaction, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("sampled_trace_id", true, wOpts))
+	require.NoError(t, readWriter.Flush(0))
+	readWriter.Close()
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	size, err := eventstorage.ExportSnapshot(db, path)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), size)
+
+	// Exporting must not overwrite an existing file.
+	_, err = eventstorage.ExportSnapshot(db, path)
+	assert.ErrorIs(t, err, os.ErrExist)
+
+	db2 := newBadgerDB(t, badgerOptions)
+	require.NoError(t, eventstorage.ImportSnapshot(db2, path))
+	readWriter2 := eventstorage.New(db2, eventstorage.JSONCodec{}).NewReadWriter()
+	defer readWriter2.Close()
+
+	var batch model.Batch
+	require.NoError(t, readWriter2.ReadTraceEvents("trace_id", &batch))
+	assert.Equal(t, model.Batch{transaction}, batch)
+	sampled, err := readWriter2.IsTraceSampled("sampled_trace_id")
+	require.NoError(t, err)
+	assert.True(t, sampled)
+}
+
+func TestSnapshotImportInvalid(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	readWriter := eventstorage.New(db, eventstorage.JSONCodec{}).NewReadWriter()
+	require.NoError(t, readWriter.WriteTraceSampled("trace_id", true, eventstorage.WriterOpts{TTL: time.Minute}))
+	require.NoError(t, readWriter.Flush(0))
+	readWriter.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot")
+	_, err := eventstorage.ExportSnapshot(db, path)
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	corrupt := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, data, 0600))
+		return path
+	}
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 0xff
+	for name, path := range map[string]string{
+		"truncated":     corrupt("truncated", data[:len(data)-1]),
+		"too_small":     corrupt("too_small", data[:8]),
+		"flipped":       corrupt("flipped", flipped),
+		"unknown_magic": corrupt("unknown_magic", append([]byte("XXXXXXXX"), data[8:]...)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newBadgerDB(t, badgerOptions)
+			err := eventstorage.ImportSnapshot(db, path)
+			assert.ErrorIs(t, err, eventstorage.ErrSnapshotInvalid)
+
+			readWriter := eventstorage.New(db, eventstorage.JSONCodec{}).NewReadWriter()
+			defer readWriter.Close()
+			_, err = readWriter.IsTraceSampled("trace_id")
+			assert.Equal(t, eventstorage.ErrNotFound, err)
+		})
+	}
+}
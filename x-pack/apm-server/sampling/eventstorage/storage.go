@@ -5,8 +5,11 @@
 package eventstorage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 	"syscall"
 	"time"
 
@@ -23,6 +26,33 @@ const (
 	entryMetaTraceEvent     = 'e'
 )
 
+// KeySchema identifies the layout of the keys under which trace events are
+// stored. Sampling decisions are always stored under the trace ID alone.
+//
+// All key schemas share the "<trace_id>:" prefix for trace events, so events
+// written with either schema are read by ReadTraceEvents, and the key schema
+// may be changed without discarding existing storage.
+type KeySchema string
+
+const (
+	// KeySchemaTraceEvent stores trace events under "<trace_id>:<event_id>",
+	// enabling prefix scans for a trace. This is the default key schema.
+	KeySchemaTraceEvent KeySchema = "trace_event"
+
+	// KeySchemaTraceTimestampEvent stores trace events under
+	// "<trace_id>:<timestamp><event_id>", where timestamp is the event's
+	// timestamp as 8 bytes of big-endian Unix nanoseconds. In addition to
+	// prefix scans for a trace, this orders a trace's events by timestamp,
+	// enabling range scans by time with ReadTraceEventsRange.
+	KeySchemaTraceTimestampEvent KeySchema = "trace_timestamp_event"
+)
+
+// keyTimestampLen is the length of the timestamp component of keys with
+// KeySchemaTraceTimestampEvent.
+const keyTimestampLen = 8
+
+var unixEpoch = time.Unix(0, 0)
+
 var (
 	// ErrNotFound is returned by by the Storage.IsTraceSampled method,
 	// for non-existing trace IDs.
@@ -36,8 +66,9 @@ var (
 // Storage provides storage for sampled transactions and spans,
 // and for recording trace sampling decisions.
 type Storage struct {
-	db    *badger.DB
-	codec Codec
+	db        *badger.DB
+	codec     Codec
+	keySchema KeySchema
 }
 
 // Codec provides methods for encoding and decoding events.
@@ -46,9 +77,21 @@ type Codec interface {
 	EncodeEvent(*model.APMEvent) ([]byte, error)
 }
 
-// New returns a new Storage using db and codec.
+// New returns a new Storage using db and codec, storing trace events
+// with KeySchemaTraceEvent.
 func New(db *badger.DB, codec Codec) *Storage {
-	return &Storage{db: db, codec: codec}
+	return &Storage{db: db, codec: codec, keySchema: KeySchemaTraceEvent}
+}
+
+// NewWithKeySchema returns a new Storage using db and codec, storing
+// trace events with the given key schema.
+func NewWithKeySchema(db *badger.DB, codec Codec, keySchema KeySchema) (*Storage, error) {
+	switch keySchema {
+	case KeySchemaTraceEvent, KeySchemaTraceTimestampEvent:
+	default:
+		return nil, fmt.Errorf("unknown key schema %q", keySchema)
+	}
+	return &Storage{db: db, codec: codec, keySchema: keySchema}, nil
 }
 
 // NewShardedReadWriter returns a new ShardedReadWriter, for sharded
@@ -168,7 +211,11 @@ func (rw *ReadWriter) IsTraceSampled(traceID string) (bool, error) {
 // WriteTraceEvent may return before the write is committed to storage.
 // Call Flush to ensure the write is committed.
 func (rw *ReadWriter) WriteTraceEvent(traceID string, id string, event *model.APMEvent, opts WriterOpts) error {
-	key := append(append([]byte(traceID), ':'), id...)
+	key := append([]byte(traceID), ':')
+	if rw.s.keySchema == KeySchemaTraceTimestampEvent {
+		key = appendKeyTimestamp(key, event.Timestamp)
+	}
+	key = append(key, id...)
 	data, err := rw.s.codec.EncodeEvent(event)
 	if err != nil {
 		return err
@@ -203,9 +250,42 @@ func (rw *ReadWriter) writeEntry(e *badger.Entry, opts WriterOpts) error {
 }
 
 // DeleteTraceEvent deletes the trace event from storage.
+//
+// With KeySchemaTraceTimestampEvent the event's timestamp is not known,
+// so the trace's events are scanned to find the keys to delete. Keys with
+// KeySchemaTraceEvent are deleted regardless of the key schema, as they
+// may have been written before the key schema was changed.
 func (rw *ReadWriter) DeleteTraceEvent(traceID, id string) error {
 	key := append(append([]byte(traceID), ':'), id...)
-	return rw.txn.Delete(key)
+	if err := rw.txn.Delete(key); err != nil {
+		return err
+	}
+	if rw.s.keySchema != KeySchemaTraceTimestampEvent {
+		return nil
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = key[:len(traceID)+1]
+	iter := rw.txn.NewIterator(opts)
+	defer iter.Close()
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		k := iter.Item().Key()
+		suffix := k[len(opts.Prefix):]
+		if len(suffix) == keyTimestampLen+len(id) && string(suffix[keyTimestampLen:]) == id {
+			keys = append(keys, iter.Item().KeyCopy(nil))
+		}
+	}
+	// Keys are deleted after closing the iterator,
+	// as the transaction must not be modified while
+	// iterating.
+	iter.Close()
+	for _, k := range keys {
+		if err := rw.txn.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ReadTraceEvents reads trace events with the given trace ID from storage into out.
@@ -216,7 +296,89 @@ func (rw *ReadWriter) ReadTraceEvents(traceID string, out *model.Batch) error {
 
 	iter := rw.txn.NewIterator(opts)
 	defer iter.Close()
-	for iter.Rewind(); iter.Valid(); iter.Next() {
+	iter.Rewind()
+	return rw.readTraceEvents(iter, out)
+}
+
+// ReadTraceEventsRange reads trace events with the given trace ID and a
+// timestamp in the range [start, end) from storage into out, in timestamp
+// order.
+//
+// The range scan relies on the timestamp component of keys, so events
+// stored with KeySchemaTraceEvent are only read if their keys happen to
+// sort within the range. Such events are never read if their timestamp
+// is outside the range.
+func (rw *ReadWriter) ReadTraceEventsRange(traceID string, start, end time.Time, out *model.Batch) error {
+	opts := badger.DefaultIteratorOptions
+	rw.readKeyBuf = append(append(rw.readKeyBuf[:0], traceID...), ':')
+	opts.Prefix = rw.readKeyBuf
+	prefixLen := len(rw.readKeyBuf)
+	startKey := appendKeyTimestamp(append([]byte(nil), rw.readKeyBuf...), start)
+	endKey := appendKeyTimestamp(append([]byte(nil), rw.readKeyBuf...), end)
+
+	iter := rw.txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Seek(startKey); iter.ValidForPrefix(rw.readKeyBuf); iter.Next() {
+		item := iter.Item()
+		key := item.Key()
+		if len(key) > prefixLen+keyTimestampLen {
+			key = key[:prefixLen+keyTimestampLen]
+		}
+		if bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		if item.IsDeletedOrExpired() || item.UserMeta() != entryMetaTraceEvent {
+			continue
+		}
+		var event model.APMEvent
+		if err := item.Value(func(data []byte) error {
+			return rw.s.codec.DecodeEvent(data, &event)
+		}); err != nil {
+			return err
+		}
+		// Keys with KeySchemaTraceEvent may sort within the range,
+		// so the event's timestamp is checked to exclude them.
+		if event.Timestamp.Before(start) || !event.Timestamp.Before(end) {
+			continue
+		}
+		*out = append(*out, event)
+	}
+	return nil
+}
+
+// ReadTraceEventsBatch reads trace events with any of the given trace IDs from
+// storage into out, grouped by trace ID.
+//
+// ReadTraceEventsBatch uses a single iterator for all of the trace IDs, which
+// is cheaper than calling ReadTraceEvents for each trace ID when there are
+// many uncommitted writes, as creating an iterator must sort the keys of all
+// uncommitted writes.
+func (rw *ReadWriter) ReadTraceEventsBatch(traceIDs []string, out *model.Batch) error {
+	if len(traceIDs) == 0 {
+		return nil
+	}
+	// Seek to the trace IDs in sorted order, so the iterator
+	// only moves forwards.
+	sorted := make([]string, len(traceIDs))
+	copy(sorted, traceIDs)
+	sort.Strings(sorted)
+
+	iter := rw.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer iter.Close()
+	for _, traceID := range sorted {
+		rw.readKeyBuf = append(append(rw.readKeyBuf[:0], traceID...), ':')
+		iter.Seek(rw.readKeyBuf)
+		if err := rw.readTraceEvents(iter, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTraceEvents reads trace events from iter, from its current position
+// until it is no longer valid for the prefix in rw.readKeyBuf.
+func (rw *ReadWriter) readTraceEvents(iter *badger.Iterator, out *model.Batch) error {
+	for ; iter.ValidForPrefix(rw.readKeyBuf); iter.Next() {
 		item := iter.Item()
 		if item.IsDeletedOrExpired() {
 			continue
@@ -237,3 +399,14 @@ func (rw *ReadWriter) ReadTraceEvents(traceID string, out *model.Batch) error {
 	}
 	return nil
 }
+
+// appendKeyTimestamp appends the timestamp component of a key with
+// KeySchemaTraceTimestampEvent to key. Timestamps before the Unix epoch
+// are clamped to it, so that keys sort in timestamp order.
+func appendKeyTimestamp(key []byte, t time.Time) []byte {
+	var buf [keyTimestampLen]byte
+	if t.After(unixEpoch) {
+		binary.BigEndian.PutUint64(buf[:], uint64(t.UnixNano()))
+	}
+	return append(key, buf[:]...)
+}
@@ -69,6 +69,13 @@ func BenchmarkWriteTransaction(b *testing.B) {
 			codec: nopCodec{},
 		},
 	}
+	for _, compression := range []string{eventstorage.CompressionSnappy, eventstorage.CompressionZstd} {
+		codec, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, compression)
+		if err != nil {
+			b.Fatal(err)
+		}
+		cases = append(cases, testCase{name: "json_" + compression + "_codec", codec: codec})
+	}
 	for _, tc := range cases {
 		b.Run(tc.name, func(b *testing.B) {
 			test(b, tc.codec, false)
@@ -161,6 +168,57 @@ func BenchmarkReadEvents(b *testing.B) {
 	}
 }
 
+func BenchmarkReadEventsBatch(b *testing.B) {
+	// Simulate reading the events of many buffered traces at flush time,
+	// with uncommitted writes in the transaction.
+	const numTraces = 1000
+	const eventsPerTrace = 10
+	db := newBadgerDB(b, badgerOptions)
+	store := eventstorage.New(db, eventstorage.JSONCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	traceIDs := make([]string, numTraces)
+	for i := range traceIDs {
+		traceIDs[i] = uuid.Must(uuid.NewV4()).String()
+		for j := 0; j < eventsPerTrace; j++ {
+			transactionID := uuid.Must(uuid.NewV4()).String()
+			transaction := makeTransaction(transactionID, traceIDs[i])
+			if err := readWriter.WriteTraceEvent(traceIDs[i], transactionID, transaction, wOpts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("individual", func(b *testing.B) {
+		var batch model.Batch
+		for i := 0; i < b.N; i++ {
+			batch = batch[:0]
+			for _, traceID := range traceIDs {
+				if err := readWriter.ReadTraceEvents(traceID, &batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if len(batch) != numTraces*eventsPerTrace {
+				b.Fatalf("expected %d events, got %d", numTraces*eventsPerTrace, len(batch))
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		var batch model.Batch
+		for i := 0; i < b.N; i++ {
+			batch = batch[:0]
+			if err := readWriter.ReadTraceEventsBatch(traceIDs, &batch); err != nil {
+				b.Fatal(err)
+			}
+			if len(batch) != numTraces*eventsPerTrace {
+				b.Fatalf("expected %d events, got %d", numTraces*eventsPerTrace, len(batch))
+			}
+		}
+	})
+}
+
 func BenchmarkIsTraceSampled(b *testing.B) {
 	sampledTraceUUID := uuid.Must(uuid.NewV4())
 	unsampledTraceUUID := uuid.Must(uuid.NewV4())
@@ -204,6 +204,44 @@ func TestReadTraceEvents(t *testing.T) {
 	}, events)
 }
 
+func TestReadTraceEventsBatch(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.JSONCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	traceIDs := []string{"trace1", "trace2", "trace3", "trace10"}
+	for _, traceID := range traceIDs {
+		for _, id := range []string{"a", "b"} {
+			event := &model.APMEvent{
+				Trace:       model.Trace{ID: traceID},
+				Transaction: &model.Transaction{ID: id},
+			}
+			require.NoError(t, readWriter.WriteTraceEvent(traceID, id, event, wOpts))
+		}
+	}
+	// Flush some of the writes, to read from both committed
+	// and uncommitted writes.
+	require.NoError(t, readWriter.WriteTraceSampled("trace2", true, wOpts))
+	require.NoError(t, readWriter.Flush(0))
+	require.NoError(t, readWriter.WriteTraceEvent("trace1", "c", &model.APMEvent{
+		Trace:       model.Trace{ID: "trace1"},
+		Transaction: &model.Transaction{ID: "c"},
+	}, wOpts))
+
+	var events model.Batch
+	require.NoError(t, readWriter.ReadTraceEventsBatch([]string{"trace1", "trace2", "unknown"}, &events))
+	transactionIDs := make(map[string][]string)
+	for _, event := range events {
+		transactionIDs[event.Trace.ID] = append(transactionIDs[event.Trace.ID], event.Transaction.ID)
+	}
+	assert.Equal(t, map[string][]string{
+		"trace1": {"a", "b", "c"},
+		"trace2": {"a", "b"},
+	}, transactionIDs)
+}
+
 func TestReadTraceEventsDecodeError(t *testing.T) {
 	db := newBadgerDB(t, badgerOptions)
 	store := eventstorage.New(db, eventstorage.JSONCodec{})
@@ -255,6 +293,160 @@ func TestIsTraceSampled(t *testing.T) {
 	assert.Equal(t, err, eventstorage.ErrNotFound)
 }
 
+func TestNewWithKeySchemaInvalid(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	_, err := eventstorage.NewWithKeySchema(db, eventstorage.JSONCodec{}, "wat")
+	assert.EqualError(t, err, `unknown key schema "wat"`)
+}
+
+func TestKeySchemaTraceTimestampEventPrefix(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store, err := eventstorage.NewWithKeySchema(db, eventstorage.JSONCodec{}, eventstorage.KeySchemaTraceTimestampEvent)
+	require.NoError(t, err)
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+
+	// Trace IDs which are prefixes of one another must not
+	// have their events read together.
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	now := time.Now().UTC()
+	for _, traceID := range []string{"trace1", "trace10", "trace2"} {
+		for i, id := range []string{"c", "a", "b"} {
+			event := &model.APMEvent{
+				Timestamp:   now.Add(time.Duration(i) * time.Second),
+				Trace:       model.Trace{ID: traceID},
+				Transaction: &model.Transaction{ID: id},
+			}
+			require.NoError(t, readWriter.WriteTraceEvent(traceID, id, event, wOpts))
+		}
+	}
+	require.NoError(t, readWriter.WriteTraceSampled("trace1", true, wOpts))
+	require.NoError(t, readWriter.Flush(0))
+
+	// Events are read in timestamp order rather than event ID order.
+	var events model.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace1", &events))
+	assert.Equal(t, []string{"c", "a", "b"}, transactionIDs(events))
+
+	events = events[:0]
+	require.NoError(t, readWriter.ReadTraceEventsBatch([]string{"trace2", "trace10"}, &events))
+	assert.Len(t, events, 6)
+	for _, event := range events[:3] {
+		assert.Equal(t, "trace10", event.Trace.ID)
+	}
+	for _, event := range events[3:] {
+		assert.Equal(t, "trace2", event.Trace.ID)
+	}
+
+	sampled, err := readWriter.IsTraceSampled("trace1")
+	require.NoError(t, err)
+	assert.True(t, sampled)
+}
+
+func TestReadTraceEventsRange(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store, err := eventstorage.NewWithKeySchema(db, eventstorage.JSONCodec{}, eventstorage.KeySchemaTraceTimestampEvent)
+	require.NoError(t, err)
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	base := time.Unix(1600000000, 0).UTC()
+	for _, traceID := range []string{"trace1", "trace10"} {
+		for i := 0; i < 5; i++ {
+			id := string(rune('a' + i))
+			event := &model.APMEvent{
+				Timestamp:   base.Add(time.Duration(i) * time.Second),
+				Trace:       model.Trace{ID: traceID},
+				Transaction: &model.Transaction{ID: id},
+			}
+			require.NoError(t, readWriter.WriteTraceEvent(traceID, id, event, wOpts))
+		}
+	}
+	// Read from both committed and uncommitted writes.
+	require.NoError(t, readWriter.Flush(0))
+	require.NoError(t, readWriter.WriteTraceEvent("trace1", "z", &model.APMEvent{
+		Timestamp:   base.Add(1500 * time.Millisecond),
+		Trace:       model.Trace{ID: "trace1"},
+		Transaction: &model.Transaction{ID: "z"},
+	}, wOpts))
+
+	for name, test := range map[string]struct {
+		start, end time.Time
+		expected   []string
+	}{
+		"all":                           {base, base.Add(time.Minute), []string{"a", "b", "z", "c", "d", "e"}},
+		"start_inclusive_end_exclusive": {base.Add(time.Second), base.Add(3 * time.Second), []string{"b", "z", "c"}},
+		"before_all":                    {base.Add(-time.Minute), base, nil},
+		"after_all":                     {base.Add(time.Minute), base.Add(time.Hour), nil},
+		"empty_range":                   {base.Add(time.Second), base.Add(time.Second), nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var events model.Batch
+			require.NoError(t, readWriter.ReadTraceEventsRange("trace1", test.start, test.end, &events))
+			assert.Equal(t, test.expected, transactionIDs(events))
+			for _, event := range events {
+				assert.Equal(t, "trace1", event.Trace.ID)
+			}
+		})
+	}
+}
+
+func TestKeySchemaMixed(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	now := time.Now().UTC()
+
+	// Write an event with the default key schema, then change
+	// the key schema; both events are read and deleted.
+	store := eventstorage.New(db, eventstorage.JSONCodec{})
+	readWriter := store.NewReadWriter()
+	require.NoError(t, readWriter.WriteTraceEvent("trace1", "a", &model.APMEvent{
+		Timestamp:   now,
+		Transaction: &model.Transaction{ID: "a"},
+	}, wOpts))
+	require.NoError(t, readWriter.Flush(0))
+	readWriter.Close()
+
+	store, err := eventstorage.NewWithKeySchema(db, eventstorage.JSONCodec{}, eventstorage.KeySchemaTraceTimestampEvent)
+	require.NoError(t, err)
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	for _, id := range []string{"b", "ab"} {
+		require.NoError(t, readWriter.WriteTraceEvent("trace1", id, &model.APMEvent{
+			Timestamp:   now,
+			Transaction: &model.Transaction{ID: id},
+		}, wOpts))
+	}
+	require.NoError(t, readWriter.Flush(0))
+
+	var events model.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace1", &events))
+	assert.ElementsMatch(t, []string{"a", "b", "ab"}, transactionIDs(events))
+
+	// Events with a timestamp outside the range are excluded,
+	// regardless of where their keys sort.
+	events = events[:0]
+	require.NoError(t, readWriter.ReadTraceEventsRange("trace1", now.Add(time.Second), now.Add(time.Minute), &events))
+	assert.Empty(t, events)
+
+	// Deleting an event does not delete events whose IDs share a suffix.
+	require.NoError(t, readWriter.DeleteTraceEvent("trace1", "a"))
+	require.NoError(t, readWriter.DeleteTraceEvent("trace1", "b"))
+	require.NoError(t, readWriter.Flush(0))
+	events = events[:0]
+	require.NoError(t, readWriter.ReadTraceEvents("trace1", &events))
+	assert.Equal(t, []string{"ab"}, transactionIDs(events))
+}
+
+func transactionIDs(events model.Batch) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.Transaction.ID)
+	}
+	return ids
+}
+
 func badgerOptions() badger.Options {
 	return badger.DefaultOptions("").WithInMemory(true).WithLogger(nil)
 }
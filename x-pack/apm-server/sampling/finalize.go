@@ -0,0 +1,160 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// finalizeLatencyWindow is the rotating window over which the time taken
+// to finalize traces is reported. It is longer than writeLatencyWindow, as
+// traces are finalized at most once per flush interval.
+const finalizeLatencyWindow = 10 * time.Minute
+
+// traceFirstSeen tracks the time at which the first event of each trace
+// awaiting a sampling decision was written to local storage, for measuring
+// the time taken to finalize traces.
+//
+// traceFirstSeen is safe for concurrent use.
+type traceFirstSeen struct {
+	mu     sync.Mutex
+	traces map[string]time.Time
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+func newTraceFirstSeen() *traceFirstSeen {
+	return &traceFirstSeen{
+		traces: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// observe records that an event for traceID has been written to local
+// storage, if it is the first such event.
+func (t *traceFirstSeen) observe(traceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.traces[traceID]; !ok {
+		t.traces[traceID] = t.now()
+	}
+}
+
+// finalize stops tracking traceID, returning the time elapsed since its
+// first event was observed. If traceID is not tracked, finalize returns
+// false.
+func (t *traceFirstSeen) finalize(traceID string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	firstSeen, ok := t.traces[traceID]
+	if !ok {
+		return 0, false
+	}
+	delete(t.traces, traceID)
+	return t.now().Sub(firstSeen), true
+}
+
+// forget stops tracking traceID, e.g. because the trace was not sampled.
+func (t *traceFirstSeen) forget(traceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.traces, traceID)
+}
+
+// oldest returns the number of traces tracked, and the time at which the
+// first event of the oldest of them was observed.
+func (t *traceFirstSeen) oldest() (int, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var oldest time.Time
+	for _, firstSeen := range t.traces {
+		if oldest.IsZero() || firstSeen.Before(oldest) {
+			oldest = firstSeen
+		}
+	}
+	return len(t.traces), oldest
+}
+
+// expire stops tracking traces first observed more than maxAge ago,
+// whose events have expired from local storage.
+func (t *traceFirstSeen) expire(maxAge time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := t.now().Add(-maxAge)
+	for traceID, firstSeen := range t.traces {
+		if firstSeen.Before(cutoff) {
+			delete(t.traces, traceID)
+		}
+	}
+}
+
+// recordFinalized records the time taken to finalize the given sampled
+// traces, from when their first event was written to local storage.
+func (p *Processor) recordFinalized(traceIDs []string) {
+	for _, traceID := range traceIDs {
+		if d, ok := p.traceFirstSeen.finalize(traceID); ok {
+			p.finalizeLatency.record(traceID, d)
+		}
+	}
+}
+
+// finalizeWorkers tracks the reporting of locally sampled traces by the
+// workers started by Run, of which there are FinalizeConcurrency. When the
+// reservoirs are finalized, the sampled traces are queued in batches for
+// the workers, bounding the number of batches whose events are read from
+// storage and reported concurrently.
+type finalizeWorkers struct {
+	// active and backlog are accessed atomically, and must be first
+	// for 64-bit alignment.
+	//
+	// active holds the number of batches being reported, and backlog
+	// holds the number of sampled traces queued for the workers.
+	active  int64
+	backlog int64
+
+	concurrency int
+}
+
+func newFinalizeWorkers(concurrency int) *finalizeWorkers {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &finalizeWorkers{concurrency: concurrency}
+}
+
+// queued records that n sampled traces have been queued for the workers.
+func (w *finalizeWorkers) queued(n int) {
+	atomic.AddInt64(&w.backlog, int64(n))
+}
+
+// start records that a worker has started reporting a batch of n sampled
+// traces, and returns a function to call once the batch has been reported.
+func (w *finalizeWorkers) start(n int) (done func()) {
+	atomic.AddInt64(&w.backlog, -int64(n))
+	atomic.AddInt64(&w.active, 1)
+	return func() { atomic.AddInt64(&w.active, -1) }
+}
+
+func (w *finalizeWorkers) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "concurrency", int64(w.concurrency))
+	monitoring.ReportInt(V, "active", atomic.LoadInt64(&w.active))
+	monitoring.ReportInt(V, "backlog", atomic.LoadInt64(&w.backlog))
+}
+
+// maxTTL returns the greatest of ttl and outcomeTTLs.
+func maxTTL(ttl time.Duration, outcomeTTLs map[string]time.Duration) time.Duration {
+	for _, outcomeTTL := range outcomeTTLs {
+		if outcomeTTL > ttl {
+			ttl = outcomeTTL
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,48 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceFirstSeen(t *testing.T) {
+	now := time.Now()
+	f := newTraceFirstSeen()
+	f.now = func() time.Time { return now }
+
+	f.observe("sampled")
+	f.observe("unsampled")
+	now = now.Add(10 * time.Second)
+	f.observe("sampled") // first seen time is unchanged
+	f.observe("expired")
+	f.forget("unsampled")
+
+	d, ok := f.finalize("sampled")
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, d)
+	_, ok = f.finalize("sampled") // finalized traces are no longer tracked
+	assert.False(t, ok)
+	_, ok = f.finalize("unsampled")
+	assert.False(t, ok)
+
+	now = now.Add(time.Minute)
+	f.expire(time.Minute)
+	assert.Len(t, f.traces, 1)
+	now = now.Add(time.Nanosecond)
+	f.expire(time.Minute)
+	assert.Empty(t, f.traces)
+}
+
+func TestMaxTTL(t *testing.T) {
+	assert.Equal(t, time.Minute, maxTTL(time.Minute, nil))
+	assert.Equal(t, time.Hour, maxTTL(time.Minute, map[string]time.Duration{
+		"success": time.Second,
+		"failure": time.Hour,
+	}))
+}
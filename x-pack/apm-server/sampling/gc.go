@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// gcDiscardRatio is the ratio of discardable data in a value log file
+// above which it is rewritten, per Badger's recommendation.
+const gcDiscardRatio = 0.5
+
+// gcMetrics holds metrics about Badger value log garbage collection.
+//
+// All fields are updated atomically.
+type gcMetrics struct {
+	runs               int64
+	reclaimedBytes     int64
+	lastReclaimedBytes int64
+	lastDurationMicros int64
+}
+
+func (m *gcMetrics) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "runs", atomic.LoadInt64(&m.runs))
+	monitoring.ReportInt(V, "reclaimed_bytes", atomic.LoadInt64(&m.reclaimedBytes))
+	monitoring.ReportInt(V, "last_reclaimed_bytes", atomic.LoadInt64(&m.lastReclaimedBytes))
+	monitoring.ReportInt(V, "last_duration_us", atomic.LoadInt64(&m.lastDurationMicros))
+}
+
+// runValueLogGC runs a cycle of Badger value log garbage collection,
+// recording how much space was reclaimed and how long it took.
+//
+// The space reclaimed is measured as the change in the total size of the
+// value log files on disk, rather than with badger.DB.Size, as the latter
+// is only updated periodically.
+func (p *Processor) runValueLogGC() error {
+	sizeBefore := valueLogFilesSize(p.config.StorageDir)
+	start := time.Now()
+	err := p.eventStore.RunValueLogGC(gcDiscardRatio)
+	duration := time.Since(start)
+	if err != nil && err != badger.ErrNoRewrite {
+		return err
+	}
+	reclaimed := sizeBefore - valueLogFilesSize(p.config.StorageDir)
+	if reclaimed < 0 {
+		// Events may have been written concurrently.
+		reclaimed = 0
+	}
+	atomic.AddInt64(&p.gcMetrics.runs, 1)
+	atomic.AddInt64(&p.gcMetrics.reclaimedBytes, reclaimed)
+	atomic.StoreInt64(&p.gcMetrics.lastReclaimedBytes, reclaimed)
+	atomic.StoreInt64(&p.gcMetrics.lastDurationMicros, duration.Microseconds())
+	p.logger.Debugf("value log GC reclaimed %d bytes in %s", reclaimed, duration)
+	return nil
+}
+
+// valueLogFilesSize returns the total size of the Badger value log files
+// in dir. Errors are ignored, as files may be removed concurrently.
+func valueLogFilesSize(dir string) int64 {
+	filenames, _ := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	var size int64
+	for _, filename := range filenames {
+		if info, err := os.Stat(filename); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
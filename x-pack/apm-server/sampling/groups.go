@@ -8,7 +8,10 @@ import (
 	"errors"
 	"math"
 	"math/rand"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/apm-server/internal/model"
@@ -16,71 +19,190 @@ import (
 
 const minReservoirSize = 1000
 
+// reservoirStrategyDiversity is the reservoir strategy which prefers
+// keeping root transactions that differ by name, outcome, and duration.
+const reservoirStrategyDiversity = "diversity"
+
 var (
 	errTooManyTraceGroups = errors.New("too many trace groups")
 	errNoMatchingPolicy   = errors.New("no matching policy")
 )
 
-// traceGroups maintains a collection of trace groups.
-type traceGroups struct {
+// traceGroupsConfig holds configuration for traceGroups.
+type traceGroupsConfig struct {
 	// ingestRateDecayFactor is λ, the decay factor used for calculating the
 	// exponentially weighted moving average ingest rate for each trace group.
 	ingestRateDecayFactor float64
 
+	// ingestRateDecayFactors holds decay factors by service environment,
+	// overriding ingestRateDecayFactor for the groups of policies with a
+	// matching ServiceEnvironment. Groups of policies without a service
+	// environment may mix environments, so always use ingestRateDecayFactor.
+	ingestRateDecayFactors map[string]float64
+
 	// maxDynamicServiceGroups holds the maximum number of dynamic service groups
-	// to maintain. Once this is reached, no new dynamic service groups will
-	// be created, and events may be dropped.
+	// to maintain. Once this is reached, new dynamic service groups are created
+	// only by evicting the least recently seen group which has not been seen
+	// since the reservoirs were last finalized. If there is no such group, no
+	// new dynamic service groups will be created, and events may be dropped.
 	maxDynamicServiceGroups int
 
+	// countDroppedTraces controls whether the number of dropped traces
+	// is counted for each droppedTraceKey.
+	countDroppedTraces bool
+
+	// countDecisions controls whether the number of traces kept and
+	// dropped is counted for each decisionKey.
+	countDecisions bool
+
+	// keepDroppedRoots controls whether the trace IDs of root transactions
+	// admitted to a reservoir, but not sampled, are recorded when the
+	// reservoirs are finalized, so that the root transactions can be
+	// reported without the rest of their traces.
+	keepDroppedRoots bool
+
+	// traceNameNormalizers holds rules for normalizing root transaction
+	// names before matching them against policies.
+	traceNameNormalizers traceNameNormalizers
+
+	// defaultTraceOutcome holds the outcome used for matching root
+	// transactions with an empty outcome against policies, if non-empty.
+	defaultTraceOutcome string
+
+	// reservoirStrategy holds the strategy used for sampling root
+	// transactions into each trace group's reservoir.
+	reservoirStrategy string
+
+	// auditLog records the sampling decisions made for root transactions,
+	// if non-nil.
+	auditLog *auditLog
+}
+
+// traceGroups maintains a collection of trace groups.
+type traceGroups struct {
+	traceGroupsConfig
+
+	// errorTraces tracks the traces for which error events have been
+	// observed. errorTraces is non-nil only if a policy has HasError
+	// criteria.
+	errorTraces *errorTraces
+
+	// spanCountThresholds holds the distinct MinSpanCount criteria of the
+	// policies in ascending order, and spanCounts tracks the number of
+	// spans stored for each trace. spanCounts is non-nil only if a policy
+	// has MinSpanCount criteria.
+	spanCountThresholds []int
+	spanCounts          *traceSpanCounts
+
+	// probabilities records the probability with which each trace is
+	// sampled, if non-nil.
+	probabilities *sampleProbabilities
+
+	// sampledBy records the policy by which each trace is sampled,
+	// if non-nil.
+	sampledBy *sampledByPolicies
+
 	mu                      sync.RWMutex
 	policyGroups            []policyGroup
 	numDynamicServiceGroups int
+
+	// lastSeen is incremented each time a dynamic service group is matched,
+	// and recorded in the group, for ordering groups by when they were last
+	// seen. Access to lastSeen is protected by mu.
+	lastSeen uint64
+
+	// evictable records whether there may be dynamic service groups which
+	// have not been seen since the reservoirs were last finalized, and so
+	// may be evicted. Groups are only marked as unseen by finalization, so
+	// once a search for such a group fails, evictable remains false until
+	// the reservoirs are next finalized. Access to evictable is protected
+	// by mu.
+	evictable bool
+
+	// dynamicServiceGroupsEvicted and dynamicServiceGroupsRejected count
+	// the dynamic service groups evicted to make room for new groups, and
+	// the root transactions dropped because no group could be evicted,
+	// once maxDynamicServiceGroups has been reached. They are accessed
+	// atomically.
+	dynamicServiceGroupsEvicted  int64
+	dynamicServiceGroupsRejected int64
+
+	// dropped holds the number of root transactions dropped since the
+	// last call to takeDroppedTraces, if countDroppedTraces is true.
+	// Access to dropped is protected by mu.
+	dropped map[droppedTraceKey]int64
+
+	// decisions holds the number of root transactions kept and dropped
+	// since the last call to takeDecisions, if countDecisions is true.
+	// Access to decisions is protected by mu.
+	decisions map[decisionKey]decisionCounts
+
+	// droppedRoots holds the trace IDs of root transactions admitted to
+	// a reservoir but not sampled since the last call to takeDroppedRoots,
+	// if keepDroppedRoots is true. Access to droppedRoots is protected by mu.
+	droppedRoots []string
 }
 
 type policyGroup struct {
 	policy  Policy
+	name    string // policy.Name, or the policy's index if it has no name
+	match   matchFunc
+	metrics *policyMetrics         // heap-allocated for 64-bit alignment
 	g       *traceGroup            // nil for catch-all
 	dynamic map[string]*traceGroup // nil for static
 }
 
-func (g *policyGroup) match(transactionEvent *model.APMEvent) bool {
-	if g.policy.ServiceName != "" && g.policy.ServiceName != transactionEvent.Service.Name {
-		return false
-	}
-	if g.policy.ServiceEnvironment != "" && g.policy.ServiceEnvironment != transactionEvent.Service.Environment {
-		return false
-	}
-	if g.policy.TraceOutcome != "" && g.policy.TraceOutcome != transactionEvent.Event.Outcome {
-		return false
+func newTraceGroups(policies []Policy, config traceGroupsConfig) *traceGroups {
+	groups := &traceGroups{
+		traceGroupsConfig: config,
+		policyGroups:      make([]policyGroup, len(policies)),
 	}
-	if g.policy.TraceName != "" && g.policy.TraceName != transactionEvent.Transaction.Name {
-		return false
+	if config.countDroppedTraces {
+		groups.dropped = make(map[droppedTraceKey]int64)
 	}
-	return true
-}
-
-func newTraceGroups(
-	policies []Policy,
-	maxDynamicServiceGroups int,
-	ingestRateDecayFactor float64,
-) *traceGroups {
-	groups := &traceGroups{
-		ingestRateDecayFactor:   ingestRateDecayFactor,
-		maxDynamicServiceGroups: maxDynamicServiceGroups,
-		policyGroups:            make([]policyGroup, len(policies)),
+	if config.countDecisions {
+		groups.decisions = make(map[decisionKey]decisionCounts)
 	}
 	for i, policy := range policies {
-		pg := policyGroup{policy: policy}
+		pg := policyGroup{
+			policy:  policy,
+			name:    policy.Name,
+			match:   policy.compile(),
+			metrics: &policyMetrics{},
+		}
+		if pg.name == "" {
+			pg.name = strconv.Itoa(i)
+		}
+		if policy.hasErrorCriteria() && groups.errorTraces == nil {
+			groups.errorTraces = newErrorTraces()
+		}
+		groups.spanCountThresholds = policy.appendSpanCountThresholds(groups.spanCountThresholds)
 		if policy.ServiceName != "" {
-			pg.g = newTraceGroup(policy.SampleRate)
+			pg.g = newTraceGroup(&pg, config)
 		} else {
 			pg.dynamic = make(map[string]*traceGroup)
 		}
 		groups.policyGroups[i] = pg
 	}
+	if len(groups.spanCountThresholds) > 0 {
+		groups.spanCountThresholds = uniqueSortedInts(groups.spanCountThresholds)
+		groups.spanCounts = newTraceSpanCounts()
+	}
 	return groups
 }
 
+// uniqueSortedInts sorts values in ascending order, removing duplicates.
+func uniqueSortedInts(values []int) []int {
+	sort.Ints(values)
+	unique := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
 // traceGroup represents a single trace group, including a measurement of the
 // observed ingest rate, a trace ID weighted random sampling reservoir.
 type traceGroup struct {
@@ -89,9 +211,12 @@ type traceGroup struct {
 	samplingFraction float64
 
 	mu sync.Mutex
+	// rng holds the random number generator used by the reservoir, and
+	// for sampling completed traces.
+	rng *rand.Rand
 	// reservoir holds a random sample of root transactions observed
 	// for this trace group, weighted by duration.
-	reservoir *weightedRandomSample
+	reservoir traceReservoir
 	// total holds the total number of root transactions observed for
 	// this trace group, including those that are not added to the
 	// reservoir. This is used to update ingestRate.
@@ -101,16 +226,82 @@ type traceGroup struct {
 	// sampling interval. This is read and written only by the periodic
 	// finalizeSampledTraces calls.
 	ingestRate float64
+	// effectiveSampleRate holds the fraction of root transactions that
+	// were sampled in the most recent tail sampling interval in which any
+	// were observed for this trace group. Like ingestRate, this is only
+	// written by finalizeSampledTraces.
+	effectiveSampleRate float64
+
+	// dropped is non-nil if dropped traces are being counted, and holds
+	// the number of root transactions dropped in this interval.
+	dropped map[droppedTraceKey]int64
+
+	// admitted is non-nil if dropped traces are being counted, decisions
+	// audited, or dropped root transactions kept, and holds the keys of
+	// root transactions admitted to the reservoir in this interval, by
+	// trace ID. Admitted root transactions which are not ultimately sampled
+	// are counted as dropped, audited, and recorded for keeping, when the
+	// reservoir is finalized.
+	admitted map[string]droppedTraceKey
+
+	// decisions is non-nil if decisions are being counted, and holds
+	// the number of root transactions kept and dropped since the
+	// counts were last added to traceGroups.decisions.
+	decisions *decisionCounts
+
+	// errorCandidates holds the trace IDs of root transactions admitted
+	// to the reservoir in this interval which would have matched a
+	// policy with HasError criteria, had an error been observed for the
+	// trace, mapped to that policy's sample rate. It is created lazily.
+	errorCandidates map[string]float64
+
+	// spanCountCandidates holds the trace IDs of root transactions
+	// admitted to the reservoir in this interval which would have matched
+	// other policies, had more spans been stored for the trace, mapped to
+	// the span counts at which they would match. It is created lazily.
+	spanCountCandidates map[string][]spanCountCandidate
+
+	// metrics holds the metrics of the policy for which this trace
+	// group was created.
+	metrics *policyMetrics
+
+	// policyName holds the name of the policy for which this trace
+	// group was created, for recording decisions in auditLog.
+	policyName string
+	auditLog   *auditLog
+
+	// lastSeen and seen record, for dynamic service groups, the value
+	// of traceGroups.lastSeen when the group was last matched, and
+	// whether it has been matched since the reservoirs were last
+	// finalized. They are protected by traceGroups.mu.
+	lastSeen uint64
+	seen     bool
 }
 
-func newTraceGroup(samplingFraction float64) *traceGroup {
-	return &traceGroup{
-		samplingFraction: samplingFraction,
-		reservoir: newWeightedRandomSample(
-			rand.New(rand.NewSource(time.Now().UnixNano())),
-			minReservoirSize,
-		),
+func newTraceGroup(pg *policyGroup, config traceGroupsConfig) *traceGroup {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	g := &traceGroup{
+		samplingFraction: pg.policy.SampleRate,
+		metrics:          pg.metrics,
+		policyName:       pg.name,
+		auditLog:         config.auditLog,
+		rng:              rng,
+	}
+	if config.reservoirStrategy == reservoirStrategyDiversity {
+		g.reservoir = newStratifiedSample(rng, minReservoirSize)
+	} else {
+		g.reservoir = randomReservoir{newWeightedRandomSample(rng, minReservoirSize)}
+	}
+	if config.countDroppedTraces {
+		g.dropped = make(map[droppedTraceKey]int64)
+	}
+	if config.countDroppedTraces || config.keepDroppedRoots || config.auditLog != nil {
+		g.admitted = make(map[string]droppedTraceKey)
 	}
+	if config.countDecisions {
+		g.decisions = &decisionCounts{}
+	}
+	return g
 }
 
 // sampleTrace will return true if the root transaction is admitted to
@@ -119,24 +310,79 @@ func newTraceGroup(samplingFraction float64) *traceGroup {
 // If the transaction is not admitted due to the transaction group limit
 // having been reached, sampleTrace will return errTooManyTraceGroups.
 func (g *traceGroups) sampleTrace(transactionEvent *model.APMEvent) (bool, error) {
-	group, err := g.getTraceGroup(transactionEvent)
+	traceHasError := g.errorTraces.contains(transactionEvent.Trace.ID)
+	traceSpanCount := g.spanCounts.count(transactionEvent.Trace.ID)
+	pg := g.matchPolicyGroup(transactionEvent, traceHasError, traceSpanCount)
+	if pg == nil {
+		return false, errNoMatchingPolicy
+	}
+	group, err := g.getPolicyTraceGroup(pg, transactionEvent)
 	if err != nil {
 		return false, err
 	}
-	return group.sampleTrace(transactionEvent)
+	var stratum stratumKey
+	if g.reservoirStrategy == reservoirStrategyDiversity {
+		traceName := g.traceNameNormalizers.normalize(transactionEvent.Transaction.Name)
+		stratum = makeStratumKey(traceName, transactionEvent)
+	}
+	// Errors may be observed after the root transaction, so if the trace
+	// has none yet, record the sample rate of any HasError policy it would
+	// otherwise match, for reconsidering it when the reservoir is finalized.
+	var errorSampleRate float64
+	if g.errorTraces != nil && !traceHasError {
+		if errorPolicy := g.matchPolicyGroup(transactionEvent, true, traceSpanCount); errorPolicy != pg {
+			errorSampleRate = errorPolicy.policy.SampleRate
+		}
+	}
+	// Likewise, spans may be stored after the root transaction, so record
+	// the sample rates of the policies it would match with more spans.
+	var spanCountCandidates []spanCountCandidate
+	for _, threshold := range g.spanCountThresholds {
+		if threshold <= traceSpanCount {
+			continue
+		}
+		if spanCountPolicy := g.matchPolicyGroup(transactionEvent, traceHasError, threshold); spanCountPolicy != pg {
+			spanCountCandidates = append(spanCountCandidates, spanCountCandidate{
+				minSpanCount: threshold,
+				sampleRate:   spanCountPolicy.policy.SampleRate,
+			})
+		}
+	}
+	return group.sampleTrace(transactionEvent, stratum, errorSampleRate, spanCountCandidates)
 }
 
 func (g *traceGroups) getTraceGroup(transactionEvent *model.APMEvent) (*traceGroup, error) {
-	var pg *policyGroup
-	for i := range g.policyGroups {
-		if g.policyGroups[i].match(transactionEvent) {
-			pg = &g.policyGroups[i]
-			break
-		}
-	}
+	traceHasError := g.errorTraces.contains(transactionEvent.Trace.ID)
+	traceSpanCount := g.spanCounts.count(transactionEvent.Trace.ID)
+	pg := g.matchPolicyGroup(transactionEvent, traceHasError, traceSpanCount)
 	if pg == nil {
 		return nil, errNoMatchingPolicy
 	}
+	return g.getPolicyTraceGroup(pg, transactionEvent)
+}
+
+// matchPolicyGroup returns the first policy group matching transactionEvent,
+// or nil if there is none. traceHasError reports whether an error event has
+// been observed for the trace, and traceSpanCount holds the number of spans
+// stored for the trace.
+func (g *traceGroups) matchPolicyGroup(transactionEvent *model.APMEvent, traceHasError bool, traceSpanCount int) *policyGroup {
+	traceName := g.traceNameNormalizers.normalize(transactionEvent.Transaction.Name)
+	traceOutcome := transactionEvent.Event.Outcome
+	if traceOutcome == "" {
+		traceOutcome = g.defaultTraceOutcome
+	}
+	for i := range g.policyGroups {
+		if g.policyGroups[i].match(transactionEvent, traceName, traceOutcome, traceHasError, traceSpanCount) {
+			return &g.policyGroups[i]
+		}
+	}
+	return nil
+}
+
+// getPolicyTraceGroup returns the trace group of pg for transactionEvent,
+// creating a dynamic service group if necessary.
+func (g *traceGroups) getPolicyTraceGroup(pg *policyGroup, transactionEvent *model.APMEvent) (*traceGroup, error) {
+	atomic.AddInt64(&pg.metrics.matched, 1)
 	if pg.g != nil {
 		return pg.g, nil
 	}
@@ -146,62 +392,321 @@ func (g *traceGroups) getTraceGroup(transactionEvent *model.APMEvent) (*traceGro
 
 	group, ok := pg.dynamic[transactionEvent.Service.Name]
 	if !ok {
-		if g.numDynamicServiceGroups == g.maxDynamicServiceGroups {
+		if g.numDynamicServiceGroups == g.maxDynamicServiceGroups && !g.evictDynamicServiceGroup() {
+			atomic.AddInt64(&g.dynamicServiceGroupsRejected, 1)
+			atomic.AddInt64(&pg.metrics.dropped, 1)
+			if g.countDroppedTraces {
+				g.dropped[makeDroppedTraceKey(transactionEvent)]++
+			}
+			if g.countDecisions {
+				key := decisionKey{policy: pg.name, serviceName: transactionEvent.Service.Name}
+				g.addDecisionCounts(key, decisionCounts{dropped: 1})
+			}
+			if g.auditLog != nil {
+				g.auditLog.record(transactionEvent.Trace.ID, pg.name, false)
+			}
 			return nil, errTooManyTraceGroups
 		}
 		g.numDynamicServiceGroups++
-		group = newTraceGroup(pg.policy.SampleRate)
+		group = newTraceGroup(pg, g.traceGroupsConfig)
 		pg.dynamic[transactionEvent.Service.Name] = group
 	}
+	g.lastSeen++
+	group.lastSeen = g.lastSeen
+	group.seen = true
 	return group, nil
 }
 
-func (g *traceGroup) sampleTrace(transactionEvent *model.APMEvent) (bool, error) {
+// evictDynamicServiceGroup evicts the least recently seen dynamic service
+// group which has not been seen since the reservoirs were last finalized,
+// reporting whether a group was evicted. Such groups have no root
+// transactions awaiting a sampling decision, so no traces are lost by
+// evicting them; only their observed ingest rate is forgotten.
+//
+// evictDynamicServiceGroup must be called with g.mu held.
+func (g *traceGroups) evictDynamicServiceGroup() bool {
+	if !g.evictable {
+		return false
+	}
+	var lru *policyGroup
+	var lruServiceName string
+	var lruGroup *traceGroup
+	for i := range g.policyGroups {
+		pg := &g.policyGroups[i]
+		for serviceName, group := range pg.dynamic {
+			if group.seen || (lruGroup != nil && group.lastSeen >= lruGroup.lastSeen) {
+				continue
+			}
+			group.mu.Lock()
+			empty := group.reservoir.Len() == 0
+			group.mu.Unlock()
+			if empty {
+				lru, lruServiceName, lruGroup = pg, serviceName, group
+			}
+		}
+	}
+	if lruGroup == nil {
+		g.evictable = false
+		return false
+	}
+	delete(lru.dynamic, lruServiceName)
+	g.numDynamicServiceGroups--
+	atomic.AddInt64(&g.dynamicServiceGroupsEvicted, 1)
+	return true
+}
+
+// sampleTrace will return true if the root transaction is admitted to the
+// group's reservoir, and false otherwise. If errorSampleRate is positive and
+// the root transaction is admitted, it is recorded as a candidate for sampling
+// with that rate should an error be observed for the trace before the
+// reservoir is finalized. Similarly, if spanCountCandidates is non-empty, it
+// is recorded as a candidate for sampling should enough spans be stored.
+func (g *traceGroup) sampleTrace(
+	transactionEvent *model.APMEvent, stratum stratumKey,
+	errorSampleRate float64, spanCountCandidates []spanCountCandidate,
+) (bool, error) {
 	if g.samplingFraction == 0 {
+		atomic.AddInt64(&g.metrics.dropped, 1)
+		if g.dropped != nil || g.decisions != nil {
+			g.mu.Lock()
+			if g.dropped != nil {
+				g.dropped[makeDroppedTraceKey(transactionEvent)]++
+			}
+			if g.decisions != nil {
+				g.decisions.dropped++
+			}
+			g.mu.Unlock()
+		}
+		if g.auditLog != nil {
+			g.auditLog.record(transactionEvent.Trace.ID, g.policyName, false)
+		}
 		return false, nil
 	}
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	g.total++
-	return g.reservoir.Sample(
+	admitted := g.reservoir.Sample(
 		transactionEvent.Event.Duration.Seconds(),
+		stratum,
 		transactionEvent.Trace.ID,
-	), nil
+	)
+	if admitted {
+		if g.admitted != nil {
+			g.admitted[transactionEvent.Trace.ID] = makeDroppedTraceKey(transactionEvent)
+		}
+		if errorSampleRate > 0 {
+			if g.errorCandidates == nil {
+				g.errorCandidates = make(map[string]float64)
+			}
+			g.errorCandidates[transactionEvent.Trace.ID] = errorSampleRate
+		}
+		if len(spanCountCandidates) > 0 {
+			if g.spanCountCandidates == nil {
+				g.spanCountCandidates = make(map[string][]spanCountCandidate)
+			}
+			g.spanCountCandidates[transactionEvent.Trace.ID] = spanCountCandidates
+		}
+		return true, nil
+	}
+	if g.dropped != nil {
+		g.dropped[makeDroppedTraceKey(transactionEvent)]++
+	}
+	if g.auditLog != nil {
+		g.auditLog.record(transactionEvent.Trace.ID, g.policyName, false)
+	}
+	return false, nil
+}
+
+// sampleCompletedTrace reports whether the trace of a root transaction, which
+// has been signalled as complete, is sampled. Unlike sampleTrace, the decision
+// is made immediately rather than when the reservoirs are finalized: the trace
+// is sampled with a probability equal to the matching policy's sample rate.
+//
+// If the transaction is not sampled due to the transaction group limit having
+// been reached, sampleCompletedTrace will return errTooManyTraceGroups.
+func (g *traceGroups) sampleCompletedTrace(transactionEvent *model.APMEvent) (bool, error) {
+	group, err := g.getTraceGroup(transactionEvent)
+	if err != nil {
+		return false, err
+	}
+	sampled := group.sampleCompletedTrace(transactionEvent)
+	if sampled {
+		g.probabilities.record(transactionEvent.Trace.ID, group.samplingFraction)
+		g.sampledBy.record([]string{transactionEvent.Trace.ID}, group.policyName)
+	}
+	return sampled, nil
+}
+
+// sampleCompletedTrace samples the trace of a completed root transaction
+// independently of the reservoir, which only holds traces awaiting a decision.
+// Completed traces are therefore not included in the group's total.
+func (g *traceGroup) sampleCompletedTrace(transactionEvent *model.APMEvent) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sampled := g.rng.Float64() < g.samplingFraction
+	if sampled {
+		atomic.AddInt64(&g.metrics.kept, 1)
+		if g.decisions != nil {
+			g.decisions.kept++
+		}
+	} else {
+		atomic.AddInt64(&g.metrics.dropped, 1)
+		if g.dropped != nil {
+			g.dropped[makeDroppedTraceKey(transactionEvent)]++
+		}
+		if g.decisions != nil {
+			g.decisions.dropped++
+		}
+	}
+	if g.auditLog != nil {
+		g.auditLog.record(transactionEvent.Trace.ID, g.policyName, sampled)
+	}
+	return sampled
 }
 
 // finalizeSampledTraces locks the groups, appends their current trace IDs to
 // traceIDs, and returns the extended slice. On return the groups' sampling
 // reservoirs will be reset.
 //
-// If the maximum number of groups has been reached, then any dynamically
-// created groups with the minimum reservoir size (low ingest or sampling rate)
-// may be removed. These groups may also be removed if they have seen no
-// activity in this interval.
+// Any dynamically created groups with the minimum reservoir size (low ingest
+// or sampling rate) which have seen no activity in this interval are removed.
+// The remaining dynamic groups are marked as unseen, making them candidates
+// for eviction until they are next seen.
 func (g *traceGroups) finalizeSampledTraces(traceIDs []string) []string {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	maxDynamicServiceGroupsReached := g.numDynamicServiceGroups == g.maxDynamicServiceGroups
+	var droppedRoots *[]string
+	if g.keepDroppedRoots {
+		droppedRoots = &g.droppedRoots
+	}
 	for _, pg := range g.policyGroups {
+		ingestRateDecayFactor := g.environmentIngestRateDecayFactor(pg.policy.ServiceEnvironment)
+		n := len(traceIDs)
 		if pg.g != nil {
-			traceIDs = pg.g.finalizeSampledTraces(traceIDs, g.ingestRateDecayFactor)
+			traceIDs = pg.g.finalizeSampledTraces(traceIDs, ingestRateDecayFactor, g.dropped, droppedRoots, g.errorTraces, g.spanCounts, g.probabilities)
+			g.sampledBy.record(traceIDs[n:], pg.name)
+			g.addDecisions(pg.name, pg.policy.ServiceName, pg.g)
 			continue
 		}
 		for serviceName, group := range pg.dynamic {
 			total := group.total
-			traceIDs = group.finalizeSampledTraces(traceIDs, g.ingestRateDecayFactor)
-			if (maxDynamicServiceGroupsReached || total == 0) && group.reservoir.Size() == minReservoirSize {
+			traceIDs = group.finalizeSampledTraces(traceIDs, ingestRateDecayFactor, g.dropped, droppedRoots, g.errorTraces, g.spanCounts, g.probabilities)
+			g.sampledBy.record(traceIDs[n:], pg.name)
+			n = len(traceIDs)
+			g.addDecisions(pg.name, serviceName, group)
+			if total == 0 && group.reservoir.Size() == minReservoirSize {
 				g.numDynamicServiceGroups--
 				delete(pg.dynamic, serviceName)
+				continue
 			}
+			group.seen = false
 		}
 	}
+	g.evictable = g.numDynamicServiceGroups > 0
 	return traceIDs
 }
 
+// environmentIngestRateDecayFactor returns the ingest rate decay factor for
+// the groups of policies with the given service environment.
+func (g *traceGroups) environmentIngestRateDecayFactor(environment string) float64 {
+	if factor, ok := g.ingestRateDecayFactors[environment]; ok && environment != "" {
+		return factor
+	}
+	return g.ingestRateDecayFactor
+}
+
+// observeSpan records that a span has been stored for traceID, if any
+// policy has MinSpanCount criteria.
+func (g *traceGroups) observeSpan(traceID string) {
+	if g.spanCounts != nil {
+		g.spanCounts.observe(traceID)
+	}
+}
+
+// expireSpanCounts forgets the traces whose first span was stored more
+// than maxAge ago.
+func (g *traceGroups) expireSpanCounts(maxAge time.Duration) {
+	if g.spanCounts != nil {
+		g.spanCounts.expire(maxAge)
+	}
+}
+
+// observeError records that an error event has been observed for traceID,
+// if any policy has HasError criteria.
+func (g *traceGroups) observeError(traceID string) {
+	if g.errorTraces != nil {
+		g.errorTraces.observe(traceID)
+	}
+}
+
+// expireErrorTraces forgets the traces whose first error was observed more
+// than maxAge ago.
+func (g *traceGroups) expireErrorTraces(maxAge time.Duration) {
+	if g.errorTraces != nil {
+		g.errorTraces.expire(maxAge)
+	}
+}
+
+// takeDroppedTraces returns the number of root transactions dropped since the
+// last call, by droppedTraceKey, and resets the counts. Root transactions which
+// were admitted to a sampling reservoir are counted once the reservoir has been
+// finalized.
+//
+// takeDroppedTraces returns nil if dropped traces are not being counted.
+func (g *traceGroups) takeDroppedTraces() map[droppedTraceKey]int64 {
+	if !g.countDroppedTraces {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	dropped := g.dropped
+	g.dropped = make(map[droppedTraceKey]int64)
+	return dropped
+}
+
+// takeDroppedRoots returns the trace IDs of root transactions which were
+// admitted to a sampling reservoir, but not sampled, since the last call,
+// and resets them.
+//
+// takeDroppedRoots returns nil if dropped root transactions are not being
+// kept.
+func (g *traceGroups) takeDroppedRoots() []string {
+	if !g.keepDroppedRoots {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	droppedRoots := g.droppedRoots
+	g.droppedRoots = nil
+	return droppedRoots
+}
+
 // finalizeSampledTraces appends the group's current trace IDs to traceIDs, and
 // returns the extended slice. On return the groups' sampling reservoirs will be
 // reset.
-func (g *traceGroup) finalizeSampledTraces(traceIDs []string, ingestRateDecayFactor float64) []string {
+//
+// If dropped traces are being counted, the group's counts will be added to
+// dropped, and then reset. If decisions are being audited, the decisions for
+// the traces admitted to the reservoir are recorded. If droppedRoots is
+// non-nil, the trace IDs of root transactions admitted to the reservoir but
+// not sampled are appended to it. Candidates for HasError policies whose
+// traces are found in errorTraces are sampled by sampleErrorCandidates, and
+// candidates for MinSpanCount policies whose traces have enough spans in
+// spanCounts are sampled by sampleSpanCountCandidates.
+//
+// The probability with which each trace was sampled is recorded in
+// probabilities: the fraction of the group's root transactions sampled by
+// the reservoir in this interval, or the sample rate of the HasError or
+// MinSpanCount policy for error or span count candidates.
+func (g *traceGroup) finalizeSampledTraces(
+	traceIDs []string,
+	ingestRateDecayFactor float64,
+	dropped map[droppedTraceKey]int64,
+	droppedRoots *[]string,
+	errorTraces *errorTraces,
+	spanCounts *traceSpanCounts,
+	probabilities *sampleProbabilities,
+) []string {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
@@ -212,6 +717,7 @@ func (g *traceGroup) finalizeSampledTraces(traceIDs []string, ingestRateDecayFac
 		g.ingestRate += ingestRateDecayFactor * float64(g.total)
 	}
 	desiredTotal := int(math.Round(g.samplingFraction * float64(g.total)))
+	total := g.total
 	g.total = 0
 
 	for n := g.reservoir.Len(); n > desiredTotal; n-- {
@@ -220,7 +726,50 @@ func (g *traceGroup) finalizeSampledTraces(traceIDs []string, ingestRateDecayFac
 		// lowest weighted traces to limit to the desired total.
 		g.reservoir.Pop()
 	}
+	sampled := len(traceIDs)
 	traceIDs = append(traceIDs, g.reservoir.Values()...)
+	if probabilities != nil && total > 0 {
+		probability := float64(len(traceIDs)-sampled) / float64(total)
+		for _, traceID := range traceIDs[sampled:] {
+			probabilities.record(traceID, probability)
+		}
+	}
+	traceIDs = g.sampleErrorCandidates(traceIDs, sampled, errorTraces, probabilities)
+	traceIDs = g.sampleSpanCountCandidates(traceIDs, sampled, spanCounts, probabilities)
+	kept := len(traceIDs) - sampled
+	if total > 0 {
+		g.effectiveSampleRate = float64(kept) / float64(total)
+	}
+	atomic.AddInt64(&g.metrics.kept, int64(kept))
+	atomic.AddInt64(&g.metrics.dropped, int64(total-kept))
+	if g.decisions != nil {
+		g.decisions.kept += int64(kept)
+		g.decisions.dropped += int64(total - kept)
+	}
+	if g.admitted != nil {
+		for _, traceID := range traceIDs[sampled:] {
+			delete(g.admitted, traceID)
+			if g.auditLog != nil {
+				g.auditLog.record(traceID, g.policyName, true)
+			}
+		}
+		for traceID, key := range g.admitted {
+			if g.dropped != nil {
+				g.dropped[key]++
+			}
+			if droppedRoots != nil {
+				*droppedRoots = append(*droppedRoots, traceID)
+			}
+			if g.auditLog != nil {
+				g.auditLog.record(traceID, g.policyName, false)
+			}
+			delete(g.admitted, traceID)
+		}
+	}
+	for key, n := range g.dropped {
+		dropped[key] += n
+		delete(g.dropped, key)
+	}
 
 	// Resize the reservoir, so that it can hold the desired fraction of
 	// the observed ingest rate.
@@ -232,3 +781,82 @@ func (g *traceGroup) finalizeSampledTraces(traceIDs []string, ingestRateDecayFac
 	g.reservoir.Resize(newReservoirSize)
 	return traceIDs
 }
+
+// sampleErrorCandidates appends to traceIDs the error candidates which were
+// not sampled by the reservoir, i.e. are not in traceIDs[sampled:], but whose
+// traces have since been observed to have errors, each with the sample rate
+// of the HasError policy it would have matched, which is recorded in
+// probabilities. Such traces are counted as kept by this group. The
+// candidates are reset.
+func (g *traceGroup) sampleErrorCandidates(
+	traceIDs []string, sampled int,
+	errorTraces *errorTraces,
+	probabilities *sampleProbabilities,
+) []string {
+	if len(g.errorCandidates) == 0 {
+		return traceIDs
+	}
+	reservoirSampled := make(map[string]struct{}, len(traceIDs)-sampled)
+	for _, traceID := range traceIDs[sampled:] {
+		reservoirSampled[traceID] = struct{}{}
+	}
+	for traceID, sampleRate := range g.errorCandidates {
+		delete(g.errorCandidates, traceID)
+		if _, ok := reservoirSampled[traceID]; ok || !errorTraces.contains(traceID) {
+			continue
+		}
+		if g.rng.Float64() < sampleRate {
+			traceIDs = append(traceIDs, traceID)
+			probabilities.record(traceID, sampleRate)
+		}
+	}
+	return traceIDs
+}
+
+// spanCountCandidate records that a root transaction would match a policy
+// with the given sample rate, were minSpanCount spans stored for its trace.
+type spanCountCandidate struct {
+	minSpanCount int
+	sampleRate   float64
+}
+
+// sampleSpanCountCandidates appends to traceIDs the span count candidates
+// which were not sampled, i.e. are not in traceIDs[sampled:], but for whose
+// traces enough spans have since been stored, each with the sample rate of
+// the policy it would have matched given the trace's span count, which is
+// recorded in probabilities. Such traces are counted as kept by this group.
+// The candidates are reset.
+func (g *traceGroup) sampleSpanCountCandidates(
+	traceIDs []string, sampled int,
+	spanCounts *traceSpanCounts,
+	probabilities *sampleProbabilities,
+) []string {
+	if len(g.spanCountCandidates) == 0 {
+		return traceIDs
+	}
+	alreadySampled := make(map[string]struct{}, len(traceIDs)-sampled)
+	for _, traceID := range traceIDs[sampled:] {
+		alreadySampled[traceID] = struct{}{}
+	}
+	for traceID, candidates := range g.spanCountCandidates {
+		delete(g.spanCountCandidates, traceID)
+		if _, ok := alreadySampled[traceID]; ok {
+			continue
+		}
+		// Candidates are in ascending order of minSpanCount, and the
+		// policy matched is that of the greatest minSpanCount reached.
+		spanCount := spanCounts.count(traceID)
+		sampleRate := -1.0
+		for _, candidate := range candidates {
+			if spanCount < candidate.minSpanCount {
+				break
+			}
+			sampleRate = candidate.sampleRate
+		}
+		if sampleRate >= 0 && g.rng.Float64() < sampleRate {
+			traceIDs = append(traceIDs, traceID)
+			probabilities.record(traceID, sampleRate)
+		}
+	}
+	return traceIDs
+}
@@ -6,6 +6,7 @@ package sampling
 
 import (
 	"fmt"
+	"io"
 	"testing"
 	"time"
 
@@ -63,7 +64,10 @@ func TestTraceGroupsPolicies(t *testing.T) {
 		policy.ServiceName = ""
 		policies = append(policies, policy)
 	}
-	groups := newTraceGroups(policies, 1000, 1.0)
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1000,
+		ingestRateDecayFactor:   1.0,
+	})
 
 	assertSampleRate := func(sampleRate float64, serviceName, serviceEnvironment, traceOutcome, traceName string) {
 		tx := makeTransaction(serviceName, serviceEnvironment, traceOutcome, traceName)
@@ -85,13 +89,141 @@ func TestTraceGroupsPolicies(t *testing.T) {
 	}
 }
 
+func TestTraceGroupsTraceNameNormalizers(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{TraceName: "GET /user/:id/orders/:id"}, SampleRate: 1},
+		{PolicyCriteria: PolicyCriteria{TraceName: "GET /user/:id"}, SampleRate: 0.5},
+		{SampleRate: 0},
+	}
+	normalizers := []TraceNameNormalizer{
+		{Pattern: `/\d+`, Replacement: "/:id"},
+		{Pattern: `^get `, Replacement: "GET "},
+	}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		traceNameNormalizers:    newTraceNameNormalizers(normalizers),
+		maxDynamicServiceGroups: 1000,
+		ingestRateDecayFactor:   1.0,
+	})
+
+	for _, test := range []struct {
+		traceName string
+		policy    int
+	}{
+		{"GET /user/12345", 1},
+		{"get /user/1", 1},
+		{"GET /user/1/orders/2", 0},
+		{"GET /user/:id", 1},
+		{"GET /user/abc", 2},
+		{"POST /user/1", 2},
+	} {
+		tx := &model.APMEvent{
+			Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &model.Transaction{Name: test.traceName},
+		}
+		before := groups.policyGroups[test.policy].metrics.matched
+		_, err := groups.sampleTrace(tx)
+		require.NoError(t, err)
+		assert.Equal(t, before+1, groups.policyGroups[test.policy].metrics.matched, test.traceName)
+
+		// The transaction name itself is not modified.
+		assert.Equal(t, test.traceName, tx.Transaction.Name)
+	}
+}
+
+func TestTraceGroupsDefaultTraceOutcome(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{TraceOutcome: "failure"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	for _, test := range []struct {
+		defaultTraceOutcome string
+		outcome             string
+		policy              int
+	}{
+		{"", "", 1},
+		{"", "failure", 0},
+		{"failure", "", 0},
+		{"failure", "success", 1},
+		{"unknown", "", 1},
+	} {
+		groups := newTraceGroups(policies, traceGroupsConfig{
+			defaultTraceOutcome:     test.defaultTraceOutcome,
+			maxDynamicServiceGroups: 1000,
+			ingestRateDecayFactor:   1.0,
+		})
+		tx := &model.APMEvent{
+			Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+			Event:       model.Event{Outcome: test.outcome},
+			Transaction: &model.Transaction{Name: "GET /"},
+		}
+		_, err := groups.sampleTrace(tx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), groups.policyGroups[test.policy].metrics.matched, "%+v", test)
+
+		// The transaction outcome itself is not modified.
+		assert.Equal(t, test.outcome, tx.Event.Outcome)
+	}
+}
+
+func TestTraceGroupsSampleCompletedTrace(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{ServiceName: "never"}, SampleRate: 0},
+		{PolicyCriteria: PolicyCriteria{ServiceName: "always"}, SampleRate: 1},
+		{SampleRate: 0.5},
+	}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1000,
+		ingestRateDecayFactor:   1.0,
+		countDroppedTraces:      true,
+	})
+
+	makeTransaction := func(serviceName string) *model.APMEvent {
+		return &model.APMEvent{
+			Service:     model.Service{Name: serviceName},
+			Event:       model.Event{Duration: time.Millisecond},
+			Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &model.Transaction{Type: "request", Name: "GET /"},
+		}
+	}
+	var halfSampled int
+	for i := 0; i < 1000; i++ {
+		sampled, err := groups.sampleCompletedTrace(makeTransaction("never"))
+		require.NoError(t, err)
+		assert.False(t, sampled)
+		sampled, err = groups.sampleCompletedTrace(makeTransaction("always"))
+		require.NoError(t, err)
+		assert.True(t, sampled)
+		sampled, err = groups.sampleCompletedTrace(makeTransaction("sometimes"))
+		require.NoError(t, err)
+		if sampled {
+			halfSampled++
+		}
+	}
+	assert.InDelta(t, 500, halfSampled, 100)
+
+	// Completed traces are decided immediately, and are not
+	// added to the reservoirs to be finalized later.
+	assert.Empty(t, groups.finalizeSampledTraces(nil))
+	assert.Equal(t, int64(0), groups.policyGroups[0].metrics.kept)
+	assert.Equal(t, int64(1000), groups.policyGroups[0].metrics.dropped)
+	assert.Equal(t, int64(1000), groups.policyGroups[1].metrics.kept)
+	assert.Equal(t, int64(0), groups.policyGroups[1].metrics.dropped)
+	assert.Equal(t, map[droppedTraceKey]int64{
+		{serviceName: "never", transactionType: "request", transactionName: "GET /"}:     1000,
+		{serviceName: "sometimes", transactionType: "request", transactionName: "GET /"}: int64(1000 - halfSampled),
+	}, groups.takeDroppedTraces())
+}
+
 func TestTraceGroupsMax(t *testing.T) {
 	const (
 		maxDynamicServices    = 100
 		ingestRateCoefficient = 1.0
 	)
 	policies := []Policy{{SampleRate: 1.0}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   ingestRateCoefficient,
+	})
 
 	for i := 0; i < maxDynamicServices; i++ {
 		serviceName := fmt.Sprintf("service_group_%d", i)
@@ -122,6 +254,10 @@ func TestTraceGroupsMax(t *testing.T) {
 	})
 	assert.Equal(t, errTooManyTraceGroups, err)
 	assert.False(t, admitted)
+
+	metrics := groups.policyGroups[0].metrics
+	assert.Equal(t, int64(maxDynamicServices*minReservoirSize+1), metrics.matched)
+	assert.Equal(t, int64(1), metrics.dropped)
 }
 
 func TestTraceGroupReservoirResize(t *testing.T) {
@@ -130,7 +266,10 @@ func TestTraceGroupReservoirResize(t *testing.T) {
 		ingestRateCoefficient = 0.75
 	)
 	policies := []Policy{{SampleRate: 0.2}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   ingestRateCoefficient,
+	})
 
 	sendTransactions := func(n int) {
 		for i := 0; i < n; i++ {
@@ -163,13 +302,90 @@ func TestTraceGroupReservoirResize(t *testing.T) {
 	}
 }
 
+func TestTraceGroupReservoirResizeEnvironmentDecayFactor(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{ServiceName: "svc", ServiceEnvironment: "production"}, SampleRate: 0.2},
+		{PolicyCriteria: PolicyCriteria{ServiceName: "svc", ServiceEnvironment: "development"}, SampleRate: 0.2},
+	}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1,
+		ingestRateDecayFactor:   1.0,
+		ingestRateDecayFactors:  map[string]float64{"production": 0.75},
+	})
+	assert.Equal(t, 0.75, groups.environmentIngestRateDecayFactor("production"))
+	assert.Equal(t, 1.0, groups.environmentIngestRateDecayFactor("development"))
+
+	sendTransactions := func(environment string, n int) {
+		for i := 0; i < n; i++ {
+			groups.sampleTrace(&model.APMEvent{
+				Service:     model.Service{Name: "svc", Environment: environment},
+				Processor:   model.TransactionProcessor,
+				Trace:       model.Trace{ID: "0102030405060708090a0b0c0d0e0f10"},
+				Transaction: &model.Transaction{ID: "0102030405060708"},
+			})
+		}
+	}
+	sendTransactions("production", 10000)
+	sendTransactions("development", 10000)
+	assert.Len(t, groups.finalizeSampledTraces(nil), 2000) // initial reservoir sizes
+
+	// The production group's ingest rate decays by 0.75, while the
+	// development group's ingest rate is replaced by each interval's.
+	for i, expected := range []int{
+		2000 + 2000, // 0.2 * 10000 (initial ingest rate)
+		3500 + 4000, // 0.2 * (0.25*10000 + 0.75*20000) + 0.2 * 20000
+		3875 + 4000, // 0.2 * (0.25*17500 + 0.75*20000) + 0.2 * 20000
+	} {
+		sendTransactions("production", 20000)
+		sendTransactions("development", 20000)
+		assert.Len(t, groups.finalizeSampledTraces(nil), expected, fmt.Sprintf("iteration %d", i))
+	}
+}
+
+func TestTraceGroupReservoirStrategyDiversity(t *testing.T) {
+	policies := []Policy{{SampleRate: 0.1}}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1,
+		ingestRateDecayFactor:   1.0,
+		reservoirStrategy:       reservoirStrategyDiversity,
+	})
+
+	sendTransaction := func(traceID, name, outcome string) {
+		_, err := groups.sampleTrace(&model.APMEvent{
+			Processor:   model.TransactionProcessor,
+			Trace:       model.Trace{ID: traceID},
+			Event:       model.Event{Outcome: outcome},
+			Transaction: &model.Transaction{ID: traceID, Name: name},
+		})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 2000; i++ {
+		sendTransaction(fmt.Sprintf("common%d", i), "GET /common", "success")
+		if i%100 == 0 {
+			sendTransaction(fmt.Sprintf("rare%d", i), "GET /rare", "failure")
+		}
+	}
+
+	// The reservoir only has room for 10% of the root transactions, but
+	// all of the rare transactions are kept in preference to the common
+	// ones, as they differ by name and outcome.
+	sampled := groups.finalizeSampledTraces(nil)
+	assert.Len(t, sampled, 202)
+	for i := 0; i < 2000; i += 100 {
+		assert.Contains(t, sampled, fmt.Sprintf("rare%d", i))
+	}
+}
+
 func TestTraceGroupReservoirResizeMinimum(t *testing.T) {
 	const (
 		maxDynamicServices    = 1
 		ingestRateCoefficient = 1.0
 	)
 	policies := []Policy{{SampleRate: 0.1}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   ingestRateCoefficient,
+	})
 
 	sendTransactions := func(n int) {
 		for i := 0; i < n; i++ {
@@ -203,7 +419,10 @@ func TestTraceGroupsRemoval(t *testing.T) {
 		{SampleRate: 0.5},
 		{PolicyCriteria: PolicyCriteria{ServiceName: "defined_later"}, SampleRate: 0.5},
 	}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   ingestRateCoefficient,
+	})
 
 	for i := 0; i < 10000; i++ {
 		_, err := groups.sampleTrace(&model.APMEvent{
@@ -245,8 +464,9 @@ func TestTraceGroupsRemoval(t *testing.T) {
 	})
 	assert.Equal(t, errTooManyTraceGroups, err)
 
-	// Finalizing should remove the "few" trace group, since its reservoir
-	// size is at the minimum, and the number of groups is at the maximum.
+	// After finalizing, neither trace group has been seen in the current
+	// interval, so the least recently seen "many" trace group is evicted
+	// to make room for another trace group.
 	groups.finalizeSampledTraces(nil)
 
 	// We should now be able to add another trace group.
@@ -256,6 +476,65 @@ func TestTraceGroupsRemoval(t *testing.T) {
 		Transaction: &model.Transaction{},
 	})
 	assert.NoError(t, err)
+	assert.NotContains(t, groups.policyGroups[1].dynamic, "many")
+	assert.Contains(t, groups.policyGroups[1].dynamic, "few")
+}
+
+func TestTraceGroupsEviction(t *testing.T) {
+	const maxDynamicServices = 3
+	policies := []Policy{{SampleRate: 0.5}}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   1.0,
+	})
+
+	sampleTrace := func(serviceName string) error {
+		_, err := groups.sampleTrace(&model.APMEvent{
+			Service:     model.Service{Name: serviceName},
+			Event:       model.Event{Duration: time.Millisecond},
+			Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &model.Transaction{},
+		})
+		return err
+	}
+	assertServices := func(t *testing.T, serviceNames ...string) {
+		t.Helper()
+		var actual []string
+		for serviceName := range groups.policyGroups[0].dynamic {
+			actual = append(actual, serviceName)
+		}
+		assert.ElementsMatch(t, serviceNames, actual)
+		assert.Equal(t, len(serviceNames), groups.numDynamicServiceGroups)
+	}
+
+	for _, serviceName := range []string{"a", "b", "c"} {
+		require.NoError(t, sampleTrace(serviceName))
+	}
+
+	// All services have been seen in this interval, and may have
+	// traces awaiting a decision, so none may be evicted.
+	assert.Equal(t, errTooManyTraceGroups, sampleTrace("d"))
+	assertServices(t, "a", "b", "c")
+
+	// After finalizing, services are evicted in order of when they were
+	// last seen, skipping those seen since the reservoirs were finalized.
+	groups.finalizeSampledTraces(nil)
+	require.NoError(t, sampleTrace("c"))
+	require.NoError(t, sampleTrace("a"))
+	require.NoError(t, sampleTrace("d"))
+	assertServices(t, "a", "c", "d")
+	assert.Equal(t, errTooManyTraceGroups, sampleTrace("e"))
+	assertServices(t, "a", "c", "d")
+
+	groups.finalizeSampledTraces(nil)
+	require.NoError(t, sampleTrace("e"))
+	assertServices(t, "a", "d", "e")
+	require.NoError(t, sampleTrace("f"))
+	assertServices(t, "d", "e", "f")
+
+	assert.Equal(t, int64(3), groups.dynamicServiceGroupsEvicted)
+	assert.Equal(t, int64(2), groups.dynamicServiceGroupsRejected)
+	assert.Equal(t, int64(2), groups.policyGroups[0].metrics.dropped)
 }
 
 func BenchmarkTraceGroups(b *testing.B) {
@@ -264,7 +543,10 @@ func BenchmarkTraceGroups(b *testing.B) {
 		ingestRateCoefficient = 1.0
 	)
 	policies := []Policy{{SampleRate: 1.0}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   ingestRateCoefficient,
+	})
 
 	b.RunParallel(func(pb *testing.PB) {
 		// Transaction identifiers are different for each goroutine, simulating
@@ -285,3 +567,240 @@ func BenchmarkTraceGroups(b *testing.B) {
 		}
 	})
 }
+
+func TestTraceGroupsDroppedTraces(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{ServiceName: "never"}, SampleRate: 0},
+		{SampleRate: 0.5},
+	}
+	const maxDynamicServices = 1
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   1.0,
+		countDroppedTraces:      true,
+	})
+
+	makeTransaction := func(serviceName, transactionName string) *model.APMEvent {
+		return &model.APMEvent{
+			Service:     model.Service{Name: serviceName},
+			Event:       model.Event{Duration: time.Millisecond},
+			Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &model.Transaction{Type: "request", Name: transactionName},
+		}
+	}
+	for i := 0; i < 100; i++ {
+		_, err := groups.sampleTrace(makeTransaction("never", "never_sampled"))
+		require.NoError(t, err)
+		_, err = groups.sampleTrace(makeTransaction("dynamic", "half_sampled"))
+		require.NoError(t, err)
+		_, err = groups.sampleTrace(makeTransaction("too_many_groups", "dropped"))
+		assert.Equal(t, errTooManyTraceGroups, err)
+	}
+	sampled := groups.finalizeSampledTraces(nil)
+	assert.Len(t, sampled, 50)
+
+	assert.Equal(t, map[droppedTraceKey]int64{
+		{serviceName: "never", transactionType: "request", transactionName: "never_sampled"}:     100,
+		{serviceName: "dynamic", transactionType: "request", transactionName: "half_sampled"}:    50,
+		{serviceName: "too_many_groups", transactionType: "request", transactionName: "dropped"}: 100,
+	}, groups.takeDroppedTraces())
+	assert.Empty(t, groups.takeDroppedTraces())
+}
+
+func TestTraceGroupsDecisions(t *testing.T) {
+	policies := []Policy{
+		{Name: "never", PolicyCriteria: PolicyCriteria{ServiceName: "never"}, SampleRate: 0},
+		{SampleRate: 0.5},
+	}
+	const maxDynamicServices = 1
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   1.0,
+		countDecisions:          true,
+	})
+
+	makeTransaction := func(serviceName string) *model.APMEvent {
+		return &model.APMEvent{
+			Service:     model.Service{Name: serviceName},
+			Event:       model.Event{Duration: time.Millisecond},
+			Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &model.Transaction{Type: "request", Name: "name"},
+		}
+	}
+	for i := 0; i < 100; i++ {
+		_, err := groups.sampleTrace(makeTransaction("never"))
+		require.NoError(t, err)
+		_, err = groups.sampleTrace(makeTransaction("dynamic"))
+		require.NoError(t, err)
+		_, err = groups.sampleTrace(makeTransaction("too_many_groups"))
+		assert.Equal(t, errTooManyTraceGroups, err)
+	}
+	sampled, err := groups.sampleCompletedTrace(makeTransaction("never"))
+	require.NoError(t, err)
+	assert.False(t, sampled)
+	assert.Len(t, groups.finalizeSampledTraces(nil), 50)
+
+	assert.Equal(t, map[decisionKey]decisionCounts{
+		{policy: "never", serviceName: "never"}:       {dropped: 101},
+		{policy: "1", serviceName: "dynamic"}:         {kept: 50, dropped: 50},
+		{policy: "1", serviceName: "too_many_groups"}: {dropped: 100},
+	}, groups.takeDecisions())
+	assert.Empty(t, groups.takeDecisions())
+}
+
+func TestTraceGroupsDroppedRoots(t *testing.T) {
+	policies := []Policy{{SampleRate: 0.5}}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1,
+		ingestRateDecayFactor:   1.0,
+		keepDroppedRoots:        true,
+	})
+
+	traceIDs := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		traceID := uuid.Must(uuid.NewV4()).String()
+		admitted, err := groups.sampleTrace(&model.APMEvent{
+			Event:       model.Event{Duration: time.Millisecond},
+			Trace:       model.Trace{ID: traceID},
+			Transaction: &model.Transaction{Type: "request", Name: "name"},
+		})
+		require.NoError(t, err)
+		require.True(t, admitted)
+		traceIDs[traceID] = true
+	}
+	assert.Empty(t, groups.takeDroppedRoots())
+
+	// Root transactions admitted to the reservoir, but not sampled,
+	// are recorded when the reservoir is finalized.
+	sampled := groups.finalizeSampledTraces(nil)
+	droppedRoots := groups.takeDroppedRoots()
+	assert.Len(t, sampled, 50)
+	assert.Len(t, droppedRoots, 50)
+	for _, traceID := range append(sampled, droppedRoots...) {
+		assert.True(t, traceIDs[traceID])
+		delete(traceIDs, traceID)
+	}
+	assert.Empty(t, groups.takeDroppedRoots())
+}
+
+func TestTraceGroupsHasError(t *testing.T) {
+	policies := []Policy{
+		{Name: "errors", PolicyCriteria: PolicyCriteria{HasError: true}, SampleRate: 1},
+		{SampleRate: 0.01},
+	}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1000,
+		ingestRateDecayFactor:   1.0,
+	})
+	require.NotNil(t, groups.errorTraces)
+
+	sampleTrace := func(traceID string) {
+		admitted, err := groups.sampleTrace(&model.APMEvent{
+			Service:     model.Service{Name: "service_name"},
+			Event:       model.Event{Duration: time.Millisecond},
+			Trace:       model.Trace{ID: traceID},
+			Transaction: &model.Transaction{Type: "request", Name: "name"},
+		})
+		require.NoError(t, err)
+		require.True(t, admitted)
+	}
+
+	// Traces with errors observed before their root transactions match
+	// the HasError policy; those with errors observed afterwards are
+	// sampled when the reservoirs are finalized.
+	withErrors := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		traceID := fmt.Sprintf("early%d", i)
+		groups.observeError(traceID)
+		sampleTrace(traceID)
+		withErrors[traceID] = true
+	}
+	for i := 0; i < 5; i++ {
+		traceID := fmt.Sprintf("late%d", i)
+		sampleTrace(traceID)
+		groups.observeError(traceID)
+		withErrors[traceID] = true
+	}
+	for i := 0; i < 100; i++ {
+		sampleTrace(fmt.Sprintf("none%d", i))
+	}
+
+	// The default policy keeps round(105*0.01) = 1 trace, which may be
+	// one of those with errors; all traces with errors are sampled.
+	sampled := groups.finalizeSampledTraces(nil)
+	var withoutErrors int
+	for _, traceID := range sampled {
+		if withErrors[traceID] {
+			delete(withErrors, traceID)
+		} else {
+			withoutErrors++
+		}
+	}
+	assert.Empty(t, withErrors)
+	assert.LessOrEqual(t, withoutErrors, 1)
+
+	// Traces with errors observed after their root transactions are
+	// sampled even if the reservoir keeps none of its traces.
+	sampleTrace("late")
+	groups.observeError("late")
+	sampled = groups.finalizeSampledTraces(nil)
+	assert.Equal(t, []string{"late"}, sampled) // desired total is round(1*0.01)=0
+
+	groups.errorTraces.now = func() time.Time { return time.Now().Add(time.Hour) }
+	groups.expireErrorTraces(time.Minute)
+	assert.False(t, groups.errorTraces.contains("early0"))
+}
+
+func TestTraceGroupsAuditLog(t *testing.T) {
+	policies := []Policy{
+		{Name: "never", PolicyCriteria: PolicyCriteria{ServiceName: "never"}, SampleRate: 0},
+		{SampleRate: 0.5},
+	}
+	const maxDynamicServices = 1
+	auditLog := newAuditLog(io.Discard)
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: maxDynamicServices,
+		ingestRateDecayFactor:   1.0,
+		auditLog:                auditLog,
+	})
+
+	makeTransaction := func(serviceName string) *model.APMEvent {
+		return &model.APMEvent{
+			Service:     model.Service{Name: serviceName},
+			Event:       model.Event{Duration: time.Millisecond},
+			Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &model.Transaction{Type: "request"},
+		}
+	}
+	for i := 0; i < 100; i++ {
+		_, err := groups.sampleTrace(makeTransaction("never"))
+		require.NoError(t, err)
+		_, err = groups.sampleTrace(makeTransaction("dynamic"))
+		require.NoError(t, err)
+		_, err = groups.sampleTrace(makeTransaction("too_many_groups"))
+		assert.Equal(t, errTooManyTraceGroups, err)
+	}
+
+	// Traces admitted to the reservoir are only recorded once the
+	// reservoir is finalized.
+	assert.Len(t, auditLog.pending, 200)
+	sampled := groups.finalizeSampledTraces(nil)
+	assert.Len(t, sampled, 50)
+	assert.Len(t, auditLog.pending, 300)
+
+	decisions := make(map[[2]string]int)
+	traceDecisions := make(map[string]string)
+	for _, r := range auditLog.pending {
+		decisions[[2]string{r.Policy, r.Decision}]++
+		traceDecisions[r.TraceID] = r.Decision
+	}
+	assert.Len(t, traceDecisions, 300)
+	assert.Equal(t, map[[2]string]int{
+		{"never", "dropped"}: 100,
+		{"1", "sampled"}:     50,
+		{"1", "dropped"}:     150,
+	}, decisions)
+	for _, traceID := range sampled {
+		assert.Equal(t, "sampled", traceDecisions[traceID])
+	}
+}
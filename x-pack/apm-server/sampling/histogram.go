@@ -0,0 +1,126 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+	"github.com/elastic/go-hdrhistogram"
+)
+
+// durationHistogram records a distribution of durations with microsecond
+// precision, for reporting percentiles through CollectMonitoring.
+//
+// Percentiles are reported over a rotating window, so that recent changes
+// in latency are not hidden by the history since the process started. Each
+// report covers the durations recorded in the current window and the one
+// before it, i.e. between one and two windows' worth of durations.
+//
+// Durations are recorded into one of several shards, selected by a key,
+// to avoid a single point of lock contention between concurrent writers.
+// The shards are merged when reporting.
+//
+// durationHistogram is safe for concurrent use.
+type durationHistogram struct {
+	shards []histogramShard
+	window time.Duration
+	max    int64
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+type histogramShard struct {
+	mu          sync.Mutex
+	current     *hdrhistogram.Histogram
+	previous    *hdrhistogram.Histogram
+	windowStart time.Time
+}
+
+// newDurationHistogram returns a new durationHistogram which can record
+// durations up to max, reporting percentiles over a rotating window of the
+// given duration. Durations greater than max will be recorded as max.
+func newDurationHistogram(max, window time.Duration) *durationHistogram {
+	h := &durationHistogram{
+		// Create as many shards as there are CPUs, like
+		// eventstorage.ShardedReadWriter.
+		shards: make([]histogramShard, runtime.NumCPU()),
+		window: window,
+		max:    max.Microseconds(),
+		now:    time.Now,
+	}
+	now := h.now()
+	for i := range h.shards {
+		h.shards[i].current = h.newHistogram()
+		h.shards[i].previous = h.newHistogram()
+		h.shards[i].windowStart = now
+	}
+	return h
+}
+
+func (h *durationHistogram) newHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(1, h.max, 2)
+}
+
+// record records d in the histogram, in the shard selected by key.
+func (h *durationHistogram) record(key string, d time.Duration) {
+	us := d.Microseconds()
+	if us < 0 {
+		us = 0
+	} else if us > h.max {
+		us = h.max
+	}
+	var digest xxhash.Digest
+	digest.WriteString(key)
+	shard := &h.shards[digest.Sum64()%uint64(len(h.shards))]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	h.rotate(shard)
+	shard.current.RecordValue(us)
+}
+
+// rotate moves the shard's current window to the previous window if the
+// current window has elapsed, discarding the previous window. If more than
+// two windows have elapsed, both windows are discarded.
+//
+// rotate must be called with shard.mu held.
+func (h *durationHistogram) rotate(shard *histogramShard) {
+	elapsed := h.now().Sub(shard.windowStart)
+	if elapsed < h.window {
+		return
+	}
+	shard.previous.Reset()
+	if elapsed < 2*h.window {
+		shard.current, shard.previous = shard.previous, shard.current
+	} else {
+		shard.current.Reset()
+	}
+	shard.windowStart = shard.windowStart.Add(elapsed.Truncate(h.window))
+}
+
+// report reports the number of durations recorded in the reporting window,
+// and their 50th, 95th, and 99th percentiles in microseconds, to V.
+func (h *durationHistogram) report(V monitoring.Visitor) {
+	merged := h.newHistogram()
+	for i := range h.shards {
+		shard := &h.shards[i]
+		shard.mu.Lock()
+		h.rotate(shard)
+		merged.Merge(shard.previous)
+		merged.Merge(shard.current)
+		shard.mu.Unlock()
+	}
+	monitoring.ReportInt(V, "count", merged.TotalCount())
+	monitoring.ReportInt(V, "p50_us", merged.ValueAtQuantile(50))
+	monitoring.ReportInt(V, "p95_us", merged.ValueAtQuantile(95))
+	monitoring.ReportInt(V, "p99_us", merged.ValueAtQuantile(99))
+}
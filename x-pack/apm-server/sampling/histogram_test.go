@@ -0,0 +1,68 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+func TestDurationHistogram(t *testing.T) {
+	h := newDurationHistogram(time.Second, time.Minute)
+	for i := 1; i <= 100; i++ {
+		h.record(fmt.Sprint(i), time.Duration(i)*time.Millisecond)
+	}
+	h.record("", time.Hour) // clamped to max
+
+	snapshot := reportDurationHistogram(h)
+	assert.Equal(t, int64(101), snapshot.Ints["latency.count"])
+
+	// With 2 significant digits, hdrhistogram reports values with
+	// a relative error of up to 1%.
+	assert.InEpsilon(t, 51000, snapshot.Ints["latency.p50_us"], 0.01)
+	assert.InEpsilon(t, 96000, snapshot.Ints["latency.p95_us"], 0.01)
+	assert.InEpsilon(t, 100000, snapshot.Ints["latency.p99_us"], 0.01)
+}
+
+func TestDurationHistogramWindow(t *testing.T) {
+	h := newDurationHistogram(time.Second, time.Minute)
+	now := h.shards[0].windowStart
+	h.now = func() time.Time { return now }
+
+	h.record("a", 100*time.Millisecond)
+	snapshot := reportDurationHistogram(h)
+	assert.Equal(t, int64(1), snapshot.Ints["latency.count"])
+
+	// Durations in the previous window are still reported.
+	now = now.Add(time.Minute)
+	h.record("b", 200*time.Millisecond)
+	snapshot = reportDurationHistogram(h)
+	assert.Equal(t, int64(2), snapshot.Ints["latency.count"])
+
+	// Durations older than the previous window are discarded.
+	now = now.Add(time.Minute)
+	snapshot = reportDurationHistogram(h)
+	assert.Equal(t, int64(1), snapshot.Ints["latency.count"])
+	assert.InEpsilon(t, 200000, snapshot.Ints["latency.p50_us"], 0.01)
+
+	now = now.Add(2 * time.Minute)
+	snapshot = reportDurationHistogram(h)
+	assert.Equal(t, int64(0), snapshot.Ints["latency.count"])
+}
+
+func reportDurationHistogram(h *durationHistogram) monitoring.FlatSnapshot {
+	registry := monitoring.NewRegistry()
+	monitoring.NewFunc(registry, "latency", func(_ monitoring.Mode, V monitoring.Visitor) {
+		V.OnRegistryStart()
+		defer V.OnRegistryFinished()
+		h.report(V)
+	})
+	return monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+}
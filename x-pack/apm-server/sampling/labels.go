@@ -0,0 +1,162 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// numericLabelValueBytes holds the size attributed to each numeric label
+// value when limiting the total size of labels.
+const numericLabelValueBytes = 8
+
+// labelLimiter limits the number and total size of labels stored with
+// each buffered trace event.
+type labelLimiter struct {
+	// truncatedEvents and droppedLabels count the events whose labels
+	// were truncated, and the labels dropped. They are accessed
+	// atomically.
+	truncatedEvents int64
+	droppedLabels   int64
+
+	maxLabels int
+	maxBytes  int
+
+	// preserved holds the names of labels which are kept in preference
+	// to others when truncating.
+	preserved map[string]struct{}
+}
+
+// newLabelLimiter returns a new labelLimiter, or nil if neither maxLabels
+// nor maxBytes is positive.
+func newLabelLimiter(maxLabels, maxBytes int, preserved []string) *labelLimiter {
+	if maxLabels <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	l := &labelLimiter{
+		maxLabels: maxLabels,
+		maxBytes:  maxBytes,
+		preserved: make(map[string]struct{}, len(preserved)),
+	}
+	for _, name := range preserved {
+		l.preserved[name] = struct{}{}
+	}
+	return l
+}
+
+// limit returns event if its labels are within the limits, and otherwise a
+// shallow copy of event with its labels truncated. event is not modified, so
+// it may still be reported with all of its labels, e.g. if storing it fails.
+//
+// Labels are kept in order of preference, then name: preserved labels first,
+// and then the remaining labels. Labels which would exceed the maximum size
+// are skipped, so smaller labels later in the order may still be kept.
+func (l *labelLimiter) limit(event *model.APMEvent) *model.APMEvent {
+	n := len(event.Labels) + len(event.NumericLabels)
+	if n == 0 || l.within(event) {
+		return event
+	}
+
+	// A name may be used for both a string and a numeric label;
+	// names holds each name once.
+	names := make([]string, 0, n)
+	for k := range event.Labels {
+		names = append(names, k)
+	}
+	for k := range event.NumericLabels {
+		if _, ok := event.Labels[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		_, iPreserved := l.preserved[names[i]]
+		_, jPreserved := l.preserved[names[j]]
+		if iPreserved != jPreserved {
+			return iPreserved
+		}
+		return names[i] < names[j]
+	})
+
+	var kept, size int
+	keep := func(labelSize int) bool {
+		if l.maxLabels > 0 && kept == l.maxLabels {
+			return false
+		}
+		if l.maxBytes > 0 && size+labelSize > l.maxBytes {
+			return false
+		}
+		kept++
+		size += labelSize
+		return true
+	}
+	out := *event
+	out.Labels, out.NumericLabels = nil, nil
+	for _, k := range names {
+		if v, ok := event.Labels[k]; ok && keep(len(k)+labelValueBytes(v)) {
+			if out.Labels == nil {
+				out.Labels = make(model.Labels)
+			}
+			out.Labels[k] = v
+		}
+		if v, ok := event.NumericLabels[k]; ok && keep(len(k)+numericLabelValueBytes*numericLabelValues(v)) {
+			if out.NumericLabels == nil {
+				out.NumericLabels = make(model.NumericLabels)
+			}
+			out.NumericLabels[k] = v
+		}
+	}
+	atomic.AddInt64(&l.truncatedEvents, 1)
+	atomic.AddInt64(&l.droppedLabels, int64(n-kept))
+	return &out
+}
+
+// within reports whether the labels of event are within the limits.
+func (l *labelLimiter) within(event *model.APMEvent) bool {
+	if l.maxLabels > 0 && len(event.Labels)+len(event.NumericLabels) > l.maxLabels {
+		return false
+	}
+	if l.maxBytes <= 0 {
+		return true
+	}
+	var size int
+	for k, v := range event.Labels {
+		size += len(k) + labelValueBytes(v)
+	}
+	for k, v := range event.NumericLabels {
+		size += len(k) + numericLabelValueBytes*numericLabelValues(v)
+	}
+	return size <= l.maxBytes
+}
+
+func (l *labelLimiter) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "truncated_events", atomic.LoadInt64(&l.truncatedEvents))
+	monitoring.ReportInt(V, "dropped", atomic.LoadInt64(&l.droppedLabels))
+}
+
+// labelValueBytes returns the size of a string label's value. As with the
+// label encoding, Values takes precedence over Value if it is non-empty.
+func labelValueBytes(v model.LabelValue) int {
+	if len(v.Values) == 0 {
+		return len(v.Value)
+	}
+	var n int
+	for _, value := range v.Values {
+		n += len(value)
+	}
+	return n
+}
+
+// numericLabelValues returns the number of values of a numeric label.
+func numericLabelValues(v model.NumericLabelValue) int {
+	if len(v.Values) == 0 {
+		return 1
+	}
+	return len(v.Values)
+}
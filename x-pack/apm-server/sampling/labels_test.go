@@ -0,0 +1,90 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	assert.Nil(t, newLabelLimiter(0, 0, nil))
+
+	event := &model.APMEvent{
+		Labels: model.Labels{
+			"a":        {Value: "1"},
+			"b":        {Values: []string{"12", "34"}},
+			"c":        {Value: "123456789"},
+			"complete": {Value: "true"},
+		},
+		NumericLabels: model.NumericLabels{
+			"a": {Value: 1},
+			"d": {Values: []float64{1, 2}},
+		},
+	}
+	for _, test := range []struct {
+		name          string
+		maxLabels     int
+		maxBytes      int
+		labels        model.Labels
+		numericLabels model.NumericLabels
+		truncated     bool
+	}{{
+		name:          "within_limits",
+		maxLabels:     6,
+		maxBytes:      1000,
+		labels:        event.Labels,
+		numericLabels: event.NumericLabels,
+	}, {
+		name:      "max_labels",
+		maxLabels: 3,
+		truncated: true,
+		// Preserved labels are kept first, and then labels by name,
+		// with string and numeric labels counted separately.
+		labels: model.Labels{
+			"complete": {Value: "true"},
+			"a":        {Value: "1"},
+		},
+		numericLabels: model.NumericLabels{
+			"a": {Value: 1},
+		},
+	}, {
+		name:      "max_bytes",
+		maxBytes:  30,
+		truncated: true,
+		// Labels which would exceed the limit are skipped: "c" (10 bytes)
+		// and "d" (17 bytes), after "complete" (12), "a" (2 and 9), and
+		// "b" (5).
+		labels: model.Labels{
+			"complete": {Value: "true"},
+			"a":        {Value: "1"},
+			"b":        {Values: []string{"12", "34"}},
+		},
+		numericLabels: model.NumericLabels{
+			"a": {Value: 1},
+		},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			l := newLabelLimiter(test.maxLabels, test.maxBytes, []string{"complete"})
+			out := l.limit(event)
+			assert.Equal(t, test.labels, out.Labels)
+			assert.Equal(t, test.numericLabels, out.NumericLabels)
+			if !test.truncated {
+				assert.Same(t, event, out)
+				assert.Zero(t, l.truncatedEvents)
+				return
+			}
+			assert.Equal(t, int64(1), l.truncatedEvents)
+			assert.Equal(t, int64(6-len(test.labels)-len(test.numericLabels)), l.droppedLabels)
+
+			// The original event is not modified.
+			assert.Len(t, event.Labels, 4)
+			assert.Len(t, event.NumericLabels, 2)
+		})
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// PolicyMatcher holds a boolean expression for matching root transactions
+// to a tail-sampling policy, for criteria that cannot be expressed by
+// PolicyCriteria alone, whose fields are implicitly AND-ed.
+//
+// Exactly one of Criteria, All, or Any must be specified. For example,
+// "(service a OR service b) AND environment prod" may be expressed as:
+//
+//	PolicyMatcher{All: []PolicyMatcher{
+//		{Any: []PolicyMatcher{
+//			{Criteria: PolicyCriteria{ServiceName: "a"}},
+//			{Criteria: PolicyCriteria{ServiceName: "b"}},
+//		}},
+//		{Criteria: PolicyCriteria{ServiceEnvironment: "prod"}},
+//	}}
+type PolicyMatcher struct {
+	// Criteria holds criteria which must all be matched. At least one
+	// criterion must be specified.
+	Criteria PolicyCriteria
+
+	// All holds matchers which must all match.
+	All []PolicyMatcher
+
+	// Any holds matchers of which at least one must match.
+	Any []PolicyMatcher
+}
+
+func (m PolicyMatcher) validate() error {
+	var n int
+	if m.Criteria != (PolicyCriteria{}) {
+		n++
+	}
+	if m.All != nil {
+		n++
+	}
+	if m.Any != nil {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of Criteria, All, or Any must be specified")
+	}
+	if err := m.Criteria.validate(); err != nil {
+		return err
+	}
+	if err := validatePolicyMatchers(m.All, "All"); err != nil {
+		return err
+	}
+	return validatePolicyMatchers(m.Any, "Any")
+}
+
+func validatePolicyMatchers(matchers []PolicyMatcher, name string) error {
+	if matchers != nil && len(matchers) == 0 {
+		return errors.Errorf("%s must not be empty", name)
+	}
+	for i, m := range matchers {
+		if err := m.validate(); err != nil {
+			return errors.Wrapf(err, "%s %d invalid", name, i)
+		}
+	}
+	return nil
+}
+
+// matchFunc reports whether a root transaction matches. traceName holds
+// the transaction's name, normalized by any TraceNameNormalizers,
+// traceOutcome holds the transaction's outcome, or DefaultTraceOutcome
+// if the outcome is empty, traceHasError reports whether an error event
+// has been observed for the trace, and traceSpanCount holds the number
+// of spans stored for the trace.
+type matchFunc func(transactionEvent *model.APMEvent, traceName, traceOutcome string, traceHasError bool, traceSpanCount int) bool
+
+// compile returns a matchFunc for evaluating the matcher, which must have
+// been validated.
+func (m PolicyMatcher) compile() matchFunc {
+	switch {
+	case m.All != nil:
+		funcs := compilePolicyMatchers(m.All)
+		return func(transactionEvent *model.APMEvent, traceName, traceOutcome string, traceHasError bool, traceSpanCount int) bool {
+			for _, f := range funcs {
+				if !f(transactionEvent, traceName, traceOutcome, traceHasError, traceSpanCount) {
+					return false
+				}
+			}
+			return true
+		}
+	case m.Any != nil:
+		funcs := compilePolicyMatchers(m.Any)
+		return func(transactionEvent *model.APMEvent, traceName, traceOutcome string, traceHasError bool, traceSpanCount int) bool {
+			for _, f := range funcs {
+				if f(transactionEvent, traceName, traceOutcome, traceHasError, traceSpanCount) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return m.Criteria.match
+}
+
+func compilePolicyMatchers(matchers []PolicyMatcher) []matchFunc {
+	funcs := make([]matchFunc, len(matchers))
+	for i, m := range matchers {
+		funcs[i] = m.compile()
+	}
+	return funcs
+}
+
+// compile returns a matchFunc for evaluating the policy's criteria and
+// matcher, if any, which must all match.
+func (p Policy) compile() matchFunc {
+	if p.Match == nil {
+		return p.PolicyCriteria.match
+	}
+	matcher := p.Match.compile()
+	return func(transactionEvent *model.APMEvent, traceName, traceOutcome string, traceHasError bool, traceSpanCount int) bool {
+		return p.PolicyCriteria.match(transactionEvent, traceName, traceOutcome, traceHasError, traceSpanCount) &&
+			matcher(transactionEvent, traceName, traceOutcome, traceHasError, traceSpanCount)
+	}
+}
+
+// match reports whether transactionEvent matches all specified criteria,
+// matching traceName against TraceName, traceOutcome against TraceOutcome,
+// traceHasError against HasError, the transaction's duration against
+// MinDuration and MaxDuration, its HTTP response status code against
+// MinHTTPStatusCode and MaxHTTPStatusCode, and traceSpanCount against
+// MinSpanCount.
+func (c PolicyCriteria) match(transactionEvent *model.APMEvent, traceName, traceOutcome string, traceHasError bool, traceSpanCount int) bool {
+	if c.ServiceName != "" && c.ServiceName != transactionEvent.Service.Name {
+		return false
+	}
+	if c.ServiceEnvironment != "" && c.ServiceEnvironment != transactionEvent.Service.Environment {
+		return false
+	}
+	if c.TraceOutcome != "" && c.TraceOutcome != traceOutcome {
+		return false
+	}
+	if c.TraceName != "" && c.TraceName != traceName {
+		return false
+	}
+	if c.HasError && !traceHasError {
+		return false
+	}
+	if c.MinSpanCount > 0 && traceSpanCount < c.MinSpanCount {
+		return false
+	}
+	if c.MinDuration > 0 && transactionEvent.Event.Duration < c.MinDuration {
+		return false
+	}
+	if c.MaxDuration > 0 && transactionEvent.Event.Duration >= c.MaxDuration {
+		return false
+	}
+	if c.MinHTTPStatusCode > 0 || c.MaxHTTPStatusCode > 0 {
+		var statusCode int
+		if transactionEvent.HTTP.Response != nil {
+			statusCode = transactionEvent.HTTP.Response.StatusCode
+		}
+		if statusCode <= 0 || statusCode < c.MinHTTPStatusCode {
+			return false
+		}
+		if c.MaxHTTPStatusCode > 0 && statusCode > c.MaxHTTPStatusCode {
+			return false
+		}
+	}
+	return true
+}
+
+// hasErrorCriteria reports whether any of the matcher's criteria, or those
+// of its nested matchers, specify HasError.
+func (m PolicyMatcher) hasErrorCriteria() bool {
+	if m.Criteria.HasError {
+		return true
+	}
+	for _, matchers := range [][]PolicyMatcher{m.All, m.Any} {
+		for _, m := range matchers {
+			if m.hasErrorCriteria() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasErrorCriteria reports whether the policy's criteria, or those of its
+// matcher, specify HasError.
+func (p Policy) hasErrorCriteria() bool {
+	return p.HasError || (p.Match != nil && p.Match.hasErrorCriteria())
+}
+
+// appendSpanCountThresholds appends the positive MinSpanCount of the
+// matcher's criteria, and those of its nested matchers, to thresholds.
+func (m PolicyMatcher) appendSpanCountThresholds(thresholds []int) []int {
+	if m.Criteria.MinSpanCount > 0 {
+		thresholds = append(thresholds, m.Criteria.MinSpanCount)
+	}
+	for _, matchers := range [][]PolicyMatcher{m.All, m.Any} {
+		for _, m := range matchers {
+			thresholds = m.appendSpanCountThresholds(thresholds)
+		}
+	}
+	return thresholds
+}
+
+// appendSpanCountThresholds appends the positive MinSpanCount of the
+// policy's criteria, and those of its matcher, to thresholds. Whether the
+// policy matches a trace can only change with the trace's span count when
+// the span count reaches one of these thresholds.
+func (p Policy) appendSpanCountThresholds(thresholds []int) []int {
+	if p.MinSpanCount > 0 {
+		thresholds = append(thresholds, p.MinSpanCount)
+	}
+	if p.Match != nil {
+		thresholds = p.Match.appendSpanCountThresholds(thresholds)
+	}
+	return thresholds
+}
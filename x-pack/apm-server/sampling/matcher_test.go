@@ -0,0 +1,276 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+func TestPolicyMatcherValidate(t *testing.T) {
+	for name, test := range map[string]struct {
+		matcher PolicyMatcher
+		err     string
+	}{
+		"Criteria": {
+			matcher: PolicyMatcher{Criteria: PolicyCriteria{ServiceName: "a"}},
+		},
+		"Nested": {
+			matcher: PolicyMatcher{All: []PolicyMatcher{
+				{Any: []PolicyMatcher{{Criteria: PolicyCriteria{ServiceName: "a"}}}},
+				{Criteria: PolicyCriteria{TraceOutcome: "failure"}},
+			}},
+		},
+		"Empty": {
+			matcher: PolicyMatcher{},
+			err:     "exactly one of Criteria, All, or Any must be specified",
+		},
+		"CriteriaAndAll": {
+			matcher: PolicyMatcher{
+				Criteria: PolicyCriteria{ServiceName: "a"},
+				All:      []PolicyMatcher{{Criteria: PolicyCriteria{ServiceName: "b"}}},
+			},
+			err: "exactly one of Criteria, All, or Any must be specified",
+		},
+		"AllAndAny": {
+			matcher: PolicyMatcher{
+				All: []PolicyMatcher{{Criteria: PolicyCriteria{ServiceName: "a"}}},
+				Any: []PolicyMatcher{{Criteria: PolicyCriteria{ServiceName: "b"}}},
+			},
+			err: "exactly one of Criteria, All, or Any must be specified",
+		},
+		"EmptyAny": {
+			matcher: PolicyMatcher{Any: []PolicyMatcher{}},
+			err:     "Any must not be empty",
+		},
+		"InvalidNested": {
+			matcher: PolicyMatcher{Any: []PolicyMatcher{
+				{Criteria: PolicyCriteria{ServiceName: "a"}},
+				{All: []PolicyMatcher{{}}},
+			}},
+			err: "Any 1 invalid: All 0 invalid: exactly one of Criteria, All, or Any must be specified",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := test.matcher.validate()
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+}
+
+func TestPolicyMatcherCompile(t *testing.T) {
+	makeTransaction := func(serviceName, serviceEnvironment, traceOutcome string) *model.APMEvent {
+		return &model.APMEvent{
+			Service:     model.Service{Name: serviceName, Environment: serviceEnvironment},
+			Event:       model.Event{Outcome: traceOutcome},
+			Transaction: &model.Transaction{Name: "GET /"},
+		}
+	}
+	criteria := func(c PolicyCriteria) PolicyMatcher {
+		return PolicyMatcher{Criteria: c}
+	}
+
+	// (service a OR service b) AND
+	// (environment production OR (environment staging AND outcome failure))
+	policy := Policy{
+		PolicyCriteria: PolicyCriteria{TraceName: "GET /"},
+		Match: &PolicyMatcher{All: []PolicyMatcher{
+			{Any: []PolicyMatcher{
+				criteria(PolicyCriteria{ServiceName: "a"}),
+				criteria(PolicyCriteria{ServiceName: "b"}),
+			}},
+			{Any: []PolicyMatcher{
+				criteria(PolicyCriteria{ServiceEnvironment: "production"}),
+				criteria(PolicyCriteria{ServiceEnvironment: "staging", TraceOutcome: "failure"}),
+			}},
+		}},
+	}
+	require.NoError(t, policy.validate())
+	match := policy.compile()
+
+	for _, test := range []struct {
+		event *model.APMEvent
+		match bool
+	}{
+		{makeTransaction("a", "production", "success"), true},
+		{makeTransaction("b", "production", "failure"), true},
+		{makeTransaction("a", "staging", "failure"), true},
+		{makeTransaction("a", "staging", "success"), false},
+		{makeTransaction("c", "production", "success"), false},
+		{makeTransaction("", "production", "success"), false},
+	} {
+		assert.Equal(t, test.match, match(test.event, test.event.Transaction.Name, test.event.Event.Outcome, false, 0), "%+v %+v", test.event.Service, test.event.Event)
+	}
+
+	// The policy's own criteria are AND-ed with the matcher.
+	event := makeTransaction("a", "production", "success")
+	event.Transaction.Name = "GET /healthcheck"
+	assert.False(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 0))
+
+	// A policy without a matcher matches on its criteria alone.
+	assert.True(t, Policy{}.compile()(event, event.Transaction.Name, event.Event.Outcome, false, 0))
+}
+
+func TestPolicyCriteriaHasError(t *testing.T) {
+	event := &model.APMEvent{
+		Event:       model.Event{Outcome: "success"},
+		Transaction: &model.Transaction{Name: "GET /"},
+	}
+	policy := Policy{PolicyCriteria: PolicyCriteria{HasError: true}}
+	require.NoError(t, policy.validate())
+	assert.True(t, policy.hasErrorCriteria())
+	match := policy.compile()
+	assert.True(t, match(event, event.Transaction.Name, event.Event.Outcome, true, 0))
+	assert.False(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 0))
+
+	// HasError criteria may be nested in a matcher.
+	policy = Policy{Match: &PolicyMatcher{Any: []PolicyMatcher{
+		{Criteria: PolicyCriteria{TraceOutcome: "failure"}},
+		{Criteria: PolicyCriteria{HasError: true}},
+	}}}
+	require.NoError(t, policy.validate())
+	assert.True(t, policy.hasErrorCriteria())
+	match = policy.compile()
+	assert.True(t, match(event, event.Transaction.Name, event.Event.Outcome, true, 0))
+	assert.False(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 0))
+
+	assert.False(t, Policy{PolicyCriteria: PolicyCriteria{TraceOutcome: "failure"}}.hasErrorCriteria())
+}
+
+func TestPolicyCriteriaMinSpanCount(t *testing.T) {
+	event := &model.APMEvent{
+		Event:       model.Event{Outcome: "success"},
+		Transaction: &model.Transaction{Name: "GET /"},
+	}
+	policy := Policy{PolicyCriteria: PolicyCriteria{MinSpanCount: 10}}
+	require.NoError(t, policy.validate())
+	match := policy.compile()
+	assert.True(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 10))
+	assert.True(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 11))
+	assert.False(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 9))
+
+	// MinSpanCount criteria may be nested in a matcher, and the thresholds
+	// of the policy and its matcher are all reported.
+	policy = Policy{
+		PolicyCriteria: PolicyCriteria{MinSpanCount: 2},
+		Match: &PolicyMatcher{Any: []PolicyMatcher{
+			{Criteria: PolicyCriteria{TraceOutcome: "failure"}},
+			{Criteria: PolicyCriteria{MinSpanCount: 5}},
+		}},
+	}
+	require.NoError(t, policy.validate())
+	assert.Equal(t, []int{2, 5}, policy.appendSpanCountThresholds(nil))
+	match = policy.compile()
+	assert.True(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 5))
+	assert.False(t, match(event, event.Transaction.Name, event.Event.Outcome, false, 4))
+	assert.True(t, match(event, event.Transaction.Name, "failure", false, 2))
+	assert.False(t, match(event, event.Transaction.Name, "failure", false, 1))
+
+	assert.Empty(t, Policy{PolicyCriteria: PolicyCriteria{HasError: true}}.appendSpanCountThresholds(nil))
+}
+
+func TestPolicyCriteriaDuration(t *testing.T) {
+	makeTransaction := func(duration time.Duration) *model.APMEvent {
+		return &model.APMEvent{
+			Event:       model.Event{Duration: duration},
+			Transaction: &model.Transaction{Name: "GET /"},
+		}
+	}
+	for _, test := range []struct {
+		criteria PolicyCriteria
+		duration time.Duration
+		match    bool
+	}{
+		{PolicyCriteria{MinDuration: time.Second}, time.Second, true},
+		{PolicyCriteria{MinDuration: time.Second}, time.Second - 1, false},
+		{PolicyCriteria{MaxDuration: time.Second}, time.Second - 1, true},
+		{PolicyCriteria{MaxDuration: time.Second}, time.Second, false},
+		{PolicyCriteria{MinDuration: time.Second, MaxDuration: 2 * time.Second}, 1500 * time.Millisecond, true},
+		{PolicyCriteria{MinDuration: time.Second, MaxDuration: 2 * time.Second}, 2 * time.Second, false},
+	} {
+		policy := Policy{PolicyCriteria: test.criteria}
+		require.NoError(t, policy.validate())
+		event := makeTransaction(test.duration)
+		match := policy.compile()(event, event.Transaction.Name, event.Event.Outcome, false, 0)
+		assert.Equal(t, test.match, match, "%+v %s", test.criteria, test.duration)
+	}
+}
+
+func TestPolicyCriteriaHTTPStatusCode(t *testing.T) {
+	makeTransaction := func(statusCode int) *model.APMEvent {
+		event := &model.APMEvent{Transaction: &model.Transaction{Name: "GET /"}}
+		if statusCode > 0 {
+			event.HTTP.Response = &model.HTTPResponse{StatusCode: statusCode}
+		}
+		return event
+	}
+	serverErrors := PolicyCriteria{MinHTTPStatusCode: 500, MaxHTTPStatusCode: 599}
+	successes := PolicyCriteria{MinHTTPStatusCode: 200, MaxHTTPStatusCode: 299}
+	notFound := PolicyCriteria{MinHTTPStatusCode: 404, MaxHTTPStatusCode: 404}
+	for _, test := range []struct {
+		criteria   PolicyCriteria
+		statusCode int
+		match      bool
+	}{
+		{serverErrors, 500, true},
+		{serverErrors, 503, true},
+		{serverErrors, 599, true},
+		{serverErrors, 499, false},
+		{serverErrors, 200, false},
+		{serverErrors, 0, false},
+		{successes, 200, true},
+		{successes, 204, true},
+		{successes, 301, false},
+		{notFound, 404, true},
+		{notFound, 403, false},
+		{PolicyCriteria{MinHTTPStatusCode: 400}, 404, true},
+		{PolicyCriteria{MinHTTPStatusCode: 400}, 503, true},
+		{PolicyCriteria{MinHTTPStatusCode: 400}, 302, false},
+		{PolicyCriteria{MaxHTTPStatusCode: 399}, 101, true},
+		{PolicyCriteria{MaxHTTPStatusCode: 399}, 400, false},
+		{PolicyCriteria{MaxHTTPStatusCode: 399}, 0, false},
+	} {
+		policy := Policy{PolicyCriteria: test.criteria}
+		require.NoError(t, policy.validate())
+		event := makeTransaction(test.statusCode)
+		match := policy.compile()(event, event.Transaction.Name, event.Event.Outcome, false, 0)
+		assert.Equal(t, test.match, match, "%+v %d", test.criteria, test.statusCode)
+	}
+}
+
+func TestTraceGroupsPolicyMatcher(t *testing.T) {
+	policies := []Policy{{
+		Match: &PolicyMatcher{Any: []PolicyMatcher{
+			{Criteria: PolicyCriteria{ServiceName: "a"}},
+			{Criteria: PolicyCriteria{ServiceName: "b"}},
+		}},
+		SampleRate: 1.0,
+	}, {
+		SampleRate: 0,
+	}}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1000,
+		ingestRateDecayFactor:   1.0,
+	})
+
+	for _, serviceName := range []string{"a", "b", "c"} {
+		admitted, err := groups.sampleTrace(&model.APMEvent{
+			Service:     model.Service{Name: serviceName},
+			Trace:       model.Trace{ID: serviceName},
+			Transaction: &model.Transaction{ID: serviceName},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, serviceName != "c", admitted, serviceName)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// maxMissingTraceIDServices is the maximum number of services for which
+// events without a trace ID are counted individually, bounding the number
+// of metrics reported.
+const maxMissingTraceIDServices = 100
+
+// missingTraceIDs counts the transaction and span events received without
+// a trace ID, which cannot be tail-sampled, for identifying misbehaving
+// agents.
+type missingTraceIDs struct {
+	// events counts all such events. It is accessed atomically.
+	events int64
+
+	// services counts the events by service name, for up to
+	// maxMissingTraceIDServices services with non-empty names.
+	mu       sync.Mutex
+	services map[string]int64
+}
+
+func newMissingTraceIDs() *missingTraceIDs {
+	return &missingTraceIDs{services: make(map[string]int64)}
+}
+
+// observe reports whether event has no trace ID, counting it if so.
+func (m *missingTraceIDs) observe(event *model.APMEvent) bool {
+	if event.Trace.ID != "" {
+		return false
+	}
+	atomic.AddInt64(&m.events, 1)
+	if serviceName := event.Service.Name; serviceName != "" {
+		m.mu.Lock()
+		if _, ok := m.services[serviceName]; ok || len(m.services) < maxMissingTraceIDServices {
+			m.services[serviceName]++
+		}
+		m.mu.Unlock()
+	}
+	return true
+}
+
+func (m *missingTraceIDs) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "events", atomic.LoadInt64(&m.events))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.services) == 0 {
+		return
+	}
+	monitoring.ReportNamespace(V, "services", func() {
+		for serviceName, n := range m.services {
+			monitoring.ReportInt(V, serviceName, n)
+		}
+	})
+}
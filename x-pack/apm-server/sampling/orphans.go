@@ -0,0 +1,164 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// orphanTraces tracks traces with events in local storage awaiting a
+// sampling decision, for identifying orphaned traces: those for which
+// no root transaction is observed within a timeout.
+//
+// orphanTraces is safe for concurrent use.
+type orphanTraces struct {
+	// dropped holds the number of orphaned traces dropped,
+	// deleteFailures the number of orphaned traces whose events
+	// could not all be deleted, and lateRemoteDecisions the number
+	// of remote sampling decisions received for orphaned traces
+	// after they were dropped. They are accessed atomically, and
+	// must be the first fields for 64-bit alignment.
+	dropped             int64
+	deleteFailures      int64
+	lateRemoteDecisions int64
+
+	timeout time.Duration
+
+	mu     sync.Mutex
+	traces map[string]orphanTrace
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+type orphanTrace struct {
+	firstSeen time.Time
+	rooted    bool
+}
+
+func newOrphanTraces(timeout time.Duration) *orphanTraces {
+	return &orphanTraces{
+		timeout: timeout,
+		traces:  make(map[string]orphanTrace),
+		now:     time.Now,
+	}
+}
+
+// observe records that an event for traceID has been written to local
+// storage. If root is true, the event is the trace's root transaction.
+func (o *orphanTraces) observe(traceID string, root bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	trace, ok := o.traces[traceID]
+	if !ok {
+		trace.firstSeen = o.now()
+	}
+	trace.rooted = trace.rooted || root
+	o.traces[traceID] = trace
+}
+
+// expire stops tracking traces first observed more than the timeout ago,
+// returning the IDs of those for which no root transaction was observed.
+func (o *orphanTraces) expire() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var traceIDs []string
+	cutoff := o.now().Add(-o.timeout)
+	for traceID, trace := range o.traces {
+		if trace.firstSeen.After(cutoff) {
+			continue
+		}
+		if !trace.rooted {
+			traceIDs = append(traceIDs, traceID)
+		}
+		delete(o.traces, traceID)
+	}
+	return traceIDs
+}
+
+func (o *orphanTraces) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "dropped", atomic.LoadInt64(&o.dropped))
+	monitoring.ReportInt(V, "delete_failures", atomic.LoadInt64(&o.deleteFailures))
+	monitoring.ReportInt(V, "late_remote_decisions", atomic.LoadInt64(&o.lateRemoteDecisions))
+}
+
+// observeTrace records that an event for traceID has been written to local
+// storage, for measuring the time taken to finalize the trace, and for
+// identifying orphaned traces if they are being dropped.
+func (p *Processor) observeTrace(traceID string, root bool) {
+	p.traceFirstSeen.observe(traceID)
+	if p.orphanTraces != nil {
+		p.orphanTraces.observe(traceID, root)
+	}
+}
+
+// dropOrphanTraces drops orphaned traces for which no sampling decision has
+// been made: a negative sampling decision is recorded, so further events for
+// the traces are dropped, and their events are deleted from local storage.
+//
+// Traces for which a sampling decision has been made, e.g. remotely by the
+// server which received the root transaction, are left alone. A remote
+// decision received after an orphaned trace is dropped cannot be honoured,
+// as the trace's events have been deleted; such decisions are counted by
+// observeRemoteDecision, and indicate that OrphanTraceTimeout is too short.
+//
+// Deleting the events is best-effort: if an event cannot be deleted, the
+// failure is logged and counted, and the remaining events of the trace are
+// left to expire after TTL.
+func (p *Processor) dropOrphanTraces() {
+	for _, traceID := range p.orphanTraces.expire() {
+		if _, err := p.eventStore.IsTraceSampled(traceID); err != eventstorage.ErrNotFound {
+			if err != nil {
+				p.rateLimitedLogger.Warnf("received error reading orphaned trace sampling decision: %s", err)
+			}
+			continue
+		}
+		if err := p.eventStore.WriteTraceSampled(traceID, false); err != nil {
+			p.rateLimitedLogger.Warnf("received error writing orphaned trace sampling decision: %s", err)
+			continue
+		}
+		p.traceFirstSeen.forget(traceID)
+		p.flushTraceWrites([]string{traceID})
+		var events model.Batch
+		if err := p.eventStore.ReadTraceEvents(traceID, &events); err != nil {
+			p.rateLimitedLogger.Warnf("received error reading orphaned trace events: %s", err)
+			continue
+		}
+		for _, event := range events {
+			var err error
+			switch event.Processor {
+			case model.TransactionProcessor:
+				err = p.eventStore.DeleteTraceEvent(traceID, event.Transaction.ID)
+			case model.SpanProcessor:
+				err = p.eventStore.DeleteTraceEvent(traceID, event.Span.ID)
+			}
+			if err != nil {
+				p.rateLimitedLogger.Warnf("received error deleting orphaned trace event: %s", err)
+				atomic.AddInt64(&p.orphanTraces.deleteFailures, 1)
+				break
+			}
+		}
+		atomic.AddInt64(&p.orphanTraces.dropped, 1)
+	}
+}
+
+// observeRemoteDecision counts the remote sampling decision for traceID if
+// the trace was dropped locally as orphaned, when orphaned traces are being
+// dropped. This must be called before the remote decision is written.
+func (p *Processor) observeRemoteDecision(traceID string) {
+	if p.orphanTraces == nil {
+		return
+	}
+	if sampled, err := p.eventStore.IsTraceSampled(traceID); err == nil && !sampled {
+		atomic.AddInt64(&p.orphanTraces.lateRemoteDecisions, 1)
+	}
+}
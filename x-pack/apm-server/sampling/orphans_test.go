@@ -0,0 +1,34 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanTraces(t *testing.T) {
+	now := time.Now()
+	o := newOrphanTraces(time.Minute)
+	o.now = func() time.Time { return now }
+
+	o.observe("orphan", false)
+	o.observe("rooted", false)
+	o.observe("rooted", true)
+	now = now.Add(30 * time.Second)
+	o.observe("orphan", false) // first seen time is unchanged
+	o.observe("recent", false)
+	assert.Empty(t, o.expire())
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, []string{"orphan"}, o.expire())
+	assert.Empty(t, o.expire()) // expired traces are no longer tracked
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, []string{"recent"}, o.expire())
+	assert.Empty(t, o.traces)
+}
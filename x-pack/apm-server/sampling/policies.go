@@ -0,0 +1,142 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// UpdatePolicies replaces the processor's tail-sampling policies, which must
+// be valid as for Config.Policies, without restarting the processor. It may
+// be called concurrently with event processing.
+//
+// The policies are replaced atomically: each root transaction is matched
+// against either the old or the new policies, never a mix of both. Root
+// transactions admitted to the old policies' sampling reservoirs are not
+// dropped, but are finalized along with the new policies' reservoirs at the
+// next FlushInterval. Policies with the same Name as an old policy keep its
+// monitoring metrics; other state, such as the observed ingest rate used for
+// sizing the reservoirs, starts afresh.
+//
+// UpdatePolicies is not called by config or Fleet reloads, which replace the
+// server and its processors, including the tail-sampling processor, so the
+// new config's policies take effect with fresh sampling reservoirs. Events
+// and sampling decisions buffered in storage are kept across reloads.
+func (p *Processor) UpdatePolicies(policies []Policy) error {
+	if len(policies) == 0 {
+		return errors.New("invalid tail-sampling policies: Policies unspecified")
+	}
+	if err := validatePolicies(policies, "Policies", "Policy"); err != nil {
+		return errors.Wrap(err, "invalid tail-sampling policies")
+	}
+	groups := p.newTraceGroups(policies, newTraceNameNormalizers(p.config.TraceNameNormalizers))
+
+	p.groupsMu.Lock()
+	defer p.groupsMu.Unlock()
+	groups.inherit(p.groups)
+	p.retiredGroups = append(p.retiredGroups, p.groups)
+	p.groups = groups
+	return nil
+}
+
+// newTraceGroups returns trace groups for policies, configured according to
+// p.config.
+func (p *Processor) newTraceGroups(policies []Policy, traceNameNormalizers traceNameNormalizers) *traceGroups {
+	groups := newTraceGroups(policies, p.traceGroupsConfig(traceNameNormalizers))
+	groups.probabilities = p.sampleProbabilities
+	groups.sampledBy = p.sampledBy
+	return groups
+}
+
+// traceGroupsConfig returns the configuration for trace groups, according
+// to p.config.
+func (p *Processor) traceGroupsConfig(traceNameNormalizers traceNameNormalizers) traceGroupsConfig {
+	return traceGroupsConfig{
+		ingestRateDecayFactor:   p.config.IngestRateDecayFactor,
+		ingestRateDecayFactors:  p.config.IngestRateDecayFactors,
+		maxDynamicServiceGroups: p.config.MaxDynamicServices,
+		countDroppedTraces:      p.config.DroppedTraceMetrics,
+		countDecisions:          p.config.DecisionMetricsDataset != "",
+		// The trace IDs of dropped root transactions are also
+		// needed for passing the traces to DecisionFunc, and for
+		// deleting their events when finalizing early.
+		keepDroppedRoots:     p.config.KeepRootOnDrop || p.config.DecisionFunc != nil || p.config.FinalizeOnStorageLimit,
+		traceNameNormalizers: traceNameNormalizers,
+		defaultTraceOutcome:  p.config.DefaultTraceOutcome,
+		reservoirStrategy:    p.config.ReservoirStrategy,
+		auditLog:             p.auditLog,
+	}
+}
+
+// currentGroups returns the trace groups for the current policies.
+func (p *Processor) currentGroups() *traceGroups {
+	p.groupsMu.RLock()
+	defer p.groupsMu.RUnlock()
+	return p.groups
+}
+
+// finalizeSampledTraces finalizes the reservoirs of the trace groups retired
+// by UpdatePolicies since the last call, merging their counts into the current
+// groups, and then those of the current groups. The sampled trace IDs are
+// appended to traceIDs, and the extended slice returned.
+func (p *Processor) finalizeSampledTraces(traceIDs []string) []string {
+	p.groupsMu.Lock()
+	groups, retired := p.groups, p.retiredGroups
+	p.retiredGroups = nil
+	p.groupsMu.Unlock()
+
+	for _, old := range retired {
+		traceIDs = old.finalizeSampledTraces(traceIDs)
+		groups.merge(old)
+	}
+	return groups.finalizeSampledTraces(traceIDs)
+}
+
+// inherit carries over state from old, the trace groups being replaced by g,
+// which should be continuous across policy updates: the metrics of policies
+// with the same name, the dynamic service group counters, and the traces for
+// which errors have been observed. inherit must be called before g is used.
+func (g *traceGroups) inherit(old *traceGroups) {
+	for i := range g.policyGroups {
+		pg := &g.policyGroups[i]
+		for j := range old.policyGroups {
+			if old.policyGroups[j].policy.Name != "" && old.policyGroups[j].policy.Name == pg.policy.Name {
+				pg.metrics = old.policyGroups[j].metrics
+				if pg.g != nil {
+					pg.g.metrics = pg.metrics
+				}
+				break
+			}
+		}
+	}
+	g.dynamicServiceGroupsEvicted = atomic.LoadInt64(&old.dynamicServiceGroupsEvicted)
+	g.dynamicServiceGroupsRejected = atomic.LoadInt64(&old.dynamicServiceGroupsRejected)
+	if g.errorTraces != nil && old.errorTraces != nil {
+		g.errorTraces = old.errorTraces
+	}
+	if g.spanCounts != nil && old.spanCounts != nil {
+		g.spanCounts = old.spanCounts
+	}
+}
+
+// merge adds the dropped trace counts, decision counts, and dropped root
+// transactions recorded by old, whose reservoirs have been finalized, to g.
+func (g *traceGroups) merge(old *traceGroups) {
+	dropped := old.takeDroppedTraces()
+	decisions := old.takeDecisions()
+	droppedRoots := old.takeDroppedRoots()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, n := range dropped {
+		g.dropped[key] += n
+	}
+	for key, counts := range decisions {
+		g.addDecisionCounts(key, counts)
+	}
+	g.droppedRoots = append(g.droppedRoots, droppedRoots...)
+}
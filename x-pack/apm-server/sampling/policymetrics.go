@@ -0,0 +1,59 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync/atomic"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// policyMetrics holds counts of root transactions matched by a policy,
+// and of the traces it kept and dropped.
+//
+// Traces admitted to a sampling reservoir are counted as kept or dropped
+// once the reservoir is finalized, so kept+dropped lags matched by up to
+// one sampling interval.
+//
+// All fields are updated atomically.
+type policyMetrics struct {
+	matched int64
+	kept    int64
+	dropped int64
+}
+
+func (m *policyMetrics) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "matched", atomic.LoadInt64(&m.matched))
+	monitoring.ReportInt(V, "kept", atomic.LoadInt64(&m.kept))
+	monitoring.ReportInt(V, "dropped", atomic.LoadInt64(&m.dropped))
+}
+
+// reportPolicyMetrics reports the metrics for each policy, in a namespace
+// named after the policy's Name, or its index if it has no name.
+func (g *traceGroups) reportPolicyMetrics(V monitoring.Visitor) {
+	for i := range g.policyGroups {
+		pg := &g.policyGroups[i]
+		monitoring.ReportNamespace(V, pg.name, func() {
+			pg.metrics.report(V)
+		})
+	}
+}
+
+// reportIngestRateDecayFactors reports the default ingest rate decay factor,
+// and the effective factor for each service environment of the policies.
+func (g *traceGroups) reportIngestRateDecayFactors(V monitoring.Visitor) {
+	monitoring.ReportFloat(V, "default", g.ingestRateDecayFactor)
+	monitoring.ReportNamespace(V, "environments", func() {
+		reported := make(map[string]bool)
+		for _, pg := range g.policyGroups {
+			environment := pg.policy.ServiceEnvironment
+			if environment == "" || reported[environment] {
+				continue
+			}
+			reported[environment] = true
+			monitoring.ReportFloat(V, environment, g.environmentIngestRateDecayFactor(environment))
+		}
+	})
+}
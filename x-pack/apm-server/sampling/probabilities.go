@@ -0,0 +1,100 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// samplingProbabilityLabel is the numeric label set on the events of traces
+// sampled locally, holding the probability with which they were sampled,
+// similar to OpenTelemetry's sampling probability.
+const samplingProbabilityLabel = "sampling_probability"
+
+// sampleProbabilities records the probability with which each trace was
+// sampled by the local policies, from when the decision is made until the
+// trace's events are reported.
+//
+// A nil *sampleProbabilities records nothing, for when EmitSamplingProbability
+// is disabled.
+type sampleProbabilities struct {
+	mu sync.Mutex
+	m  map[string]float64
+}
+
+func newSampleProbabilities(enabled bool) *sampleProbabilities {
+	if !enabled {
+		return nil
+	}
+	return &sampleProbabilities{m: make(map[string]float64)}
+}
+
+// record records that the trace with the given ID was sampled with the given
+// probability.
+func (s *sampleProbabilities) record(traceID string, probability float64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[traceID] = probability
+}
+
+// take returns the probability recorded for traceID, if any, and forgets it.
+func (s *sampleProbabilities) take(traceID string) (float64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	probability, ok := s.m[traceID]
+	delete(s.m, traceID)
+	return probability, ok
+}
+
+// annotate sets the sampling probability label on each of events whose trace
+// has a recorded probability, and then forgets the probabilities recorded for
+// traceIDs, which must include the trace IDs of events.
+func (s *sampleProbabilities) annotate(traceIDs []string, events []model.APMEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range events {
+		if probability, ok := s.m[events[i].Trace.ID]; ok {
+			setSamplingProbability(&events[i], probability)
+		}
+	}
+	for _, traceID := range traceIDs {
+		delete(s.m, traceID)
+	}
+}
+
+// forget forgets the probabilities recorded for traceIDs, e.g. for traces
+// which are no longer sampled.
+func (s *sampleProbabilities) forget(traceIDs []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, traceID := range traceIDs {
+		delete(s.m, traceID)
+	}
+}
+
+// setSamplingProbability sets the sampling probability label on event. The
+// labels are copied first, as they may be shared with other events.
+func setSamplingProbability(event *model.APMEvent, probability float64) {
+	labels := make(model.NumericLabels, len(event.NumericLabels)+1)
+	for k, v := range event.NumericLabels {
+		labels[k] = v
+	}
+	labels[samplingProbabilityLabel] = model.NumericLabelValue{Value: probability}
+	event.NumericLabels = labels
+}
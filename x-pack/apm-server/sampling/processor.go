@@ -19,8 +19,10 @@ import (
 
 	"github.com/elastic/apm-server/internal/logs"
 	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
 	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
 	"github.com/elastic/apm-server/x-pack/apm-server/sampling/pubsub"
+	"github.com/elastic/elastic-agent-libs/file"
 	"github.com/elastic/elastic-agent-libs/logp"
 	"github.com/elastic/elastic-agent-libs/monitoring"
 )
@@ -37,17 +39,137 @@ const (
 	// shutdownGracePeriod is the time that the processor has to gracefully
 	// terminate after the stop method is called.
 	shutdownGracePeriod = 5 * time.Second
+
+	// readTraceEventsBatchSize is the maximum number of locally sampled
+	// traces for which events are read from storage together.
+	readTraceEventsBatchSize = 100
 )
 
+// errStorageLimitReached is returned by processTransaction and processSpan
+// for events of traces without a sampling decision, which are not stored
+// because storage is at its limit.
+var errStorageLimitReached = errors.Wrap(eventstorage.ErrLimitReached, "not storing trace event")
+
 // Processor is a tail-sampling event processor.
 type Processor struct {
 	config            Config
 	logger            *logp.Logger
 	rateLimitedLogger *logp.Logger
-	groups            *traceGroups
+
+	// groups holds the trace groups for the current policies, and
+	// retiredGroups those for policies replaced by UpdatePolicies
+	// since the reservoirs were last finalized. Both are protected
+	// by groupsMu; see UpdatePolicies.
+	groupsMu      sync.RWMutex
+	groups        *traceGroups
+	retiredGroups []*traceGroups
+
+	// shadowGroups holds the trace groups for the shadow policies,
+	// if any are configured; otherwise it is nil.
+	shadowGroups  *traceGroups
+	shadowMetrics *shadowMetrics // heap-allocated for 64-bit alignment
 
 	eventStore   *wrappedRW
 	eventMetrics *eventMetrics // heap-allocated for 64-bit alignment
+	gcMetrics    *gcMetrics    // heap-allocated for 64-bit alignment
+
+	// asyncWriter writes trace events and sampling decisions to storage
+	// asynchronously, if StorageWriteWorkers is configured; otherwise it
+	// is nil, and writes are performed synchronously.
+	asyncWriter *asyncWriter
+
+	// labelLimiter limits the labels stored with each trace event, if
+	// StoredLabelsLimit or StoredLabelsBytesLimit is configured;
+	// otherwise it is nil.
+	labelLimiter *labelLimiter
+
+	// oldestUnfinalized holds the time, in Unix nanoseconds, at which the
+	// oldest root transaction admitted to a sampling reservoir since the
+	// reservoirs were last finalized was processed, or zero if there is no
+	// such transaction. It is accessed atomically.
+	oldestUnfinalized *int64 // heap-allocated for 64-bit alignment
+
+	traceIDAllowList traceIDList
+	traceIDDenyList  traceIDList
+
+	// bypassServices holds the names of services whose events bypass
+	// tail-sampling.
+	bypassServices map[string]struct{}
+
+	// orphanTraces tracks traces awaiting a sampling decision, if
+	// OrphanTraceTimeout is configured; otherwise it is nil.
+	orphanTraces *orphanTraces
+
+	// earlyFinalizer requests early finalization of the sampling
+	// reservoirs when storage is at its limit, if FinalizeOnStorageLimit
+	// is enabled; otherwise it is nil.
+	earlyFinalizer *earlyFinalizer
+
+	// storageWatchdog recreates storage once CorruptionThreshold storage
+	// corruption errors have been recorded, if CorruptionThreshold is
+	// greater than zero; otherwise it is nil.
+	storageWatchdog *storageWatchdog
+
+	// missingTraceIDs counts the events received without a trace ID.
+	missingTraceIDs *missingTraceIDs
+
+	// traceRoots tracks the root transactions of traces, for detecting
+	// trace ID collisions.
+	traceRoots *traceRoots
+
+	// traceFirstSeen tracks when traces awaiting a sampling decision
+	// were first stored, and finalizeLatency records the time taken
+	// from then until the traces are sampled and their events reported.
+	traceFirstSeen  *traceFirstSeen
+	finalizeLatency *durationHistogram
+
+	// finalizeWorkers tracks the workers reporting locally sampled traces.
+	finalizeWorkers *finalizeWorkers
+
+	// storageDelay records the time taken from receiving trace events
+	// until they are written to storage, including any time spent
+	// queued for asynchronous writing.
+	storageDelay *durationHistogram
+
+	// storageKeys counts the keys in storage for StorageDiagnostics.
+	storageKeys *storageKeyCounter
+
+	// maxTTL holds the greatest of TTL and OutcomeTTLs.
+	maxTTL time.Duration
+
+	// auditLog records local sampling decisions to auditLogFile, if
+	// AuditLogPath is configured; otherwise both are nil.
+	auditLog     *auditLog
+	auditLogFile *file.Rotator
+
+	// sampleProbabilities records the probability with which traces were
+	// sampled locally, for annotating their events, if
+	// EmitSamplingProbability is enabled; otherwise it is nil.
+	sampleProbabilities *sampleProbabilities
+
+	// sampledBy records the policy by which traces were sampled locally,
+	// for labelling their events, if SampledByLabel is non-empty;
+	// otherwise it is nil.
+	sampledBy *sampledByPolicies
+
+	// completedTraces holds the IDs of traces signalled as complete and
+	// sampled since the reservoirs were last finalized. Their events are
+	// reported immediately, but the sampling decisions are only published
+	// to other APM Servers along with those of the reservoirs.
+	completedTracesMu sync.Mutex
+	completedTraces   []string
+
+	// circuitBreaker guards requests for publishing sampled trace IDs,
+	// if CircuitBreakerFailureThreshold is configured; otherwise it is nil.
+	circuitBreaker *pubsub.CircuitBreaker
+
+	// publishMetrics records statistics about sampled trace IDs
+	// published to Elasticsearch.
+	publishMetrics *pubsub.PublishMetrics
+
+	// initialized is closed by Run once the processor has loaded its
+	// state, and is ready to make and receive sampling decisions.
+	initialized chan struct{}
 
 	stopMu   sync.Mutex
 	stopping chan struct{}
@@ -63,6 +185,37 @@ type eventMetrics struct {
 	sampled       int64
 	headUnsampled int64
 	failedWrites  int64
+	allowListed   int64
+	denyListed    int64
+	bypassed      int64
+
+	// finalized counts the events read back from storage and reported
+	// when their traces were sampled, as opposed to those reported when
+	// received after the sampling decision.
+	finalized int64
+
+	// storageLimitEvents and storageLimitTraces count the events, and
+	// the traces by their root transactions, given a default decision
+	// rather than being stored because storage was at its limit.
+	storageLimitEvents int64
+	storageLimitTraces int64
+
+	// completedTraces counts the traces signalled as complete by their
+	// root transactions, and completedTracesSampled the number of those
+	// which were sampled.
+	completedTraces        int64
+	completedTracesSampled int64
+
+	// rootsKeptOnDrop counts the root transactions reported without the
+	// rest of their traces, because their traces were dropped and
+	// KeepRootOnDrop is enabled.
+	rootsKeptOnDrop int64
+
+	// decisionFuncKept and decisionFuncDropped count the traces whose
+	// decisions were overridden by DecisionFunc: those dropped by the
+	// policies but kept, and those sampled by the policies but dropped.
+	decisionFuncKept    int64
+	decisionFuncDropped int64
 }
 
 // NewProcessor returns a new Processor, for tail-sampling trace events.
@@ -72,20 +225,95 @@ func NewProcessor(config Config) (*Processor, error) {
 	}
 
 	logger := logp.NewLogger(logs.Sampling)
+	traceNameNormalizers := newTraceNameNormalizers(config.TraceNameNormalizers)
+	maxTTL := maxTTL(config.TTL, config.OutcomeTTLs)
+	var auditLog *auditLog
+	var auditLogFile *file.Rotator
+	if config.AuditLogPath != "" {
+		options := []file.RotatorOption{
+			file.MaxBackups(config.AuditLogMaxBackups),
+			file.Permissions(0600),
+		}
+		if config.AuditLogMaxSize > 0 {
+			options = append(options, file.MaxSizeBytes(config.AuditLogMaxSize))
+		}
+		var err error
+		auditLogFile, err = file.NewFileRotator(config.AuditLogPath, options...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create tail-sampling audit log")
+		}
+		auditLog = newAuditLog(auditLogFile)
+	}
 	p := &Processor{
 		config:            config,
 		logger:            logger,
 		rateLimitedLogger: logger.WithOptions(logs.WithRateLimit(loggerRateLimit)),
-		groups:            newTraceGroups(config.Policies, config.MaxDynamicServices, config.IngestRateDecayFactor),
-		eventStore:        newWrappedRW(config.Storage, config.TTL, int64(config.StorageLimit)),
+		eventStore:        newWrappedRW(config.DB, config.Storage, config.TTL, config.OutcomeTTLs, int64(config.StorageLimit)),
 		eventMetrics:      &eventMetrics{},
+		gcMetrics:         &gcMetrics{},
+		oldestUnfinalized: new(int64),
+		shadowMetrics:     &shadowMetrics{},
+		publishMetrics:    pubsub.NewPublishMetrics(),
+		traceIDAllowList:  newTraceIDList(config.TraceIDAllowList),
+		traceIDDenyList:   newTraceIDList(config.TraceIDDenyList),
+		traceFirstSeen:    newTraceFirstSeen(),
+		traceRoots:        newTraceRoots(),
+		missingTraceIDs:   newMissingTraceIDs(),
+		finalizeLatency:   newDurationHistogram(maxTTL, finalizeLatencyWindow),
+		storageKeys:       newStorageKeyCounter(storageKeysMaxAge),
+		maxTTL:            maxTTL,
+		auditLog:          auditLog,
+		auditLogFile:      auditLogFile,
+		labelLimiter:      newLabelLimiter(config.StoredLabelsLimit, config.StoredLabelsBytesLimit, config.PreservedLabels),
+		initialized:       make(chan struct{}),
 		stopping:          make(chan struct{}),
 		stopped:           make(chan struct{}),
-		// NOTE(marclop) This behavior should be configurable so users who
-		// rely on tail sampling for cost cutting, can discard events once
-		// the disk is full.
-		// Index all traces when the storage limit is reached.
-		indexOnWriteFailure: true,
+		// Index events which cannot be stored by default, unless
+		// configured to drop them, e.g. by users relying on
+		// tail-sampling for reducing costs.
+		indexOnWriteFailure: !config.DropOnStorageLimit,
+	}
+	p.sampleProbabilities = newSampleProbabilities(config.EmitSamplingProbability)
+	p.sampledBy = newSampledByPolicies(config.SampledByLabel)
+	p.earlyFinalizer = newEarlyFinalizer(config.FinalizeOnStorageLimit, config.FlushInterval/4)
+	p.storageWatchdog = newStorageWatchdog(config.CorruptionThreshold, config.RecreateStorage)
+	p.storageDelay = newDurationHistogram(maxStorageDelay, writeLatencyWindow)
+	p.finalizeWorkers = newFinalizeWorkers(config.FinalizeConcurrency)
+	p.groups = p.newTraceGroups(config.Policies, traceNameNormalizers)
+	if len(config.ShadowPolicies) > 0 {
+		p.shadowGroups = newTraceGroups(config.ShadowPolicies, traceGroupsConfig{
+			ingestRateDecayFactor:   config.IngestRateDecayFactor,
+			ingestRateDecayFactors:  config.IngestRateDecayFactors,
+			maxDynamicServiceGroups: config.MaxDynamicServices,
+			traceNameNormalizers:    traceNameNormalizers,
+			defaultTraceOutcome:     config.DefaultTraceOutcome,
+			reservoirStrategy:       config.ReservoirStrategy,
+		})
+	}
+	if len(config.BypassServices) > 0 {
+		p.bypassServices = make(map[string]struct{}, len(config.BypassServices))
+		for _, service := range config.BypassServices {
+			p.bypassServices[service] = struct{}{}
+		}
+	}
+	if config.OrphanTraceTimeout > 0 {
+		p.orphanTraces = newOrphanTraces(config.OrphanTraceTimeout)
+	}
+	if config.StorageWriteWorkers > 0 {
+		p.asyncWriter = newAsyncWriter(
+			p.eventStore, config.StorageWriteWorkers, config.StorageWriteQueueSize,
+			p.storageDelay, p.earlyFinalizer, p.rateLimitedLogger,
+		)
+	}
+	if config.CircuitBreakerFailureThreshold > 0 {
+		circuitBreaker, err := pubsub.NewCircuitBreaker(
+			config.CircuitBreakerFailureThreshold,
+			config.CircuitBreakerCooldown,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid tail-sampling config")
+		}
+		p.circuitBreaker = circuitBreaker
 	}
 	return p, nil
 }
@@ -106,15 +334,68 @@ func (p *Processor) CollectMonitoring(_ monitoring.Mode, V monitoring.Visitor) {
 	//     final metric would ideally be a distribution, which is not
 	//     currently an option in libbeat/monitoring.
 
-	p.groups.mu.RLock()
-	numDynamicGroups := p.groups.numDynamicServiceGroups
-	p.groups.mu.RUnlock()
+	groups := p.currentGroups()
+	groups.mu.RLock()
+	numDynamicGroups := groups.numDynamicServiceGroups
+	groups.mu.RUnlock()
 	monitoring.ReportInt(V, "dynamic_service_groups", int64(numDynamicGroups))
+	// dynamic_service_groups_evicted and dynamic_service_groups_rejected
+	// count the groups evicted, and the root transactions dropped, after
+	// reaching MaxDynamicServices. Steadily increasing values indicate
+	// that MaxDynamicServices is too small for the number of services.
+	monitoring.ReportInt(V, "dynamic_service_groups_evicted", atomic.LoadInt64(&groups.dynamicServiceGroupsEvicted))
+	monitoring.ReportInt(V, "dynamic_service_groups_rejected", atomic.LoadInt64(&groups.dynamicServiceGroupsRejected))
 
 	monitoring.ReportNamespace(V, "storage", func() {
-		lsmSize, valueLogSize := p.config.DB.Size()
+		lsmSize, valueLogSize := p.eventStore.Size()
 		monitoring.ReportInt(V, "lsm_size", int64(lsmSize))
 		monitoring.ReportInt(V, "value_log_size", int64(valueLogSize))
+		// monitoring.ReportBool reports the key rather than the value.
+		V.OnKey("at_limit")
+		V.OnBool(p.storageLimitReached())
+		monitoring.ReportNamespace(V, "limit_reached", func() {
+			monitoring.ReportInt(V, "events", atomic.LoadInt64(&p.eventMetrics.storageLimitEvents))
+			monitoring.ReportInt(V, "traces", atomic.LoadInt64(&p.eventMetrics.storageLimitTraces))
+			if p.earlyFinalizer != nil {
+				// finalized_early counts the early finalizations of
+				// the sampling reservoirs, and the traces decided by
+				// them, due to storage being at its limit.
+				monitoring.ReportNamespace(V, "finalized_early", func() {
+					p.earlyFinalizer.report(V)
+				})
+			}
+		})
+		monitoring.ReportNamespace(V, "errors", func() {
+			// errors counts the errors returned by storage reads and
+			// writes, by type. Persistently increasing counts indicate
+			// that tail-sampling is failing, and events are being
+			// indexed or dropped by default.
+			p.eventStore.errors.report(V)
+		})
+		if p.storageWatchdog != nil {
+			// recreated counts the times storage has been
+			// recreated due to persistent corruption, and
+			// recreate_failures the failed attempts, after
+			// which storage is unavailable until a retry
+			// succeeds.
+			p.storageWatchdog.report(V)
+		}
+		monitoring.ReportNamespace(V, "write_latency", func() {
+			p.eventStore.writeLatency.report(V)
+		})
+		if p.asyncWriter != nil {
+			monitoring.ReportNamespace(V, "write_queue", func() {
+				p.asyncWriter.report(V)
+			})
+		}
+		if p.labelLimiter != nil {
+			monitoring.ReportNamespace(V, "labels", func() {
+				p.labelLimiter.report(V)
+			})
+		}
+		monitoring.ReportNamespace(V, "gc", func() {
+			p.gcMetrics.report(V)
+		})
 	})
 	monitoring.ReportNamespace(V, "events", func() {
 		monitoring.ReportInt(V, "processed", atomic.LoadInt64(&p.eventMetrics.processed))
@@ -123,7 +404,122 @@ func (p *Processor) CollectMonitoring(_ monitoring.Mode, V monitoring.Visitor) {
 		monitoring.ReportInt(V, "sampled", atomic.LoadInt64(&p.eventMetrics.sampled))
 		monitoring.ReportInt(V, "head_unsampled", atomic.LoadInt64(&p.eventMetrics.headUnsampled))
 		monitoring.ReportInt(V, "failed_writes", atomic.LoadInt64(&p.eventMetrics.failedWrites))
+		monitoring.ReportInt(V, "bypassed", atomic.LoadInt64(&p.eventMetrics.bypassed))
+		if p.config.KeepRootOnDrop {
+			monitoring.ReportInt(V, "roots_kept_on_drop", atomic.LoadInt64(&p.eventMetrics.rootsKeptOnDrop))
+		}
+
+		// finalized_ratio is the ratio of events reported at finalization
+		// to events stored. A low ratio means that most stored events
+		// belong to traces which are dropped, or which expire before a
+		// sampling decision is made, e.g. due to late arrivals; a ratio
+		// approaching 1 means that most stored events are reported.
+		stored := atomic.LoadInt64(&p.eventMetrics.stored)
+		finalized := atomic.LoadInt64(&p.eventMetrics.finalized)
+		var finalizedRatio float64
+		if stored > 0 {
+			finalizedRatio = float64(finalized) / float64(stored)
+		}
+		monitoring.ReportInt(V, "finalized", finalized)
+		monitoring.ReportFloat(V, "finalized_ratio", finalizedRatio)
 	})
+	if p.config.DecisionFunc != nil {
+		monitoring.ReportNamespace(V, "decision_func", func() {
+			monitoring.ReportInt(V, "kept", atomic.LoadInt64(&p.eventMetrics.decisionFuncKept))
+			monitoring.ReportInt(V, "dropped", atomic.LoadInt64(&p.eventMetrics.decisionFuncDropped))
+		})
+	}
+	monitoring.ReportNamespace(V, "finalize_latency", func() {
+		// finalize_latency is the distribution of the time taken from
+		// storing the first event of a trace until the trace is sampled
+		// and its events reported. Comparing this with FlushInterval and
+		// TTL shows whether traces are being finalized too early, before
+		// their events have arrived, or too late.
+		p.finalizeLatency.report(V)
+	})
+	monitoring.ReportNamespace(V, "finalize", func() {
+		// finalize reports the number of workers reporting locally
+		// sampled traces, the batches of traces being reported, and
+		// the traces queued for the workers. A persistent backlog
+		// indicates that FinalizeConcurrency may be increased.
+		p.finalizeWorkers.report(V)
+	})
+	monitoring.ReportNamespace(V, "storage_delay", func() {
+		// storage_delay is the distribution of the time taken from
+		// receiving trace events until they are written to storage.
+		// Unlike finalize_latency, this excludes the sampling logic;
+		// a growing delay indicates that storage cannot keep up with
+		// intake.
+		p.storageDelay.report(V)
+	})
+	monitoring.ReportNamespace(V, "policies", func() {
+		groups.reportPolicyMetrics(V)
+	})
+	monitoring.ReportNamespace(V, "ingest_rate_decay", func() {
+		// ingest_rate_decay reports the effective ingest rate decay
+		// factor for each service environment of the policies.
+		groups.reportIngestRateDecayFactors(V)
+	})
+	monitoring.ReportNamespace(V, "missing_trace_id", func() {
+		// missing_trace_id counts the transactions and spans received
+		// without a trace ID, in total and by service name, which are
+		// reported without being tail-sampled.
+		p.missingTraceIDs.report(V)
+	})
+	monitoring.ReportNamespace(V, "trace_id_collisions", func() {
+		// trace_id_collisions counts the root transactions received
+		// for trace IDs which already had a different root transaction,
+		// and those dropped with the "drop" TraceIDCollisionPolicy.
+		p.traceRoots.report(V)
+	})
+	monitoring.ReportNamespace(V, "trace_id_lists", func() {
+		monitoring.ReportInt(V, "allowed", atomic.LoadInt64(&p.eventMetrics.allowListed))
+		monitoring.ReportInt(V, "denied", atomic.LoadInt64(&p.eventMetrics.denyListed))
+	})
+	if p.shadowGroups != nil {
+		monitoring.ReportNamespace(V, "shadow", func() {
+			p.shadowMetrics.report(V)
+			monitoring.ReportNamespace(V, "policies", func() {
+				p.shadowGroups.reportPolicyMetrics(V)
+			})
+		})
+	}
+	if p.orphanTraces != nil {
+		monitoring.ReportNamespace(V, "orphan_traces", func() {
+			p.orphanTraces.report(V)
+		})
+	}
+	if p.auditLog != nil {
+		monitoring.ReportNamespace(V, "audit_log", func() {
+			p.auditLog.report(V)
+		})
+	}
+	monitoring.ReportNamespace(V, "publish", func() {
+		stats := p.publishMetrics.Stats()
+		monitoring.ReportInt(V, "indexed", stats.Indexed)
+		monitoring.ReportInt(V, "bytes", stats.BytesTotal)
+		monitoring.ReportFloat(V, "indexed_per_second", stats.IndexedPerSecond)
+		monitoring.ReportFloat(V, "bytes_per_second", stats.BytesPerSecond)
+		monitoring.ReportNamespace(V, "failed", func() {
+			monitoring.ReportInt(V, "4xx", stats.FailedClient)
+			monitoring.ReportInt(V, "5xx", stats.FailedServer)
+			monitoring.ReportInt(V, "other", stats.FailedOther)
+		})
+		monitoring.ReportInt(V, "retries", stats.Retries)
+	})
+	if p.config.TraceCompleted != nil {
+		monitoring.ReportNamespace(V, "completed_traces", func() {
+			monitoring.ReportInt(V, "total", atomic.LoadInt64(&p.eventMetrics.completedTraces))
+			monitoring.ReportInt(V, "sampled", atomic.LoadInt64(&p.eventMetrics.completedTracesSampled))
+		})
+	}
+	if p.circuitBreaker != nil {
+		monitoring.ReportNamespace(V, "circuit_breaker", func() {
+			monitoring.ReportString(V, "state", p.circuitBreaker.State().String())
+			monitoring.ReportInt(V, "opened", p.circuitBreaker.Opened())
+			monitoring.ReportInt(V, "rejected", p.circuitBreaker.Rejected())
+		})
+	}
 }
 
 // ProcessBatch tail-samples transactions and spans.
@@ -134,29 +530,68 @@ func (p *Processor) CollectMonitoring(_ monitoring.Mode, V monitoring.Visitor) {
 // - Non-trace events (errors, metricsets)
 // - Trace events which are already known to have been tail-sampled
 // - Transactions which are head-based unsampled
+// - Trace events from services which bypass tail-sampling
+// - Stored events of traces signalled as complete, and sampled
 //
 // All other trace events will either be dropped (e.g. known to not
 // be tail-sampled), or stored for possible later publication.
 func (p *Processor) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 	events := *batch
+	received := time.Now()
+	var completed model.Batch
 	for i := 0; i < len(events); i++ {
 		event := &events[i]
-		var report, stored, failed bool
+		var report, stored, failed, listed bool
 		var err error
 		switch event.Processor {
 		case model.TransactionProcessor:
 			atomic.AddInt64(&p.eventMetrics.processed, 1)
-			report, stored, err = p.processTransaction(event)
+			if p.missingTraceIDs.observe(event) {
+				// Events without a trace ID cannot be
+				// tail-sampled, so they are reported.
+				report = true
+				break
+			}
+			if report, listed = p.matchTraceIDLists(event.Trace.ID); listed {
+				break
+			}
+			if report = p.bypass(event); !report {
+				report, stored, err = p.processTransaction(event, received, &completed)
+			}
 		case model.SpanProcessor:
 			atomic.AddInt64(&p.eventMetrics.processed, 1)
-			report, stored, err = p.processSpan(event)
+			if p.missingTraceIDs.observe(event) {
+				report = true
+				break
+			}
+			if report, listed = p.matchTraceIDLists(event.Trace.ID); listed {
+				break
+			}
+			if report = p.bypass(event); !report {
+				report, stored, err = p.processSpan(event, received)
+			}
+		case model.ErrorProcessor:
+			// Errors are not tail-sampled, but are tracked for
+			// matching policies with HasError criteria.
+			p.observeError(event)
+			continue
 		default:
 			continue
 		}
 
 		// If processing the transaction or span returns with an error we
 		// either discard or sample the trace by default.
-		if err != nil {
+		if errors.Is(err, eventstorage.ErrLimitReached) {
+			// Storage is at its limit, so the event was not stored,
+			// either without attempting to or because the write was
+			// rejected. This is not a failed write, and is counted
+			// separately. Finalizing early, if enabled, reclaims
+			// space from traces which are not sampled.
+			atomic.AddInt64(&p.eventMetrics.storageLimitEvents, 1)
+			p.earlyFinalizer.request()
+			stored = false
+			report = p.indexOnWriteFailure
+		} else if err != nil {
 			failed = true
 			stored = false
 			if p.indexOnWriteFailure {
@@ -168,6 +603,9 @@ func (p *Processor) ProcessBatch(ctx context.Context, batch *model.Batch) error
 			}
 		}
 
+		if !report && !stored {
+			modelprocessor.RecordDropped(dropReason(err), 1)
+		}
 		if !report {
 			// We shouldn't report this event, so remove it from the slice.
 			n := len(events)
@@ -178,10 +616,80 @@ func (p *Processor) ProcessBatch(ctx context.Context, batch *model.Batch) error
 
 		p.updateProcessorMetrics(report, stored, failed)
 	}
-	*batch = events
+	*batch = append(events, completed...)
 	return nil
 }
 
+// observeError records that an error event has been observed for the trace
+// of event, for matching policies with HasError criteria.
+func (p *Processor) observeError(event *model.APMEvent) {
+	if event.Trace.ID == "" {
+		return
+	}
+	p.currentGroups().observeError(event.Trace.ID)
+	if p.shadowGroups != nil {
+		p.shadowGroups.observeError(event.Trace.ID)
+	}
+}
+
+// observeSpan records that a span has been stored for traceID, for matching
+// policies with MinSpanCount criteria.
+func (p *Processor) observeSpan(traceID string) {
+	p.currentGroups().observeSpan(traceID)
+	if p.shadowGroups != nil {
+		p.shadowGroups.observeSpan(traceID)
+	}
+}
+
+// matchTraceIDLists reports whether traceID is in the trace ID allow or deny
+// lists, and if so, whether events for the trace should be reported.
+func (p *Processor) matchTraceIDLists(traceID string) (report, listed bool) {
+	if p.traceIDAllowList.match(traceID) {
+		atomic.AddInt64(&p.eventMetrics.allowListed, 1)
+		return true, true
+	}
+	if p.traceIDDenyList.match(traceID) {
+		atomic.AddInt64(&p.eventMetrics.denyListed, 1)
+		return false, true
+	}
+	return false, false
+}
+
+// storageLimitReached reports whether the size of storage has reached the
+// limit at which writes are rejected, if any: storageLimitThreshold of
+// StorageLimit.
+func (p *Processor) storageLimitReached() bool {
+	limit := p.eventStore.writerOpts.StorageLimitInBytes
+	if limit == 0 {
+		return false
+	}
+	lsm, vlog := p.eventStore.Size()
+	return lsm+vlog >= limit
+}
+
+// bypass reports whether event is from a service which bypasses
+// tail-sampling, and so should be reported immediately.
+func (p *Processor) bypass(event *model.APMEvent) bool {
+	if _, ok := p.bypassServices[event.Service.Name]; !ok {
+		return false
+	}
+	atomic.AddInt64(&p.eventMetrics.bypassed, 1)
+	return true
+}
+
+// dropReason returns the reason for dropping a trace event which was neither
+// reported nor stored, given the error returned from processing the event.
+func dropReason(err error) modelprocessor.DropReason {
+	switch {
+	case err == nil:
+		return modelprocessor.DropReasonPolicy
+	case errors.Is(err, eventstorage.ErrLimitReached):
+		return modelprocessor.DropReasonStorageFull
+	default:
+		return modelprocessor.DropReasonStorageError
+	}
+}
+
 func (p *Processor) updateProcessorMetrics(report, stored, failedWrite bool) {
 	if failedWrite {
 		atomic.AddInt64(&p.eventMetrics.failedWrites, 1)
@@ -202,7 +710,10 @@ func (p *Processor) updateProcessorMetrics(report, stored, failedWrite bool) {
 	}
 }
 
-func (p *Processor) processTransaction(event *model.APMEvent) (report, stored bool, _ error) {
+// processTransaction tail-samples a transaction. If the transaction is
+// the root of a trace signalled as complete, and the trace is sampled,
+// the trace's stored events are appended to completed.
+func (p *Processor) processTransaction(event *model.APMEvent, received time.Time, completed *model.Batch) (report, stored bool, _ error) {
 	if !event.Transaction.Sampled {
 		// (Head-based) unsampled transactions are passed through
 		// by the tail sampler.
@@ -210,6 +721,13 @@ func (p *Processor) processTransaction(event *model.APMEvent) (report, stored bo
 		return true, false, nil
 	}
 
+	if event.Parent.ID == "" && p.traceRoots.observe(event) {
+		// Another root transaction has been received for the trace ID.
+		if report, handled, err := p.handleTraceIDCollision(event); handled {
+			return report, false, err
+		}
+	}
+
 	traceSampled, err := p.eventStore.IsTraceSampled(event.Trace.ID)
 	switch err {
 	case nil:
@@ -227,20 +745,46 @@ func (p *Processor) processTransaction(event *model.APMEvent) (report, stored bo
 		return false, false, err
 	}
 
+	if p.storageLimitReached() {
+		// Storage is at its limit, so don't store events for traces
+		// without a decision. The trace is not sampled, but instead
+		// the caller makes a default decision for the event.
+		if event.Parent.ID == "" {
+			atomic.AddInt64(&p.eventMetrics.storageLimitTraces, 1)
+		}
+		return false, false, errStorageLimitReached
+	}
+
 	if event.Parent.ID != "" {
 		// Non-root transaction: write to local storage while we wait
 		// for a sampling decision.
-		return false, true, p.eventStore.WriteTraceEvent(
-			event.Trace.ID, event.Transaction.ID, event,
+		p.observeTrace(event.Trace.ID, false)
+		return false, true, p.writeTraceEvent(
+			event.Trace.ID, event.Transaction.ID, event, received,
 		)
 	}
 
-	// Root transaction: apply reservoir sampling.
+	// Root transaction: apply reservoir sampling, unless the trace
+	// has been signalled as complete, in which case the sampling
+	// decision is made immediately.
 	//
 	// TODO(axw) we should skip reservoir sampling when the matching
 	// policy's sampling rate is 100%, immediately index the event
 	// and record the trace sampling decision.
-	reservoirSampled, err := p.groups.sampleTrace(event)
+	p.evaluateShadowPolicies(event)
+	traceCompleted := p.config.TraceCompleted != nil && p.config.TraceCompleted(event)
+	var sampled bool
+	// groupsMu is held while sampling, so the root transaction is not
+	// admitted to the reservoir of groups retired by UpdatePolicies
+	// after they have been finalized.
+	p.groupsMu.RLock()
+	if traceCompleted {
+		atomic.AddInt64(&p.eventMetrics.completedTraces, 1)
+		sampled, err = p.groups.sampleCompletedTrace(event)
+	} else {
+		sampled, err = p.groups.sampleTrace(event)
+	}
+	p.groupsMu.RUnlock()
 	if err == errTooManyTraceGroups {
 		// Too many trace groups, drop the transaction.
 		p.rateLimitedLogger.Warn(`
@@ -253,28 +797,61 @@ sampling policies without service name specified.
 		return false, false, err
 	}
 
-	if !reservoirSampled {
+	if !sampled {
 		// Write the non-sampling decision to storage to avoid further
 		// writes for the trace ID, and then drop the transaction.
 		//
 		// This is a local optimisation only. To avoid creating network
 		// traffic and load on Elasticsearch for uninteresting root
 		// transactions, we do not propagate this to other APM Servers.
-		return false, false, p.eventStore.WriteTraceSampled(event.Trace.ID, false)
+		p.traceFirstSeen.forget(event.Trace.ID)
+		if err := p.writeTraceSampled(event.Trace.ID, false); err != nil {
+			return false, false, err
+		}
+		if p.config.KeepRootOnDrop {
+			// Report the root transaction without the rest of the
+			// trace, so service-level throughput and latency remain
+			// accurate.
+			atomic.AddInt64(&p.eventMetrics.rootsKeptOnDrop, 1)
+			return true, false, nil
+		}
+		return false, false, nil
+	}
+
+	if traceCompleted {
+		// The trace is complete, so there is no need to wait for the
+		// reservoirs to be finalized: report the root transaction and
+		// the trace's stored events now.
+		if err := p.reportCompletedTrace(event, completed); err != nil {
+			return false, false, err
+		}
+		atomic.AddInt64(&p.eventMetrics.completedTracesSampled, 1)
+		atomic.AddInt64(&p.eventMetrics.sampled, 1)
+		return true, false, nil
 	}
 
 	// The root transaction was admitted to the sampling reservoir, so we
 	// can proceed to write the transaction to storage; we may index it later,
 	// after finalising the sampling decision.
-	return false, true, p.eventStore.WriteTraceEvent(event.Trace.ID, event.Transaction.ID, event)
+	atomic.CompareAndSwapInt64(p.oldestUnfinalized, 0, time.Now().UnixNano())
+	p.observeTrace(event.Trace.ID, true)
+	return false, true, p.writeTraceEvent(event.Trace.ID, event.Transaction.ID, event, received)
 }
 
-func (p *Processor) processSpan(event *model.APMEvent) (report, stored bool, _ error) {
+func (p *Processor) processSpan(event *model.APMEvent, received time.Time) (report, stored bool, _ error) {
 	traceSampled, err := p.eventStore.IsTraceSampled(event.Trace.ID)
 	if err != nil {
 		if err == eventstorage.ErrNotFound {
+			if p.storageLimitReached() {
+				return false, false, errStorageLimitReached
+			}
 			// Tail-sampling decision has not yet been made, write event to local storage.
-			return false, true, p.eventStore.WriteTraceEvent(event.Trace.ID, event.Span.ID, event)
+			p.observeTrace(event.Trace.ID, false)
+			if err := p.writeTraceEvent(event.Trace.ID, event.Span.ID, event, received); err != nil {
+				return false, true, err
+			}
+			p.observeSpan(event.Trace.ID)
+			return false, true, nil
 		}
 		return false, false, err
 	}
@@ -285,8 +862,64 @@ func (p *Processor) processSpan(event *model.APMEvent) (report, stored bool, _ e
 	return traceSampled, false, nil
 }
 
-// Stop stops the processor, flushing event storage. Note that the underlying
-// badger.DB must be closed independently to ensure writes are synced to disk.
+// writeTraceEvent writes event to storage, asynchronously if configured,
+// after limiting its labels if configured. The time taken since the event
+// was received is recorded once it has been written.
+func (p *Processor) writeTraceEvent(traceID, id string, event *model.APMEvent, received time.Time) error {
+	if p.labelLimiter != nil {
+		event = p.labelLimiter.limit(event)
+	}
+	if p.asyncWriter != nil {
+		return p.asyncWriter.WriteTraceEvent(traceID, id, event, received)
+	}
+	if err := p.eventStore.WriteTraceEvent(traceID, id, event); err != nil {
+		return err
+	}
+	p.storageDelay.record(traceID, time.Since(received))
+	return nil
+}
+
+// flushTraceWrites waits for the asynchronous storage writes queued for
+// traceIDs, if any, to be performed, so that reading the traces' events
+// observes them.
+func (p *Processor) flushTraceWrites(traceIDs []string) {
+	if p.asyncWriter != nil {
+		p.asyncWriter.flush(traceIDs)
+	}
+}
+
+// writeTraceSampled writes the sampling decision for a trace to storage,
+// asynchronously if configured.
+func (p *Processor) writeTraceSampled(traceID string, sampled bool) error {
+	if p.asyncWriter != nil {
+		return p.asyncWriter.WriteTraceSampled(traceID, sampled)
+	}
+	return p.eventStore.WriteTraceSampled(traceID, sampled)
+}
+
+// Lag returns how long the oldest root transaction admitted to a sampling
+// reservoir has been waiting for the reservoir to be finalized, or zero if
+// there are no such transactions.
+func (p *Processor) Lag() time.Duration {
+	oldest := atomic.LoadInt64(p.oldestUnfinalized)
+	if oldest == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, oldest))
+}
+
+// Initialized returns a channel which is closed once Run has loaded the
+// processor's state, including the position from which to resume
+// subscribing to remote sampling decisions, and is ready to make and
+// receive sampling decisions. If Run fails before then, the channel is
+// never closed.
+func (p *Processor) Initialized() <-chan struct{} {
+	return p.initialized
+}
+
+// Stop stops the processor, flushing event storage and the audit log, if
+// enabled. Note that the underlying badger.DB must be closed independently
+// to ensure writes are synced to disk.
 func (p *Processor) Stop(ctx context.Context) error {
 	p.stopMu.Lock()
 	select {
@@ -305,7 +938,20 @@ func (p *Processor) Stop(ctx context.Context) error {
 	case <-p.stopped:
 	}
 
-	// Flush event store and the underlying read writers
+	// Write any sampling decisions made since Run last flushed
+	// the audit log, and close it.
+	if p.auditLog != nil {
+		p.flushAuditLog()
+		if err := p.auditLogFile.Close(); err != nil {
+			p.logger.With(logp.Error(err)).Warn("failed to close tail-sampling audit log")
+		}
+	}
+
+	// Wait for queued writes to be performed, if any, and
+	// flush event store and the underlying read writers.
+	if p.asyncWriter != nil {
+		p.asyncWriter.Close()
+	}
 	return p.eventStore.Flush()
 }
 
@@ -343,10 +989,23 @@ func (p *Processor) Run() error {
 	}
 	subscriberPositions := make(chan pubsub.SubscriberPosition)
 	pubsub, err := pubsub.New(pubsub.Config{
-		BeatID:     p.config.BeatID,
-		Client:     p.config.Elasticsearch,
-		DataStream: pubsub.DataStreamConfig(p.config.SampledTracesDataStream),
-		Logger:     p.logger,
+		BeatID:           p.config.BeatID,
+		Client:           p.config.Elasticsearch,
+		CompressionCodec: p.config.CompressionCodec,
+		CompressionLevel: p.config.CompressionLevel,
+		MaxRequests:      p.config.MaxBulkRequests,
+		FlushBytes:       p.config.BulkFlushBytes,
+		DataStream:       pubsub.DataStreamConfig(p.config.SampledTracesDataStream),
+		Logger:           p.logger,
+
+		PublishCircuitBreaker: p.circuitBreaker,
+		PublishMetrics:        p.publishMetrics,
+		PublishRetry: pubsub.RetryConfig{
+			MaxRetries: p.config.PublishMaxRetries,
+			Backoff:    p.config.PublishRetryBackoff,
+			Jitter:     p.config.PublishRetryJitter,
+			Timeout:    p.config.PublishRetryTimeout,
+		},
 
 		// Issue pubsub subscriber search requests at twice the frequency
 		// of publishing, so each server observes each other's sampled
@@ -359,9 +1018,19 @@ func (p *Processor) Run() error {
 	}
 
 	remoteSampledTraceIDs := make(chan string)
-	localSampledTraceIDs := make(chan string)
+	localSampledTraceIDs := make(chan []string)
 	publishSampledTraceIDs := make(chan string)
+	close(p.initialized)
 	g, ctx := errgroup.WithContext(context.Background())
+
+	// reportLocalSampledTraces reports a batch of locally sampled
+	// traces received from localSampledTraceIDs by a worker.
+	reportLocalSampledTraces := func(traceIDs []string) error {
+		done := p.finalizeWorkers.start(len(traceIDs))
+		defer done()
+		return p.reportSampledTraces(ctx, traceIDs, false)
+	}
+
 	g.Go(func() error {
 		select {
 		case <-ctx.Done():
@@ -386,13 +1055,36 @@ func (p *Processor) Run() error {
 			case <-ctx.Done():
 				return ctx.Err()
 			case <-ticker.C:
-				const discardRatio = 0.5
-				if err := p.config.DB.RunValueLogGC(discardRatio); err != nil && err != badger.ErrNoRewrite {
+				if err := p.runValueLogGC(); err != nil {
 					return err
 				}
 			}
 		}
 	})
+	if p.storageWatchdog != nil {
+		g.Go(func() error {
+			// This goroutine is responsible for recreating storage
+			// once it is persistently corrupt.
+			return p.storageWatchdog.run(ctx, p.eventStore, p.logger)
+		})
+	}
+	if p.orphanTraces != nil {
+		g.Go(func() error {
+			// This goroutine is responsible for periodically dropping
+			// orphaned traces, checking at twice the frequency of the
+			// timeout so traces are dropped soon after they time out.
+			ticker := time.NewTicker(p.config.OrphanTraceTimeout / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-ticker.C:
+					p.dropOrphanTraces()
+				}
+			}
+		})
+	}
 	g.Go(func() error {
 		defer close(subscriberPositions)
 		return pubsub.SubscribeSampledTraceIDs(ctx, initialSubscriberPosition, remoteSampledTraceIDs, subscriberPositions)
@@ -405,15 +1097,60 @@ func (p *Processor) Run() error {
 		defer ticker.Stop()
 		var traceIDs []string
 
-		publishDecisions := func() error {
+		// publishDecisions finalizes the sampling reservoirs, and publishes
+		// and reports the sampled traces. If early is true, the reservoirs
+		// are being finalized before the flush interval because storage is
+		// at its limit, and the stored events of traces which are not
+		// sampled are deleted.
+		publishDecisions := func(early bool) error {
 			p.logger.Debug("finalizing local sampling reservoirs")
-			traceIDs = p.groups.finalizeSampledTraces(traceIDs)
-			if len(traceIDs) == 0 {
+			// Reset the oldest unfinalized time before finalizing, so
+			// Lag may overestimate but never underestimate the lag.
+			atomic.StoreInt64(p.oldestUnfinalized, 0)
+			p.traceFirstSeen.expire(p.maxTTL)
+			p.traceRoots.expire(p.maxTTL)
+			p.currentGroups().expireErrorTraces(p.maxTTL)
+			p.currentGroups().expireSpanCounts(p.maxTTL)
+			if p.shadowGroups != nil {
+				p.shadowGroups.expireErrorTraces(p.maxTTL)
+				p.shadowGroups.expireSpanCounts(p.maxTTL)
+			}
+			n := len(traceIDs)
+			traceIDs = p.finalizeSampledTraces(traceIDs)
+			droppedRoots := p.currentGroups().takeDroppedRoots()
+			if p.config.DecisionFunc != nil {
+				var sampled []string
+				sampled, droppedRoots = p.applyDecisionFunc(traceIDs[n:], droppedRoots)
+				traceIDs = append(traceIDs[:n], sampled...)
+				p.sampleProbabilities.forget(droppedRoots)
+				p.sampledBy.forget(droppedRoots)
+			}
+			completedTraceIDs := p.takeCompletedTraces()
+			p.finalizeShadowDecisions(len(traceIDs) + len(completedTraceIDs))
+			if p.config.KeepRootOnDrop {
+				p.reportDroppedRoots(ctx, droppedRoots)
+			}
+			if early {
+				p.earlyFinalizer.finalized(len(traceIDs) - n + len(droppedRoots))
+				p.deleteDroppedTraces(droppedRoots)
+			}
+			p.publishDroppedTraces(ctx)
+			p.publishDecisionMetrics(ctx)
+			p.flushAuditLog()
+			if len(traceIDs) == 0 && len(completedTraceIDs) == 0 {
 				return nil
 			}
 			var g errgroup.Group
-			g.Go(func() error { return sendTraceIDs(ctx, publishSampledTraceIDs, traceIDs) })
-			g.Go(func() error { return sendTraceIDs(ctx, localSampledTraceIDs, traceIDs) })
+			g.Go(func() error {
+				// The events of completed traces have already been
+				// reported, so their decisions are only published.
+				if err := sendTraceIDs(ctx, publishSampledTraceIDs, completedTraceIDs); err != nil {
+					return err
+				}
+				return sendTraceIDs(ctx, publishSampledTraceIDs, traceIDs)
+			})
+			p.finalizeWorkers.queued(len(traceIDs))
+			g.Go(func() error { return sendTraceIDBatches(ctx, localSampledTraceIDs, traceIDs) })
 			if err := g.Wait(); err != nil {
 				return err
 			}
@@ -426,9 +1163,14 @@ func (p *Processor) Run() error {
 			case <-ctx.Done():
 				return ctx.Err()
 			case <-p.stopping:
-				return publishDecisions()
+				return publishDecisions(false)
 			case <-ticker.C:
-				if err := publishDecisions(); err != nil {
+				if err := publishDecisions(false); err != nil {
+					return err
+				}
+			case <-p.earlyFinalizer.requested():
+				p.rateLimitedLogger.Info("tail-sampling storage limit reached, finalizing local sampling reservoirs early")
+				if err := publishDecisions(true); err != nil {
 					return err
 				}
 			}
@@ -440,57 +1182,37 @@ func (p *Processor) Run() error {
 		// removing the artificial one second timeout from publisher code
 		// and just waiting as long as it takes here.
 		for {
-			var remoteDecision bool
-			var traceID string
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case traceID = <-remoteSampledTraceIDs:
+			case traceID := <-remoteSampledTraceIDs:
 				p.logger.Debug("received remotely sampled trace ID")
-				remoteDecision = true
-			case traceID = <-localSampledTraceIDs:
-			}
-			if err := p.eventStore.WriteTraceSampled(traceID, true); err != nil {
-				p.rateLimitedLogger.Warnf(
-					"received error writing sampled trace: %s", err,
-				)
-			}
-			var events model.Batch
-			if err := p.eventStore.ReadTraceEvents(traceID, &events); err != nil {
-				p.rateLimitedLogger.Warnf(
-					"received error reading trace events: %s", err,
-				)
-				continue
-			}
-			if n := len(events); n > 0 {
-				p.logger.Debugf("reporting %d events", n)
-				if remoteDecision {
-					// Remote decisions may be received multiple times,
-					// e.g. if this server restarts and resubscribes to
-					// remote sampling decisions before they have been
-					// deleted. We delete events from local storage so
-					// we don't publish duplicates; delivery is therefore
-					// at-most-once, not guaranteed.
-					for _, event := range events {
-						switch event.Processor {
-						case model.TransactionProcessor:
-							if err := p.eventStore.DeleteTraceEvent(event.Trace.ID, event.Transaction.ID); err != nil {
-								return errors.Wrap(err, "failed to delete transaction from local storage")
-							}
-						case model.SpanProcessor:
-							if err := p.eventStore.DeleteTraceEvent(event.Trace.ID, event.Span.ID); err != nil {
-								return errors.Wrap(err, "failed to delete span from local storage")
-							}
-						}
-					}
+				if err := p.reportSampledTraces(ctx, []string{traceID}, true); err != nil {
+					return err
 				}
-				atomic.AddInt64(&p.eventMetrics.sampled, int64(len(events)))
-				if err := p.config.BatchProcessor.ProcessBatch(ctx, &events); err != nil {
-					p.logger.With(logp.Error(err)).Warn("failed to report events")
+			case traceIDs := <-localSampledTraceIDs:
+				if err := reportLocalSampledTraces(traceIDs); err != nil {
+					return err
 				}
 			}
 		}
 	})
+	// The goroutine above also reports locally sampled traces, so there
+	// are FinalizeConcurrency workers reporting them in total.
+	for i := 1; i < p.finalizeWorkers.concurrency; i++ {
+		g.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case traceIDs := <-localSampledTraceIDs:
+					if err := reportLocalSampledTraces(traceIDs); err != nil {
+						return err
+					}
+				}
+			}
+		})
+	}
 	g.Go(func() error {
 		// Write subscriber position to a file on disk, to support resuming
 		// on apm-server restart without reprocessing all indices.
@@ -513,6 +1235,227 @@ func (p *Processor) Run() error {
 	return nil
 }
 
+// reportDroppedRoots reports the stored root transactions of the given traces,
+// which were admitted to a sampling reservoir but not sampled, without the rest
+// of their traces. It is called if KeepRootOnDrop is enabled.
+//
+// The root transactions are deleted from local storage once read, so they are
+// not reported again if their traces are later sampled by another APM Server.
+func (p *Processor) reportDroppedRoots(ctx context.Context, traceIDs []string) {
+	if len(traceIDs) == 0 {
+		return
+	}
+	p.flushTraceWrites(traceIDs)
+	var events model.Batch
+	if err := p.eventStore.ReadTraceEventsBatch(traceIDs, &events); err != nil {
+		p.rateLimitedLogger.Warnf(
+			"received error reading trace events: %s", err,
+		)
+		return
+	}
+	roots := events[:0]
+	for _, event := range events {
+		if event.Processor != model.TransactionProcessor || event.Parent.ID != "" {
+			continue
+		}
+		if err := p.eventStore.DeleteTraceEvent(event.Trace.ID, event.Transaction.ID); err != nil {
+			p.rateLimitedLogger.Warnf(
+				"received error deleting root transaction: %s", err,
+			)
+			continue
+		}
+		roots = append(roots, event)
+	}
+	if len(roots) == 0 {
+		return
+	}
+	atomic.AddInt64(&p.eventMetrics.rootsKeptOnDrop, int64(len(roots)))
+	if err := p.config.BatchProcessor.ProcessBatch(ctx, &roots); err != nil {
+		p.logger.With(logp.Error(err)).Warn("failed to report root transactions of dropped traces")
+	}
+}
+
+// publishDroppedTraces publishes metrics counting the traces dropped since the
+// last call, if enabled.
+func (p *Processor) publishDroppedTraces(ctx context.Context) {
+	dropped := p.currentGroups().takeDroppedTraces()
+	if len(dropped) == 0 {
+		return
+	}
+	batch := makeDroppedTracesMetricsets(dropped, time.Now())
+	if err := p.config.BatchProcessor.ProcessBatch(ctx, &batch); err != nil {
+		p.logger.With(logp.Error(err)).Warn("failed to report dropped trace metrics")
+	}
+}
+
+// publishDecisionMetrics publishes metrics counting the traces kept and
+// dropped since the last call, if enabled.
+func (p *Processor) publishDecisionMetrics(ctx context.Context) {
+	decisions := p.currentGroups().takeDecisions()
+	if len(decisions) == 0 {
+		return
+	}
+	batch := makeDecisionsMetricsets(decisions, p.config.DecisionMetricsDataset, time.Now())
+	if err := p.config.BatchProcessor.ProcessBatch(ctx, &batch); err != nil {
+		p.logger.With(logp.Error(err)).Warn("failed to report sampling decision metrics")
+	}
+}
+
+// flushAuditLog writes the local sampling decisions recorded since the last
+// call to the audit log, if enabled.
+func (p *Processor) flushAuditLog() {
+	if p.auditLog == nil {
+		return
+	}
+	if err := p.auditLog.flush(); err != nil {
+		p.rateLimitedLogger.With(logp.Error(err)).Warnf(
+			"failed to write tail-sampling audit log: %s", err,
+		)
+	}
+}
+
+// reportCompletedTrace records the trace of root, which has been signalled
+// as complete, as sampled, and appends its stored events to out. The decision
+// is published to other APM Servers when the reservoirs are next finalized.
+func (p *Processor) reportCompletedTrace(root *model.APMEvent, out *model.Batch) error {
+	traceID := root.Trace.ID
+	if err := p.writeTraceSampled(traceID, true); err != nil {
+		return err
+	}
+	p.recordFinalized([]string{traceID})
+	p.flushTraceWrites([]string{traceID})
+	n := len(*out)
+	if err := p.eventStore.ReadTraceEvents(traceID, out); err != nil {
+		p.rateLimitedLogger.Warnf(
+			"received error reading trace events: %s", err,
+		)
+	}
+	if probability, ok := p.sampleProbabilities.take(traceID); ok {
+		setSamplingProbability(root, probability)
+		for i := range (*out)[n:] {
+			setSamplingProbability(&(*out)[n+i], probability)
+		}
+	}
+	if policy, ok := p.sampledBy.take(traceID); ok {
+		p.sampledBy.set(root, policy)
+		for i := range (*out)[n:] {
+			p.sampledBy.set(&(*out)[n+i], policy)
+		}
+	}
+	stored := int64(len(*out) - n)
+	atomic.AddInt64(&p.eventMetrics.sampled, stored)
+	atomic.AddInt64(&p.eventMetrics.finalized, stored)
+
+	p.completedTracesMu.Lock()
+	p.completedTraces = append(p.completedTraces, traceID)
+	p.completedTracesMu.Unlock()
+	return nil
+}
+
+// takeCompletedTraces returns the IDs of traces signalled as complete and
+// sampled since the last call, and resets them.
+func (p *Processor) takeCompletedTraces() []string {
+	p.completedTracesMu.Lock()
+	defer p.completedTracesMu.Unlock()
+	traceIDs := p.completedTraces
+	p.completedTraces = nil
+	return traceIDs
+}
+
+// reportSampledTraces records the given trace IDs as sampled, and reports
+// their events from local storage. Events are read from storage in batches
+// of up to readTraceEventsBatchSize traces.
+//
+// If remoteDecision is true, the events are deleted from local storage.
+func (p *Processor) reportSampledTraces(ctx context.Context, traceIDs []string, remoteDecision bool) error {
+	p.recordFinalized(traceIDs)
+	// Wait for queued writes of the traces' events, so they are reported.
+	p.flushTraceWrites(traceIDs)
+	for _, traceID := range traceIDs {
+		if remoteDecision {
+			p.observeRemoteDecision(traceID)
+		}
+		if err := p.eventStore.WriteTraceSampled(traceID, true); err != nil {
+			p.rateLimitedLogger.Warnf(
+				"received error writing sampled trace: %s", err,
+			)
+		}
+	}
+	var events model.Batch
+	if err := p.eventStore.ReadTraceEventsBatch(traceIDs, &events); err != nil {
+		p.rateLimitedLogger.Warnf(
+			"received error reading trace events: %s", err,
+		)
+		p.sampleProbabilities.forget(traceIDs)
+		p.sampledBy.forget(traceIDs)
+		return nil
+	}
+	p.sampleProbabilities.annotate(traceIDs, events)
+	p.sampledBy.annotate(traceIDs, events)
+	n := len(events)
+	if n == 0 {
+		return nil
+	}
+	p.logger.Debugf("reporting %d events", n)
+	if remoteDecision {
+		// Remote decisions may be received multiple times,
+		// e.g. if this server restarts and resubscribes to
+		// remote sampling decisions before they have been
+		// deleted. We delete events from local storage so
+		// we don't publish duplicates; delivery is therefore
+		// at-most-once, not guaranteed.
+		if err := p.deleteTraceEvents(events); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&p.eventMetrics.sampled, int64(n))
+	atomic.AddInt64(&p.eventMetrics.finalized, int64(n))
+	if err := p.config.BatchProcessor.ProcessBatch(ctx, &events); err != nil {
+		p.logger.With(logp.Error(err)).Warn("failed to report events")
+	}
+	return nil
+}
+
+// deleteDroppedTraces deletes the stored events of the given traces, which
+// were not sampled, to reclaim space when storage is at its limit. The
+// decisions not to sample the traces remain in storage.
+func (p *Processor) deleteDroppedTraces(traceIDs []string) {
+	if len(traceIDs) == 0 {
+		return
+	}
+	p.flushTraceWrites(traceIDs)
+	var events model.Batch
+	if err := p.eventStore.ReadTraceEventsBatch(traceIDs, &events); err != nil {
+		p.rateLimitedLogger.Warnf(
+			"received error reading trace events: %s", err,
+		)
+		return
+	}
+	if err := p.deleteTraceEvents(events); err != nil {
+		p.rateLimitedLogger.Warnf(
+			"received error deleting trace events: %s", err,
+		)
+	}
+}
+
+// deleteTraceEvents deletes the given transactions and spans from local
+// storage.
+func (p *Processor) deleteTraceEvents(events model.Batch) error {
+	for _, event := range events {
+		switch event.Processor {
+		case model.TransactionProcessor:
+			if err := p.eventStore.DeleteTraceEvent(event.Trace.ID, event.Transaction.ID); err != nil {
+				return errors.Wrap(err, "failed to delete transaction from local storage")
+			}
+		case model.SpanProcessor:
+			if err := p.eventStore.DeleteTraceEvent(event.Trace.ID, event.Span.ID); err != nil {
+				return errors.Wrap(err, "failed to delete span from local storage")
+			}
+		}
+	}
+	return nil
+}
+
 func readSubscriberPosition(logger *logp.Logger, storageDir string) (pubsub.SubscriberPosition, error) {
 	var pos pubsub.SubscriberPosition
 	data, err := os.ReadFile(filepath.Join(storageDir, subscriberPositionFile))
@@ -536,6 +1479,26 @@ func writeSubscriberPosition(storageDir string, pos pubsub.SubscriberPosition) e
 	return os.WriteFile(filepath.Join(storageDir, subscriberPositionFile), data, 0644)
 }
 
+// sendTraceIDBatches sends copies of traceIDs to out, in batches of up to
+// readTraceEventsBatchSize trace IDs.
+func sendTraceIDBatches(ctx context.Context, out chan<- []string, traceIDs []string) error {
+	for len(traceIDs) > 0 {
+		n := len(traceIDs)
+		if n > readTraceEventsBatchSize {
+			n = readTraceEventsBatchSize
+		}
+		batch := make([]string, n)
+		copy(batch, traceIDs)
+		traceIDs = traceIDs[n:]
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- batch:
+		}
+	}
+	return nil
+}
+
 func sendTraceIDs(ctx context.Context, out chan<- string, traceIDs []string) error {
 	for _, traceID := range traceIDs {
 		select {
@@ -549,58 +1512,211 @@ func sendTraceIDs(ctx context.Context, out chan<- string, traceIDs []string) err
 
 const (
 	storageLimitThreshold = 0.90 // Allow 90% of the quota to be used.
+
+	// maxWriteLatency is the maximum storage write latency recorded in
+	// the write latency histogram. Greater latencies are recorded as
+	// maxWriteLatency.
+	maxWriteLatency = time.Minute
+
+	// writeLatencyWindow is the rotating window over which storage
+	// write latency percentiles are reported.
+	writeLatencyWindow = time.Minute
+
+	// maxStorageDelay is the maximum delay from receiving trace events
+	// until they are written to storage recorded in the storage delay
+	// histogram. Greater delays are recorded as maxStorageDelay.
+	maxStorageDelay = 10 * time.Minute
 )
 
+// errStorageUnavailable is returned by storage operations after storage
+// failed to be recreated.
+var errStorageUnavailable = errors.New("storage unavailable")
+
 // wrappedRW wraps configurable write options for global ShardedReadWriter
 type wrappedRW struct {
-	rw         *eventstorage.ShardedReadWriter
+	// mu protects db and rw, which are replaced when storage is
+	// recreated. Operations hold mu for reading while using them.
+	mu sync.RWMutex
+	db *badger.DB
+	rw *eventstorage.ShardedReadWriter
+
 	writerOpts eventstorage.WriterOpts
+
+	// outcomeTTLs holds TTLs for events keyed by event outcome,
+	// overriding writerOpts.TTL.
+	outcomeTTLs map[string]time.Duration
+
+	// writeLatency records the latency of writes to storage.
+	writeLatency *durationHistogram
+
+	// errors counts the errors returned by reads and writes, by type.
+	errors *storageErrors
 }
 
-// Stored entries expire after ttl.
+// Stored entries expire after ttl, or for events with an outcome in
+// outcomeTTLs, after the TTL for that outcome.
 // The amount of storage that can be consumed can be limited by passing in a
 // limit value greater than zero. The hard limit on storage is set to 90% of
 // the limit to account for delay in the size reporting by badger.
 // https://github.com/dgraph-io/badger/blob/82b00f27e3827022082225221ae05c03f0d37620/db.go#L1302-L1319.
-func newWrappedRW(rw *eventstorage.ShardedReadWriter, ttl time.Duration, limit int64) *wrappedRW {
+func newWrappedRW(
+	db *badger.DB, rw *eventstorage.ShardedReadWriter,
+	ttl time.Duration, outcomeTTLs map[string]time.Duration, limit int64,
+) *wrappedRW {
 	if limit > 1 {
 		limit = int64(float64(limit) * storageLimitThreshold)
 	}
 	return &wrappedRW{
+		db: db,
 		rw: rw,
 		writerOpts: eventstorage.WriterOpts{
 			TTL:                 ttl,
 			StorageLimitInBytes: limit,
 		},
+		outcomeTTLs:  outcomeTTLs,
+		writeLatency: newDurationHistogram(maxWriteLatency, writeLatencyWindow),
+		errors:       newStorageErrors(),
+	}
+}
+
+// recreate replaces the storage with that returned by f, which is called
+// once there are no storage operations in progress, and must close the
+// existing storage. If f returns an error, storage is unavailable until
+// recreated successfully.
+func (s *wrappedRW) recreate(f func() (*badger.DB, *eventstorage.ShardedReadWriter, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db, rw, err := f()
+	if err != nil {
+		s.db, s.rw = nil, nil
+		return err
 	}
+	s.db, s.rw = db, rw
+	return nil
+}
+
+// Size calls badger.DB.Size
+func (s *wrappedRW) Size() (lsm, vlog int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return 0, 0
+	}
+	return s.db.Size()
+}
+
+// KeyCount returns the number of unexpired keys in storage, iterating over
+// the keys without reading their values.
+func (s *wrappedRW) KeyCount() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return 0, errStorageUnavailable
+	}
+	var count uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// RunValueLogGC calls badger.DB.RunValueLogGC
+func (s *wrappedRW) RunValueLogGC(discardRatio float64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return badger.ErrNoRewrite
+	}
+	return s.db.RunValueLogGC(discardRatio)
 }
 
 // ReadTraceEvents calls ShardedReadWriter.ReadTraceEvents
 func (s *wrappedRW) ReadTraceEvents(traceID string, out *model.Batch) error {
-	return s.rw.ReadTraceEvents(traceID, out)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rw == nil {
+		return s.errors.read(errStorageUnavailable)
+	}
+	return s.errors.read(s.rw.ReadTraceEvents(traceID, out))
+}
+
+// ReadTraceEventsBatch calls ShardedReadWriter.ReadTraceEventsBatch
+func (s *wrappedRW) ReadTraceEventsBatch(traceIDs []string, out *model.Batch) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rw == nil {
+		return s.errors.read(errStorageUnavailable)
+	}
+	return s.errors.read(s.rw.ReadTraceEventsBatch(traceIDs, out))
 }
 
-// WriteTraceEvents calls ShardedReadWriter.WriteTraceEvents using the configured WriterOpts
+// WriteTraceEvents calls ShardedReadWriter.WriteTraceEvents using the configured WriterOpts,
+// with the TTL for the event's outcome if any.
 func (s *wrappedRW) WriteTraceEvent(traceID, id string, event *model.APMEvent) error {
-	return s.rw.WriteTraceEvent(traceID, id, event, s.writerOpts)
+	defer s.recordWriteLatency(traceID, time.Now())
+	opts := s.writerOpts
+	if ttl, ok := s.outcomeTTLs[event.Event.Outcome]; ok {
+		opts.TTL = ttl
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rw == nil {
+		return s.errors.write(errStorageUnavailable)
+	}
+	return s.errors.write(s.rw.WriteTraceEvent(traceID, id, event, opts))
 }
 
 // WriteTraceSampled calls ShardedReadWriter.WriteTraceSampled using the configured WriterOpts
 func (s *wrappedRW) WriteTraceSampled(traceID string, sampled bool) error {
-	return s.rw.WriteTraceSampled(traceID, sampled, s.writerOpts)
+	defer s.recordWriteLatency(traceID, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rw == nil {
+		return s.errors.write(errStorageUnavailable)
+	}
+	return s.errors.write(s.rw.WriteTraceSampled(traceID, sampled, s.writerOpts))
+}
+
+// recordWriteLatency records the latency of a write started at start.
+// Latencies are sharded by trace ID, like the writes themselves.
+func (s *wrappedRW) recordWriteLatency(traceID string, start time.Time) {
+	s.writeLatency.record(traceID, time.Since(start))
 }
 
 // IsTraceSampled calls ShardedReadWriter.IsTraceSampled
 func (s *wrappedRW) IsTraceSampled(traceID string) (bool, error) {
-	return s.rw.IsTraceSampled(traceID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rw == nil {
+		return false, s.errors.read(errStorageUnavailable)
+	}
+	sampled, err := s.rw.IsTraceSampled(traceID)
+	return sampled, s.errors.read(err)
 }
 
 // DeleteTraceEvent calls ShardedReadWriter.DeleteTraceEvent
 func (s *wrappedRW) DeleteTraceEvent(traceID, id string) error {
-	return s.rw.DeleteTraceEvent(traceID, id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rw == nil {
+		return s.errors.write(errStorageUnavailable)
+	}
+	return s.errors.write(s.rw.DeleteTraceEvent(traceID, id))
 }
 
 // Flush calls ShardedReadWriter.Flush
 func (s *wrappedRW) Flush() error {
-	return s.rw.Flush(s.writerOpts.StorageLimitInBytes)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rw == nil {
+		return s.errors.write(errStorageUnavailable)
+	}
+	return s.errors.write(s.rw.Flush(s.writerOpts.StorageLimitInBytes))
 }
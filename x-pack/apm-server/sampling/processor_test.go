@@ -5,15 +5,20 @@
 package sampling_test
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,8 +26,12 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
 
+	"github.com/elastic/apm-server/internal/elasticsearch"
 	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/internal/processor/otel"
 	"github.com/elastic/apm-server/x-pack/apm-server/sampling"
 	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
 	"github.com/elastic/apm-server/x-pack/apm-server/sampling/pubsub/pubsubtest"
@@ -135,6 +144,9 @@ func TestProcessAlreadyTailSampled(t *testing.T) {
 	expectedMonitoring.Ints["sampling.events.sampled"] = 2
 	expectedMonitoring.Ints["sampling.events.dropped"] = 0
 	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	expectedMonitoring.Ints["sampling.events.bypassed"] = 0
+	expectedMonitoring.Ints["sampling.events.finalized"] = 0
+	expectedMonitoring.Floats["sampling.events.finalized_ratio"] = 0
 	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`)
 
 	// Stop the processor and flush global storage so we can access the database.
@@ -242,6 +254,9 @@ func TestProcessLocalTailSampling(t *testing.T) {
 	expectedMonitoring.Ints["sampling.events.head_unsampled"] = 0
 	expectedMonitoring.Ints["sampling.events.dropped"] = 0
 	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	expectedMonitoring.Ints["sampling.events.bypassed"] = 0
+	expectedMonitoring.Ints["sampling.events.finalized"] = 2
+	expectedMonitoring.Floats["sampling.events.finalized_ratio"] = 0.5
 	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`)
 
 	// Stop the processor and flush global storage so we can access the database.
@@ -273,6 +288,64 @@ func TestProcessLocalTailSampling(t *testing.T) {
 	assert.Equal(t, unsampledTraceEvents, batch)
 }
 
+func TestProcessLocalTailSamplingFinalizeLatency(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.FlushInterval = 10 * time.Millisecond
+	reported := make(chan model.Batch)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case reported <- *batch:
+			return nil
+		}
+	})
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	trace := model.Trace{ID: "0102030405060708090a0b0c0d0e0f10"}
+	in := model.Batch{{
+		Processor: model.SpanProcessor,
+		Trace:     trace,
+		Event:     model.Event{Duration: 123 * time.Millisecond},
+		Span:      &model.Span{ID: "0102030405060709"},
+	}, {
+		Processor: model.TransactionProcessor,
+		Trace:     trace,
+		Event:     model.Event{Duration: 123 * time.Millisecond},
+		Transaction: &model.Transaction{
+			ID:      "0102030405060708",
+			Sampled: true,
+		},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	// Wait for some time to pass between storing the first event,
+	// and the trace being finalized.
+	time.Sleep(50 * time.Millisecond)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	select {
+	case events := <-reported:
+		assert.Len(t, events, 2)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for events to be reported")
+	}
+
+	metrics := collectProcessorMetrics(processor)
+	assert.Equal(t, int64(1), metrics.Ints["sampling.finalize_latency.count"])
+	for _, key := range []string{"p50_us", "p95_us", "p99_us"} {
+		assert.GreaterOrEqual(t,
+			metrics.Ints["sampling.finalize_latency."+key],
+			(50 * time.Millisecond).Microseconds(), key,
+		)
+	}
+}
+
 func TestProcessLocalTailSamplingUnsampled(t *testing.T) {
 	config := newTempdirConfig(t)
 	config.FlushInterval = time.Minute
@@ -295,99 +368,1958 @@ func TestProcessLocalTailSamplingUnsampled(t *testing.T) {
 				Sampled: true,
 			},
 		}}
-		err := processor.ProcessBatch(context.Background(), &batch)
-		require.NoError(t, err)
-		assert.Empty(t, batch)
+		err := processor.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+		assert.Empty(t, batch)
+	}
+
+	// Stop the processor so we can access the database.
+	assert.NoError(t, processor.Stop(context.Background()))
+	assert.NoError(t, config.Storage.Flush(0))
+	storage := eventstorage.New(config.DB, eventstorage.JSONCodec{})
+	reader := storage.NewReadWriter()
+	defer reader.Close()
+
+	var anyUnsampled bool
+	for _, traceID := range traceIDs {
+		sampled, err := reader.IsTraceSampled(traceID)
+		if err == eventstorage.ErrNotFound {
+			// No sampling decision made yet.
+		} else {
+			assert.NoError(t, err)
+			if !sampled {
+				anyUnsampled = true
+				break
+			}
+		}
+	}
+	assert.True(t, anyUnsampled)
+}
+
+func TestProcessLocalTailSamplingPolicyOrder(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{
+		PolicyCriteria: sampling.PolicyCriteria{TraceName: "trace_name"},
+		SampleRate:     0.5,
+	}, {
+		PolicyCriteria: sampling.PolicyCriteria{ServiceName: "service_name"},
+		SampleRate:     0.1,
+	}, {
+		PolicyCriteria: sampling.PolicyCriteria{},
+		SampleRate:     0,
+	}}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan string)
+	config.Elasticsearch = pubsubtest.Client(pubsubtest.PublisherChan(published), nil)
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	// Send transactions which would match either policy defined above.
+	rng := rand.New(rand.NewSource(0))
+	service := model.Service{Name: "service_name"}
+	numTransactions := 100
+	events := make(model.Batch, numTransactions)
+	for i := range events {
+		var traceIDBytes [16]byte
+		_, err := rng.Read(traceIDBytes[:])
+		require.NoError(t, err)
+		events[i] = model.APMEvent{
+			Service:   service,
+			Processor: model.TransactionProcessor,
+			Trace:     model.Trace{ID: fmt.Sprintf("%x", traceIDBytes[:])},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				Name:    "trace_name",
+				ID:      fmt.Sprintf("%x", traceIDBytes[8:]),
+				Sampled: true,
+			},
+		}
+	}
+
+	err = processor.ProcessBatch(context.Background(), &events)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	// Start periodic tail-sampling. We start the processor after processing
+	// events to ensure all events are processed before any local sampling
+	// decisions are made, such that we have a single tail-sampling decision
+	// to check.
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// The first matching policy should win, and sample 50%.
+	for i := 0; i < numTransactions/2; i++ {
+		select {
+		case <-published:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for publication")
+		}
+	}
+	select {
+	case <-published:
+		t.Fatal("unexpected publication")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProcessLocalTailSamplingOTLP(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{
+		PolicyCriteria: sampling.PolicyCriteria{ServiceEnvironment: "production", TraceOutcome: "failure"},
+		SampleRate:     1,
+	}, {
+		SampleRate: 0,
+	}}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan string)
+	config.Elasticsearch = pubsubtest.Client(pubsubtest.PublisherChan(published), nil)
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	// Traces received via OTLP and the Elastic APM intake protocol should
+	// be matched uniformly: deployment.environment and the span status
+	// correspond to the service environment and trace outcome.
+	var otlpEvents model.Batch
+	otlpConsumer := &otel.Consumer{Processor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		otlpEvents = append(otlpEvents, *batch...)
+		return nil
+	})}
+	traces := ptrace.NewTraces()
+	for i, environment := range []string{"production", "staging"} {
+		resourceSpans := traces.ResourceSpans().AppendEmpty()
+		resourceSpans.Resource().Attributes().InsertString("service.name", "otlp_service")
+		resourceSpans.Resource().Attributes().InsertString("deployment.environment", environment)
+		otelSpan := resourceSpans.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		otelSpan.SetTraceID(pcommon.NewTraceID([16]byte{byte(i + 1)}))
+		otelSpan.SetSpanID(pcommon.NewSpanID([8]byte{byte(i + 1)}))
+		otelSpan.Status().SetCode(ptrace.StatusCodeError)
+	}
+	require.NoError(t, otlpConsumer.ConsumeTraces(context.Background(), traces))
+	require.Len(t, otlpEvents, 2)
+	otlpTraceID := otlpEvents[0].Trace.ID
+
+	events := append(otlpEvents, model.APMEvent{
+		Service:   model.Service{Name: "intake_service", Environment: "production"},
+		Processor: model.TransactionProcessor,
+		Trace:     model.Trace{ID: "intake_trace"},
+		Event:     model.Event{Outcome: "failure"},
+		Transaction: &model.Transaction{
+			ID:      "intake_transaction",
+			Sampled: true,
+		},
+	})
+	err = processor.ProcessBatch(context.Background(), &events)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	var sampled []string
+	for i := 0; i < 2; i++ {
+		select {
+		case traceID := <-published:
+			sampled = append(sampled, traceID)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for publication")
+		}
+	}
+	select {
+	case traceID := <-published:
+		t.Fatalf("unexpected publication of %q", traceID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.ElementsMatch(t, []string{otlpTraceID, "intake_trace"}, sampled)
+}
+
+func TestProcessLocalTailSamplingDroppedTraceMetrics(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
+	config.FlushInterval = 10 * time.Millisecond
+	config.DroppedTraceMetrics = true
+	metricsets := make(chan model.APMEvent, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		for _, event := range *batch {
+			if event.Processor == model.MetricsetProcessor {
+				metricsets <- event
+			}
+		}
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	var in model.Batch
+	for i := 0; i < 10; i++ {
+		in = append(in, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Service:   model.Service{Name: "service_name"},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Name:    "transaction_name",
+				Type:    "request",
+				Sampled: true,
+			},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	var metricset model.APMEvent
+	select {
+	case metricset = <-metricsets:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for dropped trace metrics")
+	}
+	assert.Equal(t, "service_name", metricset.Service.Name)
+	assert.Equal(t, "dropped_traces", metricset.Metricset.Name)
+	assert.Equal(t, int64(5), metricset.Metricset.DocCount)
+	assert.Equal(t, &model.Transaction{
+		Name: "transaction_name",
+		Type: "request",
+		Root: true,
+	}, metricset.Transaction)
+}
+
+func TestProcessLocalTailSamplingDecisionMetrics(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{Name: "half", SampleRate: 0.5}}
+	config.FlushInterval = 10 * time.Millisecond
+	config.DecisionMetricsDataset = "apm.sampling"
+	metricsets := make(chan model.APMEvent, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		for _, event := range *batch {
+			if event.Processor == model.MetricsetProcessor {
+				metricsets <- event
+			}
+		}
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	var in model.Batch
+	for i := 0; i < 10; i++ {
+		in = append(in, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Service:   model.Service{Name: "service_name"},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	var metricset model.APMEvent
+	select {
+	case metricset = <-metricsets:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for sampling decision metrics")
+	}
+	assert.Equal(t, model.DataStream{Type: "metrics", Dataset: "apm.sampling"}, metricset.DataStream)
+	assert.Equal(t, "service_name", metricset.Service.Name)
+	assert.Equal(t, model.Labels{"tail_sampling_policy": {Value: "half"}}, metricset.Labels)
+	assert.Equal(t, &model.Metricset{
+		Name: "tail_sampling_decisions",
+		Samples: map[string]model.MetricsetSample{
+			"tail_sampling.traces.kept":    {Type: model.MetricTypeCounter, Value: 5},
+			"tail_sampling.traces.dropped": {Type: model.MetricTypeCounter, Value: 5},
+		},
+	}, metricset.Metricset)
+}
+
+func TestProcessLocalTailSamplingKeepRootOnDrop(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{
+		{PolicyCriteria: sampling.PolicyCriteria{ServiceName: "never"}, SampleRate: 0},
+		{SampleRate: 0.5},
+	}
+	config.FlushInterval = 10 * time.Millisecond
+	config.KeepRootOnDrop = true
+	published := make(chan model.Batch, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		published <- append(model.Batch(nil), (*batch)...)
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	// Root transactions dropped without being admitted to a reservoir
+	// are reported immediately, without the rest of their traces.
+	in := model.Batch{{
+		Processor:   model.TransactionProcessor,
+		Service:     model.Service{Name: "never"},
+		Trace:       model.Trace{ID: "never_trace"},
+		Event:       model.Event{Duration: 123 * time.Millisecond},
+		Transaction: &model.Transaction{ID: "never_transaction", Sampled: true},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	require.Len(t, in, 1)
+	assert.Equal(t, "never_transaction", in[0].Transaction.ID)
+
+	in = nil
+	for i := 0; i < 10; i++ {
+		in = append(in, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Service:   model.Service{Name: "service_name"},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		}, model.APMEvent{
+			Processor: model.SpanProcessor,
+			Service:   model.Service{Name: "service_name"},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Parent:    model.Parent{ID: fmt.Sprintf("transaction%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Span:      &model.Span{ID: fmt.Sprintf("span%d", i)},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Half of the traces are sampled and reported in full; the root
+	// transactions of the other half are reported alone.
+	var transactions, spans int
+	timeout := time.After(10 * time.Second)
+	for transactions < 10 || spans < 5 {
+		select {
+		case batch := <-published:
+			for _, event := range batch {
+				switch event.Processor {
+				case model.TransactionProcessor:
+					transactions++
+				case model.SpanProcessor:
+					spans++
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events (%d transactions, %d spans)", transactions, spans)
+		}
+	}
+	assert.Equal(t, 10, transactions)
+	assert.Equal(t, 5, spans)
+
+	metrics := collectProcessorMetrics(processor)
+	assert.Equal(t, int64(6), metrics.Ints["sampling.events.roots_kept_on_drop"])
+}
+
+func TestProcessLocalTailSamplingEmitSamplingProbability(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{
+		{PolicyCriteria: sampling.PolicyCriteria{ServiceName: "half"}, SampleRate: 0.5},
+		{SampleRate: 1},
+	}
+	config.FlushInterval = 10 * time.Millisecond
+	config.EmitSamplingProbability = true
+	config.TraceCompleted = func(event *model.APMEvent) bool {
+		return event.Labels["trace_complete"].Value == "true"
+	}
+	published := make(chan model.Batch, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		published <- append(model.Batch(nil), (*batch)...)
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	var in model.Batch
+	for i := 0; i < 12; i++ {
+		serviceName := "half"
+		if i >= 10 {
+			serviceName = "all"
+		}
+		in = append(in, model.APMEvent{
+			Processor: model.SpanProcessor,
+			Service:   model.Service{Name: serviceName},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Parent:    model.Parent{ID: fmt.Sprintf("transaction%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Span:      &model.Span{ID: fmt.Sprintf("span%d", i)},
+		}, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Service:   model.Service{Name: serviceName},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	// The events of completed traces are annotated when reported
+	// immediately, with the matching policy's sample rate.
+	in = model.Batch{{
+		Processor: model.SpanProcessor,
+		Service:   model.Service{Name: "all"},
+		Trace:     model.Trace{ID: "completed_trace"},
+		Parent:    model.Parent{ID: "completed_transaction"},
+		Span:      &model.Span{ID: "completed_span"},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	in = model.Batch{{
+		Processor:   model.TransactionProcessor,
+		Service:     model.Service{Name: "all"},
+		Trace:       model.Trace{ID: "completed_trace"},
+		Labels:      model.Labels{"trace_complete": {Value: "true"}},
+		Transaction: &model.Transaction{ID: "completed_transaction", Sampled: true},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	require.Len(t, in, 2)
+	for _, event := range in {
+		assert.Equal(t, model.NumericLabels{
+			"sampling_probability": {Value: 1},
+		}, event.NumericLabels)
+	}
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Half of the "half" service's traces are sampled, and all of the
+	// "all" service's traces. Their events are annotated with the
+	// effective sampling probability of the matching policy.
+	probabilities := make(map[string][]float64)
+	var events int
+	timeout := time.After(10 * time.Second)
+	for events < 14 {
+		select {
+		case batch := <-published:
+			for _, event := range batch {
+				label, ok := event.NumericLabels["sampling_probability"]
+				require.True(t, ok)
+				probabilities[event.Service.Name] = append(probabilities[event.Service.Name], label.Value)
+				events++
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events (%d received)", events)
+		}
+	}
+	assert.Equal(t, map[string][]float64{
+		"half": {0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5},
+		"all":  {1, 1, 1, 1},
+	}, probabilities)
+}
+
+func TestProcessLocalTailSamplingSampledByLabel(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{
+		{Name: "half_policy", PolicyCriteria: sampling.PolicyCriteria{ServiceName: "half"}, SampleRate: 0.5},
+		{SampleRate: 1},
+	}
+	config.FlushInterval = 10 * time.Millisecond
+	config.SampledByLabel = "sampled_by"
+	config.TraceCompleted = func(event *model.APMEvent) bool {
+		return event.Labels["trace_complete"].Value == "true"
+	}
+	published := make(chan model.Batch, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		published <- append(model.Batch(nil), (*batch)...)
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	// Labels may be shared by events, so they must not be modified.
+	sharedLabels := model.Labels{"shared": {Value: "value"}}
+	var in model.Batch
+	for i := 0; i < 12; i++ {
+		serviceName := "half"
+		if i >= 10 {
+			serviceName = "all"
+		}
+		in = append(in, model.APMEvent{
+			Processor: model.SpanProcessor,
+			Service:   model.Service{Name: serviceName},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Parent:    model.Parent{ID: fmt.Sprintf("transaction%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Labels:    sharedLabels,
+			Span:      &model.Span{ID: fmt.Sprintf("span%d", i)},
+		}, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Service:   model.Service{Name: serviceName},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Labels:    sharedLabels,
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	// The events of completed traces are labelled when reported
+	// immediately. Policies without a name are identified by index.
+	in = model.Batch{{
+		Processor: model.SpanProcessor,
+		Service:   model.Service{Name: "all"},
+		Trace:     model.Trace{ID: "completed_trace"},
+		Parent:    model.Parent{ID: "completed_transaction"},
+		Span:      &model.Span{ID: "completed_span"},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	in = model.Batch{{
+		Processor:   model.TransactionProcessor,
+		Service:     model.Service{Name: "all"},
+		Trace:       model.Trace{ID: "completed_trace"},
+		Labels:      model.Labels{"trace_complete": {Value: "true"}},
+		Transaction: &model.Transaction{ID: "completed_transaction", Sampled: true},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	require.Len(t, in, 2)
+	for _, event := range in {
+		assert.Equal(t, "tail:1", event.Labels["sampled_by"].Value)
+	}
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	sampledBy := make(map[string][]string)
+	var events int
+	timeout := time.After(10 * time.Second)
+	for events < 14 {
+		select {
+		case batch := <-published:
+			for _, event := range batch {
+				assert.Equal(t, "value", event.Labels["shared"].Value)
+				label, ok := event.Labels["sampled_by"]
+				require.True(t, ok)
+				sampledBy[event.Service.Name] = append(sampledBy[event.Service.Name], label.Value)
+				events++
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events (%d received)", events)
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"half": {
+			"tail:half_policy", "tail:half_policy", "tail:half_policy", "tail:half_policy", "tail:half_policy",
+			"tail:half_policy", "tail:half_policy", "tail:half_policy", "tail:half_policy", "tail:half_policy",
+		},
+		"all": {"tail:1", "tail:1", "tail:1", "tail:1"},
+	}, sampledBy)
+	assert.Equal(t, model.Labels{"shared": {Value: "value"}}, sharedLabels)
+}
+
+func TestProcessLocalTailSamplingFinalizeConcurrency(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.FlushInterval = 10 * time.Millisecond
+	config.FinalizeConcurrency = 2
+	reporting := make(chan struct{}, 3)
+	release := make(chan struct{})
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		reporting <- struct{}{}
+		<-release
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	// 250 sampled traces are reported in three batches
+	// of 100, 100, and 50 traces.
+	var in model.Batch
+	for i := 0; i < 250; i++ {
+		in = append(in, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Only two batches are reported concurrently, and
+	// the third batch remains in the backlog.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-reporting:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for batches to be reported")
+		}
+	}
+	select {
+	case <-reporting:
+		t.Fatal("unexpected concurrent batch")
+	case <-time.After(50 * time.Millisecond):
+	}
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.finalize.concurrency"] = 2
+	expectedMonitoring.Ints["sampling.finalize.active"] = 2
+	expectedMonitoring.Ints["sampling.finalize.backlog"] = 50
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.finalize.*`)
+
+	close(release)
+	select {
+	case <-reporting:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for batches to be reported")
+	}
+	assert.Eventually(t, func() bool {
+		metrics := collectProcessorMetrics(processor)
+		return metrics.Ints["sampling.finalize.active"] == 0 &&
+			metrics.Ints["sampling.finalize.backlog"] == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestProcessLocalTailSamplingClockSkew(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan model.Batch, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		published <- append(model.Batch(nil), (*batch)...)
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	// Events with timestamps far in the past or future, due to agent
+	// clock skew, are finalized at the next flush like any others, and
+	// are published with their original timestamps.
+	past := time.Now().Add(-365 * 24 * time.Hour).Truncate(time.Millisecond)
+	future := time.Now().Add(365 * 24 * time.Hour).Truncate(time.Millisecond)
+	in := model.Batch{{
+		Timestamp:   past,
+		Processor:   model.TransactionProcessor,
+		Trace:       model.Trace{ID: "past_trace"},
+		Event:       model.Event{Duration: 123 * time.Millisecond},
+		Transaction: &model.Transaction{ID: "past_transaction", Sampled: true},
+	}, {
+		Timestamp:   future,
+		Processor:   model.TransactionProcessor,
+		Trace:       model.Trace{ID: "future_trace"},
+		Event:       model.Event{Duration: 123 * time.Millisecond},
+		Transaction: &model.Transaction{ID: "future_transaction", Sampled: true},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	timestamps := make(map[string]time.Time)
+	timeout := time.After(10 * time.Second)
+	for len(timestamps) < 2 {
+		select {
+		case batch := <-published:
+			for _, event := range batch {
+				timestamps[event.Trace.ID] = event.Timestamp
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, received %v", timestamps)
+		}
+	}
+	assert.True(t, past.Equal(timestamps["past_trace"]), timestamps["past_trace"])
+	assert.True(t, future.Equal(timestamps["future_trace"]), timestamps["future_trace"])
+}
+
+func TestProcessLocalTailSamplingDecisionFunc(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan model.Batch, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		published <- append(model.Batch(nil), (*batch)...)
+		return nil
+	})
+
+	// Keep the traces with a "keep" label on a span, regardless of
+	// the policies' decisions.
+	type decision struct {
+		events  int
+		sampled bool
+		keep    bool
+	}
+	var mu sync.Mutex
+	decisions := make(map[string]decision)
+	hasKeepLabel := func(events model.Batch) bool {
+		for _, event := range events {
+			if event.Span != nil && event.Labels["keep"].Value == "true" {
+				return true
+			}
+		}
+		return false
+	}
+	config.DecisionFunc = func(summary sampling.TraceSummary) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		keep := hasKeepLabel(summary.Events)
+		decisions[summary.TraceID] = decision{
+			events:  len(summary.Events),
+			sampled: summary.Sampled,
+			keep:    keep,
+		}
+		return keep
+	}
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	var in model.Batch
+	for i := 0; i < 10; i++ {
+		span := model.APMEvent{
+			Processor: model.SpanProcessor,
+			Service:   model.Service{Name: "service_name"},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Parent:    model.Parent{ID: fmt.Sprintf("transaction%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Span:      &model.Span{ID: fmt.Sprintf("span%d", i)},
+		}
+		if i%2 == 0 {
+			span.Labels = model.Labels{"keep": {Value: "true"}}
+		}
+		in = append(in, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Service:   model.Service{Name: "service_name"},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		}, span)
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	publishedTraces := make(map[string]int)
+	timeout := time.After(10 * time.Second)
+	for len(publishedTraces) < 5 {
+		select {
+		case batch := <-published:
+			for _, event := range batch {
+				publishedTraces[event.Trace.ID]++
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, received %v", publishedTraces)
+		}
+	}
+	assert.Equal(t, map[string]int{
+		"trace0": 2, "trace2": 2, "trace4": 2, "trace6": 2, "trace8": 2,
+	}, publishedTraces)
+
+	// Each trace is passed to the DecisionFunc with its locally stored
+	// events and the policies' decision, half of which were to sample.
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, decisions, 10)
+	var policySampled, kept, dropped int64
+	for traceID, d := range decisions {
+		assert.Equal(t, 2, d.events, traceID)
+		if d.sampled {
+			policySampled++
+			if !d.keep {
+				dropped++
+			}
+		} else if d.keep {
+			kept++
+		}
+	}
+	assert.Equal(t, int64(5), policySampled)
+
+	metrics := collectProcessorMetrics(processor)
+	assert.Equal(t, kept, metrics.Ints["sampling.decision_func.kept"])
+	assert.Equal(t, dropped, metrics.Ints["sampling.decision_func.dropped"])
+}
+
+func TestProcessLocalTailSamplingHasError(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{
+		{PolicyCriteria: sampling.PolicyCriteria{HasError: true}, SampleRate: 1},
+		{SampleRate: 0.001},
+	}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan model.Batch, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		published <- append(model.Batch(nil), (*batch)...)
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeError := func(traceID string) model.APMEvent {
+		return model.APMEvent{
+			Processor: model.ErrorProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Error:     &model.Error{ID: traceID + "_error"},
+		}
+	}
+	// trace1 has an error observed before its root transaction, and trace3
+	// has one observed afterwards. trace2 has no errors.
+	in := model.Batch{makeError("trace1")}
+	for i := 1; i <= 3; i++ {
+		in = append(in, model.APMEvent{
+			Processor:   model.TransactionProcessor,
+			Trace:       model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:       model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{ID: fmt.Sprintf("transaction%d", i), Sampled: true},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+
+	// Error events are not tail-sampled.
+	require.Len(t, in, 1)
+	assert.Equal(t, model.ErrorProcessor, in[0].Processor)
+
+	in = model.Batch{makeError("trace3")}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	require.Len(t, in, 1)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	transactions := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for len(transactions) < 2 {
+		select {
+		case batch := <-published:
+			for _, event := range batch {
+				transactions[event.Transaction.ID] = true
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events (%v)", transactions)
+		}
+	}
+	assert.Equal(t, map[string]bool{"transaction1": true, "transaction3": true}, transactions)
+}
+
+func TestProcessLocalTailSamplingMinSpanCount(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{
+		{PolicyCriteria: sampling.PolicyCriteria{MinSpanCount: 3}, SampleRate: 1},
+		{SampleRate: 0.001},
+	}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan model.Batch, 10)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		published <- append(model.Batch(nil), (*batch)...)
+		return nil
+	})
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeSpans := func(traceID string, n int) model.Batch {
+		var batch model.Batch
+		for i := 0; i < n; i++ {
+			batch = append(batch, model.APMEvent{
+				Processor: model.SpanProcessor,
+				Trace:     model.Trace{ID: traceID},
+				Span:      &model.Span{ID: fmt.Sprintf("%s_span%d", traceID, i)},
+			})
+		}
+		return batch
+	}
+	makeTransaction := func(i int) model.APMEvent {
+		return model.APMEvent{
+			Processor:   model.TransactionProcessor,
+			Trace:       model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:       model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{ID: fmt.Sprintf("transaction%d", i), Sampled: true},
+		}
+	}
+	// trace1 has enough spans stored before its root transaction, and trace3
+	// reaches the threshold afterwards. trace2 has too few spans.
+	in := makeSpans("trace1", 3)
+	in = append(in, makeSpans("trace2", 2)...)
+	in = append(in, makeSpans("trace3", 1)...)
+	for i := 1; i <= 3; i++ {
+		in = append(in, makeTransaction(i))
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	in = makeSpans("trace3", 2)
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	transactions := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for len(transactions) < 2 {
+		select {
+		case batch := <-published:
+			for _, event := range batch {
+				if event.Transaction != nil {
+					transactions[event.Transaction.ID] = true
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events (%v)", transactions)
+		}
+	}
+	assert.Equal(t, map[string]bool{"transaction1": true, "transaction3": true}, transactions)
+}
+
+func TestProcessorUpdatePolicies(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{Name: "default", SampleRate: 1}}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan string, 100)
+	config.BatchProcessor = model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		for _, event := range *batch {
+			if event.Processor == model.TransactionProcessor {
+				published <- event.Trace.ID
+			}
+		}
+		return nil
+	})
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeTransaction := func(traceID string) model.APMEvent {
+		return model.APMEvent{
+			Processor:   model.TransactionProcessor,
+			Trace:       model.Trace{ID: traceID},
+			Event:       model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{ID: traceID + "_transaction", Sampled: true},
+		}
+	}
+
+	// A root transaction admitted to a reservoir before the policies are
+	// replaced is still sampled once the reservoirs are finalized, even
+	// though the new policies would drop it.
+	in := model.Batch{makeTransaction("before")}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &in))
+	assert.Empty(t, in)
+
+	err = processor.UpdatePolicies([]sampling.Policy{{PolicyCriteria: sampling.PolicyCriteria{ServiceName: "a"}}})
+	assert.EqualError(t, err, "invalid tail-sampling policies: Policies does not contain a default (empty criteria) policy")
+	err = processor.UpdatePolicies(nil)
+	assert.EqualError(t, err, "invalid tail-sampling policies: Policies unspecified")
+	require.NoError(t, processor.UpdatePolicies([]sampling.Policy{{Name: "default", SampleRate: 0}}))
+
+	in = model.Batch{makeTransaction("after")}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &in))
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	select {
+	case traceID := <-published:
+		assert.Equal(t, "before", traceID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for events")
+	}
+
+	// Metrics of policies with the same name are kept across updates.
+	metrics := collectProcessorMetrics(processor)
+	assert.Equal(t, int64(2), metrics.Ints["sampling.policies.default.matched"])
+	assert.Equal(t, int64(1), metrics.Ints["sampling.policies.default.kept"])
+	assert.Equal(t, int64(1), metrics.Ints["sampling.policies.default.dropped"])
+
+	// Swap the policies repeatedly while processing events concurrently.
+	// Each root transaction is sampled according to one consistent set of
+	// policies, so every trace processed after the final update is kept.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				in := model.Batch{makeTransaction(fmt.Sprintf("concurrent%d_%d", i, j))}
+				assert.NoError(t, processor.ProcessBatch(context.Background(), &in))
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		policies := []sampling.Policy{
+			{PolicyCriteria: sampling.PolicyCriteria{TraceName: "a"}, SampleRate: 1},
+			{SampleRate: float64(i % 2)},
+		}
+		require.NoError(t, processor.UpdatePolicies(policies))
+	}
+	wg.Wait()
+	require.NoError(t, processor.UpdatePolicies([]sampling.Policy{{Name: "final", SampleRate: 1}}))
+
+	in = model.Batch{makeTransaction("final")}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &in))
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case traceID := <-published:
+			if traceID == "final" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for events")
+		}
+	}
+}
+
+func TestProcessLocalTailSamplingShadowPolicies(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.ShadowPolicies = []sampling.Policy{{SampleRate: 0.5}}
+	config.FlushInterval = 10 * time.Millisecond
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	var in model.Batch
+	for i := 0; i < 10; i++ {
+		in = append(in, model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		})
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Wait for the sampling decisions to be finalized. Only the primary
+	// policies' decisions are acted upon; the shadow policies' decisions
+	// are only counted.
+	deadline := time.Now().Add(10 * time.Second)
+	for collectProcessorMetrics(processor).Ints["sampling.shadow.primary_sampled"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for sampling decisions")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.shadow.evaluated"] = 10
+	expectedMonitoring.Ints["sampling.shadow.sampled"] = 5
+	expectedMonitoring.Ints["sampling.shadow.primary_sampled"] = 10
+	expectedMonitoring.Ints["sampling.shadow.policies.0.matched"] = 10
+	expectedMonitoring.Ints["sampling.shadow.policies.0.kept"] = 5
+	expectedMonitoring.Ints["sampling.shadow.policies.0.dropped"] = 5
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.shadow.*`)
+}
+
+func TestProcessLocalTailSamplingPolicyMetrics(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{
+		Name:           "failures",
+		PolicyCriteria: sampling.PolicyCriteria{TraceOutcome: "failure"},
+		SampleRate:     1,
+	}, {
+		PolicyCriteria: sampling.PolicyCriteria{ServiceName: "service"},
+		SampleRate:     0.5,
+	}, {
+		SampleRate: 0,
+	}}
+	config.FlushInterval = 10 * time.Millisecond
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	var in model.Batch
+	for i := 0; i < 10; i++ {
+		event := model.APMEvent{
+			Processor: model.TransactionProcessor,
+			Service:   model.Service{Name: "service"},
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Event:     model.Event{Duration: 123 * time.Millisecond, Outcome: "success"},
+			Transaction: &model.Transaction{
+				ID:      fmt.Sprintf("transaction%d", i),
+				Sampled: true,
+			},
+		}
+		switch {
+		case i < 3:
+			event.Event.Outcome = "failure"
+		case i >= 7:
+			event.Service.Name = "other"
+		}
+		in = append(in, event)
+	}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Wait for the sampling decisions to be finalized. Traces admitted
+	// to a reservoir are counted as kept or dropped only once finalized.
+	deadline := time.Now().Add(10 * time.Second)
+	for collectProcessorMetrics(processor).Ints["sampling.policies.failures.kept"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for sampling decisions")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.policies.failures.matched"] = 3
+	expectedMonitoring.Ints["sampling.policies.failures.kept"] = 3
+	expectedMonitoring.Ints["sampling.policies.failures.dropped"] = 0
+	expectedMonitoring.Ints["sampling.policies.1.matched"] = 4
+	expectedMonitoring.Ints["sampling.policies.1.kept"] = 2
+	expectedMonitoring.Ints["sampling.policies.1.dropped"] = 2
+	expectedMonitoring.Ints["sampling.policies.2.matched"] = 3
+	expectedMonitoring.Ints["sampling.policies.2.kept"] = 0
+	expectedMonitoring.Ints["sampling.policies.2.dropped"] = 3
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.policies.*`)
+}
+
+func TestProcessOrphanTraces(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.OrphanTraceTimeout = 100 * time.Millisecond
+	subscriberChan := make(chan string)
+	config.Elasticsearch = pubsubtest.Client(nil, pubsubtest.SubscriberChan(subscriberChan))
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeSpan := func(traceID, spanID string) model.APMEvent {
+		return model.APMEvent{
+			Processor: model.SpanProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Span:      &model.Span{ID: spanID},
+		}
+	}
+	rooted := model.Batch{makeSpan("rooted", "span1"), {
+		Processor: model.TransactionProcessor,
+		Trace:     model.Trace{ID: "rooted"},
+		Event:     model.Event{Duration: 123 * time.Millisecond},
+		Transaction: &model.Transaction{
+			ID:      "transaction",
+			Sampled: true,
+		},
+	}}
+	in := append(model.Batch{makeSpan("orphan", "span1"), makeSpan("orphan", "span2")}, rooted...)
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	deadline := time.Now().Add(10 * time.Second)
+	for collectProcessorMetrics(processor).Ints["sampling.orphan_traces.dropped"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for orphaned traces to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.orphan_traces.dropped"] = 1
+	expectedMonitoring.Ints["sampling.orphan_traces.delete_failures"] = 0
+	expectedMonitoring.Ints["sampling.orphan_traces.late_remote_decisions"] = 0
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.orphan_traces.*`)
+
+	// Further events for the orphaned trace are dropped.
+	in = model.Batch{makeSpan("orphan", "span3")}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	// A remote sampling decision received after the orphaned trace was
+	// dropped is counted, as its events are no longer available.
+	subscriberChan <- "orphan"
+	for collectProcessorMetrics(processor).Ints["sampling.orphan_traces.late_remote_decisions"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for late remote decision to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stop the processor and flush global storage so we can access the database.
+	assert.NoError(t, processor.Stop(context.Background()))
+	assert.NoError(t, config.Storage.Flush(0))
+	reader := eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewReadWriter()
+	defer reader.Close()
+
+	var batch model.Batch
+	err = reader.ReadTraceEvents("orphan", &batch)
+	assert.NoError(t, err)
+	assert.Empty(t, batch)
+
+	err = reader.ReadTraceEvents("rooted", &batch)
+	assert.NoError(t, err)
+	assert.Len(t, batch, 2)
+}
+
+func TestProcessCircuitBreaker(t *testing.T) {
+	// Bulk requests fail with a 500 (Internal Server Error) response,
+	// which is not retried by the client.
+	var bulkRequests int64
+	client := &bulkErrorClient{Client: pubsubtest.Client(nil, nil), requests: &bulkRequests}
+
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.FlushInterval = 10 * time.Millisecond
+	config.CircuitBreakerFailureThreshold = 1
+	config.CircuitBreakerCooldown = time.Hour
+	config.Elasticsearch = client
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	processTrace := func(traceID string) {
+		in := model.Batch{{
+			Processor: model.TransactionProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      traceID,
+				Sampled: true,
+			},
+		}}
+		err := processor.ProcessBatch(context.Background(), &in)
+		require.NoError(t, err)
+	}
+	processTrace("trace1")
+
+	deadline := time.Now().Add(10 * time.Second)
+	for collectProcessorMetrics(processor).Ints["sampling.circuit_breaker.opened"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for circuit breaker to open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once the breaker is open, requests are short-circuited
+	// and do not reach Elasticsearch.
+	processTrace("trace2")
+	for collectProcessorMetrics(processor).Ints["sampling.circuit_breaker.rejected"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for circuit breaker to reject requests")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&bulkRequests))
+
+	snapshot := collectProcessorMetrics(processor)
+	assert.Equal(t, "open", snapshot.Strings["sampling.circuit_breaker.state"])
+	assert.Equal(t, int64(1), snapshot.Ints["sampling.circuit_breaker.opened"])
+}
+
+func TestProcessRemoteSamplingPublish(t *testing.T) {
+	for _, compressionLevel := range []int{gzip.NoCompression, gzip.BestSpeed} {
+		t.Run(fmt.Sprintf("compression_level=%d", compressionLevel), func(t *testing.T) {
+			recorder := pubsubtest.NewRecorder(nil)
+			config := newTempdirConfig(t)
+			config.Policies = []sampling.Policy{{SampleRate: 1}}
+			config.FlushInterval = 10 * time.Millisecond
+			config.CompressionLevel = compressionLevel
+			config.Elasticsearch = recorder.Client()
+			processor, err := sampling.NewProcessor(config)
+			require.NoError(t, err)
+			go processor.Run()
+			defer processor.Stop(context.Background())
+
+			in := model.Batch{{
+				Processor: model.TransactionProcessor,
+				Trace:     model.Trace{ID: "0102030405060708090a0b0c0d0e0f10"},
+				Event:     model.Event{Duration: 123 * time.Millisecond},
+				Transaction: &model.Transaction{
+					ID:      "0102030405060708",
+					Sampled: true,
+				},
+			}}
+			err = processor.ProcessBatch(context.Background(), &in)
+			require.NoError(t, err)
+
+			assert.Eventually(t, func() bool {
+				return recorder.Count() == 1
+			}, 10*time.Second, 10*time.Millisecond)
+			assert.Equal(t, []string{"0102030405060708090a0b0c0d0e0f10"}, recorder.TraceIDs())
+
+			bodies := recorder.BulkBodies()
+			require.Len(t, bodies, 1)
+			assert.Equal(t, 1, recorder.BulkRequests())
+			lines := strings.Split(strings.TrimSpace(string(bodies[0])), "\n")
+			require.Len(t, lines, 2)
+			assert.JSONEq(t, `{"create":{"_index":"traces-sampled-testing"}}`, lines[0])
+
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(lines[1]), &doc))
+			assert.Equal(t, map[string]interface{}{"id": "local-apm-server"}, doc["observer"])
+			assert.Equal(t, map[string]interface{}{"id": "0102030405060708090a0b0c0d0e0f10"}, doc["trace"])
+		})
+	}
+}
+
+func TestProcessPublishMetrics(t *testing.T) {
+	processTrace := func(t *testing.T, processor *sampling.Processor, traceID string) {
+		in := model.Batch{{
+			Processor: model.TransactionProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{
+				ID:      traceID,
+				Sampled: true,
+			},
+		}}
+		err := processor.ProcessBatch(context.Background(), &in)
+		require.NoError(t, err)
+	}
+	waitForMetric := func(t *testing.T, processor *sampling.Processor, name string) monitoring.FlatSnapshot {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			snapshot := collectProcessorMetrics(processor)
+			if snapshot.Ints[name] != 0 {
+				return snapshot
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("indexed", func(t *testing.T) {
+		config := newTempdirConfig(t)
+		config.Policies = []sampling.Policy{{SampleRate: 1}}
+		config.FlushInterval = 10 * time.Millisecond
+		processor, err := sampling.NewProcessor(config)
+		require.NoError(t, err)
+		go processor.Run()
+		defer processor.Stop(context.Background())
+
+		processTrace(t, processor, "trace1")
+		snapshot := waitForMetric(t, processor, "sampling.publish.indexed")
+		assert.Equal(t, int64(1), snapshot.Ints["sampling.publish.indexed"])
+		assert.NotZero(t, snapshot.Ints["sampling.publish.bytes"])
+		assert.Zero(t, snapshot.Ints["sampling.publish.failed.4xx"])
+		assert.Zero(t, snapshot.Ints["sampling.publish.failed.5xx"])
+		assert.Zero(t, snapshot.Ints["sampling.publish.failed.other"])
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		var bulkRequests int64
+		config := newTempdirConfig(t)
+		config.Policies = []sampling.Policy{{SampleRate: 1}}
+		config.FlushInterval = 10 * time.Millisecond
+		config.Elasticsearch = &bulkErrorClient{Client: pubsubtest.Client(nil, nil), requests: &bulkRequests}
+		processor, err := sampling.NewProcessor(config)
+		require.NoError(t, err)
+		go processor.Run()
+		defer processor.Stop(context.Background())
+
+		processTrace(t, processor, "trace1")
+		snapshot := waitForMetric(t, processor, "sampling.publish.failed.5xx")
+		assert.Equal(t, int64(1), snapshot.Ints["sampling.publish.failed.5xx"])
+		assert.Zero(t, snapshot.Ints["sampling.publish.indexed"])
+		assert.Zero(t, snapshot.Ints["sampling.publish.failed.4xx"])
+		assert.Zero(t, snapshot.Ints["sampling.publish.failed.other"])
+	})
+
+	t.Run("retried", func(t *testing.T) {
+		var bulkRequests int64
+		config := newTempdirConfig(t)
+		config.Policies = []sampling.Policy{{SampleRate: 1}}
+		config.FlushInterval = 10 * time.Millisecond
+		config.Elasticsearch = &bulkErrorClient{Client: pubsubtest.Client(nil, nil), requests: &bulkRequests}
+		config.PublishMaxRetries = 2
+		config.PublishRetryBackoff = time.Millisecond
+		config.PublishRetryJitter = 0.5
+		processor, err := sampling.NewProcessor(config)
+		require.NoError(t, err)
+		go processor.Run()
+		defer processor.Stop(context.Background())
+
+		// The request is retried twice, and then fails.
+		processTrace(t, processor, "trace1")
+		snapshot := waitForMetric(t, processor, "sampling.publish.failed.5xx")
+		assert.Equal(t, int64(1), snapshot.Ints["sampling.publish.failed.5xx"])
+		assert.Equal(t, int64(2), snapshot.Ints["sampling.publish.retries"])
+		assert.Equal(t, int64(3), atomic.LoadInt64(&bulkRequests))
+	})
+}
+
+// bulkErrorClient is an elasticsearch.Client which responds to bulk
+// requests with a 500 (Internal Server Error) response.
+type bulkErrorClient struct {
+	elasticsearch.Client
+	requests *int64
+}
+
+func (c *bulkErrorClient) Perform(r *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		return c.Client.Perform(r)
+	}
+	atomic.AddInt64(c.requests, 1)
+	return &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Header:     http.Header{"X-Elastic-Product": []string{"Elasticsearch"}},
+		Body:       io.NopCloser(strings.NewReader(`{"error":"internal"}`)),
+	}, nil
+}
+
+func TestProcessorLag(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.FlushInterval = 100 * time.Millisecond
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	assert.Zero(t, processor.Lag())
+
+	batch := model.Batch{{
+		Processor:   model.TransactionProcessor,
+		Trace:       model.Trace{ID: "trace"},
+		Transaction: &model.Transaction{ID: "transaction", Sampled: true},
+	}}
+	err = processor.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	assert.Empty(t, batch)
+
+	// The root transaction is waiting for its reservoir to be finalized.
+	time.Sleep(10 * time.Millisecond)
+	assert.GreaterOrEqual(t, processor.Lag(), 10*time.Millisecond)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+	assert.Eventually(t, func() bool {
+		return processor.Lag() == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestProcessorInitialized(t *testing.T) {
+	config := newTempdirConfig(t)
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	select {
+	case <-processor.Initialized():
+		t.Fatal("processor initialized before running")
+	default:
+	}
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+	select {
+	case <-processor.Initialized():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for processor to be initialized")
+	}
+}
+
+func TestProcessOutcomeTTLs(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
+	config.TTL = time.Second
+	config.OutcomeTTLs = map[string]time.Duration{"failure": time.Hour}
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeSpan := func(traceID, outcome string) model.APMEvent {
+		return model.APMEvent{
+			Processor: model.SpanProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Event:     model.Event{Outcome: outcome},
+			Span:      &model.Span{ID: "0102030405060709"},
+		}
+	}
+	successSpan := makeSpan("0102030405060708090a0b0c0d0e0f10", "success")
+	failureSpan := makeSpan("0102030405060708090a0b0c0d0e0f11", "failure")
+	batch := model.Batch{successSpan, failureSpan}
+	err = processor.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	assert.Empty(t, batch)
+	assert.NoError(t, config.Storage.Flush(0))
+
+	// Wait for the global TTL to elapse. Badger expiry has a resolution
+	// of one second, so wait for two.
+	time.Sleep(2 * time.Second)
+
+	reader := eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewReadWriter()
+	defer reader.Close()
+	batch = nil
+	assert.NoError(t, reader.ReadTraceEvents(successSpan.Trace.ID, &batch))
+	assert.Empty(t, batch)
+	assert.NoError(t, reader.ReadTraceEvents(failureSpan.Trace.ID, &batch))
+	assert.Equal(t, model.Batch{failureSpan}, batch)
+}
+
+func TestProcessAsyncStorageWrites(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.StorageWriteWorkers = 2
+	config.StorageWriteQueueSize = 4
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+
+	var batch model.Batch
+	for i := 0; i < 10; i++ {
+		batch = append(batch, model.APMEvent{
+			Processor: model.SpanProcessor,
+			Trace:     model.Trace{ID: fmt.Sprintf("trace%d", i%3)},
+			Event:     model.Event{Duration: 123 * time.Millisecond},
+			Span:      &model.Span{ID: fmt.Sprintf("span%d", i)},
+		})
+	}
+	in := batch
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	// Events are copied before being queued, so modifying them
+	// does not affect what is written to storage.
+	expected := make(model.Batch, len(batch))
+	copy(expected, batch)
+	for i := range batch {
+		batch[i].Event.Duration = 0
+	}
+
+	// Stopping the processor waits for queued writes to be performed.
+	assert.NoError(t, processor.Stop(context.Background()))
+	assert.NoError(t, config.Storage.Flush(0))
+
+	reader := eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewReadWriter()
+	defer reader.Close()
+	var stored model.Batch
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, reader.ReadTraceEvents(fmt.Sprintf("trace%d", i), &stored))
+	}
+	assert.ElementsMatch(t, expected, stored)
+
+	// Events processed after the processor is stopped cannot be
+	// stored, and are indexed by default.
+	in = model.Batch{expected[0]}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Len(t, in, 1)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.storage.write_queue.depth"] = 0
+	expectedMonitoring.Ints["sampling.storage.write_queue.dropped"] = 0
+	expectedMonitoring.Ints["sampling.storage.write_queue.written_after_decision"] = 0
+	expectedMonitoring.Ints["sampling.events.failed_writes"] = 1
+	// The storage delay is recorded for the queued writes once performed,
+	// and not for the event which failed to be queued.
+	expectedMonitoring.Ints["sampling.storage_delay.count"] = 10
+	assertMonitoring(t, processor, expectedMonitoring,
+		`sampling.storage.write_queue.*`, `sampling.events.failed_writes`, `sampling.storage_delay.count`,
+	)
+}
+
+func TestProcessStoredLabelsLimit(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.StoredLabelsLimit = 1
+	config.PreservedLabels = []string{"important"}
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	span := model.APMEvent{
+		Processor: model.SpanProcessor,
+		Trace:     model.Trace{ID: "0102030405060708090a0b0c0d0e0f10"},
+		Span:      &model.Span{ID: "0102030405060709"},
+		Labels: model.Labels{
+			"a":         {Value: "a"},
+			"important": {Value: "b"},
+		},
+		NumericLabels: model.NumericLabels{"c": {Value: 1}},
+	}
+	in := model.Batch{span}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.Empty(t, in)
+
+	// Only the preserved label is stored.
+	assert.NoError(t, config.Storage.Flush(0))
+	reader := eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewReadWriter()
+	defer reader.Close()
+	var stored model.Batch
+	assert.NoError(t, reader.ReadTraceEvents(span.Trace.ID, &stored))
+	require.Len(t, stored, 1)
+	assert.Equal(t, model.Labels{"important": {Value: "b"}}, stored[0].Labels)
+	assert.Empty(t, stored[0].NumericLabels)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.storage.labels.truncated_events"] = 1
+	expectedMonitoring.Ints["sampling.storage.labels.dropped"] = 2
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.storage.labels.*`)
+}
+
+func TestProcessTraceIDLists(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
+	config.TraceIDAllowList = []string{"0102030405060708090a0b0c0d0e0f10", "AAAA*"}
+	config.TraceIDDenyList = []string{"0102030405060708090a0b0c0d0e0f10", "bbbb*"}
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeEvents := func(traceID string) model.Batch {
+		trace := model.Trace{ID: traceID}
+		return model.Batch{{
+			Processor:   model.TransactionProcessor,
+			Trace:       trace,
+			Transaction: &model.Transaction{ID: "0102030405060708", Sampled: true},
+		}, {
+			Processor: model.SpanProcessor,
+			Trace:     trace,
+			Span:      &model.Span{ID: "0102030405060709"},
+		}}
+	}
+	allowed := append(makeEvents("0102030405060708090a0b0c0d0e0f10"), makeEvents("aaaa030405060708090a0b0c0d0e0f10")...)
+	in := append(allowed[:len(allowed):len(allowed)], makeEvents("bbbb030405060708090a0b0c0d0e0f10")...)
+	in = append(in, makeEvents("cccc030405060708090a0b0c0d0e0f10")...)
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, allowed, in)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.events.processed"] = 8
+	expectedMonitoring.Ints["sampling.events.stored"] = 2
+	expectedMonitoring.Ints["sampling.events.sampled"] = 0
+	expectedMonitoring.Ints["sampling.events.head_unsampled"] = 0
+	expectedMonitoring.Ints["sampling.events.dropped"] = 2
+	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	expectedMonitoring.Ints["sampling.events.bypassed"] = 0
+	expectedMonitoring.Ints["sampling.events.finalized"] = 0
+	expectedMonitoring.Floats["sampling.events.finalized_ratio"] = 0
+	expectedMonitoring.Ints["sampling.trace_id_lists.allowed"] = 4
+	expectedMonitoring.Ints["sampling.trace_id_lists.denied"] = 2
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`, `sampling.trace_id_lists.*`)
+}
+
+func TestProcessMissingTraceID(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeEvents := func(serviceName, traceID string) model.Batch {
+		service := model.Service{Name: serviceName}
+		trace := model.Trace{ID: traceID}
+		return model.Batch{{
+			Processor:   model.TransactionProcessor,
+			Service:     service,
+			Trace:       trace,
+			Transaction: &model.Transaction{ID: "0102030405060708", Sampled: true},
+		}, {
+			Processor: model.SpanProcessor,
+			Service:   service,
+			Trace:     trace,
+			Span:      &model.Span{ID: "0102030405060709"},
+		}}
+	}
+	// Events without a trace ID are reported, as they cannot be
+	// tail-sampled, and counted by service name if available.
+	missing := append(makeEvents("a", ""), makeEvents("", "")...)
+	in := append(missing[:len(missing):len(missing)], makeEvents("a", "0102030405060708090a0b0c0d0e0f10")...)
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, missing, in)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.events.processed"] = 6
+	expectedMonitoring.Ints["sampling.events.stored"] = 2
+	expectedMonitoring.Ints["sampling.events.sampled"] = 0
+	expectedMonitoring.Ints["sampling.events.head_unsampled"] = 0
+	expectedMonitoring.Ints["sampling.events.dropped"] = 0
+	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	expectedMonitoring.Ints["sampling.events.bypassed"] = 0
+	expectedMonitoring.Ints["sampling.events.finalized"] = 0
+	expectedMonitoring.Floats["sampling.events.finalized_ratio"] = 0
+	expectedMonitoring.Ints["sampling.missing_trace_id.events"] = 4
+	expectedMonitoring.Ints["sampling.missing_trace_id.services.a"] = 2
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`, `sampling.missing_trace_id.*`)
+}
+
+func TestProcessBypassServices(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
+	config.BypassServices = []string{"critical"}
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	makeEvents := func(serviceName, traceID string) model.Batch {
+		service := model.Service{Name: serviceName}
+		trace := model.Trace{ID: traceID}
+		return model.Batch{{
+			Processor:   model.TransactionProcessor,
+			Service:     service,
+			Trace:       trace,
+			Transaction: &model.Transaction{ID: "0102030405060708", Sampled: true},
+		}, {
+			Processor: model.SpanProcessor,
+			Service:   service,
+			Trace:     trace,
+			Span:      &model.Span{ID: "0102030405060709"},
+		}}
 	}
+	bypassed := makeEvents("critical", "0102030405060708090a0b0c0d0e0f10")
+	in := append(bypassed[:len(bypassed):len(bypassed)], makeEvents("other", "0102030405060708090a0b0c0d0e0f11")...)
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, bypassed, in)
 
-	// Stop the processor so we can access the database.
-	assert.NoError(t, processor.Stop(context.Background()))
+	// Bypassed events are not stored.
 	assert.NoError(t, config.Storage.Flush(0))
-	storage := eventstorage.New(config.DB, eventstorage.JSONCodec{})
-	reader := storage.NewReadWriter()
+	reader := eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewReadWriter()
 	defer reader.Close()
+	var batch model.Batch
+	err = reader.ReadTraceEvents("0102030405060708090a0b0c0d0e0f10", &batch)
+	assert.NoError(t, err)
+	assert.Empty(t, batch)
 
-	var anyUnsampled bool
-	for _, traceID := range traceIDs {
-		sampled, err := reader.IsTraceSampled(traceID)
-		if err == eventstorage.ErrNotFound {
-			// No sampling decision made yet.
-		} else {
-			assert.NoError(t, err)
-			if !sampled {
-				anyUnsampled = true
-				break
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.events.processed"] = 4
+	expectedMonitoring.Ints["sampling.events.stored"] = 2
+	expectedMonitoring.Ints["sampling.events.sampled"] = 0
+	expectedMonitoring.Ints["sampling.events.head_unsampled"] = 0
+	expectedMonitoring.Ints["sampling.events.dropped"] = 0
+	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	expectedMonitoring.Ints["sampling.events.bypassed"] = 2
+	expectedMonitoring.Ints["sampling.events.finalized"] = 0
+	expectedMonitoring.Floats["sampling.events.finalized_ratio"] = 0
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`)
+}
+
+func TestProcessTraceIDCollision(t *testing.T) {
+	for _, test := range []struct {
+		policy         string
+		expectReported bool
+		expectDropped  int64
+	}{
+		// By default, the colliding root transaction is merged into the
+		// existing trace, and so follows its decision to drop the trace.
+		{policy: "", expectReported: false},
+		{policy: "merge", expectReported: false},
+		{policy: "separate", expectReported: true},
+		{policy: "drop", expectReported: false, expectDropped: 1},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			config := newTempdirConfig(t)
+			config.Policies = []sampling.Policy{
+				{PolicyCriteria: sampling.PolicyCriteria{ServiceName: "service_b"}, SampleRate: 1},
+				{SampleRate: 0},
 			}
-		}
+			config.TraceIDCollisionPolicy = test.policy
+			processor, err := sampling.NewProcessor(config)
+			require.NoError(t, err)
+
+			// Two services generate the same trace ID for their root
+			// transactions. The first root transaction is dropped.
+			traceID := "0102030405060708090a0b0c0d0e0f10"
+			makeRoot := func(serviceName, transactionID string) model.Batch {
+				return model.Batch{{
+					Processor:   model.TransactionProcessor,
+					Service:     model.Service{Name: serviceName},
+					Trace:       model.Trace{ID: traceID},
+					Transaction: &model.Transaction{ID: transactionID, Sampled: true},
+				}}
+			}
+			for i := 0; i < 2; i++ {
+				// The same root transaction received again does not collide.
+				batch := makeRoot("service_a", "0102030405060708")
+				require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+				assert.Empty(t, batch)
+			}
+
+			colliding := makeRoot("service_b", "0102030405060709")
+			batch := append(model.Batch{}, colliding...)
+			require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+			if test.expectReported {
+				assert.Equal(t, colliding, batch)
+			} else {
+				assert.Empty(t, batch)
+			}
+
+			expectedMonitoring := monitoring.MakeFlatSnapshot()
+			expectedMonitoring.Ints["sampling.trace_id_collisions.detected"] = 1
+			expectedMonitoring.Ints["sampling.trace_id_collisions.dropped"] = test.expectDropped
+			assertMonitoring(t, processor, expectedMonitoring, `sampling.trace_id_collisions.*`)
+		})
 	}
-	assert.True(t, anyUnsampled)
 }
 
-func TestProcessLocalTailSamplingPolicyOrder(t *testing.T) {
+func TestProcessCompletedTraces(t *testing.T) {
+	recorder := pubsubtest.NewRecorder(nil)
 	config := newTempdirConfig(t)
-	config.Policies = []sampling.Policy{{
-		PolicyCriteria: sampling.PolicyCriteria{TraceName: "trace_name"},
-		SampleRate:     0.5,
-	}, {
-		PolicyCriteria: sampling.PolicyCriteria{ServiceName: "service_name"},
-		SampleRate:     0.1,
-	}, {
-		PolicyCriteria: sampling.PolicyCriteria{},
-		SampleRate:     0,
-	}}
+	config.Policies = []sampling.Policy{
+		{PolicyCriteria: sampling.PolicyCriteria{ServiceName: "unsampled"}, SampleRate: 0},
+		{SampleRate: 1},
+	}
 	config.FlushInterval = 10 * time.Millisecond
-	published := make(chan string)
-	config.Elasticsearch = pubsubtest.Client(pubsubtest.PublisherChan(published), nil)
-
+	config.Elasticsearch = recorder.Client()
+	config.TraceCompleted = func(event *model.APMEvent) bool {
+		return event.Labels["trace_complete"].Value == "true"
+	}
 	processor, err := sampling.NewProcessor(config)
 	require.NoError(t, err)
 
-	// Send transactions which would match either policy defined above.
-	rng := rand.New(rand.NewSource(0))
-	service := model.Service{Name: "service_name"}
-	numTransactions := 100
-	events := make(model.Batch, numTransactions)
-	for i := range events {
-		var traceIDBytes [16]byte
-		_, err := rng.Read(traceIDBytes[:])
-		require.NoError(t, err)
-		events[i] = model.APMEvent{
+	makeEvents := func(serviceName, traceID string) (model.APMEvent, model.APMEvent) {
+		service := model.Service{Name: serviceName}
+		trace := model.Trace{ID: traceID}
+		return model.APMEvent{
+			Processor: model.SpanProcessor,
 			Service:   service,
-			Processor: model.TransactionProcessor,
-			Trace:     model.Trace{ID: fmt.Sprintf("%x", traceIDBytes[:])},
-			Event:     model.Event{Duration: 123 * time.Millisecond},
-			Transaction: &model.Transaction{
-				Name:    "trace_name",
-				ID:      fmt.Sprintf("%x", traceIDBytes[8:]),
-				Sampled: true,
-			},
+			Trace:     trace,
+			Span:      &model.Span{ID: "0102030405060709"},
+		}, model.APMEvent{
+			Processor:   model.TransactionProcessor,
+			Service:     service,
+			Trace:       trace,
+			Labels:      model.Labels{"trace_complete": {Value: "true"}},
+			Transaction: &model.Transaction{ID: "0102030405060708", Sampled: true},
 		}
 	}
+	sampledSpan, sampledTransaction := makeEvents("sampled", "0102030405060708090a0b0c0d0e0f10")
+	unsampledSpan, unsampledTransaction := makeEvents("unsampled", "0102030405060708090a0b0c0d0e0f11")
 
-	err = processor.ProcessBatch(context.Background(), &events)
+	in := model.Batch{sampledSpan, unsampledSpan}
+	err = processor.ProcessBatch(context.Background(), &in)
 	require.NoError(t, err)
-	assert.Empty(t, events)
+	assert.Empty(t, in)
 
-	// Start periodic tail-sampling. We start the processor after processing
-	// events to ensure all events are processed before any local sampling
-	// decisions are made, such that we have a single tail-sampling decision
-	// to check.
+	// Completed traces are decided immediately, without waiting for
+	// the reservoirs to be finalized: the root transaction and stored
+	// events of sampled traces are reported, and the rest dropped.
+	in = model.Batch{sampledTransaction, unsampledTransaction}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, model.Batch{sampledTransaction, sampledSpan}, in)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.completed_traces.total"] = 2
+	expectedMonitoring.Ints["sampling.completed_traces.sampled"] = 1
+	expectedMonitoring.Ints["sampling.events.sampled"] = 2
+	expectedMonitoring.Ints["sampling.events.finalized"] = 1
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.completed_traces.*`,
+		`sampling.events.sampled`, `sampling.events.finalized`,
+	)
+
+	// The sampling decisions for completed traces are published to
+	// other APM Servers when the reservoirs are next finalized.
 	go processor.Run()
 	defer processor.Stop(context.Background())
+	assert.Eventually(t, func() bool {
+		return recorder.Count() == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"0102030405060708090a0b0c0d0e0f10"}, recorder.TraceIDs())
+}
 
-	// The first matching policy should win, and sample 50%.
-	for i := 0; i < numTransactions/2; i++ {
-		select {
-		case <-published:
-		case <-time.After(10 * time.Second):
-			t.Fatal("timed out waiting for publication")
-		}
+func TestProcessAuditLog(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{
+		{Name: "unsampled", PolicyCriteria: sampling.PolicyCriteria{ServiceName: "unsampled"}, SampleRate: 0},
+		{SampleRate: 1},
 	}
-	select {
-	case <-published:
-		t.Fatal("unexpected publication")
-	case <-time.After(50 * time.Millisecond):
+	config.FlushInterval = 10 * time.Millisecond
+	config.AuditLogPath = filepath.Join(t.TempDir(), "audit")
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	in := model.Batch{{
+		Processor:   model.TransactionProcessor,
+		Service:     model.Service{Name: "sampled"},
+		Trace:       model.Trace{ID: "0102030405060708090a0b0c0d0e0f10"},
+		Transaction: &model.Transaction{ID: "0102030405060708", Sampled: true},
+	}, {
+		Processor:   model.TransactionProcessor,
+		Service:     model.Service{Name: "unsampled"},
+		Trace:       model.Trace{ID: "0102030405060708090a0b0c0d0e0f11"},
+		Transaction: &model.Transaction{ID: "0102030405060709", Sampled: true},
+	}}
+	err = processor.ProcessBatch(context.Background(), &in)
+	require.NoError(t, err)
+
+	// Decisions are written to the audit log when the reservoirs are
+	// finalized, including the immediate decision to drop the trace
+	// matching the "unsampled" policy.
+	go processor.Run()
+	defer processor.Stop(context.Background())
+	assert.Eventually(t, func() bool {
+		return collectProcessorMetrics(processor).Ints["sampling.audit_log.written"] == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.NoError(t, processor.Stop(context.Background()))
+
+	files, err := filepath.Glob(config.AuditLogPath + "-*.ndjson")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+
+	type record struct {
+		Timestamp time.Time `json:"@timestamp"`
+		TraceID   string    `json:"trace.id"`
+		Decision  string    `json:"decision"`
+		Policy    string    `json:"policy"`
 	}
+	var records []record
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	for decoder.More() {
+		var r record
+		require.NoError(t, decoder.Decode(&r))
+		assert.False(t, r.Timestamp.IsZero())
+		r.Timestamp = time.Time{}
+		records = append(records, r)
+	}
+	assert.Equal(t, []record{{
+		TraceID:  "0102030405060708090a0b0c0d0e0f11",
+		Decision: "dropped",
+		Policy:   "unsampled",
+	}, {
+		TraceID:  "0102030405060708090a0b0c0d0e0f10",
+		Decision: "sampled",
+		Policy:   "1", // unnamed policies are identified by index
+	}}, records)
+	assert.Equal(t, int64(0), collectProcessorMetrics(processor).Ints["sampling.audit_log.failed"])
 }
 
 func TestProcessRemoteTailSampling(t *testing.T) {
@@ -466,6 +2398,9 @@ func TestProcessRemoteTailSampling(t *testing.T) {
 	expectedMonitoring.Ints["sampling.events.head_unsampled"] = 0
 	expectedMonitoring.Ints["sampling.events.dropped"] = 0
 	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	expectedMonitoring.Ints["sampling.events.bypassed"] = 0
+	expectedMonitoring.Ints["sampling.events.finalized"] = 1
+	expectedMonitoring.Floats["sampling.events.finalized_ratio"] = 1
 	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`)
 
 	assert.Equal(t, trace1Events, events)
@@ -520,13 +2455,18 @@ func TestGroupsMonitoring(t *testing.T) {
 
 	expectedMonitoring := monitoring.MakeFlatSnapshot()
 	expectedMonitoring.Ints["sampling.dynamic_service_groups"] = int64(config.MaxDynamicServices)
+	expectedMonitoring.Ints["sampling.dynamic_service_groups_evicted"] = 0
+	expectedMonitoring.Ints["sampling.dynamic_service_groups_rejected"] = 1
 	expectedMonitoring.Ints["sampling.events.processed"] = int64(config.MaxDynamicServices) + 2
 	expectedMonitoring.Ints["sampling.events.stored"] = int64(config.MaxDynamicServices)
 	expectedMonitoring.Ints["sampling.events.dropped"] = 1 // final event dropped, after service limit reached
 	expectedMonitoring.Ints["sampling.events.sampled"] = 0
 	expectedMonitoring.Ints["sampling.events.head_unsampled"] = 1
 	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
-	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`, `sampling.dynamic_service_groups`)
+	expectedMonitoring.Ints["sampling.events.bypassed"] = 0
+	expectedMonitoring.Ints["sampling.events.finalized"] = 0
+	expectedMonitoring.Floats["sampling.events.finalized_ratio"] = 0
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.events.*`, `sampling.dynamic_service_groups*`)
 }
 
 func TestStorageMonitoring(t *testing.T) {
@@ -552,6 +2492,19 @@ func TestStorageMonitoring(t *testing.T) {
 		assert.Empty(t, batch)
 	}
 
+	metrics := collectProcessorMetrics(processor)
+	assert.Equal(t, int64(100), metrics.Ints["sampling.storage.write_latency.count"])
+	assert.Contains(t, metrics.Ints, "sampling.storage.write_latency.p50_us")
+	assert.Contains(t, metrics.Ints, "sampling.storage.write_latency.p95_us")
+	assert.Contains(t, metrics.Ints, "sampling.storage.write_latency.p99_us")
+
+	// Events are received and written to storage synchronously, so the
+	// storage delay is recorded for each of them.
+	assert.Equal(t, int64(100), metrics.Ints["sampling.storage_delay.count"])
+	assert.Contains(t, metrics.Ints, "sampling.storage_delay.p50_us")
+	assert.Contains(t, metrics.Ints, "sampling.storage_delay.p95_us")
+	assert.Contains(t, metrics.Ints, "sampling.storage_delay.p99_us")
+
 	// Stop the processor and create a new one, which will reopen storage
 	// and calculate the storage size. Otherwise we must wait for a minute
 	// (hard-coded in badger) for storage metrics to be updated.
@@ -559,11 +2512,68 @@ func TestStorageMonitoring(t *testing.T) {
 	processor, err = sampling.NewProcessor(config)
 	require.NoError(t, err)
 
-	metrics := collectProcessorMetrics(processor)
+	metrics = collectProcessorMetrics(processor)
 	assert.NotZero(t, metrics.Ints, "sampling.storage.lsm_size")
 	assert.NotZero(t, metrics.Ints, "sampling.storage.value_log_size")
 }
 
+func TestStorageDiagnostics(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.StorageLimit = 10 << 20
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	diagnostics := processor.StorageDiagnostics()
+	assert.Zero(t, diagnostics.Keys)
+	assert.Zero(t, diagnostics.Traces)
+	assert.Zero(t, diagnostics.OldestTraceAge)
+	assert.Equal(t, uint64(10<<20), diagnostics.Limit)
+
+	for i := 0; i < 10; i++ {
+		traceID := uuid.Must(uuid.NewV4()).String()
+		batch := model.Batch{{
+			Processor:   model.TransactionProcessor,
+			Trace:       model.Trace{ID: traceID},
+			Event:       model.Event{Duration: 123 * time.Millisecond},
+			Transaction: &model.Transaction{ID: traceID, Sampled: true},
+		}, {
+			Processor: model.SpanProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Span:      &model.Span{ID: traceID + "_span"},
+		}}
+		err := processor.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+		assert.Empty(t, batch)
+	}
+	require.NoError(t, config.Storage.Flush(0))
+
+	// The key count is reused for a minute, so it is not yet updated.
+	diagnostics = processor.StorageDiagnostics()
+	assert.Zero(t, diagnostics.Keys)
+	assert.Equal(t, 10, diagnostics.Traces)
+	assert.NotZero(t, diagnostics.OldestTraceAge)
+
+	// A new processor counts the keys afresh.
+	processor, err = sampling.NewProcessor(config)
+	require.NoError(t, err)
+	diagnostics = processor.StorageDiagnostics()
+	assert.Equal(t, uint64(20), diagnostics.Keys)
+	assert.Zero(t, diagnostics.Traces)
+	size := diagnostics.LSMSize + diagnostics.ValueLogSize
+	assert.Equal(t, float64(size)/float64(10<<20), diagnostics.LimitUsage)
+
+	registry := monitoring.NewRegistry()
+	monitoring.NewFunc(registry, "tail_storage", processor.CollectStorageDiagnostics)
+	metrics := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, int64(20), metrics.Ints["tail_storage.keys"])
+	assert.Equal(t, int64(0), metrics.Ints["tail_storage.traces"])
+	assert.Equal(t, int64(0), metrics.Ints["tail_storage.oldest_trace_age_ms"])
+	assert.Equal(t, int64(10<<20), metrics.Ints["tail_storage.limit"])
+	assert.Contains(t, metrics.Ints, "tail_storage.lsm_size")
+	assert.Contains(t, metrics.Ints, "tail_storage.value_log_size")
+	assert.Contains(t, metrics.Floats, "tail_storage.limit_usage")
+}
+
 func TestStorageGC(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping slow test")
@@ -632,13 +2642,18 @@ func TestStorageGC(t *testing.T) {
 	go processor.Run()
 	defer processor.Stop(context.Background())
 
-	// Wait for the first value log file to be garbage collected.
+	// Wait for the first value log file to be garbage collected,
+	// and for the reclaimed space to be reported.
 	deadline := time.Now().Add(10 * time.Second)
 	for time.Now().Before(deadline) {
 		vlogs := vlogFilenames()
 		if len(vlogs) == 0 || vlogs[0] != "000000.vlog" {
 			// garbage collected
-			return
+			metrics := collectProcessorMetrics(processor)
+			if metrics.Ints["sampling.storage.gc.reclaimed_bytes"] > 0 {
+				assert.NotZero(t, metrics.Ints["sampling.storage.gc.runs"])
+				return
+			}
 		}
 		time.Sleep(10 * time.Millisecond)
 	}
@@ -689,25 +2704,198 @@ func TestStorageLimit(t *testing.T) {
 	config.DB, err = eventstorage.OpenBadger(config.StorageDir, 1024*1024)
 	require.NoError(t, err)
 	t.Cleanup(func() { config.DB.Close() })
+	config.Storage = eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	t.Cleanup(func() { config.Storage.Close() })
 
 	lsm, vlog := config.DB.Size()
 	assert.GreaterOrEqual(t, lsm+vlog, int64(1024))
 
 	config.StorageLimit = 1024 // Set the storage limit to 1024 bytes.
-	// Create a massive 150K span batch (per CPU) to trigger the badger error
-	// Transaction too big, causing the ProcessBatch to report the some traces
-	// immediately.
-	// Rather than setting a static threshold, use the runtime.NumCPU as a
-	// multiplier since the sharded writers use that variable and the more CPUs
-	// we have, the more sharded writes we'll have, resulting in a greater buffer.
-	processor := writeBatch(150_000*runtime.NumCPU(), config, func(b model.Batch) {
-		assert.NotEmpty(t, b)
+	// Once the storage limit is reached, events of traces without a sampling
+	// decision are not stored, and are instead reported immediately.
+	processor := writeBatch(1000, config, func(b model.Batch) {
+		assert.Len(t, b, 1000)
+	})
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Bools["sampling.storage.at_limit"] = true
+	expectedMonitoring.Ints["sampling.storage.limit_reached.events"] = 1000
+	expectedMonitoring.Ints["sampling.storage.limit_reached.traces"] = 0
+	expectedMonitoring.Ints["sampling.events.stored"] = 0
+	expectedMonitoring.Ints["sampling.events.dropped"] = 0
+	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	assertMonitoring(t, processor, expectedMonitoring,
+		`sampling.storage.at_limit`, `sampling.storage.limit_reached.*`,
+		`sampling.events.stored`, `sampling.events.dropped`, `sampling.events.failed_writes`,
+	)
+
+	// If configured, the events are dropped instead.
+	config.DropOnStorageLimit = true
+	processor = writeBatch(1000, config, func(b model.Batch) {
+		assert.Empty(t, b)
 	})
+	expectedMonitoring.Ints["sampling.events.dropped"] = 1000
+	assertMonitoring(t, processor, expectedMonitoring,
+		`sampling.storage.at_limit`, `sampling.storage.limit_reached.*`,
+		`sampling.events.stored`, `sampling.events.dropped`, `sampling.events.failed_writes`,
+	)
+}
+
+func TestStorageLimitThreshold(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test")
+	}
+
+	config := newTempdirConfig(t)
+	fillStorage(t, &config)
+
+	// Writes are rejected once 90% of the storage limit is reached, so
+	// events are treated as being at the storage limit, rather than as
+	// failed writes, while storage is between 90% and 100% of the limit.
+	lsm, vlog := config.DB.Size()
+	config.StorageLimit = uint64(float64(lsm+vlog) / 0.95)
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	batch := newSpanBatch(1000)
+	require.NoError(t, processor.ProcessBatch(context.Background(), batch))
+	assert.Len(t, *batch, 1000)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Bools["sampling.storage.at_limit"] = true
+	expectedMonitoring.Ints["sampling.storage.limit_reached.events"] = 1000
+	expectedMonitoring.Ints["sampling.storage.limit_reached.traces"] = 0
+	expectedMonitoring.Ints["sampling.events.stored"] = 0
+	expectedMonitoring.Ints["sampling.events.failed_writes"] = 0
+	assertMonitoring(t, processor, expectedMonitoring,
+		`sampling.storage.at_limit`, `sampling.storage.limit_reached.*`,
+		`sampling.events.stored`, `sampling.events.failed_writes`,
+	)
+}
+
+func TestStorageLimitThresholdFinalizeEarly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test")
+	}
+
+	config := newTempdirConfig(t)
+	fillStorage(t, &config)
 
-	failedWrites := collectProcessorMetrics(processor).Ints["sampling.events.failed_writes"]
-	t.Log(failedWrites)
-	// Ensure that there are some failed writes.
-	assert.GreaterOrEqual(t, failedWrites, int64(1))
+	// Reaching 90% of the storage limit, at which writes are rejected,
+	// finalizes the reservoirs early.
+	lsm, vlog := config.DB.Size()
+	config.StorageLimit = uint64(float64(lsm+vlog) / 0.92)
+	config.FinalizeOnStorageLimit = true
+	config.FlushInterval = time.Minute
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	batch := model.Batch{{
+		Processor:   model.TransactionProcessor,
+		Trace:       model.Trace{ID: "trace"},
+		Transaction: &model.Transaction{ID: "transaction", Sampled: true},
+	}}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Len(t, batch, 1)
+	assert.Eventually(t, func() bool {
+		snapshot := collectProcessorMetrics(processor)
+		return snapshot.Ints["sampling.storage.limit_reached.finalized_early.runs"] == 1
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// fillStorage writes span events to config's storage, and reopens the
+// database so its size is updated, as in TestStorageLimit.
+func fillStorage(t testing.TB, config *sampling.Config) {
+	processor, err := sampling.NewProcessor(*config)
+	require.NoError(t, err)
+	require.NoError(t, processor.ProcessBatch(context.Background(), newSpanBatch(5000)))
+	assert.NoError(t, config.Storage.Flush(0))
+	config.Storage.Close()
+	assert.NoError(t, config.DB.Close())
+	config.DB, err = eventstorage.OpenBadger(config.StorageDir, 1024*1024)
+	require.NoError(t, err)
+	db := config.DB
+	t.Cleanup(func() { db.Close() })
+	config.Storage = eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	storage := config.Storage
+	t.Cleanup(func() { storage.Close() })
+}
+
+// newSpanBatch returns a batch of n span events, each of a different trace.
+func newSpanBatch(n int) *model.Batch {
+	batch := make(model.Batch, n)
+	for i := range batch {
+		traceID := uuid.Must(uuid.NewV4()).String()
+		batch[i] = model.APMEvent{
+			Processor: model.SpanProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Span:      &model.Span{ID: traceID},
+		}
+	}
+	return &batch
+}
+
+func TestStorageLimitFinalizeEarly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test")
+	}
+
+	// Write span events and reopen the database, so its size is updated,
+	// as in TestStorageLimit.
+	config := newTempdirConfig(t)
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	var batch model.Batch
+	for i := 0; i < 5000; i++ {
+		traceID := uuid.Must(uuid.NewV4()).String()
+		batch = append(batch, model.APMEvent{
+			Processor: model.SpanProcessor,
+			Trace:     model.Trace{ID: traceID},
+			Span:      &model.Span{ID: traceID},
+		})
+	}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.NoError(t, config.Storage.Flush(0))
+	config.Storage.Close()
+	assert.NoError(t, config.DB.Close())
+	config.DB, err = eventstorage.OpenBadger(config.StorageDir, 1024*1024)
+	require.NoError(t, err)
+	t.Cleanup(func() { config.DB.Close() })
+	config.Storage = eventstorage.New(config.DB, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	t.Cleanup(func() { config.Storage.Close() })
+
+	config.StorageLimit = 1024
+	config.FinalizeOnStorageLimit = true
+	config.FlushInterval = time.Minute
+	processor, err = sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Reaching the storage limit finalizes the reservoirs early, once per
+	// quarter flush interval, rather than waiting for the flush interval.
+	for i := 0; i < 3; i++ {
+		batch := model.Batch{{
+			Processor:   model.TransactionProcessor,
+			Trace:       model.Trace{ID: fmt.Sprintf("trace%d", i)},
+			Transaction: &model.Transaction{ID: fmt.Sprintf("transaction%d", i), Sampled: true},
+		}}
+		require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+		assert.Len(t, batch, 1)
+	}
+	assert.Eventually(t, func() bool {
+		snapshot := collectProcessorMetrics(processor)
+		return snapshot.Ints["sampling.storage.limit_reached.finalized_early.runs"] == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Bools["sampling.storage.at_limit"] = true
+	expectedMonitoring.Ints["sampling.storage.limit_reached.events"] = 3
+	expectedMonitoring.Ints["sampling.storage.limit_reached.traces"] = 3
+	expectedMonitoring.Ints["sampling.storage.limit_reached.finalized_early.runs"] = 1
+	expectedMonitoring.Ints["sampling.storage.limit_reached.finalized_early.traces"] = 0
+	assertMonitoring(t, processor, expectedMonitoring,
+		`sampling.storage.at_limit`, `sampling.storage.limit_reached.*`,
+	)
 }
 
 func TestProcessRemoteTailSamplingPersistence(t *testing.T) {
@@ -775,6 +2963,24 @@ func TestGracefulShutdown(t *testing.T) {
 	assert.Equal(t, int(sampleRate*float64(totalTraces)), count)
 }
 
+func TestProcessorIngestRateDecayFactors(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{
+		{PolicyCriteria: sampling.PolicyCriteria{ServiceEnvironment: "production"}, SampleRate: 0.5},
+		{PolicyCriteria: sampling.PolicyCriteria{ServiceEnvironment: "development"}, SampleRate: 0.5},
+		{SampleRate: 0.1},
+	}
+	config.IngestRateDecayFactors = map[string]float64{"production": 0.1, "staging": 0.2}
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	metrics := collectProcessorMetrics(processor)
+	assert.Equal(t, 0.9, metrics.Floats["sampling.ingest_rate_decay.default"])
+	assert.Equal(t, 0.1, metrics.Floats["sampling.ingest_rate_decay.environments.production"])
+	assert.Equal(t, 0.9, metrics.Floats["sampling.ingest_rate_decay.environments.development"])
+	assert.NotContains(t, metrics.Floats, "sampling.ingest_rate_decay.environments.staging")
+}
+
 func newTempdirConfig(tb testing.TB) sampling.Config {
 	tempdir, err := os.MkdirTemp("", "samplingtest")
 	require.NoError(tb, err)
@@ -0,0 +1,203 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package pubsub
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/internal/elasticsearch"
+)
+
+// ErrCircuitOpen is returned for requests which are short-circuited by an
+// open CircuitBreaker.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerState identifies the state of a CircuitBreaker.
+type CircuitBreakerState int
+
+const (
+	// CircuitBreakerClosed is the state of a CircuitBreaker in which
+	// requests are made as usual.
+	CircuitBreakerClosed CircuitBreakerState = iota
+
+	// CircuitBreakerOpen is the state of a CircuitBreaker in which
+	// requests are short-circuited, returning ErrCircuitOpen.
+	CircuitBreakerOpen
+
+	// CircuitBreakerHalfOpen is the state of a CircuitBreaker after its
+	// cooldown has elapsed, in which a single probe request is made. If
+	// the probe succeeds the breaker closes; otherwise it reopens.
+	CircuitBreakerHalfOpen
+)
+
+// String returns the state's name.
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case CircuitBreakerOpen:
+		return "open"
+	case CircuitBreakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker guards requests made to Elasticsearch, short-circuiting
+// them while Elasticsearch is persistently failing.
+//
+// The breaker opens after a threshold of consecutive requests fail, and
+// then short-circuits requests for a cooldown period. After that, the
+// breaker is half-open: a single request is allowed through to probe Elasticsearch,
+// closing the breaker if it succeeds, or reopening it otherwise.
+//
+// A request is considered to have failed if it returns an error, or a
+// response with status 429 (Too Many Requests) or a 5xx status.
+//
+// CircuitBreaker is safe for concurrent use.
+type CircuitBreaker struct {
+	// opened and rejected are accessed atomically,
+	// and must be first for 64-bit alignment.
+	opened   int64
+	rejected int64
+
+	failureThreshold int
+	cooldown         time.Duration
+
+	mu                  sync.Mutex
+	state               CircuitBreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	probing             bool
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+// NewCircuitBreaker returns a new CircuitBreaker, which opens after
+// failureThreshold consecutive failures, for the duration of cooldown.
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration) (*CircuitBreaker, error) {
+	if failureThreshold <= 0 {
+		return nil, errors.New("failureThreshold unspecified or negative")
+	}
+	if cooldown <= 0 {
+		return nil, errors.New("cooldown unspecified or negative")
+	}
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		now:              time.Now,
+	}, nil
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() CircuitBreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitBreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return CircuitBreakerHalfOpen
+	}
+	return b.state
+}
+
+// Opened returns the number of times the breaker has opened.
+func (b *CircuitBreaker) Opened() int64 {
+	return atomic.LoadInt64(&b.opened)
+}
+
+// Rejected returns the number of requests short-circuited by the breaker.
+func (b *CircuitBreaker) Rejected() int64 {
+	return atomic.LoadInt64(&b.rejected)
+}
+
+// allow reports whether a request may be made, and whether the request is
+// a probe made while half-open. If allow returns true, done must be called
+// with the request's outcome.
+func (b *CircuitBreaker) allow() (allowed, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitBreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			break
+		}
+		b.state = CircuitBreakerHalfOpen
+		fallthrough
+	case CircuitBreakerHalfOpen:
+		if b.probing {
+			break
+		}
+		b.probing = true
+		return true, true
+	default:
+		return true, false
+	}
+	atomic.AddInt64(&b.rejected, 1)
+	return false, false
+}
+
+// done records the outcome of a request allowed by allow.
+func (b *CircuitBreaker) done(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.state = CircuitBreakerClosed
+			b.consecutiveFailures = 0
+		}
+		return
+	}
+	if b.state != CircuitBreakerClosed {
+		// The request was made before the breaker opened.
+		return
+	}
+	if !failed {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= b.failureThreshold {
+		b.open()
+	}
+}
+
+// open opens the breaker. open must be called with b.mu held.
+func (b *CircuitBreaker) open() {
+	b.state = CircuitBreakerOpen
+	b.openedAt = b.now()
+	b.consecutiveFailures = 0
+	atomic.AddInt64(&b.opened, 1)
+}
+
+// Client returns an elasticsearch.Client which makes requests through
+// client, guarded by the breaker.
+func (b *CircuitBreaker) Client(client elasticsearch.Client) elasticsearch.Client {
+	return &circuitBreakerClient{Client: client, breaker: b}
+}
+
+type circuitBreakerClient struct {
+	elasticsearch.Client
+	breaker *CircuitBreaker
+}
+
+// Perform makes the request if the breaker allows it, or otherwise
+// returns ErrCircuitOpen.
+func (c *circuitBreakerClient) Perform(r *http.Request) (*http.Response, error) {
+	allowed, probe := c.breaker.allow()
+	if !allowed {
+		return nil, ErrCircuitOpen
+	}
+	resp, err := c.Client.Perform(r)
+	failed := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	c.breaker.done(probe, failed)
+	return resp, err
+}
@@ -0,0 +1,131 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package pubsub
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/elasticsearch"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker, err := NewCircuitBreaker(3, time.Minute)
+	require.NoError(t, err)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	var requests int
+	var status int
+	var performErr error
+	client := breaker.Client(performFunc(func(*http.Request) (*http.Response, error) {
+		requests++
+		if performErr != nil {
+			return nil, performErr
+		}
+		return &http.Response{StatusCode: status}, nil
+	}))
+	perform := func() error {
+		req, _ := http.NewRequest("POST", "/_bulk", nil)
+		_, err := client.Perform(req)
+		return err
+	}
+
+	// Successful requests reset the consecutive failure count.
+	status = http.StatusInternalServerError
+	assert.NoError(t, perform())
+	assert.NoError(t, perform())
+	status = http.StatusOK
+	assert.NoError(t, perform())
+	assert.Equal(t, CircuitBreakerClosed, breaker.State())
+
+	// 4xx responses other than 429 are not considered failures.
+	status = http.StatusBadRequest
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, perform())
+	}
+	assert.Equal(t, CircuitBreakerClosed, breaker.State())
+
+	// The breaker opens after 3 consecutive failures.
+	status = http.StatusTooManyRequests
+	assert.NoError(t, perform())
+	performErr = errors.New("connection refused")
+	assert.Error(t, perform())
+	assert.Error(t, perform())
+	assert.Equal(t, CircuitBreakerOpen, breaker.State())
+	assert.Equal(t, int64(1), breaker.Opened())
+	assert.Equal(t, 11, requests)
+
+	// Requests are short-circuited while the breaker is open.
+	assert.Equal(t, ErrCircuitOpen, perform())
+	now = now.Add(time.Minute - time.Nanosecond)
+	assert.Equal(t, ErrCircuitOpen, perform())
+	assert.Equal(t, 11, requests)
+	assert.Equal(t, int64(2), breaker.Rejected())
+
+	// After the cooldown a failed probe reopens the breaker.
+	now = now.Add(time.Nanosecond)
+	assert.Equal(t, CircuitBreakerHalfOpen, breaker.State())
+	assert.Error(t, perform())
+	assert.Equal(t, 12, requests)
+	assert.Equal(t, CircuitBreakerOpen, breaker.State())
+	assert.Equal(t, int64(2), breaker.Opened())
+	assert.Equal(t, ErrCircuitOpen, perform())
+
+	// After the cooldown a successful probe closes the breaker.
+	now = now.Add(time.Minute)
+	performErr = nil
+	status = http.StatusOK
+	assert.NoError(t, perform())
+	assert.Equal(t, CircuitBreakerClosed, breaker.State())
+	assert.NoError(t, perform())
+	assert.Equal(t, 14, requests)
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	breaker, err := NewCircuitBreaker(1, time.Minute)
+	require.NoError(t, err)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	allowed, probe := breaker.allow()
+	require.True(t, allowed)
+	assert.False(t, probe)
+	breaker.done(probe, true)
+	assert.Equal(t, CircuitBreakerOpen, breaker.State())
+
+	// Only one probe is allowed while half-open.
+	now = now.Add(time.Minute)
+	allowed, probe = breaker.allow()
+	require.True(t, allowed)
+	assert.True(t, probe)
+	allowed, _ = breaker.allow()
+	assert.False(t, allowed)
+
+	breaker.done(true, false)
+	assert.Equal(t, CircuitBreakerClosed, breaker.State())
+}
+
+func TestNewCircuitBreakerInvalid(t *testing.T) {
+	_, err := NewCircuitBreaker(0, time.Minute)
+	assert.EqualError(t, err, "failureThreshold unspecified or negative")
+	_, err = NewCircuitBreaker(1, 0)
+	assert.EqualError(t, err, "cooldown unspecified or negative")
+}
+
+type performFunc func(*http.Request) (*http.Response, error)
+
+func (f performFunc) Perform(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func (f performFunc) NewBulkIndexer(elasticsearch.BulkIndexerConfig) (elasticsearch.BulkIndexer, error) {
+	return nil, errors.New("not implemented")
+}
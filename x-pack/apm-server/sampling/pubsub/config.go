@@ -6,6 +6,7 @@ package pubsub
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,6 +14,7 @@ import (
 	"github.com/elastic/elastic-agent-libs/logp"
 
 	"github.com/elastic/apm-server/internal/elasticsearch"
+	"github.com/elastic/apm-server/internal/model/modelindexer"
 )
 
 // Config holds configuration for Pubsub.
@@ -21,10 +23,31 @@ type Config struct {
 	// trace ID observations.
 	Client elasticsearch.Client
 
+	// CompressionCodec holds the codec to use for compressing bulk requests:
+	// "gzip", "zstd", or "none". If CompressionCodec is empty, gzip is used.
+	//
+	// Not all versions of Elasticsearch accept requests compressed with zstd.
+	// If CompressionCodec is "zstd", Pubsub checks that Elasticsearch accepts
+	// zstd-compressed requests before publishing, and falls back to gzip if
+	// it does not.
+	CompressionCodec string
+
 	// CompressionLevel holds the gzip compression level to use when bulk indexing.
 	// See model/modelindexer.Config.CompressionLevel for details.
 	CompressionLevel int
 
+	// MaxRequests holds the maximum number of concurrent bulk requests to
+	// make when indexing sampled trace IDs.
+	//
+	// If MaxRequests is zero, the model/modelindexer default will be used.
+	MaxRequests int
+
+	// FlushBytes holds the flush threshold in bytes for bulk requests made
+	// when indexing sampled trace IDs.
+	//
+	// If FlushBytes is zero, the model/modelindexer default will be used.
+	FlushBytes int
+
 	// DataStream holds the data stream.
 	DataStream DataStreamConfig
 
@@ -46,6 +69,21 @@ type Config struct {
 	// of locally sampled trace IDs, and so should be in the order of seconds.
 	FlushInterval time.Duration
 
+	// PublishCircuitBreaker holds an optional CircuitBreaker, for guarding
+	// the bulk requests made when publishing sampled trace IDs. While the
+	// breaker is open, sampled trace IDs are not published.
+	PublishCircuitBreaker *CircuitBreaker
+
+	// PublishRetry holds configuration for retrying failed bulk requests
+	// made when publishing sampled trace IDs. Each retry is made through
+	// PublishCircuitBreaker, if any.
+	PublishRetry RetryConfig
+
+	// PublishMetrics holds an optional PublishMetrics, for recording
+	// statistics about published sampled trace IDs. The stats are
+	// updated every FlushInterval.
+	PublishMetrics *PublishMetrics
+
 	// Logger is used for logging publish and subscribe operations -- particularly
 	// errors that occur asynchronously.
 	//
@@ -53,6 +91,18 @@ type Config struct {
 	Logger *logp.Logger
 }
 
+const (
+	// maxDataStreamNameBytes and maxDataStreamPartBytes hold the maximum
+	// length of a data stream name, and of its type, dataset, and namespace.
+	maxDataStreamNameBytes = 255
+	maxDataStreamPartBytes = 100
+
+	// invalidDataStreamChars holds the characters which may not appear in
+	// the parts of a data stream name: those disallowed in index names, and
+	// "-", which separates the parts.
+	invalidDataStreamChars = `\/*?"<>|,#: -`
+)
+
 // DataStreamConfig holds data stream configuration for Pubsub.
 type DataStreamConfig struct {
 	// Type holds the data stream's type.
@@ -82,10 +132,25 @@ func (config Config) Validate() error {
 	if config.FlushInterval <= 0 {
 		return errors.New("FlushInterval unspecified or negative")
 	}
+	if config.MaxRequests < 0 {
+		return errors.New("MaxRequests negative")
+	}
+	if config.FlushBytes < 0 {
+		return errors.New("FlushBytes negative")
+	}
+	if err := config.PublishRetry.Validate(); err != nil {
+		return errors.Wrap(err, "PublishRetry invalid")
+	}
+	switch config.CompressionCodec {
+	case "", modelindexer.CompressionCodecGzip, modelindexer.CompressionCodecZstd, modelindexer.CompressionCodecNone:
+	default:
+		return errors.Errorf("CompressionCodec %q unsupported", config.CompressionCodec)
+	}
 	return nil
 }
 
-// Validate validates the configuration.
+// Validate validates the configuration, including that the data stream's
+// name follows the data stream naming scheme.
 func (config DataStreamConfig) Validate() error {
 	if config.Type == "" {
 		return errors.New("Type unspecified")
@@ -96,6 +161,37 @@ func (config DataStreamConfig) Validate() error {
 	if config.Namespace == "" {
 		return errors.New("Namespace unspecified")
 	}
+	if err := validateDataStreamPart(config.Type); err != nil {
+		return errors.Wrap(err, "Type invalid")
+	}
+	if strings.HasPrefix(config.Type, "_") || strings.HasPrefix(config.Type, "+") {
+		return errors.Errorf("Type invalid: %q must not start with '_' or '+'", config.Type)
+	}
+	if err := validateDataStreamPart(config.Dataset); err != nil {
+		return errors.Wrap(err, "Dataset invalid")
+	}
+	if err := validateDataStreamPart(config.Namespace); err != nil {
+		return errors.Wrap(err, "Namespace invalid")
+	}
+	if name := config.String(); len(name) > maxDataStreamNameBytes {
+		return errors.Errorf("data stream name %q longer than %d bytes", name, maxDataStreamNameBytes)
+	}
+	return nil
+}
+
+// validateDataStreamPart validates the type, dataset, or namespace of a data
+// stream name, which must be lowercase, and must not contain "-" or any of
+// the characters disallowed in index names.
+func validateDataStreamPart(part string) error {
+	if len(part) > maxDataStreamPartBytes {
+		return errors.Errorf("%q longer than %d bytes", part, maxDataStreamPartBytes)
+	}
+	if part != strings.ToLower(part) {
+		return errors.Errorf("%q must be lowercase", part)
+	}
+	if i := strings.IndexAny(part, invalidDataStreamChars); i >= 0 {
+		return errors.Errorf("%q contains invalid character %q", part, part[i])
+	}
 	return nil
 }
 
@@ -5,6 +5,7 @@
 package pubsub_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -83,6 +84,62 @@ func TestConfigInvalid(t *testing.T) {
 			SearchInterval: time.Second,
 		},
 		err: "FlushInterval unspecified or negative",
+	}, {
+		config: pubsub.Config{
+			Client: elasticsearchClient,
+			DataStream: pubsub.DataStreamConfig{
+				Type:      "type",
+				Dataset:   "dataset",
+				Namespace: "namespace",
+			},
+			BeatID:         "beat_id",
+			SearchInterval: time.Second,
+			FlushInterval:  time.Second,
+			MaxRequests:    -1,
+		},
+		err: "MaxRequests negative",
+	}, {
+		config: pubsub.Config{
+			Client: elasticsearchClient,
+			DataStream: pubsub.DataStreamConfig{
+				Type:      "type",
+				Dataset:   "dataset",
+				Namespace: "namespace",
+			},
+			BeatID:         "beat_id",
+			SearchInterval: time.Second,
+			FlushInterval:  time.Second,
+			FlushBytes:     -1,
+		},
+		err: "FlushBytes negative",
+	}, {
+		config: pubsub.Config{
+			Client: elasticsearchClient,
+			DataStream: pubsub.DataStreamConfig{
+				Type:      "type",
+				Dataset:   "dataset",
+				Namespace: "namespace",
+			},
+			BeatID:         "beat_id",
+			SearchInterval: time.Second,
+			FlushInterval:  time.Second,
+			PublishRetry:   pubsub.RetryConfig{MaxRetries: 1},
+		},
+		err: "PublishRetry invalid: Backoff unspecified or negative",
+	}, {
+		config: pubsub.Config{
+			Client: elasticsearchClient,
+			DataStream: pubsub.DataStreamConfig{
+				Type:      "type",
+				Dataset:   "dataset",
+				Namespace: "namespace",
+			},
+			BeatID:           "beat_id",
+			SearchInterval:   time.Second,
+			FlushInterval:    time.Second,
+			CompressionCodec: "lz4",
+		},
+		err: `CompressionCodec "lz4" unsupported`,
 	}} {
 		pubsub, err := pubsub.New(test.config)
 		require.Error(t, err)
@@ -90,3 +147,39 @@ func TestConfigInvalid(t *testing.T) {
 		assert.EqualError(t, err, "invalid pubsub config: "+test.err)
 	}
 }
+
+func TestDataStreamConfigInvalid(t *testing.T) {
+	for _, test := range []struct {
+		config pubsub.DataStreamConfig
+		err    string
+	}{{
+		config: pubsub.DataStreamConfig{Type: "traces", Dataset: "apm.sampled", Namespace: "Default"},
+		err:    `Namespace invalid: "Default" must be lowercase`,
+	}, {
+		config: pubsub.DataStreamConfig{Type: "traces", Dataset: "apm.sampled", Namespace: "long-term"},
+		err:    `Namespace invalid: "long-term" contains invalid character '-'`,
+	}, {
+		config: pubsub.DataStreamConfig{Type: "traces", Dataset: "apm/sampled", Namespace: "default"},
+		err:    `Dataset invalid: "apm/sampled" contains invalid character '/'`,
+	}, {
+		config: pubsub.DataStreamConfig{Type: "_traces", Dataset: "apm.sampled", Namespace: "default"},
+		err:    `Type invalid: "_traces" must not start with '_' or '+'`,
+	}, {
+		config: pubsub.DataStreamConfig{Type: "traces", Dataset: "apm.sampled", Namespace: strings.Repeat("a", 101)},
+		err:    `Namespace invalid: "` + strings.Repeat("a", 101) + `" longer than 100 bytes`,
+	}, {
+		config: pubsub.DataStreamConfig{
+			Type:      strings.Repeat("a", 100),
+			Dataset:   strings.Repeat("b", 100),
+			Namespace: strings.Repeat("c", 100),
+		},
+		err: `data stream name "` + strings.Join([]string{
+			strings.Repeat("a", 100), strings.Repeat("b", 100), strings.Repeat("c", 100),
+		}, "-") + `" longer than 255 bytes`,
+	}} {
+		assert.EqualError(t, test.config.Validate(), test.err)
+	}
+
+	valid := pubsub.DataStreamConfig{Type: "traces", Dataset: "apm.sampled", Namespace: "long_term"}
+	assert.NoError(t, valid.Validate())
+}
@@ -0,0 +1,117 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package pubsub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-server/internal/model/modelindexer"
+)
+
+// PublishStats holds statistics about sampled trace IDs published to
+// Elasticsearch.
+type PublishStats struct {
+	// Indexed holds the number of sampled trace ID documents indexed.
+	Indexed int64
+
+	// BytesTotal holds the number of bytes sent in bulk request bodies,
+	// after any compression.
+	BytesTotal int64
+
+	// FailedClient holds the number of documents which failed to be
+	// indexed with a 4xx status.
+	FailedClient int64
+
+	// FailedServer holds the number of documents which failed to be
+	// indexed with a 5xx status.
+	FailedServer int64
+
+	// FailedOther holds the number of documents which failed to be
+	// indexed without a response, e.g. due to a network error.
+	FailedOther int64
+
+	// Retries holds the number of times failed requests were retried.
+	// See RetryConfig.
+	Retries int64
+
+	// IndexedPerSecond and BytesPerSecond hold the rates at which
+	// documents were indexed and bytes were sent, measured over the
+	// most recent flush interval.
+	IndexedPerSecond float64
+	BytesPerSecond   float64
+}
+
+// PublishMetrics records PublishStats for sampled trace IDs published by
+// Pubsub.PublishSampledTraceIDs.
+//
+// PublishMetrics is safe for concurrent use.
+type PublishMetrics struct {
+	mu    sync.Mutex
+	stats PublishStats
+
+	// last and lastUpdated hold the stats of the current indexer
+	// as of the most recent update, and the time of that update.
+	last        modelindexer.Stats
+	lastUpdated time.Time
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+// NewPublishMetrics returns a new PublishMetrics.
+func NewPublishMetrics() *PublishMetrics {
+	return &PublishMetrics{now: time.Now}
+}
+
+// Stats returns the current PublishStats.
+func (m *PublishMetrics) Stats() PublishStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// start is called when a new indexer is created for publishing.
+func (m *PublishMetrics) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = modelindexer.Stats{}
+	m.lastUpdated = m.now()
+}
+
+// retried records that a failed request was retried.
+func (m *PublishMetrics) retried() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Retries++
+}
+
+// update records the stats of the current indexer, accumulating the
+// changes since the previous update and calculating rates over the
+// time since then.
+func (m *PublishMetrics) update(stats modelindexer.Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	indexed := stats.Indexed - m.last.Indexed
+	bytes := stats.BytesTotal - m.last.BytesTotal
+	failedClient := stats.FailedClient - m.last.FailedClient
+	failedServer := stats.FailedServer - m.last.FailedServer
+	failed := stats.Failed - m.last.Failed
+
+	m.stats.Indexed += indexed
+	m.stats.BytesTotal += bytes
+	m.stats.FailedClient += failedClient
+	m.stats.FailedServer += failedServer
+	m.stats.FailedOther += failed - failedClient - failedServer
+
+	now := m.now()
+	if elapsed := now.Sub(m.lastUpdated).Seconds(); elapsed > 0 {
+		m.stats.IndexedPerSecond = float64(indexed) / elapsed
+		m.stats.BytesPerSecond = float64(bytes) / elapsed
+	}
+	m.last = stats
+	m.lastUpdated = now
+}
@@ -0,0 +1,63 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/internal/model/modelindexer"
+)
+
+func TestPublishMetrics(t *testing.T) {
+	m := NewPublishMetrics()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	m.start()
+	now = now.Add(2 * time.Second)
+	m.update(modelindexer.Stats{Indexed: 10, BytesTotal: 1000})
+	assert.Equal(t, PublishStats{
+		Indexed:          10,
+		BytesTotal:       1000,
+		IndexedPerSecond: 5,
+		BytesPerSecond:   500,
+	}, m.Stats())
+
+	// Rates are measured over the time since the previous update.
+	now = now.Add(4 * time.Second)
+	m.update(modelindexer.Stats{
+		Indexed:      14,
+		BytesTotal:   1400,
+		Failed:       6,
+		FailedClient: 1,
+		FailedServer: 2,
+	})
+	assert.Equal(t, PublishStats{
+		Indexed:          14,
+		BytesTotal:       1400,
+		FailedClient:     1,
+		FailedServer:     2,
+		FailedOther:      3,
+		IndexedPerSecond: 1,
+		BytesPerSecond:   100,
+	}, m.Stats())
+
+	// Stats accumulate across indexers.
+	m.start()
+	now = now.Add(time.Second)
+	m.update(modelindexer.Stats{Indexed: 1, BytesTotal: 100, Failed: 1, FailedServer: 1})
+	assert.Equal(t, PublishStats{
+		Indexed:          15,
+		BytesTotal:       1500,
+		FailedClient:     1,
+		FailedServer:     3,
+		FailedOther:      3,
+		IndexedPerSecond: 1,
+		BytesPerSecond:   100,
+	}, m.Stats())
+}
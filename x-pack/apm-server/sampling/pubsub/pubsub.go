@@ -5,6 +5,7 @@
 package pubsub
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 
@@ -31,6 +33,10 @@ var ErrClosed = errors.New("pubsub closed")
 
 var errIndexNotFound = errors.New("index not found")
 
+// checkZstdSupportedTimeout holds the amount of time to wait for Elasticsearch
+// when checking whether it accepts zstd-compressed requests.
+const checkZstdSupportedTimeout = 10 * time.Second
+
 // Pubsub provides a means of publishing and subscribing to sampled trace IDs,
 // using Elasticsearch for temporary storage.
 //
@@ -60,13 +66,26 @@ func New(config Config) (*Pubsub, error) {
 // indexing them into Elasticsearch. PublishSampledTraceIDs returns when
 // ctx is canceled.
 func (p *Pubsub) PublishSampledTraceIDs(ctx context.Context, traceIDs <-chan string) error {
-	indexer, err := modelindexer.New(p.config.Client, modelindexer.Config{
+	client := p.config.Client
+	if p.config.PublishCircuitBreaker != nil {
+		client = p.config.PublishCircuitBreaker.Client(client)
+	}
+	if p.config.PublishRetry.MaxRetries > 0 {
+		client = p.config.PublishRetry.client(client, p.config.PublishMetrics)
+	}
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		CompressionCodec: p.compressionCodec(ctx),
 		CompressionLevel: p.config.CompressionLevel,
+		MaxRequests:      p.config.MaxRequests,
+		FlushBytes:       p.config.FlushBytes,
 		FlushInterval:    p.config.FlushInterval,
 	})
 	if err != nil {
 		return err
 	}
+	if p.config.PublishMetrics != nil {
+		p.config.PublishMetrics.start()
+	}
 
 	result := p.indexSampledTraceIDs(ctx, traceIDs, indexer)
 	ctx, cancel := context.WithTimeout(context.Background(), p.config.FlushInterval)
@@ -74,10 +93,72 @@ func (p *Pubsub) PublishSampledTraceIDs(ctx context.Context, traceIDs <-chan str
 	if err := indexer.Close(ctx); err != nil {
 		result = multierror.Append(result, err)
 	}
+	if p.config.PublishMetrics != nil {
+		p.config.PublishMetrics.update(indexer.Stats())
+	}
 	return result
 }
 
+// compressionCodec returns the codec to use for compressing bulk requests.
+// If zstd is configured, but Elasticsearch does not accept zstd-compressed
+// requests, or cannot be reached to check, gzip is used instead, with the
+// configured compression level.
+func (p *Pubsub) compressionCodec(ctx context.Context) string {
+	if p.config.CompressionCodec != modelindexer.CompressionCodecZstd {
+		return p.config.CompressionCodec
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkZstdSupportedTimeout)
+	defer cancel()
+	if err := p.checkZstdSupported(ctx); err != nil {
+		p.config.Logger.With(logp.Error(err)).Warn(
+			"failed to check Elasticsearch accepts zstd-compressed requests, falling back to gzip",
+		)
+		return modelindexer.CompressionCodecGzip
+	}
+	return modelindexer.CompressionCodecZstd
+}
+
+// checkZstdSupported checks that Elasticsearch accepts zstd-compressed requests,
+// by searching the data stream with a zstd-compressed body. If Elasticsearch
+// does not support zstd, it cannot parse the body, and the search fails.
+func (p *Pubsub) checkZstdSupported(ctx context.Context) error {
+	var body bytes.Buffer
+	zw, err := zstd.NewWriter(&body)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write([]byte(`{"size":0}`)); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	ignoreUnavailable, allowNoIndices := true, true
+	resp, err := esapi.SearchRequest{
+		Index:             []string{p.config.DataStream.String()},
+		Body:              &body,
+		IgnoreUnavailable: &ignoreUnavailable,
+		AllowNoIndices:    &allowNoIndices,
+		Header:            http.Header{"Content-Encoding": []string{"zstd"}},
+	}.Do(ctx, p.config.Client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("search request failed: %s", message)
+	}
+	return nil
+}
+
 func (p *Pubsub) indexSampledTraceIDs(ctx context.Context, traceIDs <-chan string, indexer *modelindexer.Indexer) error {
+	var metricsTicker <-chan time.Time
+	if p.config.PublishMetrics != nil {
+		ticker := time.NewTicker(p.config.FlushInterval)
+		defer ticker.Stop()
+		metricsTicker = ticker.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -85,6 +166,8 @@ func (p *Pubsub) indexSampledTraceIDs(ctx context.Context, traceIDs <-chan strin
 				return err
 			}
 			return nil
+		case <-metricsTicker:
+			p.config.PublishMetrics.update(indexer.Stats())
 		case id := <-traceIDs:
 			doc := model.APMEvent{
 				Timestamp:  time.Now(),
@@ -6,6 +6,7 @@ package pubsub_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -126,6 +127,61 @@ func TestPublishSampledTraceIDs(t *testing.T) {
 	assert.ElementsMatch(t, input, received)
 }
 
+func TestPublishSampledTraceIDsCompressionCodec(t *testing.T) {
+	test := func(t *testing.T, searchStatusCode int, expectedContentEncoding string) {
+		contentEncodings := make(chan string)
+		ms := newMockElasticsearchServer(t)
+		ms.searchStatusCode = searchStatusCode
+		ms.onSearch = func(r *http.Request) {
+			// Elasticsearch is checked for zstd support by
+			// searching with a zstd-compressed body.
+			assert.Equal(t, "zstd", r.Header.Get("Content-Encoding"))
+		}
+		ms.onBulk = func(r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case contentEncodings <- r.Header.Get("Content-Encoding"):
+			}
+		}
+		client, err := elasticsearch.NewClient(&elasticsearch.Config{
+			Hosts: []string{ms.srv.Listener.Addr().String()},
+		})
+		require.NoError(t, err)
+		pub, err := pubsub.New(pubsub.Config{
+			Client:           client,
+			CompressionCodec: "zstd",
+			CompressionLevel: gzip.BestSpeed,
+			DataStream:       dataStream,
+			BeatID:           beatID,
+			FlushInterval:    time.Millisecond,
+			SearchInterval:   time.Minute,
+		})
+		require.NoError(t, err)
+
+		ids := make(chan string, 1)
+		ids <- uuid.Must(uuid.NewV4()).String()
+		ctx, cancel := context.WithCancel(context.Background())
+		var g errgroup.Group
+		defer g.Wait()
+		defer cancel()
+		g.Go(func() error {
+			return pub.PublishSampledTraceIDs(ctx, ids)
+		})
+		select {
+		case contentEncoding := <-contentEncodings:
+			assert.Equal(t, expectedContentEncoding, contentEncoding)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for bulk request")
+		}
+	}
+	t.Run("supported", func(t *testing.T) {
+		test(t, http.StatusOK, "zstd")
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		test(t, http.StatusBadRequest, "gzip")
+	})
+}
+
 func TestSubscribeSampledTraceIDs(t *testing.T) {
 	ms := newMockElasticsearchServer(t)
 	ms.statsGlobalCheckpoint = 99
@@ -356,6 +412,7 @@ func newMockElasticsearchServer(t testing.TB) *mockElasticsearchServer {
 	mux.HandleFunc("/"+dataStream.String()+"/_stats/get", m.handleStats)
 	mux.HandleFunc("/index_name/_refresh", m.handleRefresh)
 	mux.HandleFunc("/index_name/_search", m.handleSearch)
+	mux.HandleFunc("/"+dataStream.String()+"/_search", m.handleSearch)
 	var withElasticProduct http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Elastic-Product", "Elasticsearch")
 		mux.ServeHTTP(w, r)
@@ -195,7 +195,9 @@ func (rt *channelClientRoundTripper) roundTripSearch(r *http.Request, recorder *
 }
 
 func (rt *channelClientRoundTripper) roundTripBulk(r *http.Request, recorder *httptest.ResponseRecorder) error {
-	var results []map[string]elasticsearch.BulkIndexerResponseItem
+	var result struct {
+		Items []map[string]elasticsearch.BulkIndexerResponseItem `json:"items"`
+	}
 	dec := json.NewDecoder(r.Body)
 	for {
 		var m map[string]interface{}
@@ -217,10 +219,10 @@ func (rt *channelClientRoundTripper) roundTripBulk(r *http.Request, recorder *ht
 				return err
 			}
 		}
-		result := elasticsearch.BulkIndexerResponseItem{Status: 200}
-		results = append(results, map[string]elasticsearch.BulkIndexerResponseItem{action: result})
+		item := elasticsearch.BulkIndexerResponseItem{Status: 200}
+		result.Items = append(result.Items, map[string]elasticsearch.BulkIndexerResponseItem{action: item})
 	}
-	if err := json.NewEncoder(recorder).Encode(results); err != nil {
+	if err := json.NewEncoder(recorder).Encode(result); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,127 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package pubsubtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/elastic/apm-server/internal/elasticsearch"
+)
+
+// Recorder is an in-process fake of the Elasticsearch cluster used for
+// remote sampling, which records the sampled trace IDs published to it,
+// along with the bodies of the bulk requests in which they were published.
+//
+// Recorder is safe for concurrent use.
+type Recorder struct {
+	sub Subscriber
+
+	mu       sync.Mutex
+	traceIDs []string
+	bodies   [][]byte
+}
+
+// NewRecorder returns a new Recorder. Subscribe requests made through the
+// Recorder's client are responded to by calling sub, if it is non-nil.
+func NewRecorder(sub Subscriber) *Recorder {
+	return &Recorder{sub: sub}
+}
+
+// Client returns a new elasticsearch.Client, suitable for use with pubsub,
+// which records publish requests in r.
+func (r *Recorder) Client() elasticsearch.Client {
+	client, err := elasticsearch.NewClientParams(elasticsearch.ClientParams{
+		Config: elasticsearch.DefaultConfig(),
+		Transport: &recorderRoundTripper{
+			recorder: r,
+			next:     &channelClientRoundTripper{pub: PublisherFunc(r.publish), sub: r.sub},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// TraceIDs returns the trace IDs published, in the order received.
+func (r *Recorder) TraceIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.traceIDs...)
+}
+
+// Count returns the number of trace IDs published.
+func (r *Recorder) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.traceIDs)
+}
+
+// BulkRequests returns the number of bulk requests received.
+func (r *Recorder) BulkRequests() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+// BulkBodies returns the bodies of the bulk requests received, in the
+// order received. Compressed bodies are returned decompressed.
+func (r *Recorder) BulkBodies() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.bodies...)
+}
+
+func (r *Recorder) publish(ctx context.Context, traceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.traceIDs = append(r.traceIDs, traceID)
+	return nil
+}
+
+func (r *Recorder) recordBody(body []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, body)
+}
+
+// recorderRoundTripper records the bodies of bulk requests, decompressing
+// them if necessary, before passing the requests on to next.
+type recorderRoundTripper struct {
+	recorder *Recorder
+	next     http.RoundTripper
+}
+
+func (rt *recorderRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		return rt.next.RoundTrip(r)
+	}
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	rt.recorder.recordBody(data)
+
+	r = r.Clone(r.Context())
+	r.Header.Del("Content-Encoding")
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	return rt.next.RoundTrip(r)
+}
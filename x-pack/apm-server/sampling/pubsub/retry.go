@@ -0,0 +1,156 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package pubsub
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/internal/elasticsearch"
+)
+
+// RetryConfig holds configuration for retrying failed requests made when
+// publishing sampled trace IDs.
+//
+// A request is retried if it returns an error, or a response with status
+// 429 (Too Many Requests) or a 5xx status, as for CircuitBreaker. Requests
+// short-circuited by an open CircuitBreaker are not retried.
+type RetryConfig struct {
+	// MaxRetries holds the maximum number of times a failed request is
+	// retried. If MaxRetries is zero, failed requests are not retried.
+	MaxRetries int
+
+	// Backoff holds the amount of time to wait before the first retry,
+	// doubling for each subsequent retry of the same request.
+	Backoff time.Duration
+
+	// Jitter holds the fraction of each backoff, in the range [0,1], which
+	// is randomised, so that servers failing at the same time do not retry
+	// in lockstep. Each backoff is reduced by a random amount up to Jitter
+	// times the backoff.
+	Jitter float64
+
+	// Timeout holds the maximum amount of time to spend on a request,
+	// including its retries. A request is not retried if the backoff would
+	// exceed the timeout, or the request context's deadline.
+	//
+	// If Timeout is zero, only the request context's deadline applies.
+	Timeout time.Duration
+}
+
+// Validate validates the configuration.
+func (config RetryConfig) Validate() error {
+	if config.MaxRetries < 0 {
+		return errors.New("MaxRetries negative")
+	}
+	if config.MaxRetries > 0 && config.Backoff <= 0 {
+		return errors.New("Backoff unspecified or negative")
+	}
+	if config.Jitter < 0 || config.Jitter > 1 {
+		return errors.New("Jitter out of range [0,1]")
+	}
+	if config.Timeout < 0 {
+		return errors.New("Timeout negative")
+	}
+	return nil
+}
+
+// client returns an elasticsearch.Client which makes requests through
+// client, retrying failed requests. If metrics is non-nil, retries are
+// recorded in it.
+func (config RetryConfig) client(client elasticsearch.Client, metrics *PublishMetrics) elasticsearch.Client {
+	return &retryClient{
+		Client:  client,
+		config:  config,
+		metrics: metrics,
+		random:  rand.Float64,
+	}
+}
+
+type retryClient struct {
+	elasticsearch.Client
+	config  RetryConfig
+	metrics *PublishMetrics
+
+	// random is used for obtaining jitter, and may be overridden in tests.
+	random func() float64
+}
+
+// Perform makes the request, retrying it with exponential backoff while it
+// fails, up to the configured number of retries and within the configured
+// timeout. The response or error of the final attempt is returned.
+func (c *retryClient) Perform(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	deadline, hasDeadline := ctx.Deadline()
+	if c.config.Timeout > 0 {
+		if timeout := time.Now().Add(c.config.Timeout); !hasDeadline || timeout.Before(deadline) {
+			deadline, hasDeadline = timeout, true
+		}
+	}
+	for retries := 0; ; retries++ {
+		resp, err := c.Client.Perform(r)
+		if !retryable(resp, err) || retries == c.config.MaxRetries {
+			return resp, err
+		}
+		if r.Body != nil && r.GetBody == nil {
+			// The request body cannot be sent again.
+			return resp, err
+		}
+		delay := c.delay(retries)
+		if hasDeadline && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		if resp != nil && resp.Body != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		if c.metrics != nil {
+			c.metrics.retried()
+		}
+	}
+}
+
+// delay returns the amount of time to wait before retrying a request which
+// has already been retried the given number of times.
+func (c *retryClient) delay(retries int) time.Duration {
+	backoff := c.config.Backoff << retries
+	return backoff - time.Duration(c.config.Jitter*c.random()*float64(backoff))
+}
+
+// retryable reports whether a request with the given outcome should be retried.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return err != ErrCircuitOpen && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// sleep waits for d to elapse, or for ctx to be done, in which case the
+// context's error is returned.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryClient(t *testing.T) {
+	var bodies []string
+	var statuses []int
+	metrics := NewPublishMetrics()
+	client := RetryConfig{MaxRetries: 3, Backoff: time.Millisecond}.client(
+		performFunc(func(r *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+			status := statuses[0]
+			statuses = statuses[1:]
+			return &http.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+		}),
+		metrics,
+	)
+	perform := func() int {
+		req, err := http.NewRequest("POST", "/_bulk", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		resp, err := client.Perform(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// Failed requests are retried, with the same body, until they succeed.
+	statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	assert.Equal(t, http.StatusOK, perform())
+	assert.Equal(t, []string{"body", "body", "body"}, bodies)
+	assert.Equal(t, int64(2), metrics.Stats().Retries)
+
+	// The final response is returned once the retries are exhausted.
+	bodies = nil
+	statuses = []int{500, 500, 500, 502}
+	assert.Equal(t, http.StatusBadGateway, perform())
+	assert.Len(t, bodies, 4)
+	assert.Equal(t, int64(5), metrics.Stats().Retries)
+
+	// 4xx responses other than 429 are not retried.
+	bodies = nil
+	statuses = []int{http.StatusBadRequest}
+	assert.Equal(t, http.StatusBadRequest, perform())
+	assert.Len(t, bodies, 1)
+	assert.Equal(t, int64(5), metrics.Stats().Retries)
+}
+
+func TestRetryClientErrors(t *testing.T) {
+	var requests int
+	var performErr error
+	client := RetryConfig{MaxRetries: 1, Backoff: time.Millisecond}.client(
+		performFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			return nil, performErr
+		}),
+		nil,
+	)
+	for _, test := range []struct {
+		err      error
+		requests int
+	}{
+		{err: errors.New("connection refused"), requests: 2},
+		{err: ErrCircuitOpen, requests: 1},
+		{err: context.Canceled, requests: 1},
+	} {
+		requests = 0
+		performErr = test.err
+		req, _ := http.NewRequest("POST", "/_bulk", nil)
+		_, err := client.Perform(req)
+		assert.Equal(t, test.err, err)
+		assert.Equal(t, test.requests, requests, test.err.Error())
+	}
+}
+
+func TestRetryClientTimeout(t *testing.T) {
+	var requests int
+	next := performFunc(func(r *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+	})
+
+	// Requests are not retried if the backoff would exceed the timeout.
+	client := RetryConfig{MaxRetries: 3, Backoff: time.Hour, Timeout: time.Minute}.client(next, nil)
+	req, _ := http.NewRequest("POST", "/_bulk", nil)
+	resp, err := client.Perform(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 1, requests)
+
+	// ... or the request context's deadline.
+	requests = 0
+	client = RetryConfig{MaxRetries: 3, Backoff: time.Hour}.client(next, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "POST", "/_bulk", nil)
+	resp, err = client.Perform(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 1, requests)
+}
+
+func TestRetryClientDelay(t *testing.T) {
+	client := RetryConfig{MaxRetries: 3, Backoff: time.Second, Jitter: 0.5}.client(nil, nil).(*retryClient)
+	client.random = func() float64 { return 0 }
+	assert.Equal(t, time.Second, client.delay(0))
+	assert.Equal(t, 2*time.Second, client.delay(1))
+	assert.Equal(t, 4*time.Second, client.delay(2))
+
+	// Jitter reduces each backoff by up to the configured fraction.
+	client.random = func() float64 { return 1 }
+	assert.Equal(t, 500*time.Millisecond, client.delay(0))
+	assert.Equal(t, 2*time.Second, client.delay(2))
+}
+
+func TestRetryConfigInvalid(t *testing.T) {
+	for _, test := range []struct {
+		config RetryConfig
+		err    string
+	}{
+		{RetryConfig{MaxRetries: -1}, "MaxRetries negative"},
+		{RetryConfig{MaxRetries: 1}, "Backoff unspecified or negative"},
+		{RetryConfig{Jitter: 1.5}, "Jitter out of range [0,1]"},
+		{RetryConfig{Timeout: -1}, "Timeout negative"},
+	} {
+		assert.EqualError(t, test.config.Validate(), test.err)
+	}
+	assert.NoError(t, RetryConfig{}.Validate())
+}
@@ -10,6 +10,43 @@ import (
 	"math/rand"
 )
 
+// traceReservoir is a sampling reservoir holding the trace IDs of root
+// transactions, implemented by randomReservoir and stratifiedSample.
+type traceReservoir interface {
+	// Sample records a trace ID with a random probability, proportional
+	// to the given weight, reporting whether it was added. stratum is
+	// ignored by reservoirs which do not prefer diverse samples.
+	Sample(weight float64, stratum stratumKey, traceID string) bool
+
+	// Reset clears the current values.
+	Reset()
+
+	// Size returns the reservoir capacity.
+	Size() int
+
+	// Len returns the number of trace IDs currently in the reservoir.
+	Len() int
+
+	// Resize resizes the reservoir capacity.
+	Resize(n int)
+
+	// Pop removes a trace ID with a low weight.
+	Pop() string
+
+	// Values returns a copy of the currently sampled trace IDs.
+	Values() []string
+}
+
+// randomReservoir adapts weightedRandomSample to traceReservoir,
+// ignoring strata.
+type randomReservoir struct {
+	*weightedRandomSample
+}
+
+func (r randomReservoir) Sample(weight float64, _ stratumKey, traceID string) bool {
+	return r.weightedRandomSample.Sample(weight, traceID)
+}
+
 // weightedRandomSample provides a weighted, random, reservoir sampling
 // implementing Algorithm A-Res (Algorithm A with Reservoir).
 //
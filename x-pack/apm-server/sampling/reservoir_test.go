@@ -30,3 +30,43 @@ func TestResetReservoir(t *testing.T) {
 	res.Reset()
 	assert.Len(t, res.Values(), 0)
 }
+
+func TestStratifiedReservoir(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	a := stratumKey{transactionName: "a"}
+	b := stratumKey{transactionName: "b"}
+	c := stratumKey{transactionName: "c"}
+	res := newStratifiedSample(rng, 4)
+
+	// All items are admitted until the reservoir is full.
+	for _, traceID := range []string{"a1", "a2", "a3", "a4"} {
+		assert.True(t, res.Sample(1, a, traceID))
+	}
+	assert.Equal(t, 4, res.Len())
+
+	// Items from other strata evict items from the largest stratum,
+	// until the strata are evenly sized.
+	assert.True(t, res.Sample(1, b, "b1"))
+	assert.True(t, res.Sample(1, b, "b2"))
+	assert.Len(t, res.strata[a].values, 2)
+	assert.Len(t, res.strata[b].values, 2)
+	res.Sample(1, b, "b3")
+	assert.Len(t, res.strata[a].values, 2)
+	assert.Len(t, res.strata[b].values, 2)
+
+	assert.True(t, res.Sample(1, c, "c1"))
+	assert.Equal(t, 4, res.Len())
+	assert.Contains(t, res.Values(), "c1")
+	assert.Len(t, res.strata, 3)
+
+	// Pop removes items from the largest stratum.
+	res.Resize(3)
+	assert.Equal(t, 3, res.Len())
+	assert.Len(t, res.strata, 3)
+	assert.Len(t, res.Values(), 3)
+
+	res.Reset()
+	assert.Equal(t, 0, res.Len())
+	assert.Len(t, res.Values(), 0)
+	assert.Equal(t, 3, res.Size())
+}
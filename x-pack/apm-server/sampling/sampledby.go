@@ -0,0 +1,104 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// sampledByValuePrefix prefixes the policy name in the value of the
+// SampledByLabel label, identifying the traces as tail-sampled.
+const sampledByValuePrefix = "tail:"
+
+// sampledByPolicies records the name of the policy by which each trace was
+// sampled locally, from when the decision is made until the trace's events
+// are reported, for setting the SampledByLabel label.
+//
+// A nil *sampledByPolicies records nothing, for when SampledByLabel is empty.
+type sampledByPolicies struct {
+	label string
+
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newSampledByPolicies(label string) *sampledByPolicies {
+	if label == "" {
+		return nil
+	}
+	return &sampledByPolicies{label: label, m: make(map[string]string)}
+}
+
+// record records that the traces with the given IDs were sampled by the
+// policy with the given name.
+func (s *sampledByPolicies) record(traceIDs []string, policy string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, traceID := range traceIDs {
+		s.m[traceID] = policy
+	}
+}
+
+// take returns the name of the policy recorded for traceID, if any, and
+// forgets it.
+func (s *sampledByPolicies) take(traceID string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy, ok := s.m[traceID]
+	delete(s.m, traceID)
+	return policy, ok
+}
+
+// annotate sets the label on each of events whose trace has a recorded
+// policy, and then forgets the policies recorded for traceIDs, which must
+// include the trace IDs of events.
+func (s *sampledByPolicies) annotate(traceIDs []string, events []model.APMEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range events {
+		if policy, ok := s.m[events[i].Trace.ID]; ok {
+			s.set(&events[i], policy)
+		}
+	}
+	for _, traceID := range traceIDs {
+		delete(s.m, traceID)
+	}
+}
+
+// forget forgets the policies recorded for traceIDs, e.g. for traces which
+// are no longer sampled.
+func (s *sampledByPolicies) forget(traceIDs []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, traceID := range traceIDs {
+		delete(s.m, traceID)
+	}
+}
+
+// set sets the label on event, identifying the policy by which its trace
+// was sampled. The labels are copied first, as they may be shared with
+// other events.
+func (s *sampledByPolicies) set(event *model.APMEvent, policy string) {
+	labels := make(model.Labels, len(event.Labels)+1)
+	for k, v := range event.Labels {
+		labels[k] = v
+	}
+	labels[s.label] = model.LabelValue{Value: sampledByValuePrefix + policy}
+	event.Labels = labels
+}
@@ -0,0 +1,85 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import "sort"
+
+// ServiceSampleRate holds the current sampling state of a service tracked by
+// the tail-sampling processor.
+type ServiceSampleRate struct {
+	// Policy holds the name of the policy matching the service's root
+	// transactions, or the policy's index if it has no name.
+	Policy string
+
+	// ServiceName holds the name of the service. For policies with a
+	// service name specified, this is the policy's service name.
+	ServiceName string
+
+	// SampleRate holds the sample rate configured for the policy.
+	SampleRate float64
+
+	// EffectiveSampleRate holds the fraction of the service's root
+	// transactions that were sampled in the most recent tail sampling
+	// interval in which any were observed. This may differ from
+	// SampleRate due to rounding, or the sampling reservoir being too
+	// small following an increase in the ingest rate.
+	EffectiveSampleRate float64
+
+	// IngestRate holds the exponentially weighted moving average number
+	// of root transactions observed per tail sampling interval, as
+	// decayed by IngestRateDecayFactor.
+	IngestRate float64
+
+	// ReservoirSize holds the maximum number of root transactions which
+	// may be sampled in the current tail sampling interval.
+	ReservoirSize int
+}
+
+// ServiceSampleRates returns the current sampling state of each service
+// tracked by the processor, ordered by policy, in the order configured,
+// and then by service name.
+//
+// ServiceSampleRates does not modify the sampling state, and may be called
+// at any time, e.g. for inspecting the effect of IngestRateDecayFactor.
+// Services without an explicit policy are only included until they are
+// removed for inactivity, or evicted due to MaxDynamicServices.
+func (p *Processor) ServiceSampleRates() []ServiceSampleRate {
+	return p.currentGroups().serviceSampleRates()
+}
+
+func (g *traceGroups) serviceSampleRates() []ServiceSampleRate {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var rates []ServiceSampleRate
+	for i := range g.policyGroups {
+		pg := &g.policyGroups[i]
+		if pg.g != nil {
+			rates = append(rates, pg.g.serviceSampleRate(pg.name, pg.policy.ServiceName))
+			continue
+		}
+		n := len(rates)
+		for serviceName, group := range pg.dynamic {
+			rates = append(rates, group.serviceSampleRate(pg.name, serviceName))
+		}
+		dynamic := rates[n:]
+		sort.Slice(dynamic, func(i, j int) bool {
+			return dynamic[i].ServiceName < dynamic[j].ServiceName
+		})
+	}
+	return rates
+}
+
+func (g *traceGroup) serviceSampleRate(policy, serviceName string) ServiceSampleRate {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return ServiceSampleRate{
+		Policy:              policy,
+		ServiceName:         serviceName,
+		SampleRate:          g.samplingFraction,
+		EffectiveSampleRate: g.effectiveSampleRate,
+		IngestRate:          g.ingestRate,
+		ReservoirSize:       g.reservoir.Size(),
+	}
+}
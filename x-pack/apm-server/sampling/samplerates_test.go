@@ -0,0 +1,87 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+func TestTraceGroupsServiceSampleRates(t *testing.T) {
+	policies := []Policy{
+		{Name: "checkout", PolicyCriteria: PolicyCriteria{ServiceName: "checkout"}, SampleRate: 0.5},
+		{SampleRate: 0.1},
+	}
+	groups := newTraceGroups(policies, traceGroupsConfig{
+		maxDynamicServiceGroups: 1000,
+		ingestRateDecayFactor:   0.5,
+	})
+	assert.Equal(t, []ServiceSampleRate{{
+		Policy:        "checkout",
+		ServiceName:   "checkout",
+		SampleRate:    0.5,
+		ReservoirSize: minReservoirSize,
+	}}, groups.serviceSampleRates())
+
+	sampleTraces := func(serviceName string, n int) {
+		for i := 0; i < n; i++ {
+			_, err := groups.sampleTrace(&model.APMEvent{
+				Service:     model.Service{Name: serviceName},
+				Event:       model.Event{Duration: time.Millisecond},
+				Trace:       model.Trace{ID: uuid.Must(uuid.NewV4()).String()},
+				Transaction: &model.Transaction{Type: "request"},
+			})
+			require.NoError(t, err)
+		}
+	}
+	sampleTraces("checkout", 100)
+	sampleTraces("b", 50)
+	sampleTraces("a", 20)
+	groups.finalizeSampledTraces(nil)
+
+	// The first ingest rate observed for each group is used as is.
+	assert.Equal(t, []ServiceSampleRate{{
+		Policy:              "checkout",
+		ServiceName:         "checkout",
+		SampleRate:          0.5,
+		EffectiveSampleRate: 0.5,
+		IngestRate:          100,
+		ReservoirSize:       minReservoirSize,
+	}, {
+		Policy:              "1",
+		ServiceName:         "a",
+		SampleRate:          0.1,
+		EffectiveSampleRate: 0.1,
+		IngestRate:          20,
+		ReservoirSize:       minReservoirSize,
+	}, {
+		Policy:              "1",
+		ServiceName:         "b",
+		SampleRate:          0.1,
+		EffectiveSampleRate: 0.1,
+		IngestRate:          50,
+		ReservoirSize:       minReservoirSize,
+	}}, groups.serviceSampleRates())
+
+	// Subsequent ingest rates are decayed. Dynamic service groups with no
+	// activity in the interval are removed, and so are no longer reported.
+	sampleTraces("checkout", 300)
+	sampleTraces("a", 40)
+	groups.finalizeSampledTraces(nil)
+	rates := groups.serviceSampleRates()
+	require.Len(t, rates, 2)
+	assert.Equal(t, "checkout", rates[0].ServiceName)
+	assert.Equal(t, 200.0, rates[0].IngestRate)
+	assert.Equal(t, 0.5, rates[0].EffectiveSampleRate)
+	assert.Equal(t, "a", rates[1].ServiceName)
+	assert.Equal(t, 30.0, rates[1].IngestRate)
+	assert.Equal(t, 0.1, rates[1].EffectiveSampleRate)
+}
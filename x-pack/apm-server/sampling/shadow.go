@@ -0,0 +1,61 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync/atomic"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// shadowMetrics holds counts of traces for comparing the decisions made by
+// the shadow policies with those made by the primary policies.
+//
+// All fields are updated atomically.
+type shadowMetrics struct {
+	// evaluated holds the number of root transactions evaluated by
+	// both the primary and shadow policies.
+	evaluated int64
+
+	// sampled holds the number of traces the shadow policies would
+	// have sampled.
+	sampled int64
+
+	// primarySampled holds the number of traces the primary policies
+	// sampled, over the same period.
+	primarySampled int64
+}
+
+func (m *shadowMetrics) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "evaluated", atomic.LoadInt64(&m.evaluated))
+	monitoring.ReportInt(V, "sampled", atomic.LoadInt64(&m.sampled))
+	monitoring.ReportInt(V, "primary_sampled", atomic.LoadInt64(&m.primarySampled))
+}
+
+// evaluateShadowPolicies admits the root transaction to the shadow policies'
+// reservoirs, if shadow policies are configured. Only trace IDs are kept in
+// the reservoirs; no events are stored on behalf of the shadow policies.
+func (p *Processor) evaluateShadowPolicies(event *model.APMEvent) {
+	if p.shadowGroups == nil {
+		return
+	}
+	atomic.AddInt64(&p.shadowMetrics.evaluated, 1)
+	// Errors are ignored: errTooManyTraceGroups means the shadow policies
+	// would have dropped the trace, which is reflected in the sampled count.
+	p.shadowGroups.sampleTrace(event)
+}
+
+// finalizeShadowDecisions finalizes the shadow policies' reservoirs, if shadow
+// policies are configured, counting the traces that the shadow policies would
+// have sampled alongside the number that the primary policies sampled.
+func (p *Processor) finalizeShadowDecisions(primarySampled int) {
+	if p.shadowGroups == nil {
+		return
+	}
+	shadowSampled := p.shadowGroups.finalizeSampledTraces(nil)
+	atomic.AddInt64(&p.shadowMetrics.sampled, int64(len(shadowSampled)))
+	atomic.AddInt64(&p.shadowMetrics.primarySampled, int64(primarySampled))
+}
@@ -0,0 +1,72 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"time"
+)
+
+// traceSpanCounts tracks the number of spans stored in local storage for
+// each trace awaiting a sampling decision, for matching root transactions
+// against policies with MinSpanCount criteria.
+//
+// traceSpanCounts is safe for concurrent use. A nil *traceSpanCounts
+// counts no spans.
+type traceSpanCounts struct {
+	mu     sync.Mutex
+	traces map[string]traceSpanCount
+
+	// now is used for obtaining the current time, and may be overridden
+	// in tests.
+	now func() time.Time
+}
+
+type traceSpanCount struct {
+	spans     int
+	firstSeen time.Time
+}
+
+func newTraceSpanCounts() *traceSpanCounts {
+	return &traceSpanCounts{
+		traces: make(map[string]traceSpanCount),
+		now:    time.Now,
+	}
+}
+
+// observe records that a span has been stored for traceID.
+func (t *traceSpanCounts) observe(traceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count, ok := t.traces[traceID]
+	if !ok {
+		count.firstSeen = t.now()
+	}
+	count.spans++
+	t.traces[traceID] = count
+}
+
+// count returns the number of spans stored for traceID.
+func (t *traceSpanCounts) count(traceID string) int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.traces[traceID].spans
+}
+
+// expire stops tracking traces whose first span was stored more than
+// maxAge ago, whose events have expired from local storage.
+func (t *traceSpanCounts) expire(maxAge time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := t.now().Add(-maxAge)
+	for traceID, count := range t.traces {
+		if count.firstSeen.Before(cutoff) {
+			delete(t.traces, traceID)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/y"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// storageErrorType identifies the type of a storage error, for reporting
+// storage errors by type.
+type storageErrorType int
+
+const (
+	// storageErrorConflict is a badger transaction conflict.
+	storageErrorConflict storageErrorType = iota
+
+	// storageErrorTooLarge is a badger transaction or value which is
+	// too large to be written.
+	storageErrorTooLarge
+
+	// storageErrorIO is a filesystem or I/O error.
+	storageErrorIO
+
+	// storageErrorCorruption is a badger checksum mismatch or truncated
+	// value log, indicating that storage is corrupt.
+	storageErrorCorruption
+
+	// storageErrorOther is any other error, e.g. failure to decode a
+	// stored event, or use of a closed database.
+	storageErrorOther
+
+	numStorageErrorTypes
+)
+
+var storageErrorTypeNames = [numStorageErrorTypes]string{
+	storageErrorConflict:   "conflict",
+	storageErrorTooLarge:   "too_large",
+	storageErrorIO:         "io",
+	storageErrorCorruption: "corruption",
+	storageErrorOther:      "other",
+}
+
+// classifyStorageError returns the type of the storage error err.
+func classifyStorageError(err error) storageErrorType {
+	var pathErr *fs.PathError
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, badger.ErrConflict):
+		return storageErrorConflict
+	case errors.Is(err, badger.ErrTxnTooBig):
+		return storageErrorTooLarge
+	case errors.Is(err, y.ErrChecksumMismatch), errors.Is(err, badger.ErrTruncateNeeded):
+		return storageErrorCorruption
+	case errors.As(err, &pathErr), errors.As(err, &errno), errors.Is(err, io.ErrUnexpectedEOF):
+		return storageErrorIO
+	}
+	return storageErrorOther
+}
+
+// storageErrors counts the errors returned by storage reads and writes,
+// by type. Trace IDs not found in storage, and writes rejected due to
+// StorageLimit being reached, are not considered errors; the latter are
+// counted separately.
+//
+// storageErrors is safe for concurrent use.
+type storageErrors struct {
+	// reads and writes are accessed atomically, and must be the first
+	// fields for 64-bit alignment.
+	reads  [numStorageErrorTypes]int64
+	writes [numStorageErrorTypes]int64
+
+	// corrupted is signalled, without blocking, when a corruption
+	// error is recorded.
+	corrupted chan struct{}
+}
+
+func newStorageErrors() *storageErrors {
+	return &storageErrors{corrupted: make(chan struct{}, 1)}
+}
+
+// read records the error returned by a storage read, if any, and returns it.
+func (s *storageErrors) read(err error) error {
+	if err != nil && err != eventstorage.ErrNotFound {
+		s.record(&s.reads, err)
+	}
+	return err
+}
+
+// write records the error returned by a storage write, if any, and returns it.
+func (s *storageErrors) write(err error) error {
+	if err != nil && !errors.Is(err, eventstorage.ErrLimitReached) {
+		s.record(&s.writes, err)
+	}
+	return err
+}
+
+func (s *storageErrors) record(counts *[numStorageErrorTypes]int64, err error) {
+	errorType := classifyStorageError(err)
+	atomic.AddInt64(&counts[errorType], 1)
+	if errorType == storageErrorCorruption {
+		select {
+		case s.corrupted <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// corruptions returns the total number of corruption errors recorded.
+func (s *storageErrors) corruptions() int64 {
+	return atomic.LoadInt64(&s.reads[storageErrorCorruption]) +
+		atomic.LoadInt64(&s.writes[storageErrorCorruption])
+}
+
+func (s *storageErrors) report(V monitoring.Visitor) {
+	reportCounts := func(counts *[numStorageErrorTypes]int64) {
+		var total int64
+		for i := range counts {
+			n := atomic.LoadInt64(&counts[i])
+			monitoring.ReportInt(V, storageErrorTypeNames[i], n)
+			total += n
+		}
+		monitoring.ReportInt(V, "total", total)
+	}
+	monitoring.ReportNamespace(V, "read", func() { reportCounts(&s.reads) })
+	monitoring.ReportNamespace(V, "write", func() { reportCounts(&s.writes) })
+}
@@ -0,0 +1,72 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/y"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+func TestStorageErrors(t *testing.T) {
+	s := newStorageErrors()
+	for _, err := range []error{
+		nil,
+		eventstorage.ErrNotFound,
+		badger.ErrConflict,
+		fmt.Errorf("flush pending writes: %w", badger.ErrConflict),
+		&os.PathError{Op: "read", Path: "000001.vlog", Err: syscall.EIO},
+		pkgerrors.New("failed to decode event"),
+		pkgerrors.Wrap(y.ErrChecksumMismatch, "value corrupted"),
+	} {
+		assert.Equal(t, err, s.read(err))
+	}
+	for _, err := range []error{
+		nil,
+		fmt.Errorf("flush pending writes: %w", eventstorage.ErrLimitReached),
+		pkgerrors.Wrap(badger.ErrTxnTooBig, "failed to write"),
+		syscall.ENOSPC,
+		badger.ErrDBClosed,
+	} {
+		assert.Equal(t, err, s.write(err))
+	}
+	assert.Equal(t, int64(1), s.corruptions())
+	select {
+	case <-s.corrupted:
+	default:
+		t.Fatal("expected corruption to be signalled")
+	}
+
+	registry := monitoring.NewRegistry()
+	monitoring.NewFunc(registry, "errors", func(_ monitoring.Mode, V monitoring.Visitor) {
+		V.OnRegistryStart()
+		defer V.OnRegistryFinished()
+		s.report(V)
+	})
+	snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, map[string]int64{
+		"errors.read.conflict":    2,
+		"errors.read.too_large":   0,
+		"errors.read.io":          1,
+		"errors.read.corruption":  1,
+		"errors.read.other":       1,
+		"errors.read.total":       5,
+		"errors.write.conflict":   0,
+		"errors.write.too_large":  1,
+		"errors.write.io":         1,
+		"errors.write.corruption": 0,
+		"errors.write.other":      1,
+		"errors.write.total":      3,
+	}, snapshot.Ints)
+}
@@ -0,0 +1,118 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/logp"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+)
+
+// storageWatchdog recreates storage once the number of storage corruption
+// errors reaches CorruptionThreshold. The events and sampling decisions in
+// the corrupt storage are discarded, preferring availability over retaining
+// buffered traces in storage which keeps failing.
+//
+// A nil *storageWatchdog is used when CorruptionThreshold is zero.
+type storageWatchdog struct {
+	// recreated and recreateFailures count the times storage has been
+	// recreated, and has failed to be recreated. They are accessed
+	// atomically, and must be first for 64-bit alignment.
+	recreated        int64
+	recreateFailures int64
+
+	threshold int64
+	recreate  func() (*badger.DB, *eventstorage.ShardedReadWriter, error)
+
+	// minRetryBackoff and maxRetryBackoff bound the time waited before
+	// retrying to recreate storage after a failure, doubling with each
+	// consecutive failure.
+	minRetryBackoff time.Duration
+	maxRetryBackoff time.Duration
+}
+
+func newStorageWatchdog(
+	threshold int,
+	recreate func() (*badger.DB, *eventstorage.ShardedReadWriter, error),
+) *storageWatchdog {
+	if threshold <= 0 {
+		return nil
+	}
+	return &storageWatchdog{
+		threshold:       int64(threshold),
+		recreate:        recreate,
+		minRetryBackoff: time.Second,
+		maxRetryBackoff: time.Minute,
+	}
+}
+
+// run recreates the storage of rw each time the number of corruption errors
+// recorded since storage was last recreated reaches the threshold, until ctx
+// is cancelled.
+func (w *storageWatchdog) run(ctx context.Context, rw *wrappedRW, logger *logp.Logger) error {
+	var baseline int64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rw.errors.corrupted:
+		}
+		corruptions := rw.errors.corruptions() - baseline
+		if corruptions < w.threshold {
+			continue
+		}
+		logger.Errorf(
+			"storage corruption errors (%d) reached threshold, recreating storage and discarding buffered trace events",
+			corruptions,
+		)
+		if err := w.recreateStorage(ctx, rw, logger); err != nil {
+			return err
+		}
+		// Corruption errors recorded while recreating storage relate
+		// to the discarded storage, so they are excluded too.
+		baseline = rw.errors.corruptions()
+		atomic.AddInt64(&w.recreated, 1)
+		logger.Info("recreated storage")
+	}
+}
+
+// recreateStorage recreates the storage of rw, retrying with exponential
+// backoff while it fails, until ctx is cancelled. Storage is unavailable
+// until it has been recreated, so no further corruption errors would be
+// recorded to prompt a retry.
+func (w *storageWatchdog) recreateStorage(ctx context.Context, rw *wrappedRW, logger *logp.Logger) error {
+	backoff := w.minRetryBackoff
+	for {
+		err := rw.recreate(w.recreate)
+		if err == nil {
+			return nil
+		}
+		atomic.AddInt64(&w.recreateFailures, 1)
+		logger.With(logp.Error(err)).Errorf(
+			"failed to recreate corrupt storage, storage is unavailable; retrying in %s", backoff,
+		)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > w.maxRetryBackoff {
+			backoff = w.maxRetryBackoff
+		}
+	}
+}
+
+func (w *storageWatchdog) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "recreated", atomic.LoadInt64(&w.recreated))
+	monitoring.ReportInt(V, "recreate_failures", atomic.LoadInt64(&w.recreateFailures))
+}
@@ -0,0 +1,150 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+func TestStorageWatchdog(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*badger.DB, *eventstorage.ShardedReadWriter) {
+		db, err := eventstorage.OpenBadger(dir, 0)
+		require.NoError(t, err)
+		return db, eventstorage.New(db, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	}
+	db, storage := open()
+	rw := newWrappedRW(db, storage, time.Minute, nil, 0)
+	t.Cleanup(func() {
+		rw.rw.Close()
+		rw.db.Close()
+	})
+
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "transaction_id"}}
+	require.NoError(t, rw.WriteTraceEvent("trace_id", "transaction_id", &event))
+	require.NoError(t, rw.Flush())
+
+	w := newStorageWatchdog(2, func() (*badger.DB, *eventstorage.ShardedReadWriter, error) {
+		rw.rw.Close()
+		if err := rw.db.Close(); err != nil {
+			return nil, nil, err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, nil, err
+		}
+		db, storage := open()
+		return db, storage, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx, rw, logp.NewLogger(""))
+
+	// Storage is recreated once the threshold is reached.
+	rw.errors.read(y.ErrChecksumMismatch)
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt64(&w.recreated))
+	rw.errors.write(badger.ErrTruncateNeeded)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&w.recreated) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// The stored events are discarded, and the new storage is usable.
+	var batch model.Batch
+	require.NoError(t, rw.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, batch)
+	require.NoError(t, rw.WriteTraceEvent("trace_id", "transaction_id", &event))
+	require.NoError(t, rw.Flush())
+	require.NoError(t, rw.ReadTraceEvents("trace_id", &batch))
+	assert.Len(t, batch, 1)
+
+	// The count of corruption errors is reset after recreating storage.
+	rw.errors.read(y.ErrChecksumMismatch)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&w.recreated))
+}
+
+func TestStorageWatchdogRecreateFailed(t *testing.T) {
+	dir := t.TempDir()
+	db, err := eventstorage.OpenBadger(dir, 0)
+	require.NoError(t, err)
+	storage := eventstorage.New(db, eventstorage.JSONCodec{}).NewShardedReadWriter()
+	rw := newWrappedRW(db, storage, time.Minute, nil, 0)
+	t.Cleanup(func() {
+		rw.mu.Lock()
+		defer rw.mu.Unlock()
+		if rw.db != nil {
+			rw.rw.Close()
+			rw.db.Close()
+		}
+	})
+
+	var fail int32 = 1
+	w := newStorageWatchdog(1, func() (*badger.DB, *eventstorage.ShardedReadWriter, error) {
+		if storage != nil {
+			storage.Close()
+			db.Close()
+			storage, db = nil, nil
+		}
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, nil, errors.New("boom")
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, nil, err
+		}
+		db, err := eventstorage.OpenBadger(dir, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, eventstorage.New(db, eventstorage.JSONCodec{}).NewShardedReadWriter(), nil
+	})
+	w.minRetryBackoff = 10 * time.Millisecond
+	w.maxRetryBackoff = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- w.run(ctx, rw, logp.NewLogger("")) }()
+
+	// Failures are counted and retried, without the watchdog returning.
+	rw.errors.read(y.ErrChecksumMismatch)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&w.recreateFailures) >= 2
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Zero(t, atomic.LoadInt64(&w.recreated))
+
+	// Storage is unavailable, rather than using the closed storage.
+	var batch model.Batch
+	assert.Equal(t, errStorageUnavailable, rw.ReadTraceEvents("trace_id", &batch))
+	assert.Equal(t, errStorageUnavailable, rw.WriteTraceSampled("trace_id", true))
+	lsm, vlog := rw.Size()
+	assert.Zero(t, lsm+vlog)
+
+	// Once a retry succeeds, storage is available again.
+	atomic.StoreInt32(&fail, 0)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&w.recreated) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, rw.WriteTraceSampled("trace_id", true))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestStorageWatchdogDisabled(t *testing.T) {
+	assert.Nil(t, newStorageWatchdog(0, nil))
+}
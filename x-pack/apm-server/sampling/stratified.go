@@ -0,0 +1,169 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"container/heap"
+	"math"
+	"math/bits"
+	"math/rand"
+
+	"github.com/elastic/apm-server/internal/model"
+)
+
+// stratumKey identifies the stratum of a root transaction, for reservoirs
+// which prefer keeping root transactions that differ from one another.
+type stratumKey struct {
+	transactionName string
+	outcome         string
+
+	// durationBucket holds the number of bits required to represent the
+	// root transaction's duration in milliseconds, grouping durations
+	// into exponentially sized buckets.
+	durationBucket int
+}
+
+// makeStratumKey returns the stratumKey for a root transaction, with the
+// given (normalized) transaction name.
+func makeStratumKey(transactionName string, event *model.APMEvent) stratumKey {
+	ms := event.Event.Duration.Milliseconds()
+	if ms < 0 {
+		ms = 0
+	}
+	return stratumKey{
+		transactionName: transactionName,
+		outcome:         event.Event.Outcome,
+		durationBucket:  bits.Len64(uint64(ms)),
+	}
+}
+
+// stratifiedSample provides a weighted, random, reservoir sampling which
+// prefers diverse samples. Items are partitioned into strata, each holding
+// a weighted random sample as in weightedRandomSample.
+//
+// While the reservoir has capacity, all items are admitted. Once it is full,
+// an item is admitted either by evicting the lowest weighted item of the
+// largest stratum, if that leaves the strata more evenly sized, or otherwise
+// by displacing a lower weighted item of its own stratum. This spreads the
+// reservoir's capacity across as many strata as possible.
+type stratifiedSample struct {
+	rng    *rand.Rand
+	size   int
+	len    int
+	strata map[stratumKey]*itemheap
+}
+
+// newStratifiedSample constructs a new stratified sampler, with the given
+// random number generator and reservoir size.
+func newStratifiedSample(rng *rand.Rand, reservoirSize int) *stratifiedSample {
+	return &stratifiedSample{
+		rng:    rng,
+		size:   reservoirSize,
+		strata: make(map[stratumKey]*itemheap),
+	}
+}
+
+// Sample records a trace ID in the given stratum with a random probability,
+// proportional to the given weight in the range [0, math.MaxFloat64].
+func (s *stratifiedSample) Sample(weight float64, stratum stratumKey, traceID string) bool {
+	k := math.Pow(s.rng.Float64(), 1/weight)
+	h := s.strata[stratum]
+	if s.len < s.size {
+		s.push(stratum, h, item{key: k, value: traceID})
+		return true
+	}
+	var n int
+	if h != nil {
+		n = h.Len()
+	}
+	if largestKey, largest := s.largest(); largest != nil && n+1 < largest.Len() {
+		s.popFrom(largestKey, largest)
+		s.push(stratum, h, item{key: k, value: traceID})
+		return true
+	}
+	if h != nil && k > h.keys[0] {
+		h.keys[0] = k
+		h.values[0] = traceID
+		heap.Fix(h, 0)
+		return true
+	}
+	return false
+}
+
+// Reset clears the current values.
+func (s *stratifiedSample) Reset() {
+	for k := range s.strata {
+		delete(s.strata, k)
+	}
+	s.len = 0
+}
+
+// Size returns the reservoir capacity.
+func (s *stratifiedSample) Size() int {
+	return s.size
+}
+
+// Len returns the number of trace IDs currently in the reservoir.
+func (s *stratifiedSample) Len() int {
+	return s.len
+}
+
+// Resize resizes the reservoir capacity to n, removing trace IDs as
+// described for Pop if the reservoir holds more than n.
+func (s *stratifiedSample) Resize(n int) {
+	for s.len > n {
+		s.Pop()
+	}
+	s.size = n
+}
+
+// Pop removes the trace ID with the lowest weight from the largest
+// stratum. Pop panics when called on an empty reservoir.
+func (s *stratifiedSample) Pop() string {
+	key, h := s.largest()
+	return s.popFrom(key, h)
+}
+
+// Values returns a copy of the currently sampled trace IDs.
+func (s *stratifiedSample) Values() []string {
+	values := make([]string, 0, s.len)
+	for _, h := range s.strata {
+		values = append(values, h.values...)
+	}
+	return values
+}
+
+// largest returns the stratum holding the most items, or nil if there are
+// none. Ties are broken by preferring the stratum with the lowest weighted
+// item, which is the item that would be evicted.
+func (s *stratifiedSample) largest() (stratumKey, *itemheap) {
+	var largestKey stratumKey
+	var largest *itemheap
+	for k, h := range s.strata {
+		if largest == nil || h.Len() > largest.Len() ||
+			(h.Len() == largest.Len() && h.keys[0] < largest.keys[0]) {
+			largestKey, largest = k, h
+		}
+	}
+	return largestKey, largest
+}
+
+func (s *stratifiedSample) push(stratum stratumKey, h *itemheap, item item) {
+	if h == nil {
+		h = &itemheap{}
+		s.strata[stratum] = h
+	}
+	heap.Push(h, item)
+	s.len++
+}
+
+func (s *stratifiedSample) popFrom(stratum stratumKey, h *itemheap) string {
+	item := heap.Pop(h).(item)
+	if h.Len() == 0 {
+		delete(s.strata, stratum)
+	}
+	s.len--
+	return item.value
+}
@@ -0,0 +1,67 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"errors"
+	"strings"
+)
+
+var errEmptyTraceID = errors.New("empty trace ID")
+
+// traceIDList holds a list of exact trace IDs and trace ID prefixes.
+type traceIDList struct {
+	exact    map[string]struct{}
+	prefixes []string
+}
+
+// newTraceIDList returns a new traceIDList for the given trace IDs. Trace IDs
+// ending with "*" are treated as prefixes. Trace IDs are matched without regard
+// to case.
+func newTraceIDList(traceIDs []string) traceIDList {
+	var l traceIDList
+	for _, traceID := range traceIDs {
+		traceID = strings.ToLower(traceID)
+		if prefix := strings.TrimSuffix(traceID, "*"); prefix != traceID {
+			l.prefixes = append(l.prefixes, prefix)
+			continue
+		}
+		if l.exact == nil {
+			l.exact = make(map[string]struct{})
+		}
+		l.exact[traceID] = struct{}{}
+	}
+	return l
+}
+
+func (l *traceIDList) empty() bool {
+	return len(l.exact) == 0 && len(l.prefixes) == 0
+}
+
+// match reports whether traceID is in the list.
+func (l *traceIDList) match(traceID string) bool {
+	if l.empty() {
+		return false
+	}
+	traceID = strings.ToLower(traceID)
+	if _, ok := l.exact[traceID]; ok {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(traceID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateTraceIDList(traceIDs []string) error {
+	for _, traceID := range traceIDs {
+		if strings.TrimSuffix(traceID, "*") == "" {
+			return errEmptyTraceID
+		}
+	}
+	return nil
+}
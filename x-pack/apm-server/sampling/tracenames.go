@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// TraceNameNormalizer holds a rule for normalizing root transaction names
+// before they are matched against policies' TraceName criteria, e.g. for
+// replacing high-cardinality path segments such as IDs with a placeholder.
+type TraceNameNormalizer struct {
+	// Pattern holds a regular expression, in the syntax accepted by the
+	// regexp package, matched against transaction names.
+	Pattern string
+
+	// Replacement holds the template with which matches of Pattern are
+	// replaced. Replacement may refer to submatches of Pattern, e.g. "$1",
+	// as described by regexp.Regexp.Expand.
+	Replacement string
+}
+
+func (n TraceNameNormalizer) validate() error {
+	if n.Pattern == "" {
+		return errors.New("Pattern unspecified")
+	}
+	if _, err := regexp.Compile(n.Pattern); err != nil {
+		return errors.Wrap(err, "Pattern invalid")
+	}
+	return nil
+}
+
+// traceNameNormalizers holds compiled TraceNameNormalizers, which are
+// applied in order.
+type traceNameNormalizers []compiledTraceNameNormalizer
+
+type compiledTraceNameNormalizer struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newTraceNameNormalizers compiles normalizers, which must have been
+// validated.
+func newTraceNameNormalizers(normalizers []TraceNameNormalizer) traceNameNormalizers {
+	if len(normalizers) == 0 {
+		return nil
+	}
+	compiled := make(traceNameNormalizers, len(normalizers))
+	for i, n := range normalizers {
+		compiled[i] = compiledTraceNameNormalizer{
+			pattern:     regexp.MustCompile(n.Pattern),
+			replacement: n.Replacement,
+		}
+	}
+	return compiled
+}
+
+// normalize returns name with each normalizer applied in turn.
+func (n traceNameNormalizers) normalize(name string) string {
+	for _, normalizer := range n {
+		name = normalizer.pattern.ReplaceAllString(name, normalizer.replacement)
+	}
+	return name
+}
+
+func validateTraceNameNormalizers(normalizers []TraceNameNormalizer) error {
+	for i, n := range normalizers {
+		if err := n.validate(); err != nil {
+			return errors.Wrapf(err, "TraceNameNormalizers %d invalid", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/internal/beater"
+	"github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/internal/model"
+	"github.com/elastic/apm-server/internal/model/modelprocessor"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/pubsub/pubsubtest"
+)
+
+// defaultSelfTestTracesPerPolicy is the default number of synthetic traces
+// generated for each tail-sampling policy by "test tail-sampling".
+const defaultSelfTestTracesPerPolicy = 10
+
+// selfTestInterval is the tail-sampling interval used by "test tail-sampling".
+const selfTestInterval = 100 * time.Millisecond
+
+// newTestTailSamplingCommand returns the "test tail-sampling" command, which
+// validates the tail-sampling config end-to-end.
+func newTestTailSamplingCommand(settings instance.Settings) *cobra.Command {
+	tracesPerPolicy := defaultSelfTestTracesPerPolicy
+	short := "Test tail-sampling configuration"
+	cmd := &cobra.Command{
+		Use:   "tail-sampling",
+		Short: short,
+		Long: short + `.
+The tail-sampling config is loaded and used to run the tail-sampling processor
+against in-memory storage, without connecting to Elasticsearch or indexing any
+events. Synthetic traces are generated from the criteria of each policy, and
+the number of traces matched, kept, and dropped by each policy is reported.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := loadTailSamplingConfig(settings)
+			if err == nil {
+				err = runTailSamplingSelfTest(cfg, tracesPerPolicy, os.Stdout)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error testing tail-sampling config: %s\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().IntVar(&tracesPerPolicy, "traces", defaultSelfTestTracesPerPolicy,
+		"number of synthetic traces to generate for each policy")
+	return cmd
+}
+
+// loadTailSamplingConfig loads the APM Server config, returning an error if
+// tail-sampling is not enabled, or if its config is invalid.
+func loadTailSamplingConfig(settings instance.Settings) (*config.Config, error) {
+	b, err := instance.NewInitializedBeat(settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "error initializing beat")
+	}
+	rawConfig, err := b.BeatConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.NewConfig(rawConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Sampling.Tail.UnpackError(); err != nil {
+		return nil, err
+	}
+	if !cfg.Sampling.Tail.Enabled {
+		return nil, errors.New("tail-sampling is not enabled")
+	}
+	return cfg, nil
+}
+
+// runTailSamplingSelfTest runs the tail-sampling processor for cfg against
+// in-memory storage, feeding it tracesPerPolicy synthetic traces for each
+// policy, and writes a report of the sampling decisions to w.
+func runTailSamplingSelfTest(cfg *config.Config, tracesPerPolicy int, w io.Writer) error {
+	db, err := eventstorage.OpenBadgerInMemory()
+	if err != nil {
+		return errors.Wrap(err, "failed to open in-memory storage")
+	}
+	defer db.Close()
+	codec, err := eventstorage.NewCompressedCodec(eventstorage.JSONCodec{}, cfg.Sampling.Tail.StorageCompression)
+	if err != nil {
+		return err
+	}
+	storage := eventstorage.New(db, codec).NewShardedReadWriter()
+	defer storage.Close()
+
+	// The processor persists its subscriber position in the storage
+	// directory, so use a temporary one.
+	storageDir, err := os.MkdirTemp("", "apm-server-tail-sampling")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(storageDir)
+
+	// Sampling decisions are finalized when the processor is stopped, so
+	// the interval does not affect them. Use a short one to avoid waiting
+	// for the interval-based flushing of sampled trace IDs when stopping.
+	selfTestConfig := *cfg
+	selfTestConfig.Sampling.Tail.Interval = selfTestInterval
+	args := beater.ServerParams{
+		UUID:           uuid.Must(uuid.NewV4()),
+		Config:         &selfTestConfig,
+		Namespace:      "default",
+		BatchProcessor: modelprocessor.Nop{},
+	}
+	processor, err := sampling.NewProcessor(newTailSamplingConfig(
+		args, pubsubtest.Client(nil, nil), db, storage, storageDir,
+	))
+	if err != nil {
+		return err
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- processor.Run() }()
+
+	policies := newSamplingPolicies(cfg.Sampling.Tail.Policies)
+	var batch model.Batch
+	for _, policy := range policies {
+		for i := 0; i < tracesPerPolicy; i++ {
+			batch = appendSelfTestTrace(batch, policy.PolicyCriteria)
+		}
+	}
+	if err := processor.ProcessBatch(context.Background(), &batch); err != nil {
+		return err
+	}
+
+	// Stopping the processor finalizes the sampling decisions.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := processor.Stop(ctx); err != nil {
+		return errors.Wrap(err, "failed to stop processor")
+	}
+	if err := <-runErr; err != nil {
+		return errors.Wrap(err, "processor failed")
+	}
+
+	registry := monitoring.NewRegistry()
+	monitoring.NewFunc(registry, "sampling", processor.CollectMonitoring)
+	metrics := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+
+	fmt.Fprintf(w, "Processed %d synthetic traces.\n\n", len(policies)*tracesPerPolicy)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "POLICY\tMATCHED\tKEPT\tDROPPED")
+	for i, policy := range policies {
+		name := policy.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		prefix := "sampling.policies." + name + "."
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", name,
+			metrics.Ints[prefix+"matched"],
+			metrics.Ints[prefix+"kept"],
+			metrics.Ints[prefix+"dropped"],
+		)
+	}
+	return tw.Flush()
+}
+
+// appendSelfTestTrace appends the events of a synthetic trace, made up of a
+// root transaction matching criteria and a span, to batch.
+func appendSelfTestTrace(batch model.Batch, criteria sampling.PolicyCriteria) model.Batch {
+	var traceID [16]byte
+	if _, err := rand.Read(traceID[:]); err != nil {
+		panic(err)
+	}
+	trace := model.Trace{ID: hex.EncodeToString(traceID[:])}
+	transactionID := hex.EncodeToString(traceID[:8])
+	service := model.Service{
+		Name:        criteria.ServiceName,
+		Environment: criteria.ServiceEnvironment,
+	}
+	if service.Name == "" {
+		service.Name = "self-test"
+	}
+	outcome := criteria.TraceOutcome
+	if outcome == "" {
+		outcome = "success"
+	}
+	name := criteria.TraceName
+	if name == "" {
+		name = "self-test"
+	}
+	var http model.HTTP
+	if criteria.MinHTTPStatusCode > 0 || criteria.MaxHTTPStatusCode > 0 {
+		statusCode := criteria.MinHTTPStatusCode
+		if statusCode == 0 {
+			statusCode = criteria.MaxHTTPStatusCode
+		}
+		http.Response = &model.HTTPResponse{StatusCode: statusCode}
+	}
+	return append(batch, model.APMEvent{
+		Processor: model.TransactionProcessor,
+		Service:   service,
+		Trace:     trace,
+		Event:     model.Event{Outcome: outcome},
+		HTTP:      http,
+		Transaction: &model.Transaction{
+			ID:                  transactionID,
+			Name:                name,
+			Sampled:             true,
+			RepresentativeCount: 1,
+		},
+	}, model.APMEvent{
+		Processor: model.SpanProcessor,
+		Service:   service,
+		Trace:     trace,
+		Parent:    model.Parent{ID: transactionID},
+		Event:     model.Event{Outcome: outcome},
+		Span: &model.Span{
+			ID:                  hex.EncodeToString(traceID[8:]),
+			RepresentativeCount: 1,
+		},
+	})
+}
@@ -0,0 +1,37 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/internal/beater/config"
+)
+
+func TestRunTailSamplingSelfTest(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Sampling.Tail.Enabled = true
+	var failures config.TailSamplingPolicy
+	failures.Name = "failures"
+	failures.Trace.Outcome = "failure"
+	failures.SampleRate = 1
+	cfg.Sampling.Tail.Policies = []config.TailSamplingPolicy{failures, {SampleRate: 0}}
+
+	var out bytes.Buffer
+	err := runTailSamplingSelfTest(cfg, 5, &out)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, "Processed 10 synthetic traces.", lines[0])
+	assert.Equal(t, []string{"POLICY", "MATCHED", "KEPT", "DROPPED"}, strings.Fields(lines[2]))
+	assert.Equal(t, []string{"failures", "5", "5", "0"}, strings.Fields(lines[3]))
+	assert.Equal(t, []string{"1", "5", "0", "5"}, strings.Fields(lines[4]))
+}
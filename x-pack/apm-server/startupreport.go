@@ -0,0 +1,138 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+	"github.com/elastic/elastic-agent-libs/paths"
+
+	"github.com/elastic/apm-server/internal/beater"
+	"github.com/elastic/apm-server/x-pack/apm-server/aggregation/spanmetrics"
+	"github.com/elastic/apm-server/x-pack/apm-server/aggregation/txmetrics"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+// startupReport summarises which of the server's optional subsystems are
+// active, built from the resolved config and the constructed processors.
+//
+// The report is logged when the server is wrapped with its processors, and
+// reported in the "state" monitoring namespace, which is served by the HTTP
+// monitoring endpoint if it is enabled. It answers questions such as whether
+// tail-sampling is actually enabled, without needing the full config.
+type startupReport struct {
+	// Processors holds the names of the processors, in processing order.
+	Processors []string `json:"processors"`
+
+	Aggregation  startupAggregationReport  `json:"aggregation"`
+	TailSampling startupTailSamplingReport `json:"tail_sampling"`
+}
+
+type startupAggregationReport struct {
+	Transactions        bool `json:"transactions"`
+	ServiceDestinations bool `json:"service_destinations"`
+}
+
+// startupTailSamplingReport describes tail-sampling. Only Enabled is set if
+// tail-sampling is disabled.
+type startupTailSamplingReport struct {
+	Enabled  bool `json:"enabled"`
+	Policies int  `json:"policies,omitempty"`
+
+	// StorageBackend, StoragePath, and StorageCodec describe the local
+	// storage of events awaiting a sampling decision.
+	StorageBackend string `json:"storage_backend,omitempty"`
+	StoragePath    string `json:"storage_path,omitempty"`
+	StorageCodec   string `json:"storage_codec,omitempty"`
+
+	// SampledTracesDataStream and SampledTracesHosts identify where sampled
+	// trace IDs are published to and searched for by remote sampling. Any
+	// credentials are removed from the hosts.
+	SampledTracesDataStream string   `json:"sampled_traces_data_stream,omitempty"`
+	SampledTracesHosts      []string `json:"sampled_traces_hosts,omitempty"`
+}
+
+// newStartupReport returns a startupReport for the server with the given
+// args, wrapped with processors.
+func newStartupReport(args beater.ServerParams, processors []namedProcessor) startupReport {
+	var report startupReport
+	for _, p := range processors {
+		report.Processors = append(report.Processors, p.name)
+		switch p.processor.(type) {
+		case *txmetrics.Aggregator:
+			report.Aggregation.Transactions = true
+		case *spanmetrics.Aggregator:
+			report.Aggregation.ServiceDestinations = true
+		case *sampling.Processor:
+			report.TailSampling.Enabled = true
+		}
+	}
+	if !report.TailSampling.Enabled {
+		return report
+	}
+	tailSamplingConfig := args.Config.Sampling.Tail
+	report.TailSampling.Policies = len(tailSamplingConfig.Policies)
+	report.TailSampling.StorageBackend = "badger"
+	report.TailSampling.StoragePath = paths.Resolve(paths.Data, tailSamplingStorageDir)
+	report.TailSampling.StorageCodec = "json"
+	if tailSamplingConfig.StorageCompression != eventstorage.CompressionNone {
+		report.TailSampling.StorageCodec += "+" + tailSamplingConfig.StorageCompression
+	}
+	dataStream := newSampledTracesDataStream(args.Namespace, tailSamplingConfig.SampledTraces)
+	report.TailSampling.SampledTracesDataStream = fmt.Sprintf(
+		"%s-%s-%s", dataStream.Type, dataStream.Dataset, dataStream.Namespace,
+	)
+	if tailSamplingConfig.ESConfig != nil {
+		for _, host := range tailSamplingConfig.ESConfig.Hosts {
+			report.TailSampling.SampledTracesHosts = append(
+				report.TailSampling.SampledTracesHosts, redactHost(host),
+			)
+		}
+	}
+	return report
+}
+
+// collectMonitoring reports the startup report, for registering with
+// registerMonitoringFunc.
+func (r startupReport) collectMonitoring(_ monitoring.Mode, V monitoring.Visitor) {
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+
+	// monitoring.ReportBool reports the key rather than the value.
+	reportBool := func(name string, value bool) {
+		V.OnKey(name)
+		V.OnBool(value)
+	}
+	monitoring.ReportStringSlice(V, "processors", r.Processors)
+	monitoring.ReportNamespace(V, "aggregation", func() {
+		reportBool("transactions", r.Aggregation.Transactions)
+		reportBool("service_destinations", r.Aggregation.ServiceDestinations)
+	})
+	monitoring.ReportNamespace(V, "tail_sampling", func() {
+		reportBool("enabled", r.TailSampling.Enabled)
+		if !r.TailSampling.Enabled {
+			return
+		}
+		monitoring.ReportInt(V, "policies", int64(r.TailSampling.Policies))
+		monitoring.ReportString(V, "storage_backend", r.TailSampling.StorageBackend)
+		monitoring.ReportString(V, "storage_path", r.TailSampling.StoragePath)
+		monitoring.ReportString(V, "storage_codec", r.TailSampling.StorageCodec)
+		monitoring.ReportString(V, "sampled_traces_data_stream", r.TailSampling.SampledTracesDataStream)
+		monitoring.ReportStringSlice(V, "sampled_traces_hosts", r.TailSampling.SampledTracesHosts)
+	})
+}
+
+// redactHost returns host with any user credentials removed.
+func redactHost(host string) string {
+	u, err := url.Parse(host)
+	if err != nil || u.User == nil {
+		return host
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,105 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/elastic-agent-libs/paths"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+// newTailSamplingStorageCommand returns the "tail-sampling-storage" command,
+// with subcommands for exporting and importing snapshots of the tail-sampling
+// storage, e.g. for migrating buffered traces to a replacement server.
+func newTailSamplingStorageCommand(settings instance.Settings) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tail-sampling-storage",
+		Short: "Manage tail-sampling storage",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "export FILE",
+		Short: "Export a snapshot of tail-sampling storage",
+		Long: `Export a snapshot of tail-sampling storage.
+The buffered trace events and sampling decisions in tail-sampling storage are
+written to FILE, which must not already exist, along with a checksum for
+verifying the snapshot's integrity when it is imported. The server must not
+be running while its storage is exported.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := withTailSamplingStorage(settings, func(db *badger.DB) error {
+				return exportTailSamplingStorage(db, args[0], os.Stdout)
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error exporting tail-sampling storage: %s\n", err)
+				os.Exit(1)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "import FILE",
+		Short: "Import a snapshot of tail-sampling storage",
+		Long: `Import a snapshot of tail-sampling storage.
+The snapshot in FILE, exported with "tail-sampling-storage export", is verified
+and then loaded into tail-sampling storage, so that its traces are sampled once
+the server is started. Nothing is imported if the snapshot fails verification.
+The server must not be running while a snapshot is imported.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := withTailSamplingStorage(settings, func(db *badger.DB) error {
+				return importTailSamplingStorage(db, args[0], os.Stdout)
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error importing tail-sampling storage: %s\n", err)
+				os.Exit(1)
+			}
+		},
+	})
+	return cmd
+}
+
+// withTailSamplingStorage loads the APM Server config, and calls f with the
+// tail-sampling storage opened with the configured options.
+func withTailSamplingStorage(settings instance.Settings, f func(*badger.DB) error) error {
+	cfg, err := loadTailSamplingConfig(settings)
+	if err != nil {
+		return err
+	}
+	storageDir := paths.Resolve(paths.Data, tailSamplingStorageDir)
+	db, err := eventstorage.OpenBadger(storageDir, cfg.Sampling.Tail.StorageValueLogFileSizeParsed)
+	if err != nil {
+		return errors.Wrap(err, "failed to open storage, check that the server is not running")
+	}
+	if err := f(db); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+func exportTailSamplingStorage(db *badger.DB, path string, w io.Writer) error {
+	size, err := eventstorage.ExportSnapshot(db, path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Exported tail-sampling storage to %s (%d bytes).\n", path, size)
+	return nil
+}
+
+func importTailSamplingStorage(db *badger.DB, path string, w io.Writer) error {
+	if err := eventstorage.ImportSnapshot(db, path); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Imported tail-sampling storage from %s.\n", path)
+	return nil
+}